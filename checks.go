@@ -0,0 +1,195 @@
+package mailroom
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/Masterminds/semver"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the columns we read and write which were most recently added to the RapidPro schema, if these are missing then the
+// database hasn't been migrated to a version of RapidPro that this mailroom supports
+var requiredColumns = map[string][]string{
+	"contacts_contact":  {"status", "last_seen_on"},
+	"flows_flowrun":     {"status", "parent_uuid", "current_node_uuid"},
+	"flows_flowsession": {"status", "wait_started_on", "output_url"},
+	"msgs_msg":          {"uuid", "metadata", "next_attempt"},
+	"tickets_ticket":    {"assignee_id", "last_activity_on"},
+}
+
+// the indexes our most frequent queries depend on, without which they'll still work but won't perform
+var requiredIndexes = []string{
+	"contacts_contacturn_path",
+	"flows_flowrun_expires_on",
+	"flows_flowsession_timeout",
+	"flows_flowsession_waiting",
+	"msgs_next_attempt_out_errored",
+	"tickets_contact_open",
+}
+
+// StartupCheck is a check of one of the services we depend on
+type StartupCheck struct {
+	Name  string
+	Check func(context.Context, *runtime.Runtime) error
+}
+
+var startupChecks = []*StartupCheck{
+	{"db", checkDB},
+	{"schema", checkSchema},
+	{"flow_spec", checkFlowSpecVersions},
+	{"redis", checkRedis},
+	{"elastic", checkElastic},
+	{"media_storage", checkMediaStorage},
+	{"session_storage", checkSessionStorage},
+}
+
+// RunStartupChecks runs all our startup checks, returning the names of those which failed
+func RunStartupChecks(ctx context.Context, rt *runtime.Runtime) []string {
+	failed := make([]string, 0)
+
+	for _, c := range startupChecks {
+		ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+		err := c.Check(ctx, rt)
+		cancel()
+
+		log := logrus.WithField("check", c.Name)
+		if err != nil {
+			log.WithError(err).Error("startup check failed")
+			failed = append(failed, c.Name)
+		} else {
+			log.Info("startup check ok")
+		}
+	}
+	return failed
+}
+
+func checkDB(ctx context.Context, rt *runtime.Runtime) error {
+	return rt.DB.PingContext(ctx)
+}
+
+const selectColumnsSQL = `
+SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ANY($1)
+`
+
+const selectIndexesSQL = `
+SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND indexname = ANY($1)
+`
+
+func checkSchema(ctx context.Context, rt *runtime.Runtime) error {
+	tables := make([]string, 0, len(requiredColumns))
+	for t := range requiredColumns {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+
+	rows, err := rt.DB.QueryxContext(ctx, selectColumnsSQL, pq.Array(tables))
+	if err != nil {
+		return errors.Wrapf(err, "error querying columns")
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return errors.Wrapf(err, "error scanning column")
+		}
+		existing[table+"."+column] = true
+	}
+
+	missing := make([]string, 0)
+	for _, t := range tables {
+		for _, c := range requiredColumns[t] {
+			if !existing[t+"."+c] {
+				missing = append(missing, t+"."+c)
+			}
+		}
+	}
+
+	indexes := make([]string, 0, len(requiredIndexes))
+	if err := rt.DB.SelectContext(ctx, &indexes, selectIndexesSQL, pq.Array(requiredIndexes)); err != nil {
+		return errors.Wrapf(err, "error querying indexes")
+	}
+
+	existingIndexes := make(map[string]bool, len(indexes))
+	for _, i := range indexes {
+		existingIndexes[i] = true
+	}
+	for _, i := range requiredIndexes {
+		if !existingIndexes[i] {
+			missing = append(missing, "index "+i)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.Errorf("database schema is missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+const selectFlowSpecVersionsSQL = `
+SELECT DISTINCT version_number FROM flows_flow WHERE is_active = TRUE
+`
+
+func checkFlowSpecVersions(ctx context.Context, rt *runtime.Runtime) error {
+	versions := make([]string, 0)
+	if err := rt.DB.SelectContext(ctx, &versions, selectFlowSpecVersionsSQL); err != nil {
+		return errors.Wrapf(err, "error querying flow versions")
+	}
+
+	// flows with older versions are migrated as they're loaded but we can't read flows with newer versions
+	newer := make([]string, 0)
+	for _, v := range versions {
+		version, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		if version.GreaterThan(goflow.SpecVersion()) {
+			newer = append(newer, v)
+		}
+	}
+
+	if len(newer) > 0 {
+		return errors.Errorf("flows have spec versions %s which are newer than supported version %s", strings.Join(newer, ", "), goflow.SpecVersion())
+	}
+	return nil
+}
+
+func checkRedis(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("PING")
+	return err
+}
+
+func checkElastic(ctx context.Context, rt *runtime.Runtime) error {
+	if rt.ES == nil {
+		return errors.New("no elastic client, check configuration")
+	}
+	_, _, err := rt.ES.Ping(rt.Config.Elastic).Do(ctx)
+	return err
+}
+
+func checkMediaStorage(ctx context.Context, rt *runtime.Runtime) error {
+	if err := rt.MediaStorage.Test(ctx); err != nil {
+		return err
+	}
+
+	// media storage is written to by every outgoing attachment so make sure we can actually write to it
+	_, err := rt.MediaStorage.Put(ctx, path.Join(rt.Config.S3MediaPrefix, "startup_check.txt"), "text/plain", []byte("ok"))
+	return errors.Wrapf(err, "error writing to %s media storage", rt.MediaStorage.Name())
+}
+
+func checkSessionStorage(ctx context.Context, rt *runtime.Runtime) error {
+	return rt.SessionStorage.Test(ctx)
+}
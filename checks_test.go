@@ -0,0 +1,39 @@
+package mailroom
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartupChecks(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	rt := testsuite.RT()
+
+	// our test runtime has no elastic client
+	assert.Equal(t, []string{"elastic"}, RunStartupChecks(ctx, rt))
+
+	err := checkSchema(ctx, rt)
+	assert.NoError(t, err)
+
+	db.MustExec(`DROP INDEX flows_flowsession_timeout`)
+	db.MustExec(`ALTER TABLE tickets_ticket DROP COLUMN last_activity_on`)
+
+	err = checkSchema(ctx, rt)
+	assert.EqualError(t, err, "database schema is missing: tickets_ticket.last_activity_on, index flows_flowsession_timeout")
+
+	err = checkFlowSpecVersions(ctx, rt)
+	assert.NoError(t, err)
+
+	db.MustExec(`UPDATE flows_flow SET version_number = '99.0.0' WHERE id = $1`, testdata.Favorites.ID)
+
+	err = checkFlowSpecVersions(ctx, rt)
+	assert.EqualError(t, err, "flows have spec versions 99.0.0 which are newer than supported version 13.1.0")
+
+	assert.Equal(t, []string{"schema", "flow_spec", "elastic"}, RunStartupChecks(ctx, rt))
+}
@@ -16,31 +16,59 @@ import (
 	_ "github.com/nyaruka/mailroom/core/hooks"
 	_ "github.com/nyaruka/mailroom/core/ivr/twiml"
 	_ "github.com/nyaruka/mailroom/core/ivr/vonage"
+	_ "github.com/nyaruka/mailroom/core/tasks/android"
 	_ "github.com/nyaruka/mailroom/core/tasks/broadcasts"
 	_ "github.com/nyaruka/mailroom/core/tasks/campaigns"
 	_ "github.com/nyaruka/mailroom/core/tasks/contacts"
+	_ "github.com/nyaruka/mailroom/core/tasks/engagement"
 	_ "github.com/nyaruka/mailroom/core/tasks/expirations"
+	_ "github.com/nyaruka/mailroom/core/tasks/groups"
+	_ "github.com/nyaruka/mailroom/core/tasks/indexing"
 	_ "github.com/nyaruka/mailroom/core/tasks/interrupts"
 	_ "github.com/nyaruka/mailroom/core/tasks/ivr"
+	_ "github.com/nyaruka/mailroom/core/tasks/janitor"
+	_ "github.com/nyaruka/mailroom/core/tasks/maintenance"
+	_ "github.com/nyaruka/mailroom/core/tasks/oauth"
+	_ "github.com/nyaruka/mailroom/core/tasks/partitions"
+	_ "github.com/nyaruka/mailroom/core/tasks/regressions"
+	_ "github.com/nyaruka/mailroom/core/tasks/reports"
 	_ "github.com/nyaruka/mailroom/core/tasks/schedules"
+	_ "github.com/nyaruka/mailroom/core/tasks/sessions"
 	_ "github.com/nyaruka/mailroom/core/tasks/starts"
 	_ "github.com/nyaruka/mailroom/core/tasks/stats"
 	_ "github.com/nyaruka/mailroom/core/tasks/timeouts"
+	_ "github.com/nyaruka/mailroom/core/tasks/usage"
+	_ "github.com/nyaruka/mailroom/core/tasks/warmup"
+	_ "github.com/nyaruka/mailroom/core/tasks/webhooks"
+	_ "github.com/nyaruka/mailroom/services/external/aggregates"
+	_ "github.com/nyaruka/mailroom/services/external/sheets"
+	_ "github.com/nyaruka/mailroom/services/external/state"
+	_ "github.com/nyaruka/mailroom/services/external/tables"
+	_ "github.com/nyaruka/mailroom/services/lookup/twilio"
 	_ "github.com/nyaruka/mailroom/services/tickets/intern"
 	_ "github.com/nyaruka/mailroom/services/tickets/mailgun"
 	_ "github.com/nyaruka/mailroom/services/tickets/rocketchat"
 	_ "github.com/nyaruka/mailroom/services/tickets/zendesk"
+	"github.com/nyaruka/mailroom/utils/logx"
+	_ "github.com/nyaruka/mailroom/web/admin"
+	_ "github.com/nyaruka/mailroom/web/attachment"
+	_ "github.com/nyaruka/mailroom/web/channel"
 	_ "github.com/nyaruka/mailroom/web/contact"
 	_ "github.com/nyaruka/mailroom/web/docs"
+	_ "github.com/nyaruka/mailroom/web/event"
 	_ "github.com/nyaruka/mailroom/web/expression"
 	_ "github.com/nyaruka/mailroom/web/flow"
+	_ "github.com/nyaruka/mailroom/web/group"
+	_ "github.com/nyaruka/mailroom/web/idempotency"
 	_ "github.com/nyaruka/mailroom/web/ivr"
 	_ "github.com/nyaruka/mailroom/web/msg"
 	_ "github.com/nyaruka/mailroom/web/org"
 	_ "github.com/nyaruka/mailroom/web/po"
+	_ "github.com/nyaruka/mailroom/web/search"
 	_ "github.com/nyaruka/mailroom/web/simulation"
 	_ "github.com/nyaruka/mailroom/web/surveyor"
 	_ "github.com/nyaruka/mailroom/web/ticket"
+	_ "github.com/nyaruka/mailroom/web/trigger"
 
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
@@ -73,7 +101,14 @@ func main() {
 	if err != nil {
 		logrus.Fatalf("invalid log level '%s'", level)
 	}
-	logrus.SetLevel(level)
+	if err := logx.Configure(config.LogFormat, level, config.LogSampleRate); err != nil {
+		logrus.Fatalf("invalid log configuration: %s", err)
+	}
+
+	moduleLevels, _ := config.ParseLogLevels()
+	for module, level := range moduleLevels {
+		logx.SetLevel(module, level)
+	}
 
 	// if we have a DSN entry, try to initialize it
 	if config.SentryDSN != "" {
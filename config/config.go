@@ -2,11 +2,16 @@ package config
 
 import (
 	"encoding/csv"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // Mailroom is the global configuration
@@ -16,30 +21,87 @@ func init() {
 	Mailroom = NewMailroomConfig()
 }
 
+// the ways we can find session timeouts and run expirations
+const (
+	SessionWaitsDB    = "db"
+	SessionWaitsBoth  = "both"
+	SessionWaitsRedis = "redis"
+)
+
 // Config is our top level configuration object
 type Config struct {
 	SentryDSN  string `help:"the DSN used for logging errors to Sentry"`
 	DB         string `help:"URL for your Postgres database"`
-	DBPoolSize int    `help:"the size of our db pool"`
+	DBPoolSize int    `help:"the size of our db pool, used for handling messages and by any workload without its own pool"`
 	Redis      string `help:"URL for your Redis instance"`
 	Elastic    string `help:"URL for your ElasticSearch service"`
 	Version    string `help:"the version of this mailroom install"`
 	LogLevel   string `help:"the logging level courier should use"`
 
+	RedisSentinels      string `help:"comma separated addresses of sentinels from which to discover the redis master, in which case the host of the redis URL is ignored"`
+	RedisSentinelMaster string `help:"the name of the redis master monitored by the sentinels"`
+	RedisCluster        bool   `help:"whether redis is a cluster whose nodes are discovered from the host of the redis URL, which requires RedisHashTags"`
+	RedisHashTags       bool   `help:"whether keys which are used together are hash tagged so they're in the same slot of a redis cluster, which RapidPro and courier must also be configured to use"`
+
+	LogFormat     string  `help:"the format of log output, one of text or json"`
+	LogLevels     string  `help:"comma separated list of per module logging level overrides ex: handler:debug,web:info"`
+	LogSampleRate float64 `help:"the fraction of high volume log entries, e.g. one per task handled, which are written"`
+
+	OTLPEndpoint    string  `help:"the OTLP/HTTP collector endpoint to export traces to, e.g. localhost:4318, tracing is disabled if empty"`
+	TraceSampleRate float64 `help:"the fraction of traces which are sampled, unless they continue a trace from a request that was already sampled"`
+
+	StrictStartup bool `help:"whether to refuse to start if any startup checks fail, otherwise we start in a degraded state"`
+	WarmOrgs      int  `help:"the number of most active orgs whose assets are loaded before we start handling tasks, 0 to disable"`
+
 	BatchWorkers   int `help:"the number of go routines that will be used to handle batch events"`
 	HandlerWorkers int `help:"the number of go routines that will be used to handle messages"`
 
+	BatchWorkersMax          int `help:"the maximum number of go routines the batch worker pool can grow to under load, 0 to disable scaling"`
+	HandlerWorkersMax        int `help:"the maximum number of go routines the handler worker pool can grow to under load, 0 to disable scaling"`
+	QueueStarvationThreshold int `help:"the number of seconds a queued task can wait before we consider its org starved"`
+
+	TaskTimeouts string `help:"comma separated list of maximum durations of task types as task_type:seconds, which are enforced as well as each task type's own maximum ex: start_flow:1800,import_contact_batch:300"`
+
 	RetryPendingMessages bool `help:"whether to requeue pending messages older than five minutes to retry"`
 
-	WebhooksTimeout        int     `help:"the timeout in milliseconds for webhook calls from engine"`
-	WebhooksMaxRetries     int     `help:"the number of times to retry a failed webhook call"`
-	WebhooksMaxBodyBytes   int     `help:"the maximum size of bytes to a webhook call response body"`
-	WebhooksInitialBackoff int     `help:"the initial backoff in milliseconds when retrying a failed webhook call"`
-	WebhooksBackoffJitter  float64 `help:"the amount of jitter to apply to backoff times"`
-	SMTPServer             string  `help:"the smtp configuration for sending emails ex: smtp://user%40password@server:port/?from=foo%40gmail.com"`
-	DisallowedNetworks     string  `help:"comma separated list of IP addresses and networks which engine can't make HTTP calls to"`
-	MaxStepsPerSprint      int     `help:"the maximum number of steps allowed per engine sprint"`
-	MaxValueLength         int     `help:"the maximum size in characters for contact field values and run result values"`
+	DBBatchPoolSize int `help:"the size of the db pool used by batch tasks, 0 to use the main pool"`
+	DBCronPoolSize  int `help:"the size of the db pool used by cron jobs, 0 to use the main pool"`
+	DBWebPoolSize   int `help:"the size of the db pool used by web requests, 0 to use the main pool"`
+
+	CommitMaxRetries     int `help:"the number of times to retry session and pre-commit hook transactions which fail because of a deadlock or serialization failure"`
+	CommitInitialBackoff int `help:"the initial backoff in milliseconds when retrying a failed commit, doubled for each retry and jittered"`
+
+	RunSteps                bool `help:"whether to also write the path of each run as normalized step rows to the flows_flowrunstep table"`
+	RunStepsRetentionMonths int  `help:"the number of months of run steps to keep, older monthly partitions are dropped"`
+
+	PartitionedTables         string `help:"comma separated list of tables partitioned by month whose partitions we maintain, one or more of msgs_msg,flows_flowrun"`
+	PartitionsAhead           int    `help:"the number of future monthly partitions to create ahead of time for partitioned tables"`
+	PartitionsRetentionMonths int    `help:"the number of months of partitions to keep attached for partitioned tables, older partitions are detached for archiving unless other tables have foreign keys to them, 0 to keep all"`
+
+	WebhooksTimeout         int     `help:"the timeout in milliseconds for webhook calls from engine"`
+	WebhooksMaxRetries      int     `help:"the number of times to retry a failed webhook call"`
+	WebhooksMaxBodyBytes    int     `help:"the maximum size of bytes to a webhook call response body"`
+	WebhooksInitialBackoff  int     `help:"the initial backoff in milliseconds when retrying a failed webhook call"`
+	WebhooksBackoffJitter   float64 `help:"the amount of jitter to apply to backoff times"`
+	WebhooksDeferredRetries int     `help:"the number of times a webhook call which failed with a connection error or a 429, 502, 503 or 504 response is retried later with exponential backoff, 0 to disable"`
+	WebhooksDeferredBackoff int     `help:"the backoff in seconds before the first deferred retry of a failed webhook call, doubling with each retry"`
+	SMTPServer              string  `help:"the smtp configuration for sending emails ex: smtp://user%40password@server:port/?from=foo%40gmail.com"`
+	DisallowedNetworks      string  `help:"comma separated list of IP addresses and networks which engine can't make HTTP calls to"`
+	MaxStepsPerSprint       int     `help:"the maximum number of steps allowed per engine sprint"`
+	MaxValueLength          int     `help:"the maximum size in characters for contact field values and run result values"`
+
+	SessionTimersMaxSeconds int `help:"the maximum wait timeout in seconds which is resumed by a precise timer rather than the minutely timeouts cron, 0 to disable"`
+	SessionTimersMaxPending int `help:"the maximum number of pending session timers, beyond which waits fall back to the timeouts cron"`
+
+	SessionWaits string `help:"how session timeouts and run expirations are found, one of db (scanned from the database every minute), both (also scheduled in redis when sessions wait, for switching over) or redis"`
+
+	CampaignFiresOverdueHours int `help:"the number of hours overdue after which unfired campaign event fires are skipped rather than fired, 0 to never skip"`
+
+	JanitorDryRun bool `help:"whether the janitor only reports the orphaned data left by crashes that it finds, rather than repairing it"`
+
+	ContactStateMaxKeys       int `help:"the maximum number of keys which flows can store in a contact's state"`
+	ContactStateMaxValueBytes int `help:"the maximum size in bytes of a value stored in a contact's state"`
+	ContactStateTTL           int `help:"the number of seconds after its last change that a contact's state expires"`
 
 	LibratoUsername string `help:"the username that will be used to authenticate to Librato"`
 	LibratoToken    string `help:"the token that will be used to authenticate to Librato"`
@@ -56,6 +118,12 @@ type Config struct {
 	S3SessionBucket string `help:"the S3 bucket we will write attachments to"`
 	S3SessionPrefix string `help:"the prefix that will be added to attachment filenames"`
 
+	SessionStorageMode string `help:"how sessions of orgs which don't set their own mode are stored, one of db, s3, s3_write or s3_only"`
+
+	S3Regions string `help:"comma separated list of data regions with their own S3 storage as name:s3_region:media_bucket:session_bucket[:endpoint], the endpoint defaulting to the regional AWS endpoint or S3Endpoint if that isn't AWS, orgs in any other region fail to load"`
+
+	RegionHosts string `help:"comma separated list of the regional hosts that external services are called on for orgs in data regions as region:host:regional_host, e.g. eu:api.mailgun.net:api.eu.mailgun.net"`
+
 	S3DisableSSL     bool `help:"whether we disable SSL when accessing S3. Should always be set to False unless you're hosting an S3 compatible service within a secure internal network"`
 	S3ForcePathStyle bool `help:"whether we force S3 path style. Should generally need to default to False unless you're hosting an S3 compatible service"`
 
@@ -64,11 +132,18 @@ type Config struct {
 
 	FCMKey            string `help:"the FCM API key used to notify Android relayers to sync"`
 	MailgunSigningKey string `help:"the signing key used to validate requests from mailgun"`
+	OAuthTokenKey     string `help:"the hex encoded 32 byte key used to encrypt stored OAuth2 tokens, token storage is disabled if not set"`
+	OrgSecretsKey     string `help:"the hex encoded 32 byte key used to encrypt secrets in org config such as SMTP passwords, org secrets are disabled if not set"`
+	WebhookRetriesKey string `help:"the hex encoded 32 byte key used to encrypt the requests of failed webhook calls stored for retrying, credential headers are stripped from them if not set"`
+
+	AndroidSyncInterval int `help:"the minimum number of seconds between FCM syncs of the same Android channel, syncs requested sooner are batched into one at the end of the interval, 0 to not limit"`
 
 	AuthToken string `help:"the token clients will need to authenticate web requests"`
 	Address   string `help:"the address to bind our web server to"`
 	Port      int    `help:"the port to bind our web server to"`
 
+	RateLimits string `help:"comma separated list of per org web request rate limits as group:requests_per_second:burst where group is the path segment after /mr/ like sim, or * for any other endpoints"`
+
 	UUIDSeed int `help:"seed to use for UUID generation in a testing environment"`
 }
 
@@ -82,19 +157,44 @@ func NewMailroomConfig() *Config {
 		BatchWorkers:   4,
 		HandlerWorkers: 32,
 		LogLevel:       "error",
+		LogFormat:      "text",
+		LogSampleRate:  1,
 		Version:        "Dev",
 
-		WebhooksTimeout:        15000,
-		WebhooksMaxRetries:     2,
-		WebhooksMaxBodyBytes:   1024 * 1024, // 1MB
-		WebhooksInitialBackoff: 5000,
-		WebhooksBackoffJitter:  0.5,
-		SMTPServer:             "",
-		DisallowedNetworks:     `127.0.0.1,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,fe80::/10`,
-		MaxStepsPerSprint:      100,
-		MaxValueLength:         640,
-
-		S3Endpoint:         "https://s3.amazonaws.com",
+		TraceSampleRate: 1,
+
+		QueueStarvationThreshold: 60,
+
+		RunSteps:                false,
+		RunStepsRetentionMonths: 3,
+
+		PartitionedTables:         "",
+		PartitionsAhead:           2,
+		PartitionsRetentionMonths: 0,
+
+		WebhooksTimeout:         15000,
+		WebhooksMaxRetries:      2,
+		WebhooksMaxBodyBytes:    1024 * 1024, // 1MB
+		WebhooksInitialBackoff:  5000,
+		WebhooksBackoffJitter:   0.5,
+		WebhooksDeferredRetries: 0,
+		WebhooksDeferredBackoff: 60,
+		SMTPServer:              "",
+		DisallowedNetworks:      `127.0.0.1,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,fe80::/10`,
+		MaxStepsPerSprint:       100,
+		MaxValueLength:          640,
+
+		SessionTimersMaxSeconds: 300,
+		SessionTimersMaxPending: 100000,
+		SessionWaits:            SessionWaitsDB,
+
+		CampaignFiresOverdueHours: 0,
+
+		ContactStateMaxKeys:       50,
+		ContactStateMaxValueBytes: 1024,
+		ContactStateTTL:           60 * 60 * 24 * 30, // 30 days
+
+		S3Endpoint:         awsS3Endpoint,
 		S3Region:           "us-east-1",
 		S3MediaBucket:      "mailroom-media",
 		S3MediaPrefix:      "/media/",
@@ -105,8 +205,19 @@ func NewMailroomConfig() *Config {
 		AWSAccessKeyID:     "",
 		AWSSecretAccessKey: "",
 
+		SessionStorageMode: "db",
+
+		AndroidSyncInterval: 5,
+
 		RetryPendingMessages: true,
 
+		DBBatchPoolSize: 0,
+		DBCronPoolSize:  0,
+		DBWebPoolSize:   0,
+
+		CommitMaxRetries:     3,
+		CommitInitialBackoff: 50,
+
 		Address: "localhost",
 		Port:    8090,
 
@@ -120,9 +231,271 @@ func (c *Config) Validate() error {
 	if err != nil {
 		return errors.Wrap(err, "unable to parse DisallowedNetworks")
 	}
+	_, err = c.ParseS3Regions()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse S3Regions")
+	}
+	_, err = c.ParseRegionHosts()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse RegionHosts")
+	}
+	_, err = c.ParsePartitionedTables()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse PartitionedTables")
+	}
+	_, err = c.ParseLogLevels()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse LogLevels")
+	}
+	_, err = c.ParseOAuthTokenKey()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse OAuthTokenKey")
+	}
+	_, err = c.ParseOrgSecretsKey()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse OrgSecretsKey")
+	}
+	_, err = c.ParseWebhookRetriesKey()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse WebhookRetriesKey")
+	}
+	_, err = c.ParseRateLimits()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse RateLimits")
+	}
+	_, err = c.ParseTaskTimeouts()
+	if err != nil {
+		return errors.Wrap(err, "unable to parse TaskTimeouts")
+	}
+	if c.RedisSentinels != "" && c.RedisSentinelMaster == "" {
+		return errors.New("RedisSentinelMaster must be set when using RedisSentinels")
+	}
+	if c.RedisSentinels != "" && c.RedisCluster {
+		return errors.New("RedisSentinels and RedisCluster can't both be used")
+	}
+	if c.RedisCluster && !c.RedisHashTags {
+		return errors.New("RedisCluster requires RedisHashTags")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.Errorf("invalid LogFormat '%s', must be text or json", c.LogFormat)
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		return errors.Errorf("invalid LogSampleRate %g, must be between 0 and 1", c.LogSampleRate)
+	}
+	if c.SessionWaits != SessionWaitsDB && c.SessionWaits != SessionWaitsBoth && c.SessionWaits != SessionWaitsRedis {
+		return errors.Errorf("invalid SessionWaits '%s', must be db, both or redis", c.SessionWaits)
+	}
+	if c.SessionStorageMode != "db" && c.SessionStorageMode != "s3" && c.SessionStorageMode != "s3_write" && c.SessionStorageMode != "s3_only" {
+		return errors.Errorf("invalid SessionStorageMode '%s', must be db, s3, s3_write or s3_only", c.SessionStorageMode)
+	}
+	if c.TraceSampleRate < 0 || c.TraceSampleRate > 1 {
+		return errors.Errorf("invalid TraceSampleRate %g, must be between 0 and 1", c.TraceSampleRate)
+	}
 	return nil
 }
 
+// ParseLogLevels parses the list of per module logging level overrides
+func (c *Config) ParseLogLevels() (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+
+	for _, l := range strings.Split(c.LogLevels, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		parts := strings.Split(l, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as module:level", l)
+		}
+
+		level, err := logrus.ParseLevel(parts[1])
+		if err != nil {
+			return nil, errors.Errorf("invalid level '%s' for module '%s'", parts[1], parts[0])
+		}
+		levels[parts[0]] = level
+	}
+
+	return levels, nil
+}
+
+// RateLimit is a token bucket limit on how often an org can make requests to a group of endpoints
+type RateLimit struct {
+	Rate  float64 // requests per second
+	Burst int     // requests which can be made at once
+}
+
+// ParseRateLimits parses the list of per org web request rate limits, keyed by endpoint group
+func (c *Config) ParseRateLimits() (map[string]*RateLimit, error) {
+	limits := make(map[string]*RateLimit)
+
+	for _, l := range strings.Split(c.RateLimits, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		parts := strings.Split(l, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as group:requests_per_second:burst", l)
+		}
+
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.Errorf("invalid rate '%s' for group '%s'", parts[1], parts[0])
+		}
+		burst, err := strconv.Atoi(parts[2])
+		if err != nil || burst < 1 {
+			return nil, errors.Errorf("invalid burst '%s' for group '%s'", parts[2], parts[0])
+		}
+		limits[parts[0]] = &RateLimit{Rate: rate, Burst: burst}
+	}
+
+	return limits, nil
+}
+
+// ParseTaskTimeouts parses the list of maximum durations of task types, keyed by task type
+func (c *Config) ParseTaskTimeouts() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+
+	for _, t := range strings.Split(c.TaskTimeouts, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		parts := strings.Split(t, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as task_type:seconds", t)
+		}
+
+		seconds, err := strconv.Atoi(parts[1])
+		if err != nil || seconds < 1 {
+			return nil, errors.Errorf("invalid seconds '%s' for task type '%s'", parts[1], parts[0])
+		}
+		timeouts[parts[0]] = time.Second * time.Duration(seconds)
+	}
+
+	return timeouts, nil
+}
+
+// ParseOAuthTokenKey parses the key used to encrypt stored OAuth2 tokens, returning nil if it isn't set
+func (c *Config) ParseOAuthTokenKey() ([]byte, error) {
+	return parseEncryptionKey(c.OAuthTokenKey)
+}
+
+// ParseOrgSecretsKey parses the key used to encrypt secrets in org config, returning nil if it isn't set
+func (c *Config) ParseOrgSecretsKey() ([]byte, error) {
+	return parseEncryptionKey(c.OrgSecretsKey)
+}
+
+// ParseWebhookRetriesKey parses the key used to encrypt stored webhook retry requests, returning nil if it isn't set
+func (c *Config) ParseWebhookRetriesKey() ([]byte, error) {
+	return parseEncryptionKey(c.WebhookRetriesKey)
+}
+
+func parseEncryptionKey(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes encoded as 64 hex characters")
+	}
+	return key, nil
+}
+
+// the tables which we support being partitioned by month
+var partitionableTables = map[string]bool{"msgs_msg": true, "flows_flowrun": true}
+
+// ParsePartitionedTables parses the list of tables which are partitioned by month
+func (c *Config) ParsePartitionedTables() ([]string, error) {
+	tables := make([]string, 0, 2)
+
+	for _, t := range strings.Split(c.PartitionedTables, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !partitionableTables[t] {
+			return nil, errors.Errorf("'%s' is not a table which can be partitioned", t)
+		}
+		tables = append(tables, t)
+	}
+
+	return tables, nil
+}
+
+// S3RegionConfig is the S3 storage configuration for a data region
+type S3RegionConfig struct {
+	Name          string
+	S3Region      string
+	MediaBucket   string
+	SessionBucket string
+	Endpoint      string
+}
+
+// the default S3 endpoint, which for AWS has a regional equivalent
+const awsS3Endpoint = "https://s3.amazonaws.com"
+
+// ParseS3Regions parses the list of data regions which have their own S3 storage
+func (c *Config) ParseS3Regions() ([]*S3RegionConfig, error) {
+	regions := make([]*S3RegionConfig, 0, 2)
+
+	for _, r := range strings.Split(c.S3Regions, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		// endpoint is optional and can itself contain colons
+		parts := strings.SplitN(r, ":", 5)
+		if len(parts) < 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as name:s3_region:media_bucket:session_bucket[:endpoint]", r)
+		}
+
+		region := &S3RegionConfig{Name: parts[0], S3Region: parts[1], MediaBucket: parts[2], SessionBucket: parts[3]}
+
+		if len(parts) == 5 && parts[4] != "" {
+			region.Endpoint = parts[4]
+		} else if c.S3Endpoint == awsS3Endpoint {
+			region.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region.S3Region)
+		} else {
+			region.Endpoint = c.S3Endpoint
+		}
+
+		regions = append(regions, region)
+	}
+
+	return regions, nil
+}
+
+// ParseRegionHosts parses the list of regional hosts of external services into a map of the hosts of each data region
+// to their regional equivalents
+func (c *Config) ParseRegionHosts() (map[string]map[string]string, error) {
+	regions := make(map[string]map[string]string)
+
+	for _, h := range strings.Split(c.RegionHosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		parts := strings.Split(h, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errors.Errorf("couldn't parse '%s' as region:host:regional_host", h)
+		}
+
+		if regions[parts[0]] == nil {
+			regions[parts[0]] = make(map[string]string)
+		}
+		regions[parts[0]][strings.ToLower(parts[1])] = strings.ToLower(parts[2])
+	}
+
+	return regions, nil
+}
+
 // ParseDisallowedNetworks parses the list of IPs and IP networks (written in CIDR notation)
 func (c *Config) ParseDisallowedNetworks() ([]net.IP, []*net.IPNet, error) {
 	addrs, err := csv.NewReader(strings.NewReader(c.DisallowedNetworks)).Read()
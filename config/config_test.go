@@ -3,9 +3,11 @@ package config_test
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/mailroom/config"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,3 +49,216 @@ func TestParseDisallowedNetworks(t *testing.T) {
 	_, _, err = cfg.ParseDisallowedNetworks()
 	assert.EqualError(t, err, `couldn't parse '127.0.0.1/x' as an IP network`)
 }
+
+func TestParseS3Regions(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	regions, err := cfg.ParseS3Regions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*config.S3RegionConfig{}, regions)
+
+	cfg.S3Regions = `eu:eu-west-1:eu-media:eu-sessions, af:af-south-1:af-media:af-sessions`
+	regions, err = cfg.ParseS3Regions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*config.S3RegionConfig{
+		{Name: "eu", S3Region: "eu-west-1", MediaBucket: "eu-media", SessionBucket: "eu-sessions", Endpoint: "https://s3.eu-west-1.amazonaws.com"},
+		{Name: "af", S3Region: "af-south-1", MediaBucket: "af-media", SessionBucket: "af-sessions", Endpoint: "https://s3.af-south-1.amazonaws.com"},
+	}, regions)
+
+	// an explicit endpoint can be given, e.g. for an S3 compatible service
+	cfg.S3Regions = `eu:eu-west-1:eu-media:eu-sessions:http://minio.eu:9000`
+	regions, err = cfg.ParseS3Regions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*config.S3RegionConfig{
+		{Name: "eu", S3Region: "eu-west-1", MediaBucket: "eu-media", SessionBucket: "eu-sessions", Endpoint: "http://minio.eu:9000"},
+	}, regions)
+
+	// otherwise a non-AWS endpoint is used for all regions
+	cfg.S3Endpoint = "http://minio:9000"
+	cfg.S3Regions = `eu:eu-west-1:eu-media:eu-sessions`
+	regions, err = cfg.ParseS3Regions()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://minio:9000", regions[0].Endpoint)
+
+	cfg.S3Regions = `eu:eu-west-1:eu-media`
+	_, err = cfg.ParseS3Regions()
+	assert.EqualError(t, err, `couldn't parse 'eu:eu-west-1:eu-media' as name:s3_region:media_bucket:session_bucket[:endpoint]`)
+}
+
+func TestParseRegionHosts(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	hosts, err := cfg.ParseRegionHosts()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{}, hosts)
+
+	cfg.RegionHosts = `eu:api.mailgun.net:api.eu.mailgun.net, eu:API.Twilio.com:api.dublin.ie1.twilio.com, af:api.twilio.com:api.af.example.com`
+	hosts, err = cfg.ParseRegionHosts()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"eu": {"api.mailgun.net": "api.eu.mailgun.net", "api.twilio.com": "api.dublin.ie1.twilio.com"},
+		"af": {"api.twilio.com": "api.af.example.com"},
+	}, hosts)
+
+	cfg.RegionHosts = `eu:https://api.mailgun.net:api.eu.mailgun.net`
+	_, err = cfg.ParseRegionHosts()
+	assert.EqualError(t, err, `couldn't parse 'eu:https://api.mailgun.net:api.eu.mailgun.net' as region:host:regional_host`)
+}
+
+func TestParsePartitionedTables(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	tables, err := cfg.ParsePartitionedTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, tables)
+
+	cfg.PartitionedTables = "msgs_msg, flows_flowrun"
+	tables, err = cfg.ParsePartitionedTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"msgs_msg", "flows_flowrun"}, tables)
+
+	cfg.PartitionedTables = "msgs_msg,contacts_contact"
+	_, err = cfg.ParsePartitionedTables()
+	assert.EqualError(t, err, "'contacts_contact' is not a table which can be partitioned")
+}
+
+func TestParseOAuthTokenKey(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	key, err := cfg.ParseOAuthTokenKey()
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	cfg.OAuthTokenKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	key, err = cfg.ParseOAuthTokenKey()
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	cfg.OAuthTokenKey = "0001020304"
+	_, err = cfg.ParseOAuthTokenKey()
+	assert.EqualError(t, err, "must be 32 bytes encoded as 64 hex characters")
+
+	assert.EqualError(t, cfg.Validate(), "unable to parse OAuthTokenKey: must be 32 bytes encoded as 64 hex characters")
+}
+
+func TestParseOrgSecretsKey(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	key, err := cfg.ParseOrgSecretsKey()
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	cfg.OrgSecretsKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+	key, err = cfg.ParseOrgSecretsKey()
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	cfg.OrgSecretsKey = "xyz"
+	assert.EqualError(t, cfg.Validate(), "unable to parse OrgSecretsKey: must be 32 bytes encoded as 64 hex characters")
+}
+
+func TestParseLogLevels(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	levels, err := cfg.ParseLogLevels()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{}, levels)
+
+	cfg.LogLevels = "handler:debug, web:warn"
+	levels, err = cfg.ParseLogLevels()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{"handler": logrus.DebugLevel, "web": logrus.WarnLevel}, levels)
+
+	cfg.LogLevels = "handler"
+	_, err = cfg.ParseLogLevels()
+	assert.EqualError(t, err, "couldn't parse 'handler' as module:level")
+
+	cfg.LogLevels = "handler:loud"
+	_, err = cfg.ParseLogLevels()
+	assert.EqualError(t, err, "invalid level 'loud' for module 'handler'")
+
+	cfg.LogLevels = ""
+	cfg.LogFormat = "xml"
+	assert.EqualError(t, cfg.Validate(), "invalid LogFormat 'xml', must be text or json")
+
+	cfg.LogFormat = "json"
+	cfg.LogSampleRate = 1.5
+	assert.EqualError(t, cfg.Validate(), "invalid LogSampleRate 1.5, must be between 0 and 1")
+
+	cfg.LogSampleRate = 0.5
+	cfg.TraceSampleRate = -1
+	assert.EqualError(t, cfg.Validate(), "invalid TraceSampleRate -1, must be between 0 and 1")
+
+	cfg.TraceSampleRate = 0
+	cfg.SessionWaits = "postgres"
+	assert.EqualError(t, cfg.Validate(), "invalid SessionWaits 'postgres', must be db, both or redis")
+
+	cfg.SessionWaits = "db"
+	cfg.SessionStorageMode = "gcs"
+	assert.EqualError(t, cfg.Validate(), "invalid SessionStorageMode 'gcs', must be db, s3, s3_write or s3_only")
+}
+
+func TestRedisTopology(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.RedisSentinels = "sentinel1:26379,sentinel2:26379"
+	assert.EqualError(t, cfg.Validate(), "RedisSentinelMaster must be set when using RedisSentinels")
+
+	cfg.RedisSentinelMaster = "mymaster"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.RedisCluster = true
+	assert.EqualError(t, cfg.Validate(), "RedisSentinels and RedisCluster can't both be used")
+
+	// a cluster can only be used once RapidPro and courier are using hash tagged keys too
+	cfg.RedisSentinels = ""
+	assert.EqualError(t, cfg.Validate(), "RedisCluster requires RedisHashTags")
+
+	cfg.RedisHashTags = true
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestParseRateLimits(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	limits, err := cfg.ParseRateLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*config.RateLimit{}, limits)
+
+	cfg.RateLimits = "sim:5:20, *:50.5:100"
+	limits, err = cfg.ParseRateLimits()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*config.RateLimit{"sim": {Rate: 5, Burst: 20}, "*": {Rate: 50.5, Burst: 100}}, limits)
+
+	cfg.RateLimits = "sim:5"
+	_, err = cfg.ParseRateLimits()
+	assert.EqualError(t, err, "couldn't parse 'sim:5' as group:requests_per_second:burst")
+
+	cfg.RateLimits = "sim:0:20"
+	_, err = cfg.ParseRateLimits()
+	assert.EqualError(t, err, "invalid rate '0' for group 'sim'")
+
+	cfg.RateLimits = "sim:5:x"
+	assert.EqualError(t, cfg.Validate(), "unable to parse RateLimits: invalid burst 'x' for group 'sim'")
+}
+
+func TestParseTaskTimeouts(t *testing.T) {
+	cfg := config.NewMailroomConfig()
+
+	timeouts, err := cfg.ParseTaskTimeouts()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{}, timeouts)
+
+	cfg.TaskTimeouts = "start_flow:1800, import_contact_batch:300"
+	timeouts, err = cfg.ParseTaskTimeouts()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"start_flow": time.Minute * 30, "import_contact_batch": time.Minute * 5}, timeouts)
+
+	cfg.TaskTimeouts = "start_flow"
+	_, err = cfg.ParseTaskTimeouts()
+	assert.EqualError(t, err, "couldn't parse 'start_flow' as task_type:seconds")
+
+	cfg.TaskTimeouts = "start_flow:0"
+	assert.EqualError(t, cfg.Validate(), "unable to parse TaskTimeouts: invalid seconds '0' for task type 'start_flow'")
+}
@@ -1,6 +1,7 @@
 package goflow
 
 import (
+	"net/http"
 	"sync"
 
 	"github.com/nyaruka/gocommon/urns"
@@ -12,13 +13,18 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-var eng, simulator flows.Engine
-var engInit, simulatorInit sync.Once
+var eng, sandbox, simulator flows.Engine
+var engInit, sandboxInit, simulatorInit sync.Once
 
 var emailFactory engine.EmailServiceFactory
 var classificationFactory engine.ClassificationServiceFactory
 var ticketFactory engine.TicketServiceFactory
 var airtimeFactory engine.AirtimeServiceFactory
+var webhookCallListener func(flows.Session)
+var webhookRequestPreparer func(flows.Session, *http.Request) error
+var webhookInterceptors []WebhookInterceptor
+var webhookCallLimiter func(flows.Session, *http.Request) error
+var classificationCallLimiter func(flows.Session, *flows.Classifier) error
 
 // RegisterEmailServiceFactory can be used by outside callers to register a email factory
 // for use by the engine
@@ -44,6 +50,40 @@ func RegisterAirtimeServiceFactory(factory engine.AirtimeServiceFactory) {
 	airtimeFactory = factory
 }
 
+// RegisterWebhookCallListener can be used by outside callers to register a function which is called before each
+// webhook call made by real sessions, e.g. to let the contact know that a reply is on its way
+func RegisterWebhookCallListener(listener func(flows.Session)) {
+	webhookCallListener = listener
+}
+
+// RegisterWebhookRequestPreparer can be used by outside callers to register a function which can modify each webhook
+// request before it is made, e.g. to add authentication
+func RegisterWebhookRequestPreparer(preparer func(flows.Session, *http.Request) error) {
+	webhookRequestPreparer = preparer
+}
+
+// WebhookInterceptor is a function which can handle a webhook request itself rather than it being made over HTTP, by
+// returning a non-nil call. It's told whether the session is a simulation so that it can avoid any side effects.
+type WebhookInterceptor func(session flows.Session, request *http.Request, simulated bool) (*flows.WebhookCall, error)
+
+// RegisterWebhookInterceptor can be used by outside callers to register a function which can handle webhook requests
+// to internal services. Interceptors are tried in the order they were registered.
+func RegisterWebhookInterceptor(interceptor WebhookInterceptor) {
+	webhookInterceptors = append(webhookInterceptors, interceptor)
+}
+
+// RegisterWebhookCallLimiter can be used by outside callers to register a function which is called before each webhook
+// call made by real sessions, which can refuse the call by returning an error, e.g. because the org is over budget
+func RegisterWebhookCallLimiter(limiter func(flows.Session, *http.Request) error) {
+	webhookCallLimiter = limiter
+}
+
+// RegisterClassificationCallLimiter can be used by outside callers to register a function which is called before each
+// classifier call made by real sessions, which can refuse the call by returning an error
+func RegisterClassificationCallLimiter(limiter func(flows.Session, *flows.Classifier) error) {
+	classificationCallLimiter = limiter
+}
+
 // Engine returns the global engine instance for use with real sessions
 func Engine(cfg *config.Config) flows.Engine {
 	engInit.Do(func() {
@@ -52,21 +92,97 @@ func Engine(cfg *config.Config) flows.Engine {
 			"X-Mailroom-Mode": "normal",
 		}
 
-		httpClient, httpRetries, httpAccess := HTTP(cfg)
-
-		eng = engine.NewBuilder().
-			WithWebhookServiceFactory(webhooks.NewServiceFactory(httpClient, httpRetries, httpAccess, webhookHeaders, cfg.WebhooksMaxBodyBytes)).
-			WithClassificationServiceFactory(classificationFactory).
-			WithEmailServiceFactory(emailFactory).
-			WithTicketServiceFactory(ticketFactory).
-			WithAirtimeServiceFactory(airtimeFactory).
-			WithMaxStepsPerSprint(cfg.MaxStepsPerSprint).
-			Build()
+		eng = newEngine(cfg, webhookHeaders)
 	})
 
 	return eng
 }
 
+// Sandbox returns the global engine instance for use with real sessions of test contacts. It's the same as the normal
+// engine except that webhook calls include a header so that receiving services can tell they aren't from real contacts.
+func Sandbox(cfg *config.Config) flows.Engine {
+	sandboxInit.Do(func() {
+		webhookHeaders := map[string]string{
+			"User-Agent":         "RapidProMailroom/" + cfg.Version,
+			"X-Mailroom-Mode":    "normal",
+			"X-Mailroom-Sandbox": "true",
+		}
+
+		sandbox = newEngine(cfg, webhookHeaders)
+	})
+
+	return sandbox
+}
+
+func newEngine(cfg *config.Config, webhookHeaders map[string]string) flows.Engine {
+	httpClient, httpRetries, httpAccess := HTTP(cfg)
+	webhookFactory := webhooks.NewServiceFactory(httpClient, httpRetries, httpAccess, webhookHeaders, cfg.WebhooksMaxBodyBytes)
+
+	return engine.NewBuilder().
+		WithWebhookServiceFactory(wrappedWebhookServiceFactory(webhookFactory, false)).
+		WithClassificationServiceFactory(limitedClassificationServiceFactory(classificationFactory)).
+		WithEmailServiceFactory(emailFactory).
+		WithTicketServiceFactory(ticketFactory).
+		WithAirtimeServiceFactory(airtimeFactory).
+		WithMaxStepsPerSprint(cfg.MaxStepsPerSprint).
+		Build()
+}
+
+// wraps the given webhook service factory so that requests are passed to our preparer and interceptor, and so that
+// our webhook call listener is notified of calls by real sessions
+func wrappedWebhookServiceFactory(factory engine.WebhookServiceFactory, simulated bool) engine.WebhookServiceFactory {
+	return func(session flows.Session) (flows.WebhookService, error) {
+		service, err := factory(session)
+		if err != nil {
+			return nil, err
+		}
+		return &wrappedWebhookService{service: service, simulated: simulated}, nil
+	}
+}
+
+type wrappedWebhookService struct {
+	service   flows.WebhookService
+	simulated bool
+}
+
+func (s *wrappedWebhookService) Call(session flows.Session, request *http.Request) (*flows.WebhookCall, error) {
+	if webhookRequestPreparer != nil {
+		if err := webhookRequestPreparer(session, request); err != nil {
+			return nil, err
+		}
+	}
+	for _, interceptor := range webhookInterceptors {
+		call, err := interceptor(session, request, s.simulated)
+		if call != nil || err != nil {
+			return call, err
+		}
+	}
+	if !s.simulated && webhookCallLimiter != nil {
+		if err := webhookCallLimiter(session, request); err != nil {
+			return nil, err
+		}
+	}
+	if !s.simulated && webhookCallListener != nil {
+		webhookCallListener(session)
+	}
+	return s.service.Call(session, request)
+}
+
+// wraps the given classification service factory so that calls by real sessions are passed to our limiter first
+func limitedClassificationServiceFactory(factory engine.ClassificationServiceFactory) engine.ClassificationServiceFactory {
+	if factory == nil {
+		return nil
+	}
+	return func(session flows.Session, classifier *flows.Classifier) (flows.ClassificationService, error) {
+		if classificationCallLimiter != nil {
+			if err := classificationCallLimiter(session, classifier); err != nil {
+				return nil, err
+			}
+		}
+		return factory(session, classifier)
+	}
+}
+
 // Simulator returns the global engine instance for use with simulated sessions
 func Simulator(cfg *config.Config) flows.Engine {
 	simulatorInit.Do(func() {
@@ -78,7 +194,7 @@ func Simulator(cfg *config.Config) flows.Engine {
 		httpClient, _, httpAccess := HTTP(cfg) // don't do retries in simulator
 
 		simulator = engine.NewBuilder().
-			WithWebhookServiceFactory(webhooks.NewServiceFactory(httpClient, nil, httpAccess, webhookHeaders, cfg.WebhooksMaxBodyBytes)).
+			WithWebhookServiceFactory(wrappedWebhookServiceFactory(webhooks.NewServiceFactory(httpClient, nil, httpAccess, webhookHeaders, cfg.WebhooksMaxBodyBytes), true)).
 			WithClassificationServiceFactory(classificationFactory).   // simulated sessions do real classification
 			WithEmailServiceFactory(simulatorEmailServiceFactory).     // but faked emails
 			WithTicketServiceFactory(simulatorTicketServiceFactory).   // and faked tickets
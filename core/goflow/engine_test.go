@@ -39,6 +39,26 @@ func TestEngineWebhook(t *testing.T) {
 	assert.Equal(t, "OK", string(call.ResponseBody))
 }
 
+func TestSandboxWebhook(t *testing.T) {
+	rt := testsuite.RT()
+
+	svc, err := goflow.Sandbox(rt.Config).Services().Webhook(nil)
+	assert.NoError(t, err)
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"http://rapidpro.io": {httpx.NewMockResponse(200, nil, "OK")},
+	}))
+
+	request, err := http.NewRequest("GET", "http://rapidpro.io", nil)
+	require.NoError(t, err)
+
+	call, err := svc.Call(nil, request)
+	assert.NoError(t, err)
+	assert.NotNil(t, call)
+	assert.Equal(t, "GET / HTTP/1.1\r\nHost: rapidpro.io\r\nUser-Agent: RapidProMailroom/Dev\r\nX-Mailroom-Mode: normal\r\nX-Mailroom-Sandbox: true\r\nAccept-Encoding: gzip\r\n\r\n", string(call.RequestTrace))
+}
+
 func TestSimulatorAirtime(t *testing.T) {
 	rt := testsuite.RT()
 
@@ -2,10 +2,12 @@ package goflow
 
 import (
 	"encoding/json"
+	"sort"
 	"sync"
 
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/actions"
 	"github.com/nyaruka/goflow/flows/definition"
 	"github.com/nyaruka/goflow/flows/definition/migrations"
 	"github.com/nyaruka/mailroom/config"
@@ -21,6 +23,16 @@ func SpecVersion() *semver.Version {
 	return definition.CurrentSpecVersion
 }
 
+// ActionTypes returns the sorted types of action supported by the engine
+func ActionTypes() []string {
+	types := make([]string, 0, len(actions.RegisteredTypes))
+	for t := range actions.RegisteredTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
 // ReadFlow reads a flow from the given JSON definition, migrating it if necessary
 func ReadFlow(cfg *config.Config, data json.RawMessage) (flows.Flow, error) {
 	return definition.ReadFlow(data, MigrationConfig(cfg))
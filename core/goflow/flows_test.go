@@ -1,6 +1,7 @@
 package goflow_test
 
 import (
+	"sort"
 	"testing"
 
 	"github.com/nyaruka/gocommon/uuids"
@@ -19,6 +20,13 @@ func TestSpecVersion(t *testing.T) {
 	assert.Equal(t, semver.MustParse("13.1.0"), goflow.SpecVersion())
 }
 
+func TestActionTypes(t *testing.T) {
+	types := goflow.ActionTypes()
+	assert.Contains(t, types, "send_msg")
+	assert.Contains(t, types, "enter_flow")
+	assert.True(t, sort.StringsAreSorted(types))
+}
+
 func TestReadFlow(t *testing.T) {
 	rt := testsuite.RT()
 
@@ -2,7 +2,9 @@ package goflow
 
 import (
 	"crypto/tls"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,3 +46,46 @@ func HTTP(cfg *config.Config) (*http.Client, *httpx.RetryConfig, *httpx.AccessCo
 	})
 	return httpClient, httpRetries, httpAccess
 }
+
+// RegionalHTTP returns the passed in HTTP client for calls to external services for an org in the passed in data region,
+// which calls the regional hosts configured for that region in place of their default hosts
+func RegionalHTTP(cfg *config.Config, client *http.Client, region string) *http.Client {
+	if region == "" {
+		return client
+	}
+
+	regionHosts, _ := cfg.ParseRegionHosts()
+	hosts := regionHosts[region]
+	if len(hosts) == 0 {
+		return client
+	}
+
+	regional := *client
+	regional.Transport = &regionalTransport{base: client.Transport, hosts: hosts}
+	return &regional
+}
+
+// transport which sends requests for some hosts to their regional equivalents
+type regionalTransport struct {
+	base  http.RoundTripper
+	hosts map[string]string
+}
+
+func (t *regionalTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if host := t.hosts[strings.ToLower(r.URL.Hostname())]; host != "" {
+		if port := r.URL.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// requests mustn't be modified by transports
+		r = r.Clone(r.Context())
+		r.URL.Host = host
+		r.Host = ""
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
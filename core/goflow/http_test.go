@@ -0,0 +1,48 @@
+package goflow_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionalHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("regional"))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+
+	cfg := config.NewMailroomConfig()
+	cfg.RegionHosts = "eu:api.example.com:127.0.0.1"
+
+	client := &http.Client{}
+
+	// orgs without a region, or in regions without regional hosts, get the client as it is
+	assert.Equal(t, client, goflow.RegionalHTTP(cfg, client, ""))
+	assert.Equal(t, client, goflow.RegionalHTTP(cfg, client, "af"))
+
+	// orgs in the region call the regional host instead
+	regional := goflow.RegionalHTTP(cfg, client, "eu")
+	assert.NotEqual(t, client, regional)
+
+	req, _ := http.NewRequest("GET", "http://api.example.com:"+serverURL.Port()+"/test", nil)
+	resp, err := regional.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "regional", string(body))
+
+	// without the request being modified
+	assert.Equal(t, "api.example.com:"+serverURL.Port(), req.URL.Host)
+}
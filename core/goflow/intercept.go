@@ -0,0 +1,55 @@
+package goflow
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/pkg/errors"
+)
+
+// NewInterceptedCall creates a webhook call for a request handled by an interceptor, with the given status and body
+// marshalled as the JSON response
+func NewInterceptedCall(request *http.Request, start time.Time, status int, body interface{}) (*flows.WebhookCall, error) {
+	requestTrace, err := httputil.DumpRequestOut(request, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error dumping intercepted request")
+	}
+
+	responseBody, err := jsonx.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(responseBody)),
+		Request:       request,
+	}
+
+	responseTrace, err := httputil.DumpResponse(response, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error dumping intercepted response")
+	}
+
+	trace := &httpx.Trace{
+		Request:       request,
+		RequestTrace:  requestTrace,
+		Response:      response,
+		ResponseTrace: responseTrace,
+		ResponseBody:  responseBody,
+		StartTime:     start,
+		EndTime:       time.Now(),
+	}
+
+	return &flows.WebhookCall{Trace: trace, ResponseJSON: responseBody}, nil
+}
@@ -2,6 +2,7 @@ package goflow
 
 import (
 	"encoding/json"
+	"sort"
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
@@ -36,3 +37,13 @@ func ReadModifiers(sa flows.SessionAssets, data []json.RawMessage, missing Missi
 	}
 	return mods, nil
 }
+
+// ModifierTypes returns the sorted types of modifier supported by the engine
+func ModifierTypes() []string {
+	types := make([]string, 0, len(modifiers.RegisteredTypes))
+	for t := range modifiers.RegisteredTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
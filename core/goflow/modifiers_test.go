@@ -2,6 +2,7 @@ package goflow_test
 
 import (
 	"encoding/json"
+	"sort"
 	"testing"
 
 	"github.com/nyaruka/mailroom/core/goflow"
@@ -62,3 +63,10 @@ func TestReadModifiers(t *testing.T) {
 	}, goflow.ErrorOnMissing)
 	assert.EqualError(t, err, `error reading modifier: {"type": "field", "value": "O"}: field 'field' is required`)
 }
+
+func TestModifierTypes(t *testing.T) {
+	types := goflow.ModifierTypes()
+	assert.Contains(t, types, "name")
+	assert.Contains(t, types, "field")
+	assert.True(t, sort.StringsAreSorted(types))
+}
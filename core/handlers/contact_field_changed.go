@@ -30,6 +30,9 @@ func handleContactFieldChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool,
 	// add our callback
 	scene.AppendToEventPreCommitHook(hooks.CommitFieldChangesHook, event)
 	scene.AppendToEventPreCommitHook(hooks.UpdateCampaignEventsHook, event)
+	scene.AppendToEventPreCommitHook(hooks.LinkContactsHook, event)
+	scene.AppendToEventPreCommitHook(hooks.ScheduleValueExpiriesHook, event)
+	scene.AppendToEventPostCommitHook(hooks.RecordContactChangesHook, event)
 
 	return nil
 }
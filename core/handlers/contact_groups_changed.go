@@ -47,7 +47,13 @@ func handleContactGroupsChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool
 		// add our add event
 		scene.AppendToEventPreCommitHook(hooks.CommitGroupChangesHook, hookEvent)
 		scene.AppendToEventPreCommitHook(hooks.UpdateCampaignEventsHook, hookEvent)
+		scene.AppendToEventPreCommitHook(hooks.ScheduleValueExpiriesHook, hookEvent)
 		scene.AppendToEventPreCommitHook(hooks.ContactModifiedHook, scene.ContactID())
+
+		// contacts entering and leaving dynamic groups is something external systems may want to know about
+		if group.Query() != "" {
+			scene.AppendToEventPostCommitHook(hooks.FireGroupChangesHook, hookEvent)
+		}
 	}
 
 	// add each of our groups
@@ -70,8 +76,15 @@ func handleContactGroupsChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool
 
 		scene.AppendToEventPreCommitHook(hooks.CommitGroupChangesHook, hookEvent)
 		scene.AppendToEventPreCommitHook(hooks.UpdateCampaignEventsHook, hookEvent)
+		scene.AppendToEventPreCommitHook(hooks.ScheduleValueExpiriesHook, hookEvent)
 		scene.AppendToEventPreCommitHook(hooks.ContactModifiedHook, scene.ContactID())
+
+		if group.Query() != "" {
+			scene.AppendToEventPostCommitHook(hooks.FireGroupChangesHook, hookEvent)
+		}
 	}
 
+	scene.AppendToEventPostCommitHook(hooks.RecordContactChangesHook, event)
+
 	return nil
 }
@@ -27,5 +27,6 @@ func handleContactNameChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool,
 	}).Debug("changing contact name")
 
 	scene.AppendToEventPreCommitHook(hooks.CommitNameChangesHook, event)
+	scene.AppendToEventPostCommitHook(hooks.RecordContactChangesHook, event)
 	return nil
 }
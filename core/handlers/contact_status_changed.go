@@ -27,5 +27,6 @@ func handleContactStatusChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool
 	}).Debug("updating contact status")
 
 	scene.AppendToEventPreCommitHook(hooks.CommitStatusChangesHook, event)
+	scene.AppendToEventPostCommitHook(hooks.RecordContactChangesHook, event)
 	return nil
 }
@@ -36,6 +36,7 @@ func handleContactURNsChanged(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool,
 	// add our callback
 	scene.AppendToEventPreCommitHook(hooks.CommitURNChangesHook, change)
 	scene.AppendToEventPreCommitHook(hooks.ContactModifiedHook, scene.ContactID())
+	scene.AppendToEventPostCommitHook(hooks.RecordContactChangesHook, event)
 
 	return nil
 }
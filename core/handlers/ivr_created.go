@@ -46,5 +46,10 @@ func handleIVRCreated(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *mode
 	// register to have this message committed
 	scene.AppendToEventPreCommitHook(hooks.CommitIVRHook, msg)
 
+	// messages without a recording are spoken by the channel's text-to-speech
+	if len(event.Msg.Attachments()) == 0 {
+		scene.AppendToEventPostCommitHook(hooks.MeterTTSHook, event)
+	}
+
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/mailroom/core/hooks"
@@ -99,24 +100,148 @@ func handleMsgCreated(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *mode
 		}
 	}
 
+	// replies stick to the channel the contact last messaged us on, otherwise org routing rules can override the channel
+	// chosen by the engine. Not being able to look up the last channel shouldn't stop the message being sent.
+	if channel != nil {
+		rc := rp.Get()
+		sticky, err := models.StickyChannel(ctx, rc, oa, scene.ContactID(), event.Msg.URN())
+		rc.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("contact_uuid", scene.ContactUUID()).Error("error looking up sticky channel, using routed channel")
+		}
+
+		if sticky != nil {
+			channel = sticky
+		} else if routed := models.RouteChannel(oa, event.Msg.URN()); routed != nil {
+			channel = routed
+		}
+	}
+
+	// collapse identical messages sent to this contact in quick succession, e.g. by flows which loop
+	var claim *models.OutgoingMsgClaim
+	duplicate := false
+	if channel != nil && scene.Session().SessionType() != models.FlowTypeSurveyor {
+		claim = models.NewOutgoingMsgClaim(oa.Org(), scene.ContactID(), event.Msg)
+	}
+	if claim != nil {
+		// claims of messages earlier in this commit aren't made until it succeeds
+		for _, e := range scene.PostCommitEvents(hooks.ClaimOutgoingMsgsHook) {
+			if e.(*models.OutgoingMsgClaim).Key == claim.Key {
+				duplicate = true
+			}
+		}
+
+		if !duplicate {
+			rc := rp.Get()
+			claimed, err := claim.IsClaimed(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			duplicate = claimed
+		}
+	}
+
 	msg, err := models.NewOutgoingMsg(oa.Org(), channel, scene.ContactID(), event.Msg, event.CreatedOn())
 	if err != nil {
 		return errors.Wrapf(err, "error creating outgoing message to %s", event.Msg.URN())
 	}
 
-	// include some information about the session
-	msg.SetSession(scene.Session().ID(), scene.Session().Status())
+	// messages sent by campaign message events can have attachments, quick replies or a template defined on the event
+	if runs := scene.Session().Runs(); len(runs) > 0 {
+		if campaignEvent := oa.CampaignMessageEventByFlowID(runs[0].FlowID()); campaignEvent != nil {
+			opts, err := campaignEvent.MessageOptions()
+			if err != nil {
+				return errors.Wrapf(err, "error reading options for campaign event: %d", campaignEvent.ID())
+			}
+			if opts != nil {
+				msg.SetCampaignOptions(oa, scene.Contact(), opts)
+			}
+		}
+	}
+
+	// fail messages we have no way of sending or which the contact has opted out of so that history shows why
+	if scene.Session().SessionType() != models.FlowTypeSurveyor && msg.Status() != models.MsgStatusFailed {
+		if scene.Contact().Status() == flows.ContactStatusStopped {
+			msg.SetFailed(models.MsgFailedContactStopped)
+		} else if channel == nil || event.Msg.URN() == urns.NilURN {
+			msg.SetFailed(models.MsgFailedNoDestination)
+		} else if duplicate {
+			logrus.WithFields(logrus.Fields{
+				"contact_uuid": scene.ContactUUID(),
+				"session_id":   scene.SessionID(),
+				"msg_uuid":     event.Msg.UUID(),
+			}).Info("suppressing duplicate outgoing message")
+
+			msg.SetFailed(models.MsgFailedDuplicate)
+		}
+	}
+
+	// once committed, this message suppresses identical ones for the rest of the window
+	if claim != nil && !duplicate {
+		scene.AppendToEventPostCommitHook(hooks.ClaimOutgoingMsgsHook, claim)
+	}
+
+	// check the message can be sent on its channel, splitting off any attachments it can't send together
+	followUps, rejected, err := models.ApplyChannelConstraints(oa.Org(), msg)
+	if err != nil {
+		return err
+	}
+	if rejected != nil {
+		logrus.WithFields(logrus.Fields{
+			"contact_uuid": scene.ContactUUID(),
+			"session_id":   scene.SessionID(),
+			"msg_uuid":     event.Msg.UUID(),
+		}).Info("rejecting outgoing message which can't be sent on its channel")
+
+		scene.AppendToEventPreCommitHook(hooks.InsertChannelEventsHook, rejected)
+	}
+
+	for _, m := range append([]*models.Msg{msg}, followUps...) {
+		// include some information about the session
+		m.SetSession(scene.Session().ID(), scene.Session().Status())
+
+		// set our reply to as well (will be noop in cases when there is no incoming message)
+		m.SetResponseTo(scene.Session().IncomingMsgID(), scene.Session().IncomingMsgExternalID())
 
-	// set our reply to as well (will be noop in cases when there is no incoming message)
-	msg.SetResponseTo(scene.Session().IncomingMsgID(), scene.Session().IncomingMsgExternalID())
+		// classify this message by where it came from so that replies and transactional messages aren't queued behind bulk sends
+		class, err := msgPriorityClass(oa, scene.Session(), m)
+		if err != nil {
+			return err
+		}
+		m.SetPriorityClass(oa.Org(), class)
+
+		// messages to test contacts are recorded but never sent
+		if models.IsTestContact(oa, scene.Contact()) {
+			m.SetSandbox()
+		}
 
-	// register to have this message committed
-	scene.AppendToEventPreCommitHook(hooks.CommitMessagesHook, msg)
+		// register to have this message committed
+		scene.AppendToEventPreCommitHook(hooks.CommitMessagesHook, m)
+		scene.AppendToEventPostCommitHook(hooks.IndexMsgsHook, m)
 
-	// don't send messages for surveyor flows
-	if scene.Session().SessionType() != models.FlowTypeSurveyor {
-		scene.AppendToEventPostCommitHook(hooks.SendMessagesHook, msg)
+		// don't send messages for surveyor flows
+		if scene.Session().SessionType() != models.FlowTypeSurveyor {
+			scene.AppendToEventPostCommitHook(hooks.SendMessagesHook, m)
+		}
 	}
 
 	return nil
 }
+
+// returns the priority class of a message created in the passed in session, based on the flow the session was started
+// in and whether the message is a reply
+func msgPriorityClass(oa *models.OrgAssets, session *models.Session, msg *models.Msg) (models.MsgPriorityClass, error) {
+	priorities := oa.Org().MsgPriorities()
+
+	var flowUUID assets.FlowUUID
+	if runs := session.Runs(); len(priorities.TransactionalFlows) > 0 && len(runs) > 0 {
+		flow, err := oa.FlowByID(runs[0].FlowID())
+		if err != nil {
+			return "", errors.Wrapf(err, "error loading flow for msg priority")
+		}
+		flowUUID = flow.UUID()
+	}
+
+	return priorities.ClassFor(flowUUID, msg.IsResponse()), nil
+}
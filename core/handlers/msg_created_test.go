@@ -67,7 +67,7 @@ func TestMsgCreated(t *testing.T) {
 			SQLAssertions: []handlers.SQLAssertion{
 				{
 					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text='Hello World' AND contact_id = $1 AND metadata = $2 AND response_to_id = $3 AND high_priority = TRUE",
-					Args:  []interface{}{testdata.Cathy.ID, `{"quick_replies":["yes","no"]}`, msg1.ID()},
+					Args:  []interface{}{testdata.Cathy.ID, `{"quick_replies":["yes","no"],"segments":{"encoding":"gsm7","count":1}}`, msg1.ID()},
 					Count: 2,
 				},
 				{
@@ -110,6 +110,111 @@ func TestMsgCreated(t *testing.T) {
 	assert.Equal(t, 1, count)
 }
 
+func TestDuplicateMsgSuppression(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"duplicate_msg_window": 60}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	tcs := []handlers.TestCase{
+		{
+			Actions: handlers.ContactActionMap{
+				testdata.Cathy: []flows.Action{
+					actions.NewSendMsg(handlers.NewActionUUID(), "Are you there?", nil, nil, false),
+					actions.NewSendMsg(handlers.NewActionUUID(), "Are you there?", nil, nil, false),
+					actions.NewSendMsg(handlers.NewActionUUID(), "Are you there?", []string{"image/png:/images/image1.png"}, nil, false),
+				},
+				testdata.George: []flows.Action{
+					actions.NewSendMsg(handlers.NewActionUUID(), "Are you there?", nil, nil, false),
+				},
+			},
+			SQLAssertions: []handlers.SQLAssertion{
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Are you there?' AND contact_id = $1 AND direction = 'O' AND status = 'Q'",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 2,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Are you there?' AND contact_id = $1 AND direction = 'O' AND status = 'F' AND metadata->>'failed_reason' = 'U'",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 1,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Are you there?' AND contact_id = $1 AND direction = 'O' AND status = 'Q'",
+					Args:  []interface{}{testdata.George.ID},
+					Count: 1,
+				},
+			},
+		},
+		{
+			// later sends within the window are also suppressed
+			Actions: handlers.ContactActionMap{
+				testdata.Cathy: []flows.Action{
+					actions.NewSendMsg(handlers.NewActionUUID(), "Are you there?", nil, nil, false),
+				},
+			},
+			SQLAssertions: []handlers.SQLAssertion{
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Are you there?' AND contact_id = $1 AND direction = 'O' AND status = 'Q'",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 2,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Are you there?' AND contact_id = $1 AND direction = 'O' AND status = 'F' AND metadata->>'failed_reason' = 'U'",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 2,
+				},
+			},
+		},
+	}
+
+	handlers.RunTestCases(t, tcs)
+}
+
+func TestChannelStickiness(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"channel_stickiness": 3600}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	// cathy last messaged us on the vonage channel
+	_, err := rc.Do("SET", fmt.Sprintf("contact_last_channel:%d:%d", testdata.Org1.ID, testdata.Cathy.ID), string(testdata.VonageChannel.UUID))
+	assert.NoError(t, err)
+
+	tcs := []handlers.TestCase{
+		{
+			Actions: handlers.ContactActionMap{
+				testdata.Cathy: []flows.Action{
+					actions.NewSendMsg(handlers.NewActionUUID(), "Hi there", nil, nil, false),
+				},
+				testdata.George: []flows.Action{
+					actions.NewSendMsg(handlers.NewActionUUID(), "Hi there", nil, nil, false),
+				},
+			},
+			SQLAssertions: []handlers.SQLAssertion{
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Hi there' AND contact_id = $1 AND channel_id = $2",
+					Args:  []interface{}{testdata.Cathy.ID, testdata.VonageChannel.ID},
+					Count: 1,
+				},
+				{
+					SQL:   "SELECT COUNT(*) FROM msgs_msg WHERE text = 'Hi there' AND contact_id = $1 AND channel_id = $2",
+					Args:  []interface{}{testdata.George.ID, testdata.TwilioChannel.ID},
+					Count: 1,
+				},
+			},
+		},
+	}
+
+	handlers.RunTestCases(t, tcs)
+}
+
 func TestNoTopup(t *testing.T) {
 	testsuite.Reset()
 	db := testsuite.DB()
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/hooks"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	models.RegisterEventHandler(events.TypeMsgWait, handleMsgWait)
+}
+
+// handleMsgWait is called for each msg wait event, waits with timeouts get a timer so that short delays are precise, and
+// if session waits are scheduled in redis, all waits get timers for their timeouts and expirations
+func handleMsgWait(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scene *models.Scene, e flows.Event) error {
+	event := e.(*events.MsgWaitEvent)
+
+	if scene.Session() != nil && (event.TimeoutSeconds != nil || config.Mailroom.SessionWaits != config.SessionWaitsDB) {
+		scene.AppendToEventPostCommitHook(hooks.ScheduleSessionTimersHook, event)
+	}
+
+	return nil
+}
@@ -44,6 +44,7 @@ func handleTicketOpened(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *mo
 	)
 
 	scene.AppendToEventPreCommitHook(hooks.InsertTicketsHook, ticket)
+	scene.AppendToEventPostCommitHook(hooks.IndexTicketsHook, ticket)
 
 	logrus.WithFields(logrus.Fields{
 		"contact_uuid":  scene.ContactUUID(),
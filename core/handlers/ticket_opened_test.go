@@ -95,6 +95,16 @@ func TestTicketOpened(t *testing.T) {
 					SQL:   "select count(*) from tickets_ticketevent where event_type = 'O'",
 					Count: 2,
 				},
+				{ // and cathy's open ticket count includes her existing ticket
+					SQL:   "select count(*) from contacts_contact where id = $1 AND ticket_count = 2",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 1,
+				},
+				{ // and bob's has been updated too
+					SQL:   "select count(*) from contacts_contact where id = $1 AND ticket_count = 1",
+					Args:  []interface{}{testdata.Bob.ID},
+					Count: 1,
+				},
 			},
 		},
 	}
@@ -6,12 +6,16 @@ import (
 
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/hooks"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/utils/scope"
+	"github.com/nyaruka/mailroom/utils/tracing"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func init() {
@@ -30,6 +34,13 @@ func handleWebhookCalled(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *m
 		"resthook":     event.Resthook,
 	}).Debug("webhook called")
 
+	scope.AddCrumb(ctx, "http", "%s %d (%dms)", event.URL, event.StatusCode, event.ElapsedMS)
+
+	// the engine has already made this call so it's added to our trace after the fact
+	elapsed := time.Millisecond * time.Duration(event.ElapsedMS)
+	tracing.Record(ctx, "webhook", event.CreatedOn().Add(-elapsed), event.CreatedOn(),
+		attribute.String("http.url", event.URL), attribute.Int("http.status_code", event.StatusCode), attribute.String("status", string(event.Status)))
+
 	// if this was a resthook and the status was 410, that means we should remove it
 	if event.Status == flows.CallStatusSubscriberGone {
 		unsub := &models.ResthookUnsubscribe{
@@ -52,9 +63,19 @@ func handleWebhookCalled(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *m
 		oa.OrgID(), scene.ContactID(),
 		event.URL, event.Request,
 		event.StatusCode, response,
-		time.Millisecond*time.Duration(event.ElapsedMS), event.CreatedOn(),
+		elapsed, event.CreatedOn(),
 	)
 	scene.AppendToEventPreCommitHook(hooks.InsertWebhookResultHook, result)
 
+	// if the call failed in a way that might succeed later, schedule a retry
+	if config.Mailroom.WebhooksDeferredRetries > 0 && event.Status != flows.CallStatusSuccess && models.ShouldRetryWebhook(event.StatusCode) {
+		retry := models.NewWebhookRetry(
+			oa.OrgID(), scene.ContactID(),
+			event.Resthook, event.URL, event.Request, event.StatusCode,
+			event.CreatedOn().Add(models.WebhookRetryBackoff(config.Mailroom, 0)),
+		)
+		scene.AppendToEventPreCommitHook(hooks.InsertWebhookRetryHook, retry)
+	}
+
 	return nil
 }
@@ -3,6 +3,7 @@ package handlers_test
 import (
 	"testing"
 
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
@@ -91,3 +92,51 @@ func TestWebhookCalled(t *testing.T) {
 
 	handlers.RunTestCases(t, tcs)
 }
+
+func TestWebhookCalledRetries(t *testing.T) {
+	testsuite.Reset()
+
+	config.Mailroom.WebhooksDeferredRetries = 3
+	defer func() { config.Mailroom.WebhooksDeferredRetries = 0 }()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"http://rapidpro.io/ok":          {httpx.NewMockResponse(200, nil, "OK")},
+		"http://rapidpro.io/unavailable": {httpx.NewMockResponse(503, nil, "Unavailable")},
+		"http://rapidpro.io/bad":         {httpx.NewMockResponse(400, nil, "Bad")},
+	}))
+
+	tcs := []handlers.TestCase{
+		{
+			Actions: handlers.ContactActionMap{
+				testdata.Cathy: []flows.Action{
+					actions.NewCallWebhook(handlers.NewActionUUID(), "GET", "http://rapidpro.io/ok", nil, "", ""),
+					actions.NewCallWebhook(handlers.NewActionUUID(), "POST", "http://rapidpro.io/unavailable", nil, `{"name": "Cathy"}`, ""),
+				},
+				testdata.George: []flows.Action{
+					actions.NewCallWebhook(handlers.NewActionUUID(), "GET", "http://rapidpro.io/bad", nil, "", ""),
+				},
+			},
+			SQLAssertions: []handlers.SQLAssertion{
+				{
+					SQL:   "select count(*) from api_webhookresult where contact_id = $1",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 2,
+				},
+				{
+					SQL:   "select count(*) from api_webhookretry where contact_id = $1 AND url = 'http://rapidpro.io/unavailable' AND status = 'P' AND attempts = 0 AND last_status_code = 503 AND next_attempt_on > NOW()",
+					Args:  []interface{}{testdata.Cathy.ID},
+					Count: 1,
+				},
+				{
+					SQL:   "select count(*) from api_webhookretry",
+					Args:  nil,
+					Count: 1,
+				},
+			},
+		},
+	}
+
+	handlers.RunTestCases(t, tcs)
+}
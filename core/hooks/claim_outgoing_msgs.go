@@ -0,0 +1,30 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// ClaimOutgoingMsgsHook is our hook for claiming committed outgoing messages so that duplicates of them are suppressed
+var ClaimOutgoingMsgsHook models.EventCommitHook = &claimOutgoingMsgsHook{}
+
+type claimOutgoingMsgsHook struct{}
+
+// Apply makes the claims of all our scenes
+func (h *claimOutgoingMsgsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	claims := make([]*models.OutgoingMsgClaim, 0, len(scenes))
+	for _, es := range scenes {
+		for _, e := range es {
+			claims = append(claims, e.(*models.OutgoingMsgClaim))
+		}
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	return models.ClaimOutgoingMsgs(rc, claims)
+}
@@ -0,0 +1,50 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/groups"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// FireGroupChangesHook is our hook for notifying the org's resthook of contacts entering or leaving dynamic groups
+var FireGroupChangesHook models.EventCommitHook = &fireGroupChangesHook{}
+
+type fireGroupChangesHook struct{}
+
+// Apply collects the group changes across all our scenes into a single notification for each group
+func (h *fireGroupChangesHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	byGroup := make(map[models.GroupID]*models.GroupMembershipChanges)
+	changes := make([]*models.GroupMembershipChanges, 0)
+
+	forGroup := func(groupID models.GroupID) *models.GroupMembershipChanges {
+		c := byGroup[groupID]
+		if c == nil {
+			c = &models.GroupMembershipChanges{GroupID: groupID, Entered: []models.ContactID{}, Left: []models.ContactID{}}
+			byGroup[groupID] = c
+			changes = append(changes, c)
+		}
+		return c
+	}
+
+	for _, es := range scenes {
+		for _, e := range es {
+			switch change := e.(type) {
+			case *models.GroupAdd:
+				c := forGroup(change.GroupID)
+				c.Entered = append(c.Entered, change.ContactID)
+			case *models.GroupRemove:
+				c := forGroup(change.GroupID)
+				c.Left = append(c.Left, change.ContactID)
+			}
+		}
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	return groups.QueueFireGroupChanges(rc, oa, changes)
+}
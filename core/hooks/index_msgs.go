@@ -0,0 +1,31 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// IndexMsgsHook is our hook for queuing the indexing of new messages
+var IndexMsgsHook models.EventCommitHook = &indexMsgsHook{}
+
+type indexMsgsHook struct{}
+
+// Apply queues all the messages created across our scenes for indexing
+func (h *indexMsgsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	ids := make([]models.MsgID, 0, len(scenes))
+	for _, ms := range scenes {
+		for _, m := range ms {
+			ids = append(ids, models.MsgID(m.(*models.Msg).ID()))
+		}
+	}
+
+	return indexing.QueueIndexMsgs(rc, ids)
+}
@@ -0,0 +1,31 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// IndexTicketsHook is our hook for queuing the indexing of new tickets
+var IndexTicketsHook models.EventCommitHook = &indexTicketsHook{}
+
+type indexTicketsHook struct{}
+
+// Apply queues a single indexing task for all the tickets opened across our scenes
+func (h *indexTicketsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	tickets := make([]*models.Ticket, 0, len(scenes))
+	for _, ts := range scenes {
+		for _, t := range ts {
+			tickets = append(tickets, t.(*models.Ticket))
+		}
+	}
+
+	return indexing.QueueIndexTickets(rc, oa.OrgID(), tickets)
+}
@@ -0,0 +1,29 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// InsertChannelEventsHook is our hook for inserting channel events created by handlers
+var InsertChannelEventsHook models.EventCommitHook = &insertChannelEventsHook{}
+
+type insertChannelEventsHook struct{}
+
+// Apply inserts all the channel events that were created
+func (h *insertChannelEventsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	for _, es := range scenes {
+		for _, e := range es {
+			if err := e.(*models.ChannelEvent).Insert(ctx, tx); err != nil {
+				return errors.Wrapf(err, "error inserting channel event")
+			}
+		}
+	}
+
+	return nil
+}
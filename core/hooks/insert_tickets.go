@@ -34,8 +34,10 @@ func (h *insertTicketsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Po
 
 	// generate opened events for each ticket
 	openEvents := make([]*models.TicketEvent, len(tickets))
+	contactIDs := make([]models.ContactID, len(tickets))
 	for i, t := range tickets {
 		openEvents[i] = models.NewTicketEvent(oa.OrgID(), models.NilUserID, t.ContactID(), t.ID(), models.TicketEventTypeOpened)
+		contactIDs[i] = t.ContactID()
 	}
 
 	// and insert those too
@@ -44,5 +46,11 @@ func (h *insertTicketsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Po
 		return errors.Wrapf(err, "error inserting ticket opened events")
 	}
 
+	// and update the open ticket counts of their contacts
+	err = models.UpdateContactTicketCounts(ctx, tx, contactIDs)
+	if err != nil {
+		return errors.Wrapf(err, "error updating contact ticket counts")
+	}
+
 	return nil
 }
@@ -0,0 +1,34 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// InsertWebhookRetryHook is our hook for inserting retries of failed webhook calls
+var InsertWebhookRetryHook models.EventCommitHook = &insertWebhookRetryHook{}
+
+type insertWebhookRetryHook struct{}
+
+// Apply inserts all the webhook retries that were created
+func (h *insertWebhookRetryHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	retries := make([]*models.WebhookRetry, 0, len(scenes))
+	for _, rs := range scenes {
+		for _, r := range rs {
+			retries = append(retries, r.(*models.WebhookRetry))
+		}
+	}
+
+	err := models.InsertWebhookRetries(ctx, tx, config.Mailroom, retries)
+	if err != nil {
+		return errors.Wrapf(err, "error inserting webhook retries")
+	}
+
+	return nil
+}
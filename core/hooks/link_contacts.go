@@ -0,0 +1,66 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LinkContactsHook is our hook to link contacts which are given the same value of a field the org links contacts on
+var LinkContactsHook models.EventCommitHook = &linkContactsHook{}
+
+type linkContactsHook struct{}
+
+// Apply links the contacts in the passed in scenes to any other contacts with the same values of linking fields
+func (h *linkContactsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	linking := oa.Org().IdentityLinking()
+	if linking == nil {
+		return nil
+	}
+
+	for scene, es := range scenes {
+		// only the last value of each field matters
+		values := make(map[*models.Field]string, len(es))
+		for _, e := range es {
+			event := e.(*events.ContactFieldChangedEvent)
+			field := oa.FieldByKey(event.Field.Key)
+			if field == nil || !linking.LinksOnField(field.Key()) {
+				continue
+			}
+
+			if event.Value != nil {
+				values[field] = event.Value.Text.Native()
+			} else {
+				delete(values, field)
+			}
+		}
+
+		for field, value := range values {
+			others, err := models.FindContactsToLinkOnField(ctx, tx, oa.OrgID(), scene.ContactID(), field, value)
+			if err != nil {
+				return err
+			}
+			if len(others) == 0 {
+				continue
+			}
+
+			if err := models.LinkContacts(ctx, tx, oa.OrgID(), scene.ContactID(), others, models.ContactLinkMethodField); err != nil {
+				return errors.Wrapf(err, "error linking contacts on field: %s", field.Key())
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"contact_uuid": scene.ContactUUID(),
+				"field_key":    field.Key(),
+				"linked":       len(others),
+			}).Debug("linked contacts on field value")
+		}
+	}
+
+	return nil
+}
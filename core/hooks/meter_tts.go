@@ -0,0 +1,33 @@
+package hooks
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/usage"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// MeterTTSHook is our hook for metering the characters of IVR messages which are spoken using text-to-speech
+var MeterTTSHook models.EventCommitHook = &meterTTSHook{}
+
+type meterTTSHook struct{}
+
+// Apply meters the characters across all our scenes as a single usage of the org
+func (h *meterTTSHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	chars := 0
+	for _, es := range scenes {
+		for _, e := range es {
+			chars += utf8.RuneCountInString(e.(*events.IVRCreatedEvent).Msg.Text())
+		}
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	return usage.Meter(rc, oa, models.UsageTypeTTSChars, int64(chars))
+}
@@ -0,0 +1,60 @@
+package hooks
+
+import (
+	"context"
+	"sort"
+
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// RecordContactChangesHook is our hook for queuing contact changes for delivery to the org's contact webhook
+var RecordContactChangesHook models.EventCommitHook = &recordContactChangesHook{}
+
+type recordContactChangesHook struct{}
+
+// Apply records a single change for each contact with all the attributes that changed
+func (h *recordContactChangesHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	if oa.Org().ContactWebhook() == nil {
+		return nil
+	}
+
+	changes := make([]*models.ContactChange, 0, len(scenes))
+
+	for scene, es := range scenes {
+		changed := make(map[string]bool)
+
+		for _, e := range es {
+			switch event := e.(type) {
+			case *events.ContactNameChangedEvent:
+				changed["name"] = true
+			case *events.ContactLanguageChangedEvent:
+				changed["language"] = true
+			case *events.ContactStatusChangedEvent:
+				changed["status"] = true
+			case *events.ContactURNsChangedEvent:
+				changed["urns"] = true
+			case *events.ContactGroupsChangedEvent:
+				changed["groups"] = true
+			case *events.ContactFieldChangedEvent:
+				changed["fields."+event.Field.Key] = true
+			}
+		}
+
+		attrs := make([]string, 0, len(changed))
+		for attr := range changed {
+			attrs = append(attrs, attr)
+		}
+		sort.Strings(attrs)
+
+		changes = append(changes, models.NewContactChange(models.ContactChangeTypeUpdated, scene.ContactUUID(), attrs))
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	return models.RecordContactChanges(rc, oa, changes)
+}
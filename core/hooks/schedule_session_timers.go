@@ -0,0 +1,34 @@
+package hooks
+
+import (
+	"context"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// ScheduleSessionTimersHook is our hook for scheduling timers for waiting sessions
+var ScheduleSessionTimersHook models.EventCommitHook = &scheduleSessionTimersHook{}
+
+type scheduleSessionTimersHook struct{}
+
+// Apply schedules timers for the timeout of each scene's session and the expirations of its runs
+func (h *scheduleSessionTimersHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	for scene := range scenes {
+		if _, err := scene.Session().ScheduleTimer(rc, config.Mailroom); err != nil {
+			return errors.Wrapf(err, "error scheduling session timer")
+		}
+		if err := scene.Session().ScheduleExpirations(rc, config.Mailroom); err != nil {
+			return errors.Wrapf(err, "error scheduling expiration timers")
+		}
+	}
+
+	return nil
+}
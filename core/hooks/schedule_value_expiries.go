@@ -0,0 +1,92 @@
+package hooks
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+)
+
+// ScheduleValueExpiriesHook is our hook to schedule the expiry of temporary field values and group memberships
+var ScheduleValueExpiriesHook models.EventCommitHook = &scheduleValueExpiriesHook{}
+
+type scheduleValueExpiriesHook struct{}
+
+// Apply schedules expiries for temporary values which have been set and cancels them for values which have been cleared
+func (h *scheduleValueExpiriesHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
+	temporary := oa.Org().TemporaryValues()
+	if temporary == nil {
+		return nil
+	}
+
+	now := dates.Now()
+	schedules := make([]*models.ValueExpiry, 0, len(scenes))
+	cancels := make([]*models.ValueExpiry, 0, len(scenes))
+
+	for scene, es := range scenes {
+		// only the last change to each value matters, which is a nil TTL if the value was cleared
+		type value struct {
+			typ    models.ValueExpiryType
+			itemID int
+		}
+		ttls := make(map[value]*time.Duration)
+
+		for _, e := range es {
+			switch event := e.(type) {
+			case *events.ContactFieldChangedEvent:
+				field := oa.FieldByKey(event.Field.Key)
+				if field == nil {
+					continue
+				}
+				if ttl := temporary.FieldTTL(field.Key()); ttl > 0 {
+					v := value{models.ValueExpiryTypeField, int(field.ID())}
+					if event.Value != nil {
+						ttls[v] = &ttl
+					} else {
+						ttls[v] = nil
+					}
+				}
+			case *models.GroupAdd:
+				group := oa.GroupByID(event.GroupID)
+				if group == nil {
+					continue
+				}
+				if ttl := temporary.GroupTTL(group.UUID()); ttl > 0 {
+					ttls[value{models.ValueExpiryTypeGroup, int(group.ID())}] = &ttl
+				}
+			case *models.GroupRemove:
+				group := oa.GroupByID(event.GroupID)
+				if group == nil {
+					continue
+				}
+				if temporary.GroupTTL(group.UUID()) > 0 {
+					ttls[value{models.ValueExpiryTypeGroup, int(group.ID())}] = nil
+				}
+			}
+		}
+
+		for v, ttl := range ttls {
+			expiry := &models.ValueExpiry{OrgID: oa.OrgID(), ContactID: scene.ContactID(), Type: v.typ, ItemID: v.itemID}
+			if ttl != nil {
+				expiry.ExpiresOn = now.Add(*ttl)
+				schedules = append(schedules, expiry)
+			} else {
+				cancels = append(cancels, expiry)
+			}
+		}
+	}
+
+	if len(schedules) == 0 && len(cancels) == 0 {
+		return nil
+	}
+
+	if err := models.ScheduleValueExpiries(ctx, tx, schedules); err != nil {
+		return err
+	}
+	return models.CancelValueExpiries(ctx, tx, cancels)
+}
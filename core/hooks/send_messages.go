@@ -3,11 +3,13 @@ package hooks
 import (
 	"context"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
 // SendMessagesHook is our hook for sending scene messages
@@ -35,6 +37,15 @@ func (h *sendMessagesHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Poo
 		msgs = append(msgs, sceneMsgs...)
 	}
 
+	// messages on channels being warmed up may need to wait for a later day's send cap, which we only reserve now that
+	// they've been committed
+	rc := rp.Get()
+	err := models.ApplyChannelWarmups(ctx, tx, rc, msgs, dates.Now())
+	rc.Close()
+	if err != nil {
+		return errors.Wrapf(err, "error applying channel warmups")
+	}
+
 	msgio.SendMessages(ctx, tx, rp, nil, msgs)
 	return nil
 }
@@ -41,7 +41,7 @@ func (h *startBroadcastsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.
 				priority = queue.HighPriority
 			}
 
-			err = queue.AddTask(rc, taskQ, queue.SendBroadcast, int(oa.OrgID()), bcast, priority)
+			err = queue.AddTracedTask(ctx, rc, taskQ, queue.SendBroadcast, int(oa.OrgID()), bcast, priority)
 			if err != nil {
 				return errors.Wrapf(err, "error queuing broadcast")
 			}
@@ -35,7 +35,7 @@ func (h *startStartHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool,
 				priority = queue.HighPriority
 			}
 
-			err := queue.AddTask(rc, taskQ, queue.StartFlow, int(oa.OrgID()), start, priority)
+			err := queue.AddTracedTask(ctx, rc, taskQ, queue.StartFlow, int(oa.OrgID()), start, priority)
 			if err != nil {
 				return errors.Wrapf(err, "error queuing flow start")
 			}
@@ -54,8 +54,11 @@ func (h *updateCampaignEventsHook) Apply(ctx context.Context, tx *sqlx.Tx, rp *r
 				fieldChanges[field.ID()] = true
 
 			case *events.MsgReceivedEvent:
+				// receiving a message updates last_seen_on, which older orgs may not have as a system field
 				field := oa.FieldByKey(models.LastSeenOnKey)
-				fieldChanges[field.ID()] = true
+				if field != nil {
+					fieldChanges[field.ID()] = true
+				}
 			}
 		}
 
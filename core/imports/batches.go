@@ -0,0 +1,70 @@
+package imports
+
+import (
+	"io"
+	"strings"
+
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/pkg/errors"
+)
+
+// ReadHeaders reads the header row of an import file and maps it to contact properties
+func ReadHeaders(oa *models.OrgAssets, r RowReader) ([]string, *Mapping, error) {
+	headers, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("import file is empty")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return headers, MapHeaders(oa, headers), nil
+}
+
+// ReadBatches reads the rows which follow the header row of an import file, converting them to contact specs which are
+// passed to the given callback in batches, along with the index of the first record in each batch. Blank rows aren't
+// records and are skipped. It returns the total number of records.
+func ReadBatches(r RowReader, mapping *Mapping, batchSize int, callback func([]*models.ContactSpec, int) error) (int, error) {
+	batch := make([]*models.ContactSpec, 0, batchSize)
+	numRecords := 0
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return numRecords, err
+		}
+
+		if isBlankRow(row) {
+			continue
+		}
+
+		batch = append(batch, mapping.Spec(row))
+		numRecords++
+
+		if len(batch) == batchSize {
+			if err := callback(batch, numRecords-len(batch)); err != nil {
+				return numRecords, err
+			}
+			batch = make([]*models.ContactSpec, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := callback(batch, numRecords-len(batch)); err != nil {
+			return numRecords, err
+		}
+	}
+
+	return numRecords, nil
+}
+
+func isBlankRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package imports
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+)
+
+// ColumnType is the contact property that a column of an import file is mapped to
+type ColumnType string
+
+// column types
+const (
+	ColumnTypeUUID     = ColumnType("uuid")
+	ColumnTypeName     = ColumnType("name")
+	ColumnTypeLanguage = ColumnType("language")
+	ColumnTypeURN      = ColumnType("urn")
+	ColumnTypeField    = ColumnType("field")
+	ColumnTypeIgnore   = ColumnType("ignore")
+)
+
+// Column is the mapping of a column of an import file to a contact property
+type Column struct {
+	Header    string     `json:"header"`
+	Type      ColumnType `json:"type"`
+	Scheme    string     `json:"scheme,omitempty"`     // for URN columns
+	FieldKey  string     `json:"field_key,omitempty"`  // for field columns
+	FieldName string     `json:"field_name,omitempty"` // for field columns
+	NewField  bool       `json:"new_field,omitempty"`  // whether the field doesn't exist yet
+}
+
+// Mapping is the mapping of the columns of an import file to contact properties
+type Mapping struct {
+	Columns []*Column `json:"columns"`
+}
+
+// the maximum length of a field key, and what we strip from field names to make keys
+const maxFieldKeyLength = 36
+
+var fieldKeyInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// MapHeaders maps the header row of an import file to contact properties:
+//
+//   * UUID or Contact UUID is the UUID of an existing contact
+//   * Name or Contact Name is the contact's name
+//   * Language is the contact's language
+//   * URN:<scheme>, a URN scheme like tel, or Phone is a URN of that scheme
+//   * Field:<key or name>, or the key or name of an existing field, is a field value, and if the field doesn't exist yet
+//     it's a new field with a key suggested by its name
+//
+// Anything else is ignored, as are any columns which repeat a property which can only have one value.
+func MapHeaders(oa *models.OrgAssets, headers []string) *Mapping {
+	fieldsByKey := make(map[string]*models.Field)
+	fieldsByName := make(map[string]*models.Field)
+	fields, _ := oa.Fields()
+	for _, f := range fields {
+		field := f.(*models.Field)
+		fieldsByKey[strings.ToLower(field.Key())] = field
+		fieldsByName[strings.ToLower(field.Name())] = field
+	}
+
+	mapped := make(map[string]bool, len(headers))
+	mapping := &Mapping{Columns: make([]*Column, len(headers))}
+
+	for i, header := range headers {
+		column := mapHeader(strings.TrimSpace(header), fieldsByKey, fieldsByName)
+		column.Header = header
+
+		// only URNs can have more than one column
+		if column.Type != ColumnTypeURN && column.Type != ColumnTypeIgnore {
+			property := string(column.Type) + ":" + column.FieldKey
+			if mapped[property] {
+				column = &Column{Header: header, Type: ColumnTypeIgnore}
+			}
+			mapped[property] = true
+		}
+
+		mapping.Columns[i] = column
+	}
+
+	return mapping
+}
+
+func mapHeader(header string, fieldsByKey, fieldsByName map[string]*models.Field) *Column {
+	lower := strings.ToLower(header)
+
+	switch lower {
+	case "uuid", "contact uuid":
+		return &Column{Type: ColumnTypeUUID}
+	case "name", "contact name":
+		return &Column{Type: ColumnTypeName}
+	case "language":
+		return &Column{Type: ColumnTypeLanguage}
+	case "phone":
+		return &Column{Type: ColumnTypeURN, Scheme: urns.TelScheme}
+	}
+
+	if strings.HasPrefix(lower, "urn:") {
+		scheme := strings.TrimSpace(lower[4:])
+		if urns.ValidSchemes[scheme] {
+			return &Column{Type: ColumnTypeURN, Scheme: scheme}
+		}
+		return &Column{Type: ColumnTypeIgnore}
+	}
+	if urns.ValidSchemes[lower] {
+		return &Column{Type: ColumnTypeURN, Scheme: lower}
+	}
+
+	isField := strings.HasPrefix(lower, "field:")
+	name := header
+	if isField {
+		name = strings.TrimSpace(header[6:])
+		lower = strings.ToLower(name)
+	}
+
+	if field := fieldsByKey[lower]; field != nil {
+		return &Column{Type: ColumnTypeField, FieldKey: field.Key(), FieldName: field.Name()}
+	}
+	if field := fieldsByName[lower]; field != nil {
+		return &Column{Type: ColumnTypeField, FieldKey: field.Key(), FieldName: field.Name()}
+	}
+	if isField && name != "" {
+		return &Column{Type: ColumnTypeField, FieldKey: FieldKeyForName(name), FieldName: name, NewField: true}
+	}
+
+	return &Column{Type: ColumnTypeIgnore}
+}
+
+// FieldKeyForName suggests a key for a new field with the given name
+func FieldKeyForName(name string) string {
+	key := strings.Trim(fieldKeyInvalidChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if len(key) > maxFieldKeyLength {
+		key = strings.TrimRight(key[:maxFieldKeyLength], "_")
+	}
+	return key
+}
+
+// Spec converts a row of an import file to a contact spec. Blank cells are ignored rather than clearing values.
+func (m *Mapping) Spec(row []string) *models.ContactSpec {
+	spec := &models.ContactSpec{URNs: []urns.URN{}, Fields: map[string]string{}}
+
+	for i, column := range m.Columns {
+		if i >= len(row) {
+			break
+		}
+		value := strings.TrimSpace(row[i])
+		if value == "" {
+			continue
+		}
+
+		switch column.Type {
+		case ColumnTypeUUID:
+			spec.UUID = flows.ContactUUID(strings.ToLower(value))
+		case ColumnTypeName:
+			spec.Name = &value
+		case ColumnTypeLanguage:
+			lang := strings.ToLower(value)
+			spec.Language = &lang
+		case ColumnTypeURN:
+			// URNs are normalized and validated when they're imported
+			spec.URNs = append(spec.URNs, urns.URN(fmt.Sprintf("%s:%s", column.Scheme, value)))
+		case ColumnTypeField:
+			spec.Fields[column.FieldKey] = value
+		}
+	}
+
+	return spec
+}
@@ -0,0 +1,102 @@
+package imports_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/imports"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapHeaders(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	mapping := imports.MapHeaders(oa, []string{
+		"Contact UUID", "Name", "Phone", "URN:Twitter", "whatsapp", "URN:Pigeon", "Language",
+		"Field:Age", "gender", "Joined", "Field:Favorite Color", "Notes", "Contact Name", " Field: ", "URN:Tel",
+	})
+
+	assert.Equal(t, []*imports.Column{
+		{Header: "Contact UUID", Type: imports.ColumnTypeUUID},
+		{Header: "Name", Type: imports.ColumnTypeName},
+		{Header: "Phone", Type: imports.ColumnTypeURN, Scheme: "tel"},
+		{Header: "URN:Twitter", Type: imports.ColumnTypeURN, Scheme: "twitter"},
+		{Header: "whatsapp", Type: imports.ColumnTypeURN, Scheme: "whatsapp"},
+		{Header: "URN:Pigeon", Type: imports.ColumnTypeIgnore},
+		{Header: "Language", Type: imports.ColumnTypeLanguage},
+		{Header: "Field:Age", Type: imports.ColumnTypeField, FieldKey: "age", FieldName: "Age"},
+		{Header: "gender", Type: imports.ColumnTypeField, FieldKey: "gender", FieldName: "Gender"},
+		{Header: "Joined", Type: imports.ColumnTypeField, FieldKey: "joined", FieldName: "Joined"},
+		{Header: "Field:Favorite Color", Type: imports.ColumnTypeField, FieldKey: "favorite_color", FieldName: "Favorite Color", NewField: true},
+		{Header: "Notes", Type: imports.ColumnTypeIgnore},
+		{Header: "Contact Name", Type: imports.ColumnTypeIgnore},
+		{Header: " Field: ", Type: imports.ColumnTypeIgnore},
+		{Header: "URN:Tel", Type: imports.ColumnTypeURN, Scheme: "tel"},
+	}, mapping.Columns)
+
+	assert.Equal(t, "favorite_color", imports.FieldKeyForName(" Favorite  Color! "))
+	assert.Equal(t, "a_really_long_field_name_which_is_to", imports.FieldKeyForName("A really long field name which is too long to be a key"))
+}
+
+func TestReadBatches(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	for _, format := range []imports.Format{imports.FormatCSV, imports.FormatXLSX} {
+		r := openReader(t, "testdata/contacts."+string(format), format)
+
+		headers, mapping, err := imports.ReadHeaders(oa, r)
+		require.NoError(t, err)
+		assert.Equal(t, 6, len(headers))
+		assert.Equal(t, 6, len(mapping.Columns))
+
+		batches := make([][]*models.ContactSpec, 0)
+		starts := make([]int, 0)
+
+		numRecords, err := imports.ReadBatches(r, mapping, 2, func(specs []*models.ContactSpec, start int) error {
+			batches = append(batches, specs)
+			starts = append(starts, start)
+			return nil
+		})
+		require.NoError(t, err, "error reading %s", format)
+		require.NoError(t, r.Close())
+
+		// blank row isn't a record
+		assert.Equal(t, 3, numRecords, "record count mismatch for %s", format)
+		assert.Equal(t, []int{0, 2}, starts)
+		require.Equal(t, 2, len(batches))
+		assert.Equal(t, 2, len(batches[0]))
+		assert.Equal(t, 1, len(batches[1]))
+
+		norbert := batches[0][0]
+		assert.Equal(t, "Norbert", *norbert.Name)
+		assert.Equal(t, []urns.URN{"tel:16055740001"}, norbert.URNs)
+		assert.Equal(t, map[string]string{"age": "32", "joined": "2021-01-01", "favorite_color": "Blue"}, norbert.Fields)
+
+		leah := batches[0][1]
+		assert.Equal(t, "Leah", *leah.Name)
+		assert.Equal(t, []urns.URN{"tel:16055740002"}, leah.URNs)
+		assert.Equal(t, map[string]string{"joined": "2021-01-01 12:00:00"}, leah.Fields)
+
+		nameless := batches[1][0]
+		assert.Nil(t, nameless.Name)
+		assert.Equal(t, []urns.URN{}, nameless.URNs)
+		assert.Equal(t, map[string]string{"age": "41.5"}, nameless.Fields)
+	}
+
+	_, _, err = imports.ReadHeaders(oa, imports.NewCSVReader(strings.NewReader("")))
+	assert.EqualError(t, err, "import file is empty")
+}
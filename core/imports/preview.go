@@ -0,0 +1,185 @@
+package imports
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the number of records included in previews so users can check they're being mapped correctly
+	previewSampleSize = 5
+
+	// the number of records previewed at a time
+	previewBatchSize = 100
+
+	// the maximum number of record errors included in previews
+	previewMaxErrors = 100
+)
+
+// FileError is an error with the contents of an import file rather than with importing them
+type FileError struct {
+	msg string
+}
+
+func newFileError(err error) *FileError {
+	return &FileError{msg: err.Error()}
+}
+
+func (e *FileError) Error() string { return e.msg }
+
+// IsFileError returns whether the given error is an error with the contents of an import file
+func IsFileError(err error) (bool, *FileError) {
+	fe, ok := errors.Cause(err).(*FileError)
+	return ok, fe
+}
+
+// PreviewColumn is the proposed mapping of a column of an import file, and for ignored columns, a new field which it
+// could be mapped to instead
+type PreviewColumn struct {
+	*Column
+	Suggested *Column `json:"suggested,omitempty"`
+}
+
+// Preview is what importing a file would do, without creating or updating any contacts
+type Preview struct {
+	Columns    []*PreviewColumn             `json:"columns"`
+	Sample     [][]string                   `json:"sample"`
+	NumRecords int                          `json:"num_records"`
+	NumCreated int                          `json:"num_created"`
+	NumUpdated int                          `json:"num_updated"`
+	NumErrored int                          `json:"num_errored"`
+	Errors     []*models.ContactImportError `json:"errors"`
+}
+
+// PreviewFile reads an entire import file, proposing a mapping of its columns and working out what importing its
+// records with that mapping would do. Problems with the file itself are returned as file errors.
+func PreviewFile(ctx context.Context, db models.Queryer, oa *models.OrgAssets, r RowReader) (*Preview, error) {
+	headers, mapping, err := ReadHeaders(oa, r)
+	if err != nil {
+		return nil, newFileError(err)
+	}
+	if !mapping.hasIdentifier() {
+		return nil, newFileError(errors.New("import file must have a UUID or URN column"))
+	}
+
+	suggested := suggestFields(oa, mapping)
+	preview := &Preview{
+		Columns: make([]*PreviewColumn, len(headers)),
+		Sample:  make([][]string, 0, previewSampleSize),
+		Errors:  make([]*models.ContactImportError, 0),
+	}
+	for i, column := range mapping.Columns {
+		preview.Columns[i] = &PreviewColumn{Column: column, Suggested: suggested[i]}
+	}
+
+	// we need the sample rows as they are in the file, so we read them before they're converted to specs
+	sampler := &samplingReader{RowReader: r, sample: &preview.Sample}
+
+	// new fields don't exist yet so values for them can't be previewed
+	previewMapping := &Mapping{Columns: make([]*Column, len(mapping.Columns))}
+	for i, column := range mapping.Columns {
+		if column.NewField {
+			column = &Column{Header: column.Header, Type: ColumnTypeIgnore}
+		}
+		previewMapping.Columns[i] = column
+	}
+
+	// records are previewed in batches like they're imported, so only duplicates within a batch are spotted
+	var previewErr error
+	preview.NumRecords, err = ReadBatches(sampler, previewMapping, previewBatchSize, func(specs []*models.ContactSpec, recordStart int) error {
+		results, err := models.PreviewContactImport(ctx, db, oa, specs, recordStart)
+		if err != nil {
+			previewErr = err
+			return err
+		}
+
+		preview.NumCreated += results.NumCreated
+		preview.NumUpdated += results.NumUpdated
+		preview.NumErrored += results.NumErrored
+
+		for _, e := range results.Errors {
+			if len(preview.Errors) < previewMaxErrors {
+				preview.Errors = append(preview.Errors, e)
+			}
+		}
+		return nil
+	})
+
+	if previewErr != nil {
+		return nil, errors.Wrap(previewErr, "error previewing import")
+	} else if err != nil {
+		return nil, newFileError(err)
+	}
+
+	return preview, nil
+}
+
+// whether a mapping has a column which can identify existing contacts
+func (m *Mapping) hasIdentifier() bool {
+	for _, column := range m.Columns {
+		if column.Type == ColumnTypeUUID || column.Type == ColumnTypeURN {
+			return true
+		}
+	}
+	return false
+}
+
+// suggests new fields for ignored columns whose headers could be the names of fields, since users often forget the
+// Field: prefix
+func suggestFields(oa *models.OrgAssets, mapping *Mapping) []*Column {
+	taken := make(map[string]bool)
+	fields, _ := oa.Fields()
+	for _, f := range fields {
+		field := f.(*models.Field)
+		taken[field.Key()] = true
+		taken[strings.ToLower(field.Name())] = true
+	}
+	for _, column := range mapping.Columns {
+		if column.Type == ColumnTypeField {
+			taken[column.FieldKey] = true
+		}
+	}
+
+	suggested := make([]*Column, len(mapping.Columns))
+
+	for i, column := range mapping.Columns {
+		name := strings.TrimSpace(column.Header)
+		lower := strings.ToLower(name)
+
+		// headers with prefixes or which are property names were ignored for a reason
+		if column.Type != ColumnTypeIgnore || name == "" || strings.Contains(lower, ":") {
+			continue
+		}
+		if mapHeader(name, nil, nil).Type != ColumnTypeIgnore {
+			continue
+		}
+
+		key := FieldKeyForName(name)
+		if key == "" || taken[key] || taken[lower] {
+			continue
+		}
+		taken[key] = true
+
+		suggested[i] = &Column{Header: column.Header, Type: ColumnTypeField, FieldKey: key, FieldName: name, NewField: true}
+	}
+
+	return suggested
+}
+
+// a row reader which keeps a copy of the first non-blank rows it reads
+type samplingReader struct {
+	RowReader
+	sample *[][]string
+}
+
+func (r *samplingReader) Read() ([]string, error) {
+	row, err := r.RowReader.Read()
+	if err == nil && len(*r.sample) < previewSampleSize && !isBlankRow(row) {
+		*r.sample = append(*r.sample, row)
+	}
+	return row, err
+}
@@ -0,0 +1,100 @@
+package imports_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/imports"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewFile(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	csv := "UUID,Name,Phone,Age,Field:Favorite Color,Nickname,Contact Name,URN:Pigeon\n" +
+		",Cathy,+16055741111,40,Red,Cat,,\n" +
+		",,,,,,,\n" +
+		",Norbert,+16055740001,,Blue,,,\n" +
+		"68dc10e7-19ce-4052-b202-7c1b49e69ba0,,,,,,,\n" +
+		",Dupe,+16055740001,,,,,\n"
+
+	preview, err := imports.PreviewFile(ctx, db, oa, imports.NewCSVReader(strings.NewReader(csv)))
+	require.NoError(t, err)
+
+	assert.Equal(t, []*imports.PreviewColumn{
+		{Column: &imports.Column{Header: "UUID", Type: imports.ColumnTypeUUID}},
+		{Column: &imports.Column{Header: "Name", Type: imports.ColumnTypeName}},
+		{Column: &imports.Column{Header: "Phone", Type: imports.ColumnTypeURN, Scheme: "tel"}},
+		{Column: &imports.Column{Header: "Age", Type: imports.ColumnTypeField, FieldKey: "age", FieldName: "Age"}},
+		{Column: &imports.Column{Header: "Field:Favorite Color", Type: imports.ColumnTypeField, FieldKey: "favorite_color", FieldName: "Favorite Color", NewField: true}},
+		{
+			Column:    &imports.Column{Header: "Nickname", Type: imports.ColumnTypeIgnore},
+			Suggested: &imports.Column{Header: "Nickname", Type: imports.ColumnTypeField, FieldKey: "nickname", FieldName: "Nickname", NewField: true},
+		},
+		{Column: &imports.Column{Header: "Contact Name", Type: imports.ColumnTypeIgnore}},
+		{Column: &imports.Column{Header: "URN:Pigeon", Type: imports.ColumnTypeIgnore}},
+	}, preview.Columns)
+
+	// blank rows aren't records
+	assert.Equal(t, [][]string{
+		{"", "Cathy", "+16055741111", "40", "Red", "Cat", "", ""},
+		{"", "Norbert", "+16055740001", "", "Blue", "", "", ""},
+		{"68dc10e7-19ce-4052-b202-7c1b49e69ba0", "", "", "", "", "", "", ""},
+		{"", "Dupe", "+16055740001", "", "", "", "", ""},
+	}, preview.Sample)
+	assert.Equal(t, 4, preview.NumRecords)
+
+	// values for new fields aren't errors
+	assert.Equal(t, 1, preview.NumCreated)
+	assert.Equal(t, 2, preview.NumUpdated)
+	assert.Equal(t, 1, preview.NumErrored)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 2, Message: "Unable to find contact with UUID '68dc10e7-19ce-4052-b202-7c1b49e69ba0'"},
+		{Record: 3, Message: "Contact with URN 'tel:+16055740001' is also in record 1"},
+	}, preview.Errors)
+
+	// nothing was actually imported
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert'`, nil, 0)
+
+	// records in later batches are numbered from the start of the file
+	rows := []string{"Phone"}
+	for i := 0; i < 101; i++ {
+		rows = append(rows, fmt.Sprintf("+1605576%04d", i))
+	}
+	rows = append(rows, "+16055760100")
+
+	preview, err = imports.PreviewFile(ctx, db, oa, imports.NewCSVReader(strings.NewReader(strings.Join(rows, "\n"))))
+	require.NoError(t, err)
+	assert.Equal(t, 102, preview.NumRecords)
+	assert.Equal(t, 5, len(preview.Sample))
+	assert.Equal(t, 101, preview.NumCreated)
+	assert.Equal(t, 1, preview.NumUpdated)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 101, Message: "Contact with URN 'tel:+16055760100' is also in record 100"},
+	}, preview.Errors)
+
+	// problems with the file itself are file errors
+	for _, tc := range []struct {
+		csv string
+		err string
+	}{
+		{"", "import file is empty"},
+		{"Name,Age\nBob,32\n", "import file must have a UUID or URN column"},
+		{"Phone\n\"+16055741111\n", "error reading CSV row"},
+	} {
+		_, err := imports.PreviewFile(ctx, db, oa, imports.NewCSVReader(strings.NewReader(tc.csv)))
+		isFileError, ferr := imports.IsFileError(err)
+		assert.True(t, isFileError, "expected file error for %s", tc.csv)
+		assert.Contains(t, ferr.Error(), tc.err)
+	}
+}
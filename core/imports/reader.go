@@ -0,0 +1,72 @@
+// Package imports reads contact import files, mapping their columns to contact properties and converting their rows to
+// the contact specs of import batches.
+package imports
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Format is the format of an import file
+type Format string
+
+// supported import file formats
+const (
+	FormatCSV  = Format("csv")
+	FormatXLSX = Format("xlsx")
+)
+
+// RowReader reads the rows of an import file one at a time, so that files never need to be loaded into memory
+type RowReader interface {
+	// Read returns the cells of the next row, or io.EOF when there are no more rows
+	Read() ([]string, error)
+
+	Close() error
+}
+
+// NewReader creates a new reader for an import file of the given format
+func NewReader(r io.ReaderAt, size int64, format Format) (RowReader, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVReader(io.NewSectionReader(r, 0, size)), nil
+	case FormatXLSX:
+		return NewXLSXReader(r, size)
+	}
+	return nil, errors.Errorf("unsupported import format: %s", format)
+}
+
+type csvReader struct {
+	r     *csv.Reader
+	first bool
+}
+
+// NewCSVReader creates a new reader for a CSV import file
+func NewCSVReader(r io.Reader) RowReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = false
+
+	return &csvReader{r: cr, first: true}
+}
+
+func (r *csvReader) Read() ([]string, error) {
+	row, err := r.r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "error reading CSV row")
+	}
+
+	// strip any byte order mark written by Excel
+	if r.first && len(row) > 0 {
+		row[0] = strings.TrimPrefix(row[0], "\ufeff")
+		r.first = false
+	}
+	return row, nil
+}
+
+func (r *csvReader) Close() error { return nil }
@@ -0,0 +1,69 @@
+package imports_test
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/imports"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, r imports.RowReader) [][]string {
+	rows := make([][]string, 0)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+	require.NoError(t, r.Close())
+	return rows
+}
+
+func openReader(t *testing.T, path string, format imports.Format) imports.RowReader {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+
+	r, err := imports.NewReader(f, info.Size(), format)
+	require.NoError(t, err)
+	return r
+}
+
+func TestReaders(t *testing.T) {
+	header := []string{"Name", "URN:Tel", "Field:Age", "Joined", "Field:Favorite Color", "Notes"}
+
+	csvRows := readAll(t, openReader(t, "testdata/contacts.csv", imports.FormatCSV))
+	assert.Equal(t, [][]string{
+		header,
+		{"Norbert", "16055740001", "32", "2021-01-01", "Blue", "TRUE"},
+		{"", "", "", "", "", ""},
+		{"Leah", "16055740002", "", "2021-01-01 12:00:00", "", "VIP"},
+		{"", "", "41.5"},
+	}, csvRows)
+
+	// XLSX files omit empty cells and rows, numbers are formatted without exponents, and dates as ISO dates
+	xlsxRows := readAll(t, openReader(t, "testdata/contacts.xlsx", imports.FormatXLSX))
+	assert.Equal(t, [][]string{
+		header,
+		{"Norbert", "16055740001", "32", "2021-01-01", "Blue", "TRUE"},
+		{},
+		{"Leah", "16055740002", "", "2021-01-01 12:00:00", "", "VIP"},
+		{"", "", "41.5"},
+	}, xlsxRows)
+
+	_, err := imports.NewReader(strings.NewReader("a,b"), 3, imports.Format("xls"))
+	assert.EqualError(t, err, "unsupported import format: xls")
+
+	_, err = imports.NewReader(strings.NewReader("a,b"), 3, imports.FormatXLSX)
+	assert.EqualError(t, err, "error opening XLSX file: zip: not a valid zip file")
+}
@@ -0,0 +1,349 @@
+package imports
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// XLSX files are zip archives of XML parts. We read the shared strings and cell styles up front as rows refer to them,
+// but stream the rows of the first worksheet one at a time.
+
+const (
+	xlsxWorkbook      = "xl/workbook.xml"
+	xlsxWorkbookRels  = "xl/_rels/workbook.xml.rels"
+	xlsxSharedStrings = "xl/sharedStrings.xml"
+	xlsxStyles        = "xl/styles.xml"
+)
+
+type xlsxReader struct {
+	sheet   io.ReadCloser
+	decoder *xml.Decoder
+
+	strings    []string
+	dateStyles map[int]bool
+	date1904   bool
+}
+
+// NewXLSXReader creates a new reader for the first worksheet of an XLSX import file
+func NewXLSXReader(r io.ReaderAt, size int64) (RowReader, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening XLSX file")
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	sheetPath, date1904, err := readXLSXWorkbook(files)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &xlsxReader{date1904: date1904}
+
+	if f := files[xlsxSharedStrings]; f != nil {
+		if x.strings, err = readXLSXSharedStrings(f); err != nil {
+			return nil, err
+		}
+	}
+	if f := files[xlsxStyles]; f != nil {
+		if x.dateStyles, err = readXLSXDateStyles(f); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet := files[sheetPath]
+	if sheet == nil {
+		return nil, errors.Errorf("XLSX file is missing worksheet %s", sheetPath)
+	}
+	if x.sheet, err = sheet.Open(); err != nil {
+		return nil, errors.Wrap(err, "error opening XLSX worksheet")
+	}
+	x.decoder = xml.NewDecoder(x.sheet)
+
+	return x, nil
+}
+
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Style  int    `xml:"s,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"is"`
+}
+
+func (x *xlsxReader) Read() ([]string, error) {
+	// find the start of the next row
+	for {
+		token, err := x.decoder.Token()
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Wrap(err, "error reading XLSX worksheet")
+		}
+		if start, isStart := token.(xml.StartElement); isStart && start.Name.Local == "row" {
+			break
+		}
+	}
+
+	row := make([]string, 0, 10)
+
+	for {
+		token, err := x.decoder.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading XLSX row")
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				if err := x.decoder.Skip(); err != nil {
+					return nil, errors.Wrap(err, "error reading XLSX row")
+				}
+				continue
+			}
+
+			cell := &xlsxCell{}
+			if err := x.decoder.DecodeElement(cell, &t); err != nil {
+				return nil, errors.Wrap(err, "error reading XLSX cell")
+			}
+
+			// empty cells are usually omitted so use the cell reference to find its column
+			col := len(row)
+			if cell.Ref != "" {
+				col = xlsxColumn(cell.Ref)
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = x.cellValue(cell)
+
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				return row, nil
+			}
+		}
+	}
+}
+
+func (x *xlsxReader) Close() error {
+	return x.sheet.Close()
+}
+
+func (x *xlsxReader) cellValue(c *xlsxCell) string {
+	switch c.Type {
+	case "s":
+		i, err := strconv.Atoi(c.Value)
+		if err != nil || i < 0 || i >= len(x.strings) {
+			return ""
+		}
+		return x.strings[i]
+	case "inlineStr":
+		text := c.Inline.Text
+		for _, r := range c.Inline.Runs {
+			text += r.Text
+		}
+		return text
+	case "str":
+		return c.Value
+	case "b":
+		if c.Value == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "e":
+		return ""
+	}
+
+	// anything else is a number, which might be a date
+	num, err := strconv.ParseFloat(c.Value, 64)
+	if err != nil {
+		return c.Value
+	}
+	if x.dateStyles[c.Style] {
+		return xlsxDate(num, x.date1904)
+	}
+
+	// large numbers like phone numbers may be written in exponent form
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
+
+// converts a cell reference like AB12 to a zero based column index like 27
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A') + 1
+	}
+	return col - 1
+}
+
+// converts a date serial, the number of days since the epoch, to an ISO date, with the time if it has one
+func xlsxDate(serial float64, date1904 bool) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	days, frac := math.Modf(serial)
+	t := epoch.AddDate(0, 0, int(days)).Add(time.Duration(math.Round(frac*86400)) * time.Second)
+
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// finds the path of the first worksheet and whether dates use the 1904 epoch
+func readXLSXWorkbook(files map[string]*zip.File) (string, bool, error) {
+	workbook := &struct {
+		Properties struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}{}
+	if err := decodeXLSXPart(files[xlsxWorkbook], workbook); err != nil {
+		return "", false, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return "", false, errors.New("XLSX file has no worksheets")
+	}
+
+	rels := &struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}{}
+	if err := decodeXLSXPart(files[xlsxWorkbookRels], rels); err != nil {
+		return "", false, err
+	}
+
+	date1904 := workbook.Properties.Date1904 == "1" || workbook.Properties.Date1904 == "true"
+
+	for _, rel := range rels.Relationships {
+		if rel.ID == workbook.Sheets[0].RelID {
+			// targets are usually relative to the workbook but can be absolute
+			if strings.HasPrefix(rel.Target, "/") {
+				return strings.TrimPrefix(rel.Target, "/"), date1904, nil
+			}
+			return path.Join("xl", rel.Target), date1904, nil
+		}
+	}
+	return "", false, errors.New("XLSX file is missing its first worksheet")
+}
+
+// reads the table of strings which string cells refer to by index
+func readXLSXSharedStrings(f *zip.File) ([]string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening XLSX shared strings")
+	}
+	defer r.Close()
+
+	strs := make([]string, 0, 100)
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return strs, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "error reading XLSX shared strings")
+		}
+
+		if start, isStart := token.(xml.StartElement); isStart && start.Name.Local == "si" {
+			si := &struct {
+				Text string `xml:"t"`
+				Runs []struct {
+					Text string `xml:"t"`
+				} `xml:"r"`
+			}{}
+			if err := decoder.DecodeElement(si, &start); err != nil {
+				return nil, errors.Wrap(err, "error reading XLSX shared string")
+			}
+
+			text := si.Text
+			for _, r := range si.Runs {
+				text += r.Text
+			}
+			strs = append(strs, text)
+		}
+	}
+}
+
+// the built in number formats which are dates or times
+var xlsxBuiltinDateFormats = map[int]bool{
+	14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true,
+	27: true, 28: true, 29: true, 30: true, 31: true, 32: true, 33: true, 34: true, 35: true, 36: true,
+	45: true, 46: true, 47: true, 50: true, 51: true, 52: true, 53: true, 54: true, 55: true, 56: true, 57: true, 58: true,
+}
+
+// quoted literals, escaped characters and bracketed sections like colors, which can't make a format a date format
+var xlsxFormatLiterals = regexp.MustCompile(`"[^"]*"|\\.|\[[^\]]*\]`)
+
+// finds which cell styles format numbers as dates
+func readXLSXDateStyles(f *zip.File) (map[int]bool, error) {
+	styles := &struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}{}
+	if err := decodeXLSXPart(f, styles); err != nil {
+		return nil, err
+	}
+
+	dateFormats := make(map[int]bool, len(xlsxBuiltinDateFormats))
+	for id := range xlsxBuiltinDateFormats {
+		dateFormats[id] = true
+	}
+	for _, nf := range styles.NumFmts {
+		code := strings.ToLower(xlsxFormatLiterals.ReplaceAllString(nf.Code, ""))
+		dateFormats[nf.ID] = strings.ContainsAny(code, "ymdhs")
+	}
+
+	dateStyles := make(map[int]bool, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		if dateFormats[xf.NumFmtID] {
+			dateStyles[i] = true
+		}
+	}
+	return dateStyles, nil
+}
+
+func decodeXLSXPart(f *zip.File, v interface{}) error {
+	if f == nil {
+		return errors.New("XLSX file is missing a required part")
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "error opening XLSX part %s", f.Name)
+	}
+	defer r.Close()
+
+	return errors.Wrapf(xml.NewDecoder(r).Decode(v), "error reading XLSX part %s", f.Name)
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/runner"
 	"github.com/nyaruka/mailroom/runtime"
@@ -54,14 +55,14 @@ func RegisterClientType(channelType models.ChannelType, constructor ClientConstr
 	constructors[channelType] = constructor
 }
 
-// GetClient creates the right kind of IVRClient for the passed in channel
-func GetClient(channel *models.Channel) (Client, error) {
+// GetClient creates the right kind of IVRClient for the passed in channel of the passed in org
+func GetClient(oa *models.OrgAssets, channel *models.Channel) (Client, error) {
 	constructor := constructors[channel.Type()]
 	if constructor == nil {
 		return nil, errors.Errorf("no ivr client for channel type: %s", channel.Type())
 	}
 
-	return constructor(http.DefaultClient, channel)
+	return constructor(goflow.RegionalHTTP(config.Mailroom, http.DefaultClient, oa.Org().Region()), channel)
 }
 
 // Client defines the interface IVR clients must satisfy
@@ -111,7 +112,7 @@ func HangupCall(ctx context.Context, config *config.Config, db *sqlx.DB, conn *m
 	}
 
 	// create the right client
-	c, err := GetClient(channel)
+	c, err := GetClient(oa, channel)
 	if err != nil {
 		return errors.Wrapf(err, "unable to create ivr client")
 	}
@@ -145,6 +146,11 @@ func HangupCall(ctx context.Context, config *config.Config, db *sqlx.DB, conn *m
 
 // RequestCallStart creates a new ChannelSession for the passed in flow start and contact, returning the created session
 func RequestCallStart(ctx context.Context, config *config.Config, db *sqlx.DB, oa *models.OrgAssets, start *models.FlowStartBatch, contact *models.Contact) (*models.ChannelConnection, error) {
+	// we never call contacts who aren't active
+	if contact.Status() != models.ContactStatusActive {
+		return nil, nil
+	}
+
 	// find a tel URL for the contact
 	telURN := urns.NilURN
 	for _, u := range contact.URNs() {
@@ -199,10 +205,10 @@ func RequestCallStart(ctx context.Context, config *config.Config, db *sqlx.DB, o
 		return nil, errors.Wrapf(err, "error creating ivr session")
 	}
 
-	return conn, RequestCallStartForConnection(ctx, config, db, channel, telURN, conn)
+	return conn, RequestCallStartForConnection(ctx, config, db, oa, channel, telURN, conn)
 }
 
-func RequestCallStartForConnection(ctx context.Context, config *config.Config, db *sqlx.DB, channel *models.Channel, telURN urns.URN, conn *models.ChannelConnection) error {
+func RequestCallStartForConnection(ctx context.Context, config *config.Config, db *sqlx.DB, oa *models.OrgAssets, channel *models.Channel, telURN urns.URN, conn *models.ChannelConnection) error {
 	// the domain that will be used for callbacks, can be specific for channels due to white labeling
 	domain := channel.ConfigValue(models.ChannelConfigCallbackDomain, config.Domain)
 
@@ -242,7 +248,7 @@ func RequestCallStartForConnection(ctx context.Context, config *config.Config, d
 	statusURL := fmt.Sprintf("https://%s/mr/ivr/c/%s/status", domain, channel.UUID())
 
 	// create the right client
-	c, err := GetClient(channel)
+	c, err := GetClient(oa, channel)
 	if err != nil {
 		return errors.Wrapf(err, "unable to create ivr client")
 	}
@@ -294,6 +300,19 @@ func WriteErrorResponse(ctx context.Context, db *sqlx.DB, client Client, conn *m
 	return client.WriteErrorResponse(w, rootErr)
 }
 
+// locks the passed in contact so that we're not also handling a message or starting a flow for them. Providers don't
+// wait long for responses so neither do we.
+func lockContact(rt *runtime.Runtime, oa *models.OrgAssets, c *models.Contact) (*models.ContactLocks, error) {
+	locks, skipped, err := models.LockContacts(rt.RP, oa.OrgID(), []models.ContactID{c.ID()}, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	if len(skipped) > 0 {
+		return nil, errors.Errorf("timed out waiting for lock on contact %d", c.ID())
+	}
+	return locks, nil
+}
+
 // StartIVRFlow takes care of starting the flow in the passed in start for the passed in contact and URN
 func StartIVRFlow(
 	ctx context.Context, rt *runtime.Runtime, client Client, resumeURL string, oa *models.OrgAssets,
@@ -305,6 +324,12 @@ func StartIVRFlow(
 		return WriteErrorResponse(ctx, rt.DB, client, conn, w, errors.Errorf("connection in invalid state: %s", conn.Status()))
 	}
 
+	locks, err := lockContact(rt, oa, c)
+	if err != nil {
+		return WriteErrorResponse(ctx, rt.DB, client, conn, w, err)
+	}
+	defer locks.Release()
+
 	// get the flow for our start
 	start, err := models.GetFlowStartAttributes(ctx, rt.DB, startID)
 	if err != nil {
@@ -395,12 +420,18 @@ func ResumeIVRFlow(
 	oa *models.OrgAssets, channel *models.Channel, conn *models.ChannelConnection, c *models.Contact, urn urns.URN,
 	r *http.Request, w http.ResponseWriter) error {
 
+	locks, err := lockContact(rt, oa, c)
+	if err != nil {
+		return WriteErrorResponse(ctx, rt.DB, client, conn, w, err)
+	}
+	defer locks.Release()
+
 	contact, err := c.FlowContact(oa)
 	if err != nil {
 		return errors.Wrapf(err, "error creating flow contact")
 	}
 
-	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorage, oa, models.FlowTypeVoice, contact)
+	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorageFor(oa.Org().Region()), oa, models.FlowTypeVoice, contact)
 	if err != nil {
 		return errors.Wrapf(err, "error loading session for contact")
 	}
@@ -463,7 +494,7 @@ func ResumeIVRFlow(
 	var clientErr error
 	switch res := ivrResume.(type) {
 	case InputResume:
-		resume, clientErr, err = buildMsgResume(ctx, rt.Config, rt.DB, rt.RP, rt.MediaStorage, client, channel, contact, urn, conn, oa, r, res)
+		resume, clientErr, err = buildMsgResume(ctx, rt.Config, rt.DB, rt.RP, rt.MediaStorageFor(oa.Org().Region()), client, channel, contact, urn, conn, oa, r, res)
 
 	case DialResume:
 		resume, clientErr, err = buildDialResume(oa, contact, res)
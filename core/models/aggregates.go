@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// AggregateType is the type of an org aggregate
+type AggregateType string
+
+// aggregate types
+const (
+	AggregateTypeContacts      = AggregateType("contacts")
+	AggregateTypeGroupContacts = AggregateType("group_contacts")
+	AggregateTypeFlowRuns      = AggregateType("flow_runs")
+	AggregateTypeFlowResponses = AggregateType("flow_responses")
+)
+
+// aggregates are expensive to calculate so we cache them for a short time
+const (
+	aggregateCacheKey     = "aggregate:%d:%s"
+	aggregateCacheSeconds = 60
+)
+
+// Aggregate is a count of something in an org, e.g. the number of contacts in a group or the number of runs of a flow
+// since the start of the day
+type Aggregate struct {
+	Type    AggregateType
+	GroupID GroupID
+	FlowID  FlowID
+	Since   *time.Time
+}
+
+func (a *Aggregate) cacheKey(orgID OrgID) string {
+	since := int64(0)
+	if a.Since != nil {
+		since = a.Since.Unix()
+	}
+	return fmt.Sprintf(aggregateCacheKey, orgID, fmt.Sprintf("%s:%d:%d:%d", a.Type, a.GroupID, a.FlowID, since))
+}
+
+const countContactsSQL = `
+SELECT COALESCE(SUM(c.count), 0)
+  FROM contacts_contactgroupcount c
+  JOIN contacts_contactgroup g ON g.id = c.group_id
+ WHERE g.org_id = $1 AND g.group_type = 'A'`
+
+const countGroupContactsSQL = `SELECT COALESCE(SUM(count), 0) FROM contacts_contactgroupcount WHERE group_id = $1`
+
+const countFlowRunsSQL = `SELECT COALESCE(SUM(count), 0) FROM flows_flowruncount WHERE flow_id = $1`
+
+const countFlowRunsSinceSQL = `SELECT COUNT(*) FROM flows_flowrun WHERE flow_id = $1 AND created_on >= $2`
+
+const countFlowResponsesSQL = `
+SELECT COUNT(*)
+  FROM flows_flowrun
+ WHERE flow_id = $1 AND responded = TRUE AND ($2::timestamptz IS NULL OR created_on >= $2)`
+
+// GetAggregate gets the value of the given aggregate for an org, calculating it if it isn't cached
+func GetAggregate(ctx context.Context, db Queryer, rc redis.Conn, orgID OrgID, agg *Aggregate) (int64, error) {
+	key := agg.cacheKey(orgID)
+
+	count, err := redis.Int64(rc.Do("GET", key))
+	if err == nil {
+		return count, nil
+	}
+	if err != redis.ErrNil {
+		return 0, errors.Wrapf(err, "error reading cached aggregate")
+	}
+
+	if count, err = CalculateAggregate(ctx, db, orgID, agg); err != nil {
+		return 0, err
+	}
+
+	if _, err := rc.Do("SET", key, count, "EX", aggregateCacheSeconds); err != nil {
+		return 0, errors.Wrapf(err, "error caching aggregate")
+	}
+	return count, nil
+}
+
+// CalculateAggregate calculates the value of the given aggregate for an org
+func CalculateAggregate(ctx context.Context, db Queryer, orgID OrgID, agg *Aggregate) (int64, error) {
+	var count int64
+	var err error
+
+	switch agg.Type {
+	case AggregateTypeContacts:
+		err = db.GetContext(ctx, &count, countContactsSQL, orgID)
+	case AggregateTypeGroupContacts:
+		err = db.GetContext(ctx, &count, countGroupContactsSQL, agg.GroupID)
+	case AggregateTypeFlowRuns:
+		if agg.Since != nil {
+			err = db.GetContext(ctx, &count, countFlowRunsSinceSQL, agg.FlowID, *agg.Since)
+		} else {
+			err = db.GetContext(ctx, &count, countFlowRunsSQL, agg.FlowID)
+		}
+	case AggregateTypeFlowResponses:
+		err = db.GetContext(ctx, &count, countFlowResponsesSQL, agg.FlowID, agg.Since)
+	default:
+		return 0, errors.Errorf("unknown aggregate type '%s'", agg.Type)
+	}
+
+	if err != nil {
+		return 0, errors.Wrapf(err, "error calculating %s aggregate", agg.Type)
+	}
+	return count, nil
+}
@@ -8,14 +8,17 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/engine"
 	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/utils/scope"
 	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // OrgAssets is our top level cache of all things contained in an org. It is used to build
@@ -44,6 +47,7 @@ type OrgAssets struct {
 	campaigns             []*Campaign
 	campaignEventsByField map[FieldID][]*CampaignEvent
 	campaignEventsByID    map[CampaignEventID]*CampaignEvent
+	campaignEventsByFlow  map[FlowID]*CampaignEvent
 	campaignsByGroup      map[GroupID][]*Campaign
 
 	fields       []assets.Field
@@ -75,8 +79,26 @@ type OrgAssets struct {
 
 var ErrNotFound = errors.New("not found")
 
-// we cache org objects for 5 seconds, cleanup every minute (gets never return expired items)
-var orgCache = cache.New(time.Second*5, time.Minute)
+// cached org assets are checked for changes every 5 seconds, and reloaded in full every 5 minutes regardless to pick up
+// changes that can't be found by modified_on timestamps, e.g. to locations and users which don't have them
+const (
+	orgCacheCheckInterval = time.Second * 5
+	orgCacheTimeout       = time.Minute * 5
+)
+
+// our cache of org assets, cleanup every minute (gets never return expired items)
+var orgCache = cache.New(orgCacheTimeout, time.Minute)
+
+// an entry in our org cache, which records when its assets were last checked for changes by the database's clock, and
+// when they're next due to be checked by ours
+type orgCacheEntry struct {
+	assets    *OrgAssets
+	checkedOn time.Time
+	nextCheck time.Time
+}
+
+// the number of orgs whose assets are loaded at once when warming our cache
+const warmConcurrency = 4
 
 // map of org id -> assetLoader used to make sure we only load an individual org once when expired
 var assetLoaders = sync.Map{}
@@ -105,9 +127,44 @@ func loadOrgAssetsOnce(ctx context.Context, db *sqlx.DB, orgID OrgID) (*OrgAsset
 	return actualLoader.assets, actualLoader.err
 }
 
-// FlushCache clears our entire org cache
+// FlushCache clears our entire org cache, and the in-process tiers of our other caches
 func FlushCache() {
 	orgCache.Flush()
+	channelOrgCache.Flush()
+}
+
+// WarmOrgAssets loads the assets of the passed in orgs into our cache, a few orgs at a time, returning the ids of
+// any orgs whose assets couldn't be loaded
+func WarmOrgAssets(ctx context.Context, db *sqlx.DB, orgIDs []OrgID) []OrgID {
+	toLoad := make(chan OrgID, len(orgIDs))
+	for _, orgID := range orgIDs {
+		toLoad <- orgID
+	}
+	close(toLoad)
+
+	failed := make([]OrgID, 0)
+	failedLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < warmConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for orgID := range toLoad {
+				if _, err := GetOrgAssets(ctx, db, orgID); err != nil {
+					logrus.WithError(err).WithField("org_id", orgID).Error("error warming org assets")
+
+					failedLock.Lock()
+					failed = append(failed, orgID)
+					failedLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return failed
 }
 
 // NewOrgAssets creates and returns a new org assets objects, potentially using the previous
@@ -116,7 +173,7 @@ func NewOrgAssets(ctx context.Context, db *sqlx.DB, orgID OrgID, prev *OrgAssets
 	// build our new assets
 	oa := &OrgAssets{
 		db:      db,
-		builtAt: time.Now(),
+		builtAt: dates.Now(),
 		orgID:   orgID,
 	}
 
@@ -241,18 +298,23 @@ func NewOrgAssets(ctx context.Context, db *sqlx.DB, orgID OrgID, prev *OrgAssets
 		}
 		oa.campaignEventsByField = make(map[FieldID][]*CampaignEvent)
 		oa.campaignEventsByID = make(map[CampaignEventID]*CampaignEvent)
+		oa.campaignEventsByFlow = make(map[FlowID]*CampaignEvent)
 		oa.campaignsByGroup = make(map[GroupID][]*Campaign)
 		for _, c := range oa.campaigns {
 			oa.campaignsByGroup[c.GroupID()] = append(oa.campaignsByGroup[c.GroupID()], c)
 			for _, e := range c.Events() {
 				oa.campaignEventsByField[e.RelativeToID()] = append(oa.campaignEventsByField[e.RelativeToID()], e)
 				oa.campaignEventsByID[e.ID()] = e
+				if e.EventType() == CampaignEventTypeMessage {
+					oa.campaignEventsByFlow[e.FlowID()] = e
+				}
 			}
 		}
 	} else {
 		oa.campaigns = prev.campaigns
 		oa.campaignEventsByField = prev.campaignEventsByField
 		oa.campaignEventsByID = prev.campaignEventsByID
+		oa.campaignEventsByFlow = prev.campaignEventsByFlow
 		oa.campaignsByGroup = prev.campaignsByGroup
 	}
 
@@ -377,43 +439,73 @@ func GetOrgAssetsWithRefresh(ctx context.Context, db *sqlx.DB, orgID OrgID, refr
 		return nil, errors.Errorf("nil db, cannot load org")
 	}
 
-	// do we have a recent cache?
+	scope.Set(ctx, "org_id", orgID)
+
+	// do we have a cache?
 	key := fmt.Sprintf("%d", orgID)
-	var cached *OrgAssets
 	c, found := orgCache.Get(key)
-	if found {
-		cached = c.(*OrgAssets)
-	}
-
-	// if found and nothing to refresh, return it
-	if found && refresh == RefreshNone {
-		return cached, nil
-	}
 
 	// if it wasn't found at all, reload it
 	if !found {
+		// anything modified from now on may not be included in what we load
+		checkedOn, err := loadDBNow(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+
 		o, err := loadOrgAssetsOnce(ctx, db, orgID)
 		if err != nil {
 			return nil, err
 		}
 
 		// cache it for the future
-		orgCache.SetDefault(key, o)
+		cacheOrgAssets(key, o, checkedOn)
 		return o, nil
 	}
 
+	entry := c.(*orgCacheEntry)
+	cached, checkedOn := entry.assets, entry.checkedOn
+
+	// if it hasn't been checked for changes recently, also refresh anything that's been modified since it was
+	if !dates.Now().Before(entry.nextCheck) {
+		changed, changesOn, err := loadAssetChanges(ctx, db, orgID, checkedOn)
+		if err != nil {
+			return nil, err
+		}
+
+		refresh |= changed
+		checkedOn = changesOn
+	}
+
+	// if nothing to refresh, return it
+	if refresh == RefreshNone {
+		return cached, nil
+	}
+
 	// otherwise we need to refresh only some parts, go do that
 	o, err := NewOrgAssets(ctx, db, orgID, cached, refresh)
 	if err != nil {
 		return nil, err
 	}
 
-	orgCache.SetDefault(key, o)
+	cacheOrgAssets(key, o, checkedOn)
 
 	// return our assets
 	return o, nil
 }
 
+// caches the passed in org assets until they're due to be reloaded in full
+func cacheOrgAssets(key string, oa *OrgAssets, checkedOn time.Time) {
+	now := dates.Now()
+	expiresIn := oa.builtAt.Add(orgCacheTimeout).Sub(now)
+	if expiresIn <= 0 {
+		orgCache.Delete(key)
+		return
+	}
+
+	orgCache.Set(key, &orgCacheEntry{assets: oa, checkedOn: checkedOn, nextCheck: now.Add(orgCacheCheckInterval)}, expiresIn)
+}
+
 func (a *OrgAssets) OrgID() OrgID { return a.orgID }
 
 func (a *OrgAssets) Env() envs.Environment { return a.org }
@@ -564,6 +656,11 @@ func (a *OrgAssets) CampaignEventByID(eventID CampaignEventID) *CampaignEvent {
 	return a.campaignEventsByID[eventID]
 }
 
+// CampaignMessageEventByFlowID returns the message event whose generated flow is the passed in flow, if any
+func (a *OrgAssets) CampaignMessageEventByFlowID(flowID FlowID) *CampaignEvent {
+	return a.campaignEventsByFlow[flowID]
+}
+
 func (a *OrgAssets) Groups() ([]assets.Group, error) {
 	return a.groups, nil
 }
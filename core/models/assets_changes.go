@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// which kinds of assets have changed since a time, found by their modified_on timestamps
+type assetChanges struct {
+	Org         bool `db:"org"`
+	Channels    bool `db:"channels"`
+	Fields      bool `db:"fields"`
+	Groups      bool `db:"contact_groups"`
+	Classifiers bool `db:"classifiers"`
+	Labels      bool `db:"labels"`
+	Resthooks   bool `db:"resthooks"`
+	Campaigns   bool `db:"campaigns"`
+	Triggers    bool `db:"triggers"`
+	Templates   bool `db:"templates"`
+	Globals     bool `db:"globals"`
+	Flows       bool `db:"flows"`
+	Ticketers   bool `db:"ticketers"`
+
+	CheckedOn time.Time `db:"checked_on"`
+}
+
+// changes are looked for from a little before we last checked, so that we don't miss changes made by transactions which
+// were still in progress then, as their modified_on timestamps are from when they started
+const assetChangesOverlap = time.Second * 30
+
+const selectAssetChangesSQL = `
+SELECT
+	NOW() AS checked_on,
+	EXISTS(SELECT 1 FROM orgs_org WHERE id = $1 AND modified_on > $2) AS org,
+	EXISTS(SELECT 1 FROM channels_channel WHERE org_id = $1 AND modified_on > $2) AS channels,
+	EXISTS(SELECT 1 FROM contacts_contactfield WHERE org_id = $1 AND modified_on > $2) AS fields,
+	EXISTS(SELECT 1 FROM contacts_contactgroup WHERE org_id = $1 AND modified_on > $2) AS contact_groups,
+	EXISTS(SELECT 1 FROM classifiers_classifier WHERE org_id = $1 AND modified_on > $2) AS classifiers,
+	EXISTS(SELECT 1 FROM msgs_label WHERE org_id = $1 AND modified_on > $2) AS labels,
+	EXISTS(
+		SELECT 1 FROM api_resthook r LEFT OUTER JOIN api_resthooksubscriber s ON s.resthook_id = r.id
+		WHERE r.org_id = $1 AND (r.modified_on > $2 OR s.modified_on > $2)
+	) AS resthooks,
+	EXISTS(
+		SELECT 1 FROM campaigns_campaign c LEFT OUTER JOIN campaigns_campaignevent e ON e.campaign_id = c.id
+		WHERE c.org_id = $1 AND (c.modified_on > $2 OR e.modified_on > $2)
+	) AS campaigns,
+	EXISTS(SELECT 1 FROM triggers_trigger WHERE org_id = $1 AND modified_on > $2) AS triggers,
+	EXISTS(SELECT 1 FROM templates_template WHERE org_id = $1 AND modified_on > $2) AS templates,
+	EXISTS(SELECT 1 FROM globals_global WHERE org_id = $1 AND modified_on > $2) AS globals,
+	EXISTS(SELECT 1 FROM flows_flow WHERE org_id = $1 AND modified_on > $2) AS flows,
+	EXISTS(SELECT 1 FROM tickets_ticketer WHERE org_id = $1 AND modified_on > $2) AS ticketers
+`
+
+// loads which of the given org's assets have been modified since the passed in time, as the pieces of its assets which
+// need to be refreshed, and the time of the check by the database's clock, which is what modified_on timestamps are
+// set by. Locations and users don't have modified_on timestamps so changes to them can't be found this way, and are
+// only picked up when the org's assets are reloaded in full.
+func loadAssetChanges(ctx context.Context, db Queryer, orgID OrgID, since time.Time) (Refresh, time.Time, error) {
+	changes := &assetChanges{}
+	if err := db.GetContext(ctx, changes, selectAssetChangesSQL, orgID, since.Add(-assetChangesOverlap)); err != nil {
+		return RefreshNone, time.Time{}, errors.Wrapf(err, "error checking for asset changes for org: %d", orgID)
+	}
+
+	refresh := RefreshNone
+	for _, c := range []struct {
+		changed bool
+		refresh Refresh
+	}{
+		{changes.Org, RefreshOrg},
+		{changes.Channels, RefreshChannels | RefreshOrg}, // the org's default country is that of its channels
+		{changes.Fields, RefreshFields},
+		{changes.Groups, RefreshGroups},
+		{changes.Classifiers, RefreshClassifiers},
+		{changes.Labels, RefreshLabels},
+		{changes.Resthooks, RefreshResthooks},
+		{changes.Campaigns, RefreshCampaigns},
+		{changes.Triggers, RefreshTriggers},
+		{changes.Templates, RefreshTemplates},
+		{changes.Globals, RefreshGlobals},
+		{changes.Flows, RefreshFlows},
+		{changes.Ticketers, RefreshTicketers},
+	} {
+		if c.changed {
+			refresh |= c.refresh
+		}
+	}
+	return refresh, changes.CheckedOn, nil
+}
+
+// loads the current time by the database's clock
+func loadDBNow(ctx context.Context, db Queryer) (time.Time, error) {
+	var now time.Time
+	if err := db.GetContext(ctx, &now, `SELECT NOW()`); err != nil {
+		return time.Time{}, errors.Wrapf(err, "error loading database time")
+	}
+	return now, nil
+}
@@ -3,7 +3,9 @@ package models_test
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/assets/static/types"
 	"github.com/nyaruka/mailroom/core/models"
@@ -68,3 +70,54 @@ func TestCloneForSimulation(t *testing.T) {
 	_, err = oa.CloneForSimulation(ctx, db, map[assets.FlowUUID]json.RawMessage{"a121f1af-7dfa-47af-9d22-9726372e2daa": []byte(newFavoritesDef)}, nil)
 	assert.EqualError(t, err, "unable to find flow with UUID 'a121f1af-7dfa-47af-9d22-9726372e2daa': not found")
 }
+
+func TestOrgAssetsCacheInvalidation(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	oa1, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Twilio", oa1.ChannelByID(testdata.TwilioChannel.ID).Name())
+
+	db.MustExec(`UPDATE channels_channel SET name = 'Twilio 2', modified_on = NOW() WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	// assets were checked for changes when they were loaded so we get the cached assets
+	oa2, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Same(t, oa1, oa2)
+
+	// once they're due to be checked again, the changed channels are reloaded
+	dates.SetNowSource(dates.NewFixedNowSource(time.Now().Add(time.Second * 10)))
+
+	oa3, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.NotSame(t, oa1, oa3)
+	assert.Equal(t, "Twilio 2", oa3.ChannelByID(testdata.TwilioChannel.ID).Name())
+
+	// but everything else is reused
+	assert.Same(t, oa1.FieldByKey("age"), oa3.FieldByKey("age"))
+	assert.Same(t, oa1.GroupByID(testdata.DoctorsGroup.ID), oa3.GroupByID(testdata.DoctorsGroup.ID))
+
+	// until they're due to be checked again, we keep getting the same assets
+	oa4, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Same(t, oa3, oa4)
+
+	// changes to users can't be found by timestamps so they're left until the assets are reloaded in full
+	db.MustExec(`UPDATE auth_user SET first_name = 'Adam', last_name = '' WHERE id = $1`, testdata.Admin.ID)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Now().Add(time.Second * 20)))
+
+	oa5, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Same(t, oa4, oa5)
+	assert.NotEqual(t, "Adam", oa5.UserByID(testdata.Admin.ID).Name())
+
+	models.FlushCache()
+
+	oa6, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Adam", oa6.UserByID(testdata.Admin.ID).Name())
+}
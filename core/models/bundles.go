@@ -0,0 +1,878 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/null"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// A bundle is an export of flows, campaigns and triggers, and the fields and groups they depend on, in the format
+// produced by RapidPro's exporter. Importing a bundle matches each object to an existing object in the org by UUID and
+// then by name, updating it if found or creating it if not, and rewrites references in flow definitions to any objects
+// which were matched to an existing object with a different UUID.
+
+// the oldest export version we can import, older exports contain legacy flow definitions
+const minBundleVersion = 13
+
+// Bundle is an export of flows, campaigns and triggers
+type Bundle struct {
+	Version   string            `json:"version"   validate:"required"`
+	Fields    []*BundleField    `json:"fields"    validate:"dive"`
+	Groups    []*BundleGroup    `json:"groups"    validate:"dive"`
+	Flows     []json.RawMessage `json:"flows"`
+	Campaigns []*BundleCampaign `json:"campaigns" validate:"dive"`
+	Triggers  []*BundleTrigger  `json:"triggers"  validate:"dive"`
+}
+
+// BundleField is a contact field in a bundle
+type BundleField struct {
+	Key  string           `json:"key"  validate:"required"`
+	Name string           `json:"name" validate:"required"`
+	Type assets.FieldType `json:"type" validate:"required"`
+}
+
+// BundleGroup is a contact group in a bundle
+type BundleGroup struct {
+	UUID  assets.GroupUUID `json:"uuid" validate:"required,uuid"`
+	Name  string           `json:"name" validate:"required"`
+	Query string           `json:"query"`
+}
+
+// BundleCampaign is a campaign and its events in a bundle
+type BundleCampaign struct {
+	UUID   CampaignUUID           `json:"uuid"   validate:"required,uuid"`
+	Name   string                 `json:"name"   validate:"required"`
+	Group  *assets.GroupReference `json:"group"  validate:"required"`
+	Events []*BundleCampaignEvent `json:"events" validate:"dive"`
+}
+
+// BundleCampaignEvent is a campaign event in a bundle
+type BundleCampaignEvent struct {
+	EventType    CampaignEventType     `json:"event_type"    validate:"required,eq=F|eq=M"`
+	RelativeTo   *BundleFieldReference `json:"relative_to"   validate:"required"`
+	Offset       int                   `json:"offset"`
+	Unit         OffsetUnit            `json:"unit"          validate:"required,eq=M|eq=H|eq=D|eq=W"`
+	DeliveryHour int                   `json:"delivery_hour" validate:"min=-1,max=23"`
+	StartMode    StartMode             `json:"start_mode"`
+	Flow         *assets.FlowReference `json:"flow"`
+	Message      map[string]string     `json:"message"`
+	BaseLanguage envs.Language         `json:"base_language"`
+}
+
+// BundleFieldReference is a reference to a contact field in a bundle
+type BundleFieldReference struct {
+	Key   string `json:"key"   validate:"required"`
+	Label string `json:"label"`
+}
+
+// BundleTrigger is a trigger in a bundle
+type BundleTrigger struct {
+	TriggerType   TriggerType              `json:"trigger_type"   validate:"required"`
+	Keyword       string                   `json:"keyword"`
+	MatchType     MatchType                `json:"match_type"`
+	ReferrerID    string                   `json:"referrer_id"`
+	Flow          *assets.FlowReference    `json:"flow"           validate:"required"`
+	Groups        []*assets.GroupReference `json:"groups"`
+	ExcludeGroups []*assets.GroupReference `json:"exclude_groups"`
+	Channel       assets.ChannelUUID       `json:"channel"`
+}
+
+// BundleImportAction is what an import did with an object in the bundle
+type BundleImportAction string
+
+const (
+	// BundleImportCreated is when no matching object existed so one was created
+	BundleImportCreated = BundleImportAction("created")
+
+	// BundleImportUpdated is when a matching object existed and was updated from the bundle
+	BundleImportUpdated = BundleImportAction("updated")
+
+	// BundleImportExisting is when a matching object existed and was left as is
+	BundleImportExisting = BundleImportAction("existing")
+)
+
+// BundleImportItem is the outcome of importing a single object in a bundle
+type BundleImportItem struct {
+	ID      int                `json:"id"`
+	UUID    string             `json:"uuid,omitempty"`
+	Key     string             `json:"key,omitempty"`
+	Name    string             `json:"name,omitempty"`
+	Type    string             `json:"type,omitempty"`
+	Keyword string             `json:"keyword,omitempty"`
+	Action  BundleImportAction `json:"action"`
+}
+
+// BundleImport is the report of a bundle import
+type BundleImport struct {
+	Fields             []*BundleImportItem `json:"fields"`
+	Groups             []*BundleImportItem `json:"groups"`
+	Flows              []*BundleImportItem `json:"flows"`
+	Campaigns          []*BundleImportItem `json:"campaigns"`
+	Triggers           []*BundleImportItem `json:"triggers"`
+	ArchivedTriggerIDs []TriggerID         `json:"archived_trigger_ids"`
+	RemappedUUIDs      map[string]string   `json:"remapped_uuids"`
+
+	// query based groups which need populating and campaign events which need scheduling once the import is committed
+	DynamicGroups map[GroupID]string `json:"-"`
+	EventIDs      []CampaignEventID  `json:"-"`
+}
+
+var fieldValueTypes = map[assets.FieldType]string{
+	assets.FieldTypeText:     "T",
+	assets.FieldTypeNumber:   "N",
+	assets.FieldTypeDatetime: "D",
+	assets.FieldTypeState:    "S",
+	assets.FieldTypeDistrict: "I",
+	assets.FieldTypeWard:     "W",
+}
+
+type bundleImporter struct {
+	tx     Queryer
+	cfg    *config.Config
+	oa     *OrgAssets
+	userID UserID
+	report *BundleImport
+
+	fieldIDs map[string]FieldID
+	groupIDs map[assets.GroupUUID]GroupID
+	flowIDs  map[assets.FlowUUID]FlowID
+}
+
+// ImportBundle imports the passed in bundle into the org, which should be done inside a transaction so that a bundle
+// is either imported completely or not at all
+func ImportBundle(ctx context.Context, tx Queryer, cfg *config.Config, oa *OrgAssets, userID UserID, bundle *Bundle) (*BundleImport, error) {
+	version, err := strconv.ParseFloat(bundle.Version, 64)
+	if err != nil || version < minBundleVersion {
+		return nil, errors.Errorf("unsupported export version %s, must be %d or later", bundle.Version, minBundleVersion)
+	}
+
+	i := &bundleImporter{
+		tx:     tx,
+		cfg:    cfg,
+		oa:     oa,
+		userID: userID,
+		report: &BundleImport{
+			Fields:             make([]*BundleImportItem, 0),
+			Groups:             make([]*BundleImportItem, 0),
+			Flows:              make([]*BundleImportItem, 0),
+			Campaigns:          make([]*BundleImportItem, 0),
+			Triggers:           make([]*BundleImportItem, 0),
+			ArchivedTriggerIDs: make([]TriggerID, 0),
+			RemappedUUIDs:      make(map[string]string),
+			DynamicGroups:      make(map[GroupID]string),
+		},
+		fieldIDs: make(map[string]FieldID),
+		groupIDs: make(map[assets.GroupUUID]GroupID),
+		flowIDs:  make(map[assets.FlowUUID]FlowID),
+	}
+
+	for _, f := range bundle.Fields {
+		if _, err := i.field(ctx, f.Key, f.Name, f.Type); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range bundle.Groups {
+		if _, err := i.group(ctx, g.UUID, g.Name, g.Query); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.importFlows(ctx, bundle.Flows); err != nil {
+		return nil, err
+	}
+	for _, c := range bundle.Campaigns {
+		if err := i.importCampaign(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.importTriggers(ctx, bundle.Triggers); err != nil {
+		return nil, err
+	}
+
+	return i.report, nil
+}
+
+func (i *bundleImporter) remap(from, to string) {
+	if from != to {
+		i.report.RemappedUUIDs[from] = to
+	}
+}
+
+// returns a UUID for a new object, which is the UUID it had in the bundle unless that's already in use
+func (i *bundleImporter) newUUID(ctx context.Context, table string, uuid string) (string, error) {
+	var exists bool
+	if err := i.tx.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM `+table+` WHERE uuid = $1)`, uuid); err != nil {
+		return "", errors.Wrapf(err, "error checking whether uuid %s is in use", uuid)
+	}
+	if exists {
+		return string(uuids.New()), nil
+	}
+	return uuid, nil
+}
+
+// a matched object is identified by its id and uuid
+type bundleMatch struct {
+	ID   int    `db:"id"`
+	UUID string `db:"uuid"`
+}
+
+func (i *bundleImporter) match(ctx context.Context, query string, uuid string, name string) (*bundleMatch, error) {
+	match := &bundleMatch{}
+	err := i.tx.GetContext(ctx, match, query, i.oa.OrgID(), uuid, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return match, err
+}
+
+const selectFieldByKeySQL = `SELECT id FROM contacts_contactfield WHERE org_id = $1 AND key = $2 AND is_active = TRUE`
+
+const insertFieldSQL = `
+INSERT INTO
+	contacts_contactfield(is_active, created_on, modified_on, uuid, label, key, field_type, value_type, show_in_table, priority, created_by_id, modified_by_id, org_id)
+	VALUES(TRUE, NOW(), NOW(), $1, $2, $3, 'U', $4, FALSE, 0, $5, $5, $6)
+RETURNING
+	id
+`
+
+// gets the field with the given key, creating it if it doesn't exist
+func (i *bundleImporter) field(ctx context.Context, key, name string, fieldType assets.FieldType) (FieldID, error) {
+	if id, found := i.fieldIDs[key]; found {
+		return id, nil
+	}
+
+	var id FieldID
+	action := BundleImportExisting
+
+	err := i.tx.GetContext(ctx, &id, selectFieldByKeySQL, i.oa.OrgID(), key)
+	if err == sql.ErrNoRows {
+		valueType, found := fieldValueTypes[fieldType]
+		if !found {
+			return 0, errors.Errorf("field '%s' has unknown type '%s'", key, fieldType)
+		}
+		action = BundleImportCreated
+		err = i.tx.GetContext(ctx, &id, insertFieldSQL, uuids.New(), name, key, valueType, i.userID, i.oa.OrgID())
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "error importing field '%s'", key)
+	}
+
+	i.fieldIDs[key] = id
+	i.report.Fields = append(i.report.Fields, &BundleImportItem{ID: int(id), Key: key, Name: name, Action: action})
+	return id, nil
+}
+
+const selectGroupMatchSQL = `
+SELECT
+	id,
+	uuid
+FROM
+	contacts_contactgroup
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	group_type = 'U' AND
+	(uuid = $2 OR LOWER(name) = LOWER($3))
+ORDER BY
+	uuid = $2 DESC
+LIMIT 1
+`
+
+const insertGroupSQL = `
+INSERT INTO
+	contacts_contactgroup(uuid, org_id, group_type, name, query, status, is_active, created_by_id, created_on, modified_by_id, modified_on)
+	VALUES($1, $2, 'U', $3, $4, $5, TRUE, $6, NOW(), $6, NOW())
+RETURNING
+	id
+`
+
+// gets the group matching the given UUID or name, creating it if it doesn't exist
+func (i *bundleImporter) group(ctx context.Context, uuid assets.GroupUUID, name, query string) (GroupID, error) {
+	if id, found := i.groupIDs[uuid]; found {
+		return id, nil
+	}
+
+	match, err := i.match(ctx, selectGroupMatchSQL, string(uuid), name)
+	if err != nil {
+		return GroupID(0), errors.Wrapf(err, "error looking up group '%s'", name)
+	}
+
+	item := &BundleImportItem{Name: name, Action: BundleImportExisting}
+
+	if match != nil {
+		item.ID, item.UUID = match.ID, match.UUID
+	} else {
+		item.Action = BundleImportCreated
+		item.UUID, err = i.newUUID(ctx, "contacts_contactgroup", string(uuid))
+		if err != nil {
+			return GroupID(0), err
+		}
+
+		status := GroupStatusReady
+		if query != "" {
+			status = GroupStatusInitializing
+		}
+
+		err = i.tx.GetContext(ctx, &item.ID, insertGroupSQL, item.UUID, i.oa.OrgID(), name, null.String(query), status, i.userID)
+		if err != nil {
+			return GroupID(0), errors.Wrapf(err, "error creating group '%s'", name)
+		}
+		if query != "" {
+			i.report.DynamicGroups[GroupID(item.ID)] = query
+		}
+	}
+
+	i.remap(string(uuid), item.UUID)
+	i.groupIDs[uuid] = GroupID(item.ID)
+	i.report.Groups = append(i.report.Groups, item)
+	return GroupID(item.ID), nil
+}
+
+// the properties of a flow definition which we need to create or update the flow
+type bundleFlow struct {
+	UUID               assets.FlowUUID `json:"uuid"                 validate:"required,uuid"`
+	Name               string          `json:"name"                 validate:"required"`
+	Type               flows.FlowType  `json:"type"                 validate:"required"`
+	Language           envs.Language   `json:"language"`
+	ExpireAfterMinutes int             `json:"expire_after_minutes"`
+
+	definition json.RawMessage
+	item       *BundleImportItem
+}
+
+const selectFlowMatchSQL = `
+SELECT
+	id,
+	uuid
+FROM
+	flows_flow
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	is_system = FALSE AND
+	(uuid = $2 OR LOWER(name) = LOWER($3))
+ORDER BY
+	uuid = $2 DESC
+LIMIT 1
+`
+
+const insertFlowSQL = `
+INSERT INTO
+	flows_flow(is_active, created_on, modified_on, uuid, name, is_archived, is_system, flow_type, expires_after_minutes, ignore_triggers,
+			   saved_on, base_language, version_number, created_by_id, modified_by_id, saved_by_id, org_id, has_issues)
+	VALUES(TRUE, NOW(), NOW(), $1, $2, FALSE, $3, $4, $5, FALSE, NOW(), $6, $7, $8, $8, $8, $9, FALSE)
+RETURNING
+	id
+`
+
+const updateFlowSQL = `
+UPDATE
+	flows_flow
+SET
+	name = $2,
+	flow_type = $3,
+	expires_after_minutes = $4,
+	base_language = $5,
+	version_number = $6,
+	modified_on = NOW(),
+	modified_by_id = $7,
+	saved_on = NOW(),
+	saved_by_id = $7
+WHERE
+	id = $1
+`
+
+const insertFlowRevisionSQL = `
+INSERT INTO
+	flows_flowrevision(is_active, created_on, modified_on, definition, spec_version, revision, created_by_id, modified_by_id, flow_id)
+	SELECT TRUE, NOW(), NOW(), $2, $3, COALESCE(MAX(revision), 0) + 1, $4, $4, $1 FROM flows_flowrevision WHERE flow_id = $1
+`
+
+// imports the flows in the bundle, which is done in two passes as flows can reference each other, so we need to know
+// every flow's UUID in this org before we can rewrite any of their definitions
+func (i *bundleImporter) importFlows(ctx context.Context, definitions []json.RawMessage) error {
+	bundled := make([]*bundleFlow, len(definitions))
+
+	for n, definition := range definitions {
+		f := &bundleFlow{definition: definition}
+		if err := utils.UnmarshalAndValidate(definition, f); err != nil {
+			return errors.Wrapf(err, "unable to read flow #%d", n)
+		}
+		if _, found := flowTypeMapping[f.Type]; !found {
+			return errors.Errorf("flow '%s' has unknown type '%s'", f.Name, f.Type)
+		}
+
+		match, err := i.match(ctx, selectFlowMatchSQL, string(f.UUID), f.Name)
+		if err != nil {
+			return errors.Wrapf(err, "error looking up flow '%s'", f.Name)
+		}
+
+		f.item = &BundleImportItem{Name: f.Name, Action: BundleImportUpdated}
+		if match != nil {
+			f.item.ID, f.item.UUID = match.ID, match.UUID
+		} else {
+			f.item.Action = BundleImportCreated
+			f.item.UUID, err = i.newUUID(ctx, "flows_flow", string(f.UUID))
+			if err != nil {
+				return err
+			}
+		}
+		i.remap(string(f.UUID), f.item.UUID)
+		bundled[n] = f
+	}
+
+	// UUIDs are rewritten by simple replacement rather than by cloning the definitions, as that would also give new
+	// UUIDs to nodes and actions which would break any sessions waiting in an updated flow
+	replacements := make([]string, 0, len(i.report.RemappedUUIDs)*2)
+	for from, to := range i.report.RemappedUUIDs {
+		replacements = append(replacements, from, to)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	for _, f := range bundled {
+		definition, err := goflow.MigrateDefinition(i.cfg, json.RawMessage(replacer.Replace(string(f.definition))), goflow.SpecVersion())
+		if err != nil {
+			return errors.Wrapf(err, "unable to migrate flow '%s'", f.Name)
+		}
+		if _, err := goflow.ReadFlow(i.cfg, definition); err != nil {
+			return errors.Wrapf(err, "flow '%s' is invalid", f.Name)
+		}
+
+		id, err := i.saveFlow(ctx, FlowID(f.item.ID), f.item.UUID, f.Name, flowTypeMapping[f.Type], f.ExpireAfterMinutes, f.Language, false, definition)
+		if err != nil {
+			return errors.Wrapf(err, "error importing flow '%s'", f.Name)
+		}
+
+		f.item.ID = int(id)
+		i.flowIDs[f.UUID] = id
+		i.report.Flows = append(i.report.Flows, f.item)
+	}
+
+	return nil
+}
+
+// creates a flow if the passed in id is nil, otherwise updates it, and in both cases saves the definition as a new revision
+func (i *bundleImporter) saveFlow(ctx context.Context, id FlowID, uuid string, name string, flowType FlowType, expires int, language envs.Language, system bool, definition json.RawMessage) (FlowID, error) {
+	if expires <= 0 {
+		expires = 60 * 24 * 7
+		if flowType == FlowTypeVoice {
+			expires = 5
+		}
+	}
+	version := goflow.SpecVersion().String()
+
+	var err error
+	if id == NilFlowID {
+		err = i.tx.GetContext(ctx, &id, insertFlowSQL, uuid, name, system, flowType, expires, null.String(language), version, i.userID, i.oa.OrgID())
+	} else {
+		_, err = i.tx.ExecContext(ctx, updateFlowSQL, id, name, flowType, expires, null.String(language), version, i.userID)
+	}
+	if err != nil {
+		return NilFlowID, err
+	}
+
+	_, err = i.tx.ExecContext(ctx, insertFlowRevisionSQL, id, string(definition), version, i.userID)
+	return id, err
+}
+
+const selectFlowIDByUUIDSQL = `SELECT id FROM flows_flow WHERE org_id = $1 AND uuid = $2 AND is_active = TRUE`
+
+// gets the id of the referenced flow, which must either be in the bundle or already exist in this org
+func (i *bundleImporter) flow(ctx context.Context, ref *assets.FlowReference) (FlowID, error) {
+	if id, found := i.flowIDs[ref.UUID]; found {
+		return id, nil
+	}
+
+	var id FlowID
+	err := i.tx.GetContext(ctx, &id, selectFlowIDByUUIDSQL, i.oa.OrgID(), ref.UUID)
+	if err == sql.ErrNoRows {
+		return NilFlowID, errors.Errorf("no such flow '%s' (%s)", ref.Name, ref.UUID)
+	}
+	if err != nil {
+		return NilFlowID, errors.Wrapf(err, "error looking up flow '%s'", ref.Name)
+	}
+
+	i.flowIDs[ref.UUID] = id
+	return id, nil
+}
+
+const selectCampaignMatchSQL = `
+SELECT
+	id,
+	uuid
+FROM
+	campaigns_campaign
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	(uuid = $2 OR LOWER(name) = LOWER($3))
+ORDER BY
+	uuid = $2 DESC
+LIMIT 1
+`
+
+const insertCampaignSQL = `
+INSERT INTO
+	campaigns_campaign(is_active, created_on, modified_on, uuid, name, is_archived, created_by_id, modified_by_id, group_id, org_id)
+	VALUES(TRUE, NOW(), NOW(), $1, $2, FALSE, $3, $3, $4, $5)
+RETURNING
+	id
+`
+
+const updateCampaignSQL = `
+UPDATE
+	campaigns_campaign
+SET
+	name = $2,
+	group_id = $3,
+	modified_on = NOW(),
+	modified_by_id = $4
+WHERE
+	id = $1
+`
+
+const deactivateCampaignEventsSQL = `
+WITH deactivated AS (
+	UPDATE
+		campaigns_campaignevent
+	SET
+		is_active = FALSE,
+		modified_on = NOW()
+	WHERE
+		campaign_id = $1 AND
+		is_active = TRUE
+	RETURNING
+		id
+)
+DELETE FROM
+	campaigns_eventfire
+WHERE
+	event_id IN (SELECT id FROM deactivated) AND
+	fired IS NULL
+`
+
+const insertCampaignEventSQL = `
+INSERT INTO
+	campaigns_campaignevent(is_active, created_on, modified_on, uuid, campaign_id, event_type, "offset", unit, start_mode, message,
+							delivery_hour, flow_id, relative_to_id, created_by_id, modified_by_id)
+	VALUES(TRUE, NOW(), NOW(), $1, $2, $3, $4, $5, $6, CASE WHEN $7::text[] IS NULL THEN NULL ELSE hstore($7::text[], $8::text[]) END,
+		   $9, $10, $11, $12, $12)
+RETURNING
+	id
+`
+
+// imports a campaign, replacing the events of an existing campaign with those in the bundle
+func (i *bundleImporter) importCampaign(ctx context.Context, c *BundleCampaign) error {
+	groupID, err := i.group(ctx, c.Group.UUID, c.Group.Name, "")
+	if err != nil {
+		return err
+	}
+
+	match, err := i.match(ctx, selectCampaignMatchSQL, string(c.UUID), c.Name)
+	if err != nil {
+		return errors.Wrapf(err, "error looking up campaign '%s'", c.Name)
+	}
+
+	item := &BundleImportItem{Name: c.Name, Action: BundleImportUpdated}
+
+	if match != nil {
+		item.ID, item.UUID = match.ID, match.UUID
+
+		if _, err := i.tx.ExecContext(ctx, updateCampaignSQL, item.ID, c.Name, groupID, i.userID); err != nil {
+			return errors.Wrapf(err, "error updating campaign '%s'", c.Name)
+		}
+		if _, err := i.tx.ExecContext(ctx, deactivateCampaignEventsSQL, item.ID); err != nil {
+			return errors.Wrapf(err, "error removing events of campaign '%s'", c.Name)
+		}
+	} else {
+		item.Action = BundleImportCreated
+		item.UUID, err = i.newUUID(ctx, "campaigns_campaign", string(c.UUID))
+		if err != nil {
+			return err
+		}
+		if err := i.tx.GetContext(ctx, &item.ID, insertCampaignSQL, item.UUID, c.Name, i.userID, groupID, i.oa.OrgID()); err != nil {
+			return errors.Wrapf(err, "error creating campaign '%s'", c.Name)
+		}
+	}
+	i.remap(string(c.UUID), item.UUID)
+
+	for _, e := range c.Events {
+		if err := i.importCampaignEvent(ctx, CampaignID(item.ID), e); err != nil {
+			return errors.Wrapf(err, "error importing event of campaign '%s'", c.Name)
+		}
+	}
+
+	i.report.Campaigns = append(i.report.Campaigns, item)
+	return nil
+}
+
+func (i *bundleImporter) importCampaignEvent(ctx context.Context, campaignID CampaignID, e *BundleCampaignEvent) error {
+	label := e.RelativeTo.Label
+	if label == "" {
+		label = e.RelativeTo.Key
+	}
+	fieldID, err := i.field(ctx, e.RelativeTo.Key, label, assets.FieldTypeDatetime)
+	if err != nil {
+		return err
+	}
+
+	uuid := CampaignEventUUID(uuids.New())
+	startMode := e.StartMode
+	if startMode == "" {
+		startMode = StartModeInterrupt
+	}
+
+	var flowID FlowID
+	var keys, values []string
+
+	if e.EventType == CampaignEventTypeFlow {
+		if e.Flow == nil {
+			return errors.New("flow events must have a flow")
+		}
+		if flowID, err = i.flow(ctx, e.Flow); err != nil {
+			return err
+		}
+	} else {
+		if len(e.Message) == 0 {
+			return errors.New("message events must have a message")
+		}
+		if flowID, err = i.createMessageFlow(ctx, uuid, e.BaseLanguage, e.Message); err != nil {
+			return err
+		}
+
+		keys, values = make([]string, 0, len(e.Message)), make([]string, 0, len(e.Message))
+		for k, v := range e.Message {
+			keys, values = append(keys, k), append(values, v)
+		}
+	}
+
+	var id CampaignEventID
+	err = i.tx.GetContext(ctx, &id, insertCampaignEventSQL, uuid, campaignID, e.EventType, e.Offset, e.Unit, startMode,
+		pq.Array(keys), pq.Array(values), e.DeliveryHour, flowID, fieldID, i.userID)
+	if err != nil {
+		return errors.Wrapf(err, "error inserting campaign event")
+	}
+
+	i.report.EventIDs = append(i.report.EventIDs, id)
+	return nil
+}
+
+// creates the system flow which a message event starts to send its message, translated into each of its languages
+func (i *bundleImporter) createMessageFlow(ctx context.Context, eventUUID CampaignEventUUID, baseLanguage envs.Language, message map[string]string) (FlowID, error) {
+	languages := make([]string, 0, len(message))
+	for lang := range message {
+		// keys which aren't language codes hold message options
+		if !strings.HasPrefix(lang, "_") {
+			languages = append(languages, lang)
+		}
+	}
+	if len(languages) == 0 {
+		return NilFlowID, errors.New("message events must have message text")
+	}
+	sort.Strings(languages)
+
+	if _, found := message[string(baseLanguage)]; !found || baseLanguage == "" {
+		baseLanguage = envs.Language(languages[0])
+	}
+
+	actionUUID := uuids.New()
+	localization := make(map[string]interface{}, len(languages))
+	for _, lang := range languages {
+		if lang != string(baseLanguage) {
+			localization[lang] = map[uuids.UUID]interface{}{actionUUID: map[string]interface{}{"text": []string{message[lang]}}}
+		}
+	}
+
+	flowUUID := uuids.New()
+	name := "Single Message (" + string(eventUUID) + ")"
+
+	definition, err := json.Marshal(map[string]interface{}{
+		"uuid":                 flowUUID,
+		"name":                 name,
+		"spec_version":         goflow.SpecVersion().String(),
+		"language":             baseLanguage,
+		"type":                 flows.FlowTypeMessaging,
+		"revision":             1,
+		"expire_after_minutes": 60 * 24 * 7,
+		"localization":         localization,
+		"nodes": []interface{}{
+			map[string]interface{}{
+				"uuid":    uuids.New(),
+				"actions": []interface{}{map[string]interface{}{"uuid": actionUUID, "type": "send_msg", "text": message[string(baseLanguage)]}},
+				"exits":   []interface{}{map[string]interface{}{"uuid": uuids.New()}},
+			},
+		},
+	})
+	if err != nil {
+		return NilFlowID, errors.Wrapf(err, "error marshalling message flow definition")
+	}
+
+	id, err := i.saveFlow(ctx, NilFlowID, string(flowUUID), name, FlowTypeMessaging, 0, baseLanguage, true, definition)
+	return id, errors.Wrapf(err, "error creating message flow")
+}
+
+const insertTriggerSQL = `
+INSERT INTO
+	triggers_trigger(is_active, created_on, modified_on, trigger_type, is_archived, keyword, referrer_id, match_type, channel_id, flow_id, created_by_id, modified_by_id, org_id)
+	VALUES(TRUE, NOW(), NOW(), $1, FALSE, $2, $3, $4, $5, $6, $7, $7, $8)
+RETURNING
+	id
+`
+
+const insertTriggerGroupsSQL = `INSERT INTO triggers_trigger_groups(trigger_id, contactgroup_id) SELECT $1, UNNEST($2::int[])`
+
+const insertTriggerExcludeGroupsSQL = `INSERT INTO triggers_trigger_exclude_groups(trigger_id, contactgroup_id) SELECT $1, UNNEST($2::int[])`
+
+// imports triggers, skipping those which already exist and archiving existing triggers which would make matching
+// ambiguous with an imported trigger
+func (i *bundleImporter) importTriggers(ctx context.Context, bundled []*BundleTrigger) error {
+	archive := make([]TriggerID, 0)
+
+	for _, bt := range bundled {
+		t, err := i.proposeTrigger(ctx, bt)
+		if err != nil {
+			return err
+		}
+
+		item := &BundleImportItem{Type: string(t.TriggerType()), Keyword: t.Keyword(), Action: BundleImportCreated}
+
+		conflicts := FindTriggerConflicts(i.oa, t)
+		ambiguous := make([]TriggerID, 0, len(conflicts))
+		for _, c := range conflicts {
+			if c.Type != TriggerConflictAmbiguous {
+				continue
+			}
+			if triggersEquivalent(t, c.Trigger) {
+				item.ID, item.Action = int(c.Trigger.ID()), BundleImportExisting
+				break
+			}
+			ambiguous = append(ambiguous, c.Trigger.ID())
+		}
+
+		if item.Action == BundleImportCreated {
+			if item.ID, err = i.insertTrigger(ctx, t); err != nil {
+				return errors.Wrapf(err, "error creating trigger for flow '%s'", bt.Flow.Name)
+			}
+			archive = append(archive, ambiguous...)
+		}
+
+		i.report.Triggers = append(i.report.Triggers, item)
+	}
+
+	if len(archive) > 0 {
+		archived, err := ArchiveTriggers(ctx, i.tx, i.oa.OrgID(), archive)
+		if err != nil {
+			return err
+		}
+		i.report.ArchivedTriggerIDs = archived
+	}
+	return nil
+}
+
+// resolves the references of a bundled trigger to create a trigger which can be checked for conflicts
+func (i *bundleImporter) proposeTrigger(ctx context.Context, bt *BundleTrigger) (*Trigger, error) {
+	if bt.TriggerType == ScheduleTriggerType {
+		return nil, errors.New("schedule triggers can't be imported")
+	}
+
+	t := &Trigger{}
+	t.t.TriggerType = bt.TriggerType
+	t.t.Keyword = strings.ToLower(bt.Keyword)
+	t.t.ReferrerID = bt.ReferrerID
+	t.t.IncludeGroupIDs = make([]GroupID, 0, len(bt.Groups))
+	t.t.ExcludeGroupIDs = make([]GroupID, 0, len(bt.ExcludeGroups))
+
+	if bt.TriggerType == KeywordTriggerType {
+		if t.t.Keyword == "" {
+			return nil, errors.New("keyword triggers must have a keyword")
+		}
+		t.t.MatchType = bt.MatchType
+		if t.t.MatchType == "" {
+			t.t.MatchType = MatchFirst
+		}
+	}
+
+	var err error
+	if t.t.FlowID, err = i.flow(ctx, bt.Flow); err != nil {
+		return nil, err
+	}
+
+	// channels aren't exported with their config so may not exist in this org, in which case the trigger applies to all channels
+	if bt.Channel != "" {
+		if channel := i.oa.ChannelByUUID(bt.Channel); channel != nil {
+			t.t.ChannelID = channel.ID()
+		}
+	}
+
+	for _, g := range bt.Groups {
+		id, err := i.group(ctx, g.UUID, g.Name, "")
+		if err != nil {
+			return nil, err
+		}
+		t.t.IncludeGroupIDs = append(t.t.IncludeGroupIDs, id)
+	}
+	for _, g := range bt.ExcludeGroups {
+		id, err := i.group(ctx, g.UUID, g.Name, "")
+		if err != nil {
+			return nil, err
+		}
+		t.t.ExcludeGroupIDs = append(t.t.ExcludeGroupIDs, id)
+	}
+
+	return t, nil
+}
+
+func (i *bundleImporter) insertTrigger(ctx context.Context, t *Trigger) (int, error) {
+	var id int
+	err := i.tx.GetContext(ctx, &id, insertTriggerSQL, t.TriggerType(), null.String(t.Keyword()), null.String(t.ReferrerID()), null.String(t.MatchType()), t.ChannelID(), t.FlowID(), i.userID, i.oa.OrgID())
+	if err != nil {
+		return 0, err
+	}
+	if len(t.IncludeGroupIDs()) > 0 {
+		if _, err := i.tx.ExecContext(ctx, insertTriggerGroupsSQL, id, pq.Array(t.IncludeGroupIDs())); err != nil {
+			return 0, err
+		}
+	}
+	if len(t.ExcludeGroupIDs()) > 0 {
+		if _, err := i.tx.ExecContext(ctx, insertTriggerExcludeGroupsSQL, id, pq.Array(t.ExcludeGroupIDs())); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// whether two triggers are the same apart from their ids
+func triggersEquivalent(t1, t2 *Trigger) bool {
+	return t1.FlowID() == t2.FlowID() && t1.MatchType() == t2.MatchType() && t1.ChannelID() == t2.ChannelID() &&
+		sameGroupIDs(t1.IncludeGroupIDs(), t2.IncludeGroupIDs()) && sameGroupIDs(t1.ExcludeGroupIDs(), t2.ExcludeGroupIDs())
+}
+
+func sameGroupIDs(ids1, ids2 []GroupID) bool {
+	if len(ids1) != len(ids2) {
+		return false
+	}
+	seen := make(map[GroupID]bool, len(ids1))
+	for _, id := range ids1 {
+		seen[id] = true
+	}
+	for _, id := range ids2 {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package models_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const registrationFlowDef = `{
+	"uuid": "2bd8b2f8-4d36-4d1f-8a4e-7ef8a3cf2a31",
+	"name": "Registration",
+	"spec_version": "13.0.0",
+	"language": "eng",
+	"type": "messaging",
+	"revision": 3,
+	"expire_after_minutes": 720,
+	"localization": {},
+	"nodes": [
+		{
+			"uuid": "0fd5cfe3-2d4b-49f0-a4b5-0a2f3a8b8d1c",
+			"actions": [
+				{
+					"uuid": "6b5a1e1c-8b2a-4d84-a3a0-7b08b0d1e7a2",
+					"type": "add_contact_groups",
+					"groups": [{"uuid": "8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d", "name": "Doctors"}]
+				}
+			],
+			"exits": [{"uuid": "d2f1c9a0-3e4b-4c5d-8e6f-7a8b9c0d1e2f"}]
+		}
+	]
+}`
+
+func TestImportBundle(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`DELETE FROM triggers_trigger`)
+	joinID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+	helpID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.PickANumber, "help", models.MatchFirst, nil, nil)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+
+	bundle := &models.Bundle{}
+	err = json.Unmarshal([]byte(`{
+		"version": "13",
+		"fields": [
+			{"key": "age", "name": "Age", "type": "number"},
+			{"key": "nickname", "name": "Nickname", "type": "text"}
+		],
+		"groups": [
+			{"uuid": "8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d", "name": "doctors", "query": null},
+			{"uuid": "f0a9b8c7-d6e5-4f3a-a2b1-c0d9e8f7a6b5", "name": "Youth", "query": "age < 18"}
+		],
+		"flows": [`+registrationFlowDef+`],
+		"campaigns": [
+			{
+				"uuid": "b4e2d9a1-7c3f-4e5a-9b8d-1f2e3d4c5b6a",
+				"name": "Welcome",
+				"group": {"uuid": "f0a9b8c7-d6e5-4f3a-a2b1-c0d9e8f7a6b5", "name": "Youth"},
+				"events": [
+					{
+						"event_type": "F",
+						"relative_to": {"key": "joined", "label": "Joined"},
+						"offset": 1,
+						"unit": "D",
+						"delivery_hour": -1,
+						"start_mode": "I",
+						"flow": {"uuid": "2bd8b2f8-4d36-4d1f-8a4e-7ef8a3cf2a31", "name": "Registration"}
+					},
+					{
+						"event_type": "M",
+						"relative_to": {"key": "joined", "label": "Joined"},
+						"offset": 2,
+						"unit": "D",
+						"delivery_hour": 9,
+						"message": {"eng": "Welcome!", "fra": "Bienvenue!"},
+						"base_language": "eng"
+					}
+				]
+			}
+		],
+		"triggers": [
+			{"trigger_type": "K", "keyword": "Join", "flow": {"uuid": "2bd8b2f8-4d36-4d1f-8a4e-7ef8a3cf2a31", "name": "Registration"}},
+			{"trigger_type": "K", "keyword": "help", "match_type": "F", "flow": {"uuid": "5890fe3a-f204-4661-b74d-025be4ee019c", "name": "Pick a Number"}},
+			{"trigger_type": "K", "keyword": "register", "flow": {"uuid": "2bd8b2f8-4d36-4d1f-8a4e-7ef8a3cf2a31", "name": "Registration"}, "groups": [{"uuid": "f0a9b8c7-d6e5-4f3a-a2b1-c0d9e8f7a6b5", "name": "Youth"}]}
+		]
+	}`), bundle)
+	require.NoError(t, err)
+
+	tx := db.MustBegin()
+	report, err := models.ImportBundle(ctx, tx, config.Mailroom, oa, testdata.Admin.ID, bundle)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	// age field existed, nickname was created and joined already existed
+	require.Len(t, report.Fields, 3)
+	assert.Equal(t, models.BundleImportExisting, report.Fields[0].Action)
+	assert.Equal(t, int(testdata.AgeField.ID), report.Fields[0].ID)
+	assert.Equal(t, models.BundleImportCreated, report.Fields[1].Action)
+	assert.Equal(t, models.BundleImportExisting, report.Fields[2].Action)
+	assert.Equal(t, int(testdata.JoinedField.ID), report.Fields[2].ID)
+
+	// doctors group was matched by name and so remapped, youth group was created and needs populating
+	require.Len(t, report.Groups, 2)
+	assert.Equal(t, models.BundleImportExisting, report.Groups[0].Action)
+	assert.Equal(t, int(testdata.DoctorsGroup.ID), report.Groups[0].ID)
+	assert.Equal(t, models.BundleImportCreated, report.Groups[1].Action)
+	assert.Equal(t, string(testdata.DoctorsGroup.UUID), report.RemappedUUIDs["8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d"])
+	assert.Equal(t, map[models.GroupID]string{models.GroupID(report.Groups[1].ID): "age < 18"}, report.DynamicGroups)
+
+	require.Len(t, report.Flows, 1)
+	assert.Equal(t, models.BundleImportCreated, report.Flows[0].Action)
+	assert.Equal(t, "2bd8b2f8-4d36-4d1f-8a4e-7ef8a3cf2a31", report.Flows[0].UUID)
+	flowID := report.Flows[0].ID
+
+	// flow definition should reference the existing doctors group
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrevision WHERE flow_id = $1 AND revision = 1 AND definition LIKE '%' || $2 || '%'`, []interface{}{flowID, testdata.DoctorsGroup.UUID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flow WHERE id = $1 AND expires_after_minutes = 720 AND flow_type = 'M'`, []interface{}{flowID}, 1)
+
+	// campaign created with a flow event and a message event which has its own system flow
+	require.Len(t, report.Campaigns, 1)
+	assert.Equal(t, models.BundleImportCreated, report.Campaigns[0].Action)
+	assert.Len(t, report.EventIDs, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_campaignevent WHERE campaign_id = $1 AND is_active = TRUE`, []interface{}{report.Campaigns[0].ID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_campaignevent e JOIN flows_flow f ON f.id = e.flow_id WHERE e.campaign_id = $1 AND e.event_type = 'M' AND f.is_system = TRUE AND e.message -> 'fra' = 'Bienvenue!'`, []interface{}{report.Campaigns[0].ID}, 1)
+
+	// join trigger created and existing one archived as ambiguous, help trigger already existed
+	require.Len(t, report.Triggers, 3)
+	assert.Equal(t, models.BundleImportCreated, report.Triggers[0].Action)
+	assert.Equal(t, "join", report.Triggers[0].Keyword)
+	assert.Equal(t, models.BundleImportExisting, report.Triggers[1].Action)
+	assert.Equal(t, int(helpID), report.Triggers[1].ID)
+	assert.Equal(t, models.BundleImportCreated, report.Triggers[2].Action)
+	assert.Equal(t, []models.TriggerID{joinID}, report.ArchivedTriggerIDs)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM triggers_trigger_groups WHERE trigger_id = $1`, []interface{}{report.Triggers[2].ID}, 1)
+
+	// importing again updates the flow and campaign rather than creating new ones
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+
+	tx = db.MustBegin()
+	report, err = models.ImportBundle(ctx, tx, config.Mailroom, oa, testdata.Admin.ID, bundle)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, models.BundleImportUpdated, report.Flows[0].Action)
+	assert.Equal(t, flowID, report.Flows[0].ID)
+	assert.Equal(t, models.BundleImportUpdated, report.Campaigns[0].Action)
+	assert.Equal(t, models.BundleImportExisting, report.Triggers[0].Action)
+	assert.Equal(t, []models.TriggerID{}, report.ArchivedTriggerIDs)
+	assert.Equal(t, map[models.GroupID]string{}, report.DynamicGroups)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrevision WHERE flow_id = $1`, []interface{}{flowID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_campaignevent WHERE campaign_id = $1 AND is_active = TRUE`, []interface{}{report.Campaigns[0].ID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_campaignevent WHERE campaign_id = $1 AND is_active = FALSE`, []interface{}{report.Campaigns[0].ID}, 2)
+
+	// a bundle referencing a flow which doesn't exist fails
+	bundle = &models.Bundle{
+		Version:  "13",
+		Triggers: []*models.BundleTrigger{{TriggerType: models.KeywordTriggerType, Keyword: "foo", Flow: &assets.FlowReference{UUID: "a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d", Name: "Missing"}}},
+	}
+	_, err = models.ImportBundle(ctx, db, config.Mailroom, oa, testdata.Admin.ID, bundle)
+	assert.EqualError(t, err, "no such flow 'Missing' (a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d)")
+
+	// as does an old export
+	_, err = models.ImportBundle(ctx, db, config.Mailroom, oa, testdata.Admin.ID, &models.Bundle{Version: "11.12"})
+	assert.EqualError(t, err, "unsupported export version 11.12, must be 13 or later")
+}
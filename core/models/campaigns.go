@@ -4,11 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/utils/dbutil"
 	"github.com/nyaruka/null"
 
@@ -39,6 +42,9 @@ type OffsetUnit string
 // StartMode defines how a campaign event should be started
 type StartMode string
 
+// CampaignEventType defines whether a campaign event starts a flow or sends a message
+type CampaignEventType string
+
 const (
 	// CreatedOnKey is key of created on system field
 	CreatedOnKey = "created_on"
@@ -69,6 +75,20 @@ const (
 
 	// StartModePassive means the flow should be started without interrupting the user in other flows
 	StartModePassive = StartMode("P")
+
+	// CampaignEventTypeFlow means the event starts a flow
+	CampaignEventTypeFlow = CampaignEventType("F")
+
+	// CampaignEventTypeMessage means the event sends a message via a generated single message flow
+	CampaignEventTypeMessage = CampaignEventType("M")
+)
+
+// message events store their translated text keyed by language in the event's message column, and these reserved keys
+// (which can't be language codes) hold JSON encoded options applied to the message regardless of language
+const (
+	messageAttachmentsKey  = "_attachments"
+	messageQuickRepliesKey = "_quick_replies"
+	messageTemplateKey     = "_template"
 )
 
 // Campaign is our struct for a campaign and all its events
@@ -107,7 +127,7 @@ type CampaignEvent struct {
 	e struct {
 		ID            CampaignEventID   `json:"id"`
 		UUID          CampaignEventUUID `json:"uuid"`
-		EventType     string            `json:"event_type"`
+		EventType     CampaignEventType `json:"event_type"`
 		StartMode     StartMode         `json:"start_mode"`
 		RelativeToID  FieldID           `json:"relative_to_id"`
 		RelativeToKey string            `json:"relative_to_key"`
@@ -115,11 +135,26 @@ type CampaignEvent struct {
 		Unit          OffsetUnit        `json:"unit"`
 		DeliveryHour  int               `json:"delivery_hour"`
 		FlowID        FlowID            `json:"flow_id"`
+		Message       map[string]string `json:"message"`
 	}
 
 	campaign *Campaign
 }
 
+// CampaignMessageTemplate is a template a message event should be sent with, if a translation exists for the channel
+type CampaignMessageTemplate struct {
+	UUID      assets.TemplateUUID `json:"uuid"      validate:"required"`
+	Name      string              `json:"name"`
+	Variables []string            `json:"variables"`
+}
+
+// CampaignMessageOptions are the options beyond translated text that a message event can be sent with
+type CampaignMessageOptions struct {
+	Attachments  []utils.Attachment
+	QuickReplies []string
+	Template     *CampaignMessageTemplate
+}
+
 // UnmarshalJSON is our unmarshaller for json data
 func (e *CampaignEvent) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, &e.e)
@@ -256,6 +291,44 @@ func (e *CampaignEvent) Campaign() *Campaign { return e.campaign }
 // StartMode returns the start mode for this campaign event
 func (e *CampaignEvent) StartMode() StartMode { return e.e.StartMode }
 
+// EventType returns whether this campaign event starts a flow or sends a message
+func (e *CampaignEvent) EventType() CampaignEventType { return e.e.EventType }
+
+// FlowID returns the id of the flow this event starts, which for message events is the generated message flow
+func (e *CampaignEvent) FlowID() FlowID { return e.e.FlowID }
+
+// MessageOptions returns the attachments, quick replies and template (if any) defined on this message event, or nil
+// if this isn't a message event or it doesn't define any
+func (e *CampaignEvent) MessageOptions() (*CampaignMessageOptions, error) {
+	if e.EventType() != CampaignEventTypeMessage {
+		return nil, nil
+	}
+
+	opts := &CampaignMessageOptions{}
+
+	if v, ok := e.e.Message[messageAttachmentsKey]; ok {
+		if err := json.Unmarshal([]byte(v), &opts.Attachments); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling attachments for campaign event: %d", e.ID())
+		}
+	}
+	if v, ok := e.e.Message[messageQuickRepliesKey]; ok {
+		if err := json.Unmarshal([]byte(v), &opts.QuickReplies); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling quick replies for campaign event: %d", e.ID())
+		}
+	}
+	if v, ok := e.e.Message[messageTemplateKey]; ok {
+		opts.Template = &CampaignMessageTemplate{}
+		if err := utils.UnmarshalAndValidate([]byte(v), opts.Template); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling template for campaign event: %d", e.ID())
+		}
+	}
+
+	if len(opts.Attachments) == 0 && len(opts.QuickReplies) == 0 && opts.Template == nil {
+		return nil, nil
+	}
+	return opts, nil
+}
+
 // loadCampaigns loads all the campaigns for the passed in org
 func loadCampaigns(ctx context.Context, db sqlx.Queryer, orgID OrgID) ([]*Campaign, error) {
 	start := time.Now()
@@ -308,7 +381,8 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
             e.offset as offset,
 			e.unit as unit,
 			e.delivery_hour as delivery_hour,
-			e.flow_id as flow_id
+			e.flow_id as flow_id,
+			hstore_to_json(e.message) as message
 		FROM 
 			campaigns_campaignevent e
 			JOIN contacts_contactfield f on e.relative_to_id = f.id
@@ -392,6 +466,182 @@ const (
 	FireResultSkipped = "S"
 )
 
+// MaxCampaignRepeats is the most times a repeating campaign event can fire again for a contact
+const MaxCampaignRepeats = 100
+
+// the shortest interval a campaign event can repeat at, to protect against runaway repetition
+const minCampaignRepeatInterval = time.Hour
+
+// CampaignRepeat is the configuration of a campaign event which, after firing, repeats on an interval until the contact
+// leaves the campaign group, has a field with a given value, or the event has repeated the maximum number of times
+type CampaignRepeat struct {
+	Interval   int        `json:"interval"`
+	Unit       OffsetUnit `json:"unit"`
+	MaxRepeats int        `json:"max_repeats"`
+	UntilField string     `json:"until_field"`
+	UntilValue string     `json:"until_value"`
+}
+
+func (r *CampaignRepeat) valid() bool {
+	switch r.Unit {
+	case OffsetMinute:
+		return time.Duration(r.Interval)*time.Minute >= minCampaignRepeatInterval
+	case OffsetHour, OffsetDay, OffsetWeek:
+		return r.Interval > 0
+	}
+	return false
+}
+
+// Limit returns the number of times the event can repeat for a contact
+func (r *CampaignRepeat) Limit() int {
+	if r.MaxRepeats <= 0 || r.MaxRepeats > MaxCampaignRepeats {
+		return MaxCampaignRepeats
+	}
+	return r.MaxRepeats
+}
+
+// Next returns the next occurrence after the passed in time in the passed in timezone
+func (r *CampaignRepeat) Next(tz *time.Location, t time.Time) time.Time {
+	t = t.In(tz)
+
+	switch r.Unit {
+	case OffsetMinute:
+		return t.Add(time.Minute * time.Duration(r.Interval))
+	case OffsetHour:
+		return t.Add(time.Hour * time.Duration(r.Interval))
+	case OffsetDay:
+		return t.AddDate(0, 0, r.Interval)
+	default:
+		return t.AddDate(0, 0, r.Interval*7)
+	}
+}
+
+// IsComplete returns whether the passed in contact has met the condition to stop this repeating
+func (r *CampaignRepeat) IsComplete(contact *flows.Contact) bool {
+	if r.UntilField == "" {
+		return false
+	}
+
+	value := contact.Fields()[r.UntilField]
+	if value == nil {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(fmt.Sprint(value.QueryValue())), strings.TrimSpace(r.UntilValue))
+}
+
+const selectFiredFiresSQL = `
+SELECT 
+	id as fire_id,
+	event_id,
+	contact_id,
+	scheduled,
+	fired,
+	fired_result
+FROM 
+	campaigns_eventfire
+WHERE 
+	id = ANY($1) AND
+	fired IS NOT NULL
+`
+
+const selectContactFireCountsSQL = `
+SELECT 
+	contact_id, 
+	COUNT(*) 
+FROM 
+	campaigns_eventfire 
+WHERE 
+	event_id = $1 AND 
+	contact_id = ANY($2) AND 
+	fired IS NOT NULL 
+GROUP BY 
+	contact_id
+`
+
+// ScheduleCampaignRepeats schedules the next occurrence of the passed in repeating event for each of the passed in fires
+// which has now been fired, unless the contact has left the campaign group, met the repeat's until condition, or
+// already had the maximum number of repeats
+func ScheduleCampaignRepeats(ctx context.Context, db Queryer, oa *OrgAssets, event *CampaignEvent, repeat *CampaignRepeat, fires []*EventFire) error {
+	fireIDs := make([]int64, len(fires))
+	for i, f := range fires {
+		fireIDs[i] = int64(f.FireID)
+	}
+
+	// only fires which were actually fired (started or skipped) are repeated, failed fires will be retried
+	rows, err := db.QueryxContext(ctx, selectFiredFiresSQL, pq.Array(fireIDs))
+	if err != nil {
+		return errors.Wrapf(err, "error selecting fired event fires")
+	}
+	defer rows.Close()
+
+	fired := make(map[ContactID]*EventFire, len(fireIDs))
+	contactIDs := make([]ContactID, 0, len(fireIDs))
+	for rows.Next() {
+		fire := &EventFire{}
+		if err := rows.StructScan(fire); err != nil {
+			return errors.Wrapf(err, "error scanning event fire")
+		}
+		fired[fire.ContactID] = fire
+		contactIDs = append(contactIDs, fire.ContactID)
+	}
+	rows.Close()
+
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	// count how many times each contact has had this event fire, the first of which wasn't a repeat
+	counts := make(map[ContactID]int, len(contactIDs))
+	rows, err = db.QueryxContext(ctx, selectContactFireCountsSQL, event.ID(), pq.Array(contactIDs))
+	if err != nil {
+		return errors.Wrapf(err, "error counting event fires")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var contactID ContactID
+		var count int
+		if err := rows.Scan(&contactID, &count); err != nil {
+			return errors.Wrapf(err, "error scanning event fire count")
+		}
+		counts[contactID] = count
+	}
+	rows.Close()
+
+	contacts, err := LoadContacts(ctx, db, oa, contactIDs)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contacts for repeating event")
+	}
+
+	tz := oa.Env().Timezone()
+	now := time.Now()
+	fas := make([]*FireAdd, 0, len(contacts))
+
+	for _, c := range contacts {
+		if counts[c.ID()]-1 >= repeat.Limit() {
+			continue
+		}
+
+		contact, err := c.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact")
+		}
+		if c.Status() != ContactStatusActive || !event.QualifiesByGroup(contact) || repeat.IsComplete(contact) {
+			continue
+		}
+
+		// keep to the original cadence but never schedule in the past, e.g. if fires were delayed by a backlog
+		next := repeat.Next(tz, fired[c.ID()].Scheduled)
+		if next.Before(now) {
+			next = repeat.Next(tz, now)
+		}
+
+		fas = append(fas, &FireAdd{ContactID: c.ID(), EventID: event.ID(), Scheduled: next})
+	}
+
+	return AddEventFires(ctx, db, fas)
+}
+
 // EventFire represents a single campaign event fire for an event and contact
 type EventFire struct {
 	FireID      FireID          `db:"fire_id"`
@@ -447,6 +697,96 @@ WHERE
 	f.fired IS NULL
 `
 
+// ClaimEventFires claims the passed in event fires for firing, returning those which weren't already claimed, so that
+// if the same fire is queued more than once, it is only fired once. Claims expire after the given period so that those
+// of workers which die before firing are released.
+func ClaimEventFires(ctx context.Context, db Queryer, fires []*EventFire, expiration time.Duration) ([]*EventFire, error) {
+	byID := make(map[FireID]*EventFire, len(fires))
+	ids := make([]FireID, len(fires))
+	for i, f := range fires {
+		byID[f.FireID] = f
+		ids[i] = f.FireID
+	}
+
+	var claimedIDs []FireID
+	err := db.SelectContext(ctx, &claimedIDs, claimEventFiresSQL, pq.Array(ids), int(expiration/time.Second))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error claiming event fires")
+	}
+
+	claimed := make([]*EventFire, len(claimedIDs))
+	for i, id := range claimedIDs {
+		claimed[i] = byID[id]
+	}
+	return claimed, nil
+}
+
+const claimEventFiresSQL = `
+UPDATE
+	campaigns_eventfire
+SET
+	claimed_on = NOW()
+WHERE
+	id = ANY($1) AND
+	fired IS NULL AND
+	(claimed_on IS NULL OR claimed_on < NOW() - $2 * INTERVAL '1 second')
+RETURNING
+	id
+`
+
+// UnclaimedEventFires returns which of the passed in event fires aren't currently claimed
+func UnclaimedEventFires(ctx context.Context, db Queryer, fireIDs []FireID, expiration time.Duration) ([]FireID, error) {
+	unclaimed := make([]FireID, 0, len(fireIDs))
+	err := db.SelectContext(ctx, &unclaimed, selectUnclaimedEventFiresSQL, pq.Array(fireIDs), int(expiration/time.Second))
+	return unclaimed, errors.Wrapf(err, "error selecting unclaimed event fires")
+}
+
+const selectUnclaimedEventFiresSQL = `
+SELECT
+	id
+FROM
+	campaigns_eventfire
+WHERE
+	id = ANY($1) AND
+	(claimed_on IS NULL OR claimed_on < NOW() - $2 * INTERVAL '1 second')
+ORDER BY
+	id
+`
+
+// UnclaimEventFires releases the claims on the passed in event fires so that they can be retried
+func UnclaimEventFires(ctx context.Context, db Queryer, fires []*EventFire) error {
+	ids := make([]FireID, len(fires))
+	for i, f := range fires {
+		ids[i] = f.FireID
+	}
+
+	_, err := db.ExecContext(ctx, `UPDATE campaigns_eventfire SET claimed_on = NULL WHERE id = ANY($1) AND fired IS NULL`, pq.Array(ids))
+	return errors.Wrapf(err, "error unclaiming event fires")
+}
+
+// SkipOverdueEventFires marks as skipped the unfired event fires which were scheduled before the passed in time,
+// returning the number of fires skipped. Fires end up this overdue because of clock skew or fires being created in
+// the past by migrations, and firing them now would surprise contacts.
+func SkipOverdueEventFires(ctx context.Context, db Queryer, scheduledBefore time.Time) (int, error) {
+	result, err := db.ExecContext(ctx, skipOverdueEventFiresSQL, scheduledBefore)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error skipping overdue event fires")
+	}
+	count, _ := result.RowsAffected()
+	return int(count), nil
+}
+
+const skipOverdueEventFiresSQL = `
+UPDATE
+	campaigns_eventfire
+SET
+	fired = NOW(),
+	fired_result = 'S'
+WHERE
+	fired IS NULL AND
+	scheduled < $1
+`
+
 // DeleteUnfiredEventFires removes event fires for the passed in event and contact
 func DeleteUnfiredEventFires(ctx context.Context, tx Queryer, removes []*FireDelete) error {
 	if len(removes) == 0 {
@@ -589,6 +929,51 @@ func AddCampaignEventsForGroupAddition(ctx context.Context, tx Queryer, org *Org
 	return AddEventFires(ctx, tx, fas)
 }
 
+// RescheduleCampaignEventsForField recalculates the unfired event fires of the passed in contacts for all events relative
+// to the field with the passed in key, which can be one of the system fields created_on or last_seen_on. This should be
+// called whenever the value of that field changes outside of a flow session.
+func RescheduleCampaignEventsForField(ctx context.Context, tx Queryer, org *OrgAssets, contacts []*flows.Contact, key string) error {
+	field := org.FieldByKey(key)
+	if field == nil {
+		return nil
+	}
+
+	events := org.CampaignEventsByFieldID(field.ID())
+	if len(events) == 0 {
+		return nil
+	}
+
+	fds := make([]*FireDelete, 0, len(contacts)*len(events))
+	fas := make([]*FireAdd, 0, len(contacts)*len(events))
+
+	tz := org.Env().Timezone()
+	now := time.Now()
+
+	for _, contact := range contacts {
+		for _, e := range events {
+			if !e.QualifiesByGroup(contact) {
+				continue
+			}
+
+			fds = append(fds, &FireDelete{ContactID: ContactID(contact.ID()), EventID: e.ID()})
+
+			scheduled, err := e.ScheduleForContact(tz, now, contact)
+			if err != nil {
+				return errors.Wrapf(err, "error calculating schedule for event: %d and contact: %d", e.ID(), contact.ID())
+			}
+			if scheduled != nil {
+				fas = append(fas, &FireAdd{ContactID: ContactID(contact.ID()), EventID: e.ID(), Scheduled: *scheduled})
+			}
+		}
+	}
+
+	if err := DeleteUnfiredEventFires(ctx, tx, fds); err != nil {
+		return errors.Wrapf(err, "error deleting unfired event fires for field: %s", key)
+	}
+
+	return AddEventFires(ctx, tx, fas)
+}
+
 // ScheduleCampaignEvent calculates event fires for a new campaign event
 func ScheduleCampaignEvent(ctx context.Context, db *sqlx.DB, orgID OrgID, eventID CampaignEventID) error {
 	oa, err := GetOrgAssetsWithRefresh(ctx, db, orgID, RefreshCampaigns)
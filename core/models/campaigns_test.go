@@ -6,6 +6,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
@@ -81,6 +84,51 @@ func TestCampaignSchedule(t *testing.T) {
 	}
 }
 
+func TestCampaignMessageOptions(t *testing.T) {
+	tcs := []struct {
+		EventJSON string
+		Options   *models.CampaignMessageOptions
+		HasError  bool
+	}{
+		// flow events never have message options
+		{`{"id": 1, "event_type": "F", "message": null}`, nil, false},
+
+		// message events with only translated text don't either
+		{`{"id": 2, "event_type": "M", "message": {"eng": "Hi there", "spa": "Hola"}}`, nil, false},
+
+		{
+			`{"id": 3, "event_type": "M", "message": {"eng": "Hi there", "_attachments": "[\"image/jpeg:https://example.com/hi.jpg\"]", "_quick_replies": "[\"Yes\", \"No\"]"}}`,
+			&models.CampaignMessageOptions{Attachments: []utils.Attachment{"image/jpeg:https://example.com/hi.jpg"}, QuickReplies: []string{"Yes", "No"}},
+			false,
+		},
+		{
+			`{"id": 4, "event_type": "M", "message": {"eng": "Hi there", "_template": "{\"uuid\": \"9c22b594-fcab-4b29-9bcb-ce4404894a80\", \"name\": \"revive_issue\", \"variables\": [\"Bob\"]}"}}`,
+			&models.CampaignMessageOptions{Template: &models.CampaignMessageTemplate{UUID: "9c22b594-fcab-4b29-9bcb-ce4404894a80", Name: "revive_issue", Variables: []string{"Bob"}}},
+			false,
+		},
+
+		// template without a UUID
+		{`{"id": 5, "event_type": "M", "message": {"eng": "Hi there", "_template": "{\"name\": \"revive_issue\"}"}}`, nil, true},
+
+		// invalid JSON
+		{`{"id": 6, "event_type": "M", "message": {"eng": "Hi there", "_quick_replies": "[\"Yes\""}}`, nil, true},
+	}
+
+	for i, tc := range tcs {
+		evt := &models.CampaignEvent{}
+		err := json.Unmarshal([]byte(tc.EventJSON), evt)
+		require.NoError(t, err)
+
+		options, err := evt.MessageOptions()
+		if tc.HasError {
+			assert.Error(t, err, "%d: expected error", i)
+		} else {
+			assert.NoError(t, err, "%d: unexpected error", i)
+			assert.Equal(t, tc.Options, options, "%d: options mismatch", i)
+		}
+	}
+}
+
 func TestAddEventFires(t *testing.T) {
 	ctx := testsuite.CTX()
 	db := testsuite.DB()
@@ -114,3 +162,62 @@ func TestAddEventFires(t *testing.T) {
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2`, []interface{}{testdata.Cathy.ID, testdata.RemindersEvent1.ID}, 2)
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, []interface{}{testdata.Bob.ID}, 2)
 }
+
+func TestRescheduleCampaignEventsForField(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	defer testsuite.Reset()
+
+	// create an event based on last_seen_on + 1 day
+	var eventID models.CampaignEventID
+	err := db.Get(&eventID, `
+	INSERT INTO campaigns_campaignevent(is_active, created_on, modified_on, uuid, "offset", unit, event_type, delivery_hour, campaign_id, created_by_id, modified_by_id, flow_id, relative_to_id, start_mode)
+	VALUES(TRUE, NOW(), NOW(), $1, 1, 'D', 'F', -1, $2, 1, 1, $3, $4, 'I') RETURNING id`, uuids.New(), testdata.RemindersCampaign.ID, testdata.Favorites.ID, testdata.LastSeenOnField.ID)
+	require.NoError(t, err)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshCampaigns)
+	require.NoError(t, err)
+
+	reschedule := func(lastSeenOn time.Time) {
+		db.MustExec(`UPDATE contacts_contact SET last_seen_on = $2 WHERE id = $1`, testdata.Cathy.ID, lastSeenOn)
+		_, cathy := testdata.Cathy.Load(db, oa)
+
+		err := models.RescheduleCampaignEventsForField(ctx, db, oa, []*flows.Contact{cathy}, models.LastSeenOnKey)
+		require.NoError(t, err)
+	}
+
+	reschedule(time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE event_id = $1 AND fired IS NULL`, []interface{}{eventID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE event_id = $1 AND contact_id = $2 AND scheduled = '2040-01-02T00:00:00Z'`, []interface{}{eventID, testdata.Cathy.ID}, 1)
+
+	// seeing the contact again replaces the unfired fire
+	reschedule(time.Date(2040, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE event_id = $1 AND fired IS NULL`, []interface{}{eventID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE event_id = $1 AND contact_id = $2 AND scheduled = '2040-03-02T00:00:00Z'`, []interface{}{eventID, testdata.Cathy.ID}, 1)
+
+	// events relative to other fields are left alone
+	err = models.AddEventFires(ctx, db, []*models.FireAdd{{ContactID: testdata.Cathy.ID, EventID: testdata.RemindersEvent1.ID, Scheduled: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)}})
+	require.NoError(t, err)
+
+	reschedule(time.Date(2040, 4, 1, 0, 0, 0, 0, time.UTC))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE event_id = $1 AND fired IS NULL`, []interface{}{testdata.RemindersEvent1.ID}, 1)
+}
+
+func TestCampaignRepeat(t *testing.T) {
+	eastern, _ := time.LoadLocation("US/Eastern")
+
+	repeat := &models.CampaignRepeat{Interval: 2, Unit: models.OffsetDay}
+	assert.Equal(t, models.MaxCampaignRepeats, repeat.Limit())
+	assert.Equal(t, time.Date(2029, 11, 5, 0, 30, 0, 0, eastern), repeat.Next(eastern, time.Date(2029, 11, 3, 0, 30, 0, 0, eastern)))
+
+	repeat = &models.CampaignRepeat{Interval: 90, Unit: models.OffsetMinute, MaxRepeats: 5000}
+	assert.Equal(t, models.MaxCampaignRepeats, repeat.Limit())
+	assert.Equal(t, time.Date(2029, 1, 1, 1, 30, 0, 0, eastern), repeat.Next(eastern, time.Date(2029, 1, 1, 0, 0, 0, 0, eastern)))
+
+	repeat = &models.CampaignRepeat{Interval: 1, Unit: models.OffsetWeek, MaxRepeats: 3}
+	assert.Equal(t, 3, repeat.Limit())
+	assert.Equal(t, time.Date(2029, 1, 8, 0, 0, 0, 0, eastern), repeat.Next(eastern, time.Date(2029, 1, 1, 0, 0, 0, 0, eastern)))
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ContentViolation is a way in which a message's content can't be sent on its channel
+type ContentViolation string
+
+// content violations
+const (
+	ContentViolationTextTooLong           = ContentViolation("text_too_long")
+	ContentViolationTooManySegments       = ContentViolation("too_many_segments")
+	ContentViolationUnsupportedAttachment = ContentViolation("unsupported_attachment")
+	ContentViolationTooManyQuickReplies   = ContentViolation("too_many_quick_replies")
+)
+
+// ChannelConstraints are the limits a channel puts on the content of the messages it sends. Zero values mean no limit.
+// Channel types have defaults which can be overridden in channel config, e.g.
+//
+//   {"constraints": {"max_length": 640, "max_segments": 4, "attachment_types": ["image"], "max_attachments": 1}}
+//
+type ChannelConstraints struct {
+	MaxLength       int      `json:"max_length"`
+	MaxSegments     int      `json:"max_segments"`
+	MaxAttachments  int      `json:"max_attachments"`
+	AttachmentTypes []string `json:"attachment_types"`
+	MaxQuickReplies int      `json:"max_quick_replies"`
+}
+
+// the constraints of channel types which courier would otherwise truncate or reject messages for
+var channelTypeConstraints = map[ChannelType]*ChannelConstraints{
+	ChannelType("FB"):  {MaxLength: 2000, MaxQuickReplies: 13},
+	ChannelType("TG"):  {MaxLength: 4096},
+	ChannelType("WA"):  {MaxLength: 4096, MaxQuickReplies: 10},
+	ChannelType("D3"):  {MaxLength: 4096, MaxQuickReplies: 10},
+	ChannelType("T"):   {MaxAttachments: 10, AttachmentTypes: []string{"image", "audio", "video", "application"}},
+	ChannelType("TMS"): {MaxAttachments: 10, AttachmentTypes: []string{"image", "audio", "video", "application"}},
+	ChannelType("TWT"): {MaxLength: 10000, MaxAttachments: 1, MaxQuickReplies: 20},
+	ChannelTypeAndroid: {MaxAttachments: -1},
+}
+
+// Constraints returns the constraints on the content of messages sent on this channel, or nil if it has none
+func (c *Channel) Constraints() *ChannelConstraints {
+	constraints := channelTypeConstraints[c.Type()]
+
+	if raw, found := c.c.Config[ChannelConfigConstraints]; found && raw != nil {
+		override := &ChannelConstraints{}
+		b, err := json.Marshal(raw)
+		if err == nil {
+			err = json.Unmarshal(b, override)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", c.UUID()).Error("invalid channel constraints config")
+			return constraints
+		}
+		return override
+	}
+
+	return constraints
+}
+
+// Check returns the ways in which the passed in message violates these constraints. Extra attachments aren't a
+// violation as they can be split off into follow-up messages.
+func (c *ChannelConstraints) Check(msg *Msg) []ContentViolation {
+	violations := make([]ContentViolation, 0)
+
+	if c.MaxLength > 0 && utf8.RuneCountInString(msg.Text()) > c.MaxLength {
+		violations = append(violations, ContentViolationTextTooLong)
+	}
+	if c.MaxSegments > 0 && msg.URN().Scheme() == urns.TelScheme && CalculateSegments(msg.Text()).Count > c.MaxSegments {
+		violations = append(violations, ContentViolationTooManySegments)
+	}
+	if c.MaxQuickReplies > 0 && msgQuickReplyCount(msg) > c.MaxQuickReplies {
+		violations = append(violations, ContentViolationTooManyQuickReplies)
+	}
+
+	for _, a := range msg.Attachments() {
+		if c.MaxAttachments < 0 || !c.allowsAttachment(a) {
+			violations = append(violations, ContentViolationUnsupportedAttachment)
+			break
+		}
+	}
+
+	return violations
+}
+
+// whether an attachment's content type is one that can be sent, e.g. image/jpeg is allowed by image or image/jpeg
+func (c *ChannelConstraints) allowsAttachment(a utils.Attachment) bool {
+	if len(c.AttachmentTypes) == 0 {
+		return true
+	}
+	for _, t := range c.AttachmentTypes {
+		if a.ContentType() == t || strings.HasPrefix(a.ContentType(), t+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func msgQuickReplyCount(msg *Msg) int {
+	switch qrs := msg.m.Metadata.Map()["quick_replies"].(type) {
+	case []string:
+		return len(qrs)
+	case []interface{}:
+		return len(qrs)
+	}
+	return 0
+}
+
+// ApplyChannelConstraints checks the passed in outgoing message against the constraints of its channel. If the channel
+// splits long messages, text beyond what it can send in one message is split off into follow-up messages, as are
+// attachments beyond what the channel can send in one message, and these are returned in the order they should be sent.
+// If the message can't be sent on its channel, it's failed and an event recording why is returned.
+func ApplyChannelConstraints(org *Org, msg *Msg) ([]*Msg, *ChannelEvent, error) {
+	if msg.channel == nil || msg.Status() == MsgStatusFailed {
+		return nil, nil, nil
+	}
+
+	followUps := make([]*Msg, 0)
+
+	// split long text first so that the parts are checked rather than the whole
+	splitting := msg.channel.Splitting()
+	if splitting != nil {
+		textFollowUps, err := splitMessage(org, msg, splitting)
+		if err != nil {
+			return nil, nil, err
+		}
+		followUps = append(followUps, textFollowUps...)
+	}
+
+	constraints := msg.channel.Constraints()
+	if constraints != nil {
+		violations := constraints.Check(msg)
+		if len(violations) > 0 {
+			msg.SetFailed(MsgFailedInvalidContent)
+
+			rejected := NewChannelEvent(MsgRejectedEventType, org.ID(), msg.ChannelID(), msg.ContactID(), GetURNID(msg.URN()), map[string]interface{}{
+				"msg_uuid":   string(msg.UUID()),
+				"text":       msg.Text(),
+				"violations": violations,
+			}, false)
+
+			return nil, rejected, nil
+		}
+
+		attachmentFollowUps, err := splitAttachments(org, msg, constraints)
+		if err != nil {
+			return nil, nil, err
+		}
+		followUps = append(followUps, attachmentFollowUps...)
+	}
+
+	if splitting != nil {
+		delayFollowUps(msg, followUps, splitting.Delay)
+	}
+
+	return followUps, nil, nil
+}
+
+// splits attachments beyond what the channel can send in one message into as many follow-up messages as it takes to
+// send them
+func splitAttachments(org *Org, msg *Msg, constraints *ChannelConstraints) ([]*Msg, error) {
+	if constraints.MaxAttachments <= 0 || len(msg.m.Attachments) <= constraints.MaxAttachments {
+		return nil, nil
+	}
+
+	extra := msg.Attachments()[constraints.MaxAttachments:]
+	msg.m.Attachments = msg.m.Attachments[:constraints.MaxAttachments]
+	msg.calculateSegments()
+
+	followUps := make([]*Msg, 0, 1)
+	for len(extra) > 0 {
+		n := constraints.MaxAttachments
+		if n > len(extra) {
+			n = len(extra)
+		}
+
+		out := flows.NewMsgOut(msg.URN(), msg.channel.ChannelReference(), "", extra[:n], nil, nil, flows.NilMsgTopic)
+		followUp, err := NewOutgoingMsg(org, msg.channel, msg.ContactID(), out, msg.CreatedOn())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating follow-up message for attachments")
+		}
+
+		followUps = append(followUps, followUp)
+		extra = extra[n:]
+	}
+
+	return followUps, nil
+}
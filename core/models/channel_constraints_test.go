@@ -0,0 +1,117 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelConstraints(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	// Twilio channels get the defaults for their type
+	constraints := oa.ChannelByID(testdata.TwilioChannel.ID).Constraints()
+	require.NotNil(t, constraints)
+	assert.Equal(t, 10, constraints.MaxAttachments)
+
+	db.MustExec(`UPDATE channels_channel SET config = '{"constraints": {"max_length": 20, "max_attachments": 2, "attachment_types": ["image", "audio/mp3"], "max_quick_replies": 2}}' WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	assert.Equal(t, &models.ChannelConstraints{MaxLength: 20, MaxAttachments: 2, AttachmentTypes: []string{"image", "audio/mp3"}, MaxQuickReplies: 2}, channel.Constraints())
+
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+
+	tcs := []struct {
+		text               string
+		attachments        []utils.Attachment
+		quickReplies       []string
+		expectedStatus     models.MsgStatus
+		expectedViolations []models.ContentViolation
+		expectedFollowUps  [][]utils.Attachment
+	}{
+		{
+			text:           "Hi there",
+			attachments:    []utils.Attachment{"image/jpeg:https://foo.bar/1.jpg"},
+			quickReplies:   []string{"yes", "no"},
+			expectedStatus: models.MsgStatusQueued,
+		},
+		{
+			text:               "This is too long to send",
+			expectedStatus:     models.MsgStatusFailed,
+			expectedViolations: []models.ContentViolation{models.ContentViolationTextTooLong},
+		},
+		{
+			text:               "Pick one",
+			attachments:        []utils.Attachment{"audio/wav:https://foo.bar/1.wav"},
+			quickReplies:       []string{"a", "b", "c"},
+			expectedStatus:     models.MsgStatusFailed,
+			expectedViolations: []models.ContentViolation{models.ContentViolationTooManyQuickReplies, models.ContentViolationUnsupportedAttachment},
+		},
+		{
+			text: "Photos",
+			attachments: []utils.Attachment{
+				"image/jpeg:https://foo.bar/1.jpg",
+				"image/jpeg:https://foo.bar/2.jpg",
+				"audio/mp3:https://foo.bar/3.mp3",
+				"image/png:https://foo.bar/4.png",
+				"image/png:https://foo.bar/5.png",
+			},
+			expectedStatus: models.MsgStatusQueued,
+			expectedFollowUps: [][]utils.Attachment{
+				{"audio/mp3:https://foo.bar/3.mp3", "image/png:https://foo.bar/4.png"},
+				{"image/png:https://foo.bar/5.png"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		out := flows.NewMsgOut(urn, channel.ChannelReference(), tc.text, tc.attachments, tc.quickReplies, nil, flows.NilMsgTopic)
+		msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+		require.NoError(t, err)
+
+		followUps, rejected, err := models.ApplyChannelConstraints(oa.Org(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedStatus, msg.Status(), "status mismatch for msg '%s'", tc.text)
+
+		if len(tc.expectedViolations) > 0 {
+			require.NotNil(t, rejected, "expected rejection for msg '%s'", tc.text)
+			assert.Equal(t, models.MsgFailedInvalidContent, msg.FailedReason())
+			assert.Equal(t, models.MsgRejectedEventType, rejected.EventType())
+			assert.Equal(t, tc.expectedViolations, rejected.Extra()["violations"])
+		} else {
+			assert.Nil(t, rejected, "unexpected rejection for msg '%s'", tc.text)
+		}
+
+		if len(tc.expectedFollowUps) > 0 {
+			assert.Len(t, msg.Attachments(), 2)
+			require.Len(t, followUps, len(tc.expectedFollowUps))
+
+			for i, f := range followUps {
+				assert.Equal(t, "", f.Text())
+				assert.Equal(t, tc.expectedFollowUps[i], f.Attachments())
+				assert.Equal(t, channel, f.Channel())
+				assert.Equal(t, msg.URN(), f.URN())
+			}
+		} else {
+			assert.Len(t, followUps, 0)
+		}
+	}
+}
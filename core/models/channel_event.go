@@ -21,6 +21,8 @@ const (
 	MOMissEventType          = ChannelEventType("mo_miss")
 	MOCallEventType          = ChannelEventType("mo_call")
 	StopContactEventType     = ChannelEventType("stop_contact")
+	DeleteContactEventType   = ChannelEventType("delete_contact")
+	MsgRejectedEventType     = ChannelEventType("msg_rejected")
 )
 
 // ContactSeenEvents are those which count as the contact having been seen
@@ -52,13 +54,14 @@ type ChannelEvent struct {
 	}
 }
 
-func (e *ChannelEvent) ID() ChannelEventID    { return e.e.ID }
-func (e *ChannelEvent) ContactID() ContactID  { return e.e.ContactID }
-func (e *ChannelEvent) URNID() URNID          { return e.e.URNID }
-func (e *ChannelEvent) OrgID() OrgID          { return e.e.OrgID }
-func (e *ChannelEvent) ChannelID() ChannelID  { return e.e.ChannelID }
-func (e *ChannelEvent) IsNewContact() bool    { return e.e.NewContact }
-func (e *ChannelEvent) OccurredOn() time.Time { return e.e.OccurredOn }
+func (e *ChannelEvent) ID() ChannelEventID          { return e.e.ID }
+func (e *ChannelEvent) EventType() ChannelEventType { return e.e.EventType }
+func (e *ChannelEvent) ContactID() ContactID        { return e.e.ContactID }
+func (e *ChannelEvent) URNID() URNID                { return e.e.URNID }
+func (e *ChannelEvent) OrgID() OrgID                { return e.e.OrgID }
+func (e *ChannelEvent) ChannelID() ChannelID        { return e.e.ChannelID }
+func (e *ChannelEvent) IsNewContact() bool          { return e.e.NewContact }
+func (e *ChannelEvent) OccurredOn() time.Time       { return e.e.OccurredOn }
 
 func (e *ChannelEvent) Extra() map[string]interface{} {
 	return e.e.Extra.Map()
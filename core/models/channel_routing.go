@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/phonenumbers"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const configChannelRouting = "channel_routing"
+
+// the channel each contact last sent us a message on, which expires after the org's channel stickiness period
+const lastChannelKey = "contact_last_channel:%d:%d"
+
+// ChannelRoutingRule maps tel URNs in a country or with a prefix to the channels that should be preferred for sending to them,
+// and is configured on the org as a list, e.g.
+//
+//   "channel_routing": [
+//     {"prefix": "+25078", "channels": ["c7ac4de2-4d1c-4a2e-8f5b-0b1e8a7b0e01"]},
+//     {"country": "RW", "channels": ["a0a1f8a6-1e8b-4bd8-9e3f-bcf0b6dfd1f5", "c7ac4de2-4d1c-4a2e-8f5b-0b1e8a7b0e01"]}
+//   ]
+//
+type ChannelRoutingRule struct {
+	Country  envs.Country         `json:"country,omitempty"`
+	Prefix   string               `json:"prefix,omitempty"`
+	Channels []assets.ChannelUUID `json:"channels"`
+}
+
+// Matches returns whether this rule applies to the passed in phone number and country
+func (r *ChannelRoutingRule) Matches(number string, country envs.Country) bool {
+	if r.Prefix != "" && !strings.HasPrefix(number, r.Prefix) {
+		return false
+	}
+	if r.Country != "" && r.Country != country {
+		return false
+	}
+	return r.Prefix != "" || r.Country != ""
+}
+
+// ChannelRoutingRules returns the channel routing rules configured for this org
+func (o *Org) ChannelRoutingRules() []*ChannelRoutingRule { return o.channelRouting }
+
+// parses the channel routing rules from our config, logging and ignoring them if they're invalid
+func (o *Org) parseChannelRoutingRules() []*ChannelRoutingRule {
+	var rules []*ChannelRoutingRule
+	if _, err := o.ConfigObject(configChannelRouting, &rules); err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid channel routing config")
+		return nil
+	}
+	return rules
+}
+
+// RouteChannel returns the channel which the org's routing rules say should be used to send to the passed in URN, or nil
+// if no rule applies or none of the rule's channels can send to the URN
+func RouteChannel(oa *OrgAssets, urn urns.URN) *Channel {
+	if urn.Scheme() != urns.TelScheme {
+		return nil
+	}
+
+	rules := oa.Org().ChannelRoutingRules()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	number := urn.Path()
+	country := envs.NilCountry
+	if parsed, err := phonenumbers.Parse(number, ""); err == nil {
+		country = envs.Country(phonenumbers.GetRegionCodeForNumber(parsed))
+	}
+
+	for _, rule := range rules {
+		if !rule.Matches(number, country) {
+			continue
+		}
+
+		for _, channelUUID := range rule.Channels {
+			channel := oa.ChannelByUUID(channelUUID)
+			if channel != nil && channelCanSendTo(channel, urns.TelScheme) {
+				return channel
+			}
+		}
+	}
+	return nil
+}
+
+// RecordLastChannel records the channel that a contact has just sent us a message on, if the org has channel stickiness
+func RecordLastChannel(rc redis.Conn, oa *OrgAssets, contactID ContactID, channel *Channel) error {
+	ttl := oa.Org().ChannelStickiness()
+	if ttl <= 0 {
+		return nil
+	}
+
+	_, err := rc.Do("SET", fmt.Sprintf(lastChannelKey, oa.OrgID(), contactID), string(channel.UUID()), "PX", int(ttl/time.Millisecond))
+	return errors.Wrapf(err, "error recording last channel for contact %d", contactID)
+}
+
+// StickyChannel returns the channel the contact last sent us a message on, if that was within the org's stickiness
+// period and that channel can still send to the passed in URN, otherwise nil
+func StickyChannel(ctx context.Context, rc redis.Conn, oa *OrgAssets, contactID ContactID, urn urns.URN) (*Channel, error) {
+	if oa.Org().ChannelStickiness() <= 0 {
+		return nil, nil
+	}
+
+	// read from redis every time so that we see the last channels recorded by other instances
+	channelUUID, err := redis.String(rc.Do("GET", fmt.Sprintf(lastChannelKey, oa.OrgID(), contactID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up last channel for contact %d", contactID)
+	}
+
+	channel := oa.ChannelByUUID(assets.ChannelUUID(channelUUID))
+	if channel == nil || !channelCanSendTo(channel, urn.Scheme()) {
+		return nil, nil
+	}
+	return channel, nil
+}
+
+// returns whether the passed in channel has the send role and supports the given scheme
+func channelCanSendTo(channel *Channel, scheme string) bool {
+	canSend := false
+	for _, role := range channel.Roles() {
+		if role == assets.ChannelRoleSend {
+			canSend = true
+		}
+	}
+	if !canSend {
+		return false
+	}
+
+	for _, s := range channel.Schemes() {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
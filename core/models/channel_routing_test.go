@@ -0,0 +1,121 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteChannel(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// no rules, no routing
+	assert.Nil(t, models.RouteChannel(oa, urns.URN("tel:+16055741111")))
+
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('channel_routing', $2::jsonb) WHERE id = $1`, testdata.Org1.ID, `[
+		{"prefix": "+1605574", "channels": ["`+string(testdata.TwitterChannel.UUID)+`", "`+string(testdata.VonageChannel.UUID)+`"]},
+		{"country": "RW", "channels": ["`+string(testdata.TwilioChannel.UUID)+`"]},
+		{"country": "KE", "channels": ["f1bc6b5e-3aa4-4c52-9d2e-000000000000"]}
+	]`)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, len(oa.Org().ChannelRoutingRules()))
+
+	// twitter channel can't send to tel so we get the next channel in the rule
+	channel := models.RouteChannel(oa, urns.URN("tel:+16055741111"))
+	assert.Equal(t, testdata.VonageChannel.ID, channel.ID())
+
+	channel = models.RouteChannel(oa, urns.URN("tel:+250788123123"))
+	assert.Equal(t, testdata.TwilioChannel.ID, channel.ID())
+
+	// rule with no valid channels, no matching rule, and non-tel URN
+	assert.Nil(t, models.RouteChannel(oa, urns.URN("tel:+254791541111")))
+	assert.Nil(t, models.RouteChannel(oa, urns.URN("tel:+593979111111")))
+	assert.Nil(t, models.RouteChannel(oa, urns.URN("twitter:bob")))
+
+	// invalid rules are ignored
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('channel_routing', 'RW') WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	assert.Nil(t, oa.Org().ChannelRoutingRules())
+	assert.Nil(t, models.RouteChannel(oa, urns.URN("tel:+250788123123")))
+}
+
+func TestStickyChannel(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+	twitter := oa.ChannelByID(testdata.TwitterChannel.ID)
+
+	// no stickiness configured, so nothing is recorded
+	err = models.RecordLastChannel(rc, oa, testdata.Cathy.ID, vonage)
+	require.NoError(t, err)
+	exists, err := redis.Bool(rc.Do("EXISTS", "contact_last_channel:1:10000"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"channel_stickiness": 3600}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	assert.Equal(t, time.Hour, oa.Org().ChannelStickiness())
+
+	// no last channel recorded for this contact yet
+	sticky, err := models.StickyChannel(ctx, rc, oa, testdata.Cathy.ID, urns.URN("tel:+16055741111"))
+	require.NoError(t, err)
+	assert.Nil(t, sticky)
+
+	err = models.RecordLastChannel(rc, oa, testdata.Cathy.ID, vonage)
+	require.NoError(t, err)
+
+	sticky, err = models.StickyChannel(ctx, rc, oa, testdata.Cathy.ID, urns.URN("tel:+16055741111"))
+	require.NoError(t, err)
+	require.NotNil(t, sticky)
+	assert.Equal(t, testdata.VonageChannel.ID, sticky.ID())
+
+	// channel can't send to twitter URNs so isn't used for them
+	sticky, err = models.StickyChannel(ctx, rc, oa, testdata.Cathy.ID, urns.URN("twitter:cathy"))
+	require.NoError(t, err)
+	assert.Nil(t, sticky)
+
+	// last channel is replaced when contact messages us on another channel
+	err = models.RecordLastChannel(rc, oa, testdata.Cathy.ID, twitter)
+	require.NoError(t, err)
+
+	sticky, err = models.StickyChannel(ctx, rc, oa, testdata.Cathy.ID, urns.URN("twitter:cathy"))
+	require.NoError(t, err)
+	require.NotNil(t, sticky)
+	assert.Equal(t, testdata.TwitterChannel.ID, sticky.ID())
+
+	// last channels recorded by other instances are seen straight away
+	rc.Do("SET", "contact_last_channel:1:10000", string(testdata.VonageChannel.UUID))
+
+	sticky, err = models.StickyChannel(ctx, rc, oa, testdata.Cathy.ID, urns.URN("tel:+16055741111"))
+	require.NoError(t, err)
+	require.NotNil(t, sticky)
+	assert.Equal(t, testdata.VonageChannel.ID, sticky.ID())
+}
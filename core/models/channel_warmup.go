@@ -0,0 +1,252 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the daily send caps of channels being warmed up which don't configure their own
+var defaultWarmupCaps = []int{50, 200, 1000, 5000, 20000}
+
+// each channel's sends on each day of its warm-up are counted so that we know when it's reached that day's cap
+const (
+	channelWarmupKey    = "channel_warmup:%s:%s"
+	channelWarmupExpiry = time.Hour * 24 * 3
+)
+
+// ChannelWarmup is the ramp of daily send caps for a new channel, which protects the reputation of its sender by
+// limiting how many messages it sends on each of its first days, e.g.
+//
+//   {"started_on": "2021-07-01T00:00:00Z", "caps": [50, 200, 1000]}
+//
+// If the start isn't set it's when the channel was added. After the last day, sends aren't capped.
+type ChannelWarmup struct {
+	StartedOn *time.Time `json:"started_on"`
+	Caps      []int      `json:"caps"`
+}
+
+// Warmup returns the warm-up of this channel or nil if it isn't being warmed up
+func (c *Channel) Warmup() *ChannelWarmup {
+	raw, found := c.c.Config[ChannelConfigWarmup]
+	if !found || raw == nil || raw == false {
+		return nil
+	}
+
+	warmup := &ChannelWarmup{}
+
+	// can be configured as just true to use the default caps from when the channel was added
+	if raw != true {
+		b, err := json.Marshal(raw)
+		if err == nil {
+			err = json.Unmarshal(b, warmup)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", c.UUID()).Error("invalid channel warmup config")
+			return nil
+		}
+	}
+
+	if warmup.StartedOn == nil {
+		startedOn := c.CreatedOn()
+		warmup.StartedOn = &startedOn
+	}
+	if len(warmup.Caps) == 0 {
+		warmup.Caps = defaultWarmupCaps
+	}
+	return warmup
+}
+
+// CapOn returns the send cap on the day of the given time, or -1 if sends aren't capped that day
+func (w *ChannelWarmup) CapOn(t time.Time) int {
+	day := int(warmupDay(t).Sub(warmupDay(*w.StartedOn)) / (time.Hour * 24))
+	if day < 0 {
+		day = 0
+	}
+	if day >= len(w.Caps) {
+		return -1
+	}
+	return w.Caps[day]
+}
+
+// warm-up days are UTC days
+func warmupDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// ApplyChannelWarmups reserves a send on its channel's warm-up for each of the passed in messages which is to be sent
+// on a channel being warmed up. Messages which don't fit under today's cap spill over to the first later day that they
+// do fit, and their next attempt is set to the start of that day so that they aren't sent before then. This must be
+// called once messages have been committed, so that messages which never are don't take up reservations.
+func ApplyChannelWarmups(ctx context.Context, db Queryer, rc redis.Conn, msgs []*Msg, now time.Time) error {
+	delayed := make([]interface{}, 0)
+
+	for _, msg := range msgs {
+		if msg.channel == nil || msg.Status() != MsgStatusQueued || msg.IsSandbox() {
+			continue
+		}
+
+		warmup := msg.channel.Warmup()
+		if warmup == nil {
+			continue
+		}
+
+		sendOn, err := reserveWarmupSend(rc, msg.channel.UUID(), warmup, now)
+		if err != nil {
+			return err
+		}
+
+		// messages already delayed past then, e.g. later parts of a split message, keep their delay
+		if sendOn.After(now) && (msg.m.NextAttempt == nil || sendOn.After(*msg.m.NextAttempt)) {
+			msg.m.NextAttempt = &sendOn
+			delayed = append(delayed, &msg.m)
+		}
+	}
+
+	return BulkQuery(ctx, "delaying warmup messages", db, updateMsgsNextAttemptSQL, delayed)
+}
+
+const updateMsgsNextAttemptSQL = `
+UPDATE
+	msgs_msg m
+SET
+	next_attempt = r.next_attempt::timestamp with time zone,
+	modified_on = NOW()
+FROM (
+	VALUES(:id, :next_attempt)
+) AS
+	r(id, next_attempt)
+WHERE
+	m.id = r.id::bigint
+`
+
+// reserves a send on the first day from now that the channel has capacity, returning when that send can be made
+func reserveWarmupSend(rc redis.Conn, channelUUID assets.ChannelUUID, warmup *ChannelWarmup, now time.Time) (time.Time, error) {
+	day := warmupDay(now)
+
+	for {
+		limit := warmup.CapOn(day)
+		if limit < 0 {
+			break
+		}
+
+		key := fmt.Sprintf(channelWarmupKey, channelUUID, day.Format("2006-01-02"))
+
+		rc.Send("MULTI")
+		rc.Send("INCR", key)
+		rc.Send("EXPIRE", key, int(channelWarmupExpiry/time.Second)+int(day.Sub(warmupDay(now))/time.Second))
+		replies, err := redis.Values(rc.Do("EXEC"))
+		if err != nil {
+			return now, errors.Wrapf(err, "error reserving warmup send for channel: %s", channelUUID)
+		}
+
+		sent, _ := redis.Int(replies[0], nil)
+		if sent <= limit {
+			break
+		}
+
+		// this day is full so give back our reservation and try the next day
+		if _, err := rc.Do("DECR", key); err != nil {
+			return now, errors.Wrapf(err, "error releasing warmup send for channel: %s", channelUUID)
+		}
+		day = day.Add(time.Hour * 24)
+	}
+
+	if day.After(now) {
+		return day, nil
+	}
+	return now, nil
+}
+
+const selectDelayedMsgsSQL = `
+SELECT
+	id
+FROM
+	msgs_msg
+WHERE
+	org_id = $1 AND
+	direction = 'O' AND
+	status = 'Q' AND
+	error_count = 0 AND
+	next_attempt <= $2
+ORDER BY
+	next_attempt ASC,
+	id ASC
+LIMIT
+	$3`
+
+// LoadDelayedMessages loads the given org's outgoing messages which were delayed by channel warm-ups or message splitting
+// and can now be sent, ready to be queued to courier
+func LoadDelayedMessages(ctx context.Context, db Queryer, oa *OrgAssets, now time.Time, limit int) ([]*Msg, error) {
+	var ids []MsgID
+	if err := db.SelectContext(ctx, &ids, selectDelayedMsgsSQL, oa.OrgID(), now, limit); err != nil {
+		return nil, errors.Wrapf(err, "error selecting delayed msgs for org: %d", oa.OrgID())
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	msgs, err := LoadMessages(ctx, db, oa.OrgID(), DirectionOut, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		if msg.ContactURNID() != nil {
+			msg.m.URN, err = URNForID(ctx, db, oa, *msg.ContactURNID())
+			if err != nil {
+				return nil, errors.Wrapf(err, "error loading URN for msg: %d", msg.ID())
+			}
+		}
+		if channel := oa.ChannelByID(msg.ChannelID()); channel != nil {
+			msg.m.ChannelUUID = channel.UUID()
+			msg.channel = channel
+		}
+		msg.m.NextAttempt = nil
+	}
+
+	return msgs, nil
+}
+
+const clearMsgsNextAttemptSQL = `UPDATE msgs_msg SET next_attempt = NULL, queued_on = NOW(), modified_on = NOW() WHERE id = ANY($1)`
+
+// ClearMessagesNextAttempt clears the next attempt of the given messages once they've been queued for sending
+func ClearMessagesNextAttempt(ctx context.Context, db Queryer, msgs []*Msg) error {
+	ids := make([]MsgID, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = MsgID(msg.ID())
+	}
+
+	_, err := db.ExecContext(ctx, clearMsgsNextAttemptSQL, pq.Array(ids))
+	return errors.Wrapf(err, "error clearing next attempt of msgs")
+}
+
+const selectOrgsWithDelayedMsgsSQL = `
+SELECT DISTINCT
+	org_id
+FROM
+	msgs_msg
+WHERE
+	direction = 'O' AND
+	status = 'Q' AND
+	error_count = 0 AND
+	next_attempt <= $1`
+
+// OrgIDsWithDelayedMessages gets the ids of the orgs with outgoing messages delayed by channel warm-ups or message
+// splitting which can now be sent
+func OrgIDsWithDelayedMessages(ctx context.Context, db Queryer, now time.Time) ([]OrgID, error) {
+	var ids []OrgID
+	if err := db.SelectContext(ctx, &ids, selectOrgsWithDelayedMsgsSQL, now); err != nil {
+		return nil, errors.Wrapf(err, "error selecting orgs with delayed msgs")
+	}
+	return ids, nil
+}
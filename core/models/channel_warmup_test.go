@@ -0,0 +1,98 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelWarmups(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	// channels aren't warmed up by default
+	assert.Nil(t, oa.ChannelByID(testdata.TwilioChannel.ID).Warmup())
+
+	// a warmup can be just enabled to use the default caps from when the channel was added
+	db.MustExec(`UPDATE channels_channel SET config = '{"warmup": true}', created_on = '2021-07-01T12:00:00Z' WHERE id = $1`, testdata.VonageChannel.ID)
+	db.MustExec(`UPDATE channels_channel SET config = '{"warmup": {"started_on": "2021-07-01T00:00:00Z", "caps": [2, 3]}}' WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	warmup := oa.ChannelByID(testdata.VonageChannel.ID).Warmup()
+	require.NotNil(t, warmup)
+	assert.Equal(t, time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC), warmup.StartedOn.UTC())
+	assert.Equal(t, []int{50, 200, 1000, 5000, 20000}, warmup.Caps)
+	assert.Equal(t, 50, warmup.CapOn(time.Date(2021, 7, 1, 23, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 200, warmup.CapOn(time.Date(2021, 7, 2, 1, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 20000, warmup.CapOn(time.Date(2021, 7, 5, 1, 0, 0, 0, time.UTC)))
+	assert.Equal(t, -1, warmup.CapOn(time.Date(2021, 7, 6, 1, 0, 0, 0, time.UTC)))
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	warmup = channel.Warmup()
+	require.NotNil(t, warmup)
+	assert.Equal(t, []int{2, 3}, warmup.Caps)
+
+	now := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	msgs := make([]*models.Msg, 6)
+	for i := range msgs {
+		urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+		flowMsg := flows.NewMsgOut(urn, assets.NewChannelReference(testdata.TwilioChannel.UUID, "Twilio"), fmt.Sprintf("Hi %d", i), nil, nil, nil, flows.NilMsgTopic)
+		msgs[i], err = models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, flowMsg, now)
+		require.NoError(t, err)
+	}
+
+	err = models.InsertMessages(ctx, db, msgs)
+	require.NoError(t, err)
+
+	err = models.ApplyChannelWarmups(ctx, db, rc, msgs, now)
+	assert.NoError(t, err)
+
+	// first two fit under today's cap, next three spill over to tomorrow and the last to the day after the warmup ends
+	day2 := time.Date(2021, 7, 2, 0, 0, 0, 0, time.UTC)
+	day3 := time.Date(2021, 7, 3, 0, 0, 0, 0, time.UTC)
+	expected := []*time.Time{nil, nil, &day2, &day2, &day2, &day3}
+
+	for i, msg := range msgs {
+		assert.Equal(t, expected[i], msg.NextAttempt(), "next attempt mismatch for msg %d", i)
+	}
+
+	// delayed messages can be loaded once their day comes
+	orgIDs, err := models.OrgIDsWithDelayedMessages(ctx, db, now)
+	assert.NoError(t, err)
+	assert.Len(t, orgIDs, 0)
+
+	orgIDs, err = models.OrgIDsWithDelayedMessages(ctx, db, day2.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []models.OrgID{testdata.Org1.ID}, orgIDs)
+
+	delayed, err := models.LoadDelayedMessages(ctx, db, oa, day2.Add(time.Minute), 100)
+	assert.NoError(t, err)
+	assert.Len(t, delayed, 3)
+	assert.Equal(t, "Hi 2", delayed[0].Text())
+	assert.Equal(t, channel, delayed[0].Channel())
+	assert.Nil(t, delayed[0].NextAttempt())
+
+	err = models.ClearMessagesNextAttempt(ctx, db, delayed)
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE next_attempt IS NOT NULL`, nil, 1)
+}
@@ -5,13 +5,16 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"math"
+	"strconv"
 	"time"
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/utils/cache"
 	"github.com/nyaruka/mailroom/utils/dbutil"
 	"github.com/nyaruka/null"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -36,6 +39,11 @@ const (
 	ChannelConfigCallbackDomain      = "callback_domain"
 	ChannelConfigMaxConcurrentEvents = "max_concurrent_events"
 	ChannelConfigFCMID               = "FCM_ID"
+	ChannelConfigTypingIndicators    = "typing_indicators"
+	ChannelConfigWarmup              = "warmup"
+	ChannelConfigConstraints         = "constraints"
+	ChannelConfigTransliterate       = "transliterate"
+	ChannelConfigSplitMessages       = "split_messages"
 )
 
 // Channel is the mailroom struct that represents channels
@@ -55,6 +63,7 @@ type Channel struct {
 		MatchPrefixes      []string                 `json:"match_prefixes"`
 		AllowInternational bool                     `json:"allow_international"`
 		Config             map[string]interface{}   `json:"config"`
+		CreatedOn          time.Time                `json:"created_on"`
 	}
 }
 
@@ -94,6 +103,9 @@ func (c *Channel) AllowInternational() bool { return c.c.AllowInternational }
 // Parent returns a reference to the parent channel of this channel (if any)
 func (c *Channel) Parent() *assets.ChannelReference { return c.c.Parent }
 
+// CreatedOn returns when this channel was added
+func (c *Channel) CreatedOn() time.Time { return c.c.CreatedOn }
+
 // Config returns the config for this channel
 func (c *Channel) Config() map[string]interface{} { return c.c.Config }
 
@@ -115,6 +127,17 @@ func (c *Channel) ConfigValue(key string, def string) string {
 	return def
 }
 
+// SupportsTyping returns whether this channel has been configured to send typing indicators
+func (c *Channel) SupportsTyping() bool {
+	return c.ConfigValue(ChannelConfigTypingIndicators, "false") == "true"
+}
+
+// Transliterates returns whether this channel has been configured to transliterate outgoing text to GSM-7 where it
+// can, so that messages aren't sent as more expensive UCS-2
+func (c *Channel) Transliterates() bool {
+	return c.ConfigValue(ChannelConfigTransliterate, "false") == "true"
+}
+
 // ChannelReference return a channel reference for this channel
 func (c *Channel) ChannelReference() *assets.ChannelReference {
 	return assets.NewChannelReference(c.UUID(), c.Name())
@@ -169,7 +192,8 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
 		FROM unnest(regexp_split_to_array(c.role,'')) as r)
 	) as roles,
 	JSON_EXTRACT_PATH(c.config::json, 'matching_prefixes') as match_prefixes,
-	JSON_EXTRACT_PATH(c.config::json, 'allow_international') as allow_international
+	JSON_EXTRACT_PATH(c.config::json, 'allow_international') as allow_international,
+	c.created_on as created_on
 FROM 
 	channels_channel c
 WHERE 
@@ -180,14 +204,34 @@ ORDER BY
 ) r;
 `
 
+// the orgs of channels, looked up for every IVR callback. Channels never change org, but a released channel will still be
+// found by other instances until their in-process values expire.
+var channelOrgCache = cache.NewTwoTier("channel_org", 10000, time.Minute, time.Minute*10)
+
 // OrgIDForChannelUUID returns the org id for the passed in channel UUID if any
-func OrgIDForChannelUUID(ctx context.Context, db Queryer, channelUUID assets.ChannelUUID) (OrgID, error) {
-	var orgID OrgID
-	err := db.GetContext(ctx, &orgID, `SELECT org_id FROM channels_channel WHERE uuid = $1 AND is_active = TRUE`, channelUUID)
+func OrgIDForChannelUUID(ctx context.Context, db Queryer, rp *redis.Pool, channelUUID assets.ChannelUUID) (OrgID, error) {
+	value, err := channelOrgCache.Get(ctx, rp, string(channelUUID), func(ctx context.Context, key string) (string, error) {
+		var orgID OrgID
+		err := db.GetContext(ctx, &orgID, `SELECT org_id FROM channels_channel WHERE uuid = $1 AND is_active = TRUE`, key)
+		return strconv.Itoa(int(orgID)), err
+	})
 	if err != nil {
 		return NilOrgID, errors.Wrapf(err, "no channel found with uuid: %s", channelUUID)
 	}
-	return orgID, nil
+
+	orgID, err := strconv.Atoi(value)
+	return OrgID(orgID), errors.Wrapf(err, "invalid cached org id for channel: %s", channelUUID)
+}
+
+// ClearCachedChannel clears the cached values of the channel with the passed in id, e.g. because it has been released
+func ClearCachedChannel(ctx context.Context, db Queryer, rp *redis.Pool, channelID ChannelID) error {
+	var channelUUID assets.ChannelUUID
+	err := db.GetContext(ctx, &channelUUID, `SELECT uuid FROM channels_channel WHERE id = $1`, channelID)
+	if err != nil {
+		return errors.Wrapf(err, "error looking up channel: %d", channelID)
+	}
+
+	return errors.Wrapf(channelOrgCache.Clear(rp, string(channelUUID)), "error clearing cached org of channel: %d", channelID)
 }
 
 // MarshalJSON marshals into JSON. 0 values will become null
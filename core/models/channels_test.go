@@ -88,3 +88,23 @@ func TestChannels(t *testing.T) {
 		assert.Equal(t, tc.Parent, channel.Parent())
 	}
 }
+
+func TestOrgIDForChannelUUID(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+	defer models.FlushCache()
+
+	orgID, err := models.OrgIDForChannelUUID(ctx, db, rp, testdata.TwilioChannel.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.Org1.ID, orgID)
+
+	_, err = models.OrgIDForChannelUUID(ctx, db, rp, assets.ChannelUUID("f46f95b2-c75d-4be9-a1de-a9e3edd7a2a5"))
+	assert.EqualError(t, err, "no channel found with uuid: f46f95b2-c75d-4be9-a1de-a9e3edd7a2a5: sql: no rows in result set")
+
+	// a channel's org is cached, so is still found after it's deleted until that expires
+	db.MustExec(`UPDATE channels_channel SET is_active = FALSE WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	orgID, err = models.OrgIDForChannelUUID(ctx, db, rp, testdata.TwilioChannel.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.Org1.ID, orgID)
+}
@@ -33,6 +33,9 @@ const (
 	ClassifierTypeBothub = "bothub"
 )
 
+// ClassifierTypes are the sorted types of classifier we support
+var ClassifierTypes = []string{ClassifierTypeBothub, ClassifierTypeLuis, ClassifierTypeWit}
+
 // classifier config key constants
 const (
 	// Wit.ai config options
@@ -52,7 +55,7 @@ const (
 func init() {
 	goflow.RegisterClassificationServiceFactory(
 		func(session flows.Session, classifier *flows.Classifier) (flows.ClassificationService, error) {
-			return classifier.Asset().(*Classifier).AsService(classifier)
+			return classifier.Asset().(*Classifier).AsService(orgFromSession(session), classifier)
 		},
 	)
 }
@@ -89,9 +92,10 @@ func (c *Classifier) Intents() []string { return c.c.intentNames }
 // Type returns the type of this classifier
 func (c *Classifier) Type() string { return c.c.Type }
 
-// AsService builds the corresponding ClassificationService for the passed in Classifier
-func (c *Classifier) AsService(classifier *flows.Classifier) (flows.ClassificationService, error) {
+// AsService builds the corresponding ClassificationService for the passed in Classifier, to be used by the passed in org
+func (c *Classifier) AsService(org *Org, classifier *flows.Classifier) (flows.ClassificationService, error) {
 	httpClient, httpRetries, httpAccess := goflow.HTTP(config.Mailroom)
+	httpClient = goflow.RegionalHTTP(config.Mailroom, httpClient, org.Region())
 
 	switch c.Type() {
 	case ClassifierTypeWit:
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/nyaruka/librato"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/utils/dbutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the amount of jitter applied to the backoff between commit retries so that the retrying transactions don't collide again
+const commitRetryJitter = 0.5
+
+// RetryCommit calls the passed in function which begins and commits a transaction, and if it fails because of a deadlock
+// or serialization failure, e.g. with writes from RapidPro, calls it again after a backoff, up to the configured maximum
+// number of retries. The function must start from scratch each time as the failed transaction will have been rolled back.
+func RetryCommit(ctx context.Context, label string, fn func() error) error {
+	backoff := time.Duration(config.Mailroom.CommitInitialBackoff) * time.Millisecond
+
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || !dbutil.IsRetryable(err) || retry >= config.Mailroom.CommitMaxRetries {
+			return err
+		}
+
+		table := dbutil.ErrorTable(err)
+		if table == "" {
+			table = "unknown"
+		}
+		librato.Gauge(fmt.Sprintf("mr.commit_retry.%s", table), 1)
+
+		logrus.WithError(err).WithFields(logrus.Fields{"label": label, "table": table, "retry": retry + 1}).Warn("retrying commit after deadlock or serialization failure")
+
+		wait := backoff + time.Duration(rand.Float64()*commitRetryJitter*float64(backoff))
+		backoff *= 2
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
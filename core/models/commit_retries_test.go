@@ -0,0 +1,57 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryCommit(t *testing.T) {
+	ctx := context.Background()
+
+	defer func(retries, backoff int) {
+		config.Mailroom.CommitMaxRetries = retries
+		config.Mailroom.CommitInitialBackoff = backoff
+	}(config.Mailroom.CommitMaxRetries, config.Mailroom.CommitInitialBackoff)
+
+	config.Mailroom.CommitMaxRetries = 3
+	config.Mailroom.CommitInitialBackoff = 1
+
+	deadlock := errors.Wrap(&pq.Error{Code: "40P01", Table: "contacts_contact"}, "error committing")
+
+	// deadlocks are retried until the function succeeds
+	calls := 0
+	err := models.RetryCommit(ctx, "test", func() error {
+		calls++
+		if calls <= 2 {
+			return deadlock
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// but only up to the maximum number of retries
+	calls = 0
+	err = models.RetryCommit(ctx, "test", func() error {
+		calls++
+		return deadlock
+	})
+	assert.Equal(t, deadlock, err)
+	assert.Equal(t, 4, calls)
+
+	// other errors aren't retried
+	calls = 0
+	err = models.RetryCommit(ctx, "test", func() error {
+		calls++
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// ContactChangeType is the type of a change to a contact
+type ContactChangeType string
+
+// contact change types
+const (
+	ContactChangeTypeCreated = ContactChangeType("contact.created")
+	ContactChangeTypeUpdated = ContactChangeType("contact.updated")
+	ContactChangeTypeDeleted = ContactChangeType("contact.deleted")
+)
+
+// each org's undelivered changes are a sorted set scored by their sequence number, which is also the cursor that's
+// delivered to the org's webhook so that it can tell if it has missed or already seen changes
+const (
+	contactChangesKey         = "contact_changes:%d"
+	contactChangesSeqKey      = "contact_changes_seq:%d"
+	contactChangesOrgsKey     = "contact_changes_orgs"
+	contactChangesFailuresKey = "contact_changes_failures:%d"
+	contactChangesBackoffKey  = "contact_changes_backoff:%d"
+
+	// if an org's webhook is down for long enough, the oldest undelivered changes are dropped
+	contactChangesMaxQueued = 100000
+
+	contactChangesMinBackoff = time.Second * 10
+	contactChangesMaxBackoff = time.Hour
+)
+
+// ContactWebhook is where an org's contact changes are delivered. If it has a secret, each request is signed with it.
+type ContactWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// ContactChange is a change to a contact which is delivered to the org's contact webhook. For updates, Changed is the
+// attributes which changed, e.g. name, language, status, urns, groups or fields.age
+type ContactChange struct {
+	Seq         int64             `json:"seq"`
+	Type        ContactChangeType `json:"type"`
+	ContactUUID flows.ContactUUID `json:"contact_uuid"`
+	Changed     []string          `json:"changed,omitempty"`
+	OccurredOn  time.Time         `json:"occurred_on"`
+}
+
+// NewContactChange creates a new change to the given contact
+func NewContactChange(changeType ContactChangeType, contactUUID flows.ContactUUID, changed []string) *ContactChange {
+	return &ContactChange{Type: changeType, ContactUUID: contactUUID, Changed: changed, OccurredOn: time.Now()}
+}
+
+// RecordContactChanges queues the given changes for delivery to the org's contact webhook, if it has one
+func RecordContactChanges(rc redis.Conn, oa *OrgAssets, changes []*ContactChange) error {
+	if len(changes) == 0 || oa.Org().ContactWebhook() == nil {
+		return nil
+	}
+
+	orgID := oa.OrgID()
+
+	last, err := redis.Int64(rc.Do("INCRBY", fmt.Sprintf(contactChangesSeqKey, orgID), len(changes)))
+	if err != nil {
+		return errors.Wrapf(err, "error reserving contact change sequence numbers")
+	}
+
+	key := fmt.Sprintf(contactChangesKey, orgID)
+	args := []interface{}{key}
+
+	for i, change := range changes {
+		change.Seq = last - int64(len(changes)) + int64(i) + 1
+
+		encoded, err := json.Marshal(change)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding contact change")
+		}
+		args = append(args, change.Seq, encoded)
+	}
+
+	// the org is recorded as having changes first as it can't be in the same transaction as keys in other slots of a
+	// redis cluster, and checking an org without changes is harmless
+	if _, err := rc.Do("SADD", contactChangesOrgsKey, orgID); err != nil {
+		return errors.Wrapf(err, "error recording org with contact changes")
+	}
+
+	rc.Send("MULTI")
+	rc.Send("ZADD", args...)
+	rc.Send("ZREMRANGEBYRANK", key, 0, -(contactChangesMaxQueued + 1))
+	if _, err := rc.Do("EXEC"); err != nil {
+		return errors.Wrapf(err, "error queuing contact changes for org: %d", orgID)
+	}
+	return nil
+}
+
+// OrgIDsWithContactChanges gets the ids of the orgs which may have undelivered contact changes
+func OrgIDsWithContactChanges(rc redis.Conn) ([]OrgID, error) {
+	ids, err := redis.Ints(rc.Do("SMEMBERS", contactChangesOrgsKey))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading orgs with contact changes")
+	}
+
+	orgIDs := make([]OrgID, len(ids))
+	for i := range ids {
+		orgIDs[i] = OrgID(ids[i])
+	}
+	return orgIDs, nil
+}
+
+// LoadContactChanges loads up to limit of the oldest undelivered contact changes for the given org
+func LoadContactChanges(rc redis.Conn, orgID OrgID, limit int) ([]*ContactChange, error) {
+	encoded, err := redis.ByteSlices(rc.Do("ZRANGE", fmt.Sprintf(contactChangesKey, orgID), 0, limit-1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading contact changes for org: %d", orgID)
+	}
+
+	changes := make([]*ContactChange, len(encoded))
+	for i := range encoded {
+		changes[i] = &ContactChange{}
+		if err := json.Unmarshal(encoded[i], changes[i]); err != nil {
+			return nil, errors.Wrapf(err, "error decoding contact change")
+		}
+	}
+	return changes, nil
+}
+
+// AckContactChanges removes the given org's contact changes up to and including the given sequence number once they've
+// been delivered, and resets any backoff from previous failed deliveries
+func AckContactChanges(rc redis.Conn, orgID OrgID, upTo int64) error {
+	key := fmt.Sprintf(contactChangesKey, orgID)
+
+	rc.Send("MULTI")
+	rc.Send("ZREMRANGEBYSCORE", key, "-inf", upTo)
+	rc.Send("ZCARD", key)
+	replies, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return errors.Wrapf(err, "error acknowledging contact changes for org: %d", orgID)
+	}
+
+	// these keys are deleted with separate commands as they can be in different slots of a redis cluster
+	for _, k := range []string{fmt.Sprintf(contactChangesFailuresKey, orgID), fmt.Sprintf(contactChangesBackoffKey, orgID)} {
+		if _, err := rc.Do("DEL", k); err != nil {
+			return errors.Wrapf(err, "error resetting contact changes backoff for org: %d", orgID)
+		}
+	}
+
+	// if that was everything, this org no longer needs checking
+	if remaining, _ := redis.Int(replies[1], nil); remaining == 0 {
+		if _, err := rc.Do("SREM", contactChangesOrgsKey, orgID); err != nil {
+			return errors.Wrapf(err, "error removing org from orgs with contact changes")
+		}
+	}
+	return nil
+}
+
+// ClearContactChanges removes all of the given org's undelivered contact changes, e.g. because it no longer has a
+// contact webhook
+func ClearContactChanges(rc redis.Conn, orgID OrgID) error {
+	// these keys are deleted with separate commands as they can be in different slots of a redis cluster
+	keys := []string{fmt.Sprintf(contactChangesKey, orgID), fmt.Sprintf(contactChangesFailuresKey, orgID), fmt.Sprintf(contactChangesBackoffKey, orgID)}
+	for _, k := range keys {
+		if _, err := rc.Do("DEL", k); err != nil {
+			return errors.Wrapf(err, "error clearing contact changes for org: %d", orgID)
+		}
+	}
+	if _, err := rc.Do("SREM", contactChangesOrgsKey, orgID); err != nil {
+		return errors.Wrapf(err, "error clearing contact changes for org: %d", orgID)
+	}
+	return nil
+}
+
+// ContactChangesBackedOff returns whether delivery of the given org's contact changes should wait because of recent
+// failures
+func ContactChangesBackedOff(rc redis.Conn, orgID OrgID) (bool, error) {
+	exists, err := redis.Bool(rc.Do("EXISTS", fmt.Sprintf(contactChangesBackoffKey, orgID)))
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking contact changes backoff for org: %d", orgID)
+	}
+	return exists, nil
+}
+
+// BackoffContactChanges records a failed delivery of the given org's contact changes, so that the next attempt waits
+// for twice as long as the last, up to a maximum. It returns how long the next attempt will wait for.
+func BackoffContactChanges(rc redis.Conn, orgID OrgID) (time.Duration, error) {
+	failuresKey := fmt.Sprintf(contactChangesFailuresKey, orgID)
+
+	failures, err := redis.Int(rc.Do("INCR", failuresKey))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error recording contact changes failure for org: %d", orgID)
+	}
+
+	backoff := contactChangesMinBackoff
+	for i := 1; i < failures && backoff < contactChangesMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > contactChangesMaxBackoff {
+		backoff = contactChangesMaxBackoff
+	}
+
+	if _, err := rc.Do("EXPIRE", failuresKey, int(contactChangesMaxBackoff.Seconds())*24); err != nil {
+		return 0, errors.Wrapf(err, "error setting contact changes backoff for org: %d", orgID)
+	}
+	if _, err := rc.Do("SET", fmt.Sprintf(contactChangesBackoffKey, orgID), failures, "EX", int(backoff.Seconds())); err != nil {
+		return 0, errors.Wrapf(err, "error setting contact changes backoff for org: %d", orgID)
+	}
+	return backoff, nil
+}
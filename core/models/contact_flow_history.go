@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// contactFlowHistory is the changes to the flows a contact has entered and completed, which are kept on the contact so
+// that they're indexed for entered, completed and last_flow conditions in contact queries
+type contactFlowHistory struct {
+	ContactID        ContactID     `db:"contact_id"`
+	LastFlowID       FlowID        `db:"last_flow_id"`
+	EnteredFlowIDs   pq.Int64Array `db:"entered_flow_ids"`
+	CompletedFlowIDs pq.Int64Array `db:"completed_flow_ids"`
+
+	lastCreatedOn time.Time
+}
+
+// newContactFlowHistories returns the flow history changes of the contacts of the passed in runs, given that each run
+// was last written at the passed in time
+func newContactFlowHistories(runs []*FlowRun, lastWritten map[flows.RunUUID]time.Time) []*contactFlowHistory {
+	byContact := make(map[ContactID]*contactFlowHistory)
+	histories := make([]*contactFlowHistory, 0, 1)
+
+	for _, r := range runs {
+		written, seen := lastWritten[r.UUID()]
+		completed := r.r.Status == RunStatusCompleted && (!seen || r.ModifiedOn().After(written))
+		if seen && !completed {
+			continue
+		}
+
+		contactID := ContactID(r.r.ContactID)
+		h := byContact[contactID]
+		if h == nil {
+			h = &contactFlowHistory{ContactID: contactID}
+			byContact[contactID] = h
+			histories = append(histories, h)
+		}
+
+		if !seen {
+			h.EnteredFlowIDs = appendFlowID(h.EnteredFlowIDs, r.FlowID())
+
+			if h.LastFlowID == NilFlowID || !r.r.CreatedOn.Before(h.lastCreatedOn) {
+				h.LastFlowID = r.FlowID()
+				h.lastCreatedOn = r.r.CreatedOn
+			}
+		}
+		if completed {
+			h.CompletedFlowIDs = appendFlowID(h.CompletedFlowIDs, r.FlowID())
+		}
+	}
+
+	// order by contact so that concurrent writes lock contacts in a consistent order
+	sort.Slice(histories, func(i, j int) bool { return histories[i].ContactID < histories[j].ContactID })
+
+	return histories
+}
+
+// appends the passed in flow id to the ids if it isn't already there
+func appendFlowID(ids pq.Int64Array, flowID FlowID) pq.Int64Array {
+	for _, id := range ids {
+		if id == int64(flowID) {
+			return ids
+		}
+	}
+	return append(ids, int64(flowID))
+}
+
+// contacts are only updated if their last flow changes or they've entered or completed flows they hadn't before, and
+// modified_on isn't touched as these columns aren't edits to the contact
+const updateContactFlowHistorySQL = `
+UPDATE
+	contacts_contact c
+SET
+	last_flow_id = COALESCE(h.last_flow_id::int, c.last_flow_id),
+	entered_flow_ids = ARRAY(SELECT DISTINCT f FROM unnest(c.entered_flow_ids || COALESCE(h.entered_flow_ids::int[], '{}')) f ORDER BY f),
+	completed_flow_ids = ARRAY(SELECT DISTINCT f FROM unnest(c.completed_flow_ids || COALESCE(h.completed_flow_ids::int[], '{}')) f ORDER BY f)
+FROM (
+	VALUES(:contact_id, :last_flow_id, :entered_flow_ids, :completed_flow_ids)
+) AS
+	h(contact_id, last_flow_id, entered_flow_ids, completed_flow_ids)
+WHERE
+	c.id = h.contact_id::int AND (
+		(h.last_flow_id IS NOT NULL AND c.last_flow_id IS DISTINCT FROM h.last_flow_id::int) OR
+		NOT c.entered_flow_ids @> COALESCE(h.entered_flow_ids::int[], '{}') OR
+		NOT c.completed_flow_ids @> COALESCE(h.completed_flow_ids::int[], '{}')
+	)
+`
+
+// updates the flow histories of the contacts of the passed in runs with the flows they've entered or completed since
+// each run was last written
+func updateContactFlowHistories(ctx context.Context, tx Queryer, runs []*FlowRun, lastWritten map[flows.RunUUID]time.Time) error {
+	histories := newContactFlowHistories(runs, lastWritten)
+
+	hs := make([]interface{}, len(histories))
+	for i := range histories {
+		hs[i] = histories[i]
+	}
+
+	return errors.Wrapf(BulkQuery(ctx, "update contact flow histories", tx, updateContactFlowHistorySQL, hs), "error updating contact flow histories")
+}
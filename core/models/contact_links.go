@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// ContactLinkMethod is how two contacts were found to be the same person
+type ContactLinkMethod string
+
+// contact link methods
+const (
+	ContactLinkMethodField = ContactLinkMethod("field")
+	ContactLinkMethodCode  = ContactLinkMethod("code")
+)
+
+// IdentityLinking is how an org links contacts which are the same person on different channels, e.g.
+//
+//   {"identity_linking": {"fields": ["email"], "link_codes": true}}
+//
+// Contacts are linked when they're given the same value of one of the fields, or when a contact sends a link code which
+// was generated for another contact, e.g. "LINK 7KQ2MX".
+type IdentityLinking struct {
+	Fields    []string `json:"fields"`
+	LinkCodes bool     `json:"link_codes"`
+}
+
+// LinksOnField returns whether contacts are linked by the field with the given key
+func (l *IdentityLinking) LinksOnField(key string) bool {
+	for _, f := range l.Fields {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ContactLink is a link between a contact and another contact which is the same person
+type ContactLink struct {
+	ContactID ContactID         `db:"contact_id"   json:"contact_id"`
+	Method    ContactLinkMethod `db:"method"       json:"method"`
+	CreatedOn time.Time         `db:"created_on"   json:"created_on"`
+}
+
+// each link is stored once with the lower contact id first
+const insertContactLinksSQL = `
+INSERT INTO contacts_contactlink(org_id, contact_id, linked_contact_id, method, created_on)
+     SELECT $1, LEAST($2, l), GREATEST($2, l), $4, $5 FROM UNNEST($3::int[]) l WHERE l != $2
+ON CONFLICT (contact_id, linked_contact_id) DO NOTHING
+`
+
+// LinkContacts links the given contact to each of the other contacts, ignoring any links which already exist
+func LinkContacts(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID, others []ContactID, method ContactLinkMethod) error {
+	if len(others) == 0 {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, insertContactLinksSQL, orgID, contactID, pq.Array(others), method, dates.Now())
+	return errors.Wrapf(err, "error linking contact: %d", contactID)
+}
+
+const selectContactLinksSQL = `
+SELECT
+	CASE WHEN l.contact_id = $2 THEN l.linked_contact_id ELSE l.contact_id END AS contact_id,
+	l.method,
+	l.created_on
+FROM
+	contacts_contactlink l
+	INNER JOIN contacts_contact c ON c.id = CASE WHEN l.contact_id = $2 THEN l.linked_contact_id ELSE l.contact_id END
+WHERE
+	l.org_id = $1 AND
+	(l.contact_id = $2 OR l.linked_contact_id = $2) AND
+	c.is_active = TRUE
+ORDER BY
+	l.created_on, l.id
+`
+
+// LoadContactLinks loads the links from the given contact to other active contacts which are the same person
+func LoadContactLinks(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID) ([]*ContactLink, error) {
+	links := make([]*ContactLink, 0)
+	if err := db.SelectContext(ctx, &links, selectContactLinksSQL, orgID, contactID); err != nil {
+		return nil, errors.Wrapf(err, "error loading links for contact: %d", contactID)
+	}
+	return links, nil
+}
+
+const selectContactIDsWithFieldValueSQL = `
+SELECT
+	id
+FROM
+	contacts_contact
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	id != $2 AND
+	LOWER(fields->$3->>'text') = LOWER($4)
+`
+
+// FindContactsToLinkOnField finds the other active contacts which have the same value of the given field as the given
+// contact, ignoring case, e.g. contacts with the same email address
+func FindContactsToLinkOnField(ctx context.Context, db Queryer, orgID OrgID, contactID ContactID, field *Field, value string) ([]ContactID, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	ids, err := queryContactIDs(ctx, db, selectContactIDsWithFieldValueSQL, orgID, contactID, field.UUID(), value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error finding contacts to link on field: %s", field.Key())
+	}
+	return ids, nil
+}
+
+// link codes are stored in redis for an hour, which is long enough for a contact to send it on their other channel
+const (
+	contactLinkCodeKey    = "contact_link_code:%d:%s"
+	contactLinkCodeExpiry = time.Hour
+	contactLinkCodeChars  = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	contactLinkCodeLength = 6
+)
+
+// messages which redeem link codes, e.g. "LINK 7KQ2MX"
+var contactLinkCodeRegex = regexp.MustCompile(`(?i)^\s*link\s+([a-z0-9]{6})\s*$`)
+
+// NewContactLinkCode generates a new code which links the contact that sends it to the given contact
+func NewContactLinkCode(rc redis.Conn, orgID OrgID, contactID ContactID) (string, error) {
+	code := make([]byte, contactLinkCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(contactLinkCodeChars))))
+		if err != nil {
+			return "", errors.Wrapf(err, "error generating contact link code")
+		}
+		code[i] = contactLinkCodeChars[n.Int64()]
+	}
+
+	key := fmt.Sprintf(contactLinkCodeKey, orgID, string(code))
+	if _, err := rc.Do("SET", key, int64(contactID), "EX", int(contactLinkCodeExpiry/time.Second)); err != nil {
+		return "", errors.Wrapf(err, "error storing contact link code")
+	}
+	return string(code), nil
+}
+
+// RedeemContactLinkCode checks whether the given message text is a link code and if so links the contact which sent it
+// to the contact the code was generated for, returning whether the message was a link code. Codes can only be used once.
+func RedeemContactLinkCode(ctx context.Context, db Queryer, rc redis.Conn, orgID OrgID, contactID ContactID, text string) (bool, error) {
+	match := contactLinkCodeRegex.FindStringSubmatch(text)
+	if match == nil {
+		return false, nil
+	}
+
+	key := fmt.Sprintf(contactLinkCodeKey, orgID, strings.ToUpper(match[1]))
+
+	rc.Send("MULTI")
+	rc.Send("GET", key)
+	rc.Send("DEL", key)
+	replies, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return false, errors.Wrapf(err, "error redeeming contact link code")
+	}
+
+	linkedID, err := redis.Int64(replies[0], nil)
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "error reading contact link code")
+	}
+
+	if err := LinkContacts(ctx, db, orgID, contactID, []ContactID{ContactID(linkedID)}, ContactLinkMethodCode); err != nil {
+		return false, err
+	}
+	return true, nil
+}
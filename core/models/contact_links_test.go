@@ -0,0 +1,90 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactLinks(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// give Cathy and George the same gender with different cases, Bob a different one
+	db.MustExec(`UPDATE contacts_contact SET fields = fields || jsonb_build_object($2::text, jsonb_build_object('text', 'Female')) WHERE id = $1`, testdata.Cathy.ID, testdata.GenderField.UUID)
+	db.MustExec(`UPDATE contacts_contact SET fields = fields || jsonb_build_object($2::text, jsonb_build_object('text', 'female')) WHERE id = $1`, testdata.George.ID, testdata.GenderField.UUID)
+	db.MustExec(`UPDATE contacts_contact SET fields = fields || jsonb_build_object($2::text, jsonb_build_object('text', 'Male')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+
+	gender := oa.FieldByKey("gender")
+
+	others, err := models.FindContactsToLinkOnField(ctx, db, testdata.Org1.ID, testdata.Cathy.ID, gender, " FEMALE ")
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.George.ID}, others)
+
+	others, err = models.FindContactsToLinkOnField(ctx, db, testdata.Org1.ID, testdata.Cathy.ID, gender, "")
+	require.NoError(t, err)
+	assert.Len(t, others, 0)
+
+	// link Cathy and George, twice to check that links aren't duplicated
+	require.NoError(t, models.LinkContacts(ctx, db, testdata.Org1.ID, testdata.George.ID, []models.ContactID{testdata.Cathy.ID}, models.ContactLinkMethodField))
+	require.NoError(t, models.LinkContacts(ctx, db, testdata.Org1.ID, testdata.Cathy.ID, others, models.ContactLinkMethodField))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactlink`, nil, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactlink WHERE contact_id = $1 AND linked_contact_id = $2`, []interface{}{testdata.Cathy.ID, testdata.George.ID}, 1)
+
+	links, err := models.LoadContactLinks(ctx, db, testdata.Org1.ID, testdata.George.ID)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, testdata.Cathy.ID, links[0].ContactID)
+	assert.Equal(t, models.ContactLinkMethodField, links[0].Method)
+
+	// links to deleted contacts aren't loaded
+	db.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.Cathy.ID)
+
+	links, err = models.LoadContactLinks(ctx, db, testdata.Org1.ID, testdata.George.ID)
+	require.NoError(t, err)
+	assert.Len(t, links, 0)
+}
+
+func TestContactLinkCodes(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	code, err := models.NewContactLinkCode(rc, testdata.Org1.ID, testdata.Cathy.ID)
+	require.NoError(t, err)
+	assert.Len(t, code, 6)
+
+	// messages which aren't link codes are ignored
+	linked, err := models.RedeemContactLinkCode(ctx, db, rc, testdata.Org1.ID, testdata.Bob.ID, "hello")
+	require.NoError(t, err)
+	assert.False(t, linked)
+
+	// as are codes for other orgs
+	linked, err = models.RedeemContactLinkCode(ctx, db, rc, testdata.Org2.ID, testdata.Bob.ID, "link "+code)
+	require.NoError(t, err)
+	assert.False(t, linked)
+
+	linked, err = models.RedeemContactLinkCode(ctx, db, rc, testdata.Org1.ID, testdata.Bob.ID, fmt.Sprintf(" Link %s ", code))
+	require.NoError(t, err)
+	assert.True(t, linked)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactlink WHERE contact_id = $1 AND linked_contact_id = $2 AND method = 'code'`, []interface{}{testdata.Cathy.ID, testdata.Bob.ID}, 1)
+
+	// codes can only be used once
+	linked, err = models.RedeemContactLinkCode(ctx, db, rc, testdata.Org1.ID, testdata.George.ID, "LINK "+code)
+	require.NoError(t, err)
+	assert.False(t, linked)
+}
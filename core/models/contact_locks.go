@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/locker"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// how long a contact lock lasts if its owner dies, as locks are extended while they're held
+const contactLockExpiration = time.Minute
+
+// ContactLocks are locks on contacts, which ensure that only one process at a time runs sessions for or modifies
+// each contact. They're kept from expiring until they're released.
+type ContactLocks struct {
+	rp         *redis.Pool
+	orgID      OrgID
+	contactIDs []ContactID
+	values     map[ContactID]string
+	stop       func()
+}
+
+// LockContacts tries to grab the locks of the passed in contacts, waiting up to the passed in retry period for each
+// one. It returns the locks which were grabbed and the contacts which are locked by others. Callers which need to lock
+// more contacts should release the locks they have before retrying the rest, so that they can't deadlock each other.
+func LockContacts(rp *redis.Pool, orgID OrgID, contactIDs []ContactID, retry time.Duration) (*ContactLocks, []ContactID, error) {
+	locks := &ContactLocks{
+		rp:         rp,
+		orgID:      orgID,
+		contactIDs: make([]ContactID, 0, len(contactIDs)),
+		values:     make(map[ContactID]string, len(contactIDs)),
+	}
+	skipped := make([]ContactID, 0, 5)
+
+	for _, contactID := range contactIDs {
+		if _, locked := locks.values[contactID]; locked {
+			continue
+		}
+
+		value, err := locker.GrabLock(rp, ContactLock(orgID, contactID), contactLockExpiration, retry)
+		if err != nil {
+			locks.Release()
+			return nil, nil, errors.Wrapf(err, "error grabbing lock for contact %d", contactID)
+		}
+
+		if value == "" {
+			skipped = append(skipped, contactID)
+		} else {
+			locks.contactIDs = append(locks.contactIDs, contactID)
+			locks.values[contactID] = value
+		}
+	}
+
+	if len(locks.values) > 0 {
+		keys := make(map[string]string, len(locks.values))
+		for contactID, value := range locks.values {
+			keys[ContactLock(orgID, contactID)] = value
+		}
+		locks.stop = locker.KeepLocks(rp, keys, contactLockExpiration)
+	}
+
+	return locks, skipped, nil
+}
+
+// ContactIDs returns the ids of the locked contacts
+func (l *ContactLocks) ContactIDs() []ContactID { return l.contactIDs }
+
+// Release releases these locks, it's safe to call more than once
+func (l *ContactLocks) Release() {
+	if l.stop != nil {
+		l.stop()
+		l.stop = nil
+	}
+
+	for contactID, value := range l.values {
+		locker.ReleaseLock(l.rp, ContactLock(l.orgID, contactID), value)
+	}
+	l.values = nil
+}
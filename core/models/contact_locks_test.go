@@ -0,0 +1,52 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/locker"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockContacts(t *testing.T) {
+	_, _, rp := testsuite.Reset()
+	defer testsuite.Reset()
+
+	// grab a lock on Bob like something else is handling him
+	bobLock, err := locker.GrabLock(rp, models.ContactLock(testdata.Org1.ID, testdata.Bob.ID), time.Minute, 0)
+	require.NoError(t, err)
+
+	locks, skipped, err := models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID, testdata.Cathy.ID}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, locks.ContactIDs())
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, skipped)
+
+	// now nobody else can lock Cathy
+	none, skipped, err := models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(none.ContactIDs()))
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, skipped)
+
+	// until we release our locks
+	locks.Release()
+	locks.Release()
+
+	locks, skipped, err = models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, locks.ContactIDs())
+	assert.Equal(t, 0, len(skipped))
+	locks.Release()
+
+	// locks are per contact so releasing ours didn't release Bob's
+	none, skipped, err = models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Bob.ID}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(none.ContactIDs()))
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, skipped)
+
+	locker.ReleaseLock(rp, models.ContactLock(testdata.Org1.ID, testdata.Bob.ID), bobLock)
+}
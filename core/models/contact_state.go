@@ -0,0 +1,162 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/nyaruka/mailroom/config"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// each contact's state is a hash of keys to values which expires after it hasn't been changed for a while
+const contactStateKey = "contact_state:%d:%d"
+
+var contactStateKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]{1,64}$`)
+
+// errors returned when a change to a contact's state isn't allowed
+var (
+	ErrContactStateInvalidKey = errors.New("invalid state key")
+	ErrContactStateFull       = errors.New("contact state has reached its maximum number of keys")
+	ErrContactStateTooLong    = errors.New("state value is too long")
+	ErrContactStateNotInteger = errors.New("state value is not an integer")
+)
+
+// ContactStateChange is a change to a value in a contact's state, where a nil value means the key was removed
+type ContactStateChange struct {
+	Key      string  `json:"key"`
+	Previous *string `json:"previous"`
+	Value    *string `json:"value"`
+}
+
+// Changed returns whether this change actually changed the value
+func (c *ContactStateChange) Changed() bool {
+	if c.Previous == nil || c.Value == nil {
+		return c.Previous != c.Value
+	}
+	return *c.Previous != *c.Value
+}
+
+func (c *ContactStateChange) log(orgID OrgID, contactID ContactID) {
+	if c.Changed() {
+		logrus.WithFields(logrus.Fields{"org_id": orgID, "contact_id": contactID, "key": c.Key, "previous": c.Previous, "value": c.Value}).Info("contact state changed")
+	}
+}
+
+// ValidateContactStateKey checks that the given key can be used in a contact's state
+func ValidateContactStateKey(key string) error {
+	if !contactStateKeyRegex.MatchString(key) {
+		return ErrContactStateInvalidKey
+	}
+	return nil
+}
+
+// GetContactState gets all the values in the given contact's state
+func GetContactState(rc redis.Conn, orgID OrgID, contactID ContactID) (map[string]string, error) {
+	state, err := redis.StringMap(rc.Do("HGETALL", fmt.Sprintf(contactStateKey, orgID, contactID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading state for contact #%d", contactID)
+	}
+	return state, nil
+}
+
+// SetContactStateValue sets the value of the given key in a contact's state
+func SetContactStateValue(rc redis.Conn, cfg *config.Config, orgID OrgID, contactID ContactID, key, value string) (*ContactStateChange, error) {
+	if len(value) > cfg.ContactStateMaxValueBytes {
+		return nil, ErrContactStateTooLong
+	}
+	return changeContactState(rc, cfg, orgID, contactID, key, "set", value)
+}
+
+// IncrContactStateValue increments the integer value of the given key in a contact's state, a missing key being zero
+func IncrContactStateValue(rc redis.Conn, cfg *config.Config, orgID OrgID, contactID ContactID, key string, by int64) (*ContactStateChange, error) {
+	return changeContactState(rc, cfg, orgID, contactID, key, "incr", strconv.FormatInt(by, 10))
+}
+
+// DeleteContactStateValue removes the given key from a contact's state
+func DeleteContactStateValue(rc redis.Conn, orgID OrgID, contactID ContactID, key string) (*ContactStateChange, error) {
+	if err := ValidateContactStateKey(key); err != nil {
+		return nil, err
+	}
+
+	previous, err := redis.String(deleteContactStateValue.Do(rc, fmt.Sprintf(contactStateKey, orgID, contactID), key))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error updating state for contact #%d", contactID)
+	}
+
+	change := &ContactStateChange{Key: key}
+	if err == nil {
+		change.Previous = &previous
+	}
+	change.log(orgID, contactID)
+	return change, nil
+}
+
+func changeContactState(rc redis.Conn, cfg *config.Config, orgID OrgID, contactID ContactID, key, op, arg string) (*ContactStateChange, error) {
+	if err := ValidateContactStateKey(key); err != nil {
+		return nil, err
+	}
+
+	values, err := redis.Values(updateContactState.Do(rc, fmt.Sprintf(contactStateKey, orgID, contactID), key, op, arg, cfg.ContactStateMaxKeys, cfg.ContactStateTTL))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating state for contact #%d", contactID)
+	}
+
+	var status, previous, value string
+	var hadPrevious int
+	if _, err := redis.Scan(values, &status, &hadPrevious, &previous, &value); err != nil {
+		return nil, errors.Wrapf(err, "error reading updated state for contact #%d", contactID)
+	}
+
+	switch status {
+	case "full":
+		return nil, ErrContactStateFull
+	case "nan":
+		return nil, ErrContactStateNotInteger
+	}
+
+	change := &ContactStateChange{Key: key, Value: &value}
+	if hadPrevious == 1 {
+		change.Previous = &previous
+	}
+	change.log(orgID, contactID)
+	return change, nil
+}
+
+var updateContactState = redis.NewScript(1, `
+local state, field, op, arg, maxKeys, ttl = KEYS[1], ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]), ARGV[5]
+
+local previous = redis.call("hget", state, field)
+
+-- changing an existing key is always allowed, adding a new one only if we're under our limit
+if not previous and redis.call("hlen", state) >= maxKeys then
+	return {"full", 0, "", ""}
+end
+
+if op == "incr" then
+	local result = redis.pcall("hincrby", state, field, arg)
+	if type(result) == "table" and result.err then
+		return {"nan", 0, "", ""}
+	end
+else
+	redis.call("hset", state, field, arg)
+end
+
+redis.call("expire", state, ttl)
+
+if previous then
+	return {"ok", 1, previous, redis.call("hget", state, field)}
+end
+return {"ok", 0, "", redis.call("hget", state, field)}
+`)
+
+var deleteContactStateValue = redis.NewScript(1, `
+local state, field = KEYS[1], ARGV[1]
+
+local previous = redis.call("hget", state, field)
+redis.call("hdel", state, field)
+return previous
+`)
@@ -0,0 +1,83 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactState(t *testing.T) {
+	testsuite.Reset()
+	rt := testsuite.RT()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	rt.Config.ContactStateMaxKeys = 2
+	rt.Config.ContactStateMaxValueBytes = 10
+
+	str := func(s string) *string { return &s }
+
+	change, err := models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "color", "red")
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "color", Previous: nil, Value: str("red")}, change)
+	assert.True(t, change.Changed())
+
+	change, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "color", "red")
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "color", Previous: str("red"), Value: str("red")}, change)
+	assert.False(t, change.Changed())
+
+	change, err = models.IncrContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "visits", 1)
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "visits", Previous: nil, Value: str("1")}, change)
+
+	change, err = models.IncrContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "visits", 5)
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "visits", Previous: str("1"), Value: str("6")}, change)
+
+	_, err = models.IncrContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "color", 1)
+	assert.Equal(t, models.ErrContactStateNotInteger, err)
+
+	_, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "color", "very very red")
+	assert.Equal(t, models.ErrContactStateTooLong, err)
+
+	_, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "bad key", "red")
+	assert.Equal(t, models.ErrContactStateInvalidKey, err)
+
+	// we're at our limit of keys so can't add new ones
+	_, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "size", "large")
+	assert.Equal(t, models.ErrContactStateFull, err)
+
+	// but other contacts have their own state
+	_, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.George.ID, "size", "large")
+	assert.NoError(t, err)
+
+	state, err := models.GetContactState(rc, testdata.Org1.ID, testdata.Cathy.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"color": "red", "visits": "6"}, state)
+
+	// state expires after its last change
+	ttl, err := redis.Int(rc.Do("TTL", "contact_state:1:10000"))
+	require.NoError(t, err)
+	assert.Greater(t, ttl, rt.Config.ContactStateTTL-5)
+
+	change, err = models.DeleteContactStateValue(rc, testdata.Org1.ID, testdata.Cathy.ID, "color")
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "color", Previous: str("red"), Value: nil}, change)
+	assert.True(t, change.Changed())
+
+	change, err = models.DeleteContactStateValue(rc, testdata.Org1.ID, testdata.Cathy.ID, "color")
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactStateChange{Key: "color", Previous: nil, Value: nil}, change)
+	assert.False(t, change.Changed())
+
+	// now there's room for a new key
+	_, err = models.SetContactStateValue(rc, rt.Config, testdata.Org1.ID, testdata.Cathy.ID, "size", "large")
+	assert.NoError(t, err)
+}
@@ -16,9 +16,14 @@ import (
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/utils/dbutil"
 	"github.com/nyaruka/null"
 
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -1028,6 +1033,23 @@ func StopContact(ctx context.Context, db Queryer, orgID OrgID, contactID Contact
 	return nil
 }
 
+const detachContactURNSQL = `
+UPDATE
+	contacts_contacturn
+SET
+	contact_id = NULL
+WHERE
+	id = $2 AND
+	contact_id = $1
+`
+
+// DetachContactURN detaches the URN with the passed in id from the contact, e.g. because the account it identifies
+// no longer exists. If a message later arrives from that URN it will be attached to a new contact.
+func DetachContactURN(ctx context.Context, db Queryer, contactID ContactID, urnID URNID) error {
+	_, err := db.ExecContext(ctx, detachContactURNSQL, contactID, urnID)
+	return errors.Wrapf(err, "error detaching URN %d from contact", urnID)
+}
+
 const deleteAllContactGroupsSQL = `
 DELETE FROM
 	contacts_contactgroup_contacts
@@ -1147,6 +1169,35 @@ func UpdateContactLastSeenOn(ctx context.Context, db Queryer, contactID ContactI
 	return err
 }
 
+const updateContactTicketCountsSQL = `
+UPDATE
+	contacts_contact c
+SET
+	ticket_count = n.ticket_count
+FROM (
+	SELECT
+		ct.id,
+		(SELECT COUNT(*) FROM tickets_ticket t WHERE t.contact_id = ct.id AND t.status = 'O') AS ticket_count
+	FROM
+		contacts_contact ct
+	WHERE
+		ct.id = ANY($1)
+) n
+WHERE
+	c.id = n.id AND
+	c.ticket_count != n.ticket_count
+`
+
+// UpdateContactTicketCounts updates the number of open tickets on the passed in contacts for open_tickets conditions in
+// contact queries. Contacts whose count hasn't changed aren't updated, and modified on isn't touched.
+func UpdateContactTicketCounts(ctx context.Context, db Queryer, contactIDs []ContactID) error {
+	if len(contactIDs) == 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, updateContactTicketCountsSQL, pq.Array(contactIDs))
+	return err
+}
+
 // UpdateContactURNs updates the contact urns in our database to match the passed in changes
 func UpdateContactURNs(ctx context.Context, db Queryer, org *OrgAssets, changes []*ContactURNsChanged) error {
 	// keep track of all our inserts
@@ -1407,6 +1458,72 @@ func UpdateContactStatus(ctx context.Context, db Queryer, changes []*ContactStat
 	return err
 }
 
+// ChangeContactStatuses changes the status of the passed in contacts by applying status modifiers, so that the same events
+// are created as when the status is changed by a flow. Contacts who are no longer active have their waiting sessions
+// interrupted. It returns the events created for each contact.
+func ChangeContactStatuses(ctx context.Context, db *sqlx.DB, rp *redis.Pool, oa *OrgAssets, userID UserID, contacts []*Contact, status flows.ContactStatus) (map[*flows.Contact][]flows.Event, error) {
+	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+	for _, c := range contacts {
+		flowContact, err := c.FlowContact(oa)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating flow contact for contact: %d", c.ID())
+		}
+		modifiersByContact[flowContact] = []flows.Modifier{modifiers.NewStatus(status)}
+	}
+
+	eventsByContact, err := ApplyModifiers(ctx, db, rp, oa, modifiersByContact)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error applying status modifiers")
+	}
+
+	// figure out which contacts actually changed
+	changedIDs := make([]ContactID, 0, len(contacts))
+	changedFlowIDs := make([]flows.ContactID, 0, len(contacts))
+	for flowContact, evts := range eventsByContact {
+		if len(evts) > 0 {
+			changedIDs = append(changedIDs, ContactID(flowContact.ID()))
+			changedFlowIDs = append(changedFlowIDs, flowContact.ID())
+		}
+	}
+
+	if err := UpdateContactModifiedBy(ctx, db, changedIDs, userID); err != nil {
+		return nil, errors.Wrapf(err, "error updating modified by for contacts")
+	}
+
+	if status != flows.ContactStatusActive {
+		now := dates.Now()
+		for _, sessionType := range []FlowType{FlowTypeMessaging, FlowTypeVoice} {
+			if err := InterruptContactRuns(ctx, db, sessionType, changedFlowIDs, now); err != nil {
+				return nil, errors.Wrapf(err, "error interrupting sessions for contacts")
+			}
+		}
+	}
+
+	return eventsByContact, nil
+}
+
+const selectContactIDsNotSeenSinceSQL = `
+SELECT
+	id
+FROM
+	contacts_contact
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	status = 'A' AND
+	COALESCE(last_seen_on, created_on) < $2
+ORDER BY
+	id ASC
+LIMIT
+	$3
+`
+
+// ContactIDsNotSeenSince returns the ids of active contacts in the passed in org who haven't been seen since the passed in
+// time, or if they've never been seen, were created before it
+func ContactIDsNotSeenSince(ctx context.Context, db Queryer, orgID OrgID, since time.Time, limit int) ([]ContactID, error) {
+	return queryContactIDs(ctx, db, selectContactIDsNotSeenSinceSQL, orgID, since, limit)
+}
+
 const updateContactStatusSQL = `
 	UPDATE
 		contacts_contact c
@@ -1420,3 +1537,21 @@ const updateContactStatusSQL = `
 	WHERE
 		c.id = r.id::int
 `
+
+// IsTestContact returns whether the passed in contact is a test contact, i.e. a member of the org's test contacts group.
+// Messages to test contacts are never sent and webhook calls made in their sessions are flagged as sandbox calls.
+func IsTestContact(oa *OrgAssets, contact *flows.Contact) bool {
+	groupUUID := oa.Org().TestContactsGroup()
+	if groupUUID == "" || contact == nil {
+		return false
+	}
+	return contact.Groups().FindByUUID(groupUUID) != nil
+}
+
+// EngineForContact returns the flow engine to use for sessions of the passed in contact
+func EngineForContact(cfg *config.Config, oa *OrgAssets, contact *flows.Contact) flows.Engine {
+	if IsTestContact(oa, contact) {
+		return goflow.Sandbox(cfg)
+	}
+	return goflow.Engine(cfg)
+}
@@ -10,11 +10,14 @@ import (
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/utils/test"
 
+	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -561,6 +564,95 @@ func TestUpdateContactStatus(t *testing.T) {
 
 }
 
+func TestChangeContactStatuses(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// give Cathy a waiting session and an unfired campaign event
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", nil)
+	db.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW(), $1, $2)`, testdata.Cathy.ID, testdata.RemindersEvent1.ID)
+
+	contacts, err := models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+
+	eventsByContact, err := models.ChangeContactStatuses(ctx, db, rp, oa, testdata.Admin.ID, contacts, flows.ContactStatusArchived)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(eventsByContact))
+
+	for contact, events := range eventsByContact {
+		assert.Equal(t, flows.ContactStatusArchived, contact.Status())
+		assert.Equal(t, 1, len(events))
+	}
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = ANY($1) AND status = 'V' AND modified_by_id = $2`, []interface{}{pq.Array([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}), testdata.Admin.ID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'I'`, []interface{}{sessionID}, 1)
+
+	// event fires are kept, they'll be skipped if they come due while the contact is inactive
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NULL`, []interface{}{testdata.Cathy.ID}, 1)
+
+	// reload Cathy who is now archived
+	contacts, err = models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactStatus(models.ContactStatusArchived), contacts[0].Status())
+
+	// changing back to active creates events but doesn't touch sessions
+	eventsByContact, err = models.ChangeContactStatuses(ctx, db, rp, oa, models.NilUserID, contacts, flows.ContactStatusActive)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(eventsByContact))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND status = 'A'`, []interface{}{testdata.Cathy.ID}, 1)
+
+	// blocking and then unblocking also leaves her future campaign events in place
+	contacts, err = models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+
+	_, err = models.ChangeContactStatuses(ctx, db, rp, oa, testdata.Admin.ID, contacts, flows.ContactStatusBlocked)
+	require.NoError(t, err)
+
+	contacts, err = models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+
+	_, err = models.ChangeContactStatuses(ctx, db, rp, oa, testdata.Admin.ID, contacts, flows.ContactStatusActive)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND status = 'A'`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NULL`, []interface{}{testdata.Cathy.ID}, 1)
+}
+
+func TestIsTestContact(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	testdata.TestersGroup.Add(db, testdata.Cathy)
+
+	// no test contacts group configured
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+	_, bob := testdata.Bob.Load(db, oa)
+
+	assert.False(t, models.IsTestContact(oa, cathy))
+	assert.False(t, models.IsTestContact(oa, bob))
+	assert.Equal(t, goflow.Engine(config.Mailroom), models.EngineForContact(config.Mailroom, oa, cathy))
+
+	// make testers our test contacts
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('test_contacts_group', $1::text) WHERE id = $2`, testdata.TestersGroup.UUID, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err = models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assert.True(t, models.IsTestContact(oa, cathy))
+	assert.False(t, models.IsTestContact(oa, bob))
+	assert.Equal(t, goflow.Sandbox(config.Mailroom), models.EngineForContact(config.Mailroom, oa, cathy))
+	assert.Equal(t, goflow.Engine(config.Mailroom), models.EngineForContact(config.Mailroom, oa, bob))
+}
+
 func TestUpdateContactURNs(t *testing.T) {
 	testsuite.Reset()
 	ctx := testsuite.CTX()
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// RecommendedIndexes are the indexes which our hot queries depend on, by table, e.g. finding due campaign fires,
+// expired runs and timed out sessions. Without them these queries still work but get slower as the tables grow.
+var RecommendedIndexes = map[string][]string{
+	"campaigns_eventfire": {"campaigns_eventfire_unfired_unique"},
+	"flows_flowrun":       {"flows_flowrun_expires_on"},
+	"flows_flowsession":   {"flows_flowsession_timeout", "flows_flowsession_waiting"},
+	"msgs_msg":            {"msgs_next_attempt_out_errored"},
+}
+
+// tables are stale when the rows modified since they were last analyzed are more than this fraction of their rows,
+// which is lower than postgres's default autovacuum threshold since the planner relies on accurate stats for these
+const (
+	staleTableModsFraction = 0.05
+	staleTableModsMin      = 1000
+)
+
+// TableStats are the planner statistics of a table
+type TableStats struct {
+	Name             string     `db:"relname"`
+	LiveRows         int64      `db:"n_live_tup"`
+	ModsSinceAnalyze int64      `db:"n_mod_since_analyze"`
+	LastAnalyzed     *time.Time `db:"last_analyzed"`
+}
+
+// IsStale returns whether enough of this table has changed since it was last analyzed that its stats should be refreshed
+func (s *TableStats) IsStale() bool {
+	threshold := int64(float64(s.LiveRows) * staleTableModsFraction)
+	if threshold < staleTableModsMin {
+		threshold = staleTableModsMin
+	}
+	return s.ModsSinceAnalyze > threshold
+}
+
+const selectTableStatsSQL = `
+  SELECT relname, n_live_tup, n_mod_since_analyze, GREATEST(last_analyze, last_autoanalyze) AS last_analyzed
+    FROM pg_stat_user_tables
+   WHERE schemaname = current_schema() AND relname = ANY($1)
+ORDER BY relname
+`
+
+// LoadTableStats loads the planner statistics of the given tables
+func LoadTableStats(ctx context.Context, db Queryer, tables []string) ([]*TableStats, error) {
+	stats := make([]*TableStats, 0, len(tables))
+	if err := db.SelectContext(ctx, &stats, selectTableStatsSQL, pq.Array(tables)); err != nil {
+		return nil, errors.Wrapf(err, "error loading table stats")
+	}
+	return stats, nil
+}
+
+// AnalyzeTable refreshes the planner statistics of the given table
+func AnalyzeTable(ctx context.Context, db Queryer, table string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ANALYZE %s", pq.QuoteIdentifier(table)))
+	return errors.Wrapf(err, "error analyzing table %s", table)
+}
+
+const selectExistingIndexesSQL = `SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND indexname = ANY($1)`
+
+// MissingRecommendedIndexes returns which of our recommended indexes don't exist
+func MissingRecommendedIndexes(ctx context.Context, db Queryer) ([]string, error) {
+	recommended := make([]string, 0)
+	for _, indexes := range RecommendedIndexes {
+		recommended = append(recommended, indexes...)
+	}
+	sort.Strings(recommended)
+
+	existing := make([]string, 0, len(recommended))
+	if err := db.SelectContext(ctx, &existing, selectExistingIndexesSQL, pq.Array(recommended)); err != nil {
+		return nil, errors.Wrapf(err, "error querying indexes")
+	}
+
+	exists := make(map[string]bool, len(existing))
+	for _, i := range existing {
+		exists[i] = true
+	}
+
+	missing := make([]string, 0)
+	for _, i := range recommended {
+		if !exists[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// DBAdvisory is the result of the last check of the database our hot queries depend on
+type DBAdvisory struct {
+	MissingIndexes []string  `json:"missing_indexes"`
+	AnalyzedTables []string  `json:"analyzed_tables"`
+	CheckedOn      time.Time `json:"checked_on"`
+}
+
+// the advisory is stored in redis so that every instance can report it, and it expires if it stops being checked
+const (
+	dbAdvisoryKey    = "db_advisory"
+	dbAdvisoryExpiry = time.Hour * 3
+)
+
+// SaveDBAdvisory saves the result of checking the database
+func SaveDBAdvisory(rc redis.Conn, advisory *DBAdvisory) error {
+	data, err := json.Marshal(advisory)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling db advisory")
+	}
+	_, err = rc.Do("SET", dbAdvisoryKey, data, "EX", int(dbAdvisoryExpiry/time.Second))
+	return errors.Wrapf(err, "error saving db advisory")
+}
+
+// GetDBAdvisory gets the result of the last check of the database, or nil if it hasn't been checked recently
+func GetDBAdvisory(rc redis.Conn) (*DBAdvisory, error) {
+	data, err := redis.Bytes(rc.Do("GET", dbAdvisoryKey))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting db advisory")
+	}
+
+	advisory := &DBAdvisory{}
+	if err := json.Unmarshal(data, advisory); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshalling db advisory")
+	}
+	return advisory, nil
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// An engagement score is a number from 0 to 100 calculated for each contact from how recently and how often they've
+// sent us messages, and how often they complete the flows they're started in. Orgs opt in by configuring the key of a
+// number field to hold scores, which makes them available to flows as @fields and to contact queries and groups.
+
+const (
+	configEngagementField = "engagement_field"
+
+	engagementRecencyWeight    = 40
+	engagementFrequencyWeight  = 30
+	engagementCompletionWeight = 30
+
+	// contacts seen longer ago than this get no recency score
+	engagementRecencyDays = 90
+
+	// the period over which we count inbound messages, and how many in that period gets the full frequency score
+	engagementFrequencyDays = 30
+	engagementFrequencyFull = 10
+
+	// the period over which we count runs to calculate a completion rate
+	engagementCompletionDays = 90
+
+	engagementBatchSize = 1000
+)
+
+// EngagementField returns the number field which engagement scores are written to, or nil if this org doesn't have
+// engagement scoring enabled or the configured field isn't a number field
+func (a *OrgAssets) EngagementField() *Field {
+	key := a.Org().ConfigValue(configEngagementField, "")
+	if key == "" {
+		return nil
+	}
+	field := a.FieldByKey(key)
+	if field == nil || field.System() || field.Type() != assets.FieldTypeNumber {
+		return nil
+	}
+	return field
+}
+
+// ContactEngagement is the activity of a contact from which their engagement score is calculated
+type ContactEngagement struct {
+	ContactID      ContactID  `db:"contact_id"`
+	LastSeenOn     *time.Time `db:"last_seen_on"`
+	InboundCount   int        `db:"inbound_count"`
+	RunCount       int        `db:"run_count"`
+	CompletedCount int        `db:"completed_count"`
+	CurrentScore   *float64   `db:"current_score"`
+}
+
+// Score calculates the engagement score of this contact as of the passed in time
+func (e *ContactEngagement) Score(now time.Time) int {
+	score := 0.0
+
+	if e.LastSeenOn != nil {
+		days := now.Sub(*e.LastSeenOn).Hours() / 24
+		score += engagementRecencyWeight * math.Max(0, 1-math.Max(0, days)/engagementRecencyDays)
+	}
+
+	score += engagementFrequencyWeight * math.Min(1, float64(e.InboundCount)/engagementFrequencyFull)
+
+	if e.RunCount > 0 {
+		score += engagementCompletionWeight * float64(e.CompletedCount) / float64(e.RunCount)
+	}
+
+	return int(math.Round(score))
+}
+
+const selectEngagementContactIDsSQL = `
+SELECT
+	id
+FROM
+	contacts_contact
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	status = 'A' AND
+	id > $2
+ORDER BY
+	id
+LIMIT $3
+`
+
+const selectContactEngagementSQL = `
+SELECT
+	c.id AS contact_id,
+	c.last_seen_on,
+	(SELECT COUNT(*) FROM msgs_msg m WHERE m.contact_id = c.id AND m.direction = 'I' AND m.created_on > $2) AS inbound_count,
+	(SELECT COUNT(*) FROM flows_flowrun r WHERE r.contact_id = c.id AND r.created_on > $3) AS run_count,
+	(SELECT COUNT(*) FROM flows_flowrun r WHERE r.contact_id = c.id AND r.created_on > $3 AND r.status = 'C') AS completed_count,
+	(c.fields->$4->>'number')::numeric AS current_score
+FROM
+	contacts_contact c
+WHERE
+	c.id = ANY($1)
+`
+
+type engagementUpdate struct {
+	ContactID ContactID `db:"contact_id"`
+	Updates   string    `db:"updates"`
+}
+
+const updateEngagementSQL = `
+UPDATE
+	contacts_contact c
+SET
+	fields = COALESCE(fields,'{}'::jsonb) || r.updates::jsonb,
+	modified_on = NOW()
+FROM (
+	VALUES(:contact_id, :updates)
+) AS
+	r(contact_id, updates)
+WHERE
+	c.id = r.contact_id::int
+`
+
+// ScoreEngagement calculates the engagement scores of all the active contacts in the passed in org and writes those
+// which have changed to the given field, returning the ids of the contacts whose scores changed
+func ScoreEngagement(ctx context.Context, db Queryer, oa *OrgAssets, field *Field, now time.Time) ([]ContactID, error) {
+	changed := make([]ContactID, 0, engagementBatchSize)
+	lastID := ContactID(0)
+
+	for {
+		ids := make([]ContactID, 0, engagementBatchSize)
+		rows, err := db.QueryxContext(ctx, selectEngagementContactIDsSQL, oa.OrgID(), lastID, engagementBatchSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error selecting contacts to score")
+		}
+		for rows.Next() {
+			var id ContactID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, errors.Wrapf(err, "error scanning contact id")
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		if len(ids) == 0 {
+			break
+		}
+		lastID = ids[len(ids)-1]
+
+		batchChanged, err := scoreEngagementBatch(ctx, db, field, ids, now)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, batchChanged...)
+
+		if len(ids) < engagementBatchSize {
+			break
+		}
+	}
+
+	return changed, nil
+}
+
+func scoreEngagementBatch(ctx context.Context, db Queryer, field *Field, ids []ContactID, now time.Time) ([]ContactID, error) {
+	rows, err := db.QueryxContext(ctx, selectContactEngagementSQL, pq.Array(ids), now.AddDate(0, 0, -engagementFrequencyDays), now.AddDate(0, 0, -engagementCompletionDays), field.UUID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contact engagement")
+	}
+	defer rows.Close()
+
+	changed := make([]ContactID, 0, len(ids))
+	updates := make([]interface{}, 0, len(ids))
+
+	for rows.Next() {
+		e := &ContactEngagement{}
+		if err := rows.StructScan(e); err != nil {
+			return nil, errors.Wrapf(err, "error scanning contact engagement")
+		}
+
+		score := e.Score(now)
+		if e.CurrentScore != nil && int(*e.CurrentScore) == score {
+			continue
+		}
+
+		// field values are stored as they would be by the engine, i.e. with both text and typed values
+		updateJSON, err := json.Marshal(map[assets.FieldUUID]interface{}{field.UUID(): map[string]interface{}{"text": strconv.Itoa(score), "number": score}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error marshalling engagement score")
+		}
+
+		updates = append(updates, &engagementUpdate{ContactID: e.ContactID, Updates: string(updateJSON)})
+		changed = append(changed, e.ContactID)
+	}
+	rows.Close()
+
+	if err := BulkQuery(ctx, "updating engagement scores", db, updateEngagementSQL, updates); err != nil {
+		return nil, errors.Wrapf(err, "error updating engagement scores")
+	}
+	return changed, nil
+}
@@ -0,0 +1,80 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngagementScore(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(d int) *time.Time {
+		t := now.AddDate(0, 0, -d)
+		return &t
+	}
+
+	tcs := []struct {
+		engagement models.ContactEngagement
+		score      int
+	}{
+		{models.ContactEngagement{}, 0},
+		{models.ContactEngagement{LastSeenOn: daysAgo(0), InboundCount: 10, RunCount: 4, CompletedCount: 4}, 100},
+		{models.ContactEngagement{LastSeenOn: daysAgo(9), InboundCount: 5, RunCount: 4, CompletedCount: 1}, 59}, // 36 + 15 + 7.5
+		{models.ContactEngagement{LastSeenOn: daysAgo(200), InboundCount: 50}, 30},
+		{models.ContactEngagement{RunCount: 3}, 0},
+	}
+
+	for i, tc := range tcs {
+		assert.Equal(t, tc.score, tc.engagement.Score(now), "%d: score mismatch", i)
+	}
+}
+
+func TestScoreEngagement(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	// not enabled
+	assert.Nil(t, oa.EngagementField())
+
+	// enabled but with a field which isn't a number field
+	db.MustExec(`UPDATE orgs_org SET config = '{"engagement_field": "gender"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.Nil(t, oa.EngagementField())
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"engagement_field": "age"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	field := oa.EngagementField()
+	require.NotNil(t, field)
+	assert.Equal(t, "age", field.Key())
+
+	now := time.Now()
+	db.MustExec(`UPDATE contacts_contact SET last_seen_on = $2 WHERE id = $1`, testdata.Cathy.ID, now)
+
+	changed, err := models.ScoreEngagement(ctx, db, oa, field, now)
+	require.NoError(t, err)
+	assert.Contains(t, changed, testdata.Cathy.ID)
+
+	// cathy gets at least the full recency score
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND (fields->$2->>'number')::numeric >= 40`, []interface{}{testdata.Cathy.ID, testdata.AgeField.UUID}, 1)
+
+	// and every active contact in the org now has a score
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE org_id = $1 AND is_active = TRUE AND status = 'A' AND NOT fields ? $2`, []interface{}{testdata.Org1.ID, testdata.AgeField.UUID}, 0)
+
+	// scoring again changes nothing
+	changed, err = models.ScoreEngagement(ctx, db, oa, field, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(changed))
+}
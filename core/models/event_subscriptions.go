@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/nyaruka/goflow/assets"
+)
+
+// EventSubscription is a rule which starts a flow for a contact when an external system posts an event about them, e.g.
+//
+//   {
+//     "event": "order.shipped",
+//     "where": {"carrier": "DHL"},
+//     "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Shipping Update"},
+//     "restart_participants": true
+//   }
+//
+// An event matches if it has the same name and its params have all the values in where.
+type EventSubscription struct {
+	Event               string                `json:"event"`
+	Where               map[string]string     `json:"where,omitempty"`
+	Flow                *assets.FlowReference `json:"flow"`
+	RestartParticipants bool                  `json:"restart_participants"`
+}
+
+// Matches returns whether an event with the given name and params matches this subscription
+func (s *EventSubscription) Matches(event string, params map[string]interface{}) bool {
+	if s.Event != event || s.Flow == nil {
+		return false
+	}
+	for key, value := range s.Where {
+		actual, found := params[key]
+		if !found || actual == nil || fmt.Sprint(actual) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchEventSubscriptions returns the org's subscriptions which match an event with the given name and params
+func MatchEventSubscriptions(org *Org, event string, params map[string]interface{}) []*EventSubscription {
+	matches := make([]*EventSubscription, 0, 1)
+	for _, s := range org.EventSubscriptions() {
+		if s.Matches(event, params) {
+			matches = append(matches, s)
+		}
+	}
+	return matches
+}
@@ -69,6 +69,11 @@ func (s *Scene) AppendToEventPostCommitHook(hook EventCommitHook, event interfac
 	s.postCommits[hook] = append(s.postCommits[hook], event)
 }
 
+// PostCommitEvents returns the events which have been added to the passed in post commit hook
+func (s *Scene) PostCommitEvents(hook EventCommitHook) []interface{} {
+	return s.postCommits[hook]
+}
+
 // EventHandler defines a call for handling events that occur in a flow
 type EventHandler func(context.Context, *sqlx.Tx, *redis.Pool, *OrgAssets, *Scene, flows.Event) error
 
@@ -183,42 +188,53 @@ func ApplyEventPostCommitHooks(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool,
 	return nil
 }
 
-// HandleAndCommitEvents takes a set of contacts and events, handles the events and applies any hooks, and commits everything
+// HandleAndCommitEvents takes a set of contacts and events, handles the events and applies any hooks, and commits everything.
+// Pre-commit transactions which fail because of deadlocks or serialization failures are retried.
 func HandleAndCommitEvents(ctx context.Context, db QueryerWithTx, rp *redis.Pool, oa *OrgAssets, contactEvents map[*flows.Contact][]flows.Event) error {
-	// create scenes for each contact
-	scenes := make([]*Scene, 0, len(contactEvents))
-	for contact := range contactEvents {
-		scene := NewSceneForContact(contact)
-		scenes = append(scenes, scene)
-	}
+	var scenes []*Scene
+
+	err := RetryCommit(ctx, "pre commit hooks", func() error {
+		// create scenes for each contact, afresh for each attempt as handling events adds to their hooks
+		scenes = make([]*Scene, 0, len(contactEvents))
+		for contact := range contactEvents {
+			scene := NewSceneForContact(contact)
+			scenes = append(scenes, scene)
+		}
 
-	// begin the transaction for pre-commit hooks
-	tx, err := db.BeginTxx(ctx, nil)
-	if err != nil {
-		return errors.Wrapf(err, "error beginning transaction")
-	}
+		// begin the transaction for pre-commit hooks
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error beginning transaction")
+		}
+
+		// handle the events to create the hooks on each scene
+		for _, scene := range scenes {
+			err := HandleEvents(ctx, tx, rp, oa, scene, contactEvents[scene.Contact()])
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "error applying events")
+			}
+		}
 
-	// handle the events to create the hooks on each scene
-	for _, scene := range scenes {
-		err := HandleEvents(ctx, tx, rp, oa, scene, contactEvents[scene.Contact()])
+		// gather all our pre commit events, group them by hook and apply them
+		err = ApplyEventPreCommitHooks(ctx, tx, rp, oa, scenes)
 		if err != nil {
-			return errors.Wrapf(err, "error applying events")
+			tx.Rollback()
+			return errors.Wrapf(err, "error applying pre commit hooks")
 		}
-	}
 
-	// gather all our pre commit events, group them by hook and apply them
-	err = ApplyEventPreCommitHooks(ctx, tx, rp, oa, scenes)
+		// commit the transaction
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "error committing pre commit hooks")
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.Wrapf(err, "error applying pre commit hooks")
+		return err
 	}
 
-	// commit the transaction
-	if err := tx.Commit(); err != nil {
-		return errors.Wrapf(err, "error committing pre commit hooks")
-	}
-
-	// begin the transaction for post-commit hooks
-	tx, err = db.BeginTxx(ctx, nil)
+	// begin the transaction for post-commit hooks, which aren't retried as they have effects outside of the database
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "error beginning transaction for post commit")
 	}
@@ -226,6 +242,7 @@ func HandleAndCommitEvents(ctx context.Context, db QueryerWithTx, rp *redis.Pool
 	// apply the post commit hooks
 	err = ApplyEventPostCommitHooks(ctx, tx, rp, oa, scenes)
 	if err != nil {
+		tx.Rollback()
 		return errors.Wrapf(err, "error applying post commit hooks")
 	}
 
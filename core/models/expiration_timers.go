@@ -0,0 +1,145 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/mailroom/config"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// sorted set of pending run expirations, scored like session timers by the expiration in microseconds since the epoch
+const expirationTimersKey = "expiration_timers"
+
+// ExpirationTimer is a durable timer for the expiration of a waiting run
+type ExpirationTimer struct {
+	OrgID     OrgID
+	ContactID ContactID
+	SessionID SessionID
+	RunID     FlowRunID
+	HasParent bool
+	ExpiresOn time.Time
+}
+
+func (t *ExpirationTimer) member() string {
+	hasParent := 0
+	if t.HasParent {
+		hasParent = 1
+	}
+	return fmt.Sprintf("%d:%d:%d:%d:%d", t.OrgID, t.ContactID, t.SessionID, t.RunID, hasParent)
+}
+
+// ScheduleExpirationTimers adds or updates the timers for the given runs. There is only ever one timer per run.
+func ScheduleExpirationTimers(rc redis.Conn, timers []*ExpirationTimer) error {
+	if len(timers) == 0 {
+		return nil
+	}
+
+	args := redis.Args{expirationTimersKey}
+	for _, t := range timers {
+		args = args.Add(timerScore(t.ExpiresOn), t.member())
+	}
+
+	_, err := rc.Do("ZADD", args...)
+	return errors.Wrapf(err, "error scheduling expiration timers")
+}
+
+// ScheduleExpirations schedules timers for the expirations of this session's active runs, if session waits are being
+// scheduled in redis, otherwise we leave them to the expirations cron
+func (s *Session) ScheduleExpirations(rc redis.Conn, cfg *config.Config) error {
+	// voice sessions are expired by their calls
+	if cfg.SessionWaits == config.SessionWaitsDB || s.ConnectionID() != nil {
+		return nil
+	}
+
+	timers := make([]*ExpirationTimer, 0, len(s.runs))
+	for _, r := range s.runs {
+		if r.r.IsActive && r.r.ExpiresOn != nil {
+			timers = append(timers, &ExpirationTimer{
+				OrgID:     s.OrgID(),
+				ContactID: s.ContactID(),
+				SessionID: s.ID(),
+				RunID:     r.r.ID,
+				HasParent: r.r.ParentUUID != nil,
+				ExpiresOn: *r.r.ExpiresOn,
+			})
+		}
+	}
+
+	return ScheduleExpirationTimers(rc, timers)
+}
+
+// PopDueExpirationTimers removes and returns up to limit timers which are due as of now
+func PopDueExpirationTimers(rc redis.Conn, now time.Time, limit int) ([]*ExpirationTimer, error) {
+	values, err := redis.Strings(popDueTimers.Do(rc, expirationTimersKey, timerScore(now), limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error popping due expiration timers")
+	}
+
+	// values are pairs of member and score
+	timers := make([]*ExpirationTimer, 0, len(values)/2)
+	for i := 0; i < len(values)-1; i += 2 {
+		ids, expiresOn, err := parseTimer(values[i], values[i+1], 5)
+		if err != nil {
+			return nil, err
+		}
+
+		timers = append(timers, &ExpirationTimer{
+			OrgID:     OrgID(ids[0]),
+			ContactID: ContactID(ids[1]),
+			SessionID: SessionID(ids[2]),
+			RunID:     FlowRunID(ids[3]),
+			HasParent: ids[4] == 1,
+			ExpiresOn: expiresOn,
+		})
+	}
+
+	return timers, nil
+}
+
+const selectUpcomingExpirationTimersSQL = `
+SELECT org_id, contact_id, COALESCE(session_id, 0) AS session_id, id AS run_id, parent_uuid IS NOT NULL AS has_parent, expires_on
+  FROM flows_flowrun
+ WHERE is_active = TRUE AND expires_on < $1 AND connection_id IS NULL
+ ORDER BY expires_on
+ LIMIT $2`
+
+// LoadUpcomingExpirationTimers loads timers for the active runs which will expire before the given time, so that they
+// can be reconciled with the timers we have scheduled
+func LoadUpcomingExpirationTimers(ctx context.Context, db Queryer, before time.Time, limit int) ([]*ExpirationTimer, error) {
+	rows := make([]struct {
+		OrgID     OrgID     `db:"org_id"`
+		ContactID ContactID `db:"contact_id"`
+		SessionID SessionID `db:"session_id"`
+		RunID     FlowRunID `db:"run_id"`
+		HasParent bool      `db:"has_parent"`
+		ExpiresOn time.Time `db:"expires_on"`
+	}, 0, 10)
+
+	if err := db.SelectContext(ctx, &rows, selectUpcomingExpirationTimersSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading upcoming run expirations")
+	}
+
+	timers := make([]*ExpirationTimer, len(rows))
+	for i, r := range rows {
+		timers[i] = &ExpirationTimer{OrgID: r.OrgID, ContactID: r.ContactID, SessionID: r.SessionID, RunID: r.RunID, HasParent: r.HasParent, ExpiresOn: r.ExpiresOn}
+	}
+	return timers, nil
+}
+
+const selectExpiredRunIDsSQL = `
+SELECT id FROM flows_flowrun WHERE id = ANY($1) AND is_active = TRUE AND expires_on <= $2`
+
+// FilterExpiredRuns returns which of the given runs are still active and have expired as of now, as the expiration of
+// a run is pushed back each time it waits
+func FilterExpiredRuns(ctx context.Context, db Queryer, runIDs []FlowRunID, now time.Time) ([]FlowRunID, error) {
+	expired := make([]FlowRunID, 0, len(runIDs))
+	if err := db.SelectContext(ctx, &expired, selectExpiredRunIDsSQL, pq.Array(runIDs), now); err != nil {
+		return nil, errors.Wrapf(err, "error filtering expired runs")
+	}
+	return expired, nil
+}
@@ -0,0 +1,71 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationTimers(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	now := time.Date(2021, 6, 15, 12, 30, 0, 123456000, time.UTC)
+
+	timer1 := &models.ExpirationTimer{OrgID: 1, ContactID: 10000, SessionID: 101, RunID: 201, HasParent: false, ExpiresOn: now.Add(time.Second * 30)}
+	timer2 := &models.ExpirationTimer{OrgID: 1, ContactID: 10001, SessionID: 102, RunID: 202, HasParent: true, ExpiresOn: now.Add(time.Second * 10)}
+
+	err := models.ScheduleExpirationTimers(rc, []*models.ExpirationTimer{timer1, timer2})
+	require.NoError(t, err)
+
+	// rescheduling a run updates its existing timer
+	timer1.ExpiresOn = now.Add(time.Second * 5)
+	err = models.ScheduleExpirationTimers(rc, []*models.ExpirationTimer{timer1})
+	require.NoError(t, err)
+
+	timers, err := models.PopDueExpirationTimers(rc, now, 10)
+	require.NoError(t, err)
+	assert.Len(t, timers, 0)
+
+	timers, err = models.PopDueExpirationTimers(rc, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ExpirationTimer{timer1, timer2}, timers)
+
+	timers, err = models.PopDueExpirationTimers(rc, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Len(t, timers, 0)
+
+	// load timers from the database for the runs expiring in the next 15 minutes
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	expiresOn := time.Now().Add(time.Minute * 5).Round(time.Microsecond)
+	runID := testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", &expiresOn)
+	laterExpiresOn := time.Now().Add(time.Hour)
+	testdata.InsertFlowRun(db, testdata.Org1, models.SessionID(0), testdata.George, testdata.Favorites, models.RunStatusWaiting, "", &laterExpiresOn)
+
+	timers, err = models.LoadUpcomingExpirationTimers(ctx, db, time.Now().Add(time.Minute*15), 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(timers))
+	assert.Equal(t, testdata.Org1.ID, timers[0].OrgID)
+	assert.Equal(t, testdata.Cathy.ID, timers[0].ContactID)
+	assert.Equal(t, sessionID, timers[0].SessionID)
+	assert.Equal(t, runID, timers[0].RunID)
+	assert.False(t, timers[0].HasParent)
+	assert.True(t, expiresOn.Equal(timers[0].ExpiresOn))
+
+	// the run hasn't expired yet
+	expired, err := models.FilterExpiredRuns(ctx, db, []models.FlowRunID{runID}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []models.FlowRunID{}, expired)
+
+	expired, err = models.FilterExpiredRuns(ctx, db, []models.FlowRunID{runID}, time.Now().Add(time.Minute*10))
+	require.NoError(t, err)
+	assert.Equal(t, []models.FlowRunID{runID}, expired)
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/pkg/errors"
+)
+
+// we keep the most recent regression reports for each flow so that changes in behavior can be tracked across versions
+const (
+	flowRegressionsKey        = "flow_regressions:%d"
+	flowRegressionsMaxReports = 10
+	flowRegressionsTTL        = 60 * 60 * 24 * 30
+)
+
+// RecordedSession is the output of a completed session which can be replayed to check a flow still behaves the same
+type RecordedSession struct {
+	UUID   flows.SessionUUID `db:"uuid"`
+	Output json.RawMessage   `db:"output"`
+}
+
+// sessions with their output stored elsewhere are ignored, as are those which were started by another flow, since the
+// trigger flow is the one we're replaying
+const selectRecordedSessionsSQL = `
+SELECT uuid, output
+  FROM flows_flowsession
+ WHERE org_id = $1 AND
+       session_type = 'M' AND
+       status = 'C' AND
+       output IS NOT NULL AND
+       output::jsonb->'trigger'->'flow'->>'uuid' = $2
+ORDER BY id DESC
+   LIMIT $3`
+
+// LoadRecordedSessions loads up to limit of the most recent completed messaging sessions started in the given flow
+func LoadRecordedSessions(ctx context.Context, db Queryer, orgID OrgID, flowUUID assets.FlowUUID, limit int) ([]*RecordedSession, error) {
+	sessions := make([]*RecordedSession, 0, limit)
+	if err := db.SelectContext(ctx, &sessions, selectRecordedSessionsSQL, orgID, flowUUID, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading recorded sessions for flow: %s", flowUUID)
+	}
+	return sessions, nil
+}
+
+// FlowRegression is a recorded session which behaved differently when replayed
+type FlowRegression struct {
+	SessionUUID flows.SessionUUID `json:"session_uuid"`
+	Inputs      []string          `json:"inputs"`
+	Expected    []string          `json:"expected"`
+	Actual      []string          `json:"actual"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// FlowRegressionReport is the result of replaying a flow's recorded sessions with a version of mailroom and the flow
+type FlowRegressionReport struct {
+	FlowID       FlowID            `json:"flow_id"`
+	FlowUUID     assets.FlowUUID   `json:"flow_uuid"`
+	FlowRevision int               `json:"flow_revision"`
+	Version      string            `json:"version"`
+	SpecVersion  string            `json:"spec_version"`
+	CreatedOn    time.Time         `json:"created_on"`
+	Replayed     int               `json:"replayed"`
+	Skipped      int               `json:"skipped"`
+	Passed       int               `json:"passed"`
+	Regressions  []*FlowRegression `json:"regressions"`
+}
+
+// SaveFlowRegressionReport saves the given report as the most recent for its flow
+func SaveFlowRegressionReport(rc redis.Conn, report *FlowRegressionReport) error {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding regression report")
+	}
+
+	key := fmt.Sprintf(flowRegressionsKey, report.FlowID)
+
+	rc.Send("MULTI")
+	rc.Send("LPUSH", key, encoded)
+	rc.Send("LTRIM", key, 0, flowRegressionsMaxReports-1)
+	rc.Send("EXPIRE", key, flowRegressionsTTL)
+	if _, err := rc.Do("EXEC"); err != nil {
+		return errors.Wrapf(err, "error saving regression report for flow: %d", report.FlowID)
+	}
+	return nil
+}
+
+// LoadFlowRegressionReports loads the saved regression reports for the given flow, most recent first
+func LoadFlowRegressionReports(rc redis.Conn, flowID FlowID) ([]*FlowRegressionReport, error) {
+	encoded, err := redis.ByteSlices(rc.Do("LRANGE", fmt.Sprintf(flowRegressionsKey, flowID), 0, -1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading regression reports for flow: %d", flowID)
+	}
+
+	reports := make([]*FlowRegressionReport, len(encoded))
+	for i := range encoded {
+		reports[i] = &FlowRegressionReport{}
+		if err := json.Unmarshal(encoded[i], reports[i]); err != nil {
+			return nil, errors.Wrapf(err, "error decoding regression report for flow: %d", flowID)
+		}
+	}
+	return reports, nil
+}
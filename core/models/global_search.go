@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SearchResultType is the type of a global search result
+type SearchResultType string
+
+// search result type constants
+const (
+	SearchResultTypeContact = SearchResultType("contact")
+	SearchResultTypeMsg     = SearchResultType("msg")
+	SearchResultTypeTicket  = SearchResultType("ticket")
+)
+
+// AllSearchResultTypes is all the types of result a global search can return
+var AllSearchResultTypes = []SearchResultType{SearchResultTypeContact, SearchResultTypeMsg, SearchResultTypeTicket}
+
+// the elastic index searched for each type of result
+var searchResultIndexes = map[SearchResultType]string{
+	SearchResultTypeContact: "contacts",
+	SearchResultTypeMsg:     "msgs",
+	SearchResultTypeTicket:  "tickets",
+}
+
+// SearchResult is a single result of a global search
+type SearchResult struct {
+	Type  SearchResultType `json:"type"`
+	ID    int64            `json:"id"`
+	Score float64          `json:"score"`
+}
+
+// buildGlobalSearchQuery builds the elastic query for the passed in type of result, i.e. contacts by name or URN,
+// messages by their text and tickets by their subject or body
+func buildGlobalSearchQuery(orgID OrgID, resultType SearchResultType, text string) elastic.Query {
+	eq := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("org_id", orgID))
+
+	switch resultType {
+	case SearchResultTypeContact:
+		eq = eq.Filter(elastic.NewTermQuery("is_active", true)).Should(
+			elastic.NewMatchQuery("name", text),
+			elastic.NewNestedQuery("urns", elastic.NewMatchPhrasePrefixQuery("urns.path", text)),
+		).MinimumNumberShouldMatch(1)
+	case SearchResultTypeMsg:
+		eq = eq.Must(elastic.NewMatchQuery("text", text))
+	case SearchResultTypeTicket:
+		eq = eq.Must(elastic.NewMultiMatchQuery(text, "subject^2", "body"))
+	}
+
+	return eq
+}
+
+// GlobalSearch searches across the contacts, messages and tickets of an org. As relevance scores aren't comparable across
+// indexes, each type's scores are normalized against its best match before results are merged and ranked.
+func GlobalSearch(ctx context.Context, client *elastic.Client, orgID OrgID, text string, types []SearchResultType, limit int) ([]*SearchResult, error) {
+	start := time.Now()
+
+	if client == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	routing := strconv.FormatInt(int64(orgID), 10)
+
+	ms := client.MultiSearch()
+	for _, t := range types {
+		index, found := searchResultIndexes[t]
+		if !found {
+			return nil, errors.Errorf("unknown search result type: %s", t)
+		}
+
+		source := elastic.NewSearchSource().Query(buildGlobalSearchQuery(orgID, t, text)).Size(limit).FetchSource(false)
+		ms = ms.Add(elastic.NewSearchRequest().Index(index).Routing(routing).SearchSource(source))
+	}
+
+	response, err := ms.Do(ctx)
+	if err != nil {
+		ee, ok := err.(*elastic.Error)
+		if !ok {
+			return nil, errors.Wrapf(err, "error performing global search")
+		}
+		return nil, errors.Wrapf(err, "error performing global search: %s", ee.Details.Reason)
+	}
+
+	if len(response.Responses) != len(types) {
+		return nil, errors.Errorf("expected %d search responses, got %d", len(types), len(response.Responses))
+	}
+
+	results := make([]*SearchResult, 0, limit)
+	for i, r := range response.Responses {
+		if r.Error != nil {
+			return nil, errors.Errorf("error searching %s: %s", types[i], r.Error.Reason)
+		}
+		if r.Hits == nil || len(r.Hits.Hits) == 0 {
+			continue
+		}
+
+		maxScore := 0.0
+		for _, hit := range r.Hits.Hits {
+			if hit.Score != nil && *hit.Score > maxScore {
+				maxScore = *hit.Score
+			}
+		}
+
+		for _, hit := range r.Hits.Hits {
+			id, err := strconv.ParseInt(hit.Id, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unexpected non-integer %s id: %s", types[i], hit.Id)
+			}
+
+			score := 0.0
+			if hit.Score != nil && maxScore > 0 {
+				score = *hit.Score / maxScore
+			}
+
+			results = append(results, &SearchResult{Type: types[i], ID: id, Score: score})
+		}
+	}
+
+	// rank by score, keeping the order of types for ties
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":  orgID,
+		"text":    text,
+		"types":   types,
+		"elapsed": time.Since(start),
+		"count":   len(results),
+	}).Debug("global search complete")
+
+	return results, nil
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// GroupMembershipChanges is the contacts who entered and left a dynamic group in a single evaluation of it
+type GroupMembershipChanges struct {
+	GroupID GroupID     `json:"group_id"`
+	Entered []ContactID `json:"entered"`
+	Left    []ContactID `json:"left"`
+}
+
+// IsEmpty returns whether no contacts entered or left the group
+func (c *GroupMembershipChanges) IsEmpty() bool {
+	return len(c.Entered) == 0 && len(c.Left) == 0
+}
+
+const selectContactUUIDsSQL = `SELECT id, uuid FROM contacts_contact WHERE id = ANY($1) AND is_active = TRUE`
+
+// LoadContactUUIDs loads the UUIDs of the given contacts, omitting any which no longer exist
+func LoadContactUUIDs(ctx context.Context, db Queryer, ids []ContactID) (map[ContactID]flows.ContactUUID, error) {
+	rows, err := db.QueryxContext(ctx, selectContactUUIDsSQL, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contact uuids")
+	}
+	defer rows.Close()
+
+	uuids := make(map[ContactID]flows.ContactUUID, len(ids))
+	for rows.Next() {
+		var id ContactID
+		var uuid flows.ContactUUID
+		if err := rows.Scan(&id, &uuid); err != nil {
+			return nil, errors.Wrapf(err, "error scanning contact uuid")
+		}
+		uuids[id] = uuid
+	}
+	return uuids, rows.Err()
+}
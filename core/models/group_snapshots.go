@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// GroupSnapshot is the membership of a group at a point in time, which can be stored as a backup and imported into a
+// new static group, in this or another org
+type GroupSnapshot struct {
+	OrgID     OrgID                   `json:"org_id"`
+	Group     *assets.GroupReference  `json:"group"`
+	CreatedOn time.Time               `json:"created_on"`
+	Contacts  []*GroupSnapshotContact `json:"contacts"`
+}
+
+// GroupSnapshotContact is a member of a group in a snapshot
+type GroupSnapshotContact struct {
+	ID   ContactID  `json:"id"`
+	URNs []urns.URN `json:"urns"`
+}
+
+const selectGroupSnapshotContactsSQL = `
+SELECT
+	c.id,
+	ARRAY_REMOVE(ARRAY_AGG(u.identity ORDER BY u.priority DESC, u.id), NULL) AS urns
+FROM
+	contacts_contactgroup_contacts gc
+	INNER JOIN contacts_contact c ON c.id = gc.contact_id
+	LEFT OUTER JOIN contacts_contacturn u ON u.contact_id = c.id
+WHERE
+	gc.contactgroup_id = $1 AND
+	c.is_active = TRUE
+GROUP BY
+	c.id
+ORDER BY
+	c.id
+`
+
+// CreateGroupSnapshot creates a snapshot of the current active members of the given group and their URNs
+func CreateGroupSnapshot(ctx context.Context, db Queryer, orgID OrgID, group *Group) (*GroupSnapshot, error) {
+	rows, err := db.QueryxContext(ctx, selectGroupSnapshotContactsSQL, group.ID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting members of group: %d", group.ID())
+	}
+	defer rows.Close()
+
+	snapshot := &GroupSnapshot{
+		OrgID:     orgID,
+		Group:     assets.NewGroupReference(group.UUID(), group.Name()),
+		CreatedOn: dates.Now(),
+		Contacts:  make([]*GroupSnapshotContact, 0),
+	}
+
+	for rows.Next() {
+		var id ContactID
+		var identities pq.StringArray
+		if err := rows.Scan(&id, &identities); err != nil {
+			return nil, errors.Wrapf(err, "error scanning group member")
+		}
+
+		contact := &GroupSnapshotContact{ID: id, URNs: make([]urns.URN, len(identities))}
+		for i := range identities {
+			contact.URNs[i] = urns.URN(identities[i])
+		}
+		snapshot.Contacts = append(snapshot.Contacts, contact)
+	}
+
+	return snapshot, nil
+}
+
+const selectActiveContactIDsSQL = `SELECT id FROM contacts_contact WHERE org_id = $1 AND id = ANY($2) AND is_active = TRUE`
+
+const selectContactIDsByURNIdentitiesSQL = `
+SELECT DISTINCT
+	u.contact_id
+FROM
+	contacts_contacturn u
+	INNER JOIN contacts_contact c ON c.id = u.contact_id
+WHERE
+	u.org_id = $1 AND
+	u.identity = ANY($2) AND
+	c.is_active = TRUE
+`
+
+// ResolveGroupSnapshot resolves the contacts in the given snapshot to the ids of active contacts in the given org. In the
+// org the snapshot was taken from, contacts are matched by their ids, and in other orgs by their URNs.
+func ResolveGroupSnapshot(ctx context.Context, db Queryer, orgID OrgID, snapshot *GroupSnapshot) ([]ContactID, error) {
+	if snapshot.OrgID == orgID {
+		ids := make([]ContactID, len(snapshot.Contacts))
+		for i, c := range snapshot.Contacts {
+			ids[i] = c.ID
+		}
+
+		resolved, err := queryContactIDs(ctx, db, selectActiveContactIDsSQL, orgID, pq.Array(ids))
+		return resolved, errors.Wrapf(err, "error resolving group snapshot contacts by id")
+	}
+
+	identities := make([]string, 0, len(snapshot.Contacts))
+	for _, c := range snapshot.Contacts {
+		for _, u := range c.URNs {
+			identities = append(identities, string(u.Identity()))
+		}
+	}
+
+	resolved, err := queryContactIDs(ctx, db, selectContactIDsByURNIdentitiesSQL, orgID, pq.Array(identities))
+	return resolved, errors.Wrapf(err, "error resolving group snapshot contacts by URN")
+}
+
+const insertStaticGroupSQL = `
+INSERT INTO
+	contacts_contactgroup(uuid, org_id, group_type, name, query, status, is_active, created_by_id, created_on, modified_by_id, modified_on)
+	VALUES($1, $2, 'U', $3, NULL, $4, TRUE, $5, NOW(), $5, NOW())
+RETURNING
+	id
+`
+
+// CreateStaticGroup creates a new static group which is initializing until it has been populated
+func CreateStaticGroup(ctx context.Context, db Queryer, orgID OrgID, userID UserID, name string) (GroupID, assets.GroupUUID, error) {
+	uuid := assets.GroupUUID(uuids.New())
+
+	var id GroupID
+	if err := db.GetContext(ctx, &id, insertStaticGroupSQL, uuid, orgID, name, GroupStatusInitializing, userID); err != nil {
+		return GroupID(0), "", errors.Wrapf(err, "error creating group '%s'", name)
+	}
+	return id, uuid, nil
+}
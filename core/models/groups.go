@@ -333,11 +333,12 @@ func AddContactsToGroupAndCampaigns(ctx context.Context, db *sqlx.DB, org *OrgAs
 }
 
 // PopulateDynamicGroup calculates which members should be part of a group and populates the contacts
-// for that group by performing the minimum number of inserts / deletes.
-func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client, org *OrgAssets, groupID GroupID, query string) (int, error) {
+// for that group by performing the minimum number of inserts / deletes. It returns the new size of the
+// group and which contacts entered and left it.
+func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client, org *OrgAssets, groupID GroupID, query string) (int, *GroupMembershipChanges, error) {
 	err := UpdateGroupStatus(ctx, db, groupID, GroupStatusEvaluating)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error marking dynamic group as evaluating")
+		return 0, nil, errors.Wrapf(err, "error marking dynamic group as evaluating")
 	}
 
 	start := time.Now()
@@ -347,7 +348,7 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	// more recently than 10 seconds ago, we wait that long before starting in populating our group
 	newest, err := GetNewestContactModifiedOn(ctx, db, org)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error getting most recent contact modified_on for org: %d", org.OrgID())
+		return 0, nil, errors.Wrapf(err, "error getting most recent contact modified_on for org: %d", org.OrgID())
 	}
 	if newest != nil {
 		n := *newest
@@ -363,7 +364,7 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	// get current set of contacts in our group
 	ids, err := ContactIDsForGroupIDs(ctx, db, []GroupID{groupID})
 	if err != nil {
-		return 0, errors.Wrapf(err, "unable to look up contact ids for group: %d", groupID)
+		return 0, nil, errors.Wrapf(err, "unable to look up contact ids for group: %d", groupID)
 	}
 	present := make(map[ContactID]bool, len(ids))
 	for _, i := range ids {
@@ -371,9 +372,9 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	}
 
 	// calculate new set of ids
-	new, err := ContactIDsForQuery(ctx, es, org, query)
+	new, err := ContactIDsForQuery(ctx, db, es, org, query)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error performing query: %s for group: %d", query, groupID)
+		return 0, nil, errors.Wrapf(err, "error performing query: %s for group: %d", query, groupID)
 	}
 
 	// find which need to be added or removed
@@ -394,20 +395,20 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	// first remove all the contacts
 	err = RemoveContactsFromGroupAndCampaigns(ctx, db, org, groupID, removals)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error removing contacts from group: %d", groupID)
+		return 0, nil, errors.Wrapf(err, "error removing contacts from group: %d", groupID)
 	}
 
 	// then add them all
 	err = AddContactsToGroupAndCampaigns(ctx, db, org, groupID, adds)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error adding contacts to group: %d", groupID)
+		return 0, nil, errors.Wrapf(err, "error adding contacts to group: %d", groupID)
 	}
 
 	// mark our group as no longer evaluating
 	err = UpdateGroupStatus(ctx, db, groupID, GroupStatusReady)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error marking dynamic group as ready")
+		return 0, nil, errors.Wrapf(err, "error marking dynamic group as ready")
 	}
 
-	return len(new), nil
+	return len(new), &GroupMembershipChanges{GroupID: groupID, Entered: adds, Left: removals}, nil
 }
@@ -151,7 +151,7 @@ func TestDynamicGroups(t *testing.T) {
 		assert.NoError(t, err)
 
 		esServer.NextResponse = tc.ESResponse
-		count, err := models.PopulateDynamicGroup(ctx, db, es, oa, testdata.DoctorsGroup.ID, tc.Query)
+		count, _, err := models.PopulateDynamicGroup(ctx, db, es, oa, testdata.DoctorsGroup.ID, tc.Query)
 		assert.NoError(t, err, "error populating dynamic group for: %s", tc.Query)
 
 		assert.Equal(t, count, len(tc.ContactIDs))
@@ -27,6 +27,9 @@ const (
 
 	// LogTypeAirtimeTransferred is our type for when we make an airtime transfer
 	LogTypeAirtimeTransferred = "airtime_transferred"
+
+	// LogTypePhoneLookup is our type for when we look up a phone number
+	LogTypePhoneLookup = "phone_lookup"
 )
 
 // HTTPLog is our type for a HTTPLog
@@ -79,6 +82,11 @@ func NewAirtimeTransferredLog(orgID OrgID, url string, request string, response
 	return newHTTPLog(orgID, LogTypeAirtimeTransferred, url, request, response, isError, elapsed, createdOn)
 }
 
+// NewPhoneLookupLog creates a new HTTP log for a phone number lookup
+func NewPhoneLookupLog(orgID OrgID, url string, request string, response string, isError bool, elapsed time.Duration, createdOn time.Time) *HTTPLog {
+	return newHTTPLog(orgID, LogTypePhoneLookup, url, request, response, isError, elapsed, createdOn)
+}
+
 // SetAirtimeTransferID called to set the transfer ID on a log after the transfer has been created
 func (h *HTTPLog) SetAirtimeTransferID(tid AirtimeTransferID) {
 	h.h.AirtimeTransferID = tid
@@ -145,6 +153,21 @@ func (h *HTTPLogger) Ticketer(t *Ticketer) flows.HTTPLogCallback {
 	}
 }
 
+// PhoneLookup creates a callback for engine HTTP logs which are associated with phone number lookups for the given org
+func (h *HTTPLogger) PhoneLookup(orgID OrgID) flows.HTTPLogCallback {
+	return func(l *flows.HTTPLog) {
+		h.logs = append(h.logs, NewPhoneLookupLog(
+			orgID,
+			l.URL,
+			l.Request,
+			l.Response,
+			l.Status != flows.CallStatusSuccess,
+			time.Duration(l.ElapsedMS)*time.Millisecond,
+			l.CreatedOn,
+		))
+	}
+}
+
 // Insert this logger's logs into the database
 func (h *HTTPLogger) Insert(ctx context.Context, db Queryer) error {
 	if len(h.logs) > 0 {
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// IdempotencyScope is the kind of thing an idempotency key was given for
+type IdempotencyScope string
+
+// idempotency scopes of flow starts and broadcasts, whose keys RapidPro claims before creating them
+const (
+	IdempotencyScopeStart     = IdempotencyScope("start")
+	IdempotencyScopeBroadcast = IdempotencyScope("broadcast")
+)
+
+const (
+	idempotencyKeyPattern = "idempotency:%d:%s:%s"
+	idempotencyKeyExpiry  = 24 * time.Hour
+)
+
+// idempotency scopes of requests to our endpoints which create things
+const (
+	IdempotencyScopeEventReceive = IdempotencyScope("event_receive")
+	IdempotencyScopeTicketReply  = IdempotencyScope("ticket_reply")
+)
+
+// how long a request can hold its key before it's assumed to have died and the key can be claimed by a retry
+const idempotencyPendingExpiry = 5 * time.Minute
+
+// ErrIdempotentRequestInProgress is returned when a request is made with the idempotency key of a request which hasn't
+// finished yet
+var ErrIdempotentRequestInProgress = errors.New("a request with this idempotency key is still in progress")
+
+// StartIdempotentRequest claims the given idempotency key for a request before it creates anything. If the key has
+// already been used by a request which completed, its result is returned along with true, and the request should
+// return that result without creating anything again. Requests which claim the key must then call either
+// CompleteIdempotentRequest or AbandonIdempotentRequest.
+func StartIdempotentRequest(rc redis.Conn, orgID OrgID, scope IdempotencyScope, key string) (string, bool, error) {
+	redisKey := fmt.Sprintf(idempotencyKeyPattern, orgID, scope, key)
+
+	// pending requests hold the key with an empty result
+	_, err := redis.String(rc.Do("SET", redisKey, "", "NX", "EX", int(idempotencyPendingExpiry/time.Second)))
+	if err == nil {
+		return "", false, nil
+	} else if err != redis.ErrNil {
+		return "", false, errors.Wrapf(err, "error claiming idempotency key")
+	}
+
+	result, err := redis.String(rc.Do("GET", redisKey))
+	if err == redis.ErrNil {
+		// key expired between our SET and GET so it's ours for the taking
+		return StartIdempotentRequest(rc, orgID, scope, key)
+	} else if err != nil {
+		return "", false, errors.Wrapf(err, "error reading idempotency key")
+	}
+	if result == "" {
+		return "", false, ErrIdempotentRequestInProgress
+	}
+	return result, true, nil
+}
+
+// CompleteIdempotentRequest records the result of a request which claimed the given idempotency key, e.g. the id of
+// what it created, which must not be empty. The result is returned for retries of the request for 24 hours.
+func CompleteIdempotentRequest(rc redis.Conn, orgID OrgID, scope IdempotencyScope, key string, result string) error {
+	redisKey := fmt.Sprintf(idempotencyKeyPattern, orgID, scope, key)
+
+	_, err := rc.Do("SET", redisKey, result, "EX", int(idempotencyKeyExpiry/time.Second))
+	return errors.Wrapf(err, "error recording idempotency key result")
+}
+
+// AbandonIdempotentRequest releases the given idempotency key after a request which claimed it failed, so that it can
+// be retried
+func AbandonIdempotentRequest(rc redis.Conn, orgID OrgID, scope IdempotencyScope, key string) error {
+	redisKey := fmt.Sprintf(idempotencyKeyPattern, orgID, scope, key)
+
+	_, err := rc.Do("DEL", redisKey)
+	return errors.Wrapf(err, "error releasing idempotency key")
+}
+
+// IdempotentRequestResult returns the result recorded for the given idempotency key, or an empty string if the key
+// hasn't been used or the request which claimed it hasn't completed
+func IdempotentRequestResult(rc redis.Conn, orgID OrgID, scope IdempotencyScope, key string) (string, error) {
+	redisKey := fmt.Sprintf(idempotencyKeyPattern, orgID, scope, key)
+
+	result, err := redis.String(rc.Do("GET", redisKey))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return result, errors.Wrapf(err, "error reading idempotency key")
+}
@@ -0,0 +1,72 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentRequests(t *testing.T) {
+	_, _, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	// first request with a key claims it
+	_, replay, err := models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeTicketReply, "abc")
+	require.NoError(t, err)
+	assert.False(t, replay)
+
+	ttl, err := redis.Int(rc.Do("TTL", "idempotency:1:ticket_reply:abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 300, ttl)
+
+	// a retry while it's still in progress is an error
+	_, _, err = models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeTicketReply, "abc")
+	assert.Equal(t, models.ErrIdempotentRequestInProgress, err)
+
+	// once it completes, retries get its result
+	err = models.CompleteIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeTicketReply, "abc", "1234")
+	require.NoError(t, err)
+
+	result, replay, err := models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeTicketReply, "abc")
+	require.NoError(t, err)
+	assert.True(t, replay)
+	assert.Equal(t, "1234", result)
+
+	ttl, err = redis.Int(rc.Do("TTL", "idempotency:1:ticket_reply:abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 86400, ttl)
+
+	// a request which fails releases its key so that it can be retried
+	_, replay, err = models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeEventReceive, "abc")
+	require.NoError(t, err)
+	assert.False(t, replay)
+
+	err = models.AbandonIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeEventReceive, "abc")
+	require.NoError(t, err)
+
+	_, replay, err = models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeEventReceive, "abc")
+	require.NoError(t, err)
+	assert.False(t, replay)
+
+	// only completed requests have a result
+	result, err = models.IdempotentRequestResult(rc, testdata.Org1.ID, models.IdempotencyScopeEventReceive, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "", result)
+
+	result, err = models.IdempotentRequestResult(rc, testdata.Org1.ID, models.IdempotencyScopeTicketReply, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", result)
+
+	result, err = models.IdempotentRequestResult(rc, testdata.Org1.ID, models.IdempotencyScopeStart, "xyz")
+	require.NoError(t, err)
+	assert.Equal(t, "", result)
+}
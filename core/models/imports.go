@@ -12,10 +12,15 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -34,14 +39,47 @@ const (
 	ContactImportStatusProcessing ContactImportStatus = "O"
 	ContactImportStatusComplete   ContactImportStatus = "C"
 	ContactImportStatusFailed     ContactImportStatus = "F"
+	ContactImportStatusTimedOut   ContactImportStatus = "T"
+)
+
+// ContactImportMode is what an import does with the contacts in it
+type ContactImportMode string
+
+// import mode constants
+const (
+	// creates contacts which don't exist and updates those which do
+	ContactImportModeDefault ContactImportMode = "D"
+
+	// only adds existing contacts, matched by URN, to the groups in their specs
+	ContactImportModeGroupsOnly ContactImportMode = "G"
+
+	// only creates contacts, skipping records whose UUIDs or URNs belong to existing contacts
+	ContactImportModeCreateOnly ContactImportMode = "C"
+
+	// only updates existing contacts, skipping records whose URNs don't belong to any contact
+	ContactImportModeUpdateOnly ContactImportMode = "U"
+)
+
+// ContactImportFieldMerge is how an import merges the field values in it with those of existing contacts
+type ContactImportFieldMerge string
+
+// import field merge constants
+const (
+	// imported values overwrite existing values
+	ContactImportFieldMergeOverwrite ContactImportFieldMerge = "O"
+
+	// imported values are only set for fields which don't already have a value
+	ContactImportFieldMergeBlanksOnly ContactImportFieldMerge = "B"
 )
 
 // ContactImportBatch is a batch of contacts within a larger import
 type ContactImportBatch struct {
-	ID       ContactImportBatchID `db:"id"`
-	ImportID ContactImportID      `db:"contact_import_id"`
-	Status   ContactImportStatus  `db:"status"`
-	Specs    json.RawMessage      `db:"specs"`
+	ID         ContactImportBatchID    `db:"id"`
+	ImportID   ContactImportID         `db:"contact_import_id"`
+	Mode       ContactImportMode       `db:"mode"`
+	FieldMerge ContactImportFieldMerge `db:"field_merge"`
+	Status     ContactImportStatus     `db:"status"`
+	Specs      json.RawMessage         `db:"specs"`
 
 	// the range of records from the entire import contained in this batch
 	RecordStart int `db:"record_start"`
@@ -50,72 +88,303 @@ type ContactImportBatch struct {
 	// results written after processing this batch
 	NumCreated int             `db:"num_created"`
 	NumUpdated int             `db:"num_updated"`
+	NumSkipped int             `db:"num_skipped"`
 	NumErrored int             `db:"num_errored"`
 	Errors     json.RawMessage `db:"errors"`
 	FinishedOn *time.Time      `db:"finished_on"`
 }
 
-// Import does the actual import of this batch
-func (b *ContactImportBatch) Import(ctx context.Context, db *sqlx.DB, orgID OrgID) error {
-	// if any error occurs this batch should be marked as failed
-	if err := b.tryImport(ctx, db, orgID); err != nil {
+// Import does the actual import of this batch. If the context expires part way through, the batch is marked as timed
+// out with the results of the records which were imported before that.
+func (b *ContactImportBatch) Import(ctx context.Context, db *sqlx.DB, rp *redis.Pool, orgID OrgID) error {
+	// if any other error occurs this batch should be marked as failed, using a new context as ours may have expired
+	if err := b.tryImport(ctx, db, rp, orgID); err != nil {
+		if b.Status != ContactImportStatusTimedOut {
+			mctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+			defer cancel()
+
+			if merr := b.markFailed(mctx, db); merr != nil {
+				logrus.WithError(merr).WithField("batch_id", b.ID).Error("error marking contact import batch as failed")
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Preview works out what importing this batch would do without creating or updating any contacts, and marks the batch
+// as complete with the number of contacts that would be created, updated, skipped or errored
+func (b *ContactImportBatch) Preview(ctx context.Context, db *sqlx.DB, orgID OrgID) error {
+	if err := b.tryPreview(ctx, db, orgID); err != nil {
 		b.markFailed(ctx, db)
 		return err
 	}
 	return nil
 }
 
+// ContactImportResults are the results of importing, or previewing the import of, a batch of contacts
+type ContactImportResults struct {
+	NumCreated int                   `json:"num_created"`
+	NumUpdated int                   `json:"num_updated"`
+	NumSkipped int                   `json:"num_skipped"`
+	NumErrored int                   `json:"num_errored"`
+	Errors     []*ContactImportError `json:"errors"`
+}
+
+// ContactImportError is an error message associated with a particular record
+type ContactImportError struct {
+	Record  int    `json:"record"  db:"record"`
+	Message string `json:"message" db:"message"`
+}
+
+// PreviewContactImport works out what importing the given specs would do without creating or updating any contacts,
+// numbering records from the given start
+func PreviewContactImport(ctx context.Context, db Queryer, oa *OrgAssets, specs []*ContactSpec, recordStart int) (*ContactImportResults, error) {
+	imports := newImportContacts(specs, recordStart)
+
+	if err := previewContacts(ctx, db, oa, imports); err != nil {
+		return nil, errors.Wrap(err, "error previewing contacts")
+	}
+
+	return summarizeImports(imports), nil
+}
+
 // holds work data for import of a single contact
 type importContact struct {
 	record      int
 	spec        *ContactSpec
 	contact     *Contact
 	created     bool
+	updated     bool // only used by previews which don't have contacts
+	skipped     bool
 	flowContact *flows.Contact
 	mods        []flows.Modifier
+	fieldMods   map[flows.Modifier]string // the field keys of mods which set field values
 	errors      []string
 }
 
-func (b *ContactImportBatch) tryImport(ctx context.Context, db *sqlx.DB, orgID OrgID) error {
+func newImportContacts(specs []*ContactSpec, recordStart int) []*importContact {
+	imports := make([]*importContact, len(specs))
+	for i := range imports {
+		imports[i] = &importContact{record: recordStart + i, spec: specs[i]}
+	}
+	return imports
+}
+
+func (i *importContact) addError(s string, args ...interface{}) {
+	i.errors = append(i.errors, fmt.Sprintf(s, args...))
+}
+
+// skips this import because of the import's mode, recording why so that it's reported like an error
+func (i *importContact) skip(s string, args ...interface{}) {
+	i.skipped = true
+	i.contact = nil
+	i.flowContact = nil
+	i.addError(s, args...)
+}
+
+func (b *ContactImportBatch) tryImport(ctx context.Context, db *sqlx.DB, rp *redis.Pool, orgID OrgID) error {
+	// create our work data for each contact being created or updated
+	imports, err := b.loadImports()
+	if err != nil {
+		return err
+	}
+
+	applied, err := b.importContacts(ctx, db, rp, orgID, imports)
+
+	// if we ran out of time, whether that caused an error or not, what we did import is still recorded, using a new
+	// context as ours has expired
+	if ctx.Err() != nil {
+		if !applied {
+			timeOutUnappliedImports(imports)
+		}
+
+		mctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+		defer cancel()
+
+		if err := b.markTimedOut(mctx, db, imports); err != nil {
+			return errors.Wrap(err, "unable to mark as timed out")
+		}
+		return errors.Wrapf(ctx.Err(), "import of batch %d timed out", b.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.markComplete(ctx, db, imports); err != nil {
+		return errors.Wrap(err, "unable to mark as complete")
+	}
+
+	return nil
+}
+
+// gets, creates or matches the contacts of the passed in imports and applies their modifiers, returning whether it got
+// as far as applying modifiers
+func (b *ContactImportBatch) importContacts(ctx context.Context, db *sqlx.DB, rp *redis.Pool, orgID OrgID, imports []*importContact) (bool, error) {
 	if err := b.markProcessing(ctx, db); err != nil {
-		return errors.Wrap(err, "error marking as processing")
+		return false, errors.Wrap(err, "error marking as processing")
 	}
 
 	// grab our org assets
 	oa, err := GetOrgAssetsWithRefresh(ctx, db, orgID, RefreshFields|RefreshGroups)
 	if err != nil {
-		return errors.Wrap(err, "error loading org assets")
+		return false, errors.Wrap(err, "error loading org assets")
 	}
 
-	// unmarshal this batch's specs
-	var specs []*ContactSpec
-	if err := jsonx.Unmarshal(b.Specs, &specs); err != nil {
-		return errors.Wrap(err, "error unmarsaling specs")
+	if b.Mode == ContactImportModeGroupsOnly {
+		if err := b.matchContacts(ctx, db, oa, imports); err != nil {
+			return false, errors.Wrap(err, "error matching contacts")
+		}
+	} else {
+		if err := b.lookupURNs(ctx, db, oa, imports); err != nil {
+			return false, errors.Wrap(err, "error looking up URNs")
+		}
+
+		if err := b.getOrCreateContacts(ctx, db, oa, imports); err != nil {
+			return false, errors.Wrap(err, "error getting and creating contacts")
+		}
 	}
 
-	// create our work data for each contact being created or updated
-	imports := make([]*importContact, len(specs))
-	for i := range imports {
-		imports[i] = &importContact{record: b.RecordStart + i, spec: specs[i]}
+	if err := b.applyModifiers(ctx, db, rp, oa, imports); err != nil {
+		return true, errors.Wrap(err, "error applying modifiers")
 	}
 
-	if err := b.getOrCreateContacts(ctx, db, oa, imports); err != nil {
-		return errors.Wrap(err, "error getting and creating contacts")
+	return true, nil
+}
+
+// records that the passed in imports weren't finished because we ran out of time before their modifiers could be
+// applied. Contacts which were created still count as created, but found contacts weren't updated.
+func timeOutUnappliedImports(imports []*importContact) {
+	for _, imp := range imports {
+		if imp.contact != nil {
+			imp.addError("Unable to update contact as the import timed out")
+			if !imp.created {
+				imp.contact = nil
+			}
+		} else if len(imp.errors) == 0 && !imp.skipped {
+			imp.addError("Unable to import contact as the import timed out")
+		}
 	}
+}
 
-	// gather up contacts and modifiers
-	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(imports))
+// applies the modifiers of each import to its contact. Contacts are locked so that they're not in flows or other
+// imports at the same time, in batches like flow starts so that we can't deadlock with them, and are reloaded once
+// locked so that modifiers are applied to their current state.
+func (b *ContactImportBatch) applyModifiers(ctx context.Context, db *sqlx.DB, rp *redis.Pool, oa *OrgAssets, imports []*importContact) error {
+	// gather up contacts and modifiers, ignoring errored imports which couldn't get/create a contact
+	importsByContact := make(map[ContactID][]*importContact, len(imports))
+	remaining := make([]ContactID, 0, len(imports))
 	for _, imp := range imports {
-		// ignore errored imports which couldn't get/create a contact
 		if imp.contact != nil {
-			modifiersByContact[imp.flowContact] = imp.mods
+			if importsByContact[imp.contact.ID()] == nil {
+				remaining = append(remaining, imp.contact.ID())
+			}
+			importsByContact[imp.contact.ID()] = append(importsByContact[imp.contact.ID()], imp)
+		}
+	}
+
+	start := time.Now()
+
+	for len(remaining) > 0 && time.Since(start) < time.Minute*5 && ctx.Err() == nil {
+		locks, skipped, err := LockContacts(rp, oa.OrgID(), remaining, time.Second)
+		if err != nil {
+			return err
+		}
+
+		err = applyLockedModifiers(ctx, db, oa, locks.ContactIDs(), importsByContact, b.FieldMerge == ContactImportFieldMergeBlanksOnly)
+
+		locks.Release()
+
+		// modifiers are applied in a transaction, so if we ran out of time none of these contacts were updated
+		if err != nil && ctx.Err() != nil {
+			remaining = append(locks.ContactIDs(), skipped...)
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		remaining = skipped
+	}
+
+	// contacts we never got locks for, or didn't get to before running out of time, haven't been updated
+	reason := "Unable to update contact as it was busy"
+	if ctx.Err() != nil {
+		reason = "Unable to update contact as the import timed out"
+	}
+	for _, contactID := range remaining {
+		for _, imp := range importsByContact[contactID] {
+			imp.addError(reason)
+			imp.contact = nil
 		}
 	}
 
-	// and apply in bulk
+	return nil
+}
+
+// reloads the passed in locked contacts and applies the modifiers of their imports in bulk. If blanksOnly is set, field
+// values are only set for fields which the reloaded contact doesn't already have a value for.
+func applyLockedModifiers(ctx context.Context, db *sqlx.DB, oa *OrgAssets, contactIDs []ContactID, importsByContact map[ContactID][]*importContact, blanksOnly bool) error {
+	contacts, err := LoadContacts(ctx, db, oa, contactIDs)
+	if err != nil {
+		return errors.Wrap(err, "error loading locked contacts")
+	}
+
+	modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+	for _, c := range contacts {
+		flowContact, err := c.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact for %d", c.ID())
+		}
+
+		// if a contact is in more than one record, its records are applied in order
+		mods := make([]flows.Modifier, 0, 5)
+		for _, imp := range importsByContact[c.ID()] {
+			for _, mod := range imp.mods {
+				if key, isField := imp.fieldMods[mod]; isField && blanksOnly && hasFieldValue(oa, flowContact, key) {
+					continue
+				}
+				mods = append(mods, mod)
+			}
+		}
+		modifiersByContact[flowContact] = mods
+	}
+
 	_, err = ApplyModifiers(ctx, db, nil, oa, modifiersByContact)
+	return err
+}
+
+// whether the given contact has a non-empty value for the field with the given key
+func hasFieldValue(oa *OrgAssets, contact *flows.Contact, key string) bool {
+	fv := contact.Fields()[key]
+	return fv != nil && types.Render(fv.ToXValue(oa.Env())) != ""
+}
+
+func (b *ContactImportBatch) tryPreview(ctx context.Context, db *sqlx.DB, orgID OrgID) error {
+	if err := b.markProcessing(ctx, db); err != nil {
+		return errors.Wrap(err, "error marking as processing")
+	}
+
+	oa, err := GetOrgAssetsWithRefresh(ctx, db, orgID, RefreshFields|RefreshGroups)
 	if err != nil {
-		return errors.Wrap(err, "error applying modifiers")
+		return errors.Wrap(err, "error loading org assets")
+	}
+
+	imports, err := b.loadImports()
+	if err != nil {
+		return err
+	}
+
+	// matching contacts doesn't change anything so previews of group imports can do it for real
+	if b.Mode == ContactImportModeGroupsOnly {
+		if err := b.matchContacts(ctx, db, oa, imports); err != nil {
+			return errors.Wrap(err, "error matching contacts")
+		}
+	} else {
+		if err := previewContacts(ctx, db, oa, imports); err != nil {
+			return errors.Wrap(err, "error previewing contacts")
+		}
+		b.previewSkips(imports)
 	}
 
 	if err := b.markComplete(ctx, db, imports); err != nil {
@@ -125,28 +394,70 @@ func (b *ContactImportBatch) tryImport(ctx context.Context, db *sqlx.DB, orgID O
 	return nil
 }
 
+// skips previewed imports which would create or update contacts when this batch's mode doesn't allow that
+func (b *ContactImportBatch) previewSkips(imports []*importContact) {
+	for _, imp := range imports {
+		if imp.created && b.Mode == ContactImportModeUpdateOnly {
+			imp.created = false
+			imp.skip("Skipped as no contact has URNs %s", joinURNs(importIdentities(imp.spec)))
+		} else if imp.updated && b.Mode == ContactImportModeCreateOnly {
+			imp.updated = false
+			imp.skip("Skipped as contact already exists")
+		}
+	}
+}
+
+// unmarshals this batch's specs and creates our work data for each contact being created or updated
+func (b *ContactImportBatch) loadImports() ([]*importContact, error) {
+	var specs []*ContactSpec
+	if err := jsonx.Unmarshal(b.Specs, &specs); err != nil {
+		return nil, errors.Wrap(err, "error unmarsaling specs")
+	}
+	return newImportContacts(specs, b.RecordStart), nil
+}
+
 // for each import, fetches or creates the contact, creates the modifiers needed to set fields etc
 func (b *ContactImportBatch) getOrCreateContacts(ctx context.Context, db QueryerWithTx, oa *OrgAssets, imports []*importContact) error {
-	sa := oa.SessionAssets()
-
 	// build map of UUIDs to contacts
-	contactsByUUID, err := b.loadContactsByUUID(ctx, db, oa, imports)
+	contactsByUUID, err := loadImportContactsByUUID(ctx, db, oa, imports)
 	if err != nil {
 		return errors.Wrap(err, "error loading contacts by UUID")
 	}
 
+	// the first record in this batch to have each contact UUID or URN identity, so we can report duplicates
+	recordsByUUID := make(map[flows.ContactUUID]int, len(imports))
+	recordsByURN := make(map[urns.URN]int, len(imports))
+
 	for _, imp := range imports {
-		addModifier := func(m flows.Modifier) { imp.mods = append(imp.mods, m) }
-		addError := func(s string, args ...interface{}) { imp.errors = append(imp.errors, fmt.Sprintf(s, args...)) }
 		spec := imp.spec
 
+		// if we've run out of time, the remaining records are left for the batch to be marked as timed out
+		if ctx.Err() != nil {
+			imp.addError("Unable to import contact as the import timed out")
+			continue
+		}
+
+		// all of this contact's URNs were rejected by lookup
+		if spec.UUID == "" && len(spec.URNs) == 0 && len(imp.errors) > 0 {
+			continue
+		}
+
 		uuid := spec.UUID
 		if uuid != "" {
 			imp.contact = contactsByUUID[uuid]
 			if imp.contact == nil {
-				addError("Unable to find contact with UUID '%s'", uuid)
+				imp.addError("Unable to find contact with UUID '%s'", uuid)
 				continue
 			}
+			if b.Mode == ContactImportModeCreateOnly {
+				imp.skip("Skipped as contact with UUID '%s' already exists", uuid)
+				continue
+			}
+			if record, seen := recordsByUUID[uuid]; seen {
+				imp.addError("Contact with UUID '%s' is also in record %d", uuid, record)
+			} else {
+				recordsByUUID[uuid] = imp.record
+			}
 
 			imp.flowContact, err = imp.contact.FlowContact(oa)
 			if err != nil {
@@ -154,60 +465,329 @@ func (b *ContactImportBatch) getOrCreateContacts(ctx context.Context, db Queryer
 			}
 
 		} else {
+			if b.Mode == ContactImportModeUpdateOnly {
+				exists, err := urnsHaveOwner(ctx, db, oa, spec.URNs)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					imp.skip("Skipped as no contact has URNs %s", joinURNs(importIdentities(spec)))
+					continue
+				}
+			}
+
 			imp.contact, imp.flowContact, imp.created, err = GetOrCreateContact(ctx, db, oa, spec.URNs, NilChannelID)
 			if err != nil {
-				urnStrs := make([]string, len(spec.URNs))
-				for i := range spec.URNs {
-					urnStrs[i] = string(spec.URNs[i].Identity())
-				}
+				imp.addError("Unable to find or create contact with URNs %s", joinURNs(importIdentities(spec)))
+				continue
+			}
 
-				addError("Unable to find or create contact with URNs %s", strings.Join(urnStrs, ", "))
+			// checked after the fact so that contacts created by others in the meantime are still skipped
+			if b.Mode == ContactImportModeCreateOnly && !imp.created {
+				imp.skip("Skipped as contact with URNs %s already exists", joinURNs(importIdentities(spec)))
 				continue
 			}
+
+			// later records with the same URNs update the same contact, which is probably a mistake in the file
+			for _, urn := range spec.URNs {
+				identity := urn.Identity()
+				if record, seen := recordsByURN[identity]; seen {
+					imp.addError("Contact with URN '%s' is also in record %d", identity, record)
+				} else {
+					recordsByURN[identity] = imp.record
+				}
+			}
 		}
 
-		addModifier(modifiers.NewURNs(spec.URNs, modifiers.URNsAppend))
+		imp.mods = importModifiers(oa, imp)
+	}
+
+	return nil
+}
+
+// whether any of the given URNs belong to an existing contact. Invalid URNs are left for GetOrCreateContact to reject.
+func urnsHaveOwner(ctx context.Context, db Queryer, oa *OrgAssets, urnz []urns.URN) (bool, error) {
+	normalized := make([]urns.URN, len(urnz))
+	for i, urn := range urnz {
+		normalized[i] = urn.Normalize(string(oa.Env().DefaultCountry()))
+	}
+
+	owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), normalized)
+	if err != nil {
+		return false, errors.Wrap(err, "error looking up contacts for URNs")
+	}
+	return len(uniqueContactIDs(owners)) > 0, nil
+}
 
-		if spec.Name != nil {
-			addModifier(modifiers.NewName(*spec.Name))
+// for each import, finds the existing contact which owns its URNs, and creates the modifier needed to add it to the
+// groups in its spec. Contacts are never created and the rest of the spec is ignored.
+func (b *ContactImportBatch) matchContacts(ctx context.Context, db Queryer, oa *OrgAssets, imports []*importContact) error {
+	// like GetOrCreateContact, ensure all URNs are normalized, and then reject records with any that are invalid
+	allURNs := make([]urns.URN, 0, len(imports))
+	valid := make([]*importContact, 0, len(imports))
+
+	for _, imp := range imports {
+		spec := imp.spec
+		if len(spec.URNs) == 0 {
+			imp.addError("No URNs to match a contact with")
+			continue
 		}
-		if spec.Language != nil {
-			lang, err := envs.ParseLanguage(*spec.Language)
-			if err != nil {
-				addError("'%s' is not a valid language code", *spec.Language)
-			} else {
-				addModifier(modifiers.NewLanguage(lang))
-			}
+
+		invalid := false
+		for i, urn := range spec.URNs {
+			spec.URNs[i] = urn.Normalize(string(oa.Env().DefaultCountry()))
+			invalid = invalid || spec.URNs[i].Validate() != nil
 		}
+		if invalid {
+			imp.addError("Unable to find contact with URNs %s", joinURNs(importIdentities(spec)))
+			continue
+		}
+
+		allURNs = append(allURNs, spec.URNs...)
+		valid = append(valid, imp)
+	}
+
+	// look up the owners of all URNs in one go
+	owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), allURNs)
+	if err != nil {
+		return errors.Wrap(err, "error looking up contacts for URNs")
+	}
+
+	contactIDs := make([]ContactID, 0, len(valid))
+	matched := make(map[*importContact]ContactID, len(valid))
+
+	for _, imp := range valid {
+		recordOwners := make(map[urns.URN]ContactID, len(imp.spec.URNs))
+		for _, urn := range imp.spec.URNs {
+			recordOwners[urn] = owners[urn]
+		}
+
+		ownerIDs := uniqueContactIDs(recordOwners)
+		if len(ownerIDs) == 0 {
+			imp.addError("No contact found with URNs %s", joinURNs(importIdentities(imp.spec)))
+		} else if len(ownerIDs) > 1 {
+			imp.addError("URNs %s belong to different contacts", joinURNs(importIdentities(imp.spec)))
+		} else {
+			matched[imp] = ownerIDs[0]
+			contactIDs = append(contactIDs, ownerIDs[0])
+		}
+	}
+
+	contacts, err := LoadContacts(ctx, db, oa, contactIDs)
+	if err != nil {
+		return errors.Wrap(err, "error loading matched contacts")
+	}
+
+	contactsByID := make(map[ContactID]*Contact, len(contacts))
+	for _, c := range contacts {
+		contactsByID[c.ID()] = c
+	}
 
-		for key, value := range spec.Fields {
-			field := sa.Fields().Get(key)
-			if field == nil {
-				addError("'%s' is not a valid contact field key", key)
+	for imp, contactID := range matched {
+		imp.contact = contactsByID[contactID]
+		if imp.contact == nil {
+			continue
+		}
+
+		imp.flowContact, err = imp.contact.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact for %d", imp.contact.ID())
+		}
+
+		imp.mods = []flows.Modifier{importGroupsModifier(oa, imp)}
+	}
+
+	return nil
+}
+
+// for each import, works out whether the contact would be created or updated, without creating or updating anything.
+// We don't use the org's lookup service as that writes HTTP logs and may cost the org money.
+func previewContacts(ctx context.Context, db Queryer, oa *OrgAssets, imports []*importContact) error {
+	contactsByUUID, err := loadImportContactsByUUID(ctx, db, oa, imports)
+	if err != nil {
+		return errors.Wrap(err, "error loading contacts by UUID")
+	}
+
+	// the first record in this batch to have each contact UUID or URN identity, so we can spot duplicates
+	recordsByUUID := make(map[flows.ContactUUID]int, len(imports))
+	recordsByURN := make(map[urns.URN]int, len(imports))
+
+	// the URN identities of contacts which would be created, as later records with those URNs would update them
+	newByURN := make(map[urns.URN]bool, len(imports))
+
+	for _, imp := range imports {
+		spec := imp.spec
+
+		if spec.UUID != "" {
+			if contactsByUUID[spec.UUID] == nil {
+				imp.addError("Unable to find contact with UUID '%s'", spec.UUID)
+				continue
+			}
+			if record, seen := recordsByUUID[spec.UUID]; seen {
+				imp.addError("Contact with UUID '%s' is also in record %d", spec.UUID, record)
 			} else {
-				addModifier(modifiers.NewField(field, value))
+				recordsByUUID[spec.UUID] = imp.record
+			}
+			imp.updated = true
+
+		} else {
+			// like GetOrCreateContact, ensure all URNs are normalized, and then fail if any are invalid
+			identities := make([]urns.URN, len(spec.URNs))
+			invalid := false
+			for i, urn := range spec.URNs {
+				spec.URNs[i] = urn.Normalize(string(oa.Env().DefaultCountry()))
+				identities[i] = spec.URNs[i].Identity()
+				invalid = invalid || spec.URNs[i].Validate() != nil
+			}
+			if invalid {
+				imp.addError("Unable to find or create contact with URNs %s", joinURNs(identities))
+				continue
 			}
-		}
 
-		if len(spec.Groups) > 0 {
-			groups := make([]*flows.Group, 0, len(spec.Groups))
-			for _, uuid := range spec.Groups {
-				group := sa.Groups().Get(uuid)
-				if group == nil {
-					addError("'%s' is not a valid contact group UUID", uuid)
+			owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), spec.URNs)
+			if err != nil {
+				return errors.Wrap(err, "error looking up contacts for URNs")
+			}
+			ownerIDs := uniqueContactIDs(owners)
+			if len(ownerIDs) > 1 {
+				imp.addError("Unable to find or create contact with URNs %s", joinURNs(identities))
+				continue
+			}
+
+			alreadyNew := false
+			for _, identity := range identities {
+				if record, seen := recordsByURN[identity]; seen {
+					imp.addError("Contact with URN '%s' is also in record %d", identity, record)
 				} else {
-					groups = append(groups, group)
+					recordsByURN[identity] = imp.record
+				}
+				alreadyNew = alreadyNew || newByURN[identity]
+			}
+
+			if len(ownerIDs) == 1 || alreadyNew {
+				imp.updated = true
+			} else {
+				imp.created = true
+				for _, identity := range identities {
+					newByURN[identity] = true
 				}
 			}
-			addModifier(modifiers.NewGroups(groups, modifiers.GroupsAdd))
 		}
+
+		// validates languages, fields and groups
+		importModifiers(oa, imp)
 	}
 
 	return nil
 }
 
+// creates the modifiers needed to set the URNs, name, language, fields and groups of an imported contact
+func importModifiers(oa *OrgAssets, imp *importContact) []flows.Modifier {
+	sa := oa.SessionAssets()
+	spec := imp.spec
+	mods := make([]flows.Modifier, 0, 5)
+
+	mods = append(mods, modifiers.NewURNs(spec.URNs, modifiers.URNsAppend))
+
+	if spec.Name != nil {
+		mods = append(mods, modifiers.NewName(*spec.Name))
+	}
+	if spec.Language != nil {
+		lang, err := envs.ParseLanguage(*spec.Language)
+		if err != nil {
+			imp.addError("'%s' is not a valid language code", *spec.Language)
+		} else {
+			mods = append(mods, modifiers.NewLanguage(lang))
+		}
+	}
+
+	for key, value := range spec.Fields {
+		field := sa.Fields().Get(key)
+		if field == nil {
+			imp.addError("'%s' is not a valid contact field key", key)
+		} else {
+			// values which aren't valid dates are still saved as text, but probably weren't meant to be
+			if field.Type() == assets.FieldTypeDatetime && strings.TrimSpace(value) != "" {
+				if _, err := envs.DateTimeFromString(oa.Env(), value, false); err != nil {
+					imp.addError("'%s' is not a valid date for field '%s'", value, key)
+				}
+			}
+			mod := modifiers.NewField(field, value)
+			if imp.fieldMods == nil {
+				imp.fieldMods = make(map[flows.Modifier]string, len(spec.Fields))
+			}
+			imp.fieldMods[mod] = key
+			mods = append(mods, mod)
+		}
+	}
+
+	if len(spec.Groups) > 0 {
+		mods = append(mods, importGroupsModifier(oa, imp))
+	}
+
+	return mods
+}
+
+// creates the modifier needed to add an imported contact to the groups in its spec
+func importGroupsModifier(oa *OrgAssets, imp *importContact) flows.Modifier {
+	groups := make([]*flows.Group, 0, len(imp.spec.Groups))
+	for _, uuid := range imp.spec.Groups {
+		group := oa.SessionAssets().Groups().Get(uuid)
+		if group == nil {
+			imp.addError("'%s' is not a valid contact group UUID", uuid)
+		} else {
+			groups = append(groups, group)
+		}
+	}
+	return modifiers.NewGroups(groups, modifiers.GroupsAdd)
+}
+
+// gets the URN identities of an imported contact for error messages
+func importIdentities(spec *ContactSpec) []urns.URN {
+	identities := make([]urns.URN, len(spec.URNs))
+	for i := range spec.URNs {
+		identities[i] = spec.URNs[i].Identity()
+	}
+	return identities
+}
+
+func joinURNs(urnz []urns.URN) string {
+	urnStrs := make([]string, len(urnz))
+	for i := range urnz {
+		urnStrs[i] = string(urnz[i])
+	}
+	return strings.Join(urnStrs, ", ")
+}
+
+// if the org has a lookup service, validates and normalizes the phone numbers of all the contacts being imported
+func (b *ContactImportBatch) lookupURNs(ctx context.Context, db Queryer, oa *OrgAssets, imports []*importContact) error {
+	httpClient, httpRetries, _ := goflow.HTTP(config.Mailroom)
+
+	svc, err := oa.Org().LookupService(httpClient, httpRetries)
+	if err != nil {
+		return errors.Wrap(err, "error creating lookup service")
+	}
+	if svc == nil {
+		return nil
+	}
+
+	specs := make([]*ContactSpec, len(imports))
+	for i := range imports {
+		specs[i] = imports[i].spec
+	}
+
+	logger := &HTTPLogger{}
+	specErrors := LookupContactSpecs(oa, svc, specs, logger.PhoneLookup(oa.OrgID()))
+
+	for i, errs := range specErrors {
+		imports[i].errors = append(imports[i].errors, errs...)
+	}
+
+	return logger.Insert(ctx, db)
+}
+
 // loads any import contacts for which we have UUIDs
-func (b *ContactImportBatch) loadContactsByUUID(ctx context.Context, db Queryer, oa *OrgAssets, imports []*importContact) (map[flows.ContactUUID]*Contact, error) {
+func loadImportContactsByUUID(ctx context.Context, db Queryer, oa *OrgAssets, imports []*importContact) (map[flows.ContactUUID]*Contact, error) {
 	uuids := make([]flows.ContactUUID, 0, 50)
 	for _, imp := range imports {
 		if imp.spec.UUID != "" {
@@ -235,33 +815,28 @@ func (b *ContactImportBatch) markProcessing(ctx context.Context, db Queryer) err
 }
 
 func (b *ContactImportBatch) markComplete(ctx context.Context, db Queryer, imports []*importContact) error {
-	numCreated := 0
-	numUpdated := 0
-	numErrored := 0
-	importErrors := make([]importError, 0, 10)
-	for _, imp := range imports {
-		if imp.contact == nil {
-			numErrored++
-		} else if imp.created {
-			numCreated++
-		} else {
-			numUpdated++
-		}
-		for _, e := range imp.errors {
-			importErrors = append(importErrors, importError{Record: imp.record, Message: e})
-		}
-	}
+	return b.markFinished(ctx, db, ContactImportStatusComplete, imports)
+}
+
+// marks this batch as timed out, recording the results of the records which were imported before it ran out of time
+func (b *ContactImportBatch) markTimedOut(ctx context.Context, db Queryer, imports []*importContact) error {
+	return b.markFinished(ctx, db, ContactImportStatusTimedOut, imports)
+}
 
-	errorsJSON, err := jsonx.Marshal(importErrors)
+func (b *ContactImportBatch) markFinished(ctx context.Context, db Queryer, status ContactImportStatus, imports []*importContact) error {
+	results := summarizeImports(imports)
+
+	errorsJSON, err := jsonx.Marshal(results.Errors)
 	if err != nil {
 		return errors.Wrap(err, "error marshaling errors")
 	}
 
 	now := dates.Now()
-	b.Status = ContactImportStatusComplete
-	b.NumCreated = numCreated
-	b.NumUpdated = numUpdated
-	b.NumErrored = numErrored
+	b.Status = status
+	b.NumCreated = results.NumCreated
+	b.NumUpdated = results.NumUpdated
+	b.NumSkipped = results.NumSkipped
+	b.NumErrored = results.NumErrored
 	b.Errors = errorsJSON
 	b.FinishedOn = &now
 	_, err = db.NamedExecContext(ctx,
@@ -271,6 +846,7 @@ func (b *ContactImportBatch) markComplete(ctx context.Context, db Queryer, impor
 			status = :status, 
 			num_created = :num_created, 
 			num_updated = :num_updated, 
+			num_skipped = :num_skipped, 
 			num_errored = :num_errored, 
 			errors = :errors, 
 			finished_on = :finished_on 
@@ -281,6 +857,28 @@ func (b *ContactImportBatch) markComplete(ctx context.Context, db Queryer, impor
 	return err
 }
 
+// counts the contacts which were, or would be, created, updated or skipped, and those which couldn't be imported
+func summarizeImports(imports []*importContact) *ContactImportResults {
+	results := &ContactImportResults{Errors: make([]*ContactImportError, 0, 10)}
+
+	for _, imp := range imports {
+		if imp.created {
+			results.NumCreated++
+		} else if imp.contact != nil || imp.updated {
+			results.NumUpdated++
+		} else if imp.skipped {
+			results.NumSkipped++
+		} else {
+			results.NumErrored++
+		}
+		for _, e := range imp.errors {
+			results.Errors = append(results.Errors, &ContactImportError{Record: imp.record, Message: e})
+		}
+	}
+
+	return results
+}
+
 func (b *ContactImportBatch) markFailed(ctx context.Context, db Queryer) error {
 	now := dates.Now()
 	b.Status = ContactImportStatusFailed
@@ -289,18 +887,71 @@ func (b *ContactImportBatch) markFailed(ctx context.Context, db Queryer) error {
 	return err
 }
 
+const claimContactImportErrorReportSQL = `
+UPDATE
+	contacts_contactimport
+SET
+	error_report = ''
+WHERE
+	id = $1 AND
+	error_report IS NULL AND
+	NOT EXISTS (SELECT 1 FROM contacts_contactimportbatch WHERE contact_import_id = $1 AND status IN ('P', 'O'))
+RETURNING
+	id`
+
+// ClaimContactImportErrorReport returns whether every batch of the given import has finished and the caller is the
+// first to find that out, and so should generate its error report
+func ClaimContactImportErrorReport(ctx context.Context, db Queryer, importID ContactImportID) (bool, error) {
+	rows, err := db.QueryxContext(ctx, claimContactImportErrorReportSQL, importID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error claiming error report for contact import %d", importID)
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
+
+const selectContactImportErrorsSQL = `
+SELECT
+	(e->>'record')::int AS record,
+	e->>'message' AS message
+FROM
+	contacts_contactimportbatch b,
+	jsonb_array_elements(b.errors::jsonb) e
+WHERE
+	b.contact_import_id = $1
+ORDER BY
+	record ASC`
+
+// LoadContactImportErrors loads the errors of all the batches of the given import, ordered by record
+func LoadContactImportErrors(ctx context.Context, db Queryer, importID ContactImportID) ([]*ContactImportError, error) {
+	errs := make([]*ContactImportError, 0, 10)
+	err := db.SelectContext(ctx, &errs, selectContactImportErrorsSQL, importID)
+	return errs, errors.Wrapf(err, "error loading errors for contact import %d", importID)
+}
+
+// SetContactImportErrorReport sets the URL of the given import's error report
+func SetContactImportErrorReport(ctx context.Context, db Queryer, importID ContactImportID, url string) error {
+	_, err := db.ExecContext(ctx, `UPDATE contacts_contactimport SET error_report = $2 WHERE id = $1`, importID, url)
+	return errors.Wrapf(err, "error setting error report for contact import %d", importID)
+}
+
 var loadContactImportBatchSQL = `
 SELECT 
-	id,
-  	contact_import_id,
-  	status,
-  	specs,
-  	record_start,
-  	record_end
+	b.id,
+  	b.contact_import_id,
+  	i.mode,
+  	i.field_merge,
+  	b.status,
+  	b.specs,
+  	b.record_start,
+  	b.record_end
 FROM
-	contacts_contactimportbatch
+	contacts_contactimportbatch b
+INNER JOIN
+	contacts_contactimport i ON i.id = b.contact_import_id
 WHERE
-	id = $1`
+	b.id = $1`
 
 // LoadContactImportBatch loads a contact import batch by ID
 func LoadContactImportBatch(ctx context.Context, db Queryer, id ContactImportBatchID) (*ContactImportBatch, error) {
@@ -321,9 +972,3 @@ type ContactSpec struct {
 	Fields   map[string]string  `json:"fields"`
 	Groups   []assets.GroupUUID `json:"groups"`
 }
-
-// an error message associated with a particular record
-type importError struct {
-	Record  int    `json:"record"`
-	Message string `json:"message"`
-}
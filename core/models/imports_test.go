@@ -3,10 +3,12 @@ package models_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/urns"
@@ -21,6 +23,9 @@ import (
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,7 +75,7 @@ func TestContactImports(t *testing.T) {
 		batch, err := models.LoadContactImportBatch(ctx, db, batchID)
 		require.NoError(t, err)
 
-		err = batch.Import(ctx, db, testdata.Org1.ID)
+		err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
 		require.NoError(t, err)
 
 		results := &struct {
@@ -161,12 +166,273 @@ func TestContactImportBatch(t *testing.T) {
 	assert.Equal(t, 0, batch.RecordStart)
 	assert.Equal(t, 2, batch.RecordEnd)
 
-	err = batch.Import(ctx, db, testdata.Org1.ID)
+	err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
 	require.NoError(t, err)
 
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE status = 'C' AND finished_on IS NOT NULL`, []interface{}{}, 1)
 }
 
+func TestContactImportBatchErrors(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Norbert", "urns": ["tel:+16055740001"], "fields": {"joined": "2020-01-01T10:45:30Z"}},
+		{"name": "Leah", "urns": ["tel:+16055740002"], "fields": {"joined": "last tuesday"}},
+		{"name": "Norbert", "urns": ["tel:+16055740001"]}
+	]`))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+
+	// there's still a pending batch so the import isn't finished
+	claimed, err := models.ClaimContactImportErrorReport(ctx, db, importID)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// contacts with errors are still imported
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 2 AND num_updated = 1 AND num_errored = 0`, []interface{}{batchID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 1, Message: "'last tuesday' is not a valid date for field 'joined'"},
+		{Record: 2, Message: "Contact with URN 'tel:+16055740001' is also in record 0"},
+	}, errs)
+
+	// only one caller gets to generate the error report
+	claimed, err = models.ClaimContactImportErrorReport(ctx, db, importID)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = models.ClaimContactImportErrorReport(ctx, db, importID)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	err = models.SetContactImportErrorReport(ctx, db, importID, "https://example.com/errors.csv")
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimport WHERE id = $1 AND error_report = 'https://example.com/errors.csv'`, []interface{}{importID}, 1)
+}
+
+func TestContactImportBatchGroupsOnly(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	db.MustExec(`UPDATE contacts_contactimport SET mode = 'G' WHERE id = $1`, importID)
+
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Ignored", "urns": ["tel:+16055741111"], "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"]},
+		{"urns": ["tel:+16055742222"], "fields": {"age": "40"}, "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"]},
+		{"urns": ["tel:+16055749999"], "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"]},
+		{"urns": ["tel:+16055741111", "tel:+16055743333"], "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"]},
+		{"name": "Nobody", "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"]}
+	]`))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactImportModeGroupsOnly, batch.Mode)
+
+	err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 0 AND num_updated = 2 AND num_errored = 3`, []interface{}{batchID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 2, Message: "No contact found with URNs tel:+16055749999"},
+		{Record: 3, Message: "URNs tel:+16055741111, tel:+16055743333 belong to different contacts"},
+		{Record: 4, Message: "No URNs to match a contact with"},
+	}, errs)
+
+	// matched contacts are added to the group but nothing else about them changes
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = ANY($2)`, []interface{}{testdata.TestersGroup.ID, pq.Array([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Ignored' OR name = 'Nobody'`, nil, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND name = 'Cathy'`, []interface{}{testdata.Cathy.ID}, 1)
+}
+
+func TestContactImportBatchCreateOnly(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	db.MustExec(`UPDATE contacts_contactimport SET mode = 'C' WHERE id = $1`, importID)
+
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(fmt.Sprintf(`[
+		{"name": "Norbert", "urns": ["tel:+16055740001"]},
+		{"name": "Kathy", "urns": ["tel:+16055741111"]},
+		{"uuid": "%s", "name": "Robert"}
+	]`, testdata.Bob.UUID)))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactImportModeCreateOnly, batch.Mode)
+	assert.Equal(t, models.ContactImportFieldMergeOverwrite, batch.FieldMerge)
+
+	err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 1 AND num_updated = 0 AND num_skipped = 2 AND num_errored = 0`, []interface{}{batchID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 1, Message: "Skipped as contact with URNs tel:+16055741111 already exists"},
+		{Record: 2, Message: fmt.Sprintf("Skipped as contact with UUID '%s' already exists", testdata.Bob.UUID)},
+	}, errs)
+
+	// existing contacts are left as they were
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert'`, nil, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Kathy' OR name = 'Robert'`, nil, 0)
+}
+
+func TestContactImportBatchUpdateOnly(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	db.MustExec(`UPDATE contacts_contactimport SET mode = 'U', field_merge = 'B' WHERE id = $1`, importID)
+
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(fmt.Sprintf(`[
+		{"urns": ["tel:+16055741111"], "fields": {"gender": "M", "age": "40"}},
+		{"name": "Norbert", "urns": ["tel:+16055740001"]},
+		{"uuid": "%s", "name": "Robert"}
+	]`, testdata.Bob.UUID)))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactImportModeUpdateOnly, batch.Mode)
+	assert.Equal(t, models.ContactImportFieldMergeBlanksOnly, batch.FieldMerge)
+
+	err = batch.Import(ctx, db, testsuite.RP(), testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 0 AND num_updated = 2 AND num_skipped = 1 AND num_errored = 0`, []interface{}{batchID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 1, Message: "Skipped as no contact has URNs tel:+16055740001"},
+	}, errs)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert'`, nil, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND name = 'Robert'`, []interface{}{testdata.Bob.ID}, 1)
+
+	// Cathy's blank age field is set but her existing gender isn't overwritten
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshFields)
+	require.NoError(t, err)
+	contacts, err := models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+	cathy, err := contacts[0].FlowContact(oa)
+	require.NoError(t, err)
+
+	assert.Equal(t, "F", cathy.Fields()["gender"].QueryValue())
+	assert.Equal(t, decimal.RequireFromString("40"), cathy.Fields()["age"].QueryValue())
+}
+
+func TestContactImportBatchTimedOut(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+
+	// Cathy is busy for longer than the import has
+	locks, _, err := models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID}, time.Second)
+	require.NoError(t, err)
+	defer locks.Release()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Kathy", "urns": ["tel:+16055741111"]},
+		{"name": "Robert", "urns": ["tel:+16055742222"]}
+	]`))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+
+	importCtx, cancel := context.WithTimeout(ctx, time.Millisecond*1500)
+	defer cancel()
+
+	err = batch.Import(importCtx, db, rp, testdata.Org1.ID)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, models.ContactImportStatusTimedOut, batch.Status)
+
+	// Bob was updated before the import ran out of time, and that's recorded
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'T' AND num_updated = 1 AND num_errored = 1 AND finished_on IS NOT NULL`, []interface{}{batchID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND name = 'Robert'`, []interface{}{testdata.Bob.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND name = 'Cathy'`, []interface{}{testdata.Cathy.ID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 0, Message: "Unable to update contact as the import timed out"},
+	}, errs)
+}
+
+func TestContactImportBatchTimedOutBeforeModifiers(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[{"name": "Kathy", "urns": ["tel:+16055741111"]}]`))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+
+	// a batch whose context has already expired fails on its first query but is still marked as timed out
+	importCtx, cancel := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	err = batch.Import(importCtx, db, rp, testdata.Org1.ID)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, models.ContactImportStatusTimedOut, batch.Status)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'T' AND num_created = 0 AND num_updated = 0 AND num_errored = 1 AND finished_on IS NOT NULL`, []interface{}{batchID}, 1)
+
+	errs, err := models.LoadContactImportErrors(ctx, db, importID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.ContactImportError{
+		{Record: 0, Message: "Unable to import contact as the import timed out"},
+	}, errs)
+}
+
+func TestContactImportBatchPreview(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Norbert", "language": "eng", "urns": ["tel:+16055740001"]},
+		{"name": "Cathy", "urns": ["tel:+16055741111"]},
+		{"name": "Norbert", "language": "xxxx", "urns": ["tel:+16055740001"]}
+	]`))
+
+	batch, err := models.LoadContactImportBatch(ctx, db, batchID)
+	require.NoError(t, err)
+
+	err = batch.Preview(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assert.Equal(t, models.ContactImportStatusComplete, batch.Status)
+	assert.Equal(t, 1, batch.NumCreated)
+	assert.Equal(t, 2, batch.NumUpdated)
+	assert.Equal(t, 0, batch.NumErrored)
+	test.AssertEqualJSON(t, []byte(`[
+		{"record": 2, "message": "Contact with URN 'tel:+16055740001' is also in record 0"},
+		{"record": 2, "message": "'xxxx' is not a valid language code"}
+	]`), batch.Errors, "errors mismatch")
+
+	// nothing actually imported
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert'`, nil, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Cathy'`, nil, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 1 AND num_updated = 2`, []interface{}{batchID}, 1)
+}
+
 func TestContactSpecUnmarshal(t *testing.T) {
 	s := &models.ContactSpec{}
 	jsonx.Unmarshal([]byte(`{}`), s)
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const deleteLookupTableRowsSQL = `DELETE FROM orgs_lookuptablerow WHERE org_id = $1 AND table_name = $2`
+
+const insertLookupTableRowsSQL = `
+INSERT INTO orgs_lookuptablerow(org_id, table_name, key, data)
+     SELECT $1, $2, UNNEST($3::text[]), UNNEST($4::jsonb[])
+ON CONFLICT (org_id, table_name, key) DO UPDATE SET data = EXCLUDED.data
+`
+
+// ReplaceLookupTableRows replaces all the rows of the given uploaded lookup table, rows being keyed by their key
+func ReplaceLookupTableRows(ctx context.Context, tx *sqlx.Tx, orgID OrgID, name string, rows map[string]json.RawMessage) error {
+	if _, err := tx.ExecContext(ctx, deleteLookupTableRowsSQL, orgID, name); err != nil {
+		return errors.Wrapf(err, "error deleting rows of lookup table '%s'", name)
+	}
+
+	keys := make([]string, 0, len(rows))
+	data := make([]string, 0, len(rows))
+	for key, row := range rows {
+		keys = append(keys, key)
+		data = append(data, string(row))
+	}
+
+	if _, err := tx.ExecContext(ctx, insertLookupTableRowsSQL, orgID, name, pq.Array(keys), pq.Array(data)); err != nil {
+		return errors.Wrapf(err, "error inserting rows of lookup table '%s'", name)
+	}
+	return nil
+}
+
+const selectLookupTableRowSQL = `SELECT data FROM orgs_lookuptablerow WHERE org_id = $1 AND table_name = $2 AND key = $3`
+
+// GetLookupTableRow gets the row with the given key from an uploaded lookup table, returning nil if there is no match
+func GetLookupTableRow(ctx context.Context, db Queryer, orgID OrgID, name, key string) (json.RawMessage, error) {
+	var data json.RawMessage
+	err := db.GetContext(ctx, &data, selectLookupTableRowSQL, orgID, name, key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up key in lookup table '%s'", name)
+	}
+	return data, nil
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LookupResult is the result of looking up a phone number
+type LookupResult struct {
+	URN      urns.URN
+	Valid    bool
+	Carrier  string
+	LineType string
+}
+
+// LookupService is a service which can validate and normalize phone numbers
+type LookupService interface {
+	Lookup(urn urns.URN, logHTTP flows.HTTPLogCallback) (*LookupResult, error)
+}
+
+// LookupServiceFactory is a function which creates a lookup service from the org's lookup config
+type LookupServiceFactory func(httpClient *http.Client, httpRetries *httpx.RetryConfig, config map[string]string) (LookupService, error)
+
+var lookupServices = map[string]LookupServiceFactory{}
+
+// RegisterLookupService registers a new lookup service
+func RegisterLookupService(name string, factory LookupServiceFactory) {
+	lookupServices[name] = factory
+}
+
+// LookupServiceTypes returns the sorted types of the registered lookup services
+func LookupServiceTypes() []string {
+	types := make([]string, 0, len(lookupServices))
+	for t := range lookupServices {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// the maximum number of phone number lookups made at once
+const maxConcurrentLookups = 10
+
+// LookupContactSpecs looks up all the tel URNs in the passed in specs, replacing them with their normalized forms, removing
+// any which are invalid and setting carrier and line type fields if the org has configured those. The returned errors are
+// indexed by spec. Where the service itself fails, URNs are left as they are.
+func LookupContactSpecs(oa *OrgAssets, svc LookupService, specs []*ContactSpec, logHTTP flows.HTTPLogCallback) [][]string {
+	start := time.Now()
+	carrierKey, lineTypeKey := oa.Org().LookupFields()
+	specErrors := make([][]string, len(specs))
+
+	results := lookupURNs(oa, svc, specs, logHTTP)
+
+	for i, spec := range specs {
+		normalized := make([]urns.URN, 0, len(spec.URNs))
+
+		for _, urn := range spec.URNs {
+			if urn.Scheme() != urns.TelScheme {
+				normalized = append(normalized, urn)
+				continue
+			}
+
+			result := results[urn.Identity()]
+
+			if result == nil {
+				normalized = append(normalized, urn)
+			} else if !result.Valid {
+				specErrors[i] = append(specErrors[i], fmt.Sprintf("'%s' is not a valid phone number", urn.Path()))
+			} else {
+				normalized = append(normalized, result.URN)
+				setLookupField(oa, spec, carrierKey, result.Carrier)
+				setLookupField(oa, spec, lineTypeKey, result.LineType)
+			}
+		}
+
+		spec.URNs = normalized
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("org_id", oa.OrgID()).WithField("lookups", len(results)).Debug("looked up contact phone numbers")
+
+	return specErrors
+}
+
+// looks up the tel URNs in the passed in specs in parallel, returning the results by identity, which are nil where
+// the service failed
+func lookupURNs(oa *OrgAssets, svc LookupService, specs []*ContactSpec, logHTTP flows.HTTPLogCallback) map[urns.URN]*LookupResult {
+	// numbers are often repeated across a batch so only look each up once
+	results := make(map[urns.URN]*LookupResult)
+	unique := make([]urns.URN, 0, len(specs))
+	for _, spec := range specs {
+		for _, urn := range spec.URNs {
+			if _, seen := results[urn.Identity()]; urn.Scheme() == urns.TelScheme && !seen {
+				results[urn.Identity()] = nil
+				unique = append(unique, urn.Identity())
+			}
+		}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan bool, maxConcurrentLookups)
+
+	// the passed in callback doesn't have to be safe to call concurrently
+	syncedLogHTTP := func(l *flows.HTTPLog) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		logHTTP(l)
+	}
+
+	for _, urn := range unique {
+		wg.Add(1)
+		sem <- true
+
+		go func(urn urns.URN) {
+			defer func() { <-sem; wg.Done() }()
+
+			result, err := svc.Lookup(urn, syncedLogHTTP)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", oa.OrgID()).WithField("urn", urn).Warn("error looking up phone number")
+			}
+
+			mutex.Lock()
+			results[urn] = result
+			mutex.Unlock()
+		}(urn)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// sets a field value on a spec if the field exists and the spec doesn't already have a value for it
+func setLookupField(oa *OrgAssets, spec *ContactSpec, key, value string) {
+	if key == "" || value == "" || oa.FieldByKey(key) == nil {
+		return
+	}
+	if spec.Fields == nil {
+		spec.Fields = make(map[string]string)
+	}
+	if _, exists := spec.Fields[key]; !exists {
+		spec.Fields[key] = value
+	}
+}
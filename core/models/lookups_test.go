@@ -0,0 +1,85 @@
+package models_test
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testLookupService struct {
+	lookups int32
+}
+
+func (s *testLookupService) Lookup(urn urns.URN, logHTTP flows.HTTPLogCallback) (*models.LookupResult, error) {
+	atomic.AddInt32(&s.lookups, 1)
+
+	switch urn.Path() {
+	case "0788123123", "+250788123123":
+		return &models.LookupResult{URN: "tel:+250788123123", Valid: true, Carrier: "MTN", LineType: "mobile"}, nil
+	case "12345":
+		return &models.LookupResult{URN: urn, Valid: false}, nil
+	}
+	return nil, errors.New("boom")
+}
+
+func TestLookupContactSpecs(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"lookup_carrier_field": "gender", "lookup_line_type_field": "unknown"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	specs := []*models.ContactSpec{
+		{URNs: []urns.URN{"tel:0788123123", "twitter:bob"}},
+		{URNs: []urns.URN{"tel:12345"}},
+		{URNs: []urns.URN{"tel:+250788123123", "tel:0788123123"}, Fields: map[string]string{"gender": "F"}},
+		{URNs: []urns.URN{"tel:999"}},
+	}
+	svc := &testLookupService{}
+
+	specErrors := models.LookupContactSpecs(oa, svc, specs, func(*flows.HTTPLog) {})
+
+	assert.Equal(t, [][]string{nil, {"'12345' is not a valid phone number"}, nil, nil}, specErrors)
+	assert.Equal(t, int32(4), svc.lookups) // 0788123123 is only looked up once
+
+	assert.Equal(t, []urns.URN{"tel:+250788123123", "twitter:bob"}, specs[0].URNs)
+	assert.Equal(t, map[string]string{"gender": "MTN"}, specs[0].Fields)
+	assert.Equal(t, []urns.URN{}, specs[1].URNs)
+	assert.Equal(t, []urns.URN{"tel:+250788123123", "tel:+250788123123"}, specs[2].URNs)
+	assert.Equal(t, map[string]string{"gender": "F"}, specs[2].Fields) // existing values aren't overwritten
+	assert.Equal(t, []urns.URN{"tel:999"}, specs[3].URNs)              // service errors leave URN as is
+}
+
+func TestOrgLookupService(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	svc, err := oa.Org().LookupService(http.DefaultClient, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, svc)
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"lookup_service": "acme"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	_, err = oa.Org().LookupService(http.DefaultClient, nil)
+	assert.EqualError(t, err, "unrecognized lookup service type 'acme' for org: 1")
+}
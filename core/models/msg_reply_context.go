@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/pkg/errors"
+)
+
+// MsgReplyContext is what an incoming message was a reply to, for channels which tell us, e.g. one of our messages which
+// the contact quoted or a story which they replied to
+type MsgReplyContext struct {
+	MsgExternalID string `json:"msg_external_id,omitempty"`
+	StoryID       string `json:"story_id,omitempty"`
+	StoryURL      string `json:"story_url,omitempty"`
+}
+
+// reply context types
+const (
+	ReplyContextTypeMsg   = "msg"
+	ReplyContextTypeStory = "story"
+)
+
+const selectRepliedToMsgSQL = `
+SELECT
+	uuid,
+	text
+FROM
+	msgs_msg
+WHERE
+	channel_id = $1 AND
+	external_id = $2 AND
+	direction = 'O'
+ORDER BY
+	id DESC
+LIMIT 1`
+
+// ReplyContextParams builds the trigger params for an incoming message with the given reply context, looking up any
+// message of ours that was replied to so that flows can branch on it, e.g. @trigger.params.reply_to.text
+func ReplyContextParams(ctx context.Context, db Queryer, channelID ChannelID, rc *MsgReplyContext) (map[string]interface{}, error) {
+	var replyTo map[string]interface{}
+
+	if rc.MsgExternalID != "" {
+		replyTo = map[string]interface{}{"type": ReplyContextTypeMsg, "external_id": rc.MsgExternalID}
+
+		msg := &struct {
+			UUID flows.MsgUUID `db:"uuid"`
+			Text string        `db:"text"`
+		}{}
+		err := db.GetContext(ctx, msg, selectRepliedToMsgSQL, channelID, rc.MsgExternalID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "error looking up replied to msg with external id: %s", rc.MsgExternalID)
+		}
+
+		// the replied to message may not have been sent by us or may have been deleted
+		if err == nil {
+			replyTo["uuid"] = string(msg.UUID)
+			replyTo["text"] = msg.Text
+		}
+	} else if rc.StoryID != "" || rc.StoryURL != "" {
+		replyTo = map[string]interface{}{"type": ReplyContextTypeStory, "id": rc.StoryID, "url": rc.StoryURL}
+	} else {
+		return nil, nil
+	}
+
+	return map[string]interface{}{"reply_to": replyTo}, nil
+}
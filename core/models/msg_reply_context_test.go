@@ -0,0 +1,50 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyContextParams(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	out := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "Did you like the event?", nil)
+	db.MustExec(`UPDATE msgs_msg SET channel_id = $2, external_id = 'ext123' WHERE id = $1`, out.ID(), testdata.TwitterChannel.ID)
+
+	// a reply to one of our messages
+	params, err := models.ReplyContextParams(ctx, db, testdata.TwitterChannel.ID, &models.MsgReplyContext{MsgExternalID: "ext123"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"reply_to": map[string]interface{}{
+			"type":        "msg",
+			"external_id": "ext123",
+			"uuid":        string(out.UUID()),
+			"text":        "Did you like the event?",
+		},
+	}, params)
+
+	// a reply to a message we don't know about
+	params, err = models.ReplyContextParams(ctx, db, testdata.VonageChannel.ID, &models.MsgReplyContext{MsgExternalID: "ext123"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"reply_to": map[string]interface{}{"type": "msg", "external_id": "ext123"}}, params)
+
+	// a reply to a story
+	params, err = models.ReplyContextParams(ctx, db, testdata.TwitterChannel.ID, &models.MsgReplyContext{StoryID: "345", StoryURL: "https://stories.com/345"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"reply_to": map[string]interface{}{"type": "story", "id": "345", "url": "https://stories.com/345"},
+	}, params)
+
+	// an empty context isn't a reply to anything
+	params, err = models.ReplyContextParams(ctx, db, testdata.TwitterChannel.ID, &models.MsgReplyContext{})
+	require.NoError(t, err)
+	assert.Nil(t, params)
+}
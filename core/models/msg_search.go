@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the elastic index that message documents are kept in
+const msgsIndex = "msgs"
+
+// MsgDocument is how a message is represented in the search index
+type MsgDocument struct {
+	ID         MsgID         `json:"id"         db:"id"`
+	OrgID      OrgID         `json:"org_id"     db:"org_id"`
+	ContactID  ContactID     `json:"contact_id" db:"contact_id"`
+	ChannelID  ChannelID     `json:"channel_id" db:"channel_id"`
+	Direction  MsgDirection  `json:"direction"  db:"direction"`
+	Visibility MsgVisibility `json:"visibility" db:"visibility"`
+	Text       string        `json:"text"       db:"text"`
+	Labels     pq.Int64Array `json:"labels"     db:"labels"`
+	CreatedOn  time.Time     `json:"created_on" db:"created_on"`
+
+	FailedReason MsgFailedReason `json:"failed_reason,omitempty" db:"failed_reason"`
+}
+
+const selectMsgDocumentsSQL = `
+SELECT
+  m.id AS id,
+  m.org_id AS org_id,
+  m.contact_id AS contact_id,
+  m.channel_id AS channel_id,
+  m.direction AS direction,
+  m.visibility AS visibility,
+  m.text AS text,
+  ARRAY(SELECT l.label_id FROM msgs_msg_labels l WHERE l.msg_id = m.id ORDER BY l.label_id) AS labels,
+  m.created_on AS created_on,
+  COALESCE(m.metadata::jsonb->>'failed_reason', '') AS failed_reason
+FROM
+  msgs_msg m
+WHERE
+  m.id = ANY($1)
+`
+
+// IndexMsgs brings the search index documents of the passed in messages up to date with the database
+func IndexMsgs(ctx context.Context, db Queryer, client *elastic.Client, ids []MsgID) error {
+	if client == nil || len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryxContext(ctx, selectMsgDocumentsSQL, pq.Array(ids))
+	if err != nil {
+		return errors.Wrapf(err, "error selecting messages to index")
+	}
+	defer rows.Close()
+
+	bulk := client.Bulk()
+
+	for rows.Next() {
+		doc := &MsgDocument{}
+		if err := rows.StructScan(doc); err != nil {
+			return errors.Wrapf(err, "error scanning msg document")
+		}
+
+		routing := strconv.FormatInt(int64(doc.OrgID), 10)
+		bulk.Add(elastic.NewBulkIndexRequest().Index(msgsIndex).Id(strconv.FormatInt(int64(doc.ID), 10)).Routing(routing).Doc(doc))
+	}
+
+	// messages which no longer exist have nothing to index
+	if bulk.NumberOfActions() == 0 {
+		return nil
+	}
+
+	response, err := bulk.Do(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error indexing messages")
+	}
+	if failed := response.Failed(); len(failed) > 0 {
+		return errors.Errorf("error indexing %d messages: %s", len(failed), failed[0].Error.Reason)
+	}
+
+	return nil
+}
+
+// MsgSearch is a search of an org's messages, newest first. Deleted messages are never included.
+type MsgSearch struct {
+	Text       string
+	Direction  MsgDirection
+	LabelIDs   []LabelID
+	ContactIDs []ContactID
+	After      *time.Time
+	Before     *time.Time
+	Cursor     string
+	PageSize   int
+}
+
+// MsgSearchPage is a single page of message search results. NextCursor can be passed back to fetch the next page
+// and is empty when there are no more results.
+type MsgSearchPage struct {
+	IDs        []MsgID
+	Total      int64
+	NextCursor string
+}
+
+// SearchMsgs searches the messages of an org, paging through results with a cursor like SearchTickets
+func SearchMsgs(ctx context.Context, client *elastic.Client, orgID OrgID, search *MsgSearch) (*MsgSearchPage, error) {
+	start := time.Now()
+
+	if client == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	eq := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("org_id", orgID)).
+		MustNot(elastic.NewTermQuery("visibility", VisibilityDeleted))
+
+	if search.Text != "" {
+		eq = eq.Must(elastic.NewMatchQuery("text", search.Text).Operator("and"))
+	}
+	if search.Direction != "" {
+		eq = eq.Filter(elastic.NewTermQuery("direction", search.Direction))
+	}
+	if len(search.LabelIDs) > 0 {
+		labelIDs := make([]interface{}, len(search.LabelIDs))
+		for i, id := range search.LabelIDs {
+			labelIDs[i] = id
+		}
+		eq = eq.Filter(elastic.NewTermsQuery("labels", labelIDs...))
+	}
+	if len(search.ContactIDs) > 0 {
+		contactIDs := make([]interface{}, len(search.ContactIDs))
+		for i, id := range search.ContactIDs {
+			contactIDs[i] = id
+		}
+		eq = eq.Filter(elastic.NewTermsQuery("contact_id", contactIDs...))
+	}
+	if search.After != nil || search.Before != nil {
+		createdOn := elastic.NewRangeQuery("created_on")
+		if search.After != nil {
+			createdOn = createdOn.Gte(*search.After)
+		}
+		if search.Before != nil {
+			createdOn = createdOn.Lt(*search.Before)
+		}
+		eq = eq.Filter(createdOn)
+	}
+
+	s := client.Search(msgsIndex).
+		Routing(strconv.FormatInt(int64(orgID), 10)).
+		Query(eq).
+		SortBy(elastic.NewFieldSort("created_on").Desc(), elastic.NewFieldSort("id").Desc()).
+		Size(search.PageSize).
+		FetchSource(false).
+		TrackTotalHits(true)
+
+	if search.Cursor != "" {
+		after, err := decodeSearchCursor(search.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		s = s.SearchAfter(after...)
+	}
+
+	results, err := s.Do(ctx)
+	if err != nil {
+		ee, ok := err.(*elastic.Error)
+		if !ok {
+			return nil, errors.Wrapf(err, "error performing msg search")
+		}
+		return nil, errors.Wrapf(err, "error performing msg search: %s", ee.Details.Reason)
+	}
+
+	page := &MsgSearchPage{IDs: make([]MsgID, 0, len(results.Hits.Hits)), Total: results.TotalHits()}
+	for _, hit := range results.Hits.Hits {
+		id, err := strconv.ParseInt(hit.Id, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected non-integer msg id: %s", hit.Id)
+		}
+		page.IDs = append(page.IDs, MsgID(id))
+	}
+
+	if n := len(results.Hits.Hits); n > 0 && n == search.PageSize {
+		page.NextCursor, err = encodeSearchCursor(results.Hits.Hits[n-1].Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":  orgID,
+		"text":    search.Text,
+		"elapsed": time.Since(start),
+		"count":   len(page.IDs),
+		"total":   page.Total,
+	}).Debug("msg search complete")
+
+	return page, nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"encoding/json"
+	"unicode/utf16"
+
+	"github.com/nyaruka/gocommon/gsm7"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/null"
+)
+
+// MsgEncoding is the encoding a message is sent with as SMS
+type MsgEncoding string
+
+// SMS encodings
+const (
+	MsgEncodingGSM7 = MsgEncoding("gsm7")
+	MsgEncodingUCS2 = MsgEncoding("ucs2")
+)
+
+// UCS-2 messages fit 70 characters in a single segment, but only 67 in each part of a multipart message
+const (
+	ucs2SegmentSize      = 70
+	ucs2MultipartSegment = 67
+)
+
+// MsgSegments is how the text of a message is split into segments when sent as SMS, which is what it's charged by
+type MsgSegments struct {
+	Encoding MsgEncoding `json:"encoding"`
+	Count    int         `json:"count"`
+}
+
+// CalculateSegments calculates the encoding and number of segments needed to send the given text as SMS. Any
+// character outside of the GSM-7 alphabet means the whole message is sent as UCS-2.
+func CalculateSegments(text string) *MsgSegments {
+	if gsm7.IsValid(text) {
+		return &MsgSegments{Encoding: MsgEncodingGSM7, Count: gsm7.Segments(text)}
+	}
+
+	// UCS-2 lengths are in UTF-16 code units, so characters outside the BMP like most emoji count double
+	units := len(utf16.Encode([]rune(text)))
+	count := 1
+	if units > ucs2SegmentSize {
+		count = (units + ucs2MultipartSegment - 1) / ucs2MultipartSegment
+	}
+	return &MsgSegments{Encoding: MsgEncodingUCS2, Count: count}
+}
+
+// Segments returns how this message is segmented as SMS, or nil if it isn't being sent as SMS
+func (m *Msg) Segments() *MsgSegments {
+	switch s := m.m.Metadata.Map()["segments"].(type) {
+	case *MsgSegments:
+		return s
+	case map[string]interface{}:
+		// messages loaded from the database have their metadata as generic JSON
+		segments := &MsgSegments{}
+		b, _ := json.Marshal(s)
+		if err := json.Unmarshal(b, segments); err == nil {
+			return segments
+		}
+	}
+	return nil
+}
+
+// calculates the segments of this message if it's being sent as SMS, updating the msg count which SMS is charged by
+func (m *Msg) calculateSegments() {
+	if m.m.URN.Scheme() != urns.TelScheme {
+		return
+	}
+
+	segments := CalculateSegments(m.m.Text)
+	m.m.MsgCount = segments.Count + len(m.m.Attachments)
+
+	if m.m.Text == "" {
+		return
+	}
+
+	metadata := m.m.Metadata.Map()
+	if metadata == nil {
+		metadata = make(map[string]interface{}, 1)
+	}
+	metadata["segments"] = segments
+	m.m.Metadata = null.NewMap(metadata)
+}
@@ -0,0 +1,76 @@
+package models_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateSegments(t *testing.T) {
+	tcs := []struct {
+		text     string
+		expected *models.MsgSegments
+	}{
+		{"Hello world", &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}},
+		{strings.Repeat("a", 160), &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}},
+		{strings.Repeat("a", 161), &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 2}},
+		{"Hola, ¿cómo estás?", &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 1}},
+		{strings.Repeat("ü", 70), &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}},
+		{strings.Repeat("ó", 70), &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 1}},
+		{strings.Repeat("ó", 71), &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 2}},
+		{strings.Repeat("ó", 135), &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 3}},
+		{strings.Repeat("😀", 35), &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 1}},
+		{strings.Repeat("😀", 36), &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 2}},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, models.CalculateSegments(tc.text), "segments mismatch for '%s'", tc.text)
+	}
+}
+
+func TestMsgSegments(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+
+	out := flows.NewMsgOut(urn, channel.ChannelReference(), strings.Repeat("ó", 71), []utils.Attachment{"image/jpeg:https://foo.bar/1.jpg"}, nil, nil, flows.NilMsgTopic)
+	msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 2}, msg.Segments())
+	assert.Equal(t, 3, msg.MsgCount())
+
+	err = models.InsertMessages(ctx, db, []*models.Msg{msg})
+	require.NoError(t, err)
+
+	// segments are read back from the metadata of messages loaded from the database
+	msgs, err := models.LoadMessages(ctx, db, testdata.Org1.ID, models.DirectionOut, []models.MsgID{models.MsgID(msg.ID())})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 2}, msgs[0].Segments())
+
+	// messages which aren't sent as SMS don't have segments
+	out = flows.NewMsgOut(urns.URN(fmt.Sprintf("facebook:12345?id=%d", testdata.Cathy.URNID)), nil, "Hi there", nil, nil, nil, flows.NilMsgTopic)
+	msg, err = models.NewOutgoingMsg(oa.Org(), nil, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+
+	assert.Nil(t, msg.Segments())
+	assert.Equal(t, 1, msg.MsgCount())
+}
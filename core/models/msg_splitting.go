@@ -0,0 +1,181 @@
+package models
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/null"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the length long texts are split at on channels which split messages without configuring a length
+const defaultSplitLength = 640
+
+// the end of a sentence, i.e. closing punctuation followed by whitespace
+var sentenceEndRegex = regexp.MustCompile(`[.!?…。！？]+["'”’)\]]*\s`)
+
+// MsgSplitting is how a channel splits long outgoing texts into a bundle of messages instead of sending one message
+// which it might truncate, e.g.
+//
+//   {"split_messages": {"max_length": 320, "delay": 5}}
+//
+// Texts are split at paragraph, line, sentence or word boundaries, and the parts are sent in order, each the given number
+// of seconds after the previous. Delayed parts are queued by the same cron as messages delayed by channel warm-ups so
+// delays are rounded up to when that next runs.
+type MsgSplitting struct {
+	MaxLength int `json:"max_length"`
+	Delay     int `json:"delay"`
+}
+
+// Splitting returns how this channel splits long messages or nil if it doesn't
+func (c *Channel) Splitting() *MsgSplitting {
+	raw, found := c.c.Config[ChannelConfigSplitMessages]
+	if !found || raw == nil || raw == false {
+		return nil
+	}
+
+	splitting := &MsgSplitting{}
+
+	// can be configured as just true to split at the default length without delays
+	if raw != true {
+		b, err := json.Marshal(raw)
+		if err == nil {
+			err = json.Unmarshal(b, splitting)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", c.UUID()).Error("invalid channel split messages config")
+			return nil
+		}
+	}
+
+	if splitting.MaxLength <= 0 {
+		splitting.MaxLength = defaultSplitLength
+	}
+
+	// parts can't be longer than the channel will send
+	if constraints := c.Constraints(); constraints != nil && constraints.MaxLength > 0 && constraints.MaxLength < splitting.MaxLength {
+		splitting.MaxLength = constraints.MaxLength
+	}
+	return splitting
+}
+
+// SplitText splits the passed in text into parts which are no longer than the given length, preferring to split at the
+// end of paragraphs, then lines, then sentences and then words so that each part reads as a message of its own
+func SplitText(text string, maxLength int) []string {
+	text = strings.TrimSpace(text)
+	if maxLength <= 0 || utf8.RuneCountInString(text) <= maxLength {
+		return []string{text}
+	}
+
+	parts := make([]string, 0, 2)
+	for text != "" {
+		if utf8.RuneCountInString(text) <= maxLength {
+			parts = append(parts, text)
+			break
+		}
+
+		cut := splitPoint(text, maxLength)
+		parts = append(parts, strings.TrimSpace(text[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	return parts
+}
+
+// finds the byte offset to split the passed in text at so that the part before it, once trimmed, is no longer than the
+// given length. Boundaries which would make for a very short part are skipped in favor of less natural ones.
+func splitPoint(text string, maxLength int) int {
+	// the split can fall on the whitespace after the last character that fits
+	head := text[:runeOffset(text, maxLength+1)]
+	minCut := runeOffset(text, maxLength/3)
+
+	for _, sep := range []string{"\n\n", "\n"} {
+		if i := strings.LastIndex(head, sep); i >= minCut && i > 0 {
+			return i
+		}
+	}
+
+	if ends := sentenceEndRegex.FindAllStringIndex(head, -1); len(ends) > 0 {
+		if i := ends[len(ends)-1][1]; i >= minCut {
+			return i
+		}
+	}
+
+	if i := strings.LastIndexFunc(head, unicode.IsSpace); i > 0 {
+		return i
+	}
+
+	// no boundary at all so split mid-word
+	return runeOffset(text, maxLength)
+}
+
+// gets the byte offset of the rune at the given index in the passed in text, or its length if it's not that long
+func runeOffset(text string, index int) int {
+	n := 0
+	for i := range text {
+		if n == index {
+			return i
+		}
+		n++
+	}
+	return len(text)
+}
+
+// splits the text of the passed in message if it's longer than its channel allows, returning the follow-up messages
+// which make up the rest of the bundle. Any quick replies are moved to the last part as that's the one being replied to.
+func splitMessage(org *Org, msg *Msg, splitting *MsgSplitting) ([]*Msg, error) {
+	parts := SplitText(msg.Text(), splitting.MaxLength)
+	if len(parts) <= 1 {
+		return nil, nil
+	}
+
+	metadata := msg.m.Metadata.Map()
+	topic, _ := metadata["topic"].(string)
+
+	msg.m.Text = parts[0]
+
+	followUps := make([]*Msg, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		out := flows.NewMsgOut(msg.URN(), msg.channel.ChannelReference(), part, nil, nil, nil, flows.MsgTopic(topic))
+		followUp, err := NewOutgoingMsg(org, msg.channel, msg.ContactID(), out, msg.CreatedOn())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating follow-up message for split text")
+		}
+		followUps = append(followUps, followUp)
+	}
+
+	if quickReplies, found := metadata["quick_replies"]; found {
+		delete(metadata, "quick_replies")
+
+		last := followUps[len(followUps)-1]
+		lastMetadata := last.m.Metadata.Map()
+		if lastMetadata == nil {
+			lastMetadata = make(map[string]interface{}, 1)
+		}
+		lastMetadata["quick_replies"] = quickReplies
+		last.m.Metadata = null.NewMap(lastMetadata)
+		msg.m.Metadata = null.NewMap(metadata)
+	}
+
+	msg.calculateSegments()
+
+	return followUps, nil
+}
+
+// delays each of the passed in follow-up messages to be sent the given number of seconds after the one before it
+func delayFollowUps(msg *Msg, followUps []*Msg, delay int) {
+	if delay <= 0 {
+		return
+	}
+
+	for i, f := range followUps {
+		sendOn := msg.CreatedOn().Add(time.Duration((i+1)*delay) * time.Second)
+		f.m.NextAttempt = &sendOn
+	}
+}
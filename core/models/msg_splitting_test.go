@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitText(t *testing.T) {
+	tcs := []struct {
+		text      string
+		maxLength int
+		expected  []string
+	}{
+		{"Hello world", 20, []string{"Hello world"}},
+		{"  Hello world  ", 0, []string{"Hello world"}},
+		{
+			"This is the first sentence. This is the second one. And a third.",
+			30,
+			[]string{"This is the first sentence.", "This is the second one.", "And a third."},
+		},
+		{
+			"First paragraph here.\n\nSecond paragraph which is a little longer.",
+			40,
+			[]string{"First paragraph here.", "Second paragraph which is a little", "longer."},
+		},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"Привет мир! Как дела?", 12, []string{"Привет мир!", "Как дела?"}},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, models.SplitText(tc.text, tc.maxLength), "split mismatch for '%s'", tc.text)
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	assert.Nil(t, oa.ChannelByID(testdata.TwilioChannel.ID).Splitting())
+
+	db.MustExec(`UPDATE channels_channel SET config = '{"split_messages": true}' WHERE id = $1`, testdata.TwilioChannel.ID)
+	db.MustExec(`UPDATE channels_channel SET config = '{"split_messages": {"max_length": 100}, "constraints": {"max_length": 30}}' WHERE id = $1`, testdata.VonageChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	assert.Equal(t, &models.MsgSplitting{MaxLength: 640}, oa.ChannelByID(testdata.TwilioChannel.ID).Splitting())
+	assert.Equal(t, &models.MsgSplitting{MaxLength: 30}, oa.ChannelByID(testdata.VonageChannel.ID).Splitting())
+
+	db.MustExec(`UPDATE channels_channel SET config = '{"split_messages": {"max_length": 30, "delay": 10}}' WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+	createdOn := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	// short messages are sent as is
+	out := flows.NewMsgOut(urn, channel.ChannelReference(), "Hi there", nil, []string{"yes", "no"}, nil, flows.NilMsgTopic)
+	msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, createdOn)
+	require.NoError(t, err)
+
+	followUps, rejected, err := models.ApplyChannelConstraints(oa.Org(), msg)
+	assert.NoError(t, err)
+	assert.Nil(t, rejected)
+	assert.Len(t, followUps, 0)
+	assert.Equal(t, "Hi there", msg.Text())
+	assert.Nil(t, msg.NextAttempt())
+
+	// long messages are split into a bundle with the quick replies on the last part
+	out = flows.NewMsgOut(urn, channel.ChannelReference(), "This is the first sentence. This is the second one. And a third.", nil, []string{"yes", "no"}, nil, flows.NilMsgTopic)
+	msg, err = models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, createdOn)
+	require.NoError(t, err)
+
+	followUps, rejected, err = models.ApplyChannelConstraints(oa.Org(), msg)
+	assert.NoError(t, err)
+	assert.Nil(t, rejected)
+	require.Len(t, followUps, 2)
+
+	assert.Equal(t, "This is the first sentence.", msg.Text())
+	assert.Nil(t, msg.NextAttempt())
+	assert.Nil(t, msg.Metadata()["quick_replies"])
+	assert.Equal(t, &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}, msg.Segments())
+
+	assert.Equal(t, "This is the second one.", followUps[0].Text())
+	assert.Equal(t, createdOn.Add(time.Second*10), *followUps[0].NextAttempt())
+	assert.Nil(t, followUps[0].Metadata()["quick_replies"])
+
+	assert.Equal(t, "And a third.", followUps[1].Text())
+	assert.Equal(t, createdOn.Add(time.Second*20), *followUps[1].NextAttempt())
+	assert.Equal(t, []string{"yes", "no"}, followUps[1].Metadata()["quick_replies"])
+
+	for _, f := range followUps {
+		assert.Equal(t, models.MsgStatusQueued, f.Status())
+		assert.Equal(t, channel, f.Channel())
+		assert.Equal(t, msg.URN(), f.URN())
+	}
+}
@@ -2,15 +2,16 @@ package models
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/nyaruka/gocommon/dates"
-	"github.com/nyaruka/gocommon/gsm7"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
@@ -21,6 +22,9 @@ import (
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/utils/redisutil"
+	"github.com/nyaruka/mailroom/utils/tracing"
+	"github.com/nyaruka/mailroom/utils/translit"
 	"github.com/nyaruka/null"
 
 	"github.com/gomodule/redigo/redis"
@@ -28,6 +32,7 @@ import (
 	"github.com/lib/pq/hstore"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // MsgID is our internal type for msg ids, which can be null/0
@@ -51,6 +56,48 @@ const (
 	VisibilityDeleted  = MsgVisibility("D")
 )
 
+// MsgPriorityClass is the class of an outgoing message which determines whether it is sent ahead of others. Courier
+// only has two queues for each channel, high priority and bulk, so each class is sent on one or the other.
+type MsgPriorityClass string
+
+const (
+	// MsgPriorityTransactional is for messages from flows the org has marked as transactional, e.g. OTP codes
+	MsgPriorityTransactional = MsgPriorityClass("transactional")
+
+	// MsgPrioritySessionReply is for messages sent in reply to an incoming message
+	MsgPrioritySessionReply = MsgPriorityClass("session_reply")
+
+	// MsgPriorityBulk is for everything else, e.g. broadcasts, campaign events and flow starts
+	MsgPriorityBulk = MsgPriorityClass("bulk")
+)
+
+// which classes are sent at high priority unless the org has configured otherwise
+var defaultMsgHighPriority = map[MsgPriorityClass]bool{
+	MsgPriorityTransactional: true,
+	MsgPrioritySessionReply:  true,
+	MsgPriorityBulk:          false,
+}
+
+// MsgPriorities is an org's configuration of how outgoing messages are classified and which classes are sent at high
+// priority
+type MsgPriorities struct {
+	TransactionalFlows []assets.FlowUUID         `json:"transactional_flows"`
+	HighPriority       map[MsgPriorityClass]bool `json:"high_priority"`
+}
+
+// ClassFor returns the priority class of a message sent by the given flow, which may be in reply to an incoming message
+func (p *MsgPriorities) ClassFor(flowUUID assets.FlowUUID, isReply bool) MsgPriorityClass {
+	for _, f := range p.TransactionalFlows {
+		if f == flowUUID {
+			return MsgPriorityTransactional
+		}
+	}
+	if isReply {
+		return MsgPrioritySessionReply
+	}
+	return MsgPriorityBulk
+}
+
 type MsgType string
 
 const (
@@ -80,6 +127,21 @@ const (
 	MsgStatusResent       = MsgStatus("R")
 )
 
+// MsgFailedReason is the reason a message was marked as failed, which is kept in its metadata so that it can be
+// shown in contact history and exports
+type MsgFailedReason string
+
+const (
+	MsgFailedNone           = MsgFailedReason("")
+	MsgFailedNoDestination  = MsgFailedReason("D") // no URN or channel to send the message with
+	MsgFailedContactStopped = MsgFailedReason("S") // contact has opted out of messages
+	MsgFailedSuspended      = MsgFailedReason("Q") // org is suspended, e.g. because it has run out of credits
+	MsgFailedErrorLimit     = MsgFailedReason("E") // channel errored sending the message too many times
+	MsgFailedInvalidContent = MsgFailedReason("I") // content of the message can't be sent on its channel
+	MsgFailedSandbox        = MsgFailedReason("X") // message is to a test contact and is never sent
+	MsgFailedDuplicate      = MsgFailedReason("U") // identical message was sent to the contact within the org's duplicate window
+)
+
 // TemplateState represents what state are templates are in, either already evaluated, not evaluated or
 // that they are unevaluated legacy templates
 type TemplateState string
@@ -98,6 +160,7 @@ type Msg struct {
 		UUID                 flows.MsgUUID      `db:"uuid"            json:"uuid"`
 		Text                 string             `db:"text"            json:"text"`
 		HighPriority         bool               `db:"high_priority"   json:"high_priority"`
+		PriorityClass        MsgPriorityClass   `                     json:"-"`
 		CreatedOn            time.Time          `db:"created_on"      json:"created_on"`
 		ModifiedOn           time.Time          `db:"modified_on"     json:"modified_on"`
 		SentOn               time.Time          `db:"sent_on"         json:"sent_on"`
@@ -144,6 +207,7 @@ func (m *Msg) UUID() flows.MsgUUID              { return m.m.UUID }
 func (m *Msg) Channel() *Channel                { return m.channel }
 func (m *Msg) Text() string                     { return m.m.Text }
 func (m *Msg) HighPriority() bool               { return m.m.HighPriority }
+func (m *Msg) PriorityClass() MsgPriorityClass  { return m.m.PriorityClass }
 func (m *Msg) CreatedOn() time.Time             { return m.m.CreatedOn }
 func (m *Msg) ModifiedOn() time.Time            { return m.m.ModifiedOn }
 func (m *Msg) SentOn() time.Time                { return m.m.SentOn }
@@ -205,10 +269,18 @@ func (m *Msg) Attachments() []utils.Attachment {
 func (m *Msg) SetResponseTo(id MsgID, externalID null.String) {
 	m.m.ResponseToID = id
 	m.m.ResponseToExternalID = externalID
+}
 
-	if id != NilMsgID || externalID != "" {
-		m.m.HighPriority = true
-	}
+// IsResponse returns whether this message is in response to an incoming message
+func (m *Msg) IsResponse() bool {
+	return m.m.ResponseToID != NilMsgID || m.m.ResponseToExternalID != ""
+}
+
+// SetPriorityClass sets the priority class of this message, queuing it at high priority if the org sends that class at
+// high priority. Only whether it's high priority is stored and sent to courier.
+func (m *Msg) SetPriorityClass(org *Org, class MsgPriorityClass) {
+	m.m.PriorityClass = class
+	m.m.HighPriority = org.MsgPriorities().HighPriority[class]
 }
 
 func (m *Msg) MarshalJSON() ([]byte, error) {
@@ -285,22 +357,62 @@ func NewOutgoingIVR(orgID OrgID, conn *ChannelConnection, out *flows.MsgOut, cre
 	return msg, nil
 }
 
+// the keys of an org's claims are prefixed with the org's hash tag if we're using them so that they can be made together
+// in a redis cluster
+const duplicateMsgKey = "%s:%d:%s"
+
+// OutgoingMsgClaim is a claim on an outgoing message (its text and attachments) having been sent to a contact, which
+// stops identical messages being sent to them within the org's duplicate window. Claims are only made once the message
+// has been committed so that messages which are never committed don't suppress later ones.
+type OutgoingMsgClaim struct {
+	Key    string
+	Window time.Duration
+}
+
+// NewOutgoingMsgClaim creates a claim on the passed in outgoing message to the given contact, or returns nil if the org
+// has no duplicate window configured, in which case duplicate messages are always sent
+func NewOutgoingMsgClaim(org *Org, contactID ContactID, out *flows.MsgOut) *OutgoingMsgClaim {
+	window := org.DuplicateMsgWindow()
+	if window <= 0 {
+		return nil
+	}
+
+	hash := sha1.New()
+	hash.Write([]byte(out.Text()))
+	for _, a := range out.Attachments() {
+		fmt.Fprintf(hash, "|%s", a)
+	}
+
+	return &OutgoingMsgClaim{
+		Key:    fmt.Sprintf(duplicateMsgKey, redisutil.HashTag(fmt.Sprintf("msg_dedup:%d", org.ID())), contactID, hex.EncodeToString(hash.Sum(nil))),
+		Window: window,
+	}
+}
+
+// IsClaimed returns whether an identical message has already been sent to the contact within the duplicate window
+func (c *OutgoingMsgClaim) IsClaimed(rc redis.Conn) (bool, error) {
+	exists, err := redis.Bool(rc.Do("EXISTS", c.Key))
+	return exists, errors.Wrapf(err, "error checking outgoing message claim")
+}
+
+// ClaimOutgoingMsgs makes the passed in claims, restarting the window of any which already exist
+func ClaimOutgoingMsgs(rc redis.Conn, claims []*OutgoingMsgClaim) error {
+	for _, c := range claims {
+		rc.Send("SET", c.Key, "1", "PX", int(c.Window/time.Millisecond))
+	}
+	_, err := rc.Do("")
+	return errors.Wrapf(err, "error claiming outgoing messages")
+}
+
 // NewOutgoingMsg creates an outgoing message for the passed in flow message.
 func NewOutgoingMsg(org *Org, channel *Channel, contactID ContactID, out *flows.MsgOut, createdOn time.Time) (*Msg, error) {
 	msg := &Msg{}
 	m := &msg.m
 
-	// we fail messages for suspended orgs right away
-	status := MsgStatusQueued
-	if org.Suspended() {
-		status = MsgStatusFailed
-	}
-
 	m.UUID = out.UUID()
 	m.Text = out.Text()
-	m.HighPriority = false
 	m.Direction = DirectionOut
-	m.Status = status
+	m.Status = MsgStatusQueued
 	m.Visibility = VisibilityVisible
 	m.MsgType = TypeFlow
 	m.ContactID = contactID
@@ -308,6 +420,9 @@ func NewOutgoingMsg(org *Org, channel *Channel, contactID ContactID, out *flows.
 	m.TopupID = NilTopupID
 	m.CreatedOn = createdOn
 
+	// messages are bulk unless the caller knows better, e.g. they're a reply
+	msg.SetPriorityClass(org, MsgPriorityBulk)
+
 	err := msg.SetURN(out.URN())
 	if err != nil {
 		return nil, errors.Wrapf(err, "error setting msg urn")
@@ -317,6 +432,11 @@ func NewOutgoingMsg(org *Org, channel *Channel, contactID ContactID, out *flows.
 		m.ChannelUUID = channel.UUID()
 		msg.SetChannelID(channel.ID())
 		msg.channel = channel
+
+		// channels on GSM-7 routes can cut costs by sending text with close equivalents of any other characters
+		if channel.Transliterates() {
+			m.Text = translit.ToGSM7(m.Text)
+		}
 	}
 
 	m.MsgCount = 1
@@ -343,11 +463,12 @@ func NewOutgoingMsg(org *Org, channel *Channel, contactID ContactID, out *flows.
 		m.Metadata = null.NewMap(metadata)
 	}
 
-	// calculate msg count
-	if m.URN.Scheme() == urns.TelScheme {
-		m.MsgCount = gsm7.Segments(m.Text) + len(m.Attachments)
-	} else {
-		m.MsgCount = 1
+	// messages sent as SMS are counted by their segments
+	msg.calculateSegments()
+
+	// we fail messages for suspended orgs right away
+	if org.Suspended() {
+		msg.SetFailed(MsgFailedSuspended)
 	}
 
 	return msg, nil
@@ -463,6 +584,107 @@ func (m *Msg) SetSession(id SessionID, status SessionStatus) {
 	m.m.SessionStatus = status
 }
 
+// SetSandbox flags this message as being to a test contact. Sandbox messages are never handed to courier so are marked
+// as failed straight away with the sandbox reason, rather than appearing to have been sent.
+func (m *Msg) SetSandbox() {
+	metadata := m.m.Metadata.Map()
+	if metadata == nil {
+		metadata = make(map[string]interface{}, 1)
+	}
+	metadata["sandbox"] = true
+	m.m.Metadata = null.NewMap(metadata)
+
+	if m.m.Status == MsgStatusQueued {
+		m.SetFailed(MsgFailedSandbox)
+	}
+}
+
+// SetCampaignOptions adds the attachments, quick replies and template defined on a campaign message event to this
+// message. Quick replies and templating already set by the flow take precedence, and the template is only used if it
+// has a translation for this message's channel in the contact's language or the org's default language.
+func (m *Msg) SetCampaignOptions(oa *OrgAssets, contact *flows.Contact, opts *CampaignMessageOptions) {
+	for _, a := range opts.Attachments {
+		m.m.Attachments = append(m.m.Attachments, string(NormalizeAttachment(config.Mailroom, a)))
+	}
+
+	metadata := m.m.Metadata.Map()
+	if metadata == nil {
+		metadata = make(map[string]interface{}, 2)
+	}
+
+	if _, hasQuickReplies := metadata["quick_replies"]; !hasQuickReplies && len(opts.QuickReplies) > 0 {
+		metadata["quick_replies"] = opts.QuickReplies
+	}
+
+	if _, hasTemplating := metadata["templating"]; !hasTemplating && opts.Template != nil && m.channel != nil {
+		if templating := campaignTemplating(oa, contact, m.channel, opts.Template); templating != nil {
+			metadata["templating"] = templating
+		}
+	}
+
+	if len(metadata) > 0 {
+		m.m.Metadata = null.NewMap(metadata)
+	}
+
+	m.calculateSegments()
+}
+
+// campaignTemplating builds templating for the passed in campaign template from its translation for the given channel
+// in the contact's language or the org's default language, returning nil if there is no such translation
+func campaignTemplating(oa *OrgAssets, contact *flows.Contact, channel *Channel, t *CampaignMessageTemplate) *flows.MsgTemplating {
+	templates, _ := oa.Templates()
+
+	var template *Template
+	for _, a := range templates {
+		if a.UUID() == t.UUID {
+			template = a.(*Template)
+			break
+		}
+	}
+	if template == nil {
+		return nil
+	}
+
+	languages := []envs.Language{contact.Language(), oa.Env().DefaultLanguage()}
+
+	for _, lang := range languages {
+		if lang == envs.NilLanguage {
+			continue
+		}
+		for _, tr := range template.Translations() {
+			if tr.Channel().UUID == channel.UUID() && tr.Language() == lang {
+				ref := assets.NewTemplateReference(template.UUID(), template.Name())
+				return flows.NewMsgTemplating(ref, tr.Language(), tr.Country(), t.Variables, tr.Namespace())
+			}
+		}
+	}
+	return nil
+}
+
+// SetFailed marks this message as failed for the given reason so that it won't be sent
+func (m *Msg) SetFailed(reason MsgFailedReason) {
+	metadata := m.m.Metadata.Map()
+	if metadata == nil {
+		metadata = make(map[string]interface{}, 1)
+	}
+	metadata["failed_reason"] = string(reason)
+	m.m.Metadata = null.NewMap(metadata)
+
+	m.m.Status = MsgStatusFailed
+}
+
+// FailedReason returns the reason this message was marked as failed, if it was
+func (m *Msg) FailedReason() MsgFailedReason {
+	reason, _ := m.m.Metadata.Map()["failed_reason"].(string)
+	return MsgFailedReason(reason)
+}
+
+// IsSandbox returns whether this message is to a test contact and so shouldn't be sent
+func (m *Msg) IsSandbox() bool {
+	sandbox, _ := m.m.Metadata.Map()["sandbox"].(bool)
+	return sandbox
+}
+
 // SetTimeout sets the timeout for this message
 func (m *Msg) SetTimeout(start time.Time, timeout time.Duration) {
 	m.m.SessionWaitStartedOn = &start
@@ -471,12 +693,19 @@ func (m *Msg) SetTimeout(start time.Time, timeout time.Duration) {
 
 // InsertMessages inserts the passed in messages in a single query
 func InsertMessages(ctx context.Context, tx Queryer, msgs []*Msg) error {
+	ctx, span := tracing.Start(ctx, "insert messages", attribute.Int("count", len(msgs)))
+	defer span.End()
+
 	is := make([]interface{}, len(msgs))
 	for i := range msgs {
 		is[i] = &msgs[i].m
 	}
 
-	return BulkQuery(ctx, "insert messages", tx, insertMsgSQL, is)
+	err := BulkQuery(ctx, "insert messages", tx, insertMsgSQL, is)
+	if err != nil {
+		tracing.RecordError(span, err)
+	}
+	return err
 }
 
 const insertMsgSQL = `
@@ -575,6 +804,9 @@ type Broadcast struct {
 		OrgID         OrgID                                   `json:"org_id"                 db:"org_id"`
 		ParentID      BroadcastID                             `json:"parent_id,omitempty"    db:"parent_id"`
 		TicketID      TicketID                                `json:"ticket_id,omitempty"    db:"ticket_id"`
+		OptimalTime   *OptimalTime                            `json:"optimal_time,omitempty"`
+
+		IdempotencyKey string `json:"idempotency_key,omitempty"`
 	}
 }
 
@@ -588,6 +820,18 @@ func (b *Broadcast) Translations() map[envs.Language]*BroadcastTranslation { ret
 func (b *Broadcast) TemplateState() TemplateState                          { return b.b.TemplateState }
 func (b *Broadcast) TicketID() TicketID                                    { return b.b.TicketID }
 
+// OptimalTime returns the window in which to send to each contact at their most responsive hour, if this broadcast
+// opted into that
+func (b *Broadcast) OptimalTime() *OptimalTime { return b.b.OptimalTime }
+
+// IdempotencyKey is the key given by RapidPro or an API client when this broadcast was requested, so that retries of
+// that request don't send it again
+func (b *Broadcast) IdempotencyKey() string { return b.b.IdempotencyKey }
+func (b *Broadcast) WithIdempotencyKey(key string) *Broadcast {
+	b.b.IdempotencyKey = key
+	return b
+}
+
 func (b *Broadcast) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *Broadcast) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
@@ -761,7 +1005,11 @@ func NewBroadcastFromEvent(ctx context.Context, tx Queryer, org *OrgAssets, even
 		}
 	}
 
-	return NewBroadcast(org.OrgID(), NilBroadcastID, translations, TemplateStateEvaluated, event.BaseLanguage, event.URNs, contactIDs, groupIDs, NilTicketID), nil
+	// each step can only create one broadcast, so its UUID keeps the broadcast from being sent twice if its task is retried
+	bcast := NewBroadcast(org.OrgID(), NilBroadcastID, translations, TemplateStateEvaluated, event.BaseLanguage, event.URNs, contactIDs, groupIDs, NilTicketID).
+		WithIdempotencyKey(string(event.StepUUID()))
+
+	return bcast, nil
 }
 
 func (b *Broadcast) CreateBatch(contactIDs []ContactID) *BroadcastBatch {
@@ -887,6 +1135,11 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 			return nil, nil
 		}
 
+		// org routing rules can override the default channel
+		if routed := RouteChannel(oa, urn); routed != nil {
+			channel = routed
+		}
+
 		// resolve our translations, the order is:
 		//   1) valid contact language
 		//   2) org default language
@@ -955,10 +1208,14 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		// create our outgoing message
 		out := flows.NewMsgOut(urn, channel.ChannelReference(), text, t.Attachments, t.QuickReplies, nil, flows.NilMsgTopic)
 		msg, err := NewOutgoingMsg(oa.Org(), channel, c.ID(), out, time.Now())
-		msg.SetBroadcastID(bcast.BroadcastID())
 		if err != nil {
 			return nil, errors.Wrapf(err, "error creating outgoing message")
 		}
+		msg.SetBroadcastID(bcast.BroadcastID())
+
+		if IsTestContact(oa, contact) {
+			msg.SetSandbox()
+		}
 
 		return msg, nil
 	}
@@ -989,6 +1246,29 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		}
 	}
 
+	// check messages can be sent on their channels, splitting off any attachments they can't send together
+	constrained := make([]*Msg, 0, len(msgs))
+	rejections := make([]*ChannelEvent, 0)
+	for _, m := range msgs {
+		followUps, rejected, err := ApplyChannelConstraints(oa.Org(), m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error applying channel constraints to broadcast message")
+		}
+		if rejected != nil {
+			rejections = append(rejections, rejected)
+		}
+
+		constrained = append(constrained, m)
+		for _, f := range followUps {
+			f.SetBroadcastID(bcast.BroadcastID())
+			if m.IsSandbox() {
+				f.SetSandbox()
+			}
+			constrained = append(constrained, f)
+		}
+	}
+	msgs = constrained
+
 	// allocate a topup for these message if org uses topups
 	topup, err := AllocateTopups(ctx, db, rp, oa.Org(), len(msgs))
 	if err != nil {
@@ -1008,6 +1288,20 @@ func CreateBroadcastMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa
 		return nil, errors.Wrapf(err, "error inserting broadcast messages")
 	}
 
+	// messages on channels being warmed up may need to wait for a later day's send cap
+	rc := rp.Get()
+	err = ApplyChannelWarmups(ctx, db, rc, msgs, dates.Now())
+	rc.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error applying channel warmups to broadcast messages")
+	}
+
+	for _, e := range rejections {
+		if err := e.Insert(ctx, db); err != nil {
+			return nil, errors.Wrapf(err, "error inserting rejected broadcast message event")
+		}
+	}
+
 	// if the broadcast was a ticket reply, update the ticket
 	if bcast.TicketID() != NilTicketID {
 		err = updateTicketLastActivity(ctx, db, []TicketID{bcast.TicketID()}, dates.Now())
@@ -1029,11 +1323,12 @@ const updateMsgForResendingSQL = `
 		error_count = 0,
 		queued_on = r.queued_on::timestamp with time zone,
 		sent_on = NULL,
+		metadata = r.metadata,
 		modified_on = NOW()
 	FROM (
-		VALUES(:id, :channel_id, :topup_id, :queued_on)
+		VALUES(:id, :channel_id, :topup_id, :queued_on, :metadata)
 	) AS
-		r(id, channel_id, topup_id, queued_on)
+		r(id, channel_id, topup_id, queued_on, metadata)
 	WHERE
 		m.id = r.id::bigint
 `
@@ -1059,6 +1354,9 @@ func ResendMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAsse
 		ch := channels.GetForURN(contactURN, assets.ChannelRoleSend)
 		if ch != nil {
 			channel := oa.ChannelByUUID(ch.UUID())
+			if routed := RouteChannel(oa, urn); routed != nil {
+				channel = routed
+			}
 			msg.m.ChannelID = channel.ID()
 			msg.m.ChannelUUID = channel.UUID()
 			msg.channel = channel
@@ -1081,6 +1379,12 @@ func ResendMessages(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAsse
 		msg.m.ErrorCount = 0
 		msg.m.IsResend = true
 
+		// resent messages are no longer failed
+		if metadata := msg.m.Metadata.Map(); metadata != nil {
+			delete(metadata, "failed_reason")
+			msg.m.Metadata = null.NewMap(metadata)
+		}
+
 		resends[i] = msg.m
 	}
 
@@ -1107,6 +1411,15 @@ func MarkBroadcastSent(ctx context.Context, db Queryer, id BroadcastID) error {
 	return nil
 }
 
+// MarkBroadcastFailed marks the passed in broadcast as failed
+func MarkBroadcastFailed(ctx context.Context, db Queryer, id BroadcastID) error {
+	_, err := db.ExecContext(ctx, `UPDATE msgs_broadcast SET status = 'F', modified_on = now() WHERE id = $1`, id)
+	if err != nil {
+		return errors.Wrapf(err, "error setting broadcast with id %d as failed", id)
+	}
+	return nil
+}
+
 // NilID implementations
 
 // MarshalJSON marshals into JSON. 0 values will become null
@@ -15,6 +15,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/olivere/elastic/v7"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -62,6 +63,7 @@ func TestOutgoingMsgs(t *testing.T) {
 			ExpectedMetadata: map[string]interface{}{
 				"quick_replies": []string{"yes", "no"},
 				"topic":         "purchase",
+				"segments":      &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1},
 			},
 			ExpectedMsgCount: 1,
 		},
@@ -73,7 +75,7 @@ func TestOutgoingMsgs(t *testing.T) {
 			URNID:            testdata.Cathy.URNID,
 			Attachments:      []utils.Attachment{utils.Attachment("image/jpeg:https://dl-foo.com/image.jpg")},
 			ExpectedStatus:   models.MsgStatusQueued,
-			ExpectedMetadata: map[string]interface{}{},
+			ExpectedMetadata: map[string]interface{}{"segments": &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}},
 			ExpectedMsgCount: 2,
 		},
 		{
@@ -84,7 +86,7 @@ func TestOutgoingMsgs(t *testing.T) {
 			URNID:            testdata.Cathy.URNID,
 			SuspendedOrg:     true,
 			ExpectedStatus:   models.MsgStatusFailed,
-			ExpectedMetadata: map[string]interface{}{},
+			ExpectedMetadata: map[string]interface{}{"failed_reason": "Q", "segments": &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}},
 			ExpectedMsgCount: 1,
 		},
 	}
@@ -137,6 +139,166 @@ func TestOutgoingMsgs(t *testing.T) {
 	}
 }
 
+func TestOutgoingMsgTransliteration(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE channels_channel SET config = '{"transliterate": true}' WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+
+	// text sent on the Twilio channel is transliterated so that it can be sent as GSM-7
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+	assert.True(t, channel.Transliterates())
+
+	out := flows.NewMsgOut(urn, channel.ChannelReference(), "“Qué tal?” 😊", nil, nil, nil, flows.NilMsgTopic)
+	msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, `"Que tal?" :)`, msg.Text())
+	assert.Equal(t, &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}, msg.Segments())
+
+	// but not on other channels
+	channel = oa.ChannelByUUID(testdata.VonageChannel.UUID)
+	assert.False(t, channel.Transliterates())
+
+	out = flows.NewMsgOut(urn, channel.ChannelReference(), "“Qué tal?” 😊", nil, nil, nil, flows.NilMsgTopic)
+	msg, err = models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, "“Qué tal?” 😊", msg.Text())
+	assert.Equal(t, &models.MsgSegments{Encoding: models.MsgEncodingUCS2, Count: 1}, msg.Segments())
+}
+
+func TestSetFailed(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+	out := flows.NewMsgOut(urn, channel.ChannelReference(), "Hi there", nil, []string{"yes"}, nil, flows.NilMsgTopic)
+	msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+
+	assert.Equal(t, models.MsgStatusQueued, msg.Status())
+	assert.Equal(t, models.MsgFailedNone, msg.FailedReason())
+
+	msg.SetFailed(models.MsgFailedContactStopped)
+
+	assert.Equal(t, models.MsgStatusFailed, msg.Status())
+	assert.Equal(t, models.MsgFailedContactStopped, msg.FailedReason())
+	assert.Equal(t, map[string]interface{}{"quick_replies": []string{"yes"}, "failed_reason": "S", "segments": &models.MsgSegments{Encoding: models.MsgEncodingGSM7, Count: 1}}, msg.Metadata())
+}
+
+func TestSetCampaignOptions(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg|models.RefreshTemplates)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+	cathy.SetLanguage(envs.Language("eng"))
+
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+
+	newMsg := func(channelUUID assets.ChannelUUID, quickReplies []string) *models.Msg {
+		channel := oa.ChannelByUUID(channelUUID)
+		out := flows.NewMsgOut(urn, channel.ChannelReference(), "Hi there", nil, quickReplies, nil, flows.NilMsgTopic)
+		msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+		require.NoError(t, err)
+		return msg
+	}
+
+	// template has a translation for this channel in the contact's language
+	msg := newMsg(testdata.TwitterChannel.UUID, nil)
+	msg.SetCampaignOptions(oa, cathy, &models.CampaignMessageOptions{
+		Attachments:  []utils.Attachment{"image/jpeg:https://example.com/hi.jpg"},
+		QuickReplies: []string{"Yes", "No"},
+		Template:     &models.CampaignMessageTemplate{UUID: "9c22b594-fcab-4b29-9bcb-ce4404894a80", Name: "revive_issue", Variables: []string{"Cathy", "network"}},
+	})
+
+	assert.Equal(t, []utils.Attachment{"image/jpeg:https://example.com/hi.jpg"}, msg.Attachments())
+	assert.Equal(t, 2, msg.MsgCount())
+	assert.Equal(t, []string{"Yes", "No"}, msg.Metadata()["quick_replies"])
+
+	templating := msg.Metadata()["templating"].(*flows.MsgTemplating)
+	assert.Equal(t, "revive_issue", templating.Template().Name)
+	assert.Equal(t, envs.Language("eng"), templating.Language())
+	assert.Equal(t, envs.Country("US"), templating.Country())
+	assert.Equal(t, []string{"Cathy", "network"}, templating.Variables())
+	assert.Equal(t, "2d40b45c_25cd_4965_9019_f05d0124c5fa", templating.Namespace())
+
+	// quick replies from the flow take precedence, and no translation for the channel means no templating
+	msg = newMsg(testdata.TwilioChannel.UUID, []string{"Maybe"})
+	msg.SetCampaignOptions(oa, cathy, &models.CampaignMessageOptions{
+		QuickReplies: []string{"Yes", "No"},
+		Template:     &models.CampaignMessageTemplate{UUID: "9c22b594-fcab-4b29-9bcb-ce4404894a80", Name: "revive_issue"},
+	})
+
+	assert.Equal(t, []string{"Maybe"}, msg.Metadata()["quick_replies"])
+	assert.Nil(t, msg.Metadata()["templating"])
+}
+
+func TestMsgPriorityClasses(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer func() {
+		db.MustExec(`UPDATE orgs_org SET config = '{}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+		models.FlushCache()
+	}()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByUUID(testdata.TwilioChannel.UUID)
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+	out := flows.NewMsgOut(urn, channel.ChannelReference(), "Your code is 1234", nil, nil, nil, flows.NilMsgTopic)
+
+	// by default, messages are bulk and only replies and transactional messages are high priority
+	priorities := oa.Org().MsgPriorities()
+	assert.Equal(t, models.MsgPriorityBulk, priorities.ClassFor(testdata.Favorites.UUID, false))
+	assert.Equal(t, models.MsgPrioritySessionReply, priorities.ClassFor(testdata.Favorites.UUID, true))
+
+	msg, err := models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, out, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, models.MsgPriorityBulk, msg.PriorityClass())
+	assert.False(t, msg.HighPriority())
+	assert.False(t, msg.IsResponse())
+
+	msg.SetResponseTo(models.MsgID(123), "")
+	assert.True(t, msg.IsResponse())
+
+	msg.SetPriorityClass(oa.Org(), models.MsgPrioritySessionReply)
+	assert.True(t, msg.HighPriority())
+
+	// org can mark flows as transactional and change which classes are sent at high priority
+	db.MustExec(`UPDATE orgs_org SET config = '{"msg_priorities": {"transactional_flows": ["9de3663f-c5c5-4c92-9f45-ecbc09abcc85"], "high_priority": {"session_reply": false}}}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	priorities = oa.Org().MsgPriorities()
+	assert.Equal(t, models.MsgPriorityTransactional, priorities.ClassFor(testdata.Favorites.UUID, true))
+	assert.Equal(t, models.MsgPrioritySessionReply, priorities.ClassFor(testdata.PickANumber.UUID, true))
+	assert.Equal(t, map[models.MsgPriorityClass]bool{models.MsgPriorityTransactional: true, models.MsgPrioritySessionReply: false, models.MsgPriorityBulk: false}, priorities.HighPriority)
+
+	msg.SetPriorityClass(oa.Org(), models.MsgPrioritySessionReply)
+	assert.False(t, msg.HighPriority())
+
+	msg.SetPriorityClass(oa.Org(), models.MsgPriorityTransactional)
+	assert.True(t, msg.HighPriority())
+	assert.Equal(t, models.MsgPriorityTransactional, msg.PriorityClass())
+}
+
 func TestGetMessageIDFromUUID(t *testing.T) {
 	ctx := testsuite.CTX()
 	db := testsuite.DB()
@@ -191,7 +353,7 @@ func TestResendMessages(t *testing.T) {
 	testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "out 3", nil)
 
 	// make them look like failed messages
-	db.MustExec(`UPDATE msgs_msg SET status = 'F', sent_on = NOW(), error_count = 3`)
+	db.MustExec(`UPDATE msgs_msg SET status = 'F', sent_on = NOW(), error_count = 3, metadata = '{"failed_reason": "E"}'`)
 
 	// give Bob's URN an affinity for the Vonage channel
 	db.MustExec(`UPDATE contacts_contacturn SET channel_id = $1 WHERE id = $2`, testdata.VonageChannel.ID, testdata.Bob.URNID)
@@ -214,6 +376,10 @@ func TestResendMessages(t *testing.T) {
 	assert.Equal(t, models.TopupID(1), msgs[1].TopupID())
 
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'P' AND queued_on > $1 AND sent_on IS NULL`, []interface{}{now}, 2)
+
+	// and they're no longer failed
+	assert.Equal(t, models.MsgFailedNone, msgs[0].FailedReason())
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE COALESCE(metadata, '{}')::jsonb->>'failed_reason' = 'E'`, nil, 1)
 }
 
 func TestNormalizeAttachment(t *testing.T) {
@@ -338,3 +504,96 @@ func TestNonPersistentBroadcasts(t *testing.T) {
 	// test ticket was updated
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND last_activity_on > $2`, []interface{}{ticket.ID, modelTicket.LastActivityOn()}, 1)
 }
+
+func TestIndexMsgs(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	msg := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "where is the vaccine center")
+	db.MustExec(`INSERT INTO msgs_msg_labels(msg_id, label_id) VALUES($1, $2)`, msg.ID(), testdata.ReportingLabel.ID)
+
+	es.NextResponse = `{"took": 3, "errors": false, "items": [
+		{"index": {"_index": "msgs", "_id": "1", "status": 201, "result": "created"}}
+	]}`
+
+	err = models.IndexMsgs(ctx, db, client, []models.MsgID{models.MsgID(msg.ID()), 123456})
+	assert.NoError(t, err)
+
+	assert.Contains(t, es.LastBody, `"text":"where is the vaccine center"`)
+	assert.Contains(t, es.LastBody, fmt.Sprintf(`"labels":[%d]`, testdata.ReportingLabel.ID))
+	assert.Contains(t, es.LastBody, `"direction":"I"`)
+	assert.Contains(t, es.LastBody, fmt.Sprintf(`"routing":"%d"`, testdata.Org1.ID))
+
+	// nothing to index is a noop
+	es.LastBody = ""
+	assert.NoError(t, models.IndexMsgs(ctx, db, client, []models.MsgID{123456}))
+	assert.Equal(t, "", es.LastBody)
+}
+
+func TestSearchMsgs(t *testing.T) {
+	ctx := testsuite.CTX()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	es.NextResponse = `{
+		"took": 2,
+		"hits": {"total": {"value": 3}, "max_score": null, "hits": [
+			{"_index": "msgs", "_id": "1003", "_score": null, "sort": [1624377570000, 1003]},
+			{"_index": "msgs", "_id": "1001", "_score": null, "sort": [1624377560000, 1001]}
+		]}
+	}`
+
+	after := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	page, err := models.SearchMsgs(ctx, client, testdata.Org1.ID, &models.MsgSearch{
+		Text:      "vaccine",
+		Direction: models.DirectionIn,
+		LabelIDs:  []models.LabelID{testdata.ReportingLabel.ID},
+		After:     &after,
+		PageSize:  2,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []models.MsgID{1003, 1001}, page.IDs)
+	assert.Equal(t, int64(3), page.Total)
+	assert.NotEqual(t, "", page.NextCursor)
+
+	assert.Contains(t, es.LastBody, `"vaccine"`)
+	assert.Contains(t, es.LastBody, fmt.Sprintf(`{"terms":{"labels":[%d]}}`, testdata.ReportingLabel.ID))
+	assert.Contains(t, es.LastBody, `"2021-06-01T00:00:00Z"`)
+	assert.Contains(t, es.LastBody, `{"term":{"visibility":"D"}}`)
+
+	es.NextResponse = `{
+		"took": 2,
+		"hits": {"total": {"value": 3}, "max_score": null, "hits": [
+			{"_index": "msgs", "_id": "1000", "_score": null, "sort": [1624377550000, 1000]}
+		]}
+	}`
+
+	page, err = models.SearchMsgs(ctx, client, testdata.Org1.ID, &models.MsgSearch{Text: "vaccine", PageSize: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+
+	assert.Equal(t, []models.MsgID{1000}, page.IDs)
+	assert.Equal(t, "", page.NextCursor)
+	assert.Contains(t, es.LastBody, `"search_after":[1624377560000,1001]`)
+}
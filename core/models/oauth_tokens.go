@@ -0,0 +1,352 @@
+package models
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/config"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// OAuthTokenID is our type for stored OAuth2 token ids
+type OAuthTokenID int
+
+// ErrNoOAuthToken is returned when an org has no stored token for an integration
+var ErrNoOAuthToken = errors.New("no OAuth token stored for integration")
+
+// how long before it expires that we refresh an access token
+const oauthTokenRefreshMargin = time.Minute * 5
+
+var oauthHTTPClient = &http.Client{Timeout: time.Duration(15 * time.Second)}
+
+// OAuthToken is an OAuth2 token for an org integration such as a ticketer or CRM, identified by an integration key
+// like "ticketer:<uuid>". Secrets and tokens are encrypted before they're written to the database.
+type OAuthToken struct {
+	ID           OAuthTokenID `json:"id"`
+	OrgID        OrgID        `json:"org_id"`
+	Integration  string       `json:"integration"`
+	TokenURL     string       `json:"token_url"`
+	ClientID     string       `json:"client_id"`
+	ClientSecret string       `json:"-"`
+	AccessToken  string       `json:"-"`
+	RefreshToken string       `json:"-"`
+	ExpiresOn    *time.Time   `json:"expires_on"`
+}
+
+// the database representation of a token where secrets are encrypted
+type dbOAuthToken struct {
+	ID           OAuthTokenID `db:"id"`
+	OrgID        OrgID        `db:"org_id"`
+	Integration  string       `db:"integration"`
+	TokenURL     string       `db:"token_url"`
+	ClientID     string       `db:"client_id"`
+	ClientSecret string       `db:"client_secret"`
+	AccessToken  string       `db:"access_token"`
+	RefreshToken string       `db:"refresh_token"`
+	ExpiresOn    *time.Time   `db:"expires_on"`
+}
+
+const upsertOAuthTokenSQL = `
+INSERT INTO
+	orgs_oauthtoken(org_id, integration, token_url, client_id, client_secret, access_token, refresh_token, expires_on, modified_on)
+	VALUES(:org_id, :integration, :token_url, :client_id, :client_secret, :access_token, :refresh_token, :expires_on, NOW())
+ON CONFLICT (org_id, integration) DO UPDATE SET
+	token_url = EXCLUDED.token_url,
+	client_id = EXCLUDED.client_id,
+	client_secret = EXCLUDED.client_secret,
+	access_token = EXCLUDED.access_token,
+	refresh_token = EXCLUDED.refresh_token,
+	expires_on = EXCLUDED.expires_on,
+	modified_on = NOW()
+RETURNING id
+`
+
+// SaveOAuthToken saves the given token, replacing any existing token for the same org and integration
+func SaveOAuthToken(ctx context.Context, db *sqlx.DB, cfg *config.Config, token *OAuthToken) error {
+	key, err := oauthTokenKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	row, err := token.encrypt(key)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.NamedQueryContext(ctx, upsertOAuthTokenSQL, row)
+	if err != nil {
+		return errors.Wrapf(err, "error saving OAuth token")
+	}
+	defer rows.Close()
+
+	rows.Next()
+	return errors.Wrapf(rows.Scan(&token.ID), "error reading saved OAuth token id")
+}
+
+const selectOAuthTokenForUpdateSQL = `
+SELECT id, org_id, integration, token_url, client_id, client_secret, access_token, refresh_token, expires_on
+  FROM orgs_oauthtoken
+ WHERE org_id = $1 AND integration = $2
+   FOR UPDATE
+`
+
+const updateOAuthTokenSQL = `
+UPDATE orgs_oauthtoken
+   SET access_token = :access_token, refresh_token = :refresh_token, expires_on = :expires_on, modified_on = NOW()
+ WHERE id = :id
+`
+
+// GetOAuthAccessToken is the helper which services needing authenticated calls use to get a current access token for
+// an org integration. If the stored token has expired or is about to, it's refreshed first.
+func GetOAuthAccessToken(ctx context.Context, db *sqlx.DB, cfg *config.Config, orgID OrgID, integration string) (string, error) {
+	token, err := loadAndRefreshOAuthToken(ctx, db, cfg, orgID, integration, oauthTokenRefreshMargin)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+const selectExpiringOAuthTokensSQL = `
+SELECT org_id, integration
+  FROM orgs_oauthtoken
+ WHERE refresh_token != '' AND expires_on IS NOT NULL AND expires_on < $1
+ ORDER BY expires_on
+`
+
+// RefreshExpiringOAuthTokens refreshes all stored tokens which expire within the given duration, returning the number
+// refreshed. Failures are logged rather than returned so that one bad integration doesn't block the others.
+func RefreshExpiringOAuthTokens(ctx context.Context, db *sqlx.DB, cfg *config.Config, within time.Duration) (int, error) {
+	rows, err := db.QueryxContext(ctx, selectExpiringOAuthTokensSQL, time.Now().Add(within))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error selecting expiring OAuth tokens")
+	}
+	defer rows.Close()
+
+	type expiring struct {
+		OrgID       OrgID  `db:"org_id"`
+		Integration string `db:"integration"`
+	}
+	tokens := make([]*expiring, 0, 10)
+	for rows.Next() {
+		e := &expiring{}
+		if err := rows.StructScan(e); err != nil {
+			return 0, errors.Wrapf(err, "error scanning expiring OAuth token")
+		}
+		tokens = append(tokens, e)
+	}
+
+	refreshed := 0
+	for _, e := range tokens {
+		if _, err := loadAndRefreshOAuthToken(ctx, db, cfg, e.OrgID, e.Integration, within); err != nil {
+			logrus.WithError(err).WithField("org_id", e.OrgID).WithField("integration", e.Integration).Error("error refreshing OAuth token")
+			continue
+		}
+		refreshed++
+	}
+
+	return refreshed, nil
+}
+
+// loads the token for the given org and integration, refreshing it if it expires within the given duration. The row is
+// locked while we refresh so that concurrent callers don't use the same refresh token twice.
+func loadAndRefreshOAuthToken(ctx context.Context, db *sqlx.DB, cfg *config.Config, orgID OrgID, integration string, within time.Duration) (*OAuthToken, error) {
+	key, err := oauthTokenKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	row := &dbOAuthToken{}
+	err = tx.GetContext(ctx, row, selectOAuthTokenForUpdateSQL, orgID, integration)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoOAuthToken
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading OAuth token")
+	}
+
+	token, err := row.decrypt(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ExpiresOn == nil || time.Now().Add(within).Before(*token.ExpiresOn) {
+		return token, nil
+	}
+
+	if err := token.refresh(); err != nil {
+		return nil, errors.Wrapf(err, "error refreshing OAuth token for %s", integration)
+	}
+
+	if row, err = token.encrypt(key); err != nil {
+		return nil, err
+	}
+	if _, err := tx.NamedExecContext(ctx, updateOAuthTokenSQL, row); err != nil {
+		return nil, errors.Wrapf(err, "error updating refreshed OAuth token")
+	}
+
+	return token, errors.Wrapf(tx.Commit(), "error committing refreshed OAuth token")
+}
+
+// refreshes this token using its refresh token
+func (t *OAuthToken) refresh() error {
+	if t.RefreshToken == "" {
+		return errors.New("token has expired and has no refresh token")
+	}
+
+	form := url.Values{"grant_type": []string{"refresh_token"}, "refresh_token": []string{t.RefreshToken}}
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+	request, err := httpx.NewRequest(http.MethodPost, t.TokenURL, strings.NewReader(form.Encode()), headers)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(t.ClientID, t.ClientSecret)
+
+	trace, err := httpx.DoTrace(oauthHTTPClient, request, nil, nil, -1)
+	if err != nil {
+		return errors.Wrapf(err, "error requesting token")
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return errors.Errorf("token request returned status %d", trace.Response.StatusCode)
+	}
+
+	payload := &struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}{}
+	if err := jsonx.Unmarshal(trace.ResponseBody, payload); err != nil {
+		return errors.Wrapf(err, "error unmarshalling token response")
+	}
+	if payload.AccessToken == "" {
+		return errors.New("token response has no access token")
+	}
+
+	t.AccessToken = payload.AccessToken
+
+	// providers which rotate refresh tokens give us a new one
+	if payload.RefreshToken != "" {
+		t.RefreshToken = payload.RefreshToken
+	}
+
+	if payload.ExpiresIn > 0 {
+		expiresOn := time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+		t.ExpiresOn = &expiresOn
+	} else {
+		t.ExpiresOn = nil
+	}
+	return nil
+}
+
+func (t *OAuthToken) encrypt(key []byte) (*dbOAuthToken, error) {
+	row := &dbOAuthToken{ID: t.ID, OrgID: t.OrgID, Integration: t.Integration, TokenURL: t.TokenURL, ClientID: t.ClientID, ExpiresOn: t.ExpiresOn}
+
+	var err error
+	if row.ClientSecret, err = encryptSecret(key, t.ClientSecret); err != nil {
+		return nil, err
+	}
+	if row.AccessToken, err = encryptSecret(key, t.AccessToken); err != nil {
+		return nil, err
+	}
+	if row.RefreshToken, err = encryptSecret(key, t.RefreshToken); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func (r *dbOAuthToken) decrypt(key []byte) (*OAuthToken, error) {
+	token := &OAuthToken{ID: r.ID, OrgID: r.OrgID, Integration: r.Integration, TokenURL: r.TokenURL, ClientID: r.ClientID, ExpiresOn: r.ExpiresOn}
+
+	var err error
+	if token.ClientSecret, err = decryptSecret(key, r.ClientSecret); err != nil {
+		return nil, err
+	}
+	if token.AccessToken, err = decryptSecret(key, r.AccessToken); err != nil {
+		return nil, err
+	}
+	if token.RefreshToken, err = decryptSecret(key, r.RefreshToken); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func oauthTokenKey(cfg *config.Config) ([]byte, error) {
+	key, err := cfg.ParseOAuthTokenKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("OAuth token storage is not configured")
+	}
+	return key, nil
+}
+
+// encrypts the given secret using AES-GCM, returning the base64 encoded nonce and ciphertext. Empty secrets are left
+// empty so that we can still tell which tokens have refresh tokens.
+func encryptSecret(key []byte, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrapf(err, "error generating nonce")
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func decryptSecret(key []byte, encrypted string) (string, error) {
+	if encrypted == "" {
+		return "", nil
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "error decrypting secret")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthTokens(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://auth.example.com/token": {
+			httpx.NewMockResponse(200, nil, `{"access_token": "new-access", "refresh_token": "new-refresh", "expires_in": 3600}`),
+			httpx.NewMockResponse(400, nil, `{"error": "invalid_grant"}`),
+			httpx.NewMockResponse(400, nil, `{"error": "invalid_grant"}`),
+		},
+	}))
+
+	cfg := config.NewMailroomConfig()
+
+	// without a key configured, we can't store tokens
+	err := models.SaveOAuthToken(ctx, db, cfg, &models.OAuthToken{OrgID: testdata.Org1.ID, Integration: "crm"})
+	assert.EqualError(t, err, "OAuth token storage is not configured")
+
+	cfg.OAuthTokenKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	expiresSoon := time.Now().Add(time.Minute)
+	expiresLater := time.Now().Add(time.Hour)
+
+	crm := &models.OAuthToken{OrgID: testdata.Org1.ID, Integration: "crm", TokenURL: "https://auth.example.com/token", ClientID: "abc", ClientSecret: "xyz", AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresOn: &expiresSoon}
+	sheets := &models.OAuthToken{OrgID: testdata.Org1.ID, Integration: "sheets", TokenURL: "https://auth.example.com/token", ClientID: "abc", ClientSecret: "xyz", AccessToken: "sheets-access", RefreshToken: "sheets-refresh", ExpiresOn: &expiresLater}
+	bad := &models.OAuthToken{OrgID: testdata.Org2.ID, Integration: "crm", TokenURL: "https://auth.example.com/token", ClientID: "abc", ClientSecret: "xyz", AccessToken: "bad-access", RefreshToken: "bad-refresh", ExpiresOn: &expiresSoon}
+
+	for _, token := range []*models.OAuthToken{crm, sheets, bad} {
+		require.NoError(t, models.SaveOAuthToken(ctx, db, cfg, token))
+		assert.NotEqual(t, models.OAuthTokenID(0), token.ID)
+	}
+
+	// secrets are encrypted at rest
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM orgs_oauthtoken WHERE access_token LIKE '%access' OR refresh_token LIKE '%refresh' OR client_secret = 'xyz'`, nil, 0)
+
+	// token which isn't about to expire is returned as is
+	access, err := models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org1.ID, "sheets")
+	assert.NoError(t, err)
+	assert.Equal(t, "sheets-access", access)
+
+	// token which is about to expire is refreshed
+	access, err = models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org1.ID, "crm")
+	assert.NoError(t, err)
+	assert.Equal(t, "new-access", access)
+
+	access, err = models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org1.ID, "crm")
+	assert.NoError(t, err)
+	assert.Equal(t, "new-access", access)
+
+	_, err = models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org1.ID, "tickets")
+	assert.Equal(t, models.ErrNoOAuthToken, err)
+
+	// org 2's token fails to refresh but that doesn't stop the refresh of others
+	refreshed, err := models.RefreshExpiringOAuthTokens(ctx, db, cfg, time.Minute*10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, refreshed)
+
+	_, err = models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org2.ID, "crm")
+	assert.EqualError(t, err, "error refreshing OAuth token for crm: token request returned status 400")
+
+	// a different key can't decrypt our tokens
+	cfg.OAuthTokenKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+	_, err = models.GetOAuthAccessToken(ctx, db, cfg, testdata.Org1.ID, "sheets")
+	assert.EqualError(t, err, "error decrypting secret: cipher: message authentication failed")
+}
@@ -9,12 +9,14 @@ import (
 	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/services/airtime/dtone"
@@ -62,15 +64,38 @@ const (
 	// NilOrgID is the id 0 considered as nil org id
 	NilOrgID = OrgID(0)
 
+	configSMTP        = "smtp"
 	configSMTPServer  = "smtp_server"
 	configDTOneKey    = "dtone_key"
 	configDTOneSecret = "dtone_secret"
 
 	configSessionStorageMode = "session_storage_mode"
+	configRegion             = "region"
+
+	configLookupService       = "lookup_service"
+	configLookupCarrierField  = "lookup_carrier_field"
+	configLookupLineTypeField = "lookup_line_type_field"
+
+	configArchiveInactiveMonths = "archive_inactive_months"
+	configTestContactsGroup     = "test_contacts_group"
+	configShadowFlows           = "shadow_flows"
+	configTriggerSplits         = "trigger_splits"
+	configReports               = "reports"
+	configCampaignRepeats       = "campaign_repeats"
+	configDuplicateMsgWindow    = "duplicate_msg_window"
+	configMsgPriorities         = "msg_priorities"
+	configChannelStickiness     = "channel_stickiness"
+	configContactWebhook        = "contact_webhook"
+	configGroupChangesResthook  = "group_changes_resthook"
+	configUsageBudgets          = "usage_budgets"
+	configEventSubscriptions    = "event_subscriptions"
+	configIdentityLinking       = "identity_linking"
+	configTemporaryValues       = "temporary_values"
 
 	DBSessions      = SessionStorageMode("db")
 	S3Sessions      = SessionStorageMode("s3")
 	S3WriteSessions = SessionStorageMode("s3_write")
+	S3OnlySessions  = SessionStorageMode("s3_only")
 )
 
 // Org is mailroom's type for RapidPro orgs. It also implements the envs.Environment interface for GoFlow
@@ -81,7 +106,8 @@ type Org struct {
 		UsesTopups bool     `json:"uses_topups"`
 		Config     null.Map `json:"config"`
 	}
-	env envs.Environment
+	env            envs.Environment
+	channelRouting []*ChannelRoutingRule
 }
 
 // ID returns the id of the org
@@ -93,8 +119,248 @@ func (o *Org) Suspended() bool { return o.o.Suspended }
 // UsesTopups returns whether the org uses topups
 func (o *Org) UsesTopups() bool { return o.o.UsesTopups }
 
+// SessionStorageMode returns how this org's sessions are persisted, falling back to the configured default
 func (o *Org) SessionStorageMode() SessionStorageMode {
-	return SessionStorageMode(o.ConfigValue(configSessionStorageMode, string(DBSessions)))
+	return SessionStorageMode(o.ConfigValue(configSessionStorageMode, config.Mailroom.SessionStorageMode))
+}
+
+// Region returns the data region this org's data must be stored in, or empty if it can be stored anywhere. Calls to
+// external services for the org are made to the regional hosts of those services configured for the region.
+func (o *Org) Region() string {
+	return o.ConfigValue(configRegion, "")
+}
+
+// ArchiveInactiveMonths returns the number of months after which contacts who haven't been seen are archived, or zero
+// if contacts should never be archived automatically
+func (o *Org) ArchiveInactiveMonths() int {
+	switch v := o.o.Config.Map()[configArchiveInactiveMonths].(type) {
+	case float64:
+		return int(v)
+	case string:
+		months, _ := strconv.Atoi(v)
+		return months
+	}
+	return 0
+}
+
+// DuplicateMsgWindow returns the period within which identical outgoing messages to the same contact are suppressed,
+// or zero if duplicate messages should always be sent
+func (o *Org) DuplicateMsgWindow() time.Duration {
+	switch v := o.o.Config.Map()[configDuplicateMsgWindow].(type) {
+	case float64:
+		return time.Duration(v) * time.Second
+	case string:
+		seconds, _ := strconv.Atoi(v)
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// ChannelStickiness returns how long after a contact messages us on a channel that replies to them should prefer that
+// channel, or zero if replies should always use the normal channel selection
+func (o *Org) ChannelStickiness() time.Duration {
+	switch v := o.o.Config.Map()[configChannelStickiness].(type) {
+	case float64:
+		return time.Duration(v) * time.Second
+	case string:
+		seconds, _ := strconv.Atoi(v)
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// TestContactsGroup returns the UUID of the group whose members are test contacts, or empty if this org has none
+func (o *Org) TestContactsGroup() assets.GroupUUID {
+	return assets.GroupUUID(o.ConfigValue(configTestContactsGroup, ""))
+}
+
+// ShadowFlow is a version of a flow which is run in shadow alongside the active version for a percentage of messages
+type ShadowFlow struct {
+	FlowUUID assets.FlowUUID `json:"flow_uuid"`
+	Percent  int             `json:"percent"`
+}
+
+// ShadowFlow returns the shadow flow configured for the passed in flow, or nil if it has none
+func (o *Org) ShadowFlow(flowUUID assets.FlowUUID) *ShadowFlow {
+	raw, found := o.o.Config.Map()[configShadowFlows]
+	if !found {
+		return nil
+	}
+
+	shadows := make(map[assets.FlowUUID]*ShadowFlow)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &shadows)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid shadow flows config")
+		return nil
+	}
+
+	shadow := shadows[flowUUID]
+	if shadow == nil || shadow.FlowUUID == "" || shadow.Percent <= 0 {
+		return nil
+	}
+	return shadow
+}
+
+// TriggerSplit is an alternative flow which a trigger sends a percentage of contacts to
+type TriggerSplit struct {
+	FlowID  FlowID `json:"flow_id"`
+	Percent int    `json:"percent"`
+}
+
+// TriggerSplit returns the split configured for the passed in trigger, or nil if it has none
+func (o *Org) TriggerSplit(triggerID TriggerID) *TriggerSplit {
+	raw, found := o.o.Config.Map()[configTriggerSplits]
+	if !found {
+		return nil
+	}
+
+	splits := make(map[string]*TriggerSplit)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &splits)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid trigger splits config")
+		return nil
+	}
+
+	split := splits[strconv.Itoa(int(triggerID))]
+	if split == nil || split.FlowID == NilFlowID || split.Percent <= 0 {
+		return nil
+	}
+	return split
+}
+
+// CampaignRepeat returns the repeat configured for the passed in campaign event, or nil if it doesn't repeat
+func (o *Org) CampaignRepeat(eventID CampaignEventID) *CampaignRepeat {
+	raw, found := o.o.Config.Map()[configCampaignRepeats]
+	if !found {
+		return nil
+	}
+
+	repeats := make(map[string]*CampaignRepeat)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &repeats)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid campaign repeats config")
+		return nil
+	}
+
+	repeat := repeats[strconv.Itoa(int(eventID))]
+	if repeat == nil || !repeat.valid() {
+		return nil
+	}
+	return repeat
+}
+
+// MsgPriorities returns how this org's outgoing messages are assigned to priority classes and which of those are sent
+// at high priority, which will be the defaults if the org hasn't configured its own
+func (o *Org) MsgPriorities() *MsgPriorities {
+	priorities := &MsgPriorities{}
+
+	raw, found := o.o.Config.Map()[configMsgPriorities]
+	if found {
+		b, err := jsonx.Marshal(raw)
+		if err == nil {
+			err = jsonx.Unmarshal(b, priorities)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid msg priorities config")
+			priorities = &MsgPriorities{}
+		}
+	}
+
+	// fill in any classes not configured by the org with our defaults
+	highPriority := make(map[MsgPriorityClass]bool, len(defaultMsgHighPriority))
+	for class, high := range defaultMsgHighPriority {
+		highPriority[class] = high
+	}
+	for class, high := range priorities.HighPriority {
+		highPriority[class] = high
+	}
+	priorities.HighPriority = highPriority
+
+	return priorities
+}
+
+// ContactWebhook returns where this org's contact changes are delivered, or nil if they aren't
+func (o *Org) ContactWebhook() *ContactWebhook {
+	webhook := &ContactWebhook{}
+	found, err := o.ConfigObject(configContactWebhook, webhook)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid contact webhook config")
+		return nil
+	}
+	if !found || webhook.URL == "" {
+		return nil
+	}
+	return webhook
+}
+
+// GroupChangesResthook returns the slug of the resthook which is notified when contacts enter or leave dynamic groups,
+// or empty if no resthook is notified
+func (o *Org) GroupChangesResthook() string {
+	return o.ConfigValue(configGroupChangesResthook, "")
+}
+
+// UsageBudgets returns this org's monthly budgets for calls to external services, or nil if it doesn't have any
+func (o *Org) UsageBudgets() *UsageBudgets {
+	budgets := &UsageBudgets{}
+	found, err := o.ConfigObject(configUsageBudgets, budgets)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid usage budgets config")
+		return nil
+	}
+	if !found || len(budgets.Budgets) == 0 {
+		return nil
+	}
+	if len(budgets.WarnAt) == 0 {
+		budgets.WarnAt = defaultUsageWarnAt
+	}
+	return budgets
+}
+
+// EventSubscriptions returns the rules for starting flows when external systems post events to this org
+func (o *Org) EventSubscriptions() []*EventSubscription {
+	subscriptions := make([]*EventSubscription, 0)
+	if _, err := o.ConfigObject(configEventSubscriptions, &subscriptions); err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid event subscriptions config")
+		return nil
+	}
+	return subscriptions
+}
+
+// IdentityLinking returns how this org links contacts which are the same person, or nil if it doesn't
+func (o *Org) IdentityLinking() *IdentityLinking {
+	linking := &IdentityLinking{}
+	found, err := o.ConfigObject(configIdentityLinking, linking)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid identity linking config")
+		return nil
+	}
+	if !found || (len(linking.Fields) == 0 && !linking.LinkCodes) {
+		return nil
+	}
+	return linking
+}
+
+// TemporaryValues returns the fields and groups of this org whose values expire, or nil if it doesn't have any
+func (o *Org) TemporaryValues() *TemporaryValues {
+	values := &TemporaryValues{}
+	found, err := o.ConfigObject(configTemporaryValues, values)
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid temporary values config")
+		return nil
+	}
+	if !found || (len(values.Fields) == 0 && len(values.Groups) == 0) {
+		return nil
+	}
+	return values
 }
 
 // DateFormat returns the date format for this org
@@ -152,6 +418,9 @@ func (o *Org) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+
+	// routing rules are checked for every message we send so are only parsed once
+	o.channelRouting = o.parseChannelRoutingRules()
 	return nil
 }
 
@@ -160,14 +429,79 @@ func (o *Org) ConfigValue(key string, def string) string {
 	return o.o.Config.GetString(key, def)
 }
 
+// ConfigValues returns all the string config values whose keys start with the passed in prefix, keyed without the prefix
+func (o *Org) ConfigValues(prefix string) map[string]string {
+	values := make(map[string]string)
+	for key, value := range o.o.Config.Map() {
+		strValue, isString := value.(string)
+		if isString && strings.HasPrefix(key, prefix) {
+			values[strings.TrimPrefix(key, prefix)] = strValue
+		}
+	}
+	return values
+}
+
+// ConfigObject unmarshals the structured config value for the passed in key into v, returning false if it isn't set
+func (o *Org) ConfigObject(key string, v interface{}) (bool, error) {
+	raw, found := o.o.Config.Map()[key]
+	if !found {
+		return false, nil
+	}
+
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, v)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid %s config", key)
+	}
+	return true, nil
+}
+
 // EmailService returns the email service for this org
 func (o *Org) EmailService(httpClient *http.Client) (flows.EmailService, error) {
-	connectionURL := o.ConfigValue(configSMTPServer, config.Mailroom.SMTPServer)
+	connectionURL, err := o.smtpConnectionURL()
+	if err != nil {
+		return nil, err
+	}
+	return smtp.NewService(connectionURL, emailRetries)
+}
+
+// SendEmail sends a plain text email to the passed in addresses using this org's SMTP configuration
+func (o *Org) SendEmail(addresses []string, subject, body string) error {
+	connectionURL, err := o.smtpConnectionURL()
+	if err != nil {
+		return err
+	}
+
+	return sendEmail(connectionURL, addresses, subject, body, emailRetries)
+}
+
+// gets the SMTP server to send this org's emails, which is its own SMTP settings if it has them, otherwise its SMTP
+// server config or the global SMTP server
+func (o *Org) smtpConnectionURL() (string, error) {
+	settings, err := o.SMTPSettings(config.Mailroom)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid SMTP settings")
+	}
+	if settings != nil {
+		return settings.ConnectionURL(), nil
+	}
 
+	connectionURL := o.ConfigValue(configSMTPServer, config.Mailroom.SMTPServer)
 	if connectionURL == "" {
-		return nil, errors.New("missing SMTP configuration")
+		return "", errors.New("missing SMTP configuration")
 	}
-	return smtp.NewService(connectionURL, emailRetries)
+	return connectionURL, nil
+}
+
+func sendEmail(connectionURL string, addresses []string, subject, body string, retries *smtpx.RetryConfig) error {
+	client, err := smtpx.NewClientFromURL(connectionURL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid SMTP configuration")
+	}
+
+	return smtpx.Send(client, smtpx.NewMessage(addresses, subject, body, ""), retries)
 }
 
 // AirtimeService returns the airtime service for this org if one is configured
@@ -178,7 +512,26 @@ func (o *Org) AirtimeService(httpClient *http.Client, httpRetries *httpx.RetryCo
 	if key == "" || secret == "" {
 		return nil, errors.Errorf("missing %s or %s on DTOne configuration for org: %d", configDTOneKey, configDTOneSecret, o.ID())
 	}
-	return dtone.NewService(httpClient, httpRetries, key, secret), nil
+	return dtone.NewService(goflow.RegionalHTTP(config.Mailroom, httpClient, o.Region()), httpRetries, key, secret), nil
+}
+
+// LookupService returns the phone number lookup service for this org, or nil if one isn't configured
+func (o *Org) LookupService(httpClient *http.Client, httpRetries *httpx.RetryConfig) (LookupService, error) {
+	serviceType := o.ConfigValue(configLookupService, "")
+	if serviceType == "" {
+		return nil, nil
+	}
+
+	factory := lookupServices[serviceType]
+	if factory == nil {
+		return nil, errors.Errorf("unrecognized lookup service type '%s' for org: %d", serviceType, o.ID())
+	}
+	return factory(goflow.RegionalHTTP(config.Mailroom, httpClient, o.Region()), httpRetries, o.ConfigValues("lookup_"))
+}
+
+// LookupFields returns the keys of the contact fields where lookup carrier and line type should be saved, which may be empty
+func (o *Org) LookupFields() (string, string) {
+	return o.ConfigValue(configLookupCarrierField, ""), o.ConfigValue(configLookupLineTypeField, "")
 }
 
 // StoreAttachment saves an attachment to storage
@@ -207,6 +560,11 @@ func (o *Org) StoreAttachment(ctx context.Context, s storage.Storage, filename s
 	return utils.Attachment(contentType + ":" + url), nil
 }
 
+// AttachmentPath returns the path in media storage of an attachment with the given filename
+func (o *Org) AttachmentPath(filename string) string {
+	return o.attachmentPath(config.Mailroom.S3MediaPrefix, filename)
+}
+
 func (o *Org) attachmentPath(prefix string, filename string) string {
 	parts := []string{prefix, fmt.Sprintf("%d", o.ID())}
 
@@ -236,6 +594,38 @@ func orgFromSession(session flows.Session) *Org {
 	return session.Assets().Source().(*OrgAssets).Org()
 }
 
+const selectOrgIDsWithConfigSQL = `
+SELECT
+	id
+FROM
+	orgs_org
+WHERE
+	is_active = TRUE AND
+	config IS NOT NULL AND
+	(config::jsonb->>$1) IS NOT NULL
+ORDER BY
+	id ASC
+`
+
+// OrgIDsWithConfig returns the ids of all active orgs which have a value for the passed in config key
+func OrgIDsWithConfig(ctx context.Context, db Queryer, key string) ([]OrgID, error) {
+	rows, err := db.QueryxContext(ctx, selectOrgIDsWithConfigSQL, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting orgs with config: %s", key)
+	}
+	defer rows.Close()
+
+	orgIDs := make([]OrgID, 0, 10)
+	for rows.Next() {
+		var orgID OrgID
+		if err := rows.Scan(&orgID); err != nil {
+			return nil, errors.Wrapf(err, "error scanning org id")
+		}
+		orgIDs = append(orgIDs, orgID)
+	}
+	return orgIDs, nil
+}
+
 // LoadOrg loads the org for the passed in id, returning any error encountered
 func LoadOrg(ctx context.Context, cfg *config.Config, db sqlx.Queryer, orgID OrgID) (*Org, error) {
 	start := time.Now()
@@ -255,11 +645,32 @@ func LoadOrg(ctx context.Context, cfg *config.Config, db sqlx.Queryer, orgID Org
 		return nil, errors.Wrapf(err, "error unmarshalling org")
 	}
 
+	// an org whose data must stay in a region can't be used unless we have storage in that region
+	if region := org.Region(); region != "" {
+		if err := checkRegionConfigured(cfg, region); err != nil {
+			return nil, errors.Wrapf(err, "error loading org: %d", orgID)
+		}
+	}
+
 	logrus.WithField("elapsed", time.Since(start)).WithField("org_id", orgID).Debug("loaded org environment")
 
 	return org, nil
 }
 
+// checks that the passed in data region has storage configured
+func checkRegionConfigured(cfg *config.Config, region string) error {
+	regions, err := cfg.ParseS3Regions()
+	if err != nil {
+		return err
+	}
+	for _, r := range regions {
+		if r.Name == region {
+			return nil
+		}
+	}
+	return errors.Errorf("region '%s' has no configured storage", region)
+}
+
 const selectOrgByID = `
 SELECT ROW_TO_JSON(o) FROM (SELECT
 	id,
@@ -57,6 +57,19 @@ func TestOrgs(t *testing.T) {
 
 	_, err = models.LoadOrg(ctx, rt.Config, tx, 99)
 	assert.Error(t, err)
+
+	// orgs in a region we don't have storage for can't be loaded
+	tx.MustExec(`UPDATE orgs_org SET config = '{"region": "eu"}' WHERE id = $1`, testdata.Org2.ID)
+
+	_, err = models.LoadOrg(ctx, rt.Config, tx, testdata.Org2.ID)
+	assert.EqualError(t, err, "error loading org: 2: region 'eu' has no configured storage")
+
+	defer func() { rt.Config.S3Regions = "" }()
+	rt.Config.S3Regions = "eu:eu-west-1:eu-media:eu-sessions"
+
+	org, err = models.LoadOrg(ctx, rt.Config, tx, testdata.Org2.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu", org.Region())
 }
 
 func TestStoreAttachment(t *testing.T) {
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// the data which mailroom can leave orphaned if it crashes part way through something, and which is repaired by the
+// janitor. Each of these queries only returns rows that have been in that state long enough that they can't still be
+// being worked on.
+
+const selectStalledStartsSQL = `
+SELECT id FROM flows_flowstart WHERE status = 'P' AND modified_on < $1 ORDER BY id LIMIT $2`
+
+// LoadStalledStarts loads the ids of starts which are still pending though they were last modified before the given
+// time, which means their start task was lost
+func LoadStalledStarts(ctx context.Context, db Queryer, before time.Time, limit int) ([]StartID, error) {
+	ids := make([]StartID, 0, 10)
+	if err := db.SelectContext(ctx, &ids, selectStalledStartsSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading stalled starts")
+	}
+	return ids, nil
+}
+
+// MarkStartsFailed sets the status of the passed in flow starts to F
+func MarkStartsFailed(ctx context.Context, db Queryer, ids []StartID) error {
+	_, err := db.ExecContext(ctx, `UPDATE flows_flowstart SET status = 'F', modified_on = NOW() WHERE id = ANY($1)`, pq.Array(ids))
+	return errors.Wrapf(err, "error marking starts as failed")
+}
+
+const selectRunlessSessionsSQL = `
+SELECT s.id FROM flows_flowsession s
+ WHERE s.status = 'W' AND s.created_on < $1 AND NOT EXISTS (SELECT 1 FROM flows_flowrun r WHERE r.session_id = s.id)
+ ORDER BY s.id LIMIT $2`
+
+// LoadRunlessSessions loads the ids of waiting sessions created before the given time which don't have any runs, and so
+// can never be resumed
+func LoadRunlessSessions(ctx context.Context, db Queryer, before time.Time, limit int) ([]SessionID, error) {
+	ids := make([]SessionID, 0, 10)
+	if err := db.SelectContext(ctx, &ids, selectRunlessSessionsSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading runless sessions")
+	}
+	return ids, nil
+}
+
+const selectStalledMsgsSQL = `
+SELECT id FROM msgs_msg WHERE direction = 'O' AND status = 'I' AND created_on < $1 ORDER BY id LIMIT $2`
+
+// LoadStalledMsgs loads the ids of outgoing messages created before the given time which are still initializing, which
+// means they were never queued for sending
+func LoadStalledMsgs(ctx context.Context, db Queryer, before time.Time, limit int) ([]MsgID, error) {
+	ids := make([]MsgID, 0, 10)
+	if err := db.SelectContext(ctx, &ids, selectStalledMsgsSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading stalled messages")
+	}
+	return ids, nil
+}
+
+// MarkMessageIDsPending sets the status of the passed in messages to pending so that they are queued again, like
+// messages which couldn't be queued to courier
+func MarkMessageIDsPending(ctx context.Context, db Queryer, ids []MsgID) error {
+	_, err := db.ExecContext(ctx, `UPDATE msgs_msg SET status = 'P', modified_on = NOW() WHERE id = ANY($1) AND status = 'I'`, pq.Array(ids))
+	return errors.Wrapf(err, "error marking messages as pending")
+}
+
+const selectUnfiredEventFiresSQL = `
+SELECT id FROM campaigns_eventfire WHERE fired IS NULL AND scheduled < $1 ORDER BY scheduled, id LIMIT $2`
+
+// LoadUnfiredEventFires loads the ids of event fires scheduled before the given time which still haven't been fired
+func LoadUnfiredEventFires(ctx context.Context, db Queryer, before time.Time, limit int) ([]FireID, error) {
+	ids := make([]FireID, 0, 10)
+	if err := db.SelectContext(ctx, &ids, selectUnfiredEventFiresSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading unfired event fires")
+	}
+	return ids, nil
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Tables which are partitioned by month have a partition named by the table and month, e.g. msgs_msg_2021_06, holding
+// rows whose partition key falls in that month in UTC.
+//
+// We only maintain the partitions of tables which have been partitioned. Converting a table like msgs_msg to be
+// partitioned is left to a migration, which must also make its primary key and unique constraints include the
+// partition key, and deal with any foreign keys which reference it. Our writes to these tables don't change, so the
+// maintenance cron must keep partitions created ahead of the rows inserted into them.
+
+// MonthlyPartition returns the name of the monthly partition of the passed in table which holds rows for the passed in time
+func MonthlyPartition(table string, t time.Time) string {
+	return fmt.Sprintf("%s_%s", table, t.UTC().Format("2006_01"))
+}
+
+const selectIsPartitionedSQL = `
+SELECT EXISTS(
+	SELECT 1 FROM pg_partitioned_table pt INNER JOIN pg_class c ON c.oid = pt.partrelid WHERE c.relname = $1
+)
+`
+
+// IsPartitioned returns whether the passed in table exists and is partitioned
+func IsPartitioned(ctx context.Context, db Queryer, table string) (bool, error) {
+	var partitioned bool
+	err := db.GetContext(ctx, &partitioned, selectIsPartitionedSQL, table)
+	return partitioned, errors.Wrapf(err, "error checking whether %s is partitioned", table)
+}
+
+const createMonthlyPartitionSQL = `
+CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')
+`
+
+// returns the start of the month of the passed in time in UTC
+func monthOf(t time.Time) time.Time {
+	return time.Date(t.UTC().Year(), t.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func createMonthlyPartition(ctx context.Context, db Queryer, table string, month time.Time) error {
+	sql := fmt.Sprintf(createMonthlyPartitionSQL, MonthlyPartition(table, month), table, month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339))
+
+	_, err := db.ExecContext(ctx, sql)
+	return errors.Wrapf(err, "error creating partition of %s for %s", table, month.Format("2006-01"))
+}
+
+// CreateMonthlyPartitions makes sure that the passed in table has partitions for the current month and the given number
+// of months ahead, so that inserts never fail for lack of a partition
+func CreateMonthlyPartitions(ctx context.Context, db Queryer, table string, now time.Time, ahead int) error {
+	thisMonth := monthOf(now)
+
+	for i := 0; i <= ahead; i++ {
+		if err := createMonthlyPartition(ctx, db, table, thisMonth.AddDate(0, i, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const selectPartitionExistsSQL = `SELECT to_regclass($1) IS NOT NULL`
+
+// MissingMonthlyPartitions returns the names of the partitions of the passed in table for the current month and the
+// given number of months ahead which don't exist
+func MissingMonthlyPartitions(ctx context.Context, db Queryer, table string, now time.Time, ahead int) ([]string, error) {
+	thisMonth := monthOf(now)
+	missing := make([]string, 0)
+
+	for i := 0; i <= ahead; i++ {
+		partition := MonthlyPartition(table, thisMonth.AddDate(0, i, 0))
+
+		var exists bool
+		if err := db.GetContext(ctx, &exists, selectPartitionExistsSQL, partition); err != nil {
+			return nil, errors.Wrapf(err, "error checking for partition %s", partition)
+		}
+		if !exists {
+			missing = append(missing, partition)
+		}
+	}
+	return missing, nil
+}
+
+const selectPartitionsSQL = `
+SELECT
+	c.relname
+FROM
+	pg_inherits i
+	INNER JOIN pg_class c ON c.oid = i.inhrelid
+	INNER JOIN pg_class p ON p.oid = i.inhparent
+WHERE
+	p.relname = $1
+ORDER BY
+	c.relname
+`
+
+// MonthlyPartitionsBefore returns the names of the attached partitions of the passed in table for months which are
+// entirely before the given number of retention months
+func MonthlyPartitionsBefore(ctx context.Context, db Queryer, table string, now time.Time, retentionMonths int) ([]string, error) {
+	rows, err := db.QueryxContext(ctx, selectPartitionsSQL, table)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting partitions of %s", table)
+	}
+	defer rows.Close()
+
+	thisMonth := monthOf(now)
+
+	// partition names sort by month so anything before the oldest partition we keep is expired
+	oldestKept := MonthlyPartition(table, thisMonth.AddDate(0, -retentionMonths, 0))
+
+	expired := make([]string, 0, 1)
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			return nil, errors.Wrapf(err, "error scanning partition of %s", table)
+		}
+		if partition < oldestKept {
+			expired = append(expired, partition)
+		}
+	}
+	return expired, nil
+}
+
+// DropMonthlyPartitions drops the partitions of the passed in table older than the given number of retention months
+func DropMonthlyPartitions(ctx context.Context, db Queryer, table string, now time.Time, retentionMonths int) error {
+	expired, err := MonthlyPartitionsBefore(ctx, db, table, now, retentionMonths)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range expired {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s`, partition)); err != nil {
+			return errors.Wrapf(err, "error dropping partition %s", partition)
+		}
+		logrus.WithField("table", table).WithField("partition", partition).Info("dropped expired partition")
+	}
+	return nil
+}
+
+// DetachMonthlyPartitions detaches the partitions of the passed in table older than the given number of retention months.
+// Detached partitions remain as standalone tables with the same name so that they can be archived and dropped.
+func DetachMonthlyPartitions(ctx context.Context, db Queryer, table string, now time.Time, retentionMonths int) error {
+	expired, err := MonthlyPartitionsBefore(ctx, db, table, now, retentionMonths)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range expired {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s DETACH PARTITION %s`, table, partition)); err != nil {
+			return errors.Wrapf(err, "error detaching partition %s", partition)
+		}
+		logrus.WithField("table", table).WithField("partition", partition).Info("detached expired partition")
+	}
+	return nil
+}
+
+const selectReferencingTablesSQL = `
+  SELECT DISTINCT c.relname
+    FROM pg_constraint fk
+         INNER JOIN pg_class c ON c.oid = fk.conrelid
+         INNER JOIN pg_class r ON r.oid = fk.confrelid
+   WHERE fk.contype = 'f' AND r.relname = $1 AND c.relname != $1
+ORDER BY c.relname
+`
+
+// ReferencingTables returns the names of the other tables with foreign keys to the passed in table
+func ReferencingTables(ctx context.Context, db Queryer, table string) ([]string, error) {
+	tables := make([]string, 0)
+	err := db.SelectContext(ctx, &tables, selectReferencingTablesSQL, table)
+	return tables, errors.Wrapf(err, "error selecting tables referencing %s", table)
+}
+
+// MaintainPartitionedTable creates upcoming partitions of the passed in table and, if a number of retention months is
+// given, detaches old ones. Tables which aren't partitioned are left alone, and partitions of tables which other tables
+// have foreign keys to are never detached as that would fail or leave those rows referencing detached rows.
+func MaintainPartitionedTable(ctx context.Context, db Queryer, table string, now time.Time, ahead, retentionMonths int) error {
+	partitioned, err := IsPartitioned(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		logrus.WithField("table", table).Warn("table configured as partitioned isn't, skipping maintenance")
+		return nil
+	}
+
+	if err := CreateMonthlyPartitions(ctx, db, table, now, ahead); err != nil {
+		return err
+	}
+
+	if retentionMonths <= 0 {
+		return nil
+	}
+
+	referencing, err := ReferencingTables(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if len(referencing) > 0 {
+		logrus.WithField("table", table).WithField("referenced_by", referencing).Error("table has foreign keys to it, not detaching expired partitions")
+		return nil
+	}
+
+	return DetachMonthlyPartitions(ctx, db, table, now, retentionMonths)
+}
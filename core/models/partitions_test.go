@@ -0,0 +1,104 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintainPartitionedTable(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	now := time.Date(2021, 6, 23, 15, 30, 0, 0, time.UTC)
+
+	assert.Equal(t, "msgs_msg_2021_06", models.MonthlyPartition("msgs_msg", now))
+
+	// tables which aren't partitioned are left alone
+	partitioned, err := models.IsPartitioned(ctx, db, "msgs_msg")
+	require.NoError(t, err)
+	assert.False(t, partitioned)
+
+	err = models.MaintainPartitionedTable(ctx, db, "msgs_msg", now, 2, 3)
+	require.NoError(t, err)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM pg_class WHERE relname = 'msgs_msg_2021_06'`, nil, 0)
+
+	db.MustExec(`CREATE TABLE test_events (id serial, created_on timestamp with time zone NOT NULL) PARTITION BY RANGE (created_on)`)
+	db.MustExec(`CREATE TABLE test_events_2020_12 PARTITION OF test_events FOR VALUES FROM ('2020-12-01') TO ('2021-01-01')`)
+	db.MustExec(`CREATE TABLE test_events_2021_03 PARTITION OF test_events FOR VALUES FROM ('2021-03-01') TO ('2021-04-01')`)
+
+	partitioned, err = models.IsPartitioned(ctx, db, "test_events")
+	require.NoError(t, err)
+	assert.True(t, partitioned)
+
+	// without any retention, nothing is detached
+	err = models.MaintainPartitionedTable(ctx, db, "test_events", now, 2, 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"test_events_2020_12", "test_events_2021_03", "test_events_2021_06", "test_events_2021_07", "test_events_2021_08"}, attachedPartitions(t, db, "test_events"))
+
+	// inserts are routed to the partition for their month
+	db.MustExec(`INSERT INTO test_events(created_on) VALUES('2021-07-04T12:00:00Z')`)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM test_events_2021_07`, nil, 1)
+
+	// with retention, old partitions are detached but not dropped
+	err = models.MaintainPartitionedTable(ctx, db, "test_events", now, 2, 3)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"test_events_2021_03", "test_events_2021_06", "test_events_2021_07", "test_events_2021_08"}, attachedPartitions(t, db, "test_events"))
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM pg_class WHERE relname = 'test_events_2020_12'`, nil, 1)
+
+	// and running again is a noop
+	err = models.MaintainPartitionedTable(ctx, db, "test_events", now, 2, 3)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"test_events_2021_03", "test_events_2021_06", "test_events_2021_07", "test_events_2021_08"}, attachedPartitions(t, db, "test_events"))
+
+	// partitions of a table which other tables reference aren't detached
+	db.MustExec(`CREATE TABLE test_msgs (id serial, created_on timestamp with time zone NOT NULL, PRIMARY KEY (id, created_on)) PARTITION BY RANGE (created_on)`)
+	db.MustExec(`CREATE TABLE test_msgs_2020_12 PARTITION OF test_msgs FOR VALUES FROM ('2020-12-01') TO ('2021-01-01')`)
+	db.MustExec(`CREATE TABLE test_labels (msg_id integer NOT NULL, msg_created_on timestamp with time zone NOT NULL, FOREIGN KEY (msg_id, msg_created_on) REFERENCES test_msgs(id, created_on))`)
+
+	referencing, err := models.ReferencingTables(ctx, db, "test_msgs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_labels"}, referencing)
+
+	err = models.MaintainPartitionedTable(ctx, db, "test_msgs", now, 0, 3)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"test_msgs_2020_12", "test_msgs_2021_06"}, attachedPartitions(t, db, "test_msgs"))
+}
+
+func TestMissingMonthlyPartitions(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	now := time.Date(2021, 6, 23, 15, 30, 0, 0, time.UTC)
+
+	db.MustExec(`CREATE TABLE test_events (id serial, created_on timestamp with time zone NOT NULL) PARTITION BY RANGE (created_on)`)
+	db.MustExec(`CREATE TABLE test_events_2021_06 PARTITION OF test_events FOR VALUES FROM ('2021-06-01') TO ('2021-07-01')`)
+
+	missing, err := models.MissingMonthlyPartitions(ctx, db, "test_events", now, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_events_2021_07", "test_events_2021_08"}, missing)
+
+	err = models.CreateMonthlyPartitions(ctx, db, "test_events", now, 2)
+	require.NoError(t, err)
+
+	missing, err = models.MissingMonthlyPartitions(ctx, db, "test_events", now, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, missing)
+}
+
+func attachedPartitions(t *testing.T, db *sqlx.DB, table string) []string {
+	var partitions []string
+	err := db.Select(&partitions, `SELECT c.relname FROM pg_inherits i INNER JOIN pg_class c ON c.oid = i.inhrelid INNER JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = $1 ORDER BY c.relname`, table)
+	require.NoError(t, err)
+	return partitions
+}
@@ -0,0 +1,247 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReportType is the type of a scheduled report
+type ReportType string
+
+// report type constants
+const (
+	ReportTypeFlowResults = ReportType("flow_results")
+	ReportTypeMsgVolumes  = ReportType("msg_volumes")
+	ReportTypeTicketSLA   = ReportType("ticket_sla")
+)
+
+// ReportSchedule is how often a scheduled report is generated
+type ReportSchedule string
+
+// report schedule constants
+const (
+	ReportScheduleDaily   = ReportSchedule("daily")
+	ReportScheduleWeekly  = ReportSchedule("weekly")
+	ReportScheduleMonthly = ReportSchedule("monthly")
+)
+
+// Report is a recurring report defined by an org's admins. Each report covers the last complete period of its schedule
+// and is delivered by email to its recipients, stored to S3, or both.
+type Report struct {
+	UUID     uuids.UUID      `json:"uuid"`
+	Name     string          `json:"name"`
+	Type     ReportType      `json:"type"`
+	Schedule ReportSchedule  `json:"schedule"`
+	FlowUUID assets.FlowUUID `json:"flow_uuid,omitempty"`
+	Emails   []string        `json:"emails,omitempty"`
+	Store    bool            `json:"store,omitempty"`
+}
+
+// Validate checks that this report can be generated
+func (r *Report) Validate() error {
+	switch r.Type {
+	case ReportTypeFlowResults:
+		if r.FlowUUID == "" {
+			return errors.Errorf("flow results report %s has no flow", r.UUID)
+		}
+	case ReportTypeMsgVolumes, ReportTypeTicketSLA:
+	default:
+		return errors.Errorf("report %s has unknown type: %s", r.UUID, r.Type)
+	}
+
+	switch r.Schedule {
+	case ReportScheduleDaily, ReportScheduleWeekly, ReportScheduleMonthly:
+	default:
+		return errors.Errorf("report %s has unknown schedule: %s", r.UUID, r.Schedule)
+	}
+
+	if len(r.Emails) == 0 && !r.Store {
+		return errors.Errorf("report %s has no emails and isn't stored", r.UUID)
+	}
+	return nil
+}
+
+// LastPeriod returns the start and end of the last complete period of this report's schedule before now. Days start at
+// midnight and weeks on Monday in the passed in timezone.
+func (r *Report) LastPeriod(now time.Time, tz *time.Location) (time.Time, time.Time) {
+	now = now.In(tz)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+
+	switch r.Schedule {
+	case ReportScheduleWeekly:
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		end := today.AddDate(0, 0, -daysSinceMonday)
+		return end.AddDate(0, 0, -7), end
+	case ReportScheduleMonthly:
+		end := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, tz)
+		return end.AddDate(0, -1, 0), end
+	default:
+		return today.AddDate(0, 0, -1), today
+	}
+}
+
+// Reports returns the scheduled reports configured for this org, ignoring any which are invalid
+func (o *Org) Reports() []*Report {
+	raw, found := o.o.Config.Map()[configReports]
+	if !found {
+		return nil
+	}
+
+	reports := make([]*Report, 0, 2)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &reports)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid reports config")
+		return nil
+	}
+
+	valid := make([]*Report, 0, len(reports))
+	for _, r := range reports {
+		if err := r.Validate(); err != nil {
+			logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid report config")
+			continue
+		}
+		valid = append(valid, r)
+	}
+	return valid
+}
+
+// counts of each category of each result saved by runs of a flow
+const selectFlowResultsReportSQL = `
+SELECT
+  r.value->>'name' AS result,
+  COALESCE(r.value->>'category', '') AS category,
+  COUNT(*) AS count
+FROM
+  flows_flowrun fr,
+  jsonb_each(fr.results::jsonb) r
+WHERE
+  fr.org_id = $1 AND
+  fr.flow_id = $2 AND
+  fr.created_on >= $3 AND
+  fr.created_on < $4
+GROUP BY
+  1, 2
+ORDER BY
+  1, 2
+`
+
+// counts of messages in each direction on each channel for each day
+const selectMsgVolumesReportSQL = `
+SELECT
+  (m.created_on AT TIME ZONE $4)::date::text AS day,
+  COALESCE(c.name, '') AS channel,
+  m.direction AS direction,
+  COUNT(*) AS count
+FROM
+  msgs_msg m
+  LEFT OUTER JOIN channels_channel c ON c.id = m.channel_id
+WHERE
+  m.org_id = $1 AND
+  m.created_on >= $2 AND
+  m.created_on < $3
+GROUP BY
+  1, 2, 3
+ORDER BY
+  1, 2, 3
+`
+
+// how quickly the tickets opened on each ticketer were closed
+const selectTicketSLAReportSQL = `
+SELECT
+  tk.name AS ticketer,
+  COUNT(*) AS opened,
+  COUNT(t.closed_on) AS closed,
+  COUNT(*) FILTER (WHERE t.closed_on - t.opened_on <= INTERVAL '24 hours') AS closed_within_24h,
+  COALESCE(ROUND((AVG(EXTRACT(EPOCH FROM t.closed_on - t.opened_on)) / 3600)::numeric, 1), 0)::text AS avg_hours_to_close
+FROM
+  tickets_ticket t
+  INNER JOIN tickets_ticketer tk ON tk.id = t.ticketer_id
+WHERE
+  t.org_id = $1 AND
+  t.opened_on >= $2 AND
+  t.opened_on < $3
+GROUP BY
+  1
+ORDER BY
+  1
+`
+
+// GenerateReport generates the rows of the passed in report for the period between start and end, the first row being
+// the column headers
+func GenerateReport(ctx context.Context, db Queryer, oa *OrgAssets, report *Report, start, end time.Time) ([][]string, error) {
+	var header []string
+	var query string
+	var params []interface{}
+
+	switch report.Type {
+	case ReportTypeFlowResults:
+		flow, err := oa.Flow(report.FlowUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading flow for report: %s", report.FlowUUID)
+		}
+		header = []string{"Result", "Category", "Count"}
+		query = selectFlowResultsReportSQL
+		params = []interface{}{oa.OrgID(), flow.(*Flow).ID(), start, end}
+
+	case ReportTypeMsgVolumes:
+		header = []string{"Day", "Channel", "Direction", "Count"}
+		query = selectMsgVolumesReportSQL
+		params = []interface{}{oa.OrgID(), start, end, oa.Env().Timezone().String()}
+
+	case ReportTypeTicketSLA:
+		header = []string{"Ticketer", "Opened", "Closed", "Closed Within 24h", "Avg Hours To Close"}
+		query = selectTicketSLAReportSQL
+		params = []interface{}{oa.OrgID(), start, end}
+
+	default:
+		return nil, errors.Errorf("unknown report type: %s", report.Type)
+	}
+
+	rows, err := db.QueryxContext(ctx, query, params...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying %s report", report.Type)
+	}
+	defer rows.Close()
+
+	records := [][]string{header}
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error scanning %s report row", report.Type)
+		}
+
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = reportValue(v)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// formats a value scanned from the database for a report
+func reportValue(v interface{}) string {
+	switch typed := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(typed)
+	case int64:
+		return strconv.FormatInt(typed, 10)
+	default:
+		return fmt.Sprint(typed)
+	}
+}
@@ -0,0 +1,94 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportLastPeriod(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Los_Angeles")
+
+	// a Wednesday afternoon
+	now := time.Date(2021, 6, 23, 15, 30, 0, 0, tz)
+
+	tcs := []struct {
+		schedule      models.ReportSchedule
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{models.ReportScheduleDaily, time.Date(2021, 6, 22, 0, 0, 0, 0, tz), time.Date(2021, 6, 23, 0, 0, 0, 0, tz)},
+		{models.ReportScheduleWeekly, time.Date(2021, 6, 14, 0, 0, 0, 0, tz), time.Date(2021, 6, 21, 0, 0, 0, 0, tz)},
+		{models.ReportScheduleMonthly, time.Date(2021, 5, 1, 0, 0, 0, 0, tz), time.Date(2021, 6, 1, 0, 0, 0, 0, tz)},
+	}
+
+	for _, tc := range tcs {
+		report := &models.Report{Schedule: tc.schedule}
+		start, end := report.LastPeriod(now, tz)
+		assert.Equal(t, tc.expectedStart, start, "start mismatch for %s", tc.schedule)
+		assert.Equal(t, tc.expectedEnd, end, "end mismatch for %s", tc.schedule)
+	}
+}
+
+func TestOrgReports(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('reports', jsonb_build_array(
+		jsonb_build_object('uuid', '3a1d3e3b-48d3-4e3d-9e19-6ac7e1e1d6c5', 'name', 'Volumes', 'type', 'msg_volumes', 'schedule', 'weekly', 'emails', jsonb_build_array('bob@nyaruka.com')),
+		jsonb_build_object('uuid', '9d0b2a6e-6a5b-4b55-8a6c-6c6d1f2b8e11', 'name', 'Results', 'type', 'flow_results', 'schedule', 'daily', 'store', true),
+		jsonb_build_object('uuid', 'b1a2e4d3-21a9-4e27-9d0e-3d8b1b5c6f7a', 'name', 'Bad', 'type', 'unknown', 'schedule', 'daily', 'store', true)
+	)) WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	// results report has no flow and the last has an unknown type so only the first is valid
+	reports := oa.Org().Reports()
+	require.Equal(t, 1, len(reports))
+	assert.Equal(t, models.ReportTypeMsgVolumes, reports[0].Type)
+	assert.Equal(t, models.ReportScheduleWeekly, reports[0].Schedule)
+	assert.Equal(t, []string{"bob@nyaruka.com"}, reports[0].Emails)
+}
+
+func TestGenerateReport(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testdata.InsertIncomingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "hi")
+	testdata.InsertIncomingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "there")
+	testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "hello", nil)
+
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Problem", "Where my shoes", "123", nil)
+	testdata.InsertClosedTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Problem", "Where my pants", "234", nil)
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	records, err := models.GenerateReport(ctx, db, oa, &models.Report{Type: models.ReportTypeMsgVolumes}, start, end)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(records))
+	assert.Equal(t, []string{"Day", "Channel", "Direction", "Count"}, records[0])
+	assert.Equal(t, []string{"I", "2"}, records[1][2:])
+	assert.Equal(t, []string{"O", "1"}, records[2][2:])
+
+	records, err = models.GenerateReport(ctx, db, oa, &models.Report{Type: models.ReportTypeTicketSLA}, start, end)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, []string{"2", "1", "1"}, records[1][1:4])
+
+	// nothing in a period before our data
+	records, err = models.GenerateReport(ctx, db, oa, &models.Report{Type: models.ReportTypeTicketSLA}, start.AddDate(0, 0, -7), start)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/redisutil"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// We keep a rollup for each contact of how many messages they've sent us in each hour of the day (in their org's
+// timezone) so that broadcasts can be sent at the hour each contact is most likely to respond.
+
+// the keys of an org's rollups are prefixed with the org's hash tag if we're using them so that they can be fetched
+// together from a redis cluster
+const responseHoursKey = "%s:%d"
+
+func responseHoursKeyFor(orgID OrgID, contactID ContactID) string {
+	return fmt.Sprintf(responseHoursKey, redisutil.HashTag(fmt.Sprintf("contact_response_hours:%d", orgID)), contactID)
+}
+
+// how long a contact's rollup is kept after their last message, so that stale behaviour eventually ages out
+const responseHoursExpiry = time.Hour * 24 * 90
+
+// ResponseHours is the number of messages received from a contact in each hour of the day
+type ResponseHours [24]int
+
+// RecordContactResponse increments the hour of the passed in time in the contact's response hours rollup
+func RecordContactResponse(rc redis.Conn, oa *OrgAssets, contactID ContactID, t time.Time) error {
+	key := responseHoursKeyFor(oa.OrgID(), contactID)
+	hour := t.In(oa.Env().Timezone()).Hour()
+
+	rc.Send("MULTI")
+	rc.Send("HINCRBY", key, hour, 1)
+	rc.Send("EXPIRE", key, int(responseHoursExpiry/time.Second))
+	_, err := rc.Do("EXEC")
+	return errors.Wrapf(err, "error recording response hour for contact %d", contactID)
+}
+
+// GetContactResponseHours returns the response hours rollups of the passed in contacts, contacts without any history
+// are omitted
+func GetContactResponseHours(rc redis.Conn, orgID OrgID, contactIDs []ContactID) (map[ContactID]*ResponseHours, error) {
+	for _, id := range contactIDs {
+		rc.Send("HGETALL", responseHoursKeyFor(orgID, id))
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, errors.Wrapf(err, "error fetching contact response hours")
+	}
+
+	rollups := make(map[ContactID]*ResponseHours, len(contactIDs))
+	for _, id := range contactIDs {
+		values, err := redis.IntMap(rc.Receive())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading response hours for contact %d", id)
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		hours := &ResponseHours{}
+		for h, count := range values {
+			hour, err := strconv.Atoi(h)
+			if err == nil && hour >= 0 && hour < 24 {
+				hours[hour] = count
+			}
+		}
+		rollups[id] = hours
+	}
+	return rollups, nil
+}
+
+// BestHour returns the hour in the window from start (inclusive) to end (exclusive) with the most responses, and
+// whether there were any responses in that window. Windows can wrap around midnight, e.g. 20 to 6.
+func (h *ResponseHours) BestHour(start, end int) (int, bool) {
+	best, bestCount := start, 0
+
+	for i := 0; i < windowLength(start, end); i++ {
+		hour := (start + i) % 24
+		if h[hour] > bestCount {
+			best, bestCount = hour, h[hour]
+		}
+	}
+	return best, bestCount > 0
+}
+
+// OptimalTime is the window within which a broadcast sends to each contact at their most responsive hour
+type OptimalTime struct {
+	StartHour int `json:"start_hour" validate:"min=0,max=23"`
+	EndHour   int `json:"end_hour"   validate:"min=0,max=24"`
+}
+
+// SendTime returns when a contact with the passed in response hours (which may be nil) should be sent to, which is the
+// next occurrence of their best hour in the window, or as soon as possible within the window if we don't know when
+// they're most responsive
+func (o *OptimalTime) SendTime(tz *time.Location, now time.Time, hours *ResponseHours) time.Time {
+	now = now.In(tz)
+
+	if hours != nil {
+		if best, found := hours.BestHour(o.StartHour, o.EndHour); found {
+			return nextHour(now, best)
+		}
+	}
+
+	// if we're currently in the window, that's now
+	if o.contains(now.Hour()) {
+		return now
+	}
+	return nextHour(now, o.StartHour)
+}
+
+func (o *OptimalTime) contains(hour int) bool {
+	return (hour-o.StartHour+24)%24 < windowLength(o.StartHour, o.EndHour)
+}
+
+// the number of hours in a window, where an empty window (start == end) is treated as the whole day
+func windowLength(start, end int) int {
+	length := (end - start + 24) % 24
+	if length == 0 {
+		return 24
+	}
+	return length
+}
+
+// nextHour returns the start of the given hour, today if that's still ahead or the current hour, otherwise tomorrow
+func nextHour(now time.Time, hour int) time.Time {
+	if now.Hour() == hour {
+		return now
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if t.Before(now) {
+		t = time.Date(now.Year(), now.Month(), now.Day()+1, hour, 0, 0, 0, now.Location())
+	}
+	return t
+}
@@ -0,0 +1,83 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactResponseHours(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tz := oa.Env().Timezone()
+
+	for _, h := range []int{9, 9, 14, 21} {
+		err := models.RecordContactResponse(rc, oa, testdata.Cathy.ID, time.Date(2021, 6, 1, h, 30, 0, 0, tz))
+		require.NoError(t, err)
+	}
+
+	rollups, err := models.GetContactResponseHours(rc, testdata.Org1.ID, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, len(rollups))
+	assert.Equal(t, 2, rollups[testdata.Cathy.ID][9])
+	assert.Equal(t, 1, rollups[testdata.Cathy.ID][14])
+	assert.Equal(t, 1, rollups[testdata.Cathy.ID][21])
+
+	hours := rollups[testdata.Cathy.ID]
+
+	best, found := hours.BestHour(0, 24)
+	assert.Equal(t, 9, best)
+	assert.True(t, found)
+
+	best, found = hours.BestHour(12, 18)
+	assert.Equal(t, 14, best)
+	assert.True(t, found)
+
+	best, found = hours.BestHour(20, 6) // wraps around midnight
+	assert.Equal(t, 21, best)
+	assert.True(t, found)
+
+	best, found = hours.BestHour(1, 6)
+	assert.Equal(t, 1, best)
+	assert.False(t, found)
+}
+
+func TestOptimalSendTime(t *testing.T) {
+	tz, _ := time.LoadLocation("Africa/Kigali")
+	now := time.Date(2021, 6, 1, 10, 15, 0, 0, tz)
+
+	hours := &models.ResponseHours{}
+	hours[9] = 3
+	hours[14] = 1
+
+	window := &models.OptimalTime{StartHour: 8, EndHour: 18}
+
+	// best hour has passed today so it's tomorrow
+	assert.Equal(t, time.Date(2021, 6, 2, 9, 0, 0, 0, tz), window.SendTime(tz, now, hours))
+
+	// unless the window excludes it
+	window = &models.OptimalTime{StartHour: 12, EndHour: 18}
+	assert.Equal(t, time.Date(2021, 6, 1, 14, 0, 0, 0, tz), window.SendTime(tz, now, hours))
+
+	// no history and we're in the window means now
+	window = &models.OptimalTime{StartHour: 8, EndHour: 18}
+	assert.Equal(t, now, window.SendTime(tz, now, nil))
+
+	// no history and we're outside the window means the start of the window
+	window = &models.OptimalTime{StartHour: 20, EndHour: 6}
+	assert.Equal(t, time.Date(2021, 6, 1, 20, 0, 0, 0, tz), window.SendTime(tz, now, nil))
+}
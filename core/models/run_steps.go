@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/null"
+
+	"github.com/pkg/errors"
+)
+
+// RunStep is a single step of a run's path written as a normalized row for analytics, enabled by the RunSteps config
+type RunStep struct {
+	OrgID     OrgID          `db:"org_id"`
+	FlowID    FlowID         `db:"flow_id"`
+	RunUUID   flows.RunUUID  `db:"run_uuid"`
+	StepUUID  flows.StepUUID `db:"step_uuid"`
+	NodeUUID  flows.NodeUUID `db:"node_uuid"`
+	ExitUUID  null.String    `db:"exit_uuid"`
+	ArrivedOn time.Time      `db:"arrived_on"`
+}
+
+// newRunSteps returns the steps of the passed in run which need writing given that it was last written at the passed in
+// time. A step is only written once it's complete, i.e. we've moved on from it or the run has ended, so that its exit
+// is known and each step is written exactly once.
+func newRunSteps(r *FlowRun, lastWritten time.Time) []*RunStep {
+	path := r.run.Path()
+	endedSince := r.run.ExitedOn() != nil && r.run.ExitedOn().After(lastWritten)
+
+	steps := make([]*RunStep, 0, len(path))
+	for i, s := range path {
+		if i+1 < len(path) {
+			// was already complete when last written
+			if !path[i+1].ArrivedOn().After(lastWritten) {
+				continue
+			}
+		} else if !endedSince {
+			// final step is only complete once the run ends
+			continue
+		}
+
+		steps = append(steps, &RunStep{
+			OrgID:     r.r.OrgID,
+			FlowID:    r.r.FlowID,
+			RunUUID:   r.r.UUID,
+			StepUUID:  s.UUID(),
+			NodeUUID:  s.NodeUUID(),
+			ExitUUID:  null.String(s.ExitUUID()),
+			ArrivedOn: s.ArrivedOn(),
+		})
+	}
+	return steps
+}
+
+const insertRunStepsSQL = `
+INSERT INTO
+	flows_flowrunstep(org_id, flow_id, run_uuid, step_uuid, node_uuid, exit_uuid, arrived_on)
+	VALUES(:org_id, :flow_id, :run_uuid, :step_uuid, :node_uuid, :exit_uuid, :arrived_on)
+`
+
+// InsertRunSteps writes the passed in run steps
+func InsertRunSteps(ctx context.Context, tx Queryer, steps []*RunStep) error {
+	is := make([]interface{}, len(steps))
+	for i := range steps {
+		is[i] = steps[i]
+	}
+
+	return BulkQuery(ctx, "insert run steps", tx, insertRunStepsSQL, is)
+}
+
+// writes the steps of the passed in runs which have been completed since each was last written
+func writeRunSteps(ctx context.Context, tx Queryer, runs []*FlowRun, lastWritten map[flows.RunUUID]time.Time) error {
+	steps := make([]*RunStep, 0, len(runs)*2)
+	for _, r := range runs {
+		steps = append(steps, newRunSteps(r, lastWritten[r.UUID()])...)
+	}
+
+	return errors.Wrapf(InsertRunSteps(ctx, tx, steps), "error writing run steps")
+}
+
+// MaintainRunStepsPartitions makes sure that the run steps partitions for this month and next exist, and drops partitions
+// for months which are entirely older than the passed in number of retention months. The run steps table itself is
+// partitioned by month of arrival so that old steps can be cheaply dropped.
+func MaintainRunStepsPartitions(ctx context.Context, db Queryer, now time.Time, retentionMonths int) error {
+	if err := CreateMonthlyPartitions(ctx, db, "flows_flowrunstep", now, 1); err != nil {
+		return err
+	}
+
+	if retentionMonths <= 0 {
+		return nil
+	}
+
+	return DropMonthlyPartitions(ctx, db, "flows_flowrunstep", now, retentionMonths)
+}
@@ -18,7 +18,6 @@ import (
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/mailroom/config"
-	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/null"
 
 	"github.com/gomodule/redigo/redis"
@@ -108,6 +107,7 @@ type Session struct {
 		Responded     bool              `db:"responded"`
 		Output        null.String       `db:"output"`
 		OutputURL     null.String       `db:"output_url"`
+		OnlyInStorage bool              `db:"only_in_storage"` // not a column, whether output isn't written to the db
 		ContactID     ContactID         `db:"contact_id"`
 		OrgID         OrgID             `db:"org_id"`
 		CreatedOn     time.Time         `db:"created_on"`
@@ -191,6 +191,33 @@ func WriteSessionOutputsToStorage(ctx context.Context, st storage.Storage, sessi
 	return nil
 }
 
+// writes the outputs of the passed in sessions to storage if the org's session storage mode says to. If that fails, the
+// database is still written their outputs and so they are read from there. If the mode is s3_only and it succeeds,
+// only their output URLs are written to the database.
+func writeSessionOutputs(ctx context.Context, st storage.Storage, org *OrgAssets, sessions []*Session) {
+	sessionMode := org.Org().SessionStorageMode()
+	if sessionMode != S3Sessions && sessionMode != S3WriteSessions && sessionMode != S3OnlySessions {
+		return
+	}
+
+	if err := WriteSessionOutputsToStorage(ctx, st, sessions); err != nil {
+		logrus.WithError(err).Error("error writing sessions to s3")
+
+		// any output URLs are from previous writes and no longer match the outputs
+		for _, s := range sessions {
+			s.s.OutputURL = ""
+			s.s.OnlyInStorage = false
+		}
+		return
+	}
+
+	if sessionMode == S3OnlySessions {
+		for _, s := range sessions {
+			s.s.OnlyInStorage = true
+		}
+	}
+}
+
 const storageTSFormat = "20060102T150405.999Z"
 
 // StoragePath returns the path for the session
@@ -317,6 +344,7 @@ func (r *FlowRun) SetSessionID(sessionID SessionID)     { r.r.SessionID = sessio
 func (r *FlowRun) SetConnectionID(connID *ConnectionID) { r.r.ConnectionID = connID }
 func (r *FlowRun) SetStartID(startID StartID)           { r.r.StartID = startID }
 func (r *FlowRun) UUID() flows.RunUUID                  { return r.r.UUID }
+func (r *FlowRun) FlowID() FlowID                       { return r.r.FlowID }
 func (r *FlowRun) ModifiedOn() time.Time                { return r.r.ModifiedOn }
 
 // MarshalJSON is our custom marshaller so that our inner struct get output
@@ -434,8 +462,9 @@ func ActiveSessionForContact(ctx context.Context, db *sqlx.DB, st storage.Storag
 		return nil, errors.Wrapf(err, "error scanning session")
 	}
 
-	// load our output if necessary
-	if org.Org().SessionStorageMode() == S3Sessions && session.OutputURL() != "" {
+	// load our output if necessary, sessions written in s3_only mode only have their output in storage
+	sessionMode := org.Org().SessionStorageMode()
+	if session.OutputURL() != "" && (sessionMode == S3Sessions || sessionMode == S3OnlySessions || session.Output() == "") {
 		start := time.Now()
 
 		// strip just the path out of our output URL
@@ -493,20 +522,21 @@ LIMIT 1
 const insertCompleteSessionSQL = `
 INSERT INTO
 	flows_flowsession( uuid, session_type, status, responded, output, output_url, contact_id, org_id, created_on, ended_on, wait_started_on, connection_id)
-               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:contact_id,:org_id, NOW(),      NOW(),    NULL,           :connection_id)
+               VALUES(:uuid,:session_type,:status,:responded,CASE WHEN :only_in_storage THEN NULL ELSE :output END,:output_url,:contact_id,:org_id, NOW(),      NOW(),    NULL,           :connection_id)
 RETURNING id
 `
 
 const insertIncompleteSessionSQL = `
 INSERT INTO
 	flows_flowsession( uuid, session_type, status, responded, output, output_url, contact_id, org_id, created_on, current_flow_id, timeout_on, wait_started_on, connection_id)
-               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:contact_id,:org_id, NOW(),     :current_flow_id,:timeout_on,:wait_started_on,:connection_id)
+               VALUES(:uuid,:session_type,:status,:responded,CASE WHEN :only_in_storage THEN NULL ELSE :output END,:output_url,:contact_id,:org_id, NOW(),     :current_flow_id,:timeout_on,:wait_started_on,:connection_id)
 RETURNING id
 `
 
-// FlowSession creates a flow session for the passed in session object. It also populates the runs we know about
-func (s *Session) FlowSession(sa flows.SessionAssets, env envs.Environment) (flows.Session, error) {
-	session, err := goflow.Engine(config.Mailroom).ReadSession(sa, json.RawMessage(s.s.Output), assets.IgnoreMissing)
+// FlowSession creates a flow session for the passed in session object using the passed in engine. It also populates the
+// runs we know about
+func (s *Session) FlowSession(eng flows.Engine, sa flows.SessionAssets, env envs.Environment) (flows.Session, error) {
+	session, err := eng.ReadSession(sa, json.RawMessage(s.s.Output), assets.IgnoreMissing)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to unmarshal session")
 	}
@@ -539,13 +569,18 @@ func (s *Session) calculateTimeout(fs flows.Session, sprint flows.Sprint) {
 	}
 }
 
-// WriteUpdatedSession updates the session based on the state passed in from our engine session, this also takes care of applying any event hooks
+// WriteUpdatedSession updates the session based on the state passed in from our engine session, this also takes care of applying any event hooks.
+// It can be called again with a new transaction if the previous one was rolled back.
 func (s *Session) WriteUpdatedSession(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, st storage.Storage, org *OrgAssets, fs flows.Session, sprint flows.Sprint, hook SessionCommitHook) error {
 	// make sure we have our seen runs
 	if s.seenRuns == nil {
 		return errors.Errorf("missing seen runs, cannot update session")
 	}
 
+	// start from scratch in case this is a retry of a write which was rolled back
+	s.runs = nil
+	s.scene = NewSceneForSession(s)
+
 	output, err := json.Marshal(fs)
 	if err != nil {
 		return errors.Wrapf(err, "error marshalling flow session")
@@ -609,13 +644,7 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, tx *sqlx.Tx, rp *redi
 	}
 
 	// if writing to S3, do so
-	sessionMode := org.Org().SessionStorageMode()
-	if sessionMode == S3Sessions || sessionMode == S3WriteSessions {
-		err := WriteSessionOutputsToStorage(ctx, st, []*Session{s})
-		if err != nil {
-			logrus.WithError(err).Error("error writing session to s3")
-		}
-	}
+	writeSessionOutputs(ctx, st, org, []*Session{s})
 
 	// write our new session state to the db
 	_, err = tx.NamedExecContext(ctx, updateSessionSQL, s.s)
@@ -670,6 +699,18 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, tx *sqlx.Tx, rp *redi
 		return errors.Wrapf(err, "error writing runs")
 	}
 
+	err = updateContactFlowHistories(ctx, tx, s.Runs(), s.seenRuns)
+	if err != nil {
+		return err
+	}
+
+	if config.Mailroom.RunSteps {
+		err = writeRunSteps(ctx, tx, s.Runs(), s.seenRuns)
+		if err != nil {
+			return err
+		}
+	}
+
 	// apply all our events
 	if s.Status() != SessionStatusFailed {
 		err = HandleEvents(ctx, tx, rp, org, s.scene, sprint.Events())
@@ -691,7 +732,7 @@ const updateSessionSQL = `
 UPDATE 
 	flows_flowsession
 SET 
-	output = :output, 
+	output = CASE WHEN :only_in_storage THEN NULL ELSE :output END, 
 	output_url = :output_url,
 	status = :status, 
 	ended_on = CASE WHEN :status = 'W' THEN NULL ELSE NOW() END,
@@ -774,14 +815,7 @@ func WriteSessions(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, st storage.
 	}
 
 	// if writing our sessions to S3, do so
-	sessionMode := org.Org().SessionStorageMode()
-	if sessionMode == S3Sessions || sessionMode == S3WriteSessions {
-		err := WriteSessionOutputsToStorage(ctx, st, sessions)
-		if err != nil {
-			// for now, continue on for errors, we are still reading from the DB
-			logrus.WithError(err).Error("error writing sessions to s3")
-		}
-	}
+	writeSessionOutputs(ctx, st, org, sessions)
 
 	// insert our complete sessions first
 	err := BulkQuery(ctx, "insert completed sessions", tx, insertCompleteSessionSQL, completeSessionsI)
@@ -803,9 +837,11 @@ func WriteSessions(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, st storage.
 
 	// for each session associate our run with each
 	runs := make([]interface{}, 0, len(sessions))
+	flowRuns := make([]*FlowRun, 0, len(sessions))
 	for _, s := range sessions {
 		for _, r := range s.runs {
 			runs = append(runs, &r.r)
+			flowRuns = append(flowRuns, r)
 
 			// set our session id now that it is written
 			r.SetSessionID(s.ID())
@@ -818,6 +854,20 @@ func WriteSessions(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, st storage.
 		return nil, errors.Wrapf(err, "error writing runs")
 	}
 
+	err = updateContactFlowHistories(ctx, tx, flowRuns, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Mailroom.RunSteps {
+		for _, s := range sessions {
+			err = writeRunSteps(ctx, tx, s.runs, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// apply our all events for the session
 	scenes := make([]*Scene, 0, len(ss))
 	for i := range sessions {
@@ -987,6 +1037,30 @@ WHERE
 	fs.contact_id = ANY($2)
 `
 
+// FindContactsWithActiveSessions returns the ids of the contacts in the given org which are currently waiting in a flow
+// of the given type
+func FindContactsWithActiveSessions(ctx context.Context, db Queryer, orgID OrgID, flowType FlowType) ([]ContactID, error) {
+	if flowType == FlowTypeBackground {
+		flowType = FlowTypeMessaging
+	}
+
+	return queryContactIDs(ctx, db, contactsWithActiveSessionsSQL, orgID, flowType)
+}
+
+const contactsWithActiveSessionsSQL = `
+SELECT
+	DISTINCT(contact_id)
+FROM
+	flows_flowsession fs JOIN
+	flows_flow ff ON fs.current_flow_id = ff.id
+WHERE
+	fs.org_id = $1 AND
+	fs.status = 'W' AND
+	ff.is_active = TRUE AND
+	ff.is_archived = FALSE AND
+	ff.flow_type = $2
+`
+
 // RunExpiration looks up the run expiration for the passed in run, can return nil if the run is no longer active
 func RunExpiration(ctx context.Context, db *sqlx.DB, runID FlowRunID) (*time.Time, error) {
 	var expiration time.Time
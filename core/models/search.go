@@ -16,8 +16,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// BuildElasticQuery turns the passed in contact ql query into an elastic query
-func BuildElasticQuery(org *OrgAssets, group assets.GroupUUID, status ContactStatus, excludeIDs []ContactID, query *contactql.ContactQuery) elastic.Query {
+// BuildElasticQuery builds an elastic query for the contacts of the passed in org, restricted by the passed in compiled
+// contact query if there is one
+func BuildElasticQuery(org *OrgAssets, group assets.GroupUUID, status ContactStatus, excludeIDs []ContactID, query elastic.Query) elastic.Query {
 	// filter by org and active contacts
 	eq := elastic.NewBoolQuery().Must(
 		elastic.NewTermQuery("org_id", org.OrgID()),
@@ -45,18 +46,23 @@ func BuildElasticQuery(org *OrgAssets, group assets.GroupUUID, status ContactSta
 
 	// and by our query if present
 	if query != nil {
-		q := es.ToElasticQuery(org.Env(), query)
-		eq = eq.Must(q)
+		eq = eq.Must(query)
 	}
 
 	return eq
 }
 
 // ContactIDsForQueryPage returns the ids of the contacts for the passed in query page
-func ContactIDsForQueryPage(ctx context.Context, client *elastic.Client, org *OrgAssets, group assets.GroupUUID, excludeIDs []ContactID, query string, sort string, offset int, pageSize int) (*contactql.ContactQuery, []ContactID, int64, error) {
-	env := org.Env()
+func ContactIDsForQueryPage(ctx context.Context, db Queryer, client *elastic.Client, org *OrgAssets, group assets.GroupUUID, excludeIDs []ContactID, query string, sort string, offset int, pageSize int) (*contactql.ContactQuery, []ContactID, int64, error) {
+	return ContactIDsForQueryPageWithStatus(ctx, db, client, org, group, NilContactStatus, excludeIDs, query, sort, offset, pageSize)
+}
+
+// ContactIDsForQueryPageWithStatus returns the ids of the contacts for the passed in query page, only including contacts
+// with the given status if one is provided
+func ContactIDsForQueryPageWithStatus(ctx context.Context, db Queryer, client *elastic.Client, org *OrgAssets, group assets.GroupUUID, status ContactStatus, excludeIDs []ContactID, query string, sort string, offset int, pageSize int) (*contactql.ContactQuery, []ContactID, int64, error) {
 	start := time.Now()
 	var parsed *contactql.ContactQuery
+	var compiled elastic.Query
 	var err error
 
 	if client == nil {
@@ -64,13 +70,13 @@ func ContactIDsForQueryPage(ctx context.Context, client *elastic.Client, org *Or
 	}
 
 	if query != "" {
-		parsed, err = contactql.ParseQuery(env, query, org.SessionAssets())
+		parsed, compiled, err = parseAndCompileQuery(ctx, db, client, org, query)
 		if err != nil {
-			return nil, nil, 0, errors.Wrapf(err, "error parsing query: %s", query)
+			return nil, nil, 0, err
 		}
 	}
 
-	eq := BuildElasticQuery(org, group, NilContactStatus, excludeIDs, parsed)
+	eq := BuildElasticQuery(org, group, status, excludeIDs, compiled)
 
 	fieldSort, err := es.ToElasticFieldSort(sort, org.SessionAssets())
 	if err != nil {
@@ -114,8 +120,7 @@ func ContactIDsForQueryPage(ctx context.Context, client *elastic.Client, org *Or
 }
 
 // ContactIDsForQuery returns the ids of all the contacts that match the passed in query
-func ContactIDsForQuery(ctx context.Context, client *elastic.Client, org *OrgAssets, query string) ([]ContactID, error) {
-	env := org.Env()
+func ContactIDsForQuery(ctx context.Context, db Queryer, client *elastic.Client, org *OrgAssets, query string) ([]ContactID, error) {
 	start := time.Now()
 
 	if client == nil {
@@ -123,12 +128,12 @@ func ContactIDsForQuery(ctx context.Context, client *elastic.Client, org *OrgAss
 	}
 
 	// turn into elastic query
-	parsed, err := contactql.ParseQuery(env, query, org.SessionAssets())
+	_, compiled, err := parseAndCompileQuery(ctx, db, client, org, query)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing query: %s", query)
+		return nil, err
 	}
 
-	eq := BuildElasticQuery(org, "", ContactStatusActive, nil, parsed)
+	eq := BuildElasticQuery(org, "", ContactStatusActive, nil, compiled)
 
 	ids := make([]ContactID, 0, 100)
 
@@ -161,3 +166,18 @@ func ContactIDsForQuery(ctx context.Context, client *elastic.Client, org *OrgAss
 		}
 	}
 }
+
+// parses the passed in query and compiles it into an elastic query
+func parseAndCompileQuery(ctx context.Context, db Queryer, client *elastic.Client, org *OrgAssets, query string) (*contactql.ContactQuery, elastic.Query, error) {
+	parsed, err := ParseQuery(org, query)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error parsing query: %s", query)
+	}
+
+	compiled, err := ToElasticQuery(ctx, db, client, org, parsed)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error compiling query: %s", query)
+	}
+
+	return parsed, compiled, nil
+}
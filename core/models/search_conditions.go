@@ -0,0 +1,768 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/contactql/es"
+	"github.com/nyaruka/goflow/envs"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// the attributes we add to contact queries on top of those supported by contactql
+const (
+	QueryAttributeSaid        = "said"
+	QueryAttributeSaidOn      = "said_on"
+	QueryAttributeEntered     = "entered"
+	QueryAttributeCompleted   = "completed"
+	QueryAttributeLastFlow    = "last_flow"
+	QueryAttributeOpenTickets = "open_tickets"
+)
+
+// queryAttribute is one of our attributes, which contactql parses as a field so that conditions on it can be combined
+// with other conditions using AND and OR like any other
+type queryAttribute struct {
+	key       string
+	fieldType assets.FieldType
+}
+
+func (a *queryAttribute) UUID() assets.FieldUUID { return "" }
+func (a *queryAttribute) Key() string            { return a.key }
+func (a *queryAttribute) Name() string           { return a.key }
+func (a *queryAttribute) Type() assets.FieldType { return a.fieldType }
+
+var queryAttributes = map[string]*queryAttribute{
+	QueryAttributeSaid:        {QueryAttributeSaid, assets.FieldTypeText},
+	QueryAttributeSaidOn:      {QueryAttributeSaidOn, assets.FieldTypeDatetime},
+	QueryAttributeEntered:     {QueryAttributeEntered, assets.FieldTypeText},
+	QueryAttributeCompleted:   {QueryAttributeCompleted, assets.FieldTypeText},
+	QueryAttributeLastFlow:    {QueryAttributeLastFlow, assets.FieldTypeText},
+	QueryAttributeOpenTickets: {QueryAttributeOpenTickets, assets.FieldTypeNumber},
+}
+
+// returns the attribute with the passed in key, unless the org has its own field with that key which takes precedence so
+// that existing queries and groups on that field keep their meaning
+func queryAttributeFor(oa *OrgAssets, key string) *queryAttribute {
+	key = strings.ToLower(key)
+	if oa.FieldByKey(key) != nil {
+		return nil
+	}
+	return queryAttributes[key]
+}
+
+// resolves our attributes as fields when the org doesn't have its own fields with the same keys
+type queryResolver struct {
+	contactql.Resolver
+
+	oa *OrgAssets
+}
+
+func (r *queryResolver) ResolveField(key string) assets.Field {
+	if attr := queryAttributeFor(r.oa, key); attr != nil {
+		return attr
+	}
+	return r.Resolver.ResolveField(key)
+}
+
+// QueryAttributeError is an error in how one of our attributes is used in a contact query
+type QueryAttributeError struct {
+	msg string
+}
+
+func newQueryAttributeError(msg string, args ...interface{}) *QueryAttributeError {
+	return &QueryAttributeError{msg: fmt.Sprintf(msg, args...)}
+}
+
+func (e *QueryAttributeError) Error() string { return e.msg }
+
+// IsQueryError returns whether the passed in error is an error in a contact query itself, rather than in performing it,
+// and if so the error to return to the user
+func IsQueryError(err error) (bool, error) {
+	if isQueryError, qerr := contactql.IsQueryError(err); isQueryError {
+		return true, qerr
+	}
+	if aerr, ok := errors.Cause(err).(*QueryAttributeError); ok {
+		return true, aerr
+	}
+	return false, nil
+}
+
+// ParseQuery parses the passed in contact query, which can include our attributes as well as everything supported by
+// contactql, e.g. age > 10 AND (said = "stop" OR open_tickets > 0)
+func ParseQuery(oa *OrgAssets, query string) (*contactql.ContactQuery, error) {
+	parsed, err := contactql.ParseQuery(oa.Env(), query, &queryResolver{Resolver: oa.SessionAssets(), oa: oa})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAttributes(oa, parsed.Root(), true); err != nil {
+		return nil, err
+	}
+	if _, _, err := saidRange(oa, parsed); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// InspectQuery inspects the passed in query like contactql.Inspect, but reports our attributes as attributes rather than
+// fields. Queries which use them can't be used for dynamic groups as they aren't re-evaluated when messages, runs or
+// tickets change, but queries on org fields with the same keys as our attributes are still queries on those fields.
+func InspectQuery(oa *OrgAssets, query *contactql.ContactQuery) *contactql.Inspection {
+	inspection := contactql.Inspect(query)
+
+	fields := make([]*assets.FieldReference, 0, len(inspection.Fields))
+	for _, f := range inspection.Fields {
+		if queryAttributeFor(oa, f.Key) != nil {
+			inspection.Attributes = append(inspection.Attributes, f.Key)
+			inspection.AllowAsGroup = false
+		} else {
+			fields = append(fields, f)
+		}
+	}
+	inspection.Fields = fields
+
+	return inspection
+}
+
+// returns the attribute of the passed in node if it is a condition on one of our attributes
+func conditionAttribute(oa *OrgAssets, node contactql.QueryNode) (*contactql.Condition, string) {
+	if cond, ok := node.(*contactql.Condition); ok && cond.PropertyType() == contactql.PropertyTypeField {
+		if attr := queryAttributeFor(oa, cond.PropertyKey()); attr != nil {
+			return cond, attr.key
+		}
+	}
+	return nil, ""
+}
+
+// returns whether the passed in node is or contains a condition on one of our attributes
+func hasAttributeConditions(oa *OrgAssets, node contactql.QueryNode) bool {
+	switch n := node.(type) {
+	case *contactql.BoolCombination:
+		for _, child := range n.Children() {
+			if hasAttributeConditions(oa, child) {
+				return true
+			}
+		}
+		return false
+	default:
+		_, key := conditionAttribute(oa, node)
+		return key != ""
+	}
+}
+
+// checks the operators and values used with our attributes, topLevel being whether node is combined with the rest of
+// the query using AND
+func validateAttributes(oa *OrgAssets, node contactql.QueryNode, topLevel bool) error {
+	if combo, ok := node.(*contactql.BoolCombination); ok {
+		childTopLevel := topLevel && combo.Operator() == contactql.BoolOperatorAnd
+		for _, child := range combo.Children() {
+			if err := validateAttributes(oa, child, childTopLevel); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cond, key := conditionAttribute(oa, node)
+	if cond == nil {
+		return nil
+	}
+
+	switch key {
+	case QueryAttributeSaid, QueryAttributeEntered, QueryAttributeCompleted, QueryAttributeLastFlow:
+		if cond.Operator() != contactql.OpEqual && cond.Operator() != contactql.OpNotEqual {
+			return newQueryAttributeError("%s conditions can only use = or !=", key)
+		}
+		if strings.TrimSpace(cond.Value()) == "" {
+			return newQueryAttributeError("%s conditions require a value", key)
+		}
+	case QueryAttributeSaidOn:
+		if !topLevel {
+			return newQueryAttributeError("%s conditions can only be combined with other conditions using AND", key)
+		}
+		if cond.Operator() == contactql.OpNotEqual {
+			return newQueryAttributeError("%s conditions can't use !=", key)
+		}
+	case QueryAttributeOpenTickets:
+		if cond.Operator() == contactql.OpContains {
+			return newQueryAttributeError("%s conditions can't use %s", key, cond.Operator())
+		}
+		if count, err := strconv.Atoi(cond.Value()); err != nil || count < 0 {
+			return newQueryAttributeError("invalid number of open tickets: %s", cond.Value())
+		}
+	}
+	return nil
+}
+
+// returns the date range of the said_on conditions in the passed in query, which apply to all of its said conditions
+func saidRange(oa *OrgAssets, query *contactql.ContactQuery) (*time.Time, *time.Time, error) {
+	env := oa.Env()
+	var after, before *time.Time
+	hasSaid, hasSaidOn := false, false
+
+	var visit func(node contactql.QueryNode) error
+	visit = func(node contactql.QueryNode) error {
+		if combo, ok := node.(*contactql.BoolCombination); ok {
+			for _, child := range combo.Children() {
+				if err := visit(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		cond, key := conditionAttribute(oa, node)
+		if key == QueryAttributeSaid {
+			hasSaid = true
+		} else if key == QueryAttributeSaidOn {
+			hasSaidOn = true
+
+			date, err := envs.DateTimeFromString(env, cond.Value(), false)
+			if err != nil {
+				return newQueryAttributeError("invalid date for %s: %s", key, cond.Value())
+			}
+			dayStart := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, env.Timezone())
+			dayEnd := dayStart.AddDate(0, 0, 1)
+
+			switch cond.Operator() {
+			case contactql.OpEqual:
+				after, before = &dayStart, &dayEnd
+			case contactql.OpGreaterThan:
+				after = &dayEnd
+			case contactql.OpGreaterThanOrEqual:
+				after = &dayStart
+			case contactql.OpLessThan:
+				before = &dayStart
+			case contactql.OpLessThanOrEqual:
+				before = &dayEnd
+			}
+		}
+		return nil
+	}
+
+	if err := visit(query.Root()); err != nil {
+		return nil, nil, err
+	}
+	if hasSaidOn && !hasSaid {
+		return nil, nil, newQueryAttributeError("%s can only be used with a said condition", QueryAttributeSaidOn)
+	}
+
+	return after, before, nil
+}
+
+// queryCompiler compiles parsed contact queries into elastic queries. Parts of the query which don't use our attributes
+// are compiled by contactql, and conditions on our attributes are compiled by us, keeping the structure of the query.
+type queryCompiler struct {
+	ctx        context.Context
+	db         Queryer
+	client     *elastic.Client
+	oa         *OrgAssets
+	saidAfter  *time.Time
+	saidBefore *time.Time
+
+	// what each node of the query is compiled to by contactql
+	sources map[contactql.QueryNode]interface{}
+}
+
+// ToElasticQuery compiles the passed in parsed contact query into an elastic query
+func ToElasticQuery(ctx context.Context, db Queryer, client *elastic.Client, oa *OrgAssets, query *contactql.ContactQuery) (elastic.Query, error) {
+	if !hasAttributeConditions(oa, query.Root()) {
+		return es.ToElasticQuery(oa.Env(), query), nil
+	}
+
+	after, before, err := saidRange(oa, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// contactql can only compile whole queries, so we compile the whole query and take the parts of it which don't use
+	// our attributes from that, as our attributes are parsed as fields which contactql compiles without error
+	source, err := es.ToElasticQuery(oa.Env(), query).Source()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error compiling query: %s", query)
+	}
+	sources := make(map[contactql.QueryNode]interface{})
+	if err := indexQuerySources(query.Root(), source, sources); err != nil {
+		return nil, err
+	}
+
+	c := &queryCompiler{ctx: ctx, db: db, client: client, oa: oa, saidAfter: after, saidBefore: before, sources: sources}
+	return c.compile(query.Root())
+}
+
+// records the part of the passed in elastic query source which each node of the passed in query is compiled to, which
+// contactql compiles to a bool query for each combination and a query for each condition
+func indexQuerySources(node contactql.QueryNode, source interface{}, sources map[contactql.QueryNode]interface{}) error {
+	sources[node] = source
+
+	combo, ok := node.(*contactql.BoolCombination)
+	if !ok {
+		return nil
+	}
+
+	clause := "must"
+	if combo.Operator() == contactql.BoolOperatorOr {
+		clause = "should"
+	}
+
+	var children []interface{}
+	if bq, ok := source.(map[string]interface{})["bool"].(map[string]interface{}); ok {
+		switch c := bq[clause].(type) {
+		case []interface{}:
+			children = c
+		case map[string]interface{}:
+			children = []interface{}{c}
+		}
+	}
+	if len(children) != len(combo.Children()) {
+		return errors.Errorf("unexpected elastic query compiled for: %s", node)
+	}
+
+	for i, child := range combo.Children() {
+		if err := indexQuerySources(child, children[i], sources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// an elastic query which is already compiled to its source
+type sourceQuery struct {
+	source interface{}
+}
+
+func (q *sourceQuery) Source() (interface{}, error) { return q.source, nil }
+
+func (c *queryCompiler) compile(node contactql.QueryNode) (elastic.Query, error) {
+	if !hasAttributeConditions(c.oa, node) {
+		return &sourceQuery{source: c.sources[node]}, nil
+	}
+
+	if combo, ok := node.(*contactql.BoolCombination); ok {
+		children := make([]elastic.Query, 0, len(combo.Children()))
+		for _, child := range combo.Children() {
+			// said_on conditions aren't conditions themselves but restrict said conditions
+			if _, key := conditionAttribute(c.oa, child); key == QueryAttributeSaidOn {
+				continue
+			}
+
+			q, err := c.compile(child)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, q)
+		}
+
+		if combo.Operator() == contactql.BoolOperatorAnd {
+			return elastic.NewBoolQuery().Must(children...), nil
+		}
+		return elastic.NewBoolQuery().Should(children...), nil
+	}
+
+	cond, key := conditionAttribute(c.oa, node)
+	q, err := c.compileCondition(cond, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNegated(cond, key) {
+		return elastic.NewBoolQuery().MustNot(q), nil
+	}
+	return q, nil
+}
+
+// returns whether the passed in condition on one of our attributes matches what it's compiled to, or everything else
+func isNegated(cond *contactql.Condition, key string) bool {
+	return key != QueryAttributeOpenTickets && cond.Operator() == contactql.OpNotEqual
+}
+
+// compiles the passed in condition on one of our attributes, ignoring any negation
+func (c *queryCompiler) compileCondition(cond *contactql.Condition, key string) (elastic.Query, error) {
+	switch key {
+	case QueryAttributeSaid:
+		ids, err := ContactIDsWhoSaid(c.ctx, c.client, c.oa.OrgID(), cond.Value(), c.saidAfter, c.saidBefore, nil)
+		if err != nil {
+			return nil, err
+		}
+		return contactIDsQuery(ids), nil
+	case QueryAttributeEntered, QueryAttributeCompleted, QueryAttributeLastFlow:
+		flowIDs, err := flowIDsForName(c.ctx, c.db, c.oa.OrgID(), cond.Value())
+		if err != nil {
+			return nil, err
+		}
+		if len(flowIDs) == 0 {
+			return elastic.NewMatchNoneQuery(), nil
+		}
+		ids := make([]interface{}, len(flowIDs))
+		for i := range flowIDs {
+			ids[i] = flowIDs[i]
+		}
+		return elastic.NewTermsQuery(runConditionFields[RunConditionType(key)], ids...), nil
+	case QueryAttributeOpenTickets:
+		return ticketCountQuery(cond)
+	}
+	return nil, errors.Errorf("unknown query attribute: %s", key)
+}
+
+// compiles the passed in open_tickets condition to a query on the open ticket counts of contacts
+func ticketCountQuery(cond *contactql.Condition) (elastic.Query, error) {
+	count, _ := strconv.Atoi(cond.Value())
+
+	switch cond.Operator() {
+	case contactql.OpEqual:
+		return elastic.NewTermQuery(contactFieldTicketCount, count), nil
+	case contactql.OpNotEqual:
+		return elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(contactFieldTicketCount, count)), nil
+	case contactql.OpGreaterThan:
+		return elastic.NewRangeQuery(contactFieldTicketCount).Gt(count), nil
+	case contactql.OpGreaterThanOrEqual:
+		return elastic.NewRangeQuery(contactFieldTicketCount).Gte(count), nil
+	case contactql.OpLessThan:
+		return elastic.NewRangeQuery(contactFieldTicketCount).Lt(count), nil
+	case contactql.OpLessThanOrEqual:
+		return elastic.NewRangeQuery(contactFieldTicketCount).Lte(count), nil
+	}
+	return nil, newQueryAttributeError("%s conditions can't use %s", QueryAttributeOpenTickets, cond.Operator())
+}
+
+func contactIDsQuery(contactIDs []ContactID) elastic.Query {
+	ids := make([]string, len(contactIDs))
+	for i := range contactIDs {
+		ids[i] = fmt.Sprintf("%d", contactIDs[i])
+	}
+	return elastic.NewIdsQuery("_doc").Ids(ids...)
+}
+
+// EvaluateQuery evaluates the passed in parsed contact query against the passed in contacts, returning the ids of those
+// which match. Parts of the query which don't use our attributes are evaluated by contactql.
+func EvaluateQuery(ctx context.Context, db Queryer, client *elastic.Client, oa *OrgAssets, query *contactql.ContactQuery, contacts []*Contact) ([]ContactID, error) {
+	after, before, err := saidRange(oa, query)
+	if err != nil {
+		return nil, err
+	}
+
+	contactIDs := make([]ContactID, len(contacts))
+	for i, c := range contacts {
+		contactIDs[i] = c.ID()
+	}
+
+	e := &queryEvaluator{
+		queryCompiler: queryCompiler{ctx: ctx, db: db, client: client, oa: oa, saidAfter: after, saidBefore: before},
+		contactIDs:    contactIDs,
+		matches:       make(map[*contactql.Condition]map[ContactID]bool),
+	}
+
+	matched := make([]ContactID, 0, len(contacts))
+	for _, c := range contacts {
+		match, err := e.evaluate(query.Root(), c)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matched = append(matched, c.ID())
+		}
+	}
+	return matched, nil
+}
+
+// queryEvaluator evaluates queries against a set of contacts, resolving each condition on our attributes once for
+// all the contacts
+type queryEvaluator struct {
+	queryCompiler
+
+	contactIDs []ContactID
+	matches    map[*contactql.Condition]map[ContactID]bool
+}
+
+func (e *queryEvaluator) evaluate(node contactql.QueryNode, contact *Contact) (bool, error) {
+	if !hasAttributeConditions(e.oa, node) {
+		flowContact, err := contact.FlowContact(e.oa)
+		if err != nil {
+			return false, errors.Wrapf(err, "error creating flow contact for contact: %d", contact.ID())
+		}
+		return node.Evaluate(e.oa.Env(), flowContact)
+	}
+
+	if combo, ok := node.(*contactql.BoolCombination); ok {
+		and := combo.Operator() == contactql.BoolOperatorAnd
+
+		for _, child := range combo.Children() {
+			if _, key := conditionAttribute(e.oa, child); key == QueryAttributeSaidOn {
+				continue
+			}
+
+			match, err := e.evaluate(child, contact)
+			if err != nil {
+				return false, err
+			}
+			if match != and {
+				return match, nil
+			}
+		}
+		return and, nil
+	}
+
+	cond, key := conditionAttribute(e.oa, node)
+	matches := e.matches[cond]
+	if matches == nil {
+		ids, err := e.resolveForContacts(cond, key)
+		if err != nil {
+			return false, err
+		}
+		matches = make(map[ContactID]bool, len(ids))
+		for _, id := range ids {
+			matches[id] = true
+		}
+		e.matches[cond] = matches
+	}
+
+	return matches[contact.ID()] != isNegated(cond, key), nil
+}
+
+// resolves the passed in condition on one of our attributes to the ids of the contacts being evaluated which it matches,
+// ignoring any negation
+func (e *queryEvaluator) resolveForContacts(cond *contactql.Condition, key string) ([]ContactID, error) {
+	switch key {
+	case QueryAttributeSaid:
+		return ContactIDsWhoSaid(e.ctx, e.client, e.oa.OrgID(), cond.Value(), e.saidAfter, e.saidBefore, e.contactIDs)
+	case QueryAttributeEntered, QueryAttributeCompleted, QueryAttributeLastFlow:
+		return ContactIDsForRunCondition(e.ctx, e.db, e.oa.OrgID(), &RunCondition{Type: RunConditionType(key), Flow: cond.Value()}, e.contactIDs)
+	case QueryAttributeOpenTickets:
+		count, _ := strconv.Atoi(cond.Value())
+		return ContactIDsForTicketCondition(e.ctx, e.db, &TicketCondition{Comparator: string(cond.Operator()), Count: count}, e.contactIDs)
+	}
+	return nil, errors.Errorf("unknown query attribute: %s", key)
+}
+
+// MaxSaidContacts is the maximum number of contacts a said condition can match, as they're included in contact queries by id
+const MaxSaidContacts = 10000
+
+// how many contacts we fetch at a time when resolving said conditions
+const saidContactsPageSize = 1000
+
+// ContactIDsWhoSaid returns the ids of the contacts who sent messages containing the passed in text, optionally only
+// those sent within the passed in date range, using the messages index. If contact ids are passed then only those
+// contacts are considered. Texts which match more than MaxSaidContacts contacts are an error.
+func ContactIDsWhoSaid(ctx context.Context, client *elastic.Client, orgID OrgID, text string, after, before *time.Time, contactIDs []ContactID) ([]ContactID, error) {
+	if client == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	eq := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("org_id", orgID)).
+		Filter(elastic.NewTermQuery("direction", DirectionIn)).
+		MustNot(elastic.NewTermQuery("visibility", VisibilityDeleted)).
+		Must(elastic.NewMatchPhraseQuery("text", text))
+
+	if after != nil || before != nil {
+		createdOn := elastic.NewRangeQuery("created_on")
+		if after != nil {
+			createdOn = createdOn.Gte(*after)
+		}
+		if before != nil {
+			createdOn = createdOn.Lt(*before)
+		}
+		eq = eq.Filter(createdOn)
+	}
+	if len(contactIDs) > 0 {
+		ids := make([]interface{}, len(contactIDs))
+		for i, id := range contactIDs {
+			ids[i] = id
+		}
+		eq = eq.Filter(elastic.NewTermsQuery("contact_id", ids...))
+	}
+
+	ids := make([]ContactID, 0, saidContactsPageSize)
+	var afterKey map[string]interface{}
+
+	// page through the contacts who sent matching messages using a composite aggregation
+	for {
+		agg := elastic.NewCompositeAggregation().
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("contact_id").Field("contact_id")).
+			Size(saidContactsPageSize)
+		if afterKey != nil {
+			agg = agg.AggregateAfter(afterKey)
+		}
+
+		results, err := client.Search(msgsIndex).
+			Routing(strconv.FormatInt(int64(orgID), 10)).
+			Query(eq).
+			Size(0).
+			Aggregation("contacts", agg).
+			Do(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error searching messages for: %s", text)
+		}
+
+		contacts, found := results.Aggregations.Composite("contacts")
+		if !found {
+			return nil, errors.Errorf("missing contacts aggregation in messages search for: %s", text)
+		}
+
+		for _, bucket := range contacts.Buckets {
+			id, err := bucketContactID(bucket.Key["contact_id"])
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+
+		if len(ids) > MaxSaidContacts {
+			return nil, newQueryAttributeError("said \"%s\" matches more than %d contacts, try narrowing it with said_on", text, MaxSaidContacts)
+		}
+		if len(contacts.Buckets) < saidContactsPageSize || contacts.AfterKey == nil {
+			return ids, nil
+		}
+		afterKey = contacts.AfterKey
+	}
+}
+
+func bucketContactID(key interface{}) (ContactID, error) {
+	switch k := key.(type) {
+	case float64:
+		return ContactID(k), nil
+	case json.Number:
+		id, err := k.Int64()
+		return ContactID(id), err
+	}
+	return NilContactID, errors.Errorf("unexpected contact id in messages search: %v", key)
+}
+
+// the fields of contacts which conditions on flows and tickets are compiled to. These are kept up to date on contacts as
+// runs are written and tickets are opened and closed, and must be included in the contact documents written by the
+// indexer for these conditions to be used in searches.
+const (
+	contactFieldTicketCount      = "ticket_count"
+	contactFieldLastFlowID       = "last_flow_id"
+	contactFieldEnteredFlowIDs   = "entered_flow_ids"
+	contactFieldCompletedFlowIDs = "completed_flow_ids"
+)
+
+// RunConditionType is the type of a run condition
+type RunConditionType string
+
+// the run condition types we support
+const (
+	RunConditionEntered   = RunConditionType(QueryAttributeEntered)
+	RunConditionCompleted = RunConditionType(QueryAttributeCompleted)
+	RunConditionLastFlow  = RunConditionType(QueryAttributeLastFlow)
+)
+
+var runConditionFields = map[RunConditionType]string{
+	RunConditionEntered:   contactFieldEnteredFlowIDs,
+	RunConditionCompleted: contactFieldCompletedFlowIDs,
+	RunConditionLastFlow:  contactFieldLastFlowID,
+}
+
+// RunCondition is a condition on the flows a contact has run through, e.g. entered = "Registration"
+type RunCondition struct {
+	Type RunConditionType
+	Flow string
+}
+
+const selectFlowIDsForNameSQL = `
+SELECT
+	id
+FROM
+	flows_flow
+WHERE
+	org_id = $1 AND
+	is_active = TRUE AND
+	LOWER(name) = LOWER($2)
+`
+
+// returns the ids of the active flows with the passed in name, of which there can be more than one
+func flowIDsForName(ctx context.Context, db Queryer, orgID OrgID, name string) ([]int64, error) {
+	ids := make([]int64, 0, 1)
+	err := db.SelectContext(ctx, &ids, selectFlowIDsForNameSQL, orgID, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting flows with name: %s", name)
+	}
+	return ids, nil
+}
+
+const selectContactIDsForRunSQL = `
+SELECT
+	id
+FROM
+	contacts_contact
+WHERE
+	id = ANY($1) AND
+	%s
+`
+
+var runConditionSQL = map[RunConditionType]string{
+	RunConditionEntered:   `entered_flow_ids && $2`,
+	RunConditionCompleted: `completed_flow_ids && $2`,
+	RunConditionLastFlow:  `last_flow_id = ANY($2)`,
+}
+
+// ContactIDsForRunCondition returns the ids of those of the passed in contacts whose flow history matches the passed in
+// condition
+func ContactIDsForRunCondition(ctx context.Context, db Queryer, orgID OrgID, cond *RunCondition, contactIDs []ContactID) ([]ContactID, error) {
+	where, found := runConditionSQL[cond.Type]
+	if !found {
+		return nil, errors.Errorf("invalid run condition type: %s", cond.Type)
+	}
+
+	flowIDs, err := flowIDsForName(ctx, db, orgID, cond.Flow)
+	if err != nil {
+		return nil, err
+	}
+	if len(flowIDs) == 0 || len(contactIDs) == 0 {
+		return []ContactID{}, nil
+	}
+
+	ids, err := queryContactIDs(ctx, db, fmt.Sprintf(selectContactIDsForRunSQL, where), pq.Array(contactIDs), pq.Int64Array(flowIDs))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts for %s condition on flow: %s", cond.Type, cond.Flow)
+	}
+	return ids, nil
+}
+
+// TicketCondition is a condition on the number of open tickets a contact has, e.g. open_tickets > 0
+type TicketCondition struct {
+	Comparator string
+	Count      int
+}
+
+const selectContactIDsForOpenTicketsSQL = `
+SELECT
+	id
+FROM
+	contacts_contact
+WHERE
+	id = ANY($1) AND
+	ticket_count %s $2
+`
+
+// ContactIDsForTicketCondition returns the ids of those of the passed in contacts whose number of open tickets matches
+// the passed in condition
+func ContactIDsForTicketCondition(ctx context.Context, db Queryer, cond *TicketCondition, contactIDs []ContactID) ([]ContactID, error) {
+	// comparator is restricted to a known set by the parser but be paranoid since it's going into SQL
+	switch cond.Comparator {
+	case ">=", "<=", "!=", "=", ">", "<":
+	default:
+		return nil, errors.Errorf("invalid comparator for open tickets: %s", cond.Comparator)
+	}
+
+	if len(contactIDs) == 0 {
+		return []ContactID{}, nil
+	}
+
+	ids, err := queryContactIDs(ctx, db, fmt.Sprintf(selectContactIDsForOpenTicketsSQL, cond.Comparator), pq.Array(contactIDs), cond.Count)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting contacts with open tickets %s %d", cond.Comparator, cond.Count)
+	}
+	return ids, nil
+}
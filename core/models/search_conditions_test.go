@@ -0,0 +1,341 @@
+package models_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryWithAttributes(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		Query              string
+		ExpectedAttributes []string
+		ExpectedError      string
+	}{
+		{Query: `said = "stop it"`, ExpectedAttributes: []string{"said"}},
+		{Query: `name = "Bob" OR said != "stop it"`, ExpectedAttributes: []string{"name", "said"}},
+		{Query: `said = "stop" AND said_on >= 2021-01-01 AND said_on < 2021-02-01`, ExpectedAttributes: []string{"said", "said_on"}},
+		{Query: `entered = "Registration" AND completed != "Registration"`, ExpectedAttributes: []string{"entered", "completed"}},
+		{Query: `last_flow = "Favorites" OR open_tickets > 0`, ExpectedAttributes: []string{"last_flow", "open_tickets"}},
+		{Query: `said > "stop"`, ExpectedError: "said conditions can only use = or !="},
+		{Query: `age > 10 AND said_on > 2021-01-01`, ExpectedError: "said_on can only be used with a said condition"},
+		{Query: `said = "stop" OR said_on > 2021-01-01`, ExpectedError: "said_on conditions can only be combined with other conditions using AND"},
+		{Query: `open_tickets > 1.5`, ExpectedError: "invalid number of open tickets: 1.5"},
+		{Query: `open_tickets ~ 1`, ExpectedError: "open_tickets conditions can't use ~"},
+	}
+
+	for _, tc := range tcs {
+		parsed, err := models.ParseQuery(oa, tc.Query)
+
+		if tc.ExpectedError != "" {
+			assert.EqualError(t, err, tc.ExpectedError, "error mismatch for query '%s'", tc.Query)
+
+			isQueryError, _ := models.IsQueryError(err)
+			assert.True(t, isQueryError, "expected query error for query '%s'", tc.Query)
+		} else {
+			require.NoError(t, err, "unexpected error for query '%s'", tc.Query)
+
+			inspection := models.InspectQuery(oa, parsed)
+			assert.ElementsMatch(t, tc.ExpectedAttributes, inspection.Attributes, "attributes mismatch for query '%s'", tc.Query)
+			assert.Equal(t, 0, len(inspection.Fields), "fields mismatch for query '%s'", tc.Query)
+			assert.False(t, inspection.AllowAsGroup, "allow as group mismatch for query '%s'", tc.Query)
+		}
+	}
+}
+
+func TestParseQueryWithConflictingFields(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	// give the org its own field with the same key as one of our attributes
+	db.MustExec(`UPDATE contacts_contactfield SET key = 'said' WHERE id = $1`, testdata.GenderField.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshFields)
+	require.NoError(t, err)
+
+	// conditions on that key are conditions on the org's field, which can still be used for groups
+	parsed, err := models.ParseQuery(oa, `said = "stop"`)
+	require.NoError(t, err)
+
+	inspection := models.InspectQuery(oa, parsed)
+	assert.Equal(t, 0, len(inspection.Attributes))
+	assert.Equal(t, 1, len(inspection.Fields))
+	assert.Equal(t, "said", inspection.Fields[0].Key)
+	assert.True(t, inspection.AllowAsGroup)
+
+	// so there's no said condition for said_on to restrict
+	_, err = models.ParseQuery(oa, `said = "stop" AND said_on > 2021-01-01`)
+	assert.EqualError(t, err, "said_on can only be used with a said condition")
+
+	// and other attributes are unaffected
+	parsed, err = models.ParseQuery(oa, `said = "stop" AND entered = "Registration"`)
+	require.NoError(t, err)
+
+	inspection = models.InspectQuery(oa, parsed)
+	assert.Equal(t, []string{"entered"}, inspection.Attributes)
+	assert.Equal(t, 1, len(inspection.Fields))
+	assert.False(t, inspection.AllowAsGroup)
+}
+
+func TestRunAndTicketAttributesWithConflictingFields(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	// existing groups can be using org fields with the same keys as our run and ticket attributes
+	db.MustExec(`UPDATE contacts_contactfield SET key = 'completed' WHERE id = $1`, testdata.GenderField.ID)
+	db.MustExec(`UPDATE contacts_contactfield SET key = 'open_tickets' WHERE id = $1`, testdata.AgeField.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshFields)
+	require.NoError(t, err)
+
+	parsed, err := models.ParseQuery(oa, `completed = "Registration" AND open_tickets > 1.5`)
+	require.NoError(t, err)
+
+	// so those queries are still on the fields and can still be used for groups
+	inspection := models.InspectQuery(oa, parsed)
+	assert.Equal(t, 0, len(inspection.Attributes))
+	assert.Equal(t, 2, len(inspection.Fields))
+	assert.ElementsMatch(t, []string{"completed", "open_tickets"}, []string{inspection.Fields[0].Key, inspection.Fields[1].Key})
+	assert.True(t, inspection.AllowAsGroup)
+
+	// and are compiled by contactql rather than to our contact fields
+	compiled, err := models.ToElasticQuery(ctx, db, nil, oa, parsed)
+	require.NoError(t, err)
+
+	source, err := compiled.Source()
+	require.NoError(t, err)
+	sourceJSON, err := json.Marshal(source)
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(sourceJSON), "completed_flow_ids")
+	assert.NotContains(t, string(sourceJSON), "ticket_count")
+	assert.Contains(t, string(sourceJSON), string(testdata.GenderField.UUID))
+}
+
+func TestContactIDsWhoSaid(t *testing.T) {
+	ctx := testsuite.CTX()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	es.NextResponse = fmt.Sprintf(`{
+		"took": 2,
+		"hits": {"total": {"value": 3}, "max_score": null, "hits": []},
+		"aggregations": {
+			"contacts": {
+				"after_key": {"contact_id": %d},
+				"buckets": [
+					{"key": {"contact_id": %d}, "doc_count": 2},
+					{"key": {"contact_id": %d}, "doc_count": 1}
+				]
+			}
+		}
+	}`, testdata.Bob.ID, testdata.Cathy.ID, testdata.Bob.ID)
+
+	after := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	ids, err := models.ContactIDsWhoSaid(ctx, client, testdata.Org1.ID, "stop it", &after, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, ids)
+
+	assert.Contains(t, es.LastBody, `{"match_phrase":{"text":{"query":"stop it"}}}`)
+	assert.Contains(t, es.LastBody, `{"term":{"direction":"I"}}`)
+	assert.Contains(t, es.LastBody, `{"term":{"visibility":"D"}}`)
+	assert.Contains(t, es.LastBody, `"2021-06-01T00:00:00Z"`)
+	assert.Contains(t, es.LastBody, `"composite"`)
+	assert.Contains(t, es.LastBody, `"size":0`)
+
+	// can also be restricted to particular contacts
+	es.NextResponse = `{"took": 2, "hits": {"total": {"value": 0}, "hits": []}, "aggregations": {"contacts": {"buckets": []}}}`
+
+	ids, err = models.ContactIDsWhoSaid(ctx, client, testdata.Org1.ID, "stop it", nil, nil, []models.ContactID{testdata.George.ID})
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{}, ids)
+	assert.Contains(t, es.LastBody, fmt.Sprintf(`{"terms":{"contact_id":[%d]}}`, testdata.George.ID))
+}
+
+func TestToElasticQueryWithAttributes(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		Query         string
+		SaidResponse  string
+		ExpectedQuery string
+	}{
+		{ // conditions on our attributes keep their place in the query
+			Query:        `said != "stop it" OR open_tickets > 1`,
+			SaidResponse: fmt.Sprintf(`{"took": 2, "hits": {"total": {"value": 1}, "hits": []}, "aggregations": {"contacts": {"buckets": [{"key": {"contact_id": %d}, "doc_count": 1}]}}}`, testdata.Bob.ID),
+			ExpectedQuery: fmt.Sprintf(`{"bool": {"should": [
+				{"bool": {"must_not": {"ids": {"type": "_doc", "values": ["%d"]}}}},
+				{"range": {"ticket_count": {"from": 1, "include_lower": false, "include_upper": true, "to": null}}}
+			]}}`, testdata.Bob.ID),
+		},
+		{
+			Query:         `open_tickets != 0`,
+			ExpectedQuery: `{"bool": {"must_not": {"term": {"ticket_count": 0}}}}`,
+		},
+		{ // flow names are matched case-insensitively
+			Query:         `entered = "favorites"`,
+			ExpectedQuery: fmt.Sprintf(`{"terms": {"entered_flow_ids": [%d]}}`, testdata.Favorites.ID),
+		},
+		{
+			Query: `completed != "Favorites" AND last_flow = "Pick a Number"`,
+			ExpectedQuery: fmt.Sprintf(`{"bool": {"must": [
+				{"bool": {"must_not": {"terms": {"completed_flow_ids": [%d]}}}},
+				{"terms": {"last_flow_id": [%d]}}
+			]}}`, testdata.Favorites.ID, testdata.PickANumber.ID),
+		},
+		{ // flows which don't exist match no contacts
+			Query:         `entered = "Nope"`,
+			ExpectedQuery: `{"match_none": {}}`,
+		},
+	}
+
+	for _, tc := range tcs {
+		es.NextResponse = tc.SaidResponse
+
+		parsed, err := models.ParseQuery(oa, tc.Query)
+		require.NoError(t, err, "unexpected error parsing query '%s'", tc.Query)
+
+		compiled, err := models.ToElasticQuery(ctx, db, client, oa, parsed)
+		require.NoError(t, err, "unexpected error compiling query '%s'", tc.Query)
+
+		source, err := compiled.Source()
+		require.NoError(t, err)
+		sourceJSON, err := json.Marshal(source)
+		require.NoError(t, err)
+
+		assert.JSONEq(t, tc.ExpectedQuery, string(sourceJSON), "compiled query mismatch for query '%s'", tc.Query)
+	}
+}
+
+func TestEvaluateQueryWithAttributes(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Help", "Help me", "", nil)
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Help", "Help me again", "", nil)
+
+	err = models.UpdateContactTicketCounts(ctx, db, []models.ContactID{testdata.Cathy.ID})
+	require.NoError(t, err)
+
+	db.MustExec(`UPDATE contacts_contact SET entered_flow_ids = $2, last_flow_id = $3 WHERE id = $1`, testdata.George.ID, pq.Array([]models.FlowID{testdata.Favorites.ID, testdata.PickANumber.ID}), testdata.PickANumber.ID)
+
+	contacts, err := models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID})
+	require.NoError(t, err)
+
+	tcs := []struct {
+		Query           string
+		ExpectedMatches []models.ContactID
+	}{
+		{`open_tickets > 1 OR name = "Bob"`, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}},
+		{`open_tickets < 2 AND name != "Bob"`, []models.ContactID{testdata.George.ID}},
+		{`entered = "Favorites"`, []models.ContactID{testdata.George.ID}},
+		{`last_flow != "Favorites"`, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}},
+		{`last_flow = "Pick A Number" AND open_tickets = 0`, []models.ContactID{testdata.George.ID}},
+		{`completed = "Favorites"`, []models.ContactID{}},
+	}
+
+	for _, tc := range tcs {
+		parsed, err := models.ParseQuery(oa, tc.Query)
+		require.NoError(t, err, "unexpected error parsing query '%s'", tc.Query)
+
+		matched, err := models.EvaluateQuery(ctx, db, nil, oa, parsed, contacts)
+		require.NoError(t, err, "unexpected error evaluating query '%s'", tc.Query)
+		assert.ElementsMatch(t, tc.ExpectedMatches, matched, "matches mismatch for query '%s'", tc.Query)
+	}
+}
+
+func TestContactIDsForRunAndTicketConditions(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE contacts_contact SET entered_flow_ids = $2, completed_flow_ids = $2, last_flow_id = $3 WHERE id = ANY($1)`,
+		pq.Array([]models.ContactID{testdata.Cathy.ID, testdata.George.ID}), pq.Array([]models.FlowID{testdata.Favorites.ID}), testdata.Favorites.ID)
+	db.MustExec(`UPDATE contacts_contact SET entered_flow_ids = $2, last_flow_id = $3 WHERE id = $1`,
+		testdata.Bob.ID, pq.Array([]models.FlowID{testdata.Favorites.ID, testdata.PickANumber.ID}), testdata.PickANumber.ID)
+
+	contactIDs := []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID, testdata.Alexandria.ID}
+
+	ids, err := models.ContactIDsForRunCondition(ctx, db, testdata.Org1.ID, &models.RunCondition{Type: models.RunConditionEntered, Flow: "favorites"}, contactIDs)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID}, ids)
+
+	ids, err = models.ContactIDsForRunCondition(ctx, db, testdata.Org1.ID, &models.RunCondition{Type: models.RunConditionCompleted, Flow: "Favorites"}, contactIDs)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, ids)
+
+	ids, err = models.ContactIDsForRunCondition(ctx, db, testdata.Org1.ID, &models.RunCondition{Type: models.RunConditionLastFlow, Flow: "Favorites"}, contactIDs[1:])
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.ContactID{testdata.George.ID}, ids)
+
+	ids, err = models.ContactIDsForRunCondition(ctx, db, testdata.Org1.ID, &models.RunCondition{Type: models.RunConditionEntered, Flow: "Nope"}, contactIDs)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.ContactID{}, ids)
+
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Help", "Help me", "", nil)
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Help", "Help me again", "", nil)
+	testdata.InsertClosedTicket(db, testdata.Org1, testdata.Bob, testdata.Mailgun, "Help", "Help me", "", nil)
+
+	err = models.UpdateContactTicketCounts(ctx, db, contactIDs)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND ticket_count = 2`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND ticket_count = 0`, []interface{}{testdata.Bob.ID}, 1)
+
+	ids, err = models.ContactIDsForTicketCondition(ctx, db, &models.TicketCondition{Comparator: ">", Count: 1}, contactIDs)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID}, ids)
+
+	ids, err = models.ContactIDsForTicketCondition(ctx, db, &models.TicketCondition{Comparator: "=", Count: 0}, contactIDs)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.ContactID{testdata.Bob.ID, testdata.George.ID, testdata.Alexandria.ID}, ids)
+
+	_, err = models.ContactIDsForTicketCondition(ctx, db, &models.TicketCondition{Comparator: "; DROP", Count: 1}, contactIDs)
+	assert.EqualError(t, err, "invalid comparator for open tickets: ; DROP")
+}
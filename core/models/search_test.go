@@ -239,7 +239,7 @@ func TestContactIDsForQueryPage(t *testing.T) {
 	for i, tc := range tcs {
 		es.NextResponse = tc.MockedESResponse
 
-		_, ids, total, err := models.ContactIDsForQueryPage(ctx, client, oa, tc.Group, tc.ExcludeIDs, tc.Query, tc.Sort, 0, 50)
+		_, ids, total, err := models.ContactIDsForQueryPage(ctx, db, client, oa, tc.Group, tc.ExcludeIDs, tc.Query, tc.Sort, 0, 50)
 
 		if tc.ExpectedError != "" {
 			assert.EqualError(t, err, tc.ExpectedError)
@@ -401,7 +401,7 @@ func TestContactIDsForQuery(t *testing.T) {
 	for i, tc := range tcs {
 		es.NextResponse = tc.MockedESResponse
 
-		ids, err := models.ContactIDsForQuery(ctx, client, oa, tc.Query)
+		ids, err := models.ContactIDsForQuery(ctx, db, client, oa, tc.Query)
 
 		if tc.ExpectedError != "" {
 			assert.EqualError(t, err, tc.ExpectedError)
@@ -413,3 +413,76 @@ func TestContactIDsForQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestGlobalSearch(t *testing.T) {
+	ctx := testsuite.CTX()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	es.NextResponse = `{
+		"responses": [
+			{
+				"took": 2,
+				"hits": {"total": {"value": 2}, "max_score": 4.0, "hits": [
+					{"_index": "contacts", "_id": "10001", "_score": 4.0},
+					{"_index": "contacts", "_id": "10002", "_score": 1.0}
+				]}
+			},
+			{
+				"took": 2,
+				"hits": {"total": {"value": 0}, "max_score": null, "hits": []}
+			},
+			{
+				"took": 2,
+				"hits": {"total": {"value": 1}, "max_score": 9.0, "hits": [
+					{"_index": "tickets", "_id": "123", "_score": 6.0}
+				]}
+			}
+		]
+	}`
+
+	results, err := models.GlobalSearch(ctx, client, testdata.Org1.ID, "bob", models.AllSearchResultTypes, 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, []*models.SearchResult{
+		{Type: models.SearchResultTypeContact, ID: 10001, Score: 1},
+		{Type: models.SearchResultTypeTicket, ID: 123, Score: 1},
+		{Type: models.SearchResultTypeContact, ID: 10002, Score: 0.25},
+	}, results)
+
+	// each type is searched in its own index
+	assert.Contains(t, es.LastBody, `"contacts"`)
+	assert.Contains(t, es.LastBody, `"msgs"`)
+	assert.Contains(t, es.LastBody, `"tickets"`)
+
+	// only requested types are searched and results are limited
+	es.NextResponse = `{
+		"responses": [
+			{
+				"took": 2,
+				"hits": {"total": {"value": 2}, "max_score": 4.0, "hits": [
+					{"_index": "contacts", "_id": "10001", "_score": 4.0},
+					{"_index": "contacts", "_id": "10002", "_score": 1.0}
+				]}
+			}
+		]
+	}`
+
+	results, err = models.GlobalSearch(ctx, client, testdata.Org1.ID, "bob", []models.SearchResultType{models.SearchResultTypeContact}, 1)
+	require.NoError(t, err)
+
+	assert.Equal(t, []*models.SearchResult{{Type: models.SearchResultTypeContact, ID: 10001, Score: 1}}, results)
+	assert.NotContains(t, es.LastBody, `tickets`)
+
+	// unknown types are an error
+	_, err = models.GlobalSearch(ctx, client, testdata.Org1.ID, "bob", []models.SearchResultType{"flows"}, 10)
+	assert.EqualError(t, err, "unknown search result type: flows")
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/mailroom/config"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// sorted set of pending session timers, scored by the timeout in microseconds since the epoch so that we can
+// reproduce exactly the timeout_on value stored in the database
+const sessionTimersKey = "session_timers"
+
+// SessionTimer is a durable timer for a session waiting with a short timeout, e.g. a delay between messages
+type SessionTimer struct {
+	OrgID     OrgID
+	ContactID ContactID
+	SessionID SessionID
+	TimeoutOn time.Time
+}
+
+func (t *SessionTimer) member() string {
+	return fmt.Sprintf("%d:%d:%d", t.OrgID, t.ContactID, t.SessionID)
+}
+
+// ScheduleSessionTimer adds or updates the timer for the given session. There is only ever one timer per session and
+// if the maximum number of pending timers has been reached, the timer isn't added and we return false. A maximum of
+// zero means there is no limit.
+func ScheduleSessionTimer(rc redis.Conn, timer *SessionTimer, maxPending int) (bool, error) {
+	added, err := redis.Int(scheduleSessionTimer.Do(rc, sessionTimersKey, timerScore(timer.TimeoutOn), timer.member(), maxPending))
+	if err != nil {
+		return false, errors.Wrapf(err, "error scheduling timer for session #%d", timer.SessionID)
+	}
+	return added == 1, nil
+}
+
+// ScheduleTimer schedules a timer for this session's timeout if it has one which is soon enough to be worth resuming
+// precisely, otherwise we leave it to the timeouts cron. If session waits are scheduled in redis, every timeout gets a
+// timer regardless of how far off it is.
+func (s *Session) ScheduleTimer(rc redis.Conn, cfg *config.Config) (bool, error) {
+	// voice sessions are timed out by their calls
+	if s.TimeoutOn() == nil || s.ConnectionID() != nil {
+		return false, nil
+	}
+
+	timer := &SessionTimer{OrgID: s.OrgID(), ContactID: s.ContactID(), SessionID: s.ID(), TimeoutOn: *s.TimeoutOn()}
+
+	if cfg.SessionWaits != config.SessionWaitsDB {
+		return ScheduleSessionTimer(rc, timer, 0)
+	}
+
+	if cfg.SessionTimersMaxSeconds <= 0 {
+		return false, nil
+	}
+	if time.Until(*s.TimeoutOn()) > time.Duration(cfg.SessionTimersMaxSeconds)*time.Second {
+		return false, nil
+	}
+
+	return ScheduleSessionTimer(rc, timer, cfg.SessionTimersMaxPending)
+}
+
+// PopDueSessionTimers removes and returns up to limit timers which are due as of now
+func PopDueSessionTimers(rc redis.Conn, now time.Time, limit int) ([]*SessionTimer, error) {
+	values, err := redis.Strings(popDueTimers.Do(rc, sessionTimersKey, timerScore(now), limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error popping due session timers")
+	}
+
+	// values are pairs of member and score
+	timers := make([]*SessionTimer, 0, len(values)/2)
+	for i := 0; i < len(values)-1; i += 2 {
+		ids, timeoutOn, err := parseTimer(values[i], values[i+1], 3)
+		if err != nil {
+			return nil, err
+		}
+
+		timers = append(timers, &SessionTimer{
+			OrgID:     OrgID(ids[0]),
+			ContactID: ContactID(ids[1]),
+			SessionID: SessionID(ids[2]),
+			TimeoutOn: timeoutOn,
+		})
+	}
+
+	return timers, nil
+}
+
+const selectUpcomingSessionTimersSQL = `
+SELECT org_id, contact_id, id AS session_id, timeout_on
+  FROM flows_flowsession
+ WHERE status = 'W' AND timeout_on < $1 AND connection_id IS NULL
+ ORDER BY timeout_on
+ LIMIT $2`
+
+// LoadUpcomingSessionTimers loads timers for the waiting sessions which will time out before the given time, so that
+// they can be reconciled with the timers we have scheduled
+func LoadUpcomingSessionTimers(ctx context.Context, db Queryer, before time.Time, limit int) ([]*SessionTimer, error) {
+	rows := make([]struct {
+		OrgID     OrgID     `db:"org_id"`
+		ContactID ContactID `db:"contact_id"`
+		SessionID SessionID `db:"session_id"`
+		TimeoutOn time.Time `db:"timeout_on"`
+	}, 0, 10)
+
+	if err := db.SelectContext(ctx, &rows, selectUpcomingSessionTimersSQL, before, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading upcoming session timeouts")
+	}
+
+	timers := make([]*SessionTimer, len(rows))
+	for i, r := range rows {
+		timers[i] = &SessionTimer{OrgID: r.OrgID, ContactID: r.ContactID, SessionID: r.SessionID, TimeoutOn: r.TimeoutOn}
+	}
+	return timers, nil
+}
+
+// timers are scored by their time in microseconds since the epoch
+func timerScore(t time.Time) int64 {
+	return t.Round(time.Microsecond).UnixNano() / int64(time.Microsecond)
+}
+
+// parses a timer member made of colon separated ids, and its score
+func parseTimer(member, score string, numIDs int) ([]int64, time.Time, error) {
+	parts := strings.Split(member, ":")
+	if len(parts) != numIDs {
+		return nil, time.Time{}, errors.Errorf("invalid timer: %s", member)
+	}
+
+	ids := make([]int64, numIDs)
+	for i, part := range parts {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, time.Time{}, errors.Errorf("invalid timer: %s", member)
+		}
+		ids[i] = id
+	}
+
+	micros, err := strconv.ParseInt(score, 10, 64)
+	if err != nil {
+		return nil, time.Time{}, errors.Errorf("invalid timer score: %s", score)
+	}
+
+	return ids, time.Unix(0, micros*int64(time.Microsecond)).UTC(), nil
+}
+
+var scheduleSessionTimer = redis.NewScript(1, `
+local key, score, member, maxPending = KEYS[1], ARGV[1], ARGV[2], tonumber(ARGV[3])
+
+-- updating an existing timer is always allowed, adding a new one only if we're under our limit or have no limit
+if maxPending <= 0 or redis.call("zscore", key, member) or redis.call("zcard", key) < maxPending then
+	redis.call("zadd", key, score, member)
+	return 1
+end
+return 0
+`)
+
+var popDueTimers = redis.NewScript(1, `
+local key, now, limit = KEYS[1], ARGV[1], ARGV[2]
+
+local due = redis.call("zrangebyscore", key, "-inf", now, "WITHSCORES", "LIMIT", 0, limit)
+for i = 1, #due, 2 do
+	redis.call("zrem", key, due[i])
+end
+return due
+`)
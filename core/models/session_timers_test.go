@@ -0,0 +1,76 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimers(t *testing.T) {
+	testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	now := time.Date(2021, 6, 15, 12, 30, 0, 123456000, time.UTC)
+
+	timer1 := &models.SessionTimer{OrgID: 1, ContactID: 10000, SessionID: 101, TimeoutOn: now.Add(time.Second * 30)}
+	timer2 := &models.SessionTimer{OrgID: 1, ContactID: 10001, SessionID: 102, TimeoutOn: now.Add(time.Second * 10)}
+	timer3 := &models.SessionTimer{OrgID: 1, ContactID: 10002, SessionID: 103, TimeoutOn: now.Add(time.Second * 20)}
+
+	added, err := models.ScheduleSessionTimer(rc, timer1, 2)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = models.ScheduleSessionTimer(rc, timer2, 2)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	// we're at our limit so new timers aren't added..
+	added, err = models.ScheduleSessionTimer(rc, timer3, 2)
+	require.NoError(t, err)
+	assert.False(t, added)
+
+	// but existing timers can still be updated
+	timer1.TimeoutOn = now.Add(time.Second * 5)
+	added, err = models.ScheduleSessionTimer(rc, timer1, 2)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	// nothing is due yet
+	timers, err := models.PopDueSessionTimers(rc, now, 10)
+	require.NoError(t, err)
+	assert.Len(t, timers, 0)
+
+	// pop with a limit to get the first timer
+	timers, err = models.PopDueSessionTimers(rc, now.Add(time.Minute), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.SessionTimer{timer1}, timers)
+
+	timers, err = models.PopDueSessionTimers(rc, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.SessionTimer{timer2}, timers)
+
+	timers, err = models.PopDueSessionTimers(rc, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Len(t, timers, 0)
+
+	// timers can always be added if there's no limit
+	added, err = models.ScheduleSessionTimer(rc, timer1, 0)
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = models.ScheduleSessionTimer(rc, timer2, 0)
+	require.NoError(t, err)
+	assert.True(t, added)
+	added, err = models.ScheduleSessionTimer(rc, timer3, 0)
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	timers, err = models.PopDueSessionTimers(rc, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.SessionTimer{timer1, timer2, timer3}, timers)
+}
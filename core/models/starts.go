@@ -41,6 +41,7 @@ const (
 	StartStatusStarting = StartStatus("S")
 	StartStatusComplete = StartStatus("C")
 	StartStatusFailed   = StartStatus("F")
+	StartStatusTimedOut = StartStatus("T")
 )
 
 // RestartParticipants is our type for the bool of restarting participatants
@@ -100,6 +101,16 @@ func MarkStartFailed(ctx context.Context, db Queryer, startID StartID) error {
 	return nil
 }
 
+// MarkStartTimedOut sets the status for the passed in flow start to T, used when it ran out of time before all its
+// contacts were started. Contacts in batches which were already queued are still started.
+func MarkStartTimedOut(ctx context.Context, db Queryer, startID StartID) error {
+	_, err := db.ExecContext(ctx, "UPDATE flows_flowstart SET status = 'T', modified_on = NOW() WHERE id = $1", startID)
+	if err != nil {
+		return errors.Wrapf(err, "error setting start as timed out")
+	}
+	return nil
+}
+
 // FlowStartBatch represents a single flow batch that needs to be started
 type FlowStartBatch struct {
 	b struct {
@@ -168,6 +179,8 @@ type FlowStart struct {
 		ParentSummary  null.JSON `json:"parent_summary,omitempty"  db:"parent_summary"`
 		SessionHistory null.JSON `json:"session_history,omitempty" db:"session_history"`
 
+		IdempotencyKey string `json:"idempotency_key,omitempty"`
+
 		CreatedBy string `json:"created_by"` // TODO deprecated
 	}
 }
@@ -234,6 +247,14 @@ func (s *FlowStart) WithExtra(extra json.RawMessage) *FlowStart {
 	return s
 }
 
+// IdempotencyKey is the key given by RapidPro or an API client when this start was requested, so that retries of that
+// request don't start the flow again
+func (s *FlowStart) IdempotencyKey() string { return s.s.IdempotencyKey }
+func (s *FlowStart) WithIdempotencyKey(key string) *FlowStart {
+	s.s.IdempotencyKey = key
+	return s
+}
+
 func (s *FlowStart) MarshalJSON() ([]byte, error)    { return json.Marshal(s.s) }
 func (s *FlowStart) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &s.s) }
 
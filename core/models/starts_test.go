@@ -94,6 +94,11 @@ func TestStarts(t *testing.T) {
 	require.NoError(t, err)
 
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'C'`, []interface{}{startID}, 1)
+
+	err = models.MarkStartTimedOut(ctx, db, startID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'T'`, []interface{}{startID}, 1)
 }
 
 func TestStartsBuilding(t *testing.T) {
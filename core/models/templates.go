@@ -78,7 +78,7 @@ func loadTemplates(ctx context.Context, db sqlx.Queryer, orgID OrgID) ([]assets.
 		template := &Template{}
 		err = dbutil.ReadJSONRow(rows, &template.t)
 		if err != nil {
-			return nil, errors.Wrap(err, "error reading group row")
+			return nil, errors.Wrap(err, "error reading template row")
 		}
 
 		templates = append(templates, template)
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/null"
 )
 
 type TicketEventID int
@@ -26,6 +27,8 @@ type TicketEvent struct {
 		ContactID   ContactID       `json:"contact_id"              db:"contact_id"`
 		TicketID    TicketID        `json:"ticket_id"               db:"ticket_id"`
 		EventType   TicketEventType `json:"event_type"              db:"event_type"`
+		AssigneeID  UserID          `json:"assignee_id,omitempty"   db:"assignee_id"`
+		Note        null.String     `json:"note,omitempty"          db:"note"`
 		CreatedByID UserID          `json:"created_by_id,omitempty" db:"created_by_id"`
 		CreatedOn   time.Time       `json:"created_on"              db:"created_on"`
 	}
@@ -44,11 +47,28 @@ func NewTicketEvent(orgID OrgID, userID UserID, contactID ContactID, ticketID Ti
 	return event
 }
 
+// NewTicketAssignedEvent creates a new event for a ticket being assigned to the given assignee, or unassigned
+func NewTicketAssignedEvent(ticket *Ticket, userID UserID, assigneeID UserID, note string) *TicketEvent {
+	event := NewTicketEvent(ticket.OrgID(), userID, ticket.ContactID(), ticket.ID(), TicketEventTypeAssigned)
+	event.e.AssigneeID = assigneeID
+	event.e.Note = null.String(note)
+	return event
+}
+
+// NewTicketNoteEvent creates a new event for a note being added to a ticket
+func NewTicketNoteEvent(ticket *Ticket, userID UserID, note string) *TicketEvent {
+	event := NewTicketEvent(ticket.OrgID(), userID, ticket.ContactID(), ticket.ID(), TicketEventTypeNote)
+	event.e.Note = null.String(note)
+	return event
+}
+
 func (e *TicketEvent) ID() TicketEventID          { return e.e.ID }
 func (e *TicketEvent) OrgID() OrgID               { return e.e.OrgID }
 func (e *TicketEvent) ContactID() ContactID       { return e.e.ContactID }
 func (e *TicketEvent) TicketID() TicketID         { return e.e.TicketID }
 func (e *TicketEvent) EventType() TicketEventType { return e.e.EventType }
+func (e *TicketEvent) AssigneeID() UserID         { return e.e.AssigneeID }
+func (e *TicketEvent) Note() null.String          { return e.e.Note }
 
 // MarshalJSON is our custom marshaller so that our inner struct get output
 func (e *TicketEvent) MarshalJSON() ([]byte, error) {
@@ -62,8 +82,8 @@ func (e *TicketEvent) UnmarshalJSON(b []byte) error {
 
 const insertTicketEventsSQL = `
 INSERT INTO
-	tickets_ticketevent(org_id, contact_id, ticket_id, event_type, created_on, created_by_id)
-	VALUES(:org_id, :contact_id, :ticket_id, :event_type, :created_on, :created_by_id)
+	tickets_ticketevent(org_id, contact_id, ticket_id, event_type, assignee_id, note, created_on, created_by_id)
+	VALUES(:org_id, :contact_id, :ticket_id, :event_type, :assignee_id, :note, :created_on, :created_by_id)
 RETURNING
 	id
 `
@@ -0,0 +1,247 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/null"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the elastic index that ticket documents are kept in
+const ticketsIndex = "tickets"
+
+// TicketSortFields are the fields that ticket searches can be sorted by, prefixed with - for descending order
+var TicketSortFields = []string{"last_activity_on", "opened_on", "modified_on"}
+
+// DefaultTicketSort is the sort used for ticket searches which don't specify one, most recently active first
+const DefaultTicketSort = "-last_activity_on"
+
+// TicketDocument is how a ticket is represented in the search index
+type TicketDocument struct {
+	ID             TicketID     `json:"id"               db:"id"`
+	OrgID          OrgID        `json:"org_id"           db:"org_id"`
+	ContactID      ContactID    `json:"contact_id"       db:"contact_id"`
+	ContactName    null.String  `json:"contact_name"     db:"contact_name"`
+	TicketerID     TicketerID   `json:"ticketer_id"      db:"ticketer_id"`
+	Status         TicketStatus `json:"status"           db:"status"`
+	Subject        string       `json:"subject"          db:"subject"`
+	Body           string       `json:"body"             db:"body"`
+	AssigneeID     UserID       `json:"assignee_id"      db:"assignee_id"`
+	OpenedOn       time.Time    `json:"opened_on"        db:"opened_on"`
+	ModifiedOn     time.Time    `json:"modified_on"      db:"modified_on"`
+	LastActivityOn time.Time    `json:"last_activity_on" db:"last_activity_on"`
+}
+
+const selectTicketDocumentsSQL = `
+SELECT
+  t.id AS id,
+  t.org_id AS org_id,
+  t.contact_id AS contact_id,
+  c.name AS contact_name,
+  t.ticketer_id AS ticketer_id,
+  t.status AS status,
+  t.subject AS subject,
+  t.body AS body,
+  t.assignee_id AS assignee_id,
+  t.opened_on AS opened_on,
+  t.modified_on AS modified_on,
+  t.last_activity_on AS last_activity_on
+FROM
+  tickets_ticket t
+  INNER JOIN contacts_contact c ON c.id = t.contact_id
+WHERE
+  t.org_id = $1 AND
+  t.id = ANY($2)
+`
+
+// IndexTickets brings the search index documents of the passed in tickets up to date with the database, removing the
+// documents of any tickets which no longer exist
+func IndexTickets(ctx context.Context, db Queryer, client *elastic.Client, orgID OrgID, ids []TicketID) error {
+	if client == nil || len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryxContext(ctx, selectTicketDocumentsSQL, orgID, pq.Array(ids))
+	if err != nil {
+		return errors.Wrapf(err, "error selecting tickets to index")
+	}
+	defer rows.Close()
+
+	routing := strconv.FormatInt(int64(orgID), 10)
+	bulk := client.Bulk()
+	found := make(map[TicketID]bool, len(ids))
+
+	for rows.Next() {
+		doc := &TicketDocument{}
+		if err := rows.StructScan(doc); err != nil {
+			return errors.Wrapf(err, "error scanning ticket document")
+		}
+		found[doc.ID] = true
+
+		bulk.Add(elastic.NewBulkIndexRequest().Index(ticketsIndex).Id(strconv.FormatInt(int64(doc.ID), 10)).Routing(routing).Doc(doc))
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			bulk.Add(elastic.NewBulkDeleteRequest().Index(ticketsIndex).Id(strconv.FormatInt(int64(id), 10)).Routing(routing))
+		}
+	}
+
+	response, err := bulk.Do(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "error indexing tickets")
+	}
+	if failed := response.Failed(); len(failed) > 0 {
+		return errors.Errorf("error indexing %d tickets: %s", len(failed), failed[0].Error.Reason)
+	}
+
+	return nil
+}
+
+// TicketSearch is a search of an org's tickets
+type TicketSearch struct {
+	Query      string
+	Status     TicketStatus
+	AssigneeID UserID
+	Sort       string
+	Cursor     string
+	PageSize   int
+}
+
+// TicketSearchPage is a single page of ticket search results. NextCursor can be passed back to fetch the next page
+// and is empty when there are no more results.
+type TicketSearchPage struct {
+	IDs        []TicketID
+	Total      int64
+	NextCursor string
+}
+
+// SearchTickets searches the tickets of an org. Rather than using offsets, pages are fetched using a cursor which encodes
+// the sort values of the last ticket on the previous page so deep pages are as cheap as the first.
+func SearchTickets(ctx context.Context, client *elastic.Client, orgID OrgID, search *TicketSearch) (*TicketSearchPage, error) {
+	start := time.Now()
+
+	if client == nil {
+		return nil, errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	sort := search.Sort
+	if sort == "" {
+		sort = DefaultTicketSort
+	}
+	sortField := strings.TrimPrefix(sort, "-")
+	ascending := !strings.HasPrefix(sort, "-")
+
+	validSort := false
+	for _, f := range TicketSortFields {
+		if f == sortField {
+			validSort = true
+		}
+	}
+	if !validSort {
+		return nil, errors.Errorf("invalid sort field: %s", sortField)
+	}
+
+	eq := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("org_id", orgID))
+	if search.Query != "" {
+		eq = eq.Must(elastic.NewMultiMatchQuery(search.Query, "subject^2", "body", "contact_name"))
+	}
+	if search.Status != "" {
+		eq = eq.Filter(elastic.NewTermQuery("status", search.Status))
+	}
+	if search.AssigneeID != NilUserID {
+		eq = eq.Filter(elastic.NewTermQuery("assignee_id", search.AssigneeID))
+	}
+
+	// ids break any ties so that the cursor always identifies a unique position
+	s := client.Search(ticketsIndex).
+		Routing(strconv.FormatInt(int64(orgID), 10)).
+		Query(eq).
+		SortBy(elastic.NewFieldSort(sortField).Order(ascending), elastic.NewFieldSort("id").Order(ascending)).
+		Size(search.PageSize).
+		FetchSource(false).
+		TrackTotalHits(true)
+
+	if search.Cursor != "" {
+		after, err := decodeSearchCursor(search.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		s = s.SearchAfter(after...)
+	}
+
+	results, err := s.Do(ctx)
+	if err != nil {
+		ee, ok := err.(*elastic.Error)
+		if !ok {
+			return nil, errors.Wrapf(err, "error performing ticket search")
+		}
+		return nil, errors.Wrapf(err, "error performing ticket search: %s", ee.Details.Reason)
+	}
+
+	page := &TicketSearchPage{IDs: make([]TicketID, 0, len(results.Hits.Hits)), Total: results.TotalHits()}
+	for _, hit := range results.Hits.Hits {
+		id, err := strconv.Atoi(hit.Id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected non-integer ticket id: %s", hit.Id)
+		}
+		page.IDs = append(page.IDs, TicketID(id))
+	}
+
+	// a full page means there may be more results after the last ticket
+	if n := len(results.Hits.Hits); n > 0 && n == search.PageSize {
+		page.NextCursor, err = encodeSearchCursor(results.Hits.Hits[n-1].Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":  orgID,
+		"query":   search.Query,
+		"sort":    sort,
+		"elapsed": time.Since(start),
+		"count":   len(page.IDs),
+		"total":   page.Total,
+	}).Debug("ticket search complete")
+
+	return page, nil
+}
+
+// ErrInvalidCursor is returned when a search cursor can't be decoded
+var ErrInvalidCursor = errors.New("invalid search cursor")
+
+func encodeSearchCursor(values []interface{}) (string, error) {
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", errors.Wrapf(err, "error encoding search cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeSearchCursor(cursor string) ([]interface{}, error) {
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// keep numbers as is so that large sort values like timestamps and ids don't lose precision
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	values := make([]interface{}, 0, 2)
+	if err := decoder.Decode(&values); err != nil || len(values) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return values, nil
+}
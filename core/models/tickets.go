@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/nyaruka/gocommon/dates"
@@ -60,7 +61,7 @@ const (
 func init() {
 	goflow.RegisterTicketServiceFactory(
 		func(session flows.Session, ticketer *flows.Ticketer) (flows.TicketService, error) {
-			return ticketer.Asset().(*Ticketer).AsService(config.Mailroom, ticketer)
+			return ticketer.Asset().(*Ticketer).AsService(config.Mailroom, orgFromSession(session), ticketer)
 		},
 	)
 }
@@ -147,7 +148,7 @@ func (t *Ticket) ForwardIncoming(ctx context.Context, db Queryer, org *OrgAssets
 		return errors.Errorf("can't find ticketer with id %d", t.t.TicketerID)
 	}
 
-	service, err := ticketer.AsService(config.Mailroom, flows.NewTicketer(ticketer))
+	service, err := ticketer.AsService(config.Mailroom, org.Org(), flows.NewTicketer(ticketer))
 	if err != nil {
 		return err
 	}
@@ -382,6 +383,7 @@ func CloseTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID,
 	ids := make([]TicketID, 0, len(tickets))
 	events := make([]*TicketEvent, 0, len(tickets))
 	eventsByTicket := make(map[*Ticket]*TicketEvent, len(tickets))
+	contactIDs := make([]ContactID, 0, len(tickets))
 	now := dates.Now()
 
 	for _, ticket := range tickets {
@@ -397,6 +399,7 @@ func CloseTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID,
 			e := NewTicketEvent(ticket.OrgID(), userID, ticket.ContactID(), ticket.ID(), TicketEventTypeClosed)
 			events = append(events, e)
 			eventsByTicket[ticket] = e
+			contactIDs = append(contactIDs, ticket.ContactID())
 		}
 	}
 
@@ -404,7 +407,7 @@ func CloseTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID,
 		for ticketerID, ticketerTickets := range byTicketer {
 			ticketer := oa.TicketerByID(ticketerID)
 			if ticketer != nil {
-				service, err := ticketer.AsService(config.Mailroom, flows.NewTicketer(ticketer))
+				service, err := ticketer.AsService(config.Mailroom, oa.Org(), flows.NewTicketer(ticketer))
 				if err != nil {
 					return nil, err
 				}
@@ -428,6 +431,11 @@ func CloseTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID,
 		return nil, errors.Wrapf(err, "error inserting ticket events")
 	}
 
+	err = UpdateContactTicketCounts(ctx, db, contactIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating contact ticket counts")
+	}
+
 	return eventsByTicket, nil
 }
 
@@ -449,6 +457,7 @@ func ReopenTickets(ctx context.Context, db Queryer, org *OrgAssets, userID UserI
 	ids := make([]TicketID, 0, len(tickets))
 	events := make([]*TicketEvent, 0, len(tickets))
 	eventsByTicket := make(map[*Ticket]*TicketEvent, len(tickets))
+	contactIDs := make([]ContactID, 0, len(tickets))
 	now := dates.Now()
 
 	for _, ticket := range tickets {
@@ -464,6 +473,7 @@ func ReopenTickets(ctx context.Context, db Queryer, org *OrgAssets, userID UserI
 			e := NewTicketEvent(ticket.OrgID(), userID, ticket.ContactID(), ticket.ID(), TicketEventTypeReopened)
 			events = append(events, e)
 			eventsByTicket[ticket] = e
+			contactIDs = append(contactIDs, ticket.ContactID())
 		}
 	}
 
@@ -471,7 +481,7 @@ func ReopenTickets(ctx context.Context, db Queryer, org *OrgAssets, userID UserI
 		for ticketerID, ticketerTickets := range byTicketer {
 			ticketer := org.TicketerByID(ticketerID)
 			if ticketer != nil {
-				service, err := ticketer.AsService(config.Mailroom, flows.NewTicketer(ticketer))
+				service, err := ticketer.AsService(config.Mailroom, org.Org(), flows.NewTicketer(ticketer))
 				if err != nil {
 					return nil, err
 				}
@@ -495,9 +505,146 @@ func ReopenTickets(ctx context.Context, db Queryer, org *OrgAssets, userID UserI
 		return nil, errors.Wrapf(err, "error inserting ticket events")
 	}
 
+	err = UpdateContactTicketCounts(ctx, db, contactIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating contact ticket counts")
+	}
+
+	return eventsByTicket, nil
+}
+
+const assignTicketSQL = `
+UPDATE
+  tickets_ticket
+SET
+  assignee_id = $2,
+  modified_on = $3,
+  last_activity_on = $3
+WHERE
+  id = ANY($1)
+`
+
+// AssignTickets assigns the passed in tickets to the given user, or unassigns them if assignee is nil, optionally with
+// a note which is also added to the tickets on their ticketers if supported
+func AssignTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID, tickets []*Ticket, assigneeID UserID, note string, logger *HTTPLogger) (map[*Ticket]*TicketEvent, error) {
+	ids := make([]TicketID, 0, len(tickets))
+	events := make([]*TicketEvent, 0, len(tickets))
+	eventsByTicket := make(map[*Ticket]*TicketEvent, len(tickets))
+	now := dates.Now()
+
+	for _, ticket := range tickets {
+		if ticket.AssigneeID() != assigneeID {
+			ids = append(ids, ticket.ID())
+			t := &ticket.t
+			t.AssigneeID = assigneeID
+			t.ModifiedOn = now
+			t.LastActivityOn = now
+
+			e := NewTicketAssignedEvent(ticket, userID, assigneeID, note)
+			events = append(events, e)
+			eventsByTicket[ticket] = e
+		}
+	}
+
+	if note != "" {
+		if err := addTicketNotesExternally(oa, changedTickets(eventsByTicket), note, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// mark the tickets as assigned in the db
+	err := Exec(ctx, "assign tickets", db, assignTicketSQL, pq.Array(ids), assigneeID, now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating tickets")
+	}
+
+	err = InsertTicketEvents(ctx, db, events)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error inserting ticket events")
+	}
+
+	return eventsByTicket, nil
+}
+
+const noteTicketSQL = `
+UPDATE
+  tickets_ticket
+SET
+  modified_on = $2,
+  last_activity_on = $2
+WHERE
+  id = ANY($1)
+`
+
+// NoteTickets adds the passed in note to the passed in tickets, and on their ticketers if supported
+func NoteTickets(ctx context.Context, db Queryer, oa *OrgAssets, userID UserID, tickets []*Ticket, note string, logger *HTTPLogger) (map[*Ticket]*TicketEvent, error) {
+	ids := make([]TicketID, 0, len(tickets))
+	events := make([]*TicketEvent, 0, len(tickets))
+	eventsByTicket := make(map[*Ticket]*TicketEvent, len(tickets))
+	now := dates.Now()
+
+	for _, ticket := range tickets {
+		ids = append(ids, ticket.ID())
+		t := &ticket.t
+		t.ModifiedOn = now
+		t.LastActivityOn = now
+
+		e := NewTicketNoteEvent(ticket, userID, note)
+		events = append(events, e)
+		eventsByTicket[ticket] = e
+	}
+
+	if err := addTicketNotesExternally(oa, tickets, note, logger); err != nil {
+		return nil, err
+	}
+
+	err := Exec(ctx, "note tickets", db, noteTicketSQL, pq.Array(ids), now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating tickets")
+	}
+
+	err = InsertTicketEvents(ctx, db, events)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error inserting ticket events")
+	}
+
 	return eventsByTicket, nil
 }
 
+// adds the passed in note to the passed in tickets on those of their ticketers which support notes
+func addTicketNotesExternally(oa *OrgAssets, tickets []*Ticket, note string, logger *HTTPLogger) error {
+	byTicketer := make(map[TicketerID][]*Ticket)
+	for _, ticket := range tickets {
+		byTicketer[ticket.TicketerID()] = append(byTicketer[ticket.TicketerID()], ticket)
+	}
+
+	for ticketerID, ticketerTickets := range byTicketer {
+		ticketer := oa.TicketerByID(ticketerID)
+		if ticketer != nil {
+			service, err := ticketer.AsService(config.Mailroom, oa.Org(), flows.NewTicketer(ticketer))
+			if err != nil {
+				return err
+			}
+
+			if noteService, ok := service.(TicketNoteService); ok {
+				err = noteService.AddNote(ticketerTickets, note, logger.Ticketer(ticketer))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func changedTickets(changed map[*Ticket]*TicketEvent) []*Ticket {
+	tickets := make([]*Ticket, 0, len(changed))
+	for t := range changed {
+		tickets = append(tickets, t)
+	}
+	return tickets
+}
+
 // Ticketer is our type for a ticketer asset
 type Ticketer struct {
 	t struct {
@@ -533,9 +680,10 @@ func (t *Ticketer) Reference() *assets.TicketerReference {
 	return assets.NewTicketerReference(t.t.UUID, t.t.Name)
 }
 
-// AsService builds the corresponding engine service for the passed in Ticketer
-func (t *Ticketer) AsService(cfg *config.Config, ticketer *flows.Ticketer) (TicketService, error) {
+// AsService builds the corresponding engine service for the passed in Ticketer, to be used by the passed in org
+func (t *Ticketer) AsService(cfg *config.Config, org *Org, ticketer *flows.Ticketer) (TicketService, error) {
 	httpClient, httpRetries, _ := goflow.HTTP(cfg)
+	httpClient = goflow.RegionalHTTP(cfg, httpClient, org.Region())
 
 	initFunc := ticketServices[t.Type()]
 	if initFunc != nil {
@@ -572,6 +720,11 @@ type TicketService interface {
 	Reopen([]*Ticket, flows.HTTPLogCallback) error
 }
 
+// TicketNoteService is implemented by ticket services which can also add internal notes to tickets
+type TicketNoteService interface {
+	AddNote([]*Ticket, string, flows.HTTPLogCallback) error
+}
+
 // TicketServiceFunc is a func which creates a ticket service
 type TicketServiceFunc func(*config.Config, *http.Client, *httpx.RetryConfig, *flows.Ticketer, map[string]string) (TicketService, error)
 
@@ -582,6 +735,16 @@ func RegisterTicketService(name string, initFunc TicketServiceFunc) {
 	ticketServices[name] = initFunc
 }
 
+// TicketerTypes returns the sorted types of the registered ticket services
+func TicketerTypes() []string {
+	types := make([]string, 0, len(ticketServices))
+	for t := range ticketServices {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
 const selectTicketerByUUIDSQL = `
 SELECT ROW_TO_JSON(r) FROM (SELECT
 	t.id as id,
@@ -1,6 +1,7 @@
 package models_test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/null"
 
+	"github.com/olivere/elastic/v7"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -213,6 +215,9 @@ func TestCloseTickets(t *testing.T) {
 	// check ticket #1 is now closed
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND status = 'C' AND closed_on IS NOT NULL`, []interface{}{ticket1.ID}, 1)
 
+	// and cathy's open ticket count has been updated
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND ticket_count = 0`, []interface{}{testdata.Cathy.ID}, 1)
+
 	// and there's closed event for it
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE org_id = $1 AND ticket_id = $2 AND event_type = 'C'`,
 		[]interface{}{testdata.Org1.ID, ticket1.ID}, 1)
@@ -263,6 +268,8 @@ func TestReopenTickets(t *testing.T) {
 	ticket2 := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Zendesk, "Old Problem", "Where my pants", "234", nil)
 	modelTicket2 := ticket2.Load(db)
 
+	db.MustExec(`UPDATE contacts_contact SET modified_on = '2021-01-01T12:00:00Z' WHERE id = $1`, testdata.Cathy.ID)
+
 	logger := &models.HTTPLogger{}
 	evts, err := models.ReopenTickets(ctx, db, oa, testdata.Admin.ID, []*models.Ticket{modelTicket1, modelTicket2}, true, logger)
 	require.NoError(t, err)
@@ -272,6 +279,9 @@ func TestReopenTickets(t *testing.T) {
 	// check ticket #1 is now closed
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND status = 'O' AND closed_on IS NULL`, []interface{}{ticket1.ID}, 1)
 
+	// and cathy's open ticket count has been updated, without her being modified
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND ticket_count = 2 AND modified_on = '2021-01-01T12:00:00Z'`, []interface{}{testdata.Cathy.ID}, 1)
+
 	// and there's reopened event for it
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE org_id = $1 AND ticket_id = $2 AND event_type = 'R'`,
 		[]interface{}{testdata.Org1.ID, ticket1.ID}, 1)
@@ -284,3 +294,155 @@ func TestReopenTickets(t *testing.T) {
 	// but no events for ticket #2 which waas already open
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = $1 AND event_type = 'R'`, []interface{}{ticket2.ID}, 0)
 }
+
+func TestAssignAndNoteTickets(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshTicketers)
+	require.NoError(t, err)
+
+	ticket1 := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Problem", "Where my shoes", "123", nil)
+	modelTicket1 := ticket1.Load(db)
+
+	ticket2 := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Old Problem", "Where my pants", "234", testdata.Agent)
+	modelTicket2 := ticket2.Load(db)
+
+	logger := &models.HTTPLogger{}
+	evts, err := models.AssignTickets(ctx, db, oa, testdata.Admin.ID, []*models.Ticket{modelTicket1, modelTicket2}, testdata.Agent.ID, "please handle", logger)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(evts))
+	assert.Equal(t, models.TicketEventTypeAssigned, evts[modelTicket1].EventType())
+	assert.Equal(t, testdata.Agent.ID, evts[modelTicket1].AssigneeID())
+	assert.Equal(t, testdata.Agent.ID, modelTicket1.AssigneeID())
+
+	// check ticket #1 is now assigned, with an event recording that
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND assignee_id = $2`, []interface{}{ticket1.ID, testdata.Agent.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = $1 AND event_type = 'A' AND assignee_id = $2 AND note = 'please handle' AND created_by_id = $3`,
+		[]interface{}{ticket1.ID, testdata.Agent.ID, testdata.Admin.ID}, 1)
+
+	// but no event for ticket #2 which was already assigned to them
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = $1 AND event_type = 'A'`, []interface{}{ticket2.ID}, 0)
+
+	// tickets can be unassigned
+	evts, err = models.AssignTickets(ctx, db, oa, testdata.Admin.ID, []*models.Ticket{modelTicket2}, models.NilUserID, "", logger)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(evts))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticket WHERE id = $1 AND assignee_id IS NULL`, []interface{}{ticket2.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = $1 AND event_type = 'A' AND assignee_id IS NULL AND note IS NULL`, []interface{}{ticket2.ID}, 1)
+
+	// notes are added to every ticket
+	evts, err = models.NoteTickets(ctx, db, oa, testdata.Agent.ID, []*models.Ticket{modelTicket1, modelTicket2}, "spam", logger)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(evts))
+	assert.Equal(t, models.TicketEventTypeNote, evts[modelTicket2].EventType())
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM tickets_ticketevent WHERE event_type = 'N' AND note = 'spam' AND created_by_id = $1`, []interface{}{testdata.Agent.ID}, 2)
+
+	// mailgun doesn't support notes so there were no calls to it
+	require.NoError(t, logger.Insert(ctx, db))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM request_logs_httplog WHERE ticketer_id = $1`, []interface{}{testdata.Mailgun.ID}, 0)
+}
+
+func TestIndexTickets(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	ticket := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Problem", "Where my shoes", "123", testdata.Agent)
+
+	es.NextResponse = `{"took": 3, "errors": false, "items": [
+		{"index": {"_index": "tickets", "_id": "1", "status": 201, "result": "created"}},
+		{"delete": {"_index": "tickets", "_id": "123456", "status": 404, "result": "not_found"}}
+	]}`
+
+	err = models.IndexTickets(ctx, db, client, testdata.Org1.ID, []models.TicketID{ticket.ID, 123456})
+	assert.NoError(t, err)
+
+	// existing ticket is indexed with its contact's name, missing one is removed
+	assert.Contains(t, es.LastBody, `"contact_name":"Cathy"`)
+	assert.Contains(t, es.LastBody, `"subject":"Problem"`)
+	assert.Contains(t, es.LastBody, fmt.Sprintf(`"assignee_id":%d`, testdata.Agent.ID))
+	assert.Contains(t, es.LastBody, `{"delete":{"_index":"tickets","_id":"123456","routing":"1"}}`)
+
+	// tickets from other orgs are never indexed under this org
+	es.NextResponse = `{"took": 1, "errors": false, "items": [
+		{"delete": {"_index": "tickets", "_id": "1", "status": 404, "result": "not_found"}}
+	]}`
+
+	err = models.IndexTickets(ctx, db, client, testdata.Org2.ID, []models.TicketID{ticket.ID})
+	assert.NoError(t, err)
+	assert.NotContains(t, es.LastBody, `"index"`)
+
+	// no client is a noop
+	assert.NoError(t, models.IndexTickets(ctx, db, nil, testdata.Org1.ID, []models.TicketID{ticket.ID}))
+}
+
+func TestSearchTickets(t *testing.T) {
+	ctx := testsuite.CTX()
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	es.NextResponse = `{
+		"took": 2,
+		"hits": {"total": {"value": 3}, "max_score": null, "hits": [
+			{"_index": "tickets", "_id": "1003", "_score": null, "sort": [1624377570000, 1003]},
+			{"_index": "tickets", "_id": "1001", "_score": null, "sort": [1624377560000, 1001]}
+		]}
+	}`
+
+	page, err := models.SearchTickets(ctx, client, testdata.Org1.ID, &models.TicketSearch{Query: "shoes", Status: models.TicketStatusOpen, PageSize: 2})
+	require.NoError(t, err)
+
+	assert.Equal(t, []models.TicketID{1003, 1001}, page.IDs)
+	assert.Equal(t, int64(3), page.Total)
+	assert.NotEqual(t, "", page.NextCursor)
+
+	assert.Contains(t, es.LastBody, `"shoes"`)
+	assert.Contains(t, es.LastBody, `{"last_activity_on":{"order":"desc"}}`)
+
+	// fetching the next page searches after the last ticket of the previous page
+	es.NextResponse = `{
+		"took": 2,
+		"hits": {"total": {"value": 3}, "max_score": null, "hits": [
+			{"_index": "tickets", "_id": "1000", "_score": null, "sort": [1624377550000, 1000]}
+		]}
+	}`
+
+	page, err = models.SearchTickets(ctx, client, testdata.Org1.ID, &models.TicketSearch{Query: "shoes", Status: models.TicketStatusOpen, PageSize: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+
+	assert.Equal(t, []models.TicketID{1000}, page.IDs)
+	assert.Equal(t, "", page.NextCursor)
+	assert.Contains(t, es.LastBody, `"search_after":[1624377560000,1001]`)
+
+	// bad cursors and sorts are errors
+	_, err = models.SearchTickets(ctx, client, testdata.Org1.ID, &models.TicketSearch{Cursor: "!!!", PageSize: 2})
+	assert.Equal(t, models.ErrInvalidCursor, err)
+
+	_, err = models.SearchTickets(ctx, client, testdata.Org1.ID, &models.TicketSearch{Sort: "subject", PageSize: 2})
+	assert.EqualError(t, err, "invalid sort field: subject")
+}
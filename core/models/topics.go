@@ -0,0 +1,218 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/uuids"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Topics and teams let tickets be routed without an external ticketing service, e.g. with the internal ticketer. A
+// ticket can have a topic, e.g. "Billing", and be routed to a team of agents, as well as being assigned to a single
+// agent.
+
+// TopicID is our type for topic ids
+type TopicID int
+
+// NilTopicID is our nil value for topic ids
+const NilTopicID = TopicID(0)
+
+// TopicUUID is our type for topic UUIDs
+type TopicUUID uuids.UUID
+
+// TeamID is our type for team ids
+type TeamID int
+
+// NilTeamID is our nil value for team ids
+const NilTeamID = TeamID(0)
+
+// TeamUUID is our type for team UUIDs
+type TeamUUID uuids.UUID
+
+// Topic is a topic which tickets can be categorized by
+type Topic struct {
+	ID        TopicID   `db:"id"         json:"id"`
+	UUID      TopicUUID `db:"uuid"       json:"uuid"`
+	OrgID     OrgID     `db:"org_id"     json:"-"`
+	Name      string    `db:"name"       json:"name"`
+	CreatedOn time.Time `db:"created_on" json:"-"`
+}
+
+// Team is a team of agents which tickets can be routed to
+type Team struct {
+	ID        TeamID    `db:"id"         json:"id"`
+	UUID      TeamUUID  `db:"uuid"       json:"uuid"`
+	OrgID     OrgID     `db:"org_id"     json:"-"`
+	Name      string    `db:"name"       json:"name"`
+	UserIDs   []UserID  `db:"-"          json:"user_ids"`
+	CreatedOn time.Time `db:"created_on" json:"-"`
+}
+
+const selectTopicsSQL = `
+  SELECT id, uuid, org_id, name, created_on
+    FROM tickets_topic
+   WHERE org_id = $1 AND is_active = TRUE
+ORDER BY name, id
+`
+
+// LoadTopics loads the active topics of the given org
+func LoadTopics(ctx context.Context, db Queryer, orgID OrgID) ([]*Topic, error) {
+	topics := make([]*Topic, 0)
+	if err := db.SelectContext(ctx, &topics, selectTopicsSQL, orgID); err != nil {
+		return nil, errors.Wrapf(err, "error loading topics for org: %d", orgID)
+	}
+	return topics, nil
+}
+
+const insertTopicSQL = `
+INSERT INTO tickets_topic(uuid, org_id, name, is_active, created_on)
+     SELECT $1, $2, $3, TRUE, $4
+      WHERE NOT EXISTS (SELECT 1 FROM tickets_topic WHERE org_id = $2 AND LOWER(name) = LOWER($3) AND is_active = TRUE)
+  RETURNING id
+`
+
+// CreateTopic creates a new topic in the given org, erroring if it already has an active topic with the same name
+func CreateTopic(ctx context.Context, db Queryer, orgID OrgID, name string) (*Topic, error) {
+	topic := &Topic{UUID: TopicUUID(uuids.New()), OrgID: orgID, Name: strings.TrimSpace(name), CreatedOn: dates.Now()}
+
+	ids := make([]TopicID, 0, 1)
+	if err := db.SelectContext(ctx, &ids, insertTopicSQL, topic.UUID, orgID, topic.Name, topic.CreatedOn); err != nil {
+		return nil, errors.Wrapf(err, "error inserting topic")
+	}
+	if len(ids) == 0 {
+		return nil, errors.Errorf("topic with name '%s' already exists", topic.Name)
+	}
+
+	topic.ID = ids[0]
+	return topic, nil
+}
+
+const selectTeamsSQL = `
+  SELECT t.id, t.uuid, t.org_id, t.name, t.created_on, COALESCE(ARRAY_AGG(u.user_id ORDER BY u.user_id) FILTER (WHERE u.user_id IS NOT NULL), '{}') AS user_ids
+    FROM tickets_team t
+         LEFT OUTER JOIN tickets_team_users u ON u.team_id = t.id
+   WHERE t.org_id = $1 AND t.is_active = TRUE
+GROUP BY t.id
+ORDER BY t.name, t.id
+`
+
+// LoadTeams loads the active teams of the given org along with their members
+func LoadTeams(ctx context.Context, db Queryer, orgID OrgID) ([]*Team, error) {
+	rows, err := db.QueryxContext(ctx, selectTeamsSQL, orgID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading teams for org: %d", orgID)
+	}
+	defer rows.Close()
+
+	teams := make([]*Team, 0)
+	for rows.Next() {
+		team := &Team{}
+		userIDs := make([]int64, 0)
+		if err := rows.Scan(&team.ID, &team.UUID, &team.OrgID, &team.Name, &team.CreatedOn, pq.Array(&userIDs)); err != nil {
+			return nil, errors.Wrapf(err, "error scanning team")
+		}
+
+		team.UserIDs = make([]UserID, len(userIDs))
+		for i := range userIDs {
+			team.UserIDs[i] = UserID(userIDs[i])
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+const insertTeamSQL = `
+INSERT INTO tickets_team(uuid, org_id, name, is_active, created_on)
+     SELECT $1, $2, $3, TRUE, $4
+      WHERE NOT EXISTS (SELECT 1 FROM tickets_team WHERE org_id = $2 AND LOWER(name) = LOWER($3) AND is_active = TRUE)
+  RETURNING id
+`
+
+const insertTeamUsersSQL = `
+INSERT INTO tickets_team_users(team_id, user_id)
+     SELECT $1, u FROM UNNEST($2::int[]) u
+ON CONFLICT DO NOTHING
+`
+
+// CreateTeam creates a new team of the given users in the given org, erroring if it already has an active team with
+// the same name
+func CreateTeam(ctx context.Context, db Queryer, orgID OrgID, name string, userIDs []UserID) (*Team, error) {
+	team := &Team{UUID: TeamUUID(uuids.New()), OrgID: orgID, Name: strings.TrimSpace(name), UserIDs: userIDs, CreatedOn: dates.Now()}
+
+	ids := make([]TeamID, 0, 1)
+	if err := db.SelectContext(ctx, &ids, insertTeamSQL, team.UUID, orgID, team.Name, team.CreatedOn); err != nil {
+		return nil, errors.Wrapf(err, "error inserting team")
+	}
+	if len(ids) == 0 {
+		return nil, errors.Errorf("team with name '%s' already exists", team.Name)
+	}
+	team.ID = ids[0]
+
+	if len(userIDs) > 0 {
+		if _, err := db.ExecContext(ctx, insertTeamUsersSQL, team.ID, pq.Array(userIDs)); err != nil {
+			return nil, errors.Wrapf(err, "error inserting team users")
+		}
+	}
+	return team, nil
+}
+
+// TicketRouting is the topic and team of a ticket
+type TicketRouting struct {
+	TicketID TicketID `db:"ticket_id" json:"ticket_id"`
+	TopicID  TopicID  `db:"topic_id"  json:"topic_id"`
+	TeamID   TeamID   `db:"team_id"   json:"team_id"`
+}
+
+const upsertTicketRoutingSQL = `
+INSERT INTO tickets_ticketrouting(ticket_id, topic_id, team_id)
+     SELECT t, NULLIF($2::int, 0), NULLIF($3::int, 0) FROM UNNEST($1::int[]) t
+ON CONFLICT (ticket_id) DO UPDATE SET
+	topic_id = CASE WHEN $4::boolean THEN EXCLUDED.topic_id ELSE tickets_ticketrouting.topic_id END,
+	team_id = CASE WHEN $5::boolean THEN EXCLUDED.team_id ELSE tickets_ticketrouting.team_id END
+`
+
+// RouteTickets sets the topic and/or the team of the passed in tickets. A topic or team is only changed if the
+// corresponding flag is set, and can be cleared by passing its nil id.
+func RouteTickets(ctx context.Context, db Queryer, tickets []*Ticket, topicID TopicID, setTopic bool, teamID TeamID, setTeam bool) error {
+	if len(tickets) == 0 || (!setTopic && !setTeam) {
+		return nil
+	}
+
+	ids := make([]TicketID, len(tickets))
+	for i, t := range tickets {
+		ids[i] = t.ID()
+	}
+
+	if _, err := db.ExecContext(ctx, upsertTicketRoutingSQL, pq.Array(ids), topicID, teamID, setTopic, setTeam); err != nil {
+		return errors.Wrapf(err, "error routing tickets")
+	}
+
+	return UpdateTicketLastActivity(ctx, db, tickets)
+}
+
+const selectTicketRoutingSQL = `
+  SELECT ticket_id, COALESCE(topic_id, 0) AS topic_id, COALESCE(team_id, 0) AS team_id
+    FROM tickets_ticketrouting
+   WHERE ticket_id = ANY($1)
+ORDER BY ticket_id
+`
+
+// LoadTicketRouting loads the topics and teams of the given tickets, tickets which have never been routed having no
+// entry in the returned map
+func LoadTicketRouting(ctx context.Context, db Queryer, ticketIDs []TicketID) (map[TicketID]*TicketRouting, error) {
+	routings := make([]*TicketRouting, 0, len(ticketIDs))
+	if err := db.SelectContext(ctx, &routings, selectTicketRoutingSQL, pq.Array(ticketIDs)); err != nil {
+		return nil, errors.Wrapf(err, "error loading ticket routing")
+	}
+
+	byTicket := make(map[TicketID]*TicketRouting, len(routings))
+	for _, r := range routings {
+		byTicket[r.TicketID] = r
+	}
+	return byTicket, nil
+}
@@ -0,0 +1,86 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicsAndTeams(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	defer testsuite.Reset()
+
+	billing, err := models.CreateTopic(ctx, db, testdata.Org1.ID, " Billing ")
+	require.NoError(t, err)
+	assert.Equal(t, "Billing", billing.Name)
+	assert.NotEqual(t, models.NilTopicID, billing.ID)
+
+	_, err = models.CreateTopic(ctx, db, testdata.Org1.ID, "Accounts")
+	require.NoError(t, err)
+
+	// topic names are unique within an org, ignoring case
+	_, err = models.CreateTopic(ctx, db, testdata.Org1.ID, "billing")
+	assert.EqualError(t, err, "topic with name 'billing' already exists")
+
+	_, err = models.CreateTopic(ctx, db, testdata.Org2.ID, "Billing")
+	assert.NoError(t, err)
+
+	topics, err := models.LoadTopics(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(topics))
+	assert.Equal(t, "Accounts", topics[0].Name)
+	assert.Equal(t, "Billing", topics[1].Name)
+
+	support, err := models.CreateTeam(ctx, db, testdata.Org1.ID, "Support", []models.UserID{testdata.Agent.ID, testdata.Editor.ID})
+	require.NoError(t, err)
+
+	_, err = models.CreateTeam(ctx, db, testdata.Org1.ID, "Sales", nil)
+	require.NoError(t, err)
+
+	_, err = models.CreateTeam(ctx, db, testdata.Org1.ID, "SUPPORT", nil)
+	assert.EqualError(t, err, "team with name 'SUPPORT' already exists")
+
+	teams, err := models.LoadTeams(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(teams))
+	assert.Equal(t, "Sales", teams[0].Name)
+	assert.Equal(t, []models.UserID{}, teams[0].UserIDs)
+	assert.Equal(t, "Support", teams[1].Name)
+	assert.Equal(t, []models.UserID{testdata.Editor.ID, testdata.Agent.ID}, teams[1].UserIDs)
+
+	ticket1 := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, "Need help", "Where's my refund?", "", nil)
+	ticket2 := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Bob, testdata.Internal, "Need help", "Where's my order?", "", nil)
+	tickets := []*models.Ticket{ticket1.Load(db), ticket2.Load(db)}
+
+	// tickets which have never been routed have no routing
+	routings, err := models.LoadTicketRouting(ctx, db, []models.TicketID{ticket1.ID, ticket2.ID})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(routings))
+
+	err = models.RouteTickets(ctx, db, tickets, billing.ID, true, models.NilTeamID, false)
+	require.NoError(t, err)
+
+	routings, err = models.LoadTicketRouting(ctx, db, []models.TicketID{ticket1.ID, ticket2.ID})
+	require.NoError(t, err)
+	assert.Equal(t, &models.TicketRouting{TicketID: ticket1.ID, TopicID: billing.ID, TeamID: models.NilTeamID}, routings[ticket1.ID])
+	assert.Equal(t, &models.TicketRouting{TicketID: ticket2.ID, TopicID: billing.ID, TeamID: models.NilTeamID}, routings[ticket2.ID])
+
+	// setting just the team leaves the topic alone
+	err = models.RouteTickets(ctx, db, tickets[:1], models.NilTopicID, false, support.ID, true)
+	require.NoError(t, err)
+
+	// and topics can be cleared
+	err = models.RouteTickets(ctx, db, tickets[1:], models.NilTopicID, true, models.NilTeamID, false)
+	require.NoError(t, err)
+
+	routings, err = models.LoadTicketRouting(ctx, db, []models.TicketID{ticket1.ID, ticket2.ID})
+	require.NoError(t, err)
+	assert.Equal(t, &models.TicketRouting{TicketID: ticket1.ID, TopicID: billing.ID, TeamID: support.ID}, routings[ticket1.ID])
+	assert.Equal(t, &models.TicketRouting{TicketID: ticket2.ID, TopicID: models.NilTopicID, TeamID: models.NilTeamID}, routings[ticket2.ID])
+}
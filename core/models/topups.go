@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/utils/redisutil"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -18,13 +19,19 @@ type TopupID null.Int
 // NilTopupID is our nil value for topup id
 var NilTopupID = TopupID(0)
 
+// the keys of an org's credit cache, which are shared with RapidPro, are all prefixed with the org's hash tag if we're
+// using them so that our script can update them together
 const (
-	// also check lua script if modifying these
-	redisOrgCredistsUsedKey  = `org:%d:cache:credits_used`
-	redisActiveTopupKey      = `org:%d:cache:active_topup`
-	redisCreditsRemainingKey = `org:%d:cache:credits_remaining:%d`
+	redisOrgCredistsUsedKey  = `%s:cache:credits_used`
+	redisActiveTopupKey      = `%s:cache:active_topup`
+	redisCreditsRemainingKey = `%s:cache:credits_remaining:%d`
 )
 
+// returns the prefix of the keys of the credit cache of the passed in org
+func creditsKeyPrefix(orgID OrgID) string {
+	return redisutil.HashTag(fmt.Sprintf("org:%d", orgID))
+}
+
 // AllocateTopups allocates topups for the given number of messages if topups are used by the org.
 // If topups are allocated it will return the ID of the topup to assign to those messages.
 func AllocateTopups(ctx context.Context, db Queryer, rp *redis.Pool, org *Org, amount int) (TopupID, error) {
@@ -37,7 +44,8 @@ func AllocateTopups(ctx context.Context, db Queryer, rp *redis.Pool, org *Org, a
 	}
 
 	// no matter what we decrement our org credit
-	topups, err := redis.Ints(decrementCreditLua.Do(rc, org.ID(), amount))
+	prefix := creditsKeyPrefix(org.ID())
+	topups, err := redis.Ints(decrementCreditLua.Do(rc, fmt.Sprintf(redisOrgCredistsUsedKey, prefix), fmt.Sprintf(redisActiveTopupKey, prefix), amount, prefix))
 	if err != nil {
 		return NilTopupID, err
 	}
@@ -61,8 +69,8 @@ func AllocateTopups(ctx context.Context, db Queryer, rp *redis.Pool, org *Org, a
 	// got one? then cache it
 	expireSeconds := -int(time.Since(topup.Expiration) / time.Second)
 	if expireSeconds > 0 && topup.Remaining-amount > 0 {
-		rc.Send("SETEX", fmt.Sprintf(redisActiveTopupKey, org.ID()), expireSeconds, topup.ID)
-		_, err := rc.Do("SETEX", fmt.Sprintf(redisCreditsRemainingKey, org.ID(), topup.ID), expireSeconds, topup.Remaining-amount)
+		rc.Send("SETEX", fmt.Sprintf(redisActiveTopupKey, prefix), expireSeconds, topup.ID)
+		_, err := rc.Do("SETEX", fmt.Sprintf(redisCreditsRemainingKey, prefix, topup.ID), expireSeconds, topup.Remaining-amount)
 		if err != nil {
 			// an error here isn't the end of the world, log it and move on
 			logrus.WithError(err).Errorf("error setting active topup in redis for org: %d", org.ID())
@@ -72,22 +80,24 @@ func AllocateTopups(ctx context.Context, db Queryer, rp *redis.Pool, org *Org, a
 	return topup.ID, nil
 }
 
-var decrementCreditLua = redis.NewScript(2, `-- KEYS: [OrgID] [Amount]
+// the key of the credits remaining of the active topup can't be declared as it's read from the active topup key, but it
+// has the same prefix so is in the same slot of a redis cluster
+var decrementCreditLua = redis.NewScript(2, `-- KEYS: [CreditsUsedKey, ActiveTopupKey] ARGV: [Amount, KeyPrefix]
 -- first check whether we have an org level cache of credits used, and if so decrement it
-local ttl = redis.call('ttl', 'org:' .. KEYS[1] .. ':cache:credits_used')
+local ttl = redis.call('ttl', KEYS[1])
 if ttl > 0 then
-    redis.call('incrby', 'org:' .. KEYS[1] .. ':cache:credits_used', KEYS[2])
+    redis.call('incrby', KEYS[1], ARGV[1])
 end
 
 -- look up our active topup
-local orgKey = 'org:' .. KEYS[1] .. ':cache:active_topup'
+local orgKey = KEYS[2]
 local activeTopup = redis.call('get', orgKey)
 local remaining = -1
 
 -- found an active topup, try do decrement its credits
 if activeTopup then
-    local topupKey = 'org:' .. KEYS[1] .. ':cache:credits_remaining:' .. tonumber(activeTopup)
-	remaining = redis.call('decrby', topupKey, KEYS[2])
+    local topupKey = ARGV[2] .. ':cache:credits_remaining:' .. tonumber(activeTopup)
+	remaining = redis.call('decrby', topupKey, ARGV[1])
 	if remaining <= 0 then
 		redis.call('del', topupKey, orgKey)
 	end
@@ -1,12 +1,15 @@
 package models_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/redisutil"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -75,3 +78,44 @@ func TestTopups(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, models.NilTopupID, topup)
 }
+
+func TestTopupsWithHashTags(t *testing.T) {
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := testsuite.DB()
+	rp := testsuite.RP()
+	rc := rp.Get()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	redisutil.UseHashTags(true)
+	defer redisutil.UseHashTags(false)
+
+	tx, err := db.BeginTxx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	tx.MustExec(`INSERT INTO orgs_topupcredits(is_squashed, used, topup_id) VALUES(TRUE, 99000, 2),(TRUE, 990, 2)`)
+
+	org, err := models.LoadOrg(ctx, rt.Config, tx, testdata.Org2.ID)
+	require.NoError(t, err)
+
+	// first allocation calculates the active topup and caches it under keys with the org's hash tag
+	topup, err := models.AllocateTopups(ctx, tx, rp, org, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TopupID(2), topup)
+
+	prefix := fmt.Sprintf("{org:%d}", testdata.Org2.ID)
+	remaining, err := redis.Int(rc.Do("GET", prefix+":cache:credits_remaining:2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, remaining)
+
+	// and the next is allocated from those cached credits
+	topup, err = models.AllocateTopups(ctx, tx, rp, org, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TopupID(2), topup)
+
+	remaining, err = redis.Int(rc.Do("GET", prefix+":cache:credits_remaining:2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, remaining)
+}
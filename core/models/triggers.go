@@ -2,6 +2,9 @@ package models
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"sort"
 	"strings"
 	"time"
@@ -46,6 +49,16 @@ const (
 // NilTriggerID is the nil value for trigger IDs
 const NilTriggerID = TriggerID(0)
 
+// TriggerVariant is which side of a trigger split a contact was assigned to
+type TriggerVariant string
+
+// trigger variant constants
+const (
+	NoTriggerVariant    = TriggerVariant("")
+	TriggerVariantFlow  = TriggerVariant("A")
+	TriggerVariantSplit = TriggerVariant("B")
+)
+
 // Trigger represents a trigger in an organization
 type Trigger struct {
 	t struct {
@@ -81,6 +94,16 @@ func (t *Trigger) KeywordMatchType() triggers.KeywordMatchType {
 	return triggers.KeywordMatchTypeOnlyWord
 }
 
+// MarshalJSON is our custom marshaller so that our inner struct get output
+func (t *Trigger) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.t)
+}
+
+// UnmarshalJSON is our custom unmarshaller so that our inner struct is read, e.g. for proposed triggers
+func (t *Trigger) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &t.t)
+}
+
 // Match returns the match for this trigger, if any
 func (t *Trigger) Match() *triggers.KeywordMatch {
 	if t.Keyword() != "" {
@@ -92,6 +115,24 @@ func (t *Trigger) Match() *triggers.KeywordMatch {
 	return nil
 }
 
+// FlowIDForContact returns the flow this trigger should start for the passed in contact. If the org has configured a
+// split for this trigger, contacts are deterministically assigned to either the trigger's flow or the split flow by a hash
+// of their UUID, and the variant they were assigned to is returned as well.
+func (t *Trigger) FlowIDForContact(org *Org, contactUUID flows.ContactUUID) (FlowID, TriggerVariant) {
+	split := org.TriggerSplit(t.ID())
+	if split == nil {
+		return t.FlowID(), NoTriggerVariant
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(fmt.Sprintf("%d:%s", t.ID(), contactUUID)))
+
+	if int(hash.Sum32()%100) < split.Percent {
+		return split.FlowID, TriggerVariantSplit
+	}
+	return t.FlowID(), TriggerVariantFlow
+}
+
 // loadTriggers loads all non-schedule triggers for the passed in org
 func loadTriggers(ctx context.Context, db Queryer, orgID OrgID) ([]*Trigger, error) {
 	start := time.Now()
@@ -296,6 +337,156 @@ func triggerMatchQualifiers(t *Trigger, channel *Channel, contactGroups map[Grou
 	return true, score
 }
 
+// TriggerConflictType is how an existing trigger conflicts with a proposed trigger
+type TriggerConflictType string
+
+const (
+	// TriggerConflictAmbiguous is when both triggers would match with the same score so which one fires is arbitrary
+	TriggerConflictAmbiguous = TriggerConflictType("ambiguous")
+
+	// TriggerConflictShadows is when the proposed trigger would take precedence over the existing trigger
+	TriggerConflictShadows = TriggerConflictType("shadows")
+
+	// TriggerConflictShadowedBy is when the existing trigger would take precedence over the proposed trigger
+	TriggerConflictShadowedBy = TriggerConflictType("shadowed_by")
+)
+
+// TriggerConflict is an existing trigger which can match the same events as a proposed trigger
+type TriggerConflict struct {
+	Trigger *Trigger            `json:"trigger"`
+	Type    TriggerConflictType `json:"type"`
+}
+
+// FindTriggerConflicts returns the existing active triggers which can match the same events as the proposed trigger,
+// and how they conflict based on the scores they would each be given when matched
+func FindTriggerConflicts(oa *OrgAssets, proposed *Trigger) []*TriggerConflict {
+	conflicts := make([]*TriggerConflict, 0)
+
+	// channels are only considered when matching triggers for channel events
+	byChannel := proposed.TriggerType() == NewConversationTriggerType || proposed.TriggerType() == ReferralTriggerType
+
+	for _, t := range oa.Triggers() {
+		if t.ID() == proposed.ID() || t.TriggerType() != proposed.TriggerType() {
+			continue
+		}
+		if !triggersOverlap(proposed, t, byChannel) {
+			continue
+		}
+
+		conflictType := TriggerConflictAmbiguous
+		proposedScore, existingScore := triggerQualifierScore(proposed, byChannel), triggerQualifierScore(t, byChannel)
+		if proposedScore > existingScore {
+			conflictType = TriggerConflictShadows
+		} else if proposedScore < existingScore {
+			conflictType = TriggerConflictShadowedBy
+		}
+
+		conflicts = append(conflicts, &TriggerConflict{Trigger: t, Type: conflictType})
+	}
+
+	return conflicts
+}
+
+// whether the two triggers of the same type could both match the same event
+func triggersOverlap(t1, t2 *Trigger, byChannel bool) bool {
+	switch t1.TriggerType() {
+	case KeywordTriggerType:
+		// a message which is only the keyword matches both first word and only word triggers
+		if !strings.EqualFold(t1.Keyword(), t2.Keyword()) {
+			return false
+		}
+	case ReferralTriggerType:
+		// triggers without a referrer ID are only used if no trigger matches the referrer ID
+		if !strings.EqualFold(t1.ReferrerID(), t2.ReferrerID()) {
+			return false
+		}
+	}
+
+	if byChannel && t1.ChannelID() != NilChannelID && t2.ChannelID() != NilChannelID && t1.ChannelID() != t2.ChannelID() {
+		return false
+	}
+
+	// if every group one trigger includes is excluded by the other, no contact can match both
+	return !groupsExcluded(t1.IncludeGroupIDs(), t2.ExcludeGroupIDs()) && !groupsExcluded(t2.IncludeGroupIDs(), t1.ExcludeGroupIDs())
+}
+
+func groupsExcluded(include, exclude []GroupID) bool {
+	if len(include) == 0 {
+		return false
+	}
+
+	excluded := make(map[GroupID]bool, len(exclude))
+	for _, g := range exclude {
+		excluded[g] = true
+	}
+	for _, g := range include {
+		if !excluded[g] {
+			return false
+		}
+	}
+	return true
+}
+
+// the score a trigger is given by triggerMatchQualifiers when it matches
+func triggerQualifierScore(t *Trigger, byChannel bool) int {
+	score := 0
+	if byChannel && t.ChannelID() != NilChannelID {
+		score += triggerScoreByChannel
+	}
+	if len(t.IncludeGroupIDs()) > 0 {
+		score += triggerScoreByInclusion
+	}
+	if len(t.ExcludeGroupIDs()) > 0 {
+		score += triggerScoreByExclusion
+	}
+	return score
+}
+
+const updateTriggersArchivedSQL = `
+UPDATE
+	triggers_trigger
+SET
+	is_archived = $3,
+	modified_on = NOW()
+WHERE
+	org_id = $1 AND
+	id = ANY($2) AND
+	is_active = TRUE AND
+	is_archived != $3
+RETURNING
+	id
+`
+
+// ArchiveTriggers archives the passed in triggers, returning the ids of those which were archived
+func ArchiveTriggers(ctx context.Context, db Queryer, orgID OrgID, triggerIDs []TriggerID) ([]TriggerID, error) {
+	return updateTriggersArchived(ctx, db, orgID, triggerIDs, true)
+}
+
+// RestoreTriggers restores the passed in archived triggers, returning the ids of those which were restored
+func RestoreTriggers(ctx context.Context, db Queryer, orgID OrgID, triggerIDs []TriggerID) ([]TriggerID, error) {
+	return updateTriggersArchived(ctx, db, orgID, triggerIDs, false)
+}
+
+func updateTriggersArchived(ctx context.Context, db Queryer, orgID OrgID, triggerIDs []TriggerID, archived bool) ([]TriggerID, error) {
+	rows, err := db.QueryxContext(ctx, updateTriggersArchivedSQL, orgID, pq.Array(triggerIDs), archived)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error updating triggers")
+	}
+	defer rows.Close()
+
+	updated := make([]TriggerID, 0, len(triggerIDs))
+	for rows.Next() {
+		var id TriggerID
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrapf(err, "error scanning trigger id")
+		}
+		updated = append(updated, id)
+	}
+
+	sort.Slice(updated, func(i, j int) bool { return updated[i] < updated[j] })
+	return updated, nil
+}
+
 const selectTriggersSQL = `
 SELECT ROW_TO_JSON(r) FROM (SELECT
 	t.id as id, 
@@ -1,6 +1,8 @@
 package models_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/nyaruka/gocommon/uuids"
@@ -318,6 +320,65 @@ func TestArchiveContactTriggers(t *testing.T) {
 	assertTriggerArchived(georgeOnlyID, false)
 }
 
+func TestTriggerFlowIDForContact(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`DELETE FROM triggers_trigger`)
+
+	joinID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+
+	trigger := models.FindMatchingMsgTrigger(oa, cathy, "join")
+	require.NotNil(t, trigger)
+
+	// no split configured
+	flowID, variant := trigger.FlowIDForContact(oa.Org(), testdata.Cathy.UUID)
+	assert.Equal(t, testdata.Favorites.ID, flowID)
+	assert.Equal(t, models.NoTriggerVariant, variant)
+
+	setSplit := func(percent int) {
+		db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('trigger_splits', jsonb_build_object($1::text, jsonb_build_object('flow_id', $2::int, 'percent', $3::int))) WHERE id = $4`, joinID, testdata.PickANumber.ID, percent, testdata.Org1.ID)
+		models.FlushCache()
+
+		oa, err = models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+		require.NoError(t, err)
+	}
+
+	// everybody to the split flow
+	setSplit(100)
+
+	flowID, variant = trigger.FlowIDForContact(oa.Org(), testdata.Cathy.UUID)
+	assert.Equal(t, testdata.PickANumber.ID, flowID)
+	assert.Equal(t, models.TriggerVariantSplit, variant)
+
+	// half to each, assignment is deterministic for each contact
+	setSplit(50)
+
+	splits := 0
+	for i := 0; i < 1000; i++ {
+		contactUUID := flows.ContactUUID(uuids.New())
+		flowID1, variant1 := trigger.FlowIDForContact(oa.Org(), contactUUID)
+		flowID2, variant2 := trigger.FlowIDForContact(oa.Org(), contactUUID)
+
+		assert.Equal(t, flowID1, flowID2)
+		assert.Equal(t, variant1, variant2)
+
+		if variant1 == models.TriggerVariantSplit {
+			assert.Equal(t, testdata.PickANumber.ID, flowID1)
+			splits++
+		} else {
+			assert.Equal(t, testdata.Favorites.ID, flowID1)
+		}
+	}
+
+	assert.True(t, splits > 400 && splits < 600, "expected roughly half of contacts to be split, got %d", splits)
+}
+
 func assertTrigger(t *testing.T, expected models.TriggerID, actual *models.Trigger, msgAndArgs ...interface{}) {
 	if actual == nil {
 		assert.Equal(t, expected, models.NilTriggerID, msgAndArgs...)
@@ -325,3 +386,90 @@ func assertTrigger(t *testing.T, expected models.TriggerID, actual *models.Trigg
 		assert.Equal(t, expected, actual.ID(), msgAndArgs...)
 	}
 }
+
+func TestFindTriggerConflicts(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`DELETE FROM triggers_trigger`)
+
+	joinID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+	joinDoctorsID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchOnly, []*testdata.Group{testdata.DoctorsGroup}, nil)
+	joinNotTestersID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, []*testdata.Group{testdata.TestersGroup})
+	testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "leave", models.MatchFirst, nil, nil)
+	twilioConvoID := testdata.InsertNewConversationTrigger(db, testdata.Org1, testdata.Favorites, testdata.TwilioChannel)
+	testdata.InsertNewConversationTrigger(db, testdata.Org1, testdata.Favorites, testdata.VonageChannel)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshTriggers)
+	require.NoError(t, err)
+
+	proposed := func(j string) *models.Trigger {
+		trigger := &models.Trigger{}
+		require.NoError(t, json.Unmarshal([]byte(j), trigger))
+		return trigger
+	}
+
+	conflictsOf := func(trigger *models.Trigger) map[models.TriggerID]models.TriggerConflictType {
+		conflicts := make(map[models.TriggerID]models.TriggerConflictType)
+		for _, c := range models.FindTriggerConflicts(oa, trigger) {
+			conflicts[c.Trigger.ID()] = c.Type
+		}
+		return conflicts
+	}
+
+	// another join trigger without qualifiers is ambiguous with the existing one and shadowed by those with groups
+	assert.Equal(t, map[models.TriggerID]models.TriggerConflictType{
+		joinID:           models.TriggerConflictAmbiguous,
+		joinDoctorsID:    models.TriggerConflictShadowedBy,
+		joinNotTestersID: models.TriggerConflictShadowedBy,
+	}, conflictsOf(proposed(`{"trigger_type": "K", "keyword": "JOIN", "match_type": "O"}`)))
+
+	// a join trigger for testers can't overlap with the trigger which excludes testers
+	assert.Equal(t, map[models.TriggerID]models.TriggerConflictType{
+		joinID:        models.TriggerConflictShadows,
+		joinDoctorsID: models.TriggerConflictAmbiguous,
+	}, conflictsOf(proposed(fmt.Sprintf(`{"trigger_type": "K", "keyword": "join", "match_type": "F", "include_group_ids": [%d]}`, testdata.TestersGroup.ID))))
+
+	// an existing trigger doesn't conflict with itself
+	assert.Equal(t, map[models.TriggerID]models.TriggerConflictType{
+		joinDoctorsID:    models.TriggerConflictShadowedBy,
+		joinNotTestersID: models.TriggerConflictShadowedBy,
+	}, conflictsOf(proposed(fmt.Sprintf(`{"id": %d, "trigger_type": "K", "keyword": "join", "match_type": "F"}`, joinID))))
+
+	// new conversation triggers only conflict on the same channel, or if they're for any channel
+	assert.Equal(t, map[models.TriggerID]models.TriggerConflictType{
+		twilioConvoID: models.TriggerConflictAmbiguous,
+	}, conflictsOf(proposed(fmt.Sprintf(`{"trigger_type": "N", "channel_id": %d}`, testdata.TwilioChannel.ID))))
+	assert.Equal(t, 2, len(conflictsOf(proposed(`{"trigger_type": "N"}`))))
+
+	// no other triggers of this type
+	assert.Equal(t, map[models.TriggerID]models.TriggerConflictType{}, conflictsOf(proposed(`{"trigger_type": "M"}`)))
+}
+
+func TestArchiveAndRestoreTriggers(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`DELETE FROM triggers_trigger`)
+
+	trigger1ID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+	trigger2ID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "leave", models.MatchFirst, nil, nil)
+	org2TriggerID := testdata.InsertCatchallTrigger(db, testdata.Org2, testdata.Org2Favorites, nil, nil)
+
+	archived, err := models.ArchiveTriggers(ctx, db, testdata.Org1.ID, []models.TriggerID{trigger1ID, trigger2ID, org2TriggerID})
+	require.NoError(t, err)
+	assert.Equal(t, []models.TriggerID{trigger1ID, trigger2ID}, archived)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM triggers_trigger WHERE is_archived = TRUE`, nil, 2)
+
+	// archiving again is a noop
+	archived, err = models.ArchiveTriggers(ctx, db, testdata.Org1.ID, []models.TriggerID{trigger1ID})
+	require.NoError(t, err)
+	assert.Equal(t, []models.TriggerID{}, archived)
+
+	restored, err := models.RestoreTriggers(ctx, db, testdata.Org1.ID, []models.TriggerID{trigger2ID})
+	require.NoError(t, err)
+	assert.Equal(t, []models.TriggerID{trigger2ID}, restored)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM triggers_trigger WHERE is_archived = TRUE`, nil, 1)
+}
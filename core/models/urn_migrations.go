@@ -0,0 +1,377 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// URNCollisionPolicy is what we do when a rewritten URN collides with an existing URN in the same org
+type URNCollisionPolicy string
+
+// URNMigrationResult is the outcome of migrating a single URN
+type URNMigrationResult string
+
+// collision policies and migration results. When a rewritten URN collides with an existing URN of another contact, the
+// merge policy merges that contact into the contact being migrated: its fields fill in any the migrated contact doesn't
+// have, the migrated contact is added to its groups, all its URNs are moved over with the colliding URN replacing the
+// one being rewritten, and it is then released. Merges of contacts which are locked by other processes are skipped.
+const (
+	URNCollisionSkip  = URNCollisionPolicy("skip")
+	URNCollisionMerge = URNCollisionPolicy("merge")
+
+	URNMigrationUpdated = URNMigrationResult("updated")
+	URNMigrationMerged  = URNMigrationResult("merged")
+	URNMigrationSkipped = URNMigrationResult("skipped")
+	URNMigrationInvalid = URNMigrationResult("invalid")
+)
+
+// URNMigration is a record of a single URN rewrite
+type URNMigration struct {
+	URNID       URNID              `json:"urn_id"`
+	ContactID   ContactID          `json:"contact_id"`
+	OldIdentity urns.URN           `json:"old_identity"`
+	NewIdentity urns.URN           `json:"new_identity"`
+	Result      URNMigrationResult `json:"result"`
+
+	// if the contact which had the new identity was merged into this contact, that contact
+	MergedContactID ContactID `json:"merged_contact_id,omitempty"`
+}
+
+const urnMigrationBatchSize = 100
+
+const selectURNsForMigrationSQL = `
+SELECT
+	id,
+	contact_id,
+	path,
+	identity,
+	priority
+FROM
+	contacts_contacturn
+WHERE
+	org_id = $1 AND
+	scheme = $2 AND
+	id > $3
+ORDER BY
+	id ASC
+LIMIT
+	$4
+`
+
+type urnForMigration struct {
+	ID        URNID     `db:"id"`
+	ContactID ContactID `db:"contact_id"`
+	Path      string    `db:"path"`
+	Identity  urns.URN  `db:"identity"`
+	Priority  int       `db:"priority"`
+}
+
+// MigrateURNs rewrites the path of every URN in the org with the given scheme whose path matches the passed in pattern, using
+// the replacement to compute the new path. Where the new identity already exists, the policy decides whether we skip the URN or
+// merge the contact which has it into the URN's contact. URNs are migrated in batches, each committed in its own transaction,
+// and the passed in function is called with the migrations of each batch once it's committed.
+func MigrateURNs(ctx context.Context, db *sqlx.DB, rp *redis.Pool, orgID OrgID, scheme string, pattern *regexp.Regexp, replacement string, policy URNCollisionPolicy, fn func([]*URNMigration)) error {
+	if policy != URNCollisionSkip && policy != URNCollisionMerge {
+		return errors.Errorf("unknown URN collision policy: %s", policy)
+	}
+
+	start := time.Now()
+	count := 0
+	lastID := NilURNID
+
+	// contacts merged into other contacts, as later URNs we selected for them now belong to those contacts
+	merged := make(map[ContactID]ContactID)
+
+	for {
+		batch := make([]*urnForMigration, 0, urnMigrationBatchSize)
+		rows, err := db.QueryxContext(ctx, selectURNsForMigrationSQL, orgID, scheme, lastID, urnMigrationBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "error selecting URNs to migrate")
+		}
+		for rows.Next() {
+			u := &urnForMigration{}
+			if err := rows.StructScan(u); err != nil {
+				rows.Close()
+				return errors.Wrapf(err, "error scanning URN to migrate")
+			}
+			batch = append(batch, u)
+		}
+		rows.Close()
+
+		if len(batch) == 0 {
+			break
+		}
+		lastID = batch[len(batch)-1].ID
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error starting transaction")
+		}
+
+		// contacts being merged stay locked until the batch is committed
+		locks := &mergeLocks{rp: rp, orgID: orgID, held: make(map[ContactID]bool)}
+
+		batchMigrations, modifiedContactIDs, err := migrateURNBatch(ctx, tx, locks, orgID, scheme, batch, pattern, replacement, policy, merged)
+		if err != nil {
+			tx.Rollback()
+			locks.release()
+			return err
+		}
+
+		if len(modifiedContactIDs) > 0 {
+			if err := UpdateContactModifiedOn(ctx, tx, modifiedContactIDs); err != nil {
+				tx.Rollback()
+				locks.release()
+				return errors.Wrapf(err, "error updating modified on for contacts with migrated URNs")
+			}
+		}
+
+		err = tx.Commit()
+		locks.release()
+		if err != nil {
+			return errors.Wrapf(err, "error committing URN migrations")
+		}
+
+		for _, m := range batchMigrations {
+			log := logrus.WithFields(logrus.Fields{
+				"org_id":       orgID,
+				"urn_id":       m.URNID,
+				"contact_id":   m.ContactID,
+				"old_identity": m.OldIdentity,
+				"new_identity": m.NewIdentity,
+				"result":       m.Result,
+			})
+			if m.Result == URNMigrationMerged {
+				log.WithField("merged_contact_id", m.MergedContactID).Warn("migrated URN by merging the contact which had it")
+			} else {
+				log.Info("migrated URN")
+			}
+		}
+
+		fn(batchMigrations)
+		count += len(batchMigrations)
+	}
+
+	logrus.WithField("org_id", orgID).WithField("elapsed", time.Since(start)).WithField("count", count).Info("completed URN migration")
+
+	return nil
+}
+
+func migrateURNBatch(ctx context.Context, tx *sqlx.Tx, locks *mergeLocks, orgID OrgID, scheme string, batch []*urnForMigration, pattern *regexp.Regexp, replacement string, policy URNCollisionPolicy, merged map[ContactID]ContactID) ([]*URNMigration, []ContactID, error) {
+	migrations := make([]*URNMigration, 0, len(batch))
+	modifiedContactIDs := make([]ContactID, 0, len(batch))
+
+	for _, u := range batch {
+		if !pattern.MatchString(u.Path) {
+			continue
+		}
+
+		// this URN may have been moved by an earlier merge
+		for merged[u.ContactID] != NilContactID {
+			u.ContactID = merged[u.ContactID]
+		}
+
+		migration := &URNMigration{URNID: u.ID, ContactID: u.ContactID, OldIdentity: u.Identity}
+		migrations = append(migrations, migration)
+
+		newURN, err := urns.NewURNFromParts(scheme, pattern.ReplaceAllString(u.Path, replacement), "", "")
+		if err != nil || newURN.Validate() != nil {
+			migration.Result = URNMigrationInvalid
+			continue
+		}
+		migration.NewIdentity = newURN.Identity()
+
+		if migration.NewIdentity == u.Identity {
+			migration.Result = URNMigrationSkipped
+			continue
+		}
+
+		// look for an existing URN with our new identity
+		var existingID URNID
+		var existingContactID ContactID
+		err = tx.QueryRowxContext(ctx, `SELECT id, contact_id FROM contacts_contacturn WHERE org_id = $1 AND identity = $2`, orgID, migration.NewIdentity).Scan(&existingID, &existingContactID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, errors.Wrapf(err, "error looking up existing URN with identity: %s", migration.NewIdentity)
+		}
+
+		if err == sql.ErrNoRows {
+			_, err := tx.ExecContext(ctx, `UPDATE contacts_contacturn SET identity = $2, path = $3 WHERE id = $1`, u.ID, migration.NewIdentity, newURN.Path())
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "error updating URN: %d", u.ID)
+			}
+			migration.Result = URNMigrationUpdated
+		} else if policy == URNCollisionSkip || u.ContactID == NilContactID {
+			// URNs without a contact have nothing to merge into
+			migration.Result = URNMigrationSkipped
+			continue
+		} else {
+			if existingContactID != NilContactID && existingContactID != u.ContactID {
+				// don't merge contacts out from under sessions or imports which are modifying them
+				locked, err := locks.lock(u.ContactID, existingContactID)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !locked {
+					logrus.WithFields(logrus.Fields{
+						"org_id":            orgID,
+						"urn_id":            u.ID,
+						"contact_id":        u.ContactID,
+						"merged_contact_id": existingContactID,
+					}).Warn("skipping URN migration as contacts to merge are locked")
+
+					migration.Result = URNMigrationSkipped
+					continue
+				}
+
+				if err := mergeContacts(ctx, tx, orgID, u.ContactID, existingContactID); err != nil {
+					return nil, nil, err
+				}
+				merged[existingContactID] = u.ContactID
+				migration.MergedContactID = existingContactID
+			}
+
+			// the existing URN takes the place of the one being rewritten, which is detached
+			_, err := tx.ExecContext(ctx, `UPDATE contacts_contacturn SET contact_id = $2, priority = $3 WHERE id = $1`, existingID, u.ContactID, u.Priority)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "error moving URN: %d", existingID)
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE contacts_contacturn SET contact_id = NULL WHERE id = $1`, u.ID)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "error detaching URN: %d", u.ID)
+			}
+			migration.Result = URNMigrationMerged
+		}
+
+		if u.ContactID != NilContactID {
+			modifiedContactIDs = append(modifiedContactIDs, u.ContactID)
+		}
+	}
+
+	return migrations, modifiedContactIDs, nil
+}
+
+// the locks of the contacts merged in a batch of URN migrations
+type mergeLocks struct {
+	rp    *redis.Pool
+	orgID OrgID
+	held  map[ContactID]bool
+	locks []*ContactLocks
+}
+
+// locks the passed in contacts which we don't already hold, returning false if any of them are locked by others
+func (m *mergeLocks) lock(contactIDs ...ContactID) (bool, error) {
+	needed := make([]ContactID, 0, len(contactIDs))
+	for _, contactID := range contactIDs {
+		if !m.held[contactID] {
+			needed = append(needed, contactID)
+		}
+	}
+	if len(needed) == 0 {
+		return true, nil
+	}
+
+	locks, skipped, err := LockContacts(m.rp, m.orgID, needed, time.Second)
+	if err != nil {
+		return false, errors.Wrapf(err, "error locking contacts to merge")
+	}
+	if len(skipped) > 0 {
+		locks.Release()
+		return false, nil
+	}
+
+	for _, contactID := range needed {
+		m.held[contactID] = true
+	}
+	m.locks = append(m.locks, locks)
+	return true, nil
+}
+
+func (m *mergeLocks) release() {
+	for _, l := range m.locks {
+		l.Release()
+	}
+	m.locks = nil
+}
+
+const mergeContactFieldsSQL = `
+UPDATE
+	contacts_contact c
+SET
+	name = COALESCE(NULLIF(c.name, ''), m.name),
+	language = COALESCE(NULLIF(c.language, ''), m.language),
+	fields = COALESCE(m.fields, '{}'::jsonb) || COALESCE(c.fields, '{}'::jsonb),
+	modified_on = NOW()
+FROM
+	contacts_contact m
+WHERE
+	c.id = $1 AND
+	m.id = $2
+`
+
+const mergeContactGroupsSQL = `
+INSERT INTO
+	contacts_contactgroup_contacts(contact_id, contactgroup_id)
+SELECT
+	$1,
+	gc.contactgroup_id
+FROM
+	contacts_contactgroup_contacts gc
+	INNER JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id
+WHERE
+	gc.contact_id = $2 AND
+	g.org_id = $3 AND
+	g.group_type = 'U' AND
+	g.query IS NULL AND
+	NOT EXISTS (SELECT 1 FROM contacts_contactgroup_contacts e WHERE e.contact_id = $1 AND e.contactgroup_id = gc.contactgroup_id)
+`
+
+const releaseMergedContactSQL = `
+UPDATE
+	contacts_contact
+SET
+	is_active = FALSE,
+	modified_on = NOW()
+WHERE
+	id = $1
+`
+
+// merges the contact with the id from into the contact with the id into. The fields, name and language of into are kept
+// with any it doesn't have taken from from, into is added to the static groups of from, and all of from's URNs are moved
+// to into. Then from is interrupted, removed from all groups and campaign events, and released.
+func mergeContacts(ctx context.Context, tx *sqlx.Tx, orgID OrgID, into, from ContactID) error {
+	if _, err := tx.ExecContext(ctx, mergeContactFieldsSQL, into, from); err != nil {
+		return errors.Wrapf(err, "error merging fields of contact %d into contact %d", from, into)
+	}
+	if _, err := tx.ExecContext(ctx, mergeContactGroupsSQL, into, from, orgID); err != nil {
+		return errors.Wrapf(err, "error merging groups of contact %d into contact %d", from, into)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE contacts_contacturn SET contact_id = $1 WHERE contact_id = $2`, into, from); err != nil {
+		return errors.Wrapf(err, "error moving URNs of contact %d to contact %d", from, into)
+	}
+
+	for _, flowType := range []FlowType{FlowTypeMessaging, FlowTypeVoice} {
+		if err := InterruptContactRuns(ctx, tx, flowType, []flows.ContactID{flows.ContactID(from)}, time.Now()); err != nil {
+			return errors.Wrapf(err, "error interrupting merged contact %d", from)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM contacts_contactgroup_contacts WHERE contact_id = $1`, from); err != nil {
+		return errors.Wrapf(err, "error removing merged contact %d from groups", from)
+	}
+	if _, err := tx.ExecContext(ctx, deleteUnfiredEventsSQL, from); err != nil {
+		return errors.Wrapf(err, "error deleting unfired event fires of merged contact %d", from)
+	}
+	if _, err := tx.ExecContext(ctx, releaseMergedContactSQL, from); err != nil {
+		return errors.Wrapf(err, "error releasing merged contact %d", from)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package models_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateURNs(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+
+	defer testsuite.Reset()
+
+	// give Bob a URN which will collide with Cathy's migrated URN
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Bob, "tel:+16059991111", 50)
+
+	pattern := regexp.MustCompile(`^\+1605574([1-3]\d{3})$`)
+
+	var migrations []*models.URNMigration
+	batches := 0
+	collect := func(ms []*models.URNMigration) {
+		migrations = append(migrations, ms...)
+		batches++
+	}
+
+	err := models.MigrateURNs(ctx, db, rp, testdata.Org1.ID, "tel", pattern, "+1605999$1", "steal", collect)
+	assert.EqualError(t, err, "unknown URN collision policy: steal")
+
+	err = models.MigrateURNs(ctx, db, rp, testdata.Org1.ID, "tel", pattern, "+1605999$1", models.URNCollisionSkip, collect)
+	require.NoError(t, err)
+	assert.Equal(t, 1, batches)
+
+	results := make(map[models.URNID]models.URNMigrationResult)
+	for _, m := range migrations {
+		results[m.URNID] = m.Result
+	}
+	assert.Equal(t, models.URNMigrationSkipped, results[testdata.Cathy.URNID])
+	assert.Equal(t, models.URNMigrationUpdated, results[testdata.Bob.URNID])
+	assert.Equal(t, models.URNMigrationUpdated, results[testdata.George.URNID])
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16059992222' AND contact_id = $1`, []interface{}{testdata.Bob.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16055741111' AND contact_id = $1`, []interface{}{testdata.Cathy.ID}, 1)
+
+	// give Bob a field value and a group which Cathy doesn't have
+	db.MustExec(`UPDATE contacts_contact SET fields = fields || jsonb_build_object($2::text, jsonb_build_object('text', 'Male')) WHERE id = $1`, testdata.Bob.ID, testdata.GenderField.UUID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contact_id = $1`, testdata.Cathy.ID)
+	db.MustExec(`INSERT INTO contacts_contactgroup_contacts(contact_id, contactgroup_id) VALUES($1, $2)`, testdata.Bob.ID, testdata.TestersGroup.ID)
+
+	// while Bob is locked by another process, he can't be merged into Cathy
+	locks, _, err := models.LockContacts(rp, testdata.Org1.ID, []models.ContactID{testdata.Bob.ID}, time.Second)
+	require.NoError(t, err)
+
+	migrations = nil
+	err = models.MigrateURNs(ctx, db, rp, testdata.Org1.ID, "tel", pattern, "+1605999$1", models.URNCollisionMerge, collect)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(migrations))
+	assert.Equal(t, models.URNMigrationSkipped, migrations[0].Result)
+	assert.Equal(t, models.NilContactID, migrations[0].MergedContactID)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND is_active = TRUE`, []interface{}{testdata.Bob.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16059991111' AND contact_id = $1`, []interface{}{testdata.Bob.ID}, 1)
+
+	locks.Release()
+
+	// now migrate again with a merge policy, Bob should be merged into Cathy
+	migrations = nil
+	err = models.MigrateURNs(ctx, db, rp, testdata.Org1.ID, "tel", pattern, "+1605999$1", models.URNCollisionMerge, collect)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(migrations))
+	assert.Equal(t, models.URNMigrationMerged, migrations[0].Result)
+	assert.Equal(t, testdata.Cathy.ID, migrations[0].ContactID)
+	assert.Equal(t, testdata.Bob.ID, migrations[0].MergedContactID)
+
+	// Cathy has the colliding URN in place of her old one, which is detached, as well as Bob's other URN
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16059991111' AND contact_id = $1`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16059992222' AND contact_id = $1`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16055741111' AND contact_id IS NULL`, nil, 1)
+
+	// and Bob's field and group
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND fields->$2->>'text' = 'Male'`, []interface{}{testdata.Cathy.ID, testdata.GenderField.UUID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1 AND contactgroup_id = $2`, []interface{}{testdata.Cathy.ID, testdata.TestersGroup.ID}, 1)
+
+	// Bob is released with nothing left
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND is_active = FALSE`, []interface{}{testdata.Bob.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE contact_id = $1`, []interface{}{testdata.Bob.ID}, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1`, []interface{}{testdata.Bob.ID}, 0)
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// UsageType is a type of metered usage of an external service
+type UsageType string
+
+// usage types
+const (
+	UsageTypeWebhookCalls    = UsageType("webhook_calls")
+	UsageTypeClassifierCalls = UsageType("classifier_calls")
+	UsageTypeTTSChars        = UsageType("tts_chars")
+)
+
+// each org's usage is a hash per month with a field for each usage type, kept for long enough to be reported on
+// after the month has ended
+const (
+	usageKey    = "usage:%d:%s"
+	usageExpiry = time.Hour * 24 * 62
+)
+
+// by default orgs are warned when they've used 80% of a budget and again when they've used all of it
+var defaultUsageWarnAt = []int{80, 100}
+
+// UsageBudget is a monthly limit on a type of usage. If it blocks, usage is refused once the limit has been reached.
+type UsageBudget struct {
+	Limit int64 `json:"limit"`
+	Block bool  `json:"block"`
+}
+
+// UsageBudgets are an org's monthly budgets, e.g.
+//
+//   {
+//     "budgets": {
+//       "webhook_calls": {"limit": 10000, "block": true},
+//       "tts_chars": {"limit": 500000}
+//     },
+//     "warn_at": [50, 90, 100],
+//     "resthook": "usage-warnings"
+//   }
+//
+// Subscribers to the resthook are warned when usage of a type crosses each of the given percentages of its budget.
+type UsageBudgets struct {
+	Budgets  map[UsageType]*UsageBudget `json:"budgets"`
+	WarnAt   []int                      `json:"warn_at"`
+	Resthook string                     `json:"resthook"`
+}
+
+// Budget returns the budget for the given type of usage, or nil if it isn't limited
+func (b *UsageBudgets) Budget(usageType UsageType) *UsageBudget {
+	if b == nil {
+		return nil
+	}
+	budget := b.Budgets[usageType]
+	if budget == nil || budget.Limit <= 0 {
+		return nil
+	}
+	return budget
+}
+
+// UsageWarning is a warning that an org's usage of a type has crossed a percentage of its budget for the month
+type UsageWarning struct {
+	Type    UsageType `json:"type"`
+	Month   string    `json:"month"`
+	Percent int       `json:"percent"`
+	Used    int64     `json:"used"`
+	Limit   int64     `json:"limit"`
+}
+
+// UsageMonth returns the month that usage at the given time is counted in, e.g. 2021-07
+func UsageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// RecordUsage adds to the org's usage of the given type this month, returning a warning for each percentage of its
+// budget that this usage crossed
+func RecordUsage(rc redis.Conn, org *Org, usageType UsageType, amount int64) ([]*UsageWarning, error) {
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	month := UsageMonth(dates.Now())
+	key := fmt.Sprintf(usageKey, org.ID(), month)
+
+	rc.Send("MULTI")
+	rc.Send("HINCRBY", key, usageType, amount)
+	rc.Send("EXPIRE", key, int(usageExpiry/time.Second))
+	replies, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error recording %s usage for org: %d", usageType, org.ID())
+	}
+
+	used, err := redis.Int64(replies[0], nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s usage for org: %d", usageType, org.ID())
+	}
+
+	budgets := org.UsageBudgets()
+	budget := budgets.Budget(usageType)
+	if budget == nil {
+		return nil, nil
+	}
+
+	warnings := make([]*UsageWarning, 0, 1)
+	for _, percent := range budgets.WarnAt {
+		threshold := budget.Limit * int64(percent) / 100
+		if used-amount < threshold && used >= threshold {
+			warnings = append(warnings, &UsageWarning{Type: usageType, Month: month, Percent: percent, Used: used, Limit: budget.Limit})
+		}
+	}
+	return warnings, nil
+}
+
+// UsageBudgetExhausted returns whether the org's budget for the given type of usage has been used up for this month
+// and blocks further usage
+func UsageBudgetExhausted(rc redis.Conn, org *Org, usageType UsageType) (bool, error) {
+	budget := org.UsageBudgets().Budget(usageType)
+	if budget == nil || !budget.Block {
+		return false, nil
+	}
+
+	usage, err := GetUsage(rc, org.ID(), UsageMonth(dates.Now()))
+	if err != nil {
+		return false, err
+	}
+	return usage[usageType] >= budget.Limit, nil
+}
+
+// GetUsage gets the org's usage of each type in the given month
+func GetUsage(rc redis.Conn, orgID OrgID, month string) (map[UsageType]int64, error) {
+	values, err := redis.Int64Map(rc.Do("HGETALL", fmt.Sprintf(usageKey, orgID, month)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading usage for org: %d", orgID)
+	}
+
+	usage := make(map[UsageType]int64, len(values))
+	for t, v := range values {
+		usage[UsageType(t)] = v
+	}
+	return usage, nil
+}
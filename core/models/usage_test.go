@@ -0,0 +1,92 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2021, 7, 15, 12, 0, 0, 0, time.UTC)))
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// without budgets, usage is still recorded but never warned about or blocked
+	assert.Nil(t, oa.Org().UsageBudgets())
+
+	warnings, err := models.RecordUsage(rc, oa.Org(), models.UsageTypeWebhookCalls, 5)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 0)
+
+	exhausted, err := models.UsageBudgetExhausted(rc, oa.Org(), models.UsageTypeWebhookCalls)
+	assert.NoError(t, err)
+	assert.False(t, exhausted)
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"usage_budgets": {"budgets": {"webhook_calls": {"limit": 10, "block": true}, "tts_chars": {"limit": 100}}}}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err = models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	budgets := oa.Org().UsageBudgets()
+	assert.Equal(t, []int{80, 100}, budgets.WarnAt)
+	assert.Equal(t, &models.UsageBudget{Limit: 10, Block: true}, budgets.Budget(models.UsageTypeWebhookCalls))
+	assert.Nil(t, budgets.Budget(models.UsageTypeClassifierCalls))
+
+	// crossing 80% gives us a warning
+	warnings, err = models.RecordUsage(rc, oa.Org(), models.UsageTypeWebhookCalls, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.UsageWarning{{Type: models.UsageTypeWebhookCalls, Month: "2021-07", Percent: 80, Used: 8, Limit: 10}}, warnings)
+
+	// but we're only warned once for each threshold
+	warnings, err = models.RecordUsage(rc, oa.Org(), models.UsageTypeWebhookCalls, 1)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 0)
+
+	exhausted, err = models.UsageBudgetExhausted(rc, oa.Org(), models.UsageTypeWebhookCalls)
+	assert.NoError(t, err)
+	assert.False(t, exhausted)
+
+	warnings, err = models.RecordUsage(rc, oa.Org(), models.UsageTypeWebhookCalls, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.UsageWarning{{Type: models.UsageTypeWebhookCalls, Month: "2021-07", Percent: 100, Used: 10, Limit: 10}}, warnings)
+
+	exhausted, err = models.UsageBudgetExhausted(rc, oa.Org(), models.UsageTypeWebhookCalls)
+	assert.NoError(t, err)
+	assert.True(t, exhausted)
+
+	// a single large usage can cross several thresholds, and budgets which don't block are never exhausted
+	warnings, err = models.RecordUsage(rc, oa.Org(), models.UsageTypeTTSChars, 150)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 2)
+
+	exhausted, err = models.UsageBudgetExhausted(rc, oa.Org(), models.UsageTypeTTSChars)
+	assert.NoError(t, err)
+	assert.False(t, exhausted)
+
+	usage, err := models.GetUsage(rc, testdata.Org1.ID, "2021-07")
+	assert.NoError(t, err)
+	assert.Equal(t, map[models.UsageType]int64{models.UsageTypeWebhookCalls: 10, models.UsageTypeTTSChars: 150}, usage)
+
+	// usage starts again each month
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)))
+
+	exhausted, err = models.UsageBudgetExhausted(rc, oa.Org(), models.UsageTypeWebhookCalls)
+	assert.NoError(t, err)
+	assert.False(t, exhausted)
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/mailroom/utils/dbutil"
+	"github.com/nyaruka/mailroom/utils/logx"
+	"github.com/nyaruka/mailroom/utils/scope"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -19,6 +21,7 @@ type Queryer interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
 	GetContext(ctx context.Context, value interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 }
 
 // QueryerWithTx adds support for beginning transactions
@@ -36,6 +39,7 @@ func Exec(ctx context.Context, label string, tx Queryer, sql string, args ...int
 		return errors.Wrapf(err, fmt.Sprintf("error %s", label))
 	}
 	rows, _ := res.RowsAffected()
+	scope.AddCrumb(ctx, "db", "%s (%d rows, %s)", label, rows, time.Since(start))
 	if rows > 0 {
 		logrus.WithField("count", rows).WithField("elapsed", time.Since(start)).Debug(label)
 	}
@@ -55,8 +59,9 @@ func BulkQuery(ctx context.Context, label string, tx Queryer, sql string, struct
 	if err != nil {
 		return errors.Wrap(err, "error making bulk query")
 	}
+	scope.AddCrumb(ctx, "db", "%s (%d rows, %s)", label, len(structs), time.Since(start))
 
-	logrus.WithField("elapsed", time.Since(start)).WithField("rows", len(structs)).Infof("%s bulk sql complete", label)
+	logx.Sampled(logrus.WithField("elapsed", time.Since(start)).WithField("rows", len(structs))).Infof("%s bulk sql complete", label)
 
 	return nil
 }
@@ -71,6 +76,7 @@ func BulkQueryBatches(ctx context.Context, label string, tx Queryer, sql string,
 		if err != nil {
 			return errors.Wrap(err, "error making bulk batch query")
 		}
+		scope.AddCrumb(ctx, "db", "%s batch %d (%d rows, %s)", label, i+1, len(batch), time.Since(start))
 
 		logrus.WithField("elapsed", time.Since(start)).WithField("rows", len(batch)).WithField("batch", i+1).Infof("%s bulk sql batch complete", label)
 	}
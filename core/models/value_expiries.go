@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// TemporaryValues is the fields and groups of an org whose values only last for a time, in seconds, e.g.
+//
+//   {"temporary_values": {"fields": {"cooldown": 86400}, "groups": {"c153e265-f7c9-4539-9dbc-9b358714b638": 3600}}}
+//
+// Whenever a contact is given a value for one of the fields or added to one of the groups, the value is scheduled to be
+// cleared or the contact removed from the group once that time has passed, e.g. for states like "in cooldown".
+type TemporaryValues struct {
+	Fields map[string]int           `json:"fields"`
+	Groups map[assets.GroupUUID]int `json:"groups"`
+}
+
+// FieldTTL returns how long values of the field with the given key last, or zero if they don't expire
+func (v *TemporaryValues) FieldTTL(key string) time.Duration {
+	return time.Duration(v.Fields[key]) * time.Second
+}
+
+// GroupTTL returns how long contacts remain in the group with the given UUID, or zero if they aren't removed
+func (v *TemporaryValues) GroupTTL(uuid assets.GroupUUID) time.Duration {
+	return time.Duration(v.Groups[uuid]) * time.Second
+}
+
+// ValueExpiryType is the type of value which expires
+type ValueExpiryType string
+
+// value expiry types
+const (
+	ValueExpiryTypeField = ValueExpiryType("F")
+	ValueExpiryTypeGroup = ValueExpiryType("G")
+)
+
+// ValueExpiryID is the id of a value expiry
+type ValueExpiryID int64
+
+// ValueExpiry is a contact's field value or group membership which will expire at a time. ItemID is the id of the field
+// or group.
+type ValueExpiry struct {
+	ID        ValueExpiryID   `db:"id"`
+	OrgID     OrgID           `db:"org_id"`
+	ContactID ContactID       `db:"contact_id"`
+	Type      ValueExpiryType `db:"expiry_type"`
+	ItemID    int             `db:"item_id"`
+	ExpiresOn time.Time       `db:"expires_on"`
+}
+
+const upsertValueExpiriesSQL = `
+INSERT INTO contacts_contactvalueexpiry(org_id, contact_id, expiry_type, item_id, expires_on)
+     VALUES(:org_id, :contact_id, :expiry_type, :item_id, :expires_on)
+ON CONFLICT (contact_id, expiry_type, item_id) DO UPDATE SET expires_on = EXCLUDED.expires_on
+`
+
+// ScheduleValueExpiries schedules the given expiries, replacing any existing expiries of the same values
+func ScheduleValueExpiries(ctx context.Context, db Queryer, expiries []*ValueExpiry) error {
+	if len(expiries) == 0 {
+		return nil
+	}
+
+	// the same value can't be upserted twice in one statement so only keep the last expiry of each
+	type valueKey struct {
+		contactID ContactID
+		typ       ValueExpiryType
+		itemID    int
+	}
+	byValue := make(map[valueKey]int, len(expiries))
+	unique := make([]interface{}, 0, len(expiries))
+	for _, e := range expiries {
+		k := valueKey{e.ContactID, e.Type, e.ItemID}
+		if i, seen := byValue[k]; seen {
+			unique[i] = e
+		} else {
+			byValue[k] = len(unique)
+			unique = append(unique, e)
+		}
+	}
+
+	return BulkQuery(ctx, "scheduling value expiries", db, upsertValueExpiriesSQL, unique)
+}
+
+const deleteValueExpiriesSQL = `
+DELETE FROM contacts_contactvalueexpiry e
+      USING (SELECT UNNEST($1::int[]) AS contact_id, UNNEST($2::varchar[]) AS expiry_type, UNNEST($3::int[]) AS item_id) v
+      WHERE e.contact_id = v.contact_id AND e.expiry_type = v.expiry_type AND e.item_id = v.item_id
+`
+
+// CancelValueExpiries cancels the expiries of the given values, e.g. because a field was cleared before it expired
+func CancelValueExpiries(ctx context.Context, db Queryer, expiries []*ValueExpiry) error {
+	if len(expiries) == 0 {
+		return nil
+	}
+
+	contactIDs := make([]ContactID, len(expiries))
+	types := make([]ValueExpiryType, len(expiries))
+	itemIDs := make([]int, len(expiries))
+	for i, e := range expiries {
+		contactIDs[i], types[i], itemIDs[i] = e.ContactID, e.Type, e.ItemID
+	}
+
+	_, err := db.ExecContext(ctx, deleteValueExpiriesSQL, pq.Array(contactIDs), pq.Array(types), pq.Array(itemIDs))
+	return errors.Wrapf(err, "error cancelling value expiries")
+}
+
+const selectOrgsWithDueValueExpiriesSQL = `SELECT DISTINCT org_id FROM contacts_contactvalueexpiry WHERE expires_on <= $1 ORDER BY org_id`
+
+// OrgIDsWithDueValueExpiries returns the ids of the orgs which have values which have expired by the given time
+func OrgIDsWithDueValueExpiries(ctx context.Context, db Queryer, now time.Time) ([]OrgID, error) {
+	orgIDs := make([]OrgID, 0)
+	if err := db.SelectContext(ctx, &orgIDs, selectOrgsWithDueValueExpiriesSQL, now); err != nil {
+		return nil, errors.Wrapf(err, "error selecting orgs with due value expiries")
+	}
+	return orgIDs, nil
+}
+
+const selectDueValueExpiriesSQL = `
+  SELECT id, org_id, contact_id, expiry_type, item_id, expires_on
+    FROM contacts_contactvalueexpiry
+   WHERE org_id = $1 AND expires_on <= $2
+ORDER BY expires_on, id
+   LIMIT $3
+`
+
+// LoadDueValueExpiries loads up to limit of the given org's values which have expired by the given time
+func LoadDueValueExpiries(ctx context.Context, db Queryer, orgID OrgID, now time.Time, limit int) ([]*ValueExpiry, error) {
+	expiries := make([]*ValueExpiry, 0, limit)
+	if err := db.SelectContext(ctx, &expiries, selectDueValueExpiriesSQL, orgID, now, limit); err != nil {
+		return nil, errors.Wrapf(err, "error loading due value expiries for org: %d", orgID)
+	}
+	return expiries, nil
+}
+
+const deleteValueExpiriesByIDSQL = `DELETE FROM contacts_contactvalueexpiry WHERE id = ANY($1)`
+
+// DeleteValueExpiries deletes the value expiries with the given ids once they've been applied
+func DeleteValueExpiries(ctx context.Context, db Queryer, ids []ValueExpiryID) error {
+	_, err := db.ExecContext(ctx, deleteValueExpiriesByIDSQL, pq.Array(ids))
+	return errors.Wrapf(err, "error deleting value expiries")
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/goflow"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	tokenHTTPClient := &http.Client{Timeout: time.Duration(15 * time.Second)}
+
+	goflow.RegisterWebhookRequestPreparer(
+		func(session flows.Session, request *http.Request) error {
+			return orgFromSession(session).PrepareWebhookRequest(tokenHTTPClient, request)
+		},
+	)
+}
+
+const (
+	configWebhookHeaders      = "webhook_headers"
+	configWebhookAuthProfiles = "webhook_auth_profiles"
+)
+
+// WebhookAuthHeader is the header a webhook node can set to the name of an org auth profile to use for its request.
+// It's removed from the request before it is made.
+const WebhookAuthHeader = "X-Mailroom-Auth"
+
+// WebhookAuthType is the type of a webhook auth profile
+type WebhookAuthType string
+
+// webhook auth profile types
+const (
+	WebhookAuthBearer  = WebhookAuthType("bearer")
+	WebhookAuthBasic   = WebhookAuthType("basic")
+	WebhookAuthHeaders = WebhookAuthType("headers")
+	WebhookAuthOAuth2  = WebhookAuthType("oauth2")
+)
+
+// WebhookAuthProfile is a named set of credentials that webhook calls can use without them being in the flow
+type WebhookAuthProfile struct {
+	Type         WebhookAuthType   `json:"type"`
+	Token        string            `json:"token,omitempty"`
+	Username     string            `json:"username,omitempty"`
+	Password     string            `json:"password,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	TokenURL     string            `json:"token_url,omitempty"`
+	ClientID     string            `json:"client_id,omitempty"`
+	ClientSecret string            `json:"client_secret,omitempty"`
+	Scopes       []string          `json:"scopes,omitempty"`
+}
+
+// WebhookHeaders returns the headers added to all webhook calls made by this org that don't already set them
+func (o *Org) WebhookHeaders() map[string]string {
+	raw, found := o.o.Config.Map()[configWebhookHeaders]
+	if !found {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &headers)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid webhook headers config")
+		return nil
+	}
+	return headers
+}
+
+// WebhookAuthProfile returns the webhook auth profile with the given name, or nil if there is no such profile
+func (o *Org) WebhookAuthProfile(name string) *WebhookAuthProfile {
+	raw, found := o.o.Config.Map()[configWebhookAuthProfiles]
+	if !found {
+		return nil
+	}
+
+	profiles := make(map[string]*WebhookAuthProfile)
+	b, err := jsonx.Marshal(raw)
+	if err == nil {
+		err = jsonx.Unmarshal(b, &profiles)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("org_id", o.ID()).Error("invalid webhook auth profiles config")
+		return nil
+	}
+	return profiles[name]
+}
+
+// PrepareWebhookRequest adds this org's default headers to the given webhook request and, if it references an auth
+// profile, applies the credentials of that profile
+func (o *Org) PrepareWebhookRequest(httpClient *http.Client, request *http.Request) error {
+	for name, value := range o.WebhookHeaders() {
+		if request.Header.Get(name) == "" {
+			request.Header.Set(name, value)
+		}
+	}
+
+	profileName := strings.TrimSpace(request.Header.Get(WebhookAuthHeader))
+	if profileName == "" {
+		return nil
+	}
+	request.Header.Del(WebhookAuthHeader)
+
+	profile := o.WebhookAuthProfile(profileName)
+	if profile == nil {
+		return errors.Errorf("no such webhook auth profile '%s'", profileName)
+	}
+
+	switch profile.Type {
+	case WebhookAuthBearer:
+		request.Header.Set("Authorization", "Bearer "+profile.Token)
+	case WebhookAuthBasic:
+		request.SetBasicAuth(profile.Username, profile.Password)
+	case WebhookAuthHeaders:
+		for name, value := range profile.Headers {
+			request.Header.Set(name, value)
+		}
+	case WebhookAuthOAuth2:
+		token, err := oauth2Tokens.get(httpClient, o.ID(), profileName, profile)
+		if err != nil {
+			return errors.Wrapf(err, "error getting token for webhook auth profile '%s'", profileName)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return errors.Errorf("webhook auth profile '%s' has unknown type '%s'", profileName, profile.Type)
+	}
+
+	return nil
+}
+
+// how long before a token expires that we consider it expired so it's never used in a request as it expires
+const oauth2TokenExpiryMargin = time.Second * 30
+
+type oauth2Token struct {
+	accessToken string
+	expiresOn   time.Time
+}
+
+// cache of access tokens fetched using client credentials, keyed by org, profile name and client id
+type oauth2TokenCache struct {
+	tokens map[string]*oauth2Token
+	mutex  sync.Mutex
+}
+
+var oauth2Tokens = &oauth2TokenCache{tokens: make(map[string]*oauth2Token)}
+
+func (c *oauth2TokenCache) get(httpClient *http.Client, orgID OrgID, name string, profile *WebhookAuthProfile) (string, error) {
+	key := fmt.Sprintf("%d:%s:%s", orgID, name, profile.ClientID)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	token := c.tokens[key]
+	if token != nil && time.Now().Before(token.expiresOn) {
+		return token.accessToken, nil
+	}
+
+	token, err := fetchClientCredentialsToken(httpClient, profile)
+	if err != nil {
+		return "", err
+	}
+
+	c.tokens[key] = token
+	return token.accessToken, nil
+}
+
+// fetches a new access token using the OAuth2 client credentials grant
+func fetchClientCredentialsToken(httpClient *http.Client, profile *WebhookAuthProfile) (*oauth2Token, error) {
+	form := url.Values{"grant_type": []string{"client_credentials"}}
+	if len(profile.Scopes) > 0 {
+		form.Set("scope", strings.Join(profile.Scopes, " "))
+	}
+
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	request, err := httpx.NewRequest(http.MethodPost, profile.TokenURL, strings.NewReader(form.Encode()), headers)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(profile.ClientID, profile.ClientSecret)
+
+	trace, err := httpx.DoTrace(httpClient, request, nil, nil, -1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error requesting token")
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("token request returned status %d", trace.Response.StatusCode)
+	}
+
+	payload := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := jsonx.Unmarshal(trace.ResponseBody, payload); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshalling token response")
+	}
+	if payload.AccessToken == "" {
+		return nil, errors.New("token response has no access token")
+	}
+
+	// tokens without an expiry are refreshed every hour
+	expiresIn := time.Hour
+	if payload.ExpiresIn > 0 {
+		expiresIn = time.Duration(payload.ExpiresIn) * time.Second
+	}
+
+	return &oauth2Token{accessToken: payload.AccessToken, expiresOn: time.Now().Add(expiresIn - oauth2TokenExpiryMargin)}, nil
+}
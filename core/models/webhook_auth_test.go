@@ -0,0 +1,96 @@
+package models_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareWebhookRequest(t *testing.T) {
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := testsuite.DB()
+	defer db.MustExec(`UPDATE orgs_org SET config = '{}' WHERE id = $1`, testdata.Org1.ID)
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://auth.example.com/token": {
+			httpx.NewMockResponse(200, nil, `{"access_token": "tok1", "expires_in": 3600}`),
+		},
+		"https://bad.example.com/token": {
+			httpx.NewMockResponse(401, nil, `{"error": "invalid_client"}`),
+		},
+	}))
+
+	db.MustExec(`UPDATE orgs_org SET config = $2 WHERE id = $1`, testdata.Org1.ID, `{
+		"webhook_headers": {"X-Org": "nyaruka", "User-Agent": "Ignored"},
+		"webhook_auth_profiles": {
+			"crm": {"type": "bearer", "token": "sesame"},
+			"legacy": {"type": "basic", "username": "bob", "password": "pass"},
+			"custom": {"type": "headers", "headers": {"X-Api-Key": "123"}},
+			"api": {"type": "oauth2", "token_url": "https://auth.example.com/token", "client_id": "abc", "client_secret": "xyz", "scopes": ["read", "write"]},
+			"broken": {"type": "oauth2", "token_url": "https://bad.example.com/token", "client_id": "abc", "client_secret": "xyz"},
+			"weird": {"type": "magic"}
+		}
+	}`)
+
+	org, err := models.LoadOrg(ctx, rt.Config, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	assert.Nil(t, org.WebhookAuthProfile("unknown"))
+	assert.Equal(t, &models.WebhookAuthProfile{Type: models.WebhookAuthBearer, Token: "sesame"}, org.WebhookAuthProfile("crm"))
+
+	prepare := func(profile string) (*http.Request, error) {
+		headers := map[string]string{"User-Agent": "RapidProMailroom/Dev"}
+		if profile != "" {
+			headers[models.WebhookAuthHeader] = profile
+		}
+		request, _ := httpx.NewRequest("GET", "https://api.example.com/", nil, headers)
+		return request, org.PrepareWebhookRequest(http.DefaultClient, request)
+	}
+
+	// no profile just gets the default headers which don't override those set by the flow
+	request, err := prepare("")
+	assert.NoError(t, err)
+	assert.Equal(t, "nyaruka", request.Header.Get("X-Org"))
+	assert.Equal(t, "RapidProMailroom/Dev", request.Header.Get("User-Agent"))
+	assert.Equal(t, "", request.Header.Get("Authorization"))
+
+	request, err = prepare("crm")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer sesame", request.Header.Get("Authorization"))
+	assert.Equal(t, "", request.Header.Get(models.WebhookAuthHeader))
+
+	request, err = prepare("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, "Basic Ym9iOnBhc3M=", request.Header.Get("Authorization"))
+
+	request, err = prepare("custom")
+	assert.NoError(t, err)
+	assert.Equal(t, "123", request.Header.Get("X-Api-Key"))
+
+	// oauth2 profiles fetch a token which is then cached so only one token request is made
+	request, err = prepare("api")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer tok1", request.Header.Get("Authorization"))
+
+	request, err = prepare("api")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer tok1", request.Header.Get("Authorization"))
+
+	_, err = prepare("broken")
+	assert.EqualError(t, err, "error getting token for webhook auth profile 'broken': token request returned status 401")
+
+	_, err = prepare("weird")
+	assert.EqualError(t, err, "webhook auth profile 'weird' has unknown type 'magic'")
+
+	_, err = prepare("unknown")
+	assert.EqualError(t, err, "no such webhook auth profile 'unknown'")
+}
@@ -0,0 +1,292 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/config"
+
+	"github.com/pkg/errors"
+)
+
+type WebhookRetryID int64
+
+// WebhookRetryStatus is the status of a webhook retry
+type WebhookRetryStatus string
+
+const (
+	WebhookRetryStatusPending   = WebhookRetryStatus("P")
+	WebhookRetryStatusSucceeded = WebhookRetryStatus("S")
+	WebhookRetryStatusFailed    = WebhookRetryStatus("F")
+)
+
+// the status codes of responses which suggest the server might accept the same request later
+var retryableWebhookStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// request headers which are set by the HTTP client itself and so aren't replayed
+var unreplayedWebhookHeaders = []string{"Content-Length", "Accept-Encoding"}
+
+// request headers which carry credentials and so are stripped from stored requests which can't be encrypted
+var credentialWebhookHeaders = map[string]bool{"authorization": true, "proxy-authorization": true, "cookie": true}
+
+// WebhookRetry is a webhook call which failed in a way that might succeed later, and so is retried with backoff
+type WebhookRetry struct {
+	r struct {
+		ID             WebhookRetryID     `db:"id"`
+		OrgID          OrgID              `db:"org_id"`
+		ContactID      ContactID          `db:"contact_id"`
+		ContactUUID    flows.ContactUUID  `db:"contact_uuid"`
+		Resthook       string             `db:"resthook"`
+		URL            string             `db:"url"`
+		Request        string             `db:"request"`
+		Status         WebhookRetryStatus `db:"status"`
+		Attempts       int                `db:"attempts"`
+		LastStatusCode int                `db:"last_status_code"`
+		NextAttemptOn  *time.Time         `db:"next_attempt_on"`
+		CreatedOn      time.Time          `db:"created_on"`
+		ModifiedOn     time.Time          `db:"modified_on"`
+	}
+}
+
+func (r *WebhookRetry) ID() WebhookRetryID             { return r.r.ID }
+func (r *WebhookRetry) OrgID() OrgID                   { return r.r.OrgID }
+func (r *WebhookRetry) ContactID() ContactID           { return r.r.ContactID }
+func (r *WebhookRetry) ContactUUID() flows.ContactUUID { return r.r.ContactUUID }
+func (r *WebhookRetry) Resthook() string               { return r.r.Resthook }
+func (r *WebhookRetry) URL() string                    { return r.r.URL }
+func (r *WebhookRetry) Status() WebhookRetryStatus     { return r.r.Status }
+func (r *WebhookRetry) Attempts() int                  { return r.r.Attempts }
+func (r *WebhookRetry) LastStatusCode() int            { return r.r.LastStatusCode }
+func (r *WebhookRetry) NextAttemptOn() *time.Time      { return r.r.NextAttemptOn }
+
+// NewWebhookRetry creates a new pending retry of the webhook call with the given raw request, which failed with the
+// given status code, or zero if it couldn't connect
+func NewWebhookRetry(orgID OrgID, contactID ContactID, resthook, url, request string, statusCode int, nextAttemptOn time.Time) *WebhookRetry {
+	retry := &WebhookRetry{}
+	r := &retry.r
+
+	r.OrgID = orgID
+	r.ContactID = contactID
+	r.Resthook = resthook
+	r.URL = url
+	r.Request = request
+	r.Status = WebhookRetryStatusPending
+	r.LastStatusCode = statusCode
+	r.NextAttemptOn = &nextAttemptOn
+	r.CreatedOn = time.Now()
+	r.ModifiedOn = r.CreatedOn
+
+	return retry
+}
+
+// ShouldRetryWebhook returns whether a webhook call which failed with the given status code, or zero if it couldn't
+// connect, might succeed if retried later
+func ShouldRetryWebhook(statusCode int) bool {
+	return statusCode == 0 || retryableWebhookStatusCodes[statusCode]
+}
+
+// WebhookRetryBackoff returns how long to wait before making the given deferred retry (counting from zero) of a failed
+// webhook call, which doubles with each retry
+func WebhookRetryBackoff(cfg *config.Config, attempt int) time.Duration {
+	return time.Second * time.Duration(cfg.WebhooksDeferredBackoff) * time.Duration(1<<uint(attempt))
+}
+
+// HTTPRequest recreates the HTTP request of the original call from its stored raw request
+func (r *WebhookRetry) HTTPRequest(ctx context.Context, cfg *config.Config) (*http.Request, error) {
+	raw, err := unprotectWebhookRequest(cfg, r.r.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing recorded request")
+	}
+
+	body, err := ioutil.ReadAll(recorded.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading recorded request body")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, recorded.Method, r.r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request")
+	}
+
+	request.Header = recorded.Header
+	for _, h := range unreplayedWebhookHeaders {
+		request.Header.Del(h)
+	}
+
+	return request, nil
+}
+
+// RecordAttempt records an attempt of this retry which got the given status code, or zero if it couldn't connect. If
+// the call succeeded, or we've made the given maximum number of attempts, or the call failed in a way that retrying
+// won't fix, this retry is complete, otherwise its next attempt is scheduled.
+func (r *WebhookRetry) RecordAttempt(cfg *config.Config, statusCode int, success bool, now time.Time) {
+	r.r.Attempts++
+	r.r.LastStatusCode = statusCode
+	r.r.ModifiedOn = now
+
+	if success {
+		r.r.Status = WebhookRetryStatusSucceeded
+		r.r.NextAttemptOn = nil
+	} else if r.r.Attempts >= cfg.WebhooksDeferredRetries || !ShouldRetryWebhook(statusCode) {
+		r.r.Status = WebhookRetryStatusFailed
+		r.r.NextAttemptOn = nil
+	} else {
+		nextAttemptOn := now.Add(WebhookRetryBackoff(cfg, r.r.Attempts))
+		r.r.NextAttemptOn = &nextAttemptOn
+	}
+}
+
+// GiveUp marks this retry as failed without making another attempt
+func (r *WebhookRetry) GiveUp(now time.Time) {
+	r.r.Status = WebhookRetryStatusFailed
+	r.r.NextAttemptOn = nil
+	r.r.ModifiedOn = now
+}
+
+const insertWebhookRetriesSQL = `
+INSERT INTO
+api_webhookretry( org_id,  contact_id,  resthook,  url,  request,  status,  attempts,  last_status_code,  next_attempt_on,  created_on,  modified_on)
+		  VALUES(:org_id, :contact_id, :resthook, :url, :request, :status, :attempts, :last_status_code, :next_attempt_on, :created_on, :modified_on)
+RETURNING id
+`
+
+// InsertWebhookRetries inserts the passed in webhook retries, assigning them ids. Their requests are encrypted if we have
+// a key to do so, and otherwise have their credentials stripped.
+func InsertWebhookRetries(ctx context.Context, db Queryer, cfg *config.Config, retries []*WebhookRetry) error {
+	is := make([]interface{}, len(retries))
+	for i := range retries {
+		request, err := protectWebhookRequest(cfg, retries[i].r.Request)
+		if err != nil {
+			return err
+		}
+		retries[i].r.Request = request
+		is[i] = &retries[i].r
+	}
+
+	return BulkQuery(ctx, "inserting webhook retries", db, insertWebhookRetriesSQL, is)
+}
+
+const selectDueWebhookRetriesSQL = `
+SELECT
+	r.id,
+	r.org_id,
+	r.contact_id,
+	COALESCE(c.uuid::text, '') AS contact_uuid,
+	r.resthook,
+	r.url,
+	r.request,
+	r.status,
+	r.attempts,
+	r.last_status_code,
+	r.next_attempt_on,
+	r.created_on,
+	r.modified_on
+FROM
+	api_webhookretry r
+LEFT OUTER JOIN
+	contacts_contact c ON c.id = r.contact_id
+WHERE
+	r.status = 'P' AND r.next_attempt_on <= $1
+ORDER BY
+	r.next_attempt_on ASC
+LIMIT
+	$2
+`
+
+// LoadDueWebhookRetries loads up to the given number of pending webhook retries whose next attempt is due
+func LoadDueWebhookRetries(ctx context.Context, db Queryer, now time.Time, limit int) ([]*WebhookRetry, error) {
+	rows, err := db.QueryxContext(ctx, selectDueWebhookRetriesSQL, now, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting due webhook retries")
+	}
+	defer rows.Close()
+
+	retries := make([]*WebhookRetry, 0, 10)
+	for rows.Next() {
+		retry := &WebhookRetry{}
+		if err := rows.StructScan(&retry.r); err != nil {
+			return nil, errors.Wrapf(err, "error scanning webhook retry")
+		}
+		retries = append(retries, retry)
+	}
+
+	return retries, rows.Err()
+}
+
+const updateWebhookRetrySQL = `
+UPDATE
+	api_webhookretry
+SET
+	status = $2,
+	attempts = $3,
+	last_status_code = $4,
+	next_attempt_on = $5,
+	modified_on = $6
+WHERE
+	id = $1
+`
+
+// UpdateWebhookRetry updates the passed in webhook retry after an attempt
+func UpdateWebhookRetry(ctx context.Context, db Queryer, retry *WebhookRetry) error {
+	r := &retry.r
+	_, err := db.ExecContext(ctx, updateWebhookRetrySQL, r.ID, r.Status, r.Attempts, r.LastStatusCode, r.NextAttemptOn, r.ModifiedOn)
+	return errors.Wrapf(err, "error updating webhook retry #%d", r.ID)
+}
+
+// prepares a raw request for storing, encrypting it if we have a key, or stripping its credential headers if not
+func protectWebhookRequest(cfg *config.Config, request string) (string, error) {
+	key, err := cfg.ParseWebhookRetriesKey()
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		encrypted, err := encryptSecret(key, request)
+		return encrypted, errors.Wrapf(err, "error encrypting webhook request")
+	}
+
+	// headers end at the first blank line, and there's nothing to strip from a request without any
+	headerEnd := strings.Index(request, "\r\n\r\n")
+	if headerEnd < 0 {
+		return request, nil
+	}
+
+	lines := strings.Split(request[:headerEnd], "\r\n")
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		if !credentialWebhookHeaders[name] {
+			kept = append(kept, line)
+		}
+	}
+
+	return strings.Join(kept, "\r\n") + request[headerEnd:], nil
+}
+
+// reverses protectWebhookRequest, decrypting a stored raw request if we have a key
+func unprotectWebhookRequest(cfg *config.Config, stored string) (string, error) {
+	key, err := cfg.ParseWebhookRetriesKey()
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		request, err := decryptSecret(key, stored)
+		return request, errors.Wrapf(err, "error decrypting recorded request")
+	}
+	return stored, nil
+}
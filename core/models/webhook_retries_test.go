@@ -0,0 +1,146 @@
+package models_test
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookRetries(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	cfg := config.NewMailroomConfig()
+	cfg.WebhooksDeferredRetries = 3
+	cfg.WebhooksDeferredBackoff = 60
+
+	assert.True(t, models.ShouldRetryWebhook(0))
+	assert.True(t, models.ShouldRetryWebhook(429))
+	assert.True(t, models.ShouldRetryWebhook(502))
+	assert.True(t, models.ShouldRetryWebhook(503))
+	assert.True(t, models.ShouldRetryWebhook(504))
+	assert.False(t, models.ShouldRetryWebhook(400))
+	assert.False(t, models.ShouldRetryWebhook(410))
+	assert.False(t, models.ShouldRetryWebhook(500))
+
+	assert.Equal(t, time.Minute, models.WebhookRetryBackoff(cfg, 0))
+	assert.Equal(t, time.Minute*2, models.WebhookRetryBackoff(cfg, 1))
+	assert.Equal(t, time.Minute*4, models.WebhookRetryBackoff(cfg, 2))
+
+	now := time.Now()
+	request := "POST /hook?x=1 HTTP/1.1\r\nHost: example.com\r\nUser-Agent: goflow-testing\r\nContent-Length: 14\r\nContent-Type: application/json\r\nAuthorization: Token sesame\r\nAccept-Encoding: gzip\r\n\r\n{\"name\":\"Bob\"}"
+
+	due := models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com/hook?x=1", request, 502, now.Add(-time.Second))
+	notDue := models.NewWebhookRetry(testdata.Org1.ID, models.NilContactID, "new-order", "http://example.com/order", request, 0, now.Add(time.Minute))
+
+	err := models.InsertWebhookRetries(ctx, db, cfg, []*models.WebhookRetry{due, notDue})
+	require.NoError(t, err)
+	assert.NotZero(t, due.ID())
+	assert.NotZero(t, notDue.ID())
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE status = 'P' AND attempts = 0`, nil, 2)
+
+	// without a key to encrypt them, requests are stored without their credentials
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE request LIKE '%sesame%'`, nil, 0)
+
+	retries, err := models.LoadDueWebhookRetries(ctx, db, now, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(retries))
+
+	retry := retries[0]
+	assert.Equal(t, due.ID(), retry.ID())
+	assert.Equal(t, testdata.Cathy.ID, retry.ContactID())
+	assert.Equal(t, testdata.Cathy.UUID, retry.ContactUUID())
+	assert.Equal(t, 502, retry.LastStatusCode())
+
+	// the original request can be recreated without the headers which the client sets itself
+	req, err := retry.HTTPRequest(ctx, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, ctx, req.Context())
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "http://example.com/hook?x=1", req.URL.String())
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "goflow-testing", req.Header.Get("User-Agent"))
+	assert.Equal(t, "", req.Header.Get("Accept-Encoding"))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"Bob"}`, string(body))
+
+	// another retryable failure schedules the next attempt with a longer backoff
+	retry.RecordAttempt(cfg, 503, false, now)
+	assert.Equal(t, models.WebhookRetryStatusPending, retry.Status())
+	assert.Equal(t, 1, retry.Attempts())
+	assert.Equal(t, now.Add(time.Minute*2), *retry.NextAttemptOn())
+
+	err = models.UpdateWebhookRetry(ctx, db, retry)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'P' AND attempts = 1 AND last_status_code = 503`, []interface{}{retry.ID()}, 1)
+
+	// nothing is due until then
+	retries, err = models.LoadDueWebhookRetries(ctx, db, now.Add(time.Second*119), 100)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(retries))
+	assert.Equal(t, notDue.ID(), retries[0].ID())
+	assert.Equal(t, "", string(retries[0].ContactUUID()))
+
+	// a failure which retrying won't fix is permanent
+	retry.RecordAttempt(cfg, 400, false, now)
+	assert.Equal(t, models.WebhookRetryStatusFailed, retry.Status())
+	assert.Nil(t, retry.NextAttemptOn())
+
+	// as is a retryable failure once we've made the maximum number of attempts
+	retry = models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com", request, 0, now)
+	retry.RecordAttempt(cfg, 0, false, now)
+	retry.RecordAttempt(cfg, 0, false, now)
+	assert.Equal(t, models.WebhookRetryStatusPending, retry.Status())
+	retry.RecordAttempt(cfg, 0, false, now)
+	assert.Equal(t, models.WebhookRetryStatusFailed, retry.Status())
+	assert.Equal(t, 3, retry.Attempts())
+
+	// and a success is final
+	retry = models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com", request, 0, now)
+	retry.RecordAttempt(cfg, 200, true, now)
+	assert.Equal(t, models.WebhookRetryStatusSucceeded, retry.Status())
+	assert.Nil(t, retry.NextAttemptOn())
+
+	// requests which weren't recorded properly can't be recreated
+	retry = models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com", "GET http://example.com", 0, now)
+	_, err = retry.HTTPRequest(ctx, cfg)
+	assert.EqualError(t, err, "error parsing recorded request: malformed HTTP request \"GET http://example.com\"")
+
+	retry.GiveUp(now)
+	assert.Equal(t, models.WebhookRetryStatusFailed, retry.Status())
+	assert.Equal(t, 0, retry.Attempts())
+
+	// with a key, requests are stored encrypted and keep their credentials
+	cfg.WebhookRetriesKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	encrypted := models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com/hook?x=1", request, 502, now.Add(-time.Hour))
+	err = models.InsertWebhookRetries(ctx, db, cfg, []*models.WebhookRetry{encrypted})
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND request NOT LIKE '%POST /hook%' AND request NOT LIKE '%sesame%'`, []interface{}{encrypted.ID()}, 1)
+
+	retries, err = models.LoadDueWebhookRetries(ctx, db, now, 100)
+	require.NoError(t, err)
+	require.Equal(t, encrypted.ID(), retries[0].ID())
+
+	req, err = retries[0].HTTPRequest(ctx, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "Token sesame", req.Header.Get("Authorization"))
+
+	body, err = ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"Bob"}`, string(body))
+}
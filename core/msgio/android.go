@@ -1,23 +1,40 @@
 package msgio
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/utils/redisutil"
 	"github.com/pkg/errors"
 
 	"github.com/edganiukov/fcm"
+	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
 )
 
-// SyncAndroidChannels tries to trigger syncs of the given Android channels via FCM
-func SyncAndroidChannels(fc *fcm.Client, channels []*models.Channel) {
+// the keys used to limit how often Android channels are synced, which are all prefixed with the same hash tag if we're
+// using them so that they're in the same slot of a redis cluster
+const (
+	androidSyncLastPattern     = "%s:last:%s"
+	androidSyncDeferredPattern = "%s:deferred"
+	androidSyncTokensPattern   = "%s:tokens"
+)
+
+// SyncAndroidChannels tries to trigger syncs of the given Android channels via FCM. If a channel was synced less than
+// the configured sync interval ago, its sync is deferred to the end of that interval, so that a burst of messages wakes
+// the device once rather than once per message.
+func SyncAndroidChannels(rc redis.Conn, fc *fcm.Client, channels []*models.Channel) {
 	if fc == nil {
 		logrus.Warn("skipping Android sync as instance has not configured FCM")
 		return
 	}
 
+	interval := time.Second * time.Duration(config.Mailroom.AndroidSyncInterval)
+	now := time.Now()
+
 	for _, channel := range channels {
 		// no FCM ID for this channel, noop, we can't trigger a sync
 		fcmID := channel.ConfigValue(models.ChannelConfigFCMID, "")
@@ -25,25 +42,109 @@ func SyncAndroidChannels(fc *fcm.Client, channels []*models.Channel) {
 			continue
 		}
 
-		sync := &fcm.Message{
-			Token:       fcmID,
-			Priority:    "high",
-			CollapseKey: "sync",
-			Data:        map[string]interface{}{"msg": "sync"},
+		if interval > 0 {
+			syncNow, err := redis.Bool(requestAndroidSync.Do(rc, requestAndroidSyncArgs(channel.UUID(), fcmID, now, interval)...))
+			if err != nil {
+				// if we can't check when this channel was last synced, better to sync it again
+				logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error checking last sync of channel")
+			} else if !syncNow {
+				logrus.WithField("channel_uuid", channel.UUID()).Debug("android sync deferred")
+				continue
+			}
 		}
 
-		start := time.Now()
-		_, err := fc.Send(sync)
+		syncAndroidChannel(fc, channel.UUID(), fcmID)
+	}
+}
+
+// SyncDeferredAndroidChannels triggers the syncs of Android channels which were deferred until now, returning how many
+// were triggered
+func SyncDeferredAndroidChannels(rc redis.Conn, fc *fcm.Client, now time.Time) (int, error) {
+	prefix := redisutil.HashTag("android_sync")
 
-		if err != nil {
-			// log failures but continue, relayer will sync on its own
-			logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error syncing channel")
-		} else {
-			logrus.WithField("elapsed", time.Since(start)).WithField("channel_uuid", channel.UUID()).Debug("android sync complete")
+	values, err := redis.Strings(takeDeferredAndroidSyncs.Do(rc,
+		fmt.Sprintf(androidSyncDeferredPattern, prefix), fmt.Sprintf(androidSyncTokensPattern, prefix),
+		now.UnixNano()/int64(time.Millisecond),
+	))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error taking deferred android syncs")
+	}
+
+	// values are pairs of channel UUID and FCM ID
+	for i := 0; i < len(values)-1; i += 2 {
+		if values[i+1] != "" {
+			syncAndroidChannel(fc, assets.ChannelUUID(values[i]), values[i+1])
 		}
 	}
+
+	return len(values) / 2, nil
+}
+
+func syncAndroidChannel(fc *fcm.Client, channelUUID assets.ChannelUUID, fcmID string) {
+	sync := &fcm.Message{
+		Token:       fcmID,
+		Priority:    "high",
+		CollapseKey: "sync",
+		Data:        map[string]interface{}{"msg": "sync"},
+	}
+
+	start := time.Now()
+	_, err := fc.Send(sync)
+
+	if err != nil {
+		// log failures but continue, relayer will sync on its own
+		logrus.WithError(err).WithField("channel_uuid", channelUUID).Error("error syncing channel")
+	} else {
+		logrus.WithField("elapsed", time.Since(start)).WithField("channel_uuid", channelUUID).Debug("android sync complete")
+	}
 }
 
+// returns the keys and args of requestAndroidSync for the given channel
+func requestAndroidSyncArgs(channelUUID assets.ChannelUUID, fcmID string, now time.Time, interval time.Duration) []interface{} {
+	prefix := redisutil.HashTag("android_sync")
+
+	return []interface{}{
+		fmt.Sprintf(androidSyncLastPattern, prefix, channelUUID),
+		fmt.Sprintf(androidSyncDeferredPattern, prefix),
+		fmt.Sprintf(androidSyncTokensPattern, prefix),
+		string(channelUUID), fcmID, now.UnixNano() / int64(time.Millisecond), int64(interval / time.Millisecond),
+	}
+}
+
+// records a sync of a channel and returns 1 if it wasn't synced within the interval, otherwise defers the sync to the
+// end of the interval and returns 0
+var requestAndroidSync = redis.NewScript(3, `
+-- KEYS: [LastKey, DeferredKey, TokensKey] ARGV: [ChannelUUID, FCMID, NowMS, IntervalMS]
+if redis.call("SET", KEYS[1], ARGV[3], "NX", "PX", ARGV[4]) then
+	return 1
+end
+
+local last = tonumber(redis.call("GET", KEYS[1])) or tonumber(ARGV[3])
+redis.call("ZADD", KEYS[2], "NX", last + tonumber(ARGV[4]), ARGV[1])
+redis.call("HSET", KEYS[3], ARGV[1], ARGV[2])
+return 0
+`)
+
+// removes and returns the deferred syncs which are due, as pairs of channel UUID and FCM ID
+var takeDeferredAndroidSyncs = redis.NewScript(2, `
+-- KEYS: [DeferredKey, TokensKey] ARGV: [NowMS]
+local uuids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if #uuids == 0 then
+	return {}
+end
+
+local tokens = redis.call("HMGET", KEYS[2], unpack(uuids))
+redis.call("ZREM", KEYS[1], unpack(uuids))
+redis.call("HDEL", KEYS[2], unpack(uuids))
+
+local syncs = {}
+for i, uuid in ipairs(uuids) do
+	table.insert(syncs, uuid)
+	table.insert(syncs, tokens[i] or "")
+end
+return syncs
+`)
+
 // CreateFCMClient creates an FCM client based on the configured FCM API key
 func CreateFCMClient(cfg *config.Config) *fcm.Client {
 	if cfg.FCMKey == "" {
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/utils"
@@ -63,8 +64,11 @@ func newMockFCMEndpoint(tokens ...string) *MockFCMEndpoint {
 }
 
 func TestSyncAndroidChannels(t *testing.T) {
-	ctx := testsuite.CTX()
-	db := testsuite.DB()
+	ctx, db, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
 
 	mockFCM := newMockFCMEndpoint("FCMID3")
 	defer mockFCM.Stop()
@@ -83,7 +87,7 @@ func TestSyncAndroidChannels(t *testing.T) {
 	channel2 := oa.ChannelByID(testChannel2.ID)
 	channel3 := oa.ChannelByID(testChannel3.ID)
 
-	msgio.SyncAndroidChannels(fc, []*models.Channel{channel1, channel2, channel3})
+	msgio.SyncAndroidChannels(rc, fc, []*models.Channel{channel1, channel2, channel3})
 
 	// check that we try to sync the 2 channels with FCM IDs, even tho one fails
 	assert.Equal(t, 2, len(mockFCM.Messages))
@@ -93,6 +97,32 @@ func TestSyncAndroidChannels(t *testing.T) {
 	assert.Equal(t, "high", mockFCM.Messages[0].Priority)
 	assert.Equal(t, "sync", mockFCM.Messages[0].CollapseKey)
 	assert.Equal(t, map[string]interface{}{"msg": "sync"}, mockFCM.Messages[0].Data)
+
+	mockFCM.Messages = nil
+
+	// syncing again within the sync interval defers the syncs, and syncing a third time doesn't add to them
+	msgio.SyncAndroidChannels(rc, fc, []*models.Channel{channel1, channel2, channel3})
+	msgio.SyncAndroidChannels(rc, fc, []*models.Channel{channel2, channel3})
+
+	assert.Equal(t, 0, len(mockFCM.Messages))
+
+	// deferred syncs aren't due yet
+	count, err := msgio.SyncDeferredAndroidChannels(rc, fc, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 0, len(mockFCM.Messages))
+
+	// but once the interval has passed, each channel is synced once
+	count, err = msgio.SyncDeferredAndroidChannels(rc, fc, time.Now().Add(time.Second*6))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, len(mockFCM.Messages))
+	assert.ElementsMatch(t, []string{"FCMID2", "FCMID3"}, []string{mockFCM.Messages[0].Token, mockFCM.Messages[1].Token})
+
+	// and they're no longer deferred
+	count, err = msgio.SyncDeferredAndroidChannels(rc, fc, time.Now().Add(time.Second*6))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
 }
 
 func TestCreateFCMClient(t *testing.T) {
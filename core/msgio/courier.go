@@ -2,11 +2,13 @@ package msgio
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/utils/redisutil"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
@@ -18,48 +20,99 @@ const (
 	defaultPriority = 0
 )
 
+// a batch of messages for a single contact which are queued to courier as one item
+type courierBatch struct {
+	contactID models.ContactID
+	channel   *models.Channel
+	priority  int
+	msgs      []*models.Msg
+}
+
 // QueueCourierMessages queues messages for a single contact to Courier
 func QueueCourierMessages(rc redis.Conn, contactID models.ContactID, msgs []*models.Msg) error {
-	if len(msgs) == 0 {
-		return nil
+	return QueueAllCourierMessages(rc, map[models.ContactID][]*models.Msg{contactID: msgs})[contactID]
+}
+
+// QueueAllCourierMessages queues the messages of many contacts to Courier. Each contact's messages are batched by
+// channel and priority, and all batches are pipelined so that they're queued in a single round trip. It returns the
+// errors of any contacts whose messages couldn't be queued.
+func QueueAllCourierMessages(rc redis.Conn, msgsByContact map[models.ContactID][]*models.Msg) map[models.ContactID]error {
+	errs := make(map[models.ContactID]error)
+	batches := make([]*courierBatch, 0, len(msgsByContact))
+
+	for contactID, msgs := range msgsByContact {
+		contactBatches, err := batchCourierMessages(contactID, msgs)
+		if err != nil {
+			errs[contactID] = err
+			continue
+		}
+		batches = append(batches, contactBatches...)
+	}
+
+	if len(batches) == 0 {
+		return errs
 	}
 
 	now := time.Now()
 	epochMS := strconv.FormatFloat(float64(now.UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
 
-	priority := defaultPriority
-
-	// we batch msgs by channel uuid
-	batch := make([]*models.Msg, 0, len(msgs))
-	currentChannel := msgs[0].Channel()
-
-	// commits our batch to redis
-	commitBatch := func() error {
-		if len(batch) > 0 {
-			priority = defaultPriority
-			if batch[0].HighPriority() {
-				priority = highPriority
-			}
-
-			batchJSON, err := json.Marshal(batch)
-			if err != nil {
-				return err
-			}
-			start := time.Now()
-			_, err = queueMsg.Do(rc, epochMS, "msgs", currentChannel.UUID(), currentChannel.TPS(), priority, batchJSON)
-			if err != nil {
-				return err
-			}
-			logrus.WithFields(logrus.Fields{
-				"msgs":         len(batch),
-				"contact_id":   contactID,
-				"channel_uuid": currentChannel.UUID(),
-				"elapsed":      time.Since(start),
-			}).Info("msgs queued to courier")
+	// if we can't even send our commands, none of the messages were queued
+	failAll := func(err error) map[models.ContactID]error {
+		for _, batch := range batches {
+			errs[batch.contactID] = err
+		}
+		return errs
+	}
+
+	sent := make([]*courierBatch, 0, len(batches))
+	for _, batch := range batches {
+		batchJSON, err := json.Marshal(batch.msgs)
+		if err != nil {
+			errs[batch.contactID] = err
+			continue
 		}
-		return nil
+		if err := queueMsg.Send(rc, queueMsgArgs(now, epochMS, batch.channel, batch.priority, batchJSON)...); err != nil {
+			return failAll(err)
+		}
+		sent = append(sent, batch)
 	}
 
+	if err := rc.Flush(); err != nil {
+		return failAll(err)
+	}
+
+	// read the reply to each batch, and tally what was queued to each channel
+	queuedByChannel := make(map[*models.Channel]int)
+	contactsByChannel := make(map[*models.Channel]map[models.ContactID]bool)
+	for _, batch := range sent {
+		if _, err := rc.Receive(); err != nil {
+			errs[batch.contactID] = err
+			continue
+		}
+		queuedByChannel[batch.channel] += len(batch.msgs)
+		if contactsByChannel[batch.channel] == nil {
+			contactsByChannel[batch.channel] = make(map[models.ContactID]bool)
+		}
+		contactsByChannel[batch.channel][batch.contactID] = true
+	}
+
+	for channel, count := range queuedByChannel {
+		logrus.WithFields(logrus.Fields{
+			"msgs":         count,
+			"contacts":     len(contactsByChannel[channel]),
+			"channel_uuid": channel.UUID(),
+			"elapsed":      time.Since(now),
+		}).Info("msgs queued to courier")
+	}
+
+	return errs
+}
+
+// batches the messages of a single contact by channel and priority, keeping them in order
+func batchCourierMessages(contactID models.ContactID, msgs []*models.Msg) ([]*courierBatch, error) {
+	batches := make([]*courierBatch, 0, 1)
+	var batch *courierBatch
+
 	for _, msg := range msgs {
 		// android messages should never get in here
 		if msg.Channel() != nil && msg.Channel().Type() == models.ChannelTypeAndroid {
@@ -73,57 +126,72 @@ func QueueCourierMessages(rc redis.Conn, contactID models.ContactID, msgs []*mod
 
 		// nil channel object but have channel UUID? that's an error
 		if msg.Channel() == nil {
-			return errors.Errorf("msg passed in without channel set")
+			return nil, errors.Errorf("msg passed in without channel set")
 		}
 
 		// no contact urn id or urn, also an error
 		if msg.URN() == urns.NilURN || msg.ContactURNID() == nil {
-			return errors.Errorf("msg passed with nil urn: %s", msg.URN())
+			return nil, errors.Errorf("msg passed with nil urn: %s", msg.URN())
 		}
 
-		// same channel? add to batch
-		if msg.Channel() == currentChannel {
-			batch = append(batch, msg)
+		priority := defaultPriority
+		if msg.HighPriority() {
+			priority = highPriority
 		}
 
-		// different channel? queue it up
-		if msg.Channel() != currentChannel {
-			err := commitBatch()
-			if err != nil {
-				return err
-			}
-
-			currentChannel = msg.Channel()
-			batch = []*models.Msg{msg}
+		// same channel and priority? add to batch, otherwise start a new one
+		if batch != nil && msg.Channel() == batch.channel && priority == batch.priority {
+			batch.msgs = append(batch.msgs, msg)
+			continue
 		}
+
+		batch = &courierBatch{contactID: contactID, channel: msg.Channel(), priority: priority, msgs: []*models.Msg{msg}}
+		batches = append(batches, batch)
 	}
 
-	// any remaining in our batch, queue it up
-	return commitBatch()
+	return batches, nil
 }
 
-var queueMsg = redis.NewScript(6, `
--- KEYS: [EpochMS, QueueType, QueueName, TPS, Priority, Value]
+// the keys of courier's queues, which are all prefixed with its hash tag if we're using them so that they're in the same
+// slot of a redis cluster
+const (
+	courierQueuePattern         = "%s:%s|%d"
+	courierPriorityQueuePattern = "%s/%d"
+	courierTPSPattern           = "%s:tps:%d"
+	courierActivePattern        = "%s:active"
+)
+
+// returns the keys and args of queueMsg to queue the passed in batch of msgs to the passed in channel
+func queueMsgArgs(now time.Time, epochMS string, channel *models.Channel, priority int, batchJSON []byte) []interface{} {
+	prefix := redisutil.HashTag("msgs")
+
+	// our queue name is built from the type, name and tps, usually something like: "msgs:uuid1-uuid2-uuid3-uuid4|tps"
+	queueKey := fmt.Sprintf(courierQueuePattern, prefix, channel.UUID(), channel.TPS())
+
+	return []interface{}{
+		fmt.Sprintf(courierPriorityQueuePattern, queueKey, priority),
+		fmt.Sprintf(courierTPSPattern, queueKey, now.Unix()),
+		fmt.Sprintf(courierActivePattern, prefix),
+		epochMS, queueKey, channel.TPS(), batchJSON,
+	}
+}
 
--- first push onto our specific queue
--- our queue name is built from the type, name and tps, usually something like: "msgs:uuid1-uuid2-uuid3-uuid4|tps"
-local queueKey = KEYS[2] .. ":" .. KEYS[3] .. "|" .. KEYS[4]
+var queueMsg = redis.NewScript(3, `
+-- KEYS: [PriorityQueueKey, TPSKey, ActiveKey] ARGV: [EpochMS, QueueKey, TPS, Value]
 
--- our priority queue name also includes the priority of the message (we have one queue for default and one for bulk)
-local priorityQueueKey = queueKey .. "/" .. KEYS[5]
-redis.call("zadd", priorityQueueKey, KEYS[1], KEYS[6])
-local tps = tonumber(KEYS[4])
+-- first push onto our priority queue (we have one queue for default and one for bulk)
+redis.call("zadd", KEYS[1], ARGV[1], ARGV[4])
+local tps = tonumber(ARGV[3])
 
 -- if we have a TPS, check whether we are currently throttled
 local curr = -1
 if tps > 0 then
-  local tpsKey = queueKey .. ":tps:" .. math.floor(KEYS[1])
-  curr = tonumber(redis.call("get", tpsKey))
+  curr = tonumber(redis.call("get", KEYS[2]))
 end
 
 -- if we aren't then add to our active
 if not curr or curr < tps then
-redis.call("zincrby", KEYS[2] .. ":active", 0, queueKey)
+redis.call("zincrby", KEYS[3], 0, ARGV[2])
   return 1
 else
   return 0
@@ -1,13 +1,18 @@
 package msgio_test
 
 import (
+	"encoding/json"
+	"sort"
 	"testing"
 
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/redisutil"
 
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -102,3 +107,91 @@ func TestQueueCourierMessages(t *testing.T) {
 
 	testsuite.Reset()
 }
+
+func TestQueueAllCourierMessages(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg|models.RefreshChannels)
+	require.NoError(t, err)
+
+	createMsgs := func(specs ...msgSpec) []*models.Msg {
+		msgs := make([]*models.Msg, len(specs))
+		for i := range specs {
+			msgs[i] = specs[i].createMsg(t, db, oa)
+		}
+		return msgs
+	}
+
+	cathyTwilio := msgSpec{ChannelID: testdata.TwilioChannel.ID, ContactID: testdata.Cathy.ID, URNID: testdata.Cathy.URNID}
+	cathyVonage := msgSpec{ChannelID: testdata.VonageChannel.ID, ContactID: testdata.Cathy.ID, URNID: testdata.Cathy.URNID}
+	bobTwilio := msgSpec{ChannelID: testdata.TwilioChannel.ID, ContactID: testdata.Bob.ID, URNID: testdata.Bob.URNID}
+	georgeFailed := msgSpec{ChannelID: testdata.TwilioChannel.ID, ContactID: testdata.George.ID, URNID: testdata.George.URNID, Failed: true}
+
+	rc.Do("FLUSHDB")
+
+	errs := msgio.QueueAllCourierMessages(rc, map[models.ContactID][]*models.Msg{
+		testdata.Cathy.ID:  createMsgs(cathyTwilio, cathyTwilio, cathyVonage, cathyTwilio),
+		testdata.Bob.ID:    createMsgs(bobTwilio),
+		testdata.George.ID: createMsgs(georgeFailed),
+	})
+	assert.Equal(t, map[models.ContactID]error{}, errs)
+
+	// batches queued at the same time have the same score so we compare their sizes in order of size
+	batchSizes := func(queueKey string) []int {
+		batches, err := redis.Strings(rc.Do("ZRANGE", queueKey, 0, -1))
+		require.NoError(t, err)
+
+		sizes := make([]int, len(batches))
+		for i, batch := range batches {
+			var msgs []json.RawMessage
+			require.NoError(t, json.Unmarshal([]byte(batch), &msgs))
+			sizes[i] = len(msgs)
+		}
+		sort.Ints(sizes)
+		return sizes
+	}
+
+	// each contact's messages are batched by channel, and in order, so cathy's last message is its own batch
+	assert.Equal(t, []int{1, 1, 2}, batchSizes("msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0"))
+	assert.Equal(t, []int{1}, batchSizes("msgs:19012bfd-3ce3-4cae-9bb9-76cf92c73d49|10/0"))
+
+	// queueing nothing is a noop
+	assert.Equal(t, map[models.ContactID]error{}, msgio.QueueAllCourierMessages(rc, map[models.ContactID][]*models.Msg{}))
+}
+
+func TestQueueCourierMessagesWithHashTags(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	redisutil.UseHashTags(true)
+	defer redisutil.UseHashTags(false)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg|models.RefreshChannels)
+	require.NoError(t, err)
+
+	ms := msgSpec{ChannelID: testdata.TwilioChannel.ID, ContactID: testdata.Cathy.ID, URNID: testdata.Cathy.URNID}
+	msg := ms.createMsg(t, db, oa)
+
+	rc.Do("FLUSHDB")
+	err = msgio.QueueCourierMessages(rc, testdata.Cathy.ID, []*models.Msg{msg})
+	require.NoError(t, err)
+
+	// all of courier's keys have the same hash tag so they're in the same slot of a redis cluster
+	queueKey := "{msgs}:74729f45-7f29-4868-9dc4-90e491e3c7d8|10"
+	assert.Equal(t, redisc.Slot("{msgs}:active"), redisc.Slot(queueKey+"/0"))
+
+	count, err := redis.Int(rc.Do("ZCARD", queueKey+"/0"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	active, err := redis.Strings(rc.Do("ZRANGE", "{msgs}:active", 0, -1))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{queueKey}, active)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/edganiukov/fcm"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
 
@@ -23,8 +24,20 @@ func SendMessages(ctx context.Context, db models.Queryer, rp *redis.Pool, fc *fc
 	// messages that need to be marked as pending
 	pending := make([]*models.Msg, 0, 1)
 
+	now := dates.Now()
+
 	// walk through our messages, separate by whether they have a channel and if it's Android
 	for _, msg := range msgs {
+		// sandbox messages to test contacts are never sent, nor are messages which have already failed
+		if msg.IsSandbox() || msg.Status() == models.MsgStatusFailed {
+			continue
+		}
+
+		// messages delayed by channel warm-ups are queued by the warmup cron once they can be sent
+		if msg.Status() == models.MsgStatusQueued && msg.NextAttempt() != nil && msg.NextAttempt().After(now) {
+			continue
+		}
+
 		channel := msg.Channel()
 		if channel != nil {
 			if channel.Type() == models.ChannelTypeAndroid {
@@ -45,17 +58,15 @@ func SendMessages(ctx context.Context, db models.Queryer, rp *redis.Pool, fc *fc
 		rc := rp.Get()
 		defer rc.Close()
 
-		for contactID, contactMsgs := range courierMsgs {
-			err := QueueCourierMessages(rc, contactID, contactMsgs)
+		for contactID, err := range QueueAllCourierMessages(rc, courierMsgs) {
+			contactMsgs := courierMsgs[contactID]
 
 			// not being able to queue a message isn't the end of the world, log but don't return an error
-			if err != nil {
-				log.WithField("messages", contactMsgs).WithField("contact", contactID).WithError(err).Error("error queuing messages")
+			log.WithField("messages", contactMsgs).WithField("contact", contactID).WithError(err).Error("error queuing messages")
 
-				// in the case of errors we do want to change the messages back to pending however so they
-				// get queued later. (for the common case messages are only inserted and queued, without a status update)
-				pending = append(pending, contactMsgs...)
-			}
+			// in the case of errors we do want to change the messages back to pending however so they
+			// get queued later. (for the common case messages are only inserted and queued, without a status update)
+			pending = append(pending, contactMsgs...)
 		}
 	}
 
@@ -64,7 +75,11 @@ func SendMessages(ctx context.Context, db models.Queryer, rp *redis.Pool, fc *fc
 		if fc == nil {
 			fc = CreateFCMClient(config.Mailroom)
 		}
-		SyncAndroidChannels(fc, androidChannels)
+
+		rc := rp.Get()
+		defer rc.Close()
+
+		SyncAndroidChannels(rc, fc, androidChannels)
 	}
 
 	// any messages that didn't get sent should be moved back to pending (they are queued at creation to save an
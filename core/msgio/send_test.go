@@ -8,6 +8,7 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 	"github.com/nyaruka/mailroom/testsuite"
@@ -23,6 +24,7 @@ type msgSpec struct {
 	ContactID models.ContactID
 	URNID     models.URNID
 	Failed    bool
+	Sandbox   bool
 }
 
 func (m *msgSpec) createMsg(t *testing.T, db *sqlx.DB, oa *models.OrgAssets) *models.Msg {
@@ -46,6 +48,12 @@ func (m *msgSpec) createMsg(t *testing.T, db *sqlx.DB, oa *models.OrgAssets) *mo
 	msg, err := models.NewOutgoingMsg(oaOrg.Org(), channel, m.ContactID, flowMsg, time.Now())
 	require.NoError(t, err)
 
+	if m.Sandbox {
+		msg.SetSandbox()
+		require.Equal(t, models.MsgStatusFailed, msg.Status())
+		require.Equal(t, models.MsgFailedSandbox, msg.FailedReason())
+	}
+
 	models.InsertMessages(ctx, db, []*models.Msg{msg})
 	require.NoError(t, err)
 
@@ -59,6 +67,10 @@ func TestSendMessages(t *testing.T) {
 	rc := rp.Get()
 	defer rc.Close()
 
+	// cases sync the same channels so we don't want syncs to be rate limited
+	config.Mailroom.AndroidSyncInterval = 0
+	defer func() { config.Mailroom.AndroidSyncInterval = 5 }()
+
 	mockFCM := newMockFCMEndpoint("FCMID3")
 	defer mockFCM.Stop()
 
@@ -140,6 +152,26 @@ func TestSendMessages(t *testing.T) {
 			FCMTokensSynced: []string{},
 			PendingMsgs:     1,
 		},
+		{
+			Description: "sandbox messages never sent",
+			Msgs: []msgSpec{
+				{
+					ChannelID: testdata.TwilioChannel.ID,
+					ContactID: testdata.Cathy.ID,
+					URNID:     testdata.Cathy.URNID,
+					Sandbox:   true,
+				},
+				{
+					ChannelID: androidChannel1.ID,
+					ContactID: testdata.Bob.ID,
+					URNID:     testdata.Bob.URNID,
+					Sandbox:   true,
+				},
+			},
+			QueueSizes:      map[string][]int{},
+			FCMTokensSynced: []string{},
+			PendingMsgs:     1, // still just the pending message from the previous case
+		},
 	}
 
 	for _, tc := range tests {
@@ -166,3 +198,22 @@ func TestSendMessages(t *testing.T) {
 		testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE status = 'P'`, nil, tc.PendingMsgs, `pending messages mismatch in '%s'`, tc.Description)
 	}
 }
+
+func TestSendMessagesLeavesFailed(t *testing.T) {
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+	rp := testsuite.RP()
+
+	defer testsuite.ResetDB()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	// a message which mailroom failed because it had no channel shouldn't be moved back to pending
+	spec := msgSpec{ChannelID: models.NilChannelID, ContactID: testdata.Cathy.ID, URNID: testdata.Cathy.URNID, Failed: true}
+	msg := spec.createMsg(t, db, oa)
+
+	msgio.SendMessages(ctx, db, rp, nil, []*models.Msg{msg})
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'F'`, []interface{}{msg.ID()}, 1)
+}
@@ -0,0 +1,105 @@
+package msgio
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// how long after queuing a typing indication for a contact before we'll queue another
+const typingThrottle = time.Second * 10
+
+const typingKey = "typing_indicator:%d"
+
+// Typing is a typing indication queued to courier in place of a message
+type Typing struct {
+	UUID         uuids.UUID       `json:"uuid"`
+	Type         string           `json:"type"`
+	OrgID        models.OrgID     `json:"org_id"`
+	ChannelID    models.ChannelID `json:"channel_id"`
+	ChannelUUID  string           `json:"channel_uuid"`
+	ContactID    models.ContactID `json:"contact_id"`
+	ContactURNID models.URNID     `json:"contact_urn_id"`
+	URN          urns.URN         `json:"urn"`
+	HighPriority bool             `json:"high_priority"`
+	CreatedOn    time.Time        `json:"created_on"`
+}
+
+// QueueCourierTyping queues a typing-on indication to courier for the given contact URN if the channel supports it
+// and we haven't recently queued one for the same contact. Returns whether an indication was queued.
+func QueueCourierTyping(rc redis.Conn, orgID models.OrgID, channel *models.Channel, contactID models.ContactID, urn urns.URN) (bool, error) {
+	if !channel.SupportsTyping() || channel.Type() == models.ChannelTypeAndroid {
+		return false, nil
+	}
+
+	urnID := models.GetURNID(urn)
+	if urnID == models.NilURNID {
+		return false, errors.Errorf("can't queue typing indication for urn without id: %s", urn)
+	}
+
+	// typing indications are best effort so only send one every so often per contact
+	set, err := redis.String(rc.Do("SET", fmt.Sprintf(typingKey, contactID), "1", "PX", typingThrottle.Milliseconds(), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil || set != "OK" {
+		return false, errors.Wrapf(err, "error setting typing indicator throttle key")
+	}
+
+	now := time.Now()
+	epochMS := strconv.FormatFloat(float64(now.UnixNano()/int64(time.Microsecond))/float64(1000000), 'f', 6, 64)
+
+	typing := &Typing{
+		UUID:         uuids.New(),
+		Type:         "typing",
+		OrgID:        orgID,
+		ChannelID:    channel.ID(),
+		ChannelUUID:  string(channel.UUID()),
+		ContactID:    contactID,
+		ContactURNID: urnID,
+		URN:          urn,
+		HighPriority: true,
+		CreatedOn:    now,
+	}
+
+	batchJSON, err := json.Marshal([]*Typing{typing})
+	if err != nil {
+		return false, errors.Wrapf(err, "error marshalling typing indication")
+	}
+
+	if _, err := queueMsg.Do(rc, epochMS, "msgs", channel.UUID(), channel.TPS(), highPriority, batchJSON); err != nil {
+		return false, errors.Wrapf(err, "error queuing typing indication")
+	}
+
+	logrus.WithFields(logrus.Fields{"contact_id": contactID, "channel_uuid": channel.UUID()}).Debug("typing indication queued to courier")
+
+	return true, nil
+}
+
+// QueueSessionTyping queues a typing indication for the contact in the given session, if it's a messaging session and
+// the channel of the contact's preferred URN supports typing indicators
+func QueueSessionTyping(rc redis.Conn, session flows.Session) (bool, error) {
+	if session.Type() != flows.FlowTypeMessaging || session.Contact() == nil {
+		return false, nil
+	}
+
+	urn := session.Contact().PreferredURN()
+	if urn == nil || urn.Channel() == nil {
+		return false, nil
+	}
+
+	oa := session.Assets().Source().(*models.OrgAssets)
+	channel := urn.Channel().Asset().(*models.Channel)
+
+	return QueueCourierTyping(rc, oa.OrgID(), channel, models.ContactID(session.Contact().ID()), urn.URN())
+}
@@ -0,0 +1,58 @@
+package msgio_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueCourierTyping(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	// enable typing indicators on the twilio channel only
+	db.MustExec(`UPDATE channels_channel SET config = '{"typing_indicators": true}' WHERE id = $1`, testdata.TwilioChannel.ID)
+	models.FlushCache()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+	assert.True(t, twilio.SupportsTyping())
+	assert.False(t, vonage.SupportsTyping())
+
+	cathyURN := urns.URN(fmt.Sprintf("%s?id=%d", testdata.Cathy.URN, testdata.Cathy.URNID))
+
+	// channel without typing indicators enabled doesn't get one
+	queued, err := msgio.QueueCourierTyping(rc, testdata.Org1.ID, vonage, testdata.Cathy.ID, cathyURN)
+	assert.NoError(t, err)
+	assert.False(t, queued)
+
+	// urn must have an id
+	_, err = msgio.QueueCourierTyping(rc, testdata.Org1.ID, twilio, testdata.Cathy.ID, testdata.Cathy.URN)
+	assert.EqualError(t, err, "can't queue typing indication for urn without id: tel:+16055741111")
+
+	queued, err = msgio.QueueCourierTyping(rc, testdata.Org1.ID, twilio, testdata.Cathy.ID, cathyURN)
+	assert.NoError(t, err)
+	assert.True(t, queued)
+
+	// but not again for the same contact straight away
+	queued, err = msgio.QueueCourierTyping(rc, testdata.Org1.ID, twilio, testdata.Cathy.ID, cathyURN)
+	assert.NoError(t, err)
+	assert.False(t, queued)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{
+		"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/1": {1},
+	})
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nyaruka/gocommon/uuids"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Each org has a sorted set per queue of the tasks currently being executed for it, scored by when they started, so
+// that we can see what an org's workers are busy with
+
+const executingPattern = "%s:executing:%d"
+
+// executing tasks which started longer ago than this are assumed to belong to an instance which died
+const executingExpiry = time.Hour * 24
+
+// the maximum number of queued tasks we'll inspect when summarizing an org's queue
+const maxInspectedTasks = 1000
+
+// ExecutingTask is a task which a worker is currently executing
+type ExecutingTask struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Host      string    `json:"host,omitempty"`
+	QueuedOn  time.Time `json:"queued_on"`
+	StartedOn time.Time `json:"started_on"`
+}
+
+// StartExecuting records that the passed in task has started executing, returning a token to be passed to
+// StopExecuting once it has finished
+func StartExecuting(rc redis.Conn, queue string, task *Task, host string, now time.Time) (string, error) {
+	executing := &ExecutingTask{ID: string(uuids.New()), Type: task.Type, Host: host, QueuedOn: task.QueuedOn, StartedOn: now}
+	member, err := json.Marshal(executing)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf(executingPattern, queueKey(queue), task.OrgID)
+
+	rc.Send("zadd", key, now.Unix(), member)
+	rc.Send("zremrangebyscore", key, "-inf", now.Add(-executingExpiry).Unix())
+	rc.Send("expire", key, int(executingExpiry/time.Second))
+	_, err = rc.Do("")
+	return string(member), errors.Wrapf(err, "error recording executing task")
+}
+
+// StopExecuting records that the task with the passed in token has finished executing
+func StopExecuting(rc redis.Conn, queue string, orgID int, token string) error {
+	_, err := rc.Do("zrem", fmt.Sprintf(executingPattern, queueKey(queue), orgID), token)
+	return errors.Wrapf(err, "error removing executing task")
+}
+
+// OrgQueue is a summary of an org's tasks in a queue
+type OrgQueue struct {
+	Size      int              `json:"size"`
+	Types     map[string]int   `json:"types"`
+	Oldest    *time.Time       `json:"oldest_queued_on"`
+	Busy      int              `json:"busy"`
+	Executing []*ExecutingTask `json:"executing"`
+}
+
+// InspectOrgQueue summarizes the tasks queued and executing for the passed in org in the given queue. Only the next
+// 1000 queued tasks are inspected for their types and age.
+func InspectOrgQueue(rc redis.Conn, queue string, orgID int, now time.Time) (*OrgQueue, error) {
+	orgQueueKey := fmt.Sprintf(queuePattern, queueKey(queue), orgID)
+	executingKey := fmt.Sprintf(executingPattern, queueKey(queue), orgID)
+
+	rc.Send("zcard", orgQueueKey)
+	rc.Send("zrange", orgQueueKey, 0, maxInspectedTasks-1)
+	rc.Send("zscore", fmt.Sprintf(activePattern, queueKey(queue)), orgID)
+	rc.Send("zrangebyscore", executingKey, now.Add(-executingExpiry).Unix(), "+inf")
+	values, err := redis.Values(rc.Do(""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error inspecting %s queue for org %d", queue, orgID)
+	}
+
+	size, _ := redis.Int(values[0], nil)
+	queued, _ := redis.ByteSlices(values[1], nil)
+	busy, _ := redis.Int(values[2], nil)
+	executing, _ := redis.ByteSlices(values[3], nil)
+
+	summary := &OrgQueue{Size: size, Types: make(map[string]int), Busy: busy, Executing: make([]*ExecutingTask, 0, len(executing))}
+
+	for _, payload := range queued {
+		task := &Task{}
+		if err := json.Unmarshal(payload, task); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling queued task")
+		}
+		summary.Types[task.Type]++
+
+		if summary.Oldest == nil || task.QueuedOn.Before(*summary.Oldest) {
+			queuedOn := task.QueuedOn
+			summary.Oldest = &queuedOn
+		}
+	}
+
+	for _, payload := range executing {
+		task := &ExecutingTask{}
+		if err := json.Unmarshal(payload, task); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling executing task")
+		}
+		summary.Executing = append(summary.Executing, task)
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/nyaruka/mailroom/utils/redisutil"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Orgs can be put into maintenance, e.g. while their data is being migrated, during which their tasks are parked
+// rather than handled. Parked tasks keep their original scores so they're handled in the same order once they're
+// requeued, which happens when the org leaves maintenance.
+
+const (
+	maintenanceKey = "org_maintenance"
+	parkedPattern  = "parked_tasks:%s:%d"
+)
+
+// the queues whose tasks can be parked
+var parkableQueues = []string{BatchQueue, HandlerQueue}
+
+// returns the key of the set of orgs in maintenance which is checked when popping tasks from the passed in queue. When
+// keys are hash tagged each queue has its own copy of the set in the same slot as its other keys.
+func maintenanceKeyFor(queue string) string {
+	if redisutil.UsingHashTags() {
+		return queueKey(queue) + ":" + maintenanceKey
+	}
+	return maintenanceKey
+}
+
+// returns all the keys of the sets of orgs in maintenance which need to be kept up to date
+func maintenanceKeys() []string {
+	keys := []string{maintenanceKey}
+	if redisutil.UsingHashTags() {
+		for _, queue := range parkableQueues {
+			keys = append(keys, maintenanceKeyFor(queue))
+		}
+	}
+	return keys
+}
+
+// StartMaintenance puts the passed in org into maintenance
+func StartMaintenance(rc redis.Conn, orgID int) error {
+	for _, key := range maintenanceKeys() {
+		if _, err := rc.Do("sadd", key, orgID); err != nil {
+			return errors.Wrapf(err, "error starting maintenance for org %d", orgID)
+		}
+	}
+	return nil
+}
+
+// EndMaintenance takes the passed in org out of maintenance and requeues its parked tasks, returning how many were
+// requeued
+func EndMaintenance(rc redis.Conn, orgID int) (int, error) {
+	for _, key := range maintenanceKeys() {
+		if _, err := rc.Do("srem", key, orgID); err != nil {
+			return 0, errors.Wrapf(err, "error ending maintenance for org %d", orgID)
+		}
+	}
+	return RequeueParkedTasks(rc, orgID)
+}
+
+// InMaintenance returns whether the passed in org is in maintenance
+func InMaintenance(rc redis.Conn, orgID int) (bool, error) {
+	return redis.Bool(rc.Do("sismember", maintenanceKey, orgID))
+}
+
+// MaintenanceOrgs returns the ids of all orgs currently in maintenance
+func MaintenanceOrgs(rc redis.Conn) ([]int, error) {
+	orgIDs, err := redis.Ints(rc.Do("smembers", maintenanceKey))
+	return orgIDs, errors.Wrapf(err, "error getting orgs in maintenance")
+}
+
+// ParkedTasks returns up to limit of the passed in org's parked tasks in the given queue, in the order they'll be
+// handled, as well as the total number parked
+func ParkedTasks(rc redis.Conn, queue string, orgID int, limit int) ([]*Task, int, error) {
+	key := fmt.Sprintf(parkedPattern, queueKey(queue), orgID)
+
+	rc.Send("zcard", key)
+	rc.Send("zrange", key, 0, limit-1)
+	values, err := redis.Values(rc.Do(""))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "error getting parked tasks for org %d", orgID)
+	}
+
+	total, _ := redis.Int(values[0], nil)
+	payloads, _ := redis.ByteSlices(values[1], nil)
+
+	tasks := make([]*Task, len(payloads))
+	for i, payload := range payloads {
+		tasks[i] = &Task{}
+		if err := json.Unmarshal(payload, tasks[i]); err != nil {
+			return nil, 0, errors.Wrapf(err, "error unmarshalling parked task")
+		}
+	}
+	return tasks, total, nil
+}
+
+var requeueParked = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [OrgID]
+	local parked = "parked_tasks:" .. KEYS[1] .. ":" .. ARGV[1]
+	local count = redis.call("zcard", parked)
+
+	if count > 0 then
+		local queue = KEYS[1] .. ":" .. ARGV[1]
+		redis.call("zunionstore", queue, 2, queue, parked, "AGGREGATE", "MIN")
+		redis.call("del", parked)
+		redis.call("zincrby", KEYS[1] .. ":active", 0, ARGV[1])
+	end
+
+	return count
+`)
+
+// RequeueParkedTasks moves all the parked tasks of the passed in org back onto their queues, returning how many were
+// requeued. If the org is still in maintenance they'll just be parked again.
+func RequeueParkedTasks(rc redis.Conn, orgID int) (int, error) {
+	total := 0
+	for _, queue := range parkableQueues {
+		count, err := redis.Int(requeueParked.Do(rc, queueKey(queue), strconv.Itoa(orgID)))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error requeuing parked %s tasks for org %d", queue, orgID)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// DiscardParkedTasks deletes all the parked tasks of the passed in org, returning how many were discarded
+func DiscardParkedTasks(rc redis.Conn, orgID int) (int, error) {
+	total := 0
+	for _, queue := range parkableQueues {
+		key := fmt.Sprintf(parkedPattern, queueKey(queue), orgID)
+
+		rc.Send("multi")
+		rc.Send("zcard", key)
+		rc.Send("del", key)
+		values, err := redis.Values(rc.Do("exec"))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error discarding parked %s tasks for org %d", queue, orgID)
+		}
+		count, _ := redis.Int(values[0], nil)
+		total += count
+	}
+	return total, nil
+}
@@ -1,11 +1,16 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/nyaruka/mailroom/utils/redisutil"
+	"github.com/nyaruka/mailroom/utils/tracing"
+
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
 )
@@ -17,14 +22,67 @@ type Task struct {
 	Task       json.RawMessage `json:"task"`
 	QueuedOn   time.Time       `json:"queued_on"`
 	ErrorCount int             `json:"error_count,omitempty"`
+	Version    int             `json:"version,omitempty"`
+
+	// how many times this task has been requeued because it couldn't be handled yet, and when it was first requeued
+	Requeues        int        `json:"requeues,omitempty"`
+	FirstRequeuedOn *time.Time `json:"first_requeued_on,omitempty"`
+
+	// the W3C trace context of whatever queued this task, e.g. {"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// SchemaVersion returns the schema version of this task's payload, unversioned payloads being version 1
+func (t *Task) SchemaVersion() int {
+	if t.Version == 0 {
+		return 1
+	}
+	return t.Version
 }
 
+// the current schema versions of task types which have changed since their first version
+var taskVersions = map[string]int{}
+
+// SetTaskVersion sets the current schema version of payloads of the given task type, which is recorded on tasks of
+// that type as they're queued so that workers know how to decode them
+func SetTaskVersion(taskType string, version int) {
+	if version > 1 {
+		taskVersions[taskType] = version
+	} else {
+		delete(taskVersions, taskType)
+	}
+}
+
+// TaskVersion returns the current schema version of payloads of the given task type
+func TaskVersion(taskType string) int {
+	if version, found := taskVersions[taskType]; found {
+		return version
+	}
+	return 1
+}
+
+// ErrNewerVersion is returned when handling a task whose payload is of a newer schema version than we support, i.e. it
+// was queued by a newer release, in which case it's requeued for a worker that can handle it
+var ErrNewerVersion = errors.New("task payload is of a newer version")
+
 // Priority is the priority for the task
 type Priority int
 
+// returns the prefix of the keys of the passed in queue, which is hash tagged if we're using hash tags so that all the
+// keys of a queue are in the same slot of a redis cluster, as our scripts which operate on several of them require
+func queueKey(queue string) string {
+	return redisutil.HashTag(queue)
+}
+
 const (
-	queuePattern  = "%s:%d"
-	activePattern = "%s:active"
+	queuePattern   = "%s:%d"
+	activePattern  = "%s:active"
+	desiredPattern = "%s:desired_workers"
+	delayedPattern = "%s:delayed"
+	deadPattern    = "%s:dead"
+
+	// tasks handled for each org are counted in a sorted set per day
+	activityPattern = "org_activity:%s"
 
 	// DefaultPriority is the default priority for tasks
 	DefaultPriority = Priority(0)
@@ -63,7 +121,7 @@ const (
 // Size returns the number of tasks for the passed in queue
 func Size(rc redis.Conn, queue string) (int, error) {
 	// get all the active queues
-	queues, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
+	queues, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queueKey(queue)), 0, -1))
 	if err != nil {
 		return 0, errors.Wrapf(err, "error getting active queues for: %s", queue)
 	}
@@ -71,7 +129,7 @@ func Size(rc redis.Conn, queue string) (int, error) {
 	// add up each
 	size := 0
 	for _, q := range queues {
-		count, err := redis.Int(rc.Do("zcard", fmt.Sprintf(queuePattern, queue, q)))
+		count, err := redis.Int(rc.Do("zcard", fmt.Sprintf(queuePattern, queueKey(queue), q)))
 		if err != nil {
 			return 0, errors.Wrapf(err, "error getting size of: %d", q)
 		}
@@ -81,10 +139,71 @@ func Size(rc redis.Conn, queue string) (int, error) {
 	return size, nil
 }
 
+// Busy returns the number of tasks from the passed in queue which are currently being worked on
+func Busy(rc redis.Conn, queue string) (int, error) {
+	active, err := redis.IntMap(rc.Do("zrange", fmt.Sprintf(activePattern, queueKey(queue)), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting active queues for: %s", queue)
+	}
+
+	busy := 0
+	for _, workers := range active {
+		busy += workers
+	}
+	return busy, nil
+}
+
+// Waits returns, for each org with tasks in the passed in queue, how long its next task has been waiting
+func Waits(rc redis.Conn, queue string) (map[int]time.Duration, error) {
+	queues, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queueKey(queue)), 0, -1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting active queues for: %s", queue)
+	}
+
+	waits := make(map[int]time.Duration, len(queues))
+	for _, q := range queues {
+		next, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(queuePattern, queueKey(queue), q), 0, 0))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting next task of: %d", q)
+		}
+		if len(next) == 0 {
+			continue
+		}
+
+		task := &Task{}
+		if err := json.Unmarshal(next[0], task); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling next task of: %d", q)
+		}
+		waits[q] = time.Since(task.QueuedOn)
+	}
+
+	return waits, nil
+}
+
+// SetDesiredWorkers records the number of workers we think the passed in queue needs, it expires if not refreshed
+func SetDesiredWorkers(rc redis.Conn, queue string, workers int) error {
+	_, err := rc.Do("set", fmt.Sprintf(desiredPattern, queueKey(queue)), workers, "EX", 300)
+	return err
+}
+
+// DesiredWorkers returns the last recorded number of workers we think the passed in queue needs, or zero if
+// that isn't known
+func DesiredWorkers(rc redis.Conn, queue string) (int, error) {
+	workers, err := redis.Int(rc.Do("get", fmt.Sprintf(desiredPattern, queueKey(queue))))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return workers, err
+}
+
 // AddTask adds the passed in task to our queue for execution
 func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
-	score := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+	return AddTracedTask(context.Background(), rc, queue, taskType, orgID, task, priority)
+}
 
+// AddTracedTask adds the passed in task to our queue for execution, carrying the trace of the passed in context so that
+// handling the task continues that trace
+func AddTracedTask(ctx context.Context, rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
 	taskBody, err := json.Marshal(task)
 	if err != nil {
 		return err
@@ -95,19 +214,115 @@ func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task inter
 		OrgID:    orgID,
 		Task:     taskBody,
 		QueuedOn: time.Now(),
+		Version:  taskVersions[taskType],
+		Trace:    tracing.Inject(ctx),
+	}
+
+	return pushTask(rc, queue, payload, priority)
+}
+
+const (
+	// how long a requeued task waits before it can be handled again, doubling each time it's requeued up to the maximum
+	requeueDelay    = time.Second * 5
+	requeueMaxDelay = time.Minute * 5
+
+	// RequeueWindow is how long a task can keep being requeued before we give up on it
+	RequeueWindow = time.Hour
+
+	// how many of the tasks we've given up on we keep for each queue
+	maxDeadTasks = 1000
+)
+
+// RequeueTask puts the passed in task back on our queue to be handled again after a delay which backs off with the
+// number of times it has been requeued, and then behind all other tasks of its org. Tasks which have been requeued for
+// longer than RequeueWindow are instead added to the dead tasks of the queue, in which case false is returned.
+func RequeueTask(rc redis.Conn, queue string, task *Task, now time.Time) (bool, error) {
+	if task.FirstRequeuedOn == nil {
+		task.FirstRequeuedOn = &now
+	} else if now.Sub(*task.FirstRequeuedOn) > RequeueWindow {
+		return false, addDeadTask(rc, queue, task)
+	}
+
+	task.Requeues++
+
+	delay := requeueMaxDelay
+	if task.Requeues <= 10 {
+		delay = requeueDelay * time.Duration(1<<(task.Requeues-1))
+		if delay > requeueMaxDelay {
+			delay = requeueMaxDelay
+		}
+	}
+
+	jsonPayload, err := json.Marshal(task)
+	if err != nil {
+		return false, err
 	}
-	jsonPayload, err := json.Marshal(payload)
+
+	// delayed tasks are moved back onto the queue of their org once they're due, when tasks are popped
+	_, err = rc.Do("zadd", fmt.Sprintf(delayedPattern, queueKey(queue)), taskScore(now.Add(delay), DefaultPriority), jsonPayload)
+	return true, err
+}
+
+func addDeadTask(rc redis.Conn, queue string, task *Task) error {
+	jsonPayload, err := json.Marshal(task)
 	if err != nil {
 		return err
 	}
 
-	rc.Send("zadd", fmt.Sprintf(queuePattern, queue, orgID), score, jsonPayload)
-	rc.Send("zincrby", fmt.Sprintf(activePattern, queue), 0, orgID)
+	key := fmt.Sprintf(deadPattern, queueKey(queue))
+	rc.Send("lpush", key, jsonPayload)
+	rc.Send("ltrim", key, 0, maxDeadTasks-1)
 	_, err = rc.Do("")
 	return err
 }
 
-var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
+// DeadTasks returns the most recent tasks of the passed in queue which we gave up on requeuing, most recent first
+func DeadTasks(rc redis.Conn, queue string) ([]*Task, error) {
+	payloads, err := redis.ByteSlices(rc.Do("lrange", fmt.Sprintf(deadPattern, queueKey(queue)), 0, -1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting dead tasks for: %s", queue)
+	}
+
+	tasks := make([]*Task, len(payloads))
+	for i, payload := range payloads {
+		tasks[i] = &Task{}
+		if err := json.Unmarshal(payload, tasks[i]); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling dead task")
+		}
+	}
+	return tasks, nil
+}
+
+// returns the score of a task queued at the passed in time with the passed in priority
+func taskScore(t time.Time, priority Priority) string {
+	return strconv.FormatFloat(float64(t.UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+}
+
+func pushTask(rc redis.Conn, queue string, task *Task, priority Priority) error {
+	score := taskScore(time.Now(), priority)
+
+	jsonPayload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	rc.Send("zadd", fmt.Sprintf(queuePattern, queueKey(queue), task.OrgID), score, jsonPayload)
+	rc.Send("zincrby", fmt.Sprintf(activePattern, queueKey(queue)), 0, task.OrgID)
+	_, err = rc.Do("")
+	return err
+}
+
+var popTask = redis.NewScript(2, `-- KEYS: [QueueName, MaintenanceKey] ARGV: [Now, LowPriority]
+	-- move any delayed tasks which are now due onto the queues of their orgs, behind their other tasks
+	local delayed = KEYS[1] .. ":delayed"
+	local due = redis.call("zrangebyscore", delayed, 0, ARGV[1], "WITHSCORES", "LIMIT", 0, 100)
+	for i = 1, #due, 2 do
+		local org = tostring(cjson.decode(due[i])["org_id"])
+		redis.call("zadd", KEYS[1] .. ":" .. org, tonumber(due[i + 1]) + tonumber(ARGV[2]), due[i])
+		redis.call("zincrby", KEYS[1] .. ":active", 0, org)
+		redis.call("zrem", delayed, due[i])
+	end
+
     -- first get what is the active queue
 	local result = redis.call("zrange", KEYS[1] .. ":active", 0, 0, "WITHSCORES")
 
@@ -127,6 +342,12 @@ var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
 		-- then remove it from the queue
 		redis.call('zremrangebyrank', queue, 0, 0)
 
+		-- tasks for orgs in maintenance are parked with their original score until the org leaves maintenance
+		if redis.call("sismember", KEYS[2], group) == 1 then
+			redis.call("zadd", "parked_tasks:" .. KEYS[1] .. ":" .. group, result[2], result[1])
+			return {"retry", ""}
+		end
+
 		-- and add a worker to this queue
 		redis.call("zincrby", KEYS[1] .. ":active", 1, group)
 
@@ -143,7 +364,7 @@ var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
 func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 	task := Task{}
 	for {
-		values, err := redis.Strings(popTask.Do(rc, queue))
+		values, err := redis.Strings(popTask.Do(rc, queueKey(queue), maintenanceKeyFor(queue), taskScore(time.Now(), DefaultPriority), int(LowPriority)))
 		if err != nil {
 			return nil, err
 		}
@@ -161,19 +382,93 @@ func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 	}
 }
 
-var markComplete = redis.NewScript(2, `-- KEYS: [QueueName] [TaskGroup]
+// ScanTasks calls the passed in function for each task queued in the given queue, across all orgs, stopping once
+// limit tasks have been scanned. Tasks are not removed from the queue.
+func ScanTasks(rc redis.Conn, queue string, limit int, fn func(*Task)) (int, error) {
+	orgIDs, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queueKey(queue)), 0, -1))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting active queues for: %s", queue)
+	}
+
+	scanned := 0
+	for _, orgID := range orgIDs {
+		if scanned >= limit {
+			break
+		}
+
+		payloads, err := redis.ByteSlices(rc.Do("zrange", fmt.Sprintf(queuePattern, queueKey(queue), orgID), 0, limit-scanned-1))
+		if err != nil {
+			return scanned, errors.Wrapf(err, "error getting tasks of: %d", orgID)
+		}
+
+		for _, payload := range payloads {
+			task := &Task{}
+			if err := json.Unmarshal(payload, task); err != nil {
+				return scanned, errors.Wrapf(err, "error unmarshalling task of: %d", orgID)
+			}
+			fn(task)
+			scanned++
+		}
+	}
+
+	return scanned, nil
+}
+
+var markComplete = redis.NewScript(1, `-- KEYS: [QueueName] ARGV: [TaskGroup]
 	-- decrement our active
-	local active = tonumber(redis.call("zincrby", KEYS[1] .. ":active", -1, KEYS[2]))
+	local active = tonumber(redis.call("zincrby", KEYS[1] .. ":active", -1, ARGV[1]))
 
 	-- reset to zero if we somehow go below
 	if active < 0 then
-		redis.call("zadd", KEYS[1] .. ":active", 0, KEYS[2])
+		redis.call("zadd", KEYS[1] .. ":active", 0, ARGV[1])
 	end
 `)
 
 // MarkTaskComplete marks the passed in task as complete. Callers must call this in order
 // to maintain fair workers across orgs
 func MarkTaskComplete(rc redis.Conn, queue string, orgID int) error {
-	_, err := markComplete.Do(rc, queue, strconv.FormatInt(int64(orgID), 10))
+	_, err := markComplete.Do(rc, queueKey(queue), strconv.FormatInt(int64(orgID), 10))
+	return err
+}
+
+// RecordActivity counts a handled task toward the activity of the passed in org for the current day
+func RecordActivity(rc redis.Conn, orgID int, now time.Time) error {
+	key := fmt.Sprintf(activityPattern, now.UTC().Format("2006-01-02"))
+
+	rc.Send("zincrby", key, 1, orgID)
+	rc.Send("expire", key, 60*60*48)
+	_, err := rc.Do("")
 	return err
 }
+
+// MostActive returns the ids of the passed in number of orgs which have handled the most tasks over today and
+// yesterday, most active first
+func MostActive(rc redis.Conn, now time.Time, count int) ([]int, error) {
+	totals := make(map[int]int)
+	for _, day := range []time.Time{now.UTC(), now.UTC().AddDate(0, 0, -1)} {
+		counts, err := redis.IntMap(rc.Do("zrange", fmt.Sprintf(activityPattern, day.Format("2006-01-02")), 0, -1, "WITHSCORES"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting org activity for: %s", day.Format("2006-01-02"))
+		}
+		for org, c := range counts {
+			orgID, _ := strconv.Atoi(org)
+			totals[orgID] += c
+		}
+	}
+
+	orgIDs := make([]int, 0, len(totals))
+	for orgID := range totals {
+		orgIDs = append(orgIDs, orgID)
+	}
+	sort.Slice(orgIDs, func(i, j int) bool {
+		if totals[orgIDs[i]] == totals[orgIDs[j]] {
+			return orgIDs[i] < orgIDs[j]
+		}
+		return totals[orgIDs[i]] > totals[orgIDs[j]]
+	})
+
+	if len(orgIDs) > count {
+		orgIDs = orgIDs[:count]
+	}
+	return orgIDs, nil
+}
@@ -2,7 +2,11 @@ package queue
 
 import (
 	"encoding/json"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/redisutil"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
@@ -75,3 +79,352 @@ func TestQueues(t *testing.T) {
 		assert.Equal(t, tc.Size, size, "%d: mismatch", i)
 	}
 }
+
+func TestRequeueTask(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:1", "test:delayed", "test:dead")
+	defer rc.Do("del", "test:active", "test:1", "test:delayed", "test:dead")
+
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task2", DefaultPriority))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	task.Version = 3
+
+	// requeued tasks aren't handled again until their delay has passed
+	requeued, err := RequeueTask(rc, "test", task, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, requeued)
+	assert.Equal(t, 1, task.Requeues)
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, `"task2"`, string(task.Task))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// requeue a task as if that was a while ago so that it's already due
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task3", DefaultPriority))
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	task.Version = 3
+
+	requeued, err = RequeueTask(rc, "test", task, time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, requeued)
+
+	// and it's handled again unchanged, but behind the other tasks of its org
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task4", DefaultPriority))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, `"task4"`, string(task.Task))
+
+	task, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, `"task3"`, string(task.Task))
+	assert.Equal(t, 3, task.Version)
+	assert.Equal(t, 1, task.Requeues)
+	assert.NotNil(t, task.FirstRequeuedOn)
+	assert.Equal(t, 1, TaskVersion("campaign"))
+
+	// requeuing again backs off further
+	requeued, err = RequeueTask(rc, "test", task, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, requeued)
+	assert.Equal(t, 2, task.Requeues)
+
+	delayed, err := redis.Strings(rc.Do("zrange", "test:delayed", 0, -1, "WITHSCORES"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(delayed)) // task1 is still waiting on its first delay
+	assert.InDelta(t, float64(time.Now().Add(time.Second*10).Unix()), parseScore(delayed[3]), 2)
+
+	// but once a task has been requeued for longer than our window, we give up on it
+	firstRequeuedOn := time.Now().Add(-RequeueWindow - time.Minute)
+	task.FirstRequeuedOn = &firstRequeuedOn
+
+	requeued, err = RequeueTask(rc, "test", task, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, requeued)
+
+	dead, err := DeadTasks(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, `"task3"`, string(dead[0].Task))
+	assert.Equal(t, 2, dead[0].Requeues)
+}
+
+func parseScore(score string) float64 {
+	f, _ := strconv.ParseFloat(score, 64)
+	return f
+}
+
+func TestQueueStats(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	rc.Do("del", "test:active", "test:1", "test:2", "test:desired_workers")
+
+	waits, err := Waits(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]time.Duration{}, waits)
+
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 1, "task2", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "campaign", 2, "task3", DefaultPriority))
+
+	busy, err := Busy(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, busy)
+
+	// pop one task from each org
+	_, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	_, err = PopNextTask(rc, "test")
+	assert.NoError(t, err)
+
+	busy, err = Busy(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, busy)
+
+	// only org 1 still has a task waiting
+	waits, err = Waits(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(waits))
+	assert.True(t, waits[1] > 0 && waits[1] < time.Second)
+
+	desired, err := DesiredWorkers(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, desired)
+
+	assert.NoError(t, SetDesiredWorkers(rc, "test", 5))
+
+	desired, err = DesiredWorkers(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, desired)
+}
+
+func TestActivity(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	defer rc.Close()
+
+	today := time.Date(2021, 6, 23, 15, 30, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+	rc.Do("del", "org_activity:2021-06-22", "org_activity:2021-06-23", "org_activity:2021-06-21")
+
+	mostActive, err := MostActive(rc, today, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{}, mostActive)
+
+	for _, a := range []struct {
+		orgID int
+		day   time.Time
+		count int
+	}{
+		{1, today, 2},
+		{2, today, 3},
+		{3, yesterday, 4},
+		{1, yesterday, 2},
+		{4, yesterday.AddDate(0, 0, -1), 10},
+	} {
+		for i := 0; i < a.count; i++ {
+			assert.NoError(t, RecordActivity(rc, a.orgID, a.day))
+		}
+	}
+
+	// org 4 was only active the day before yesterday so isn't counted
+	mostActive, err = MostActive(rc, today, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, mostActive)
+
+	mostActive, err = MostActive(rc, today, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3, 2}, mostActive)
+}
+
+func TestMaintenance(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	defer rc.Close()
+
+	rc.Do("del", "batch:active", "batch:1001", "batch:1002", "org_maintenance", "parked_tasks:batch:1001", "parked_tasks:handler:1001")
+
+	assert.NoError(t, StartMaintenance(rc, 1001))
+
+	inMaintenance, err := InMaintenance(rc, 1001)
+	assert.NoError(t, err)
+	assert.True(t, inMaintenance)
+
+	orgIDs, err := MaintenanceOrgs(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1001}, orgIDs)
+
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1001, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1001, "task2", DefaultPriority))
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1002, "task3", DefaultPriority))
+
+	// only the task for the org not in maintenance is handled, the others get parked
+	task, err := PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1002, task.OrgID)
+	assert.NoError(t, MarkTaskComplete(rc, BatchQueue, 1002))
+
+	task, err = PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	parked, total, err := ParkedTasks(rc, BatchQueue, 1001, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 1, len(parked))
+	assert.Equal(t, json.RawMessage(`"task1"`), parked[0].Task)
+
+	// requeuing while still in maintenance just parks them again
+	requeued, err := RequeueParkedTasks(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requeued)
+
+	task, err = PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// ending maintenance requeues them in their original order
+	requeued, err = EndMaintenance(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requeued)
+
+	for _, expected := range []string{`"task1"`, `"task2"`} {
+		task, err = PopNextTask(rc, BatchQueue)
+		assert.NoError(t, err)
+		assert.Equal(t, 1001, task.OrgID)
+		assert.Equal(t, json.RawMessage(expected), task.Task)
+		assert.NoError(t, MarkTaskComplete(rc, BatchQueue, 1001))
+	}
+
+	// parked tasks can also be discarded
+	assert.NoError(t, StartMaintenance(rc, 1001))
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1001, "task4", DefaultPriority))
+
+	task, err = PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	discarded, err := DiscardParkedTasks(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, discarded)
+
+	requeued, err = EndMaintenance(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, requeued)
+}
+
+func TestInspectOrgQueue(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	defer rc.Close()
+
+	rc.Do("del", "test:active", "test:1", "test:executing:1")
+
+	now := time.Now()
+
+	summary, err := InspectOrgQueue(rc, "test", 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, &OrgQueue{Types: map[string]int{}, Executing: []*ExecutingTask{}}, summary)
+
+	assert.NoError(t, AddTask(rc, "test", "start_flow", 1, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "start_flow_batch", 1, "task2", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "test", "start_flow_batch", 1, "task3", HighPriority))
+
+	task, err := PopNextTask(rc, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "start_flow_batch", task.Type)
+
+	token, err := StartExecuting(rc, "test", task, "mr1", now)
+	assert.NoError(t, err)
+
+	summary, err = InspectOrgQueue(rc, "test", 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Size)
+	assert.Equal(t, map[string]int{"start_flow": 1, "start_flow_batch": 1}, summary.Types)
+	assert.NotNil(t, summary.Oldest)
+	assert.Equal(t, 1, summary.Busy)
+	if assert.Equal(t, 1, len(summary.Executing)) {
+		assert.Equal(t, "start_flow_batch", summary.Executing[0].Type)
+		assert.Equal(t, "mr1", summary.Executing[0].Host)
+		assert.Equal(t, task.QueuedOn.Unix(), summary.Executing[0].QueuedOn.Unix())
+	}
+
+	assert.NoError(t, StopExecuting(rc, "test", 1, token))
+	assert.NoError(t, MarkTaskComplete(rc, "test", 1))
+
+	summary, err = InspectOrgQueue(rc, "test", 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, summary.Busy)
+	assert.Equal(t, 0, len(summary.Executing))
+
+	// executing tasks which started too long ago are ignored
+	_, err = StartExecuting(rc, "test", task, "mr1", now.Add(-time.Hour*25))
+	assert.NoError(t, err)
+
+	summary, err = InspectOrgQueue(rc, "test", 1, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(summary.Executing))
+}
+
+func TestHashTaggedKeys(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	defer rc.Close()
+
+	redisutil.UseHashTags(true)
+	defer redisutil.UseHashTags(false)
+
+	rc.Do("del", "{batch}:active", "{batch}:1001", "{batch}:1002", "org_maintenance", "{batch}:org_maintenance", "{handler}:org_maintenance", "parked_tasks:{batch}:1001")
+
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1001, "task1", DefaultPriority))
+	assert.NoError(t, AddTask(rc, BatchQueue, "campaign", 1002, "task2", DefaultPriority))
+
+	// all the keys of the queue share the same hash tag
+	count, err := redis.Int(rc.Do("zcard", "{batch}:1001"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	size, err := Size(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// maintenance is recorded in the set for each queue as well as the shared one
+	assert.NoError(t, StartMaintenance(rc, 1001))
+
+	for _, key := range []string{"org_maintenance", "{batch}:org_maintenance", "{handler}:org_maintenance"} {
+		member, err := redis.Bool(rc.Do("sismember", key, 1001))
+		assert.NoError(t, err)
+		assert.True(t, member, "expected org in %s", key)
+	}
+
+	task, err := PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1002, task.OrgID)
+	assert.NoError(t, MarkTaskComplete(rc, BatchQueue, 1002))
+
+	task, err = PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	count, err = redis.Int(rc.Do("zcard", "parked_tasks:{batch}:1001"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	requeued, err := EndMaintenance(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	task, err = PopNextTask(rc, BatchQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1001, task.OrgID)
+	assert.NoError(t, MarkTaskComplete(rc, BatchQueue, 1001))
+}
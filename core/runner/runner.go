@@ -6,23 +6,29 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/librato"
-	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/nyaruka/mailroom/utils/locker"
+	"github.com/nyaruka/mailroom/utils/logx"
+	"github.com/nyaruka/mailroom/utils/scope"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var logger = logx.Module("runner")
+
 const (
 	commitTimeout     = time.Minute
 	postCommitTimeout = time.Minute
+
+	triggerVariantResultName = "Trigger Variant"
 )
 
 var startTypeToOrigin = map[models.StartType]string{
@@ -67,19 +73,26 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	start := time.Now()
 	sa := oa.SessionAssets()
 
+	scope.Set(ctx, "session_uuid", session.UUID())
+
+	ctx, span := tracing.Start(ctx, "resume session", attribute.String("session_uuid", string(session.UUID())))
+	defer span.End()
+
 	// does the flow this session is part of still exist?
-	_, err := oa.FlowByID(session.CurrentFlowID())
+	flow, err := oa.FlowByID(session.CurrentFlowID())
 	if err != nil {
 		// if this flow just isn't available anymore, log this error
 		if err == models.ErrNotFound {
-			logrus.WithField("contact_uuid", session.Contact().UUID()).WithField("session_id", session.ID()).WithField("flow_id", session.CurrentFlowID()).Error("unable to find flow in resume")
+			logger.WithField("contact_uuid", session.Contact().UUID()).WithField("session_id", session.ID()).WithField("flow_id", session.CurrentFlowID()).Error("unable to find flow in resume")
 			return nil, models.ExitSessions(ctx, rt.DB, []models.SessionID{session.ID()}, models.ExitFailed, time.Now())
 		}
 		return nil, errors.Wrapf(err, "error loading session flow: %d", session.CurrentFlowID())
 	}
 
+	scope.Set(ctx, "flow_uuid", flow.UUID())
+
 	// build our flow session
-	fs, err := session.FlowSession(sa, oa.Env())
+	fs, err := session.FlowSession(models.EngineForContact(rt.Config, oa, session.Contact()), sa, oa.Env())
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to create session from output")
 	}
@@ -87,7 +100,7 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	// resume our session
 	resumeStart := time.Now()
 	sprint, err := fs.Resume(resume)
-	logrus.WithField("contact_id", resume.Contact().ID()).WithField("elapsed", time.Since(resumeStart)).Info("engine resume complete")
+	logx.Sampled(logger).WithField("contact_id", resume.Contact().ID()).WithField("elapsed", time.Since(resumeStart)).Info("engine resume complete")
 
 	// had a problem resuming our flow? bail
 	if err != nil {
@@ -98,30 +111,36 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	txCTX, cancel := context.WithTimeout(ctx, commitTimeout)
 	defer cancel()
 
-	tx, err := rt.DB.BeginTxx(txCTX, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error starting transaction")
-	}
+	err = models.RetryCommit(txCTX, "resume", func() error {
+		tx, err := rt.DB.BeginTxx(txCTX, nil)
+		if err != nil {
+			return errors.Wrapf(err, "error starting transaction")
+		}
 
-	// write our updated session and runs
-	err = session.WriteUpdatedSession(txCTX, tx, rt.RP, rt.SessionStorage, oa, fs, sprint, hook)
-	if err != nil {
-		tx.Rollback()
-		return nil, errors.Wrapf(err, "error updating session for resume")
-	}
+		// write our updated session and runs
+		err = session.WriteUpdatedSession(txCTX, tx, rt.RP, rt.SessionStorageFor(oa.Org().Region()), oa, fs, sprint, hook)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error updating session for resume")
+		}
 
-	// commit at once
-	err = tx.Commit()
+		// commit at once
+		err = tx.Commit()
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error committing resumption of flow")
+		}
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
-		return nil, errors.Wrapf(err, "error committing resumption of flow")
+		return nil, err
 	}
 
-	// now take care of any post-commit hooks
+	// now take care of any post-commit hooks, which aren't retried as they have effects outside of the database
 	txCTX, cancel = context.WithTimeout(ctx, postCommitTimeout)
 	defer cancel()
 
-	tx, err = rt.DB.BeginTxx(txCTX, nil)
+	tx, err := rt.DB.BeginTxx(txCTX, nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error starting transaction for post commit hooks")
 	}
@@ -135,7 +154,7 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		tx.Rollback()
 		return nil, errors.Wrapf(err, "error committing session changes on resume")
 	}
-	logrus.WithField("contact_uuid", resume.Contact().UUID()).WithField("elapsed", time.Since(start)).Info("resumed session")
+	logx.Sampled(logger).WithField("contact_uuid", resume.Contact().UUID()).WithField("elapsed", time.Since(start)).Info("resumed session")
 
 	return session, nil
 }
@@ -147,12 +166,26 @@ func StartFlowBatch(
 
 	start := time.Now()
 
-	// if this is our last start, no matter what try to set the start as complete as a last step
+	ctx, span := tracing.Start(ctx, "start flow batch", attribute.Int64("start_id", int64(batch.StartID())), attribute.Int("contacts", len(batch.ContactIDs())))
+	defer span.End()
+
+	// if this is our last start, no matter what try to set the start as complete as a last step, or as timed out if we
+	// ran out of time, using a new context as ours may have expired
 	if batch.IsLast() {
 		defer func() {
-			err := models.MarkStartComplete(ctx, rt.DB, batch.StartID())
+			mctx, mcancel := context.WithTimeout(context.Background(), time.Second*15)
+			defer mcancel()
+
+			if ctx.Err() == context.DeadlineExceeded {
+				if err := models.MarkStartTimedOut(mctx, rt.DB, batch.StartID()); err != nil {
+					logger.WithError(err).WithField("start_id", batch.StartID()).Error("error marking start as timed out")
+				}
+				return
+			}
+
+			err := models.MarkStartComplete(mctx, rt.DB, batch.StartID())
 			if err != nil {
-				logrus.WithError(err).WithField("start_id", batch.StartID).Error("error marking start as complete")
+				logger.WithError(err).WithField("start_id", batch.StartID).Error("error marking start as complete")
 			}
 		}()
 	}
@@ -166,7 +199,7 @@ func StartFlowBatch(
 	// try to load our flow
 	flow, err := oa.FlowByID(batch.FlowID())
 	if err == models.ErrNotFound {
-		logrus.WithField("flow_id", batch.FlowID()).Info("skipping flow start, flow no longer active or archived")
+		logger.WithField("flow_id", batch.FlowID()).Info("skipping flow start, flow no longer active or archived")
 		return nil, nil
 	}
 	if err != nil {
@@ -382,7 +415,7 @@ func FireCampaignEvents(
 
 	sessions, err := StartFlow(ctx, rt, oa, dbFlow, contactIDs, options)
 	if err != nil {
-		logrus.WithField("contact_ids", contactIDs).WithError(err).Errorf("error starting flow for campaign event: %s", eventUUID)
+		logger.WithField("contact_ids", contactIDs).WithError(err).Errorf("error starting flow for campaign event: %s", eventUUID)
 	} else {
 		// make sure any skipped contacts are marked as fired this can occur if all fires were skipped
 		fires := make([]*models.EventFire, 0, len(sessions))
@@ -391,7 +424,7 @@ func FireCampaignEvents(
 		}
 		err = models.MarkEventsFired(ctx, rt.DB, fires, fired, models.FireResultSkipped)
 		if err != nil {
-			logrus.WithField("fire_ids", fires).WithError(err).Errorf("error marking events as skipped: %s", eventUUID)
+			logger.WithField("fire_ids", fires).WithError(err).Errorf("error marking events as skipped: %s", eventUUID)
 		}
 	}
 
@@ -416,6 +449,8 @@ func StartFlow(
 		return nil, nil
 	}
 
+	scope.Set(ctx, "flow_uuid", flow.UUID())
+
 	// figures out which contacts need to be excluded if any
 	exclude := make(map[models.ContactID]bool, 5)
 
@@ -463,68 +498,29 @@ func StartFlow(
 	remaining := includedContacts
 	start := time.Now()
 
-	// map of locks we've released
-	released := make(map[string]bool)
-
 	for len(remaining) > 0 && time.Since(start) < time.Minute*5 {
-		locked := make([]models.ContactID, 0, len(remaining))
-		locks := make([]string, 0, len(remaining))
-		skipped := make([]models.ContactID, 0, 5)
-
-		// try up to a second to get a lock for a contact
-		for _, contactID := range remaining {
-			lockID := models.ContactLock(oa.OrgID(), contactID)
-			lock, err := locker.GrabLock(rt.RP, lockID, time.Minute*5, time.Second)
-			if err != nil {
-				return nil, errors.Wrapf(err, "error attempting to grab lock")
-			}
-			if lock == "" {
-				skipped = append(skipped, contactID)
-				continue
-			}
-			locked = append(locked, contactID)
-			locks = append(locks, lock)
-
-			// defer unlocking if we exit due to error
-			defer func() {
-				if !released[lockID] {
-					locker.ReleaseLock(rt.RP, lockID, lock)
-				}
-			}()
+		// stop if we've run out of time, contacts already started stay started
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrapf(err, "error starting flow: %d", flow.ID())
 		}
 
-		// load our locked contacts
-		contacts, err := models.LoadContacts(ctx, rt.DB, oa, locked)
+		locks, skipped, err := models.LockContacts(rt.RP, oa.OrgID(), remaining, time.Second)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error loading contacts to start")
+			return nil, errors.Wrapf(err, "error attempting to grab lock")
 		}
 
-		// ok, we've filtered our contacts, build our triggers
-		triggers := make([]flows.Trigger, 0, len(locked))
-		for _, c := range contacts {
-			contact, err := c.FlowContact(oa)
-			if err != nil {
-				return nil, errors.Wrapf(err, "error creating flow contact")
-			}
-			trigger := options.TriggerBuilder(contact)
-			triggers = append(triggers, trigger)
-		}
+		ss, err := startLockedContacts(ctx, rt, oa, flow, locks.ContactIDs(), options)
+
+		// release all our locks
+		locks.Release()
 
-		ss, err := StartFlowForContacts(ctx, rt, oa, flow, triggers, options.CommitHook, options.Interrupt)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error starting flow for contacts")
+			return nil, err
 		}
 
 		// append all the sessions that were started
 		sessions = append(sessions, ss...)
 
-		// release all our locks
-		for i := range locked {
-			lockID := models.ContactLock(oa.OrgID(), locked[i])
-			locker.ReleaseLock(rt.RP, lockID, locks[i])
-			released[lockID] = true
-		}
-
 		// skipped are now our remaining
 		remaining = skipped
 	}
@@ -532,10 +528,49 @@ func StartFlow(
 	return sessions, nil
 }
 
+// starts the passed in flow for the passed in contacts, which the caller must have locked
+func startLockedContacts(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, flow *models.Flow, contactIDs []models.ContactID, options *StartOptions) ([]*models.Session, error) {
+	// load our locked contacts
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading contacts to start")
+	}
+
+	// ok, we've filtered our contacts, build our triggers for those which are still active
+	triggers := make([]flows.Trigger, 0, len(contactIDs))
+	for _, c := range contacts {
+		if c.Status() != models.ContactStatusActive {
+			continue
+		}
+
+		contact, err := c.FlowContact(oa)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating flow contact")
+		}
+		trigger := options.TriggerBuilder(contact)
+		triggers = append(triggers, trigger)
+	}
+
+	ss, err := StartFlowForContacts(ctx, rt, oa, flow, triggers, options.CommitHook, options.Interrupt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting flow for contacts")
+	}
+
+	return ss, nil
+}
+
 // StartFlowForContacts runs the passed in flow for the passed in contact
 func StartFlowForContacts(
 	ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	flow *models.Flow, triggers []flows.Trigger, hook models.SessionCommitHook, interrupt bool) ([]*models.Session, error) {
+	return StartFlowForContactsWithVariant(ctx, rt, oa, flow, triggers, hook, interrupt, models.NoTriggerVariant)
+}
+
+// StartFlowForContactsWithVariant runs the passed in flow for the passed in contacts, recording the trigger split variant
+// they were assigned to as a result on their runs so that the variants can be compared
+func StartFlowForContactsWithVariant(
+	ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
+	flow *models.Flow, triggers []flows.Trigger, hook models.SessionCommitHook, interrupt bool, variant models.TriggerVariant) ([]*models.Session, error) {
 	sa := oa.SessionAssets()
 
 	// no triggers? nothing to do
@@ -543,8 +578,11 @@ func StartFlowForContacts(
 		return nil, nil
 	}
 
+	ctx, span := tracing.Start(ctx, "start sessions", attribute.String("flow_uuid", string(flow.UUID())), attribute.Int("contacts", len(triggers)))
+	defer span.End()
+
 	start := time.Now()
-	log := logrus.WithField("flow_name", flow.Name()).WithField("flow_uuid", flow.UUID())
+	log := logger.WithField("flow_name", flow.Name()).WithField("flow_uuid", flow.UUID())
 
 	// for each trigger start the flow
 	sessions := make([]flows.Session, 0, len(triggers))
@@ -555,7 +593,7 @@ func StartFlowForContacts(
 		log := log.WithField("contact_uuid", trigger.Contact().UUID())
 		start := time.Now()
 
-		session, sprint, err := goflow.Engine(rt.Config).NewSession(sa, trigger)
+		session, sprint, err := models.EngineForContact(rt.Config, oa, trigger.Contact()).NewSession(sa, trigger)
 		if err != nil {
 			log.WithError(err).Errorf("error starting flow")
 			continue
@@ -563,6 +601,15 @@ func StartFlowForContacts(
 		log.WithField("elapsed", time.Since(start)).Info("flow engine start")
 		librato.Gauge("mr.flow_start_elapsed", float64(time.Since(start)))
 
+		if variant != models.NoTriggerVariant && len(session.Runs()) > 0 {
+			session.Runs()[0].SaveResult(&flows.Result{
+				Name:      triggerVariantResultName,
+				Value:     string(variant),
+				Category:  string(variant),
+				CreatedOn: dates.Now(),
+			})
+		}
+
 		sessions = append(sessions, session)
 		sprints = append(sprints, sprint)
 	}
@@ -596,20 +643,20 @@ func StartFlowForContacts(
 	}
 
 	// write our session to the db
-	dbSessions, err := models.WriteSessions(txCTX, tx, rt.RP, rt.SessionStorage, oa, sessions, sprints, hook)
+	dbSessions, err := models.WriteSessions(txCTX, tx, rt.RP, rt.SessionStorageFor(oa.Org().Region()), oa, sessions, sprints, hook)
 	if err == nil {
 		// commit it at once
 		commitStart := time.Now()
 		err = tx.Commit()
 
 		if err == nil {
-			logrus.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
+			logger.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
 		}
 	}
 
 	// retry committing our sessions one at a time
 	if err != nil {
-		logrus.WithError(err).Debug("failed committing bulk transaction, retrying one at a time")
+		logger.WithError(err).Debug("failed committing bulk transaction, retrying one at a time")
 
 		tx.Rollback()
 
@@ -621,32 +668,38 @@ func StartFlowForContacts(
 			txCTX, cancel := context.WithTimeout(ctx, commitTimeout)
 			defer cancel()
 
-			tx, err := rt.DB.BeginTxx(txCTX, nil)
-			if err != nil {
-				return nil, errors.Wrapf(err, "error starting transaction for retry")
-			}
+			var dbSession []*models.Session
 
-			// interrupt this contact if appropriate
-			if interrupt {
-				err = models.InterruptContactRuns(txCTX, tx, flow.FlowType(), []flows.ContactID{session.Contact().ID()}, start)
+			err := models.RetryCommit(txCTX, "start", func() error {
+				tx, err := rt.DB.BeginTxx(txCTX, nil)
 				if err != nil {
-					tx.Rollback()
-					log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Errorf("error interrupting contact")
-					continue
+					return errors.Wrapf(err, "error starting transaction for retry")
 				}
-			}
 
-			dbSession, err := models.WriteSessions(txCTX, tx, rt.RP, rt.SessionStorage, oa, []flows.Session{session}, []flows.Sprint{sprint}, hook)
-			if err != nil {
-				tx.Rollback()
-				log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Errorf("error writing session to db")
-				continue
-			}
+				// interrupt this contact if appropriate
+				if interrupt {
+					err = models.InterruptContactRuns(txCTX, tx, flow.FlowType(), []flows.ContactID{session.Contact().ID()}, start)
+					if err != nil {
+						tx.Rollback()
+						return errors.Wrapf(err, "error interrupting contact")
+					}
+				}
 
-			err = tx.Commit()
+				dbSession, err = models.WriteSessions(txCTX, tx, rt.RP, rt.SessionStorageFor(oa.Org().Region()), oa, []flows.Session{session}, []flows.Sprint{sprint}, hook)
+				if err != nil {
+					tx.Rollback()
+					return errors.Wrapf(err, "error writing session to db")
+				}
+
+				err = tx.Commit()
+				if err != nil {
+					tx.Rollback()
+					return errors.Wrapf(err, "error comitting session to db")
+				}
+				return nil
+			})
 			if err != nil {
-				tx.Rollback()
-				log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Errorf("error comitting session to db")
+				log.WithField("contact_uuid", session.Contact().UUID()).WithError(err).Error("error starting contact")
 				continue
 			}
 
@@ -658,16 +711,17 @@ func StartFlowForContacts(
 	txCTX, cancel = context.WithTimeout(ctx, postCommitTimeout*time.Duration(len(sessions)))
 	defer cancel()
 
-	tx, err = rt.DB.BeginTxx(txCTX, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error starting transaction for post commit hooks")
-	}
-
 	scenes := make([]*models.Scene, 0, len(triggers))
 	for _, s := range dbSessions {
 		scenes = append(scenes, s.Scene())
 	}
 
+	// post commit hooks aren't retried as they have effects outside of the database
+	tx, err = rt.DB.BeginTxx(txCTX, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction for post commit hooks")
+	}
+
 	err = models.ApplyEventPostCommitHooks(txCTX, tx, rt.RP, oa, scenes)
 	if err == nil {
 		err = tx.Commit()
@@ -752,7 +806,7 @@ func TriggerIVRFlow(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID
 	// queue this to our ivr starter, it will take care of creating the connections then calling back in
 	rc := rt.RP.Get()
 	defer rc.Close()
-	err = queue.AddTask(rc, queue.BatchQueue, queue.StartIVRFlowBatch, int(orgID), task, queue.HighPriority)
+	err = queue.AddTracedTask(ctx, rc, queue.BatchQueue, queue.StartIVRFlowBatch, int(orgID), task, queue.HighPriority)
 	if err != nil {
 		return errors.Wrapf(err, "error queuing ivr flow start")
 	}
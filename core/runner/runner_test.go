@@ -1,7 +1,9 @@
 package runner_test
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -9,12 +11,15 @@ import (
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/flows/resumes"
 	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/mailroom/config"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/runner"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -100,6 +105,35 @@ func TestCampaignStarts(t *testing.T) {
 		`SELECT count(*) from flows_flowsession WHERE status = 'W' AND contact_id = $1 AND session_type = 'V'`, []interface{}{testdata.Cathy.ID}, 1)
 }
 
+func TestCampaignStartsForInactiveContacts(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := rt.DB
+
+	defer testsuite.Reset()
+
+	campaign := triggers.NewCampaignReference(triggers.CampaignUUID(testdata.RemindersCampaign.UUID), "Doctor Reminders")
+
+	// George is blocked but still has his event fire
+	now := time.Now()
+	db.MustExec(`INSERT INTO campaigns_eventfire(event_id, scheduled, contact_id) VALUES($1, $2, $3)`, testdata.RemindersEvent2.ID, now, testdata.George.ID)
+	db.MustExec(`UPDATE contacts_contact SET status = 'B' WHERE id = $1`, testdata.George.ID)
+
+	var fireID models.FireID
+	db.Get(&fireID, `SELECT id FROM campaigns_eventfire WHERE contact_id = $1`, testdata.George.ID)
+
+	fires := []*models.EventFire{{FireID: fireID, EventID: testdata.RemindersEvent2.ID, ContactID: testdata.George.ID, Scheduled: now}}
+
+	sessions, err := runner.FireCampaignEvents(ctx, rt, testdata.Org1.ID, fires, testdata.CampaignFlow.UUID, campaign, "e68f4c70-9db1-44c8-8498-602d6857235e")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(sessions))
+
+	// his fire is skipped rather than started
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NOT NULL AND fired_result = 'S'`, []interface{}{testdata.George.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, []interface{}{testdata.George.ID}, 0)
+}
+
 func TestBatchStart(t *testing.T) {
 	testsuite.Reset()
 	ctx := testsuite.CTX()
@@ -214,6 +248,12 @@ func TestResume(t *testing.T) {
 		[]interface{}{contact.ID()}, 1,
 	)
 
+	// contact's flow history records that they've entered the flow but not yet completed it
+	testsuite.AssertQueryCount(t, db,
+		`SELECT count(*) FROM contacts_contact WHERE id = $1 AND last_flow_id = $2 AND entered_flow_ids = ARRAY[$2]::int[] AND completed_flow_ids = '{}'`,
+		[]interface{}{contact.ID(), flow.ID()}, 1,
+	)
+
 	tcs := []struct {
 		Message       string
 		SessionStatus flows.SessionStatus
@@ -267,4 +307,236 @@ func TestResume(t *testing.T) {
 			[]interface{}{contact.ID(), tc.Substring}, 1, "%d: didn't find expected message", i,
 		)
 	}
+
+	// and now that they've completed it
+	testsuite.AssertQueryCount(t, db,
+		`SELECT count(*) FROM contacts_contact WHERE id = $1 AND last_flow_id = $2 AND entered_flow_ids = ARRAY[$2]::int[] AND completed_flow_ids = ARRAY[$2]::int[]`,
+		[]interface{}{contact.ID(), flow.ID()}, 1,
+	)
+}
+
+func TestResumeWithOutputOnlyInStorage(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := rt.DB
+	defer testsuite.ResetStorage()
+
+	// write session outputs only to storage
+	db.MustExec(`UPDATE orgs_org set config = '{"session_storage_mode": "s3_only"}' WHERE id = 1`)
+	defer testsuite.ResetDB()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = 'W' AND output IS NULL AND output_url IS NOT NULL`, []interface{}{contact.ID()}, 1)
+
+	session := sessions[0]
+	for _, tc := range []struct {
+		Text   string
+		Status models.SessionStatus
+	}{
+		{"Red", models.SessionStatusWaiting},
+		{"Mutzig", models.SessionStatusWaiting},
+		{"Luke", models.SessionStatusCompleted},
+	} {
+		msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, tc.Text, nil)
+		msg.SetID(10)
+
+		session, err = runner.ResumeFlow(ctx, rt, oa, session, resumes.NewMsg(oa.Env(), contact, msg), nil)
+		require.NoError(t, err)
+
+		testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = $2 AND output IS NULL AND output_url IS NOT NULL`, []interface{}{contact.ID(), tc.Status}, 1)
+	}
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text like '%Thanks Luke%'`, []interface{}{contact.ID()}, 1)
+}
+
+func TestResumeRetry(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := rt.DB
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	rc.Do("FLUSHDB")
+
+	// a hook which deadlocks the first time it's called
+	calls := 0
+	hook := func(ctx context.Context, tx *sqlx.Tx, rp *redis.Pool, oa *models.OrgAssets, sessions []*models.Session) error {
+		calls++
+		if calls == 1 {
+			return &pq.Error{Code: "40P01", Table: "flows_flowsession"}
+		}
+		return nil
+	}
+
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "Red", nil)
+	msg.SetID(10)
+
+	_, err = runner.ResumeFlow(ctx, rt, oa, sessions[0], resumes.NewMsg(oa.Env(), contact, msg), hook)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// the session write was retried but its reply was only created and sent once
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text like '%I like Red too%'`, []interface{}{contact.ID()}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE contact_id = $1`, []interface{}{contact.ID()}, 1)
+
+	queued := 0
+	for _, priority := range []int{0, 1} {
+		count, err := redis.Int(rc.Do("zcard", fmt.Sprintf("msgs:%s|10/%d", testdata.TwilioChannel.UUID, priority)))
+		require.NoError(t, err)
+		queued += count
+	}
+	assert.Equal(t, 1, queued)
+}
+
+func TestShadowFlows(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+	rt := testsuite.RT()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// run pick a number in shadow alongside favorites for all messages
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('shadow_flows', jsonb_build_object($1::text, jsonb_build_object('flow_uuid', $2::text, 'percent', 100))) WHERE id = $3`, testdata.Favorites.UUID, testdata.PickANumber.UUID, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	msgIn := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "start", nil)
+
+	err = runner.StartShadowFlow(ctx, rt, oa, flow, contact, msgIn, nil, nil)
+	require.NoError(t, err)
+
+	// shadow session is waiting in redis but nothing was written to the database
+	exists, err := redis.Bool(rc.Do("EXISTS", fmt.Sprintf("shadow_session:%d:%d", testdata.Org1.ID, testdata.Cathy.ID)))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O'`, []interface{}{testdata.Cathy.ID}, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, []interface{}{testdata.Cathy.ID}, 0)
+
+	msgIn = flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "12", nil)
+
+	err = runner.ResumeShadowFlow(ctx, rt, oa, flow, contact, msgIn, nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O'`, []interface{}{testdata.Cathy.ID}, 0)
+
+	// starting a flow without a shadow clears any shadow session
+	flow, err = oa.FlowByID(testdata.SingleMessage.ID)
+	require.NoError(t, err)
+
+	err = runner.StartShadowFlow(ctx, rt, oa, flow, contact, msgIn, nil, nil)
+	require.NoError(t, err)
+
+	exists, err = redis.Bool(rc.Do("EXISTS", fmt.Sprintf("shadow_session:%d:%d", testdata.Org1.ID, testdata.Cathy.ID)))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestRunSteps(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	config.Mailroom.RunSteps = true
+	defer func() { config.Mailroom.RunSteps = false }()
+
+	err := models.MaintainRunStepsPartitions(ctx, db, time.Now(), 3)
+	require.NoError(t, err)
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	// every step but the one we're waiting at is written
+	session := sessions[0]
+
+	var pathLength int
+	err = db.Get(&pathLength, `SELECT json_array_length(path::json) FROM flows_flowrun WHERE flow_id = $1`, flow.ID())
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrunstep WHERE flow_id = $1 AND exit_uuid IS NOT NULL`, []interface{}{flow.ID()}, pathLength-1)
+
+	for i, answer := range []string{"Red", "Mutzig", "Luke"} {
+		msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, answer, nil)
+		msg.SetID(10)
+
+		session, err = runner.ResumeFlow(ctx, rt, oa, session, resumes.NewMsg(oa.Env(), contact, msg), nil)
+		require.NoError(t, err)
+
+		err = db.Get(&pathLength, `SELECT json_array_length(path::json) FROM flows_flowrun WHERE flow_id = $1`, flow.ID())
+		require.NoError(t, err)
+
+		// steps are only written once and the final step is written when the run completes
+		expected := pathLength - 1
+		if session.Status() == models.SessionStatusCompleted {
+			expected = pathLength
+		}
+
+		testsuite.AssertQueryCount(t, db, `SELECT count(DISTINCT step_uuid) FROM flows_flowrunstep WHERE flow_id = $1`, []interface{}{flow.ID()}, expected, "%d: unexpected distinct steps", i)
+		testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrunstep WHERE flow_id = $1`, []interface{}{flow.ID()}, expected, "%d: unexpected steps", i)
+	}
+}
+
+func TestMaintainRunStepsPartitions(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	now := time.Date(2021, 6, 23, 15, 30, 0, 0, time.UTC)
+
+	err := models.MaintainRunStepsPartitions(ctx, db, now, 2)
+	require.NoError(t, err)
+
+	// add an old partition
+	db.MustExec(`CREATE TABLE flows_flowrunstep_2021_01 PARTITION OF flows_flowrunstep FOR VALUES FROM ('2021-01-01') TO ('2021-02-01')`)
+	db.MustExec(`CREATE TABLE flows_flowrunstep_2021_04 PARTITION OF flows_flowrunstep FOR VALUES FROM ('2021-04-01') TO ('2021-05-01')`)
+
+	err = models.MaintainRunStepsPartitions(ctx, db, now, 2)
+	require.NoError(t, err)
+
+	var partitions []string
+	err = db.Select(&partitions, `SELECT c.relname FROM pg_inherits i INNER JOIN pg_class c ON c.oid = i.inhrelid INNER JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = 'flows_flowrunstep' ORDER BY c.relname`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"flows_flowrunstep_2021_04", "flows_flowrunstep_2021_06", "flows_flowrunstep_2021_07"}, partitions)
 }
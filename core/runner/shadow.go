@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	shadowSessionKey = "shadow_session:%d:%d"
+	shadowSessionTTL = 60 * 60 * 24 * 7
+)
+
+// StartShadowFlow starts the shadow version of the passed in flow for the passed in contact if the org has configured
+// one and this message is selected for shadowing. Shadow sessions are run by the simulator engine and never persisted
+// to the database so nothing is sent, their waiting state is kept in redis so that later messages can resume them.
+func StartShadowFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, flow *models.Flow, contact *flows.Contact, msgIn *flows.MsgIn, match *triggers.KeywordMatch, real *models.Session) error {
+	// any shadow session from a previous start is replaced by this one
+	shadow := oa.Org().ShadowFlow(flow.UUID())
+	if shadow == nil || rand.Intn(100) >= shadow.Percent {
+		return clearShadowSession(rt, oa, contact)
+	}
+
+	shadowFlow, err := oa.Flow(shadow.FlowUUID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading shadow flow: %s", shadow.FlowUUID)
+	}
+
+	trigger := triggers.NewBuilder(oa.Env(), assets.NewFlowReference(shadowFlow.UUID(), shadowFlow.Name()), contact).Msg(msgIn).WithMatch(match).Build()
+
+	session, sprint, err := goflow.Simulator(rt.Config).NewSession(oa.SessionAssets(), trigger)
+	if err != nil {
+		return errors.Wrapf(err, "error starting shadow flow: %s", shadow.FlowUUID)
+	}
+
+	logShadowComparison(flow.UUID(), shadow.FlowUUID, contact, sprint, real)
+
+	return saveShadowSession(rt, oa, contact, session)
+}
+
+// ResumeShadowFlow resumes the shadow session of the passed in contact if they have one
+func ResumeShadowFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, flow *models.Flow, contact *flows.Contact, msgIn *flows.MsgIn, real *models.Session) error {
+	rc := rt.RP.Get()
+	output, err := redis.Bytes(rc.Do("GET", fmt.Sprintf(shadowSessionKey, oa.OrgID(), contact.ID())))
+	rc.Close()
+
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error loading shadow session")
+	}
+
+	session, err := goflow.Simulator(rt.Config).ReadSession(oa.SessionAssets(), output, assets.IgnoreMissing)
+	if err != nil {
+		return errors.Wrapf(err, "error reading shadow session")
+	}
+
+	sprint, err := session.Resume(resumes.NewMsg(oa.Env(), contact, msgIn))
+	if err != nil {
+		return errors.Wrapf(err, "error resuming shadow session")
+	}
+
+	shadowFlowUUID := assets.FlowUUID("")
+	if len(session.Runs()) > 0 {
+		shadowFlowUUID = session.Runs()[0].Flow().UUID()
+	}
+
+	logShadowComparison(flow.UUID(), shadowFlowUUID, contact, sprint, real)
+
+	return saveShadowSession(rt, oa, contact, session)
+}
+
+// saves the passed in shadow session if it is waiting, otherwise clears the contact's shadow session
+func saveShadowSession(rt *runtime.Runtime, oa *models.OrgAssets, contact *flows.Contact, session flows.Session) error {
+	if session.Status() != flows.SessionStatusWaiting {
+		return clearShadowSession(rt, oa, contact)
+	}
+
+	output, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling shadow session")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err = rc.Do("SET", fmt.Sprintf(shadowSessionKey, oa.OrgID(), contact.ID()), output, "EX", shadowSessionTTL)
+	return errors.Wrapf(err, "error saving shadow session")
+}
+
+func clearShadowSession(rt *runtime.Runtime, oa *models.OrgAssets, contact *flows.Contact) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("DEL", fmt.Sprintf(shadowSessionKey, oa.OrgID(), contact.ID()))
+	return errors.Wrapf(err, "error clearing shadow session")
+}
+
+// ShadowSummary is what a sprint did that we compare between the real and shadow sessions
+type ShadowSummary struct {
+	Msgs    []string          `json:"msgs"`
+	Results map[string]string `json:"results"`
+}
+
+// SummarizeSprint summarizes the messages sent and results saved in the passed in sprint
+func SummarizeSprint(sprint flows.Sprint) *ShadowSummary {
+	summary := &ShadowSummary{Msgs: []string{}, Results: map[string]string{}}
+	if sprint == nil {
+		return summary
+	}
+
+	for _, e := range sprint.Events() {
+		switch typed := e.(type) {
+		case *events.MsgCreatedEvent:
+			summary.Msgs = append(summary.Msgs, typed.Msg.Text())
+		case *events.RunResultChangedEvent:
+			summary.Results[typed.Name] = typed.Value
+		}
+	}
+	return summary
+}
+
+func logShadowComparison(flowUUID, shadowFlowUUID assets.FlowUUID, contact *flows.Contact, shadowSprint flows.Sprint, real *models.Session) {
+	var realSprint flows.Sprint
+	if real != nil {
+		realSprint = real.Sprint()
+	}
+
+	realSummary := SummarizeSprint(realSprint)
+	shadowSummary := SummarizeSprint(shadowSprint)
+
+	realJSON, _ := json.Marshal(realSummary)
+	shadowJSON, _ := json.Marshal(shadowSummary)
+
+	logrus.WithFields(logrus.Fields{
+		"flow_uuid":        flowUUID,
+		"shadow_flow_uuid": shadowFlowUUID,
+		"contact_uuid":     contact.UUID(),
+		"real":             string(realJSON),
+		"shadow":           string(shadowJSON),
+		"matches":          string(realJSON) == string(shadowJSON),
+	}).Info("shadow flow comparison")
+}
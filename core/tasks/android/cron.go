@@ -0,0 +1,42 @@
+package android
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/sirupsen/logrus"
+)
+
+const syncAndroidLock = "sync_android"
+
+func init() {
+	mailroom.AddInitFunction(StartSyncCron)
+}
+
+// StartSyncCron starts our cron job of triggering Android channel syncs which were deferred by rate limiting
+func StartSyncCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	fc := msgio.CreateFCMClient(rt.Config)
+	if rt.Config.AndroidSyncInterval == 0 || fc == nil {
+		return nil
+	}
+
+	cron.StartCron(quit, rt.RP, syncAndroidLock, time.Second*1,
+		func(lockName string, lockValue string) error {
+			rc := rt.RP.Get()
+			defer rc.Close()
+
+			start := time.Now()
+			count, err := msgio.SyncDeferredAndroidChannels(rc, fc, start)
+			if count > 0 {
+				logrus.WithField("comp", "android_syncer").WithField("count", count).WithField("elapsed", time.Since(start)).Info("triggered deferred android syncs")
+			}
+			return err
+		},
+	)
+	return nil
+}
@@ -3,6 +3,9 @@ package tasks
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/nyaruka/goflow/utils"
@@ -11,18 +14,64 @@ import (
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-var registeredTypes = map[string](func() Task){}
+// the maximum number of queued tasks we check for unsupported versions at startup
+const maxCheckedTasks = 10000
 
-// RegisterType registers a new type of task
+func init() {
+	mailroom.AddInitFunction(CheckQueuedTasks)
+}
+
+// Decoder decodes a task payload of an older schema version into a task of the current version
+type Decoder func(data json.RawMessage) (Task, error)
+
+type registeredType struct {
+	initFunc func() Task
+	version  int
+	decoders map[int]Decoder
+}
+
+// supports returns whether we can decode payloads of the given version
+func (t *registeredType) supports(version int) bool {
+	return version == t.version || t.decoders[version] != nil
+}
+
+// versions returns the payload versions we can decode, i.e. our compatibility window
+func (t *registeredType) versions() []int {
+	versions := []int{t.version}
+	for v := range t.decoders {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+var registeredTypes = map[string]*registeredType{}
+
+// RegisterType registers a new type of task whose payloads have never changed schema
 func RegisterType(name string, initFunc func() Task) {
-	registeredTypes[name] = initFunc
+	RegisterVersionedType(name, 1, initFunc, nil)
+}
+
+// RegisterVersionedType registers a new type of task whose payloads are at the given schema version, with decoders for
+// the older versions which we still support. Older versions should be kept for as long as tasks queued by previous
+// releases might still be queued, which across a rolling deploy means at least one release.
+func RegisterVersionedType(name string, version int, initFunc func() Task, decoders map[int]Decoder) {
+	registeredTypes[name] = &registeredType{initFunc: initFunc, version: version, decoders: decoders}
+	queue.SetTaskVersion(name, version)
 
 	mailroom.AddTaskFunction(name, func(ctx context.Context, rt *runtime.Runtime, task *queue.Task) error {
+		// tasks queued by a newer release are left for a worker of that release
+		if task.SchemaVersion() > version {
+			return errors.Wrapf(queue.ErrNewerVersion, "task of type %s is version %d", task.Type, task.SchemaVersion())
+		}
+
 		// decode our task body
-		typedTask, err := ReadTask(task.Type, task.Task)
+		typedTask, err := ReadTaskVersion(task.Type, task.SchemaVersion(), task.Task)
 		if err != nil {
 			return errors.Wrapf(err, "error reading task of type %s", task.Type)
 		}
@@ -47,13 +96,67 @@ type Task interface {
 // JSON Encoding / Decoding
 //------------------------------------------------------------------------------------------
 
-// ReadTask reads an action from the given JSON
+// ReadTask reads a task of the current schema version from the given JSON
 func ReadTask(typeName string, data json.RawMessage) (Task, error) {
-	f := registeredTypes[typeName]
-	if f == nil {
+	t := registeredTypes[typeName]
+	if t == nil {
+		return nil, errors.Errorf("unknown task type: '%s'", typeName)
+	}
+
+	return ReadTaskVersion(typeName, t.version, data)
+}
+
+// ReadTaskVersion reads a task whose payload is of the given schema version from the given JSON
+func ReadTaskVersion(typeName string, version int, data json.RawMessage) (Task, error) {
+	t := registeredTypes[typeName]
+	if t == nil {
 		return nil, errors.Errorf("unknown task type: '%s'", typeName)
 	}
+	if !t.supports(version) {
+		return nil, errors.Errorf("unsupported version %d of task type '%s', supported versions are %v", version, typeName, t.versions())
+	}
 
-	task := f()
+	if version != t.version {
+		return t.decoders[version](data)
+	}
+
+	task := t.initFunc()
 	return task, utils.UnmarshalAndValidate(data, task)
 }
+
+// CheckQueuedTasks checks the tasks currently queued and warns about any with payload versions we can't decode, e.g.
+// tasks queued by a newer release during a rolling deploy, which we requeue, or by a release older than our
+// compatibility window, which will fail
+func CheckQueuedTasks(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, q := range []string{queue.BatchQueue, queue.HandlerQueue} {
+		unsupported, err := FindUnsupportedTasks(rc, q)
+		if err != nil {
+			return err
+		}
+
+		for key, count := range unsupported {
+			logrus.WithField("queue", q).WithField("task", key).WithField("count", count).Warn("queued tasks have an unsupported version")
+		}
+	}
+	return nil
+}
+
+// FindUnsupportedTasks counts, by type and version, the tasks in the given queue whose payload versions we can't decode
+func FindUnsupportedTasks(rc redis.Conn, q string) (map[string]int, error) {
+	unsupported := make(map[string]int)
+
+	_, err := queue.ScanTasks(rc, q, maxCheckedTasks, func(task *queue.Task) {
+		t := registeredTypes[task.Type]
+		if (t != nil && !t.supports(task.SchemaVersion())) || (t == nil && task.SchemaVersion() > queue.TaskVersion(task.Type)) {
+			unsupported[fmt.Sprintf("%s@%d", task.Type, task.SchemaVersion())]++
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error checking queued tasks in %s queue", q)
+	}
+
+	return unsupported, nil
+}
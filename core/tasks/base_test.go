@@ -1,11 +1,17 @@
 package tasks_test
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/tasks"
 	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -22,3 +28,69 @@ func TestReadTask(t *testing.T) {
 	assert.Equal(t, models.GroupID(23), typedTask.GroupID)
 	assert.Equal(t, "gender = F", typedTask.Query)
 }
+
+type testTaskV2 struct {
+	Names []string `json:"names" validate:"required"`
+}
+
+func (t *testTaskV2) Timeout() time.Duration { return time.Second }
+
+func (t *testTaskV2) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	return nil
+}
+
+func TestVersionedTasks(t *testing.T) {
+	testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	// version 1 of our task had a single name
+	tasks.RegisterVersionedType("test_versioned", 2, func() tasks.Task { return &testTaskV2{} }, map[int]tasks.Decoder{
+		1: func(data json.RawMessage) (tasks.Task, error) {
+			v1 := &struct {
+				Name string `json:"name"`
+			}{}
+			if err := json.Unmarshal(data, v1); err != nil {
+				return nil, err
+			}
+			return &testTaskV2{Names: []string{v1.Name}}, nil
+		},
+	})
+
+	task, err := tasks.ReadTask("test_versioned", []byte(`{"names": ["Bob", "Ann"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, &testTaskV2{Names: []string{"Bob", "Ann"}}, task)
+
+	task, err = tasks.ReadTaskVersion("test_versioned", 1, []byte(`{"name": "Bob"}`))
+	require.NoError(t, err)
+	assert.Equal(t, &testTaskV2{Names: []string{"Bob"}}, task)
+
+	_, err = tasks.ReadTaskVersion("test_versioned", 3, []byte(`{"names": ["Bob"]}`))
+	assert.EqualError(t, err, "unsupported version 3 of task type 'test_versioned', supported versions are [1 2]")
+
+	// queued tasks are stamped with the current version
+	require.NoError(t, queue.AddTask(rc, queue.BatchQueue, "test_versioned", 1, &testTaskV2{Names: []string{"Bob"}}, queue.DefaultPriority))
+	require.NoError(t, queue.AddTask(rc, queue.BatchQueue, "populate_dynamic_group", 1, &contacts.PopulateDynamicGroupTask{GroupID: 23, Query: "gender = F"}, queue.DefaultPriority))
+
+	queued, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 2, queued.Version)
+	assert.Equal(t, 2, queued.SchemaVersion())
+
+	queued, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 0, queued.Version)
+	assert.Equal(t, 1, queued.SchemaVersion())
+
+	// simulate tasks queued by other releases
+	rc.Do("zadd", "batch:1", 1, `{"type":"test_versioned","org_id":1,"task":{"name":"Bob"},"queued_on":"2021-06-23T15:30:00Z"}`)
+	rc.Do("zadd", "batch:1", 2, `{"type":"test_versioned","org_id":1,"task":{"names":["Bob"]},"queued_on":"2021-06-23T15:31:00Z","version":3}`)
+	rc.Do("zadd", "batch:2", 3, `{"type":"populate_dynamic_group","org_id":2,"task":{"group_id":23},"queued_on":"2021-06-23T15:32:00Z","version":2}`)
+	rc.Do("zadd", "batch:2", 4, `{"type":"populate_dynamic_group","org_id":2,"task":{"group_id":23},"queued_on":"2021-06-23T15:33:00Z"}`)
+	rc.Do("zadd", "batch:active", 0, 1, 0, 2)
+
+	unsupported, err := tasks.FindUnsupportedTasks(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"test_versioned@3": 1, "populate_dynamic_group@2": 1}, unsupported)
+}
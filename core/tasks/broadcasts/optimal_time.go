@@ -0,0 +1,163 @@
+package broadcasts
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	delayedBatchesLock = "delayed_broadcast_batches"
+
+	// sorted set of broadcast batches which are to be queued later, scored by when
+	delayedBatchesKey = "broadcast_batches_delayed"
+)
+
+// StartDelayedBatchesCron starts our cron job of queuing delayed broadcast batches which are now due
+func StartDelayedBatchesCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, delayedBatchesLock, time.Second*60,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return queueDueBatches(ctx, rt.RP, time.Now())
+		},
+	)
+	return nil
+}
+
+// queueOptimalTimeBatches groups the passed in contacts by when they should be sent to based on their response hours,
+// queuing batches which are due now and delaying the rest. The last batch, which includes URN sends and marks the
+// broadcast as sent, is always the latest.
+func queueOptimalTimeBatches(rc redis.Conn, oa *models.OrgAssets, bcast *models.Broadcast, q string, contactIDs map[models.ContactID]bool, repeatedContacts, urnContacts map[models.ContactID]urns.URN, now time.Time) error {
+	ids := make([]models.ContactID, 0, len(contactIDs))
+	for id := range contactIDs {
+		ids = append(ids, id)
+	}
+
+	window := bcast.OptimalTime()
+	tz := oa.Env().Timezone()
+	byTime := make(map[time.Time][]models.ContactID)
+
+	for i := 0; i < len(ids); i += startBatchSize * 10 {
+		chunk := ids[i:min(i+startBatchSize*10, len(ids))]
+
+		hours, err := models.GetContactResponseHours(rc, bcast.OrgID(), chunk)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range chunk {
+			sendOn := window.SendTime(tz, now, hours[id])
+			if !sendOn.After(now) {
+				sendOn = now
+			}
+			byTime[sendOn] = append(byTime[sendOn], id)
+		}
+	}
+
+	times := make([]time.Time, 0, len(byTime))
+	for t := range byTime {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	lastOn := now
+	if len(times) > 0 {
+		lastOn = times[len(times)-1]
+	}
+
+	queueBatch := func(sendOn time.Time, batch *models.BroadcastBatch) error {
+		if sendOn.After(now) {
+			return delayBatch(rc, sendOn, batch)
+		}
+		return queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+	}
+
+	for _, t := range times {
+		contacts := byTime[t]
+		for len(contacts) > startBatchSize {
+			if err := queueBatch(t, bcast.CreateBatch(contacts[:startBatchSize])); err != nil {
+				return errors.Wrapf(err, "error queuing broadcast batch")
+			}
+			contacts = contacts[startBatchSize:]
+		}
+
+		if t.Equal(lastOn) {
+			byTime[t] = contacts
+		} else if len(contacts) > 0 {
+			if err := queueBatch(t, bcast.CreateBatch(contacts)); err != nil {
+				return errors.Wrapf(err, "error queuing broadcast batch")
+			}
+		}
+	}
+
+	// our last batch includes whatever remains of the latest send time plus those contacts that overlap with our urns
+	contacts := byTime[lastOn]
+	for id := range repeatedContacts {
+		contacts = append(contacts, id)
+	}
+
+	batch := bcast.CreateBatch(contacts)
+	batch.SetIsLast(true)
+	batch.SetURNs(urnContacts)
+
+	return errors.Wrapf(queueBatch(lastOn, batch), "error queuing broadcast batch")
+}
+
+// delayBatch adds the passed in batch to our set of batches to be queued at the given time
+func delayBatch(rc redis.Conn, sendOn time.Time, batch *models.BroadcastBatch) error {
+	member, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling broadcast batch")
+	}
+	_, err = rc.Do("ZADD", delayedBatchesKey, sendOn.Unix(), member)
+	return err
+}
+
+// queueDueBatches queues all delayed batches which are due as of the passed in time
+func queueDueBatches(ctx context.Context, rp *redis.Pool, now time.Time) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	members, err := redis.ByteSlices(rc.Do("ZRANGEBYSCORE", delayedBatchesKey, "-inf", now.Unix()))
+	if err != nil {
+		return errors.Wrapf(err, "error fetching due broadcast batches")
+	}
+
+	for _, member := range members {
+		batch := &models.BroadcastBatch{}
+		if err := json.Unmarshal(member, batch); err != nil {
+			logrus.WithError(err).WithField("batch", string(member)).Error("error unmarshalling delayed broadcast batch, discarding")
+		} else if err := queue.AddTask(rc, queue.BatchQueue, queue.SendBroadcastBatch, int(batch.OrgID()), batch, queue.DefaultPriority); err != nil {
+			return errors.Wrapf(err, "error queuing delayed broadcast batch")
+		}
+
+		if _, err := rc.Do("ZREM", delayedBatchesKey, member); err != nil {
+			return errors.Wrapf(err, "error removing delayed broadcast batch")
+		}
+	}
+
+	if len(members) > 0 {
+		logrus.WithField("count", len(members)).Info("queued delayed broadcast batches")
+	}
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,87 @@
+package broadcasts
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimalTimeBatches(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// cathy is most responsive three hours from now, we know nothing about george
+	now := time.Now()
+	err = models.RecordContactResponse(rc, oa, testdata.Cathy.ID, now.Add(time.Hour*3))
+	require.NoError(t, err)
+
+	bcast := &models.Broadcast{}
+	err = json.Unmarshal([]byte(fmt.Sprintf(`{
+		"org_id": %d,
+		"translations": {"eng": {"text": "hello"}},
+		"base_language": "eng",
+		"contact_ids": [%d, %d],
+		"optimal_time": {"start_hour": 0, "end_hour": 0}
+	}`, testdata.Org1.ID, testdata.Cathy.ID, testdata.George.ID)), bcast)
+	require.NoError(t, err)
+
+	err = CreateBroadcastBatches(ctx, db, rp, bcast)
+	require.NoError(t, err)
+
+	// george's batch is queued right away
+	size, err := queue.Size(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	batch := &models.BroadcastBatch{}
+	require.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.Equal(t, []models.ContactID{testdata.George.ID}, batch.ContactIDs())
+	assert.False(t, batch.IsLast())
+
+	// cathy's is delayed
+	delayed, err := redis.Int(rc.Do("ZCARD", delayedBatchesKey))
+	require.NoError(t, err)
+	assert.Equal(t, 1, delayed)
+
+	// and isn't queued until it's due
+	err = queueDueBatches(ctx, rp, now.Add(time.Hour))
+	require.NoError(t, err)
+
+	size, err = queue.Size(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	err = queueDueBatches(ctx, rp, now.Add(time.Hour*3))
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	batch = &models.BroadcastBatch{}
+	require.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.Equal(t, []models.ContactID{testdata.Cathy.ID}, batch.ContactIDs())
+	assert.True(t, batch.IsLast())
+
+	delayed, err = redis.Int(rc.Do("ZCARD", delayedBatchesKey))
+	require.NoError(t, err)
+	assert.Equal(t, 0, delayed)
+}
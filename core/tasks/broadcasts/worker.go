@@ -3,6 +3,7 @@ package broadcasts
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -12,6 +13,7 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -24,6 +26,7 @@ const (
 func init() {
 	mailroom.AddTaskFunction(queue.SendBroadcast, handleSendBroadcast)
 	mailroom.AddTaskFunction(queue.SendBroadcastBatch, handleSendBroadcastBatch)
+	mailroom.AddInitFunction(StartDelayedBatchesCron)
 }
 
 // handleSendBroadcast creates all the batches of contacts that need to be sent to
@@ -46,6 +49,48 @@ func handleSendBroadcast(ctx context.Context, rt *runtime.Runtime, task *queue.T
 
 // CreateBroadcastBatches takes our master broadcast and creates batches of broadcast sends for all the unique contacts
 func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast *models.Broadcast) error {
+	if bcast.IdempotencyKey() == "" {
+		return createBroadcastBatches(ctx, db, rp, bcast)
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// RapidPro claims the key before creating a broadcast, so a broadcast whose key was completed by another broadcast
+	// is a duplicate that slipped past that and mustn't be sent again
+	if bcast.ID() != models.NilBroadcastID {
+		originalID, err := models.IdempotentRequestResult(rc, bcast.OrgID(), models.IdempotencyScopeBroadcast, bcast.IdempotencyKey())
+		if err != nil {
+			return err
+		}
+		if originalID != "" && originalID != fmt.Sprint(bcast.ID()) {
+			logrus.WithFields(logrus.Fields{"broadcast_id": bcast.ID(), "original_broadcast_id": originalID, "idempotency_key": bcast.IdempotencyKey()}).Error("broadcast duplicates an earlier broadcast with the same idempotency key")
+			return models.MarkBroadcastFailed(ctx, db, bcast.ID())
+		}
+		return createBroadcastBatches(ctx, db, rp, bcast)
+	}
+
+	// broadcasts from flows don't have an id to claim the key with, so it's held until their batches are queued
+	_, replay, err := models.StartIdempotentRequest(rc, bcast.OrgID(), models.IdempotencyScopeBroadcast, bcast.IdempotencyKey())
+	if err != nil {
+		return err
+	}
+	if replay {
+		logrus.WithField("idempotency_key", bcast.IdempotencyKey()).Info("ignoring replayed broadcast")
+		return nil
+	}
+
+	if err := createBroadcastBatches(ctx, db, rp, bcast); err != nil {
+		if abandonErr := models.AbandonIdempotentRequest(rc, bcast.OrgID(), models.IdempotencyScopeBroadcast, bcast.IdempotencyKey()); abandonErr != nil {
+			logrus.WithError(abandonErr).Error("error releasing broadcast idempotency key")
+		}
+		return err
+	}
+
+	return models.CompleteIdempotentRequest(rc, bcast.OrgID(), models.IdempotencyScopeBroadcast, bcast.IdempotencyKey(), "queued")
+}
+
+func createBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast *models.Broadcast) error {
 	// we are building a set of contact ids, start with the explicit ones
 	contactIDs := make(map[models.ContactID]bool)
 	for _, id := range bcast.ContactIDs() {
@@ -90,6 +135,11 @@ func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bc
 	rc := rp.Get()
 	defer rc.Close()
 
+	// if this broadcast opted into sending at each contact's optimal time, batches are grouped by send time instead
+	if bcast.OptimalTime() != nil {
+		return queueOptimalTimeBatches(rc, oa, bcast, q, contactIDs, repeatedContacts, urnContacts, time.Now())
+	}
+
 	contacts := make([]models.ContactID, 0, 100)
 
 	// utility functions for queueing the current set of contacts
@@ -109,7 +159,7 @@ func CreateBroadcastBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bc
 			batch.SetURNs(urnContacts)
 		}
 
-		err = queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+		err = queue.AddTracedTask(ctx, rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
 		if err != nil {
 			logrus.WithError(err).Error("error while queuing broadcast batch")
 		}
@@ -173,5 +223,18 @@ func SendBroadcastBatch(ctx context.Context, db *sqlx.DB, rp *redis.Pool, bcast
 	}
 
 	msgio.SendMessages(ctx, db, rp, nil, msgs)
+
+	// our messages exist regardless so a failure to queue their indexing isn't a failure of this batch
+	rc := rp.Get()
+	defer rc.Close()
+
+	msgIDs := make([]models.MsgID, len(msgs))
+	for i, m := range msgs {
+		msgIDs[i] = models.MsgID(m.ID())
+	}
+	if err := indexing.QueueIndexMsgs(rc, msgIDs); err != nil {
+		logrus.WithError(err).WithField("broadcast_id", bcast.BroadcastID()).Error("error queuing broadcast msgs for indexing")
+	}
+
 	return nil
 }
@@ -2,6 +2,7 @@ package broadcasts
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -287,3 +288,81 @@ func TestBroadcastTask(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestBroadcastIdempotency(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rp := testsuite.RP()
+	db := testsuite.DB()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	translations := map[envs.Language]*models.BroadcastTranslation{envs.Language("eng"): {Text: "hello once"}}
+
+	// broadcasts from flows have no id, so are only protected by holding their key
+	bcast := models.NewBroadcast(testdata.Org1.ID, models.NilBroadcastID, translations, models.TemplateStateEvaluated, envs.Language("eng"), nil, []models.ContactID{testdata.Cathy.ID}, nil, models.NilTicketID).
+		WithIdempotencyKey("5c8fa0e3-5a2d-4a0b-9b3c-8c2a7f1b6e11")
+
+	countBatches := func() int {
+		count := 0
+		for {
+			task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+			require.NoError(t, err)
+			if task == nil {
+				return count
+			}
+			count++
+		}
+	}
+
+	err := CreateBroadcastBatches(ctx, db, rp, bcast)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countBatches())
+
+	// a retry of the same broadcast doesn't queue anything
+	err = CreateBroadcastBatches(ctx, db, rp, bcast)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countBatches())
+
+	// broadcasts from RapidPro have their key claimed before they're created, and are given the id of what was created
+	insertBroadcast := func() models.BroadcastID {
+		var id models.BroadcastID
+		err := db.Get(&id,
+			`INSERT INTO msgs_broadcast(status, text, base_language, is_active, created_on, modified_on, send_all, created_by_id, modified_by_id, org_id)
+								 VALUES('Q', '"eng"=>"hello once"'::hstore, 'eng', TRUE, NOW(), NOW(), FALSE, 1, 1, 1) RETURNING id`)
+		require.NoError(t, err)
+		return id
+	}
+
+	_, replay, err := models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeBroadcast, "b0b6c0c4")
+	require.NoError(t, err)
+	assert.False(t, replay)
+
+	bcast1ID := insertBroadcast()
+
+	err = models.CompleteIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeBroadcast, "b0b6c0c4", fmt.Sprint(bcast1ID))
+	require.NoError(t, err)
+
+	bcast1 := models.NewBroadcast(testdata.Org1.ID, bcast1ID, translations, models.TemplateStateEvaluated, envs.Language("eng"), nil, []models.ContactID{testdata.Cathy.ID}, nil, models.NilTicketID).
+		WithIdempotencyKey("b0b6c0c4")
+
+	// a retry of the broadcast task still queues its batches
+	for i := 0; i < 2; i++ {
+		err = CreateBroadcastBatches(ctx, db, rp, bcast1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, countBatches())
+	}
+
+	// but a duplicate broadcast created with the same key isn't sent and is failed
+	bcast2ID := insertBroadcast()
+	bcast2 := models.NewBroadcast(testdata.Org1.ID, bcast2ID, translations, models.TemplateStateEvaluated, envs.Language("eng"), nil, []models.ContactID{testdata.Cathy.ID}, nil, models.NilTicketID).
+		WithIdempotencyKey("b0b6c0c4")
+
+	err = CreateBroadcastBatches(ctx, db, rp, bcast2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countBatches())
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_broadcast WHERE id = $1 AND status = 'F'`, []interface{}{bcast2ID}, 1)
+}
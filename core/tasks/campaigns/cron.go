@@ -25,6 +25,10 @@ const (
 	campaignsLock = "campaign_event"
 
 	maxBatchSize = 100
+
+	// claims on fires expire after this, which is longer than any fire task can run, so that claims of workers which
+	// die are released
+	fireClaimExpiration = time.Hour * 3
 )
 
 func init() {
@@ -37,6 +41,10 @@ func StartCampaignCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool)
 		func(lockName string, lockValue string) error {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 			defer cancel()
+
+			if err := skipOverdueEventFires(ctx, rt, time.Now()); err != nil {
+				logrus.WithError(err).Error("error skipping overdue campaign event fires")
+			}
 			return fireCampaignEvents(ctx, rt.DB, rt.RP, lockName, lockValue)
 		},
 	)
@@ -44,6 +52,25 @@ func StartCampaignCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool)
 	return nil
 }
 
+// skipOverdueEventFires skips fires which are so overdue that they must have been scheduled in the past by clock skew
+// or migrations, if that's enabled
+func skipOverdueEventFires(ctx context.Context, rt *runtime.Runtime, now time.Time) error {
+	if rt.Config.CampaignFiresOverdueHours <= 0 {
+		return nil
+	}
+
+	skipped, err := models.SkipOverdueEventFires(ctx, rt.DB, now.Add(-time.Hour*time.Duration(rt.Config.CampaignFiresOverdueHours)))
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logrus.WithField("comp", "campaign_events").WithField("count", skipped).Warn("skipped overdue campaign event fires")
+	}
+	librato.Gauge("mr.campaign_event_fires_overdue", float64(skipped))
+
+	return nil
+}
+
 // fireCampaignEvents looks for all expired campaign event fires and queues them to be started
 func fireCampaignEvents(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string, lockValue string) error {
 	log := logrus.WithField("comp", "campaign_events").WithField("lock", lockValue)
@@ -155,6 +182,36 @@ func fireCampaignEvents(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockNa
 	return nil
 }
 
+// StalledEventFires returns which of the passed in unfired event fires were queued but aren't claimed, which means their
+// task was lost or the worker firing them died. They won't be queued again until their queued marker expires.
+func StalledEventFires(ctx context.Context, db *sqlx.DB, rc redis.Conn, fireIDs []models.FireID) ([]models.FireID, error) {
+	queued := make([]models.FireID, 0, len(fireIDs))
+	for _, id := range fireIDs {
+		isQueued, err := marker.HasTask(rc, campaignsLock, fmt.Sprintf("%d", id))
+		if err != nil {
+			return nil, errors.Wrap(err, "error checking task lock")
+		}
+		if isQueued {
+			queued = append(queued, id)
+		}
+	}
+	if len(queued) == 0 {
+		return queued, nil
+	}
+
+	return models.UnclaimedEventFires(ctx, db, queued, fireClaimExpiration)
+}
+
+// UnmarkEventFires forgets that the passed in event fires were queued so that they are queued again by our cron
+func UnmarkEventFires(rc redis.Conn, fireIDs []models.FireID) error {
+	for _, id := range fireIDs {
+		if err := marker.RemoveTask(rc, campaignsLock, fmt.Sprintf("%d", id)); err != nil {
+			return errors.Wrap(err, "error removing task lock")
+		}
+	}
+	return nil
+}
+
 type eventFireRow struct {
 	FireID       int64           `db:"fire_id"`
 	EventID      int64           `db:"event_id"`
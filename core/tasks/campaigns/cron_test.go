@@ -49,6 +49,54 @@ func TestCampaigns(t *testing.T) {
 	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) from flows_flowrun WHERE contact_id = $1 AND flow_id = $2;`, []interface{}{testdata.George.ID, testdata.Favorites.ID}, 1)
 }
 
+func TestRepeatingCampaigns(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+	ctx := testsuite.CTX()
+
+	rt := testsuite.RT()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// configure our event to repeat daily, at most twice
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"campaign_repeats": {"10000": {"interval": 1, "unit": "D", "max_repeats": 2}}}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	rt.DB.MustExec(`INSERT INTO contacts_contactgroup_contacts(contactgroup_id, contact_id) SELECT group_id, $1 FROM campaigns_campaign WHERE id = $2 ON CONFLICT DO NOTHING`, testdata.Cathy.ID, testdata.RemindersCampaign.ID)
+	models.FlushCache()
+
+	fire := func() {
+		rt.DB.MustExec(`UPDATE campaigns_eventfire SET scheduled = NOW() WHERE fired IS NULL`)
+		time.Sleep(10 * time.Millisecond)
+
+		err := fireCampaignEvents(ctx, rt.DB, rt.RP, campaignsLock, "lock")
+		require.NoError(t, err)
+
+		task, err := queue.PopNextTask(rc, queue.BatchQueue)
+		require.NoError(t, err)
+		require.NotNil(t, task)
+
+		typedTask, err := tasks.ReadTask(task.Type, task.Task)
+		require.NoError(t, err)
+
+		err = typedTask.Perform(ctx, rt, models.OrgID(task.OrgID))
+		require.NoError(t, err)
+	}
+
+	rt.DB.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW(), $1, $2);`, testdata.Cathy.ID, testdata.RemindersEvent1.ID)
+
+	// firing the original schedules the first repeat for tomorrow
+	fire()
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND fired IS NULL AND scheduled > NOW() + interval '23 hours'`, []interface{}{testdata.Cathy.ID, testdata.RemindersEvent1.ID}, 1)
+
+	// firing that schedules the second
+	fire()
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND fired IS NULL`, []interface{}{testdata.Cathy.ID, testdata.RemindersEvent1.ID}, 1)
+
+	// but firing the second doesn't schedule any more
+	fire()
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND fired IS NULL`, []interface{}{testdata.Cathy.ID, testdata.RemindersEvent1.ID}, 0)
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND fired IS NOT NULL`, []interface{}{testdata.Cathy.ID, testdata.RemindersEvent1.ID}, 3)
+}
+
 func TestIVRCampaigns(t *testing.T) {
 	testsuite.Reset()
 	ctx := testsuite.CTX()
@@ -94,3 +142,106 @@ func TestIVRCampaigns(t *testing.T) {
 
 	assert.Equal(t, task.Type, queue.StartIVRFlowBatch)
 }
+
+func TestDuplicateCampaignFires(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+
+	rt := testsuite.RT()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	rt.DB.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW(), $1, $3), (NOW(), $2, $3);`, testdata.Cathy.ID, testdata.George.ID, testdata.RemindersEvent1.ID)
+	time.Sleep(10 * time.Millisecond)
+
+	err := fireCampaignEvents(ctx, rt.DB, rt.RP, campaignsLock, "lock")
+	assert.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+
+	typedTask, err := tasks.ReadTask(task.Type, task.Task)
+	require.NoError(t, err)
+
+	// perform the same task twice as would happen if overlapping crons both queued it
+	require.NoError(t, typedTask.Perform(ctx, rt, models.OrgID(task.OrgID)))
+	require.NoError(t, typedTask.Perform(ctx, rt, models.OrgID(task.OrgID)))
+
+	// each contact only got one run
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) from flows_flowrun WHERE contact_id = $1 AND flow_id = $2;`, []interface{}{testdata.Cathy.ID, testdata.Favorites.ID}, 1)
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) from flows_flowrun WHERE contact_id = $1 AND flow_id = $2;`, []interface{}{testdata.George.ID, testdata.Favorites.ID}, 1)
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE event_id = $1 AND fired_result = 'F'`, []interface{}{testdata.RemindersEvent1.ID}, 2)
+
+	// loading fires which have already been fired returns nothing
+	fires, err := models.LoadEventFires(ctx, rt.DB, typedTask.(*FireCampaignEventTask).FireIDs)
+	require.NoError(t, err)
+	assert.Len(t, fires, 0)
+}
+
+func TestClaimEventFires(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	db := testsuite.DB()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW(), $1, $3), (NOW(), $2, $3);`, testdata.Cathy.ID, testdata.George.ID, testdata.RemindersEvent1.ID)
+
+	var fireIDs []models.FireID
+	require.NoError(t, db.Select(&fireIDs, `SELECT id FROM campaigns_eventfire ORDER BY id`))
+	fires := []*models.EventFire{{FireID: fireIDs[0]}, {FireID: fireIDs[1]}}
+
+	claimed, err := models.ClaimEventFires(ctx, db, fires, time.Minute)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, fires, claimed)
+
+	// fires can't be claimed again until they're released
+	claimed, err = models.ClaimEventFires(ctx, db, fires, time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, claimed, 0)
+
+	unclaimed, err := models.UnclaimedEventFires(ctx, db, fireIDs, time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, unclaimed, 0)
+
+	require.NoError(t, models.UnclaimEventFires(ctx, db, fires[1:]))
+
+	unclaimed, err = models.UnclaimedEventFires(ctx, db, fireIDs, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, fireIDs[1:], unclaimed)
+
+	claimed, err = models.ClaimEventFires(ctx, db, fires, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, fires[1:], claimed)
+
+	// or until their claims expire
+	db.MustExec(`UPDATE campaigns_eventfire SET claimed_on = NOW() - INTERVAL '2 minutes' WHERE id = $1`, fireIDs[0])
+
+	claimed, err = models.ClaimEventFires(ctx, db, fires, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, fires[:1], claimed)
+}
+
+func TestSkipOverdueEventFires(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+
+	rt.DB.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW() - INTERVAL '10 days', $1, $3), (NOW() - INTERVAL '1 hour', $2, $3);`, testdata.Cathy.ID, testdata.George.ID, testdata.RemindersEvent1.ID)
+
+	// overdue fires aren't skipped by default
+	err := skipOverdueEventFires(ctx, rt, time.Now())
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE fired IS NULL`, nil, 2)
+
+	rt.Config.CampaignFiresOverdueHours = 24 * 7
+	defer func() { rt.Config.CampaignFiresOverdueHours = 0 }()
+
+	err = skipOverdueEventFires(ctx, rt, time.Now())
+	assert.NoError(t, err)
+
+	// fire scheduled 10 days ago is skipped, but fire scheduled an hour ago will be fired
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired_result = 'S'`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, rt.DB, `SELECT COUNT(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NULL`, []interface{}{testdata.George.ID}, 1)
+}
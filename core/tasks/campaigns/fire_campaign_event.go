@@ -54,6 +54,10 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 
 	// grab all the fires for this event
 	fires, err := models.LoadEventFires(ctx, db, t.FireIDs)
+	if err == nil {
+		// and claim those which another worker isn't already firing
+		fires, err = models.ClaimEventFires(ctx, db, fires, fireClaimExpiration)
+	}
 	if err != nil {
 		// unmark all these fires as fires so they can retry
 		rc := rp.Get()
@@ -66,7 +70,7 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 		rc.Close()
 
 		// if we had an error, return that
-		return errors.Wrapf(err, "error loading event fire from db: %v", t.FireIDs)
+		return errors.Wrapf(err, "error loading event fires: %v", t.FireIDs)
 	}
 
 	// no fires returned
@@ -89,18 +93,38 @@ func (t *FireCampaignEventTask) Perform(ctx context.Context, rt *runtime.Runtime
 		delete(contactMap, contactID)
 	}
 
-	// what remains in our contact map are fires that failed for some reason, umark these
+	// what remains in our contact map are fires that failed for some reason, unclaim and umark these
 	if len(contactMap) > 0 {
+		failed := make([]*models.EventFire, 0, len(contactMap))
 		rc := rp.Get()
-		for _, failed := range contactMap {
-			marker.RemoveTask(rc, campaignsLock, fmt.Sprintf("%d", failed.FireID))
+		for _, fire := range contactMap {
+			marker.RemoveTask(rc, campaignsLock, fmt.Sprintf("%d", fire.FireID))
+			failed = append(failed, fire)
 		}
 		rc.Close()
+
+		if uerr := models.UnclaimEventFires(ctx, db, failed); uerr != nil {
+			log.WithError(uerr).Error("error unclaiming failed campaign fires")
+		}
 	}
 
 	if err != nil {
 		return errors.Wrapf(err, "error firing campaign events: %d", t.FireIDs)
 	}
 
+	// if this event repeats, schedule its next occurrence for the contacts it fired for
+	oa, err := models.GetOrgAssets(ctx, db, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets")
+	}
+	event := oa.CampaignEventByID(models.CampaignEventID(t.EventID))
+	if event != nil {
+		if repeat := oa.Org().CampaignRepeat(event.ID()); repeat != nil {
+			if err := models.ScheduleCampaignRepeats(ctx, db, oa, event, repeat, fires); err != nil {
+				return errors.Wrapf(err, "error scheduling repeats of campaign event: %d", t.EventID)
+			}
+		}
+	}
+
 	return nil
 }
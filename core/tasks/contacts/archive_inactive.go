@@ -0,0 +1,141 @@
+package contacts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/utils/locker"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeArchiveInactiveContacts is the type of the task to archive contacts who haven't been seen in a while
+const TypeArchiveInactiveContacts = "archive_inactive_contacts"
+
+const (
+	archiveInactiveLock    = "archive_inactive_contacts"
+	archiveInactiveLockKey = "archive_inactive_contacts_%d"
+	archiveBatchSize       = 100
+)
+
+func init() {
+	tasks.RegisterType(TypeArchiveInactiveContacts, func() tasks.Task { return &ArchiveInactiveContactsTask{} })
+	mailroom.AddInitFunction(StartArchiveInactiveCron)
+}
+
+// StartArchiveInactiveCron starts our cron job of queuing archive tasks for orgs with an archival policy every hour
+func StartArchiveInactiveCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, archiveInactiveLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return queueArchiveTasks(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// queues a task to archive inactive contacts for each org which has configured an archival policy
+func queueArchiveTasks(ctx context.Context, rt *runtime.Runtime) error {
+	orgIDs, err := models.OrgIDsWithConfig(ctx, rt.DB, "archive_inactive_months")
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, orgID := range orgIDs {
+		err := queue.AddTask(rc, queue.BatchQueue, TypeArchiveInactiveContacts, int(orgID), &ArchiveInactiveContactsTask{}, queue.LowPriority)
+		if err != nil {
+			return errors.Wrapf(err, "error queuing archive task for org: %d", orgID)
+		}
+	}
+
+	return nil
+}
+
+// ArchiveInactiveContactsTask is our task to archive the contacts in an org who haven't been seen for the number of months
+// set by the org's archival policy
+type ArchiveInactiveContactsTask struct{}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ArchiveInactiveContactsTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform archives inactive contacts in batches
+func (t *ArchiveInactiveContactsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	months := oa.Org().ArchiveInactiveMonths()
+	if months <= 0 {
+		return nil
+	}
+
+	// only one archival per org at a time
+	lockKey := fmt.Sprintf(archiveInactiveLockKey, orgID)
+	lock, err := locker.GrabLock(rt.RP, lockKey, time.Hour, time.Second*10)
+	if err != nil {
+		return errors.Wrapf(err, "error grabbing lock to archive contacts for org: %d", orgID)
+	}
+	if lock == "" {
+		return nil
+	}
+	defer locker.ReleaseLock(rt.RP, lockKey, lock)
+
+	start := time.Now()
+	since := start.AddDate(0, -months, 0)
+	archived := 0
+
+	for {
+		contactIDs, err := models.ContactIDsNotSeenSince(ctx, rt.DB, orgID, since, archiveBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "error selecting inactive contacts for org: %d", orgID)
+		}
+		if len(contactIDs) == 0 {
+			break
+		}
+
+		contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+		if err != nil {
+			return errors.Wrapf(err, "error loading inactive contacts for org: %d", orgID)
+		}
+		if len(contacts) == 0 {
+			break
+		}
+
+		_, err = models.ChangeContactStatuses(ctx, rt.DB, rt.RP, oa, models.NilUserID, contacts, flows.ContactStatusArchived)
+		if err != nil {
+			return errors.Wrapf(err, "error archiving inactive contacts for org: %d", orgID)
+		}
+
+		archived += len(contacts)
+
+		if len(contactIDs) < archiveBatchSize {
+			break
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":   orgID,
+		"months":   months,
+		"archived": archived,
+		"elapsed":  time.Since(start),
+	}).Info("archived inactive contacts")
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package contacts_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveInactiveContactsTask(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	// Cathy was last seen a year ago, Bob has never been seen and was created a year ago, George was seen recently
+	db.MustExec(`UPDATE contacts_contact SET last_seen_on = NOW() - INTERVAL '1 year' WHERE id = $1`, testdata.Cathy.ID)
+	db.MustExec(`UPDATE contacts_contact SET last_seen_on = NULL, created_on = NOW() - INTERVAL '1 year' WHERE id = $1`, testdata.Bob.ID)
+	db.MustExec(`UPDATE contacts_contact SET last_seen_on = NOW() WHERE id = $1`, testdata.George.ID)
+	db.MustExec(`UPDATE contacts_contact SET last_seen_on = NOW() WHERE org_id = $1 AND id NOT IN ($2, $3)`, testdata.Org1.ID, testdata.Cathy.ID, testdata.Bob.ID)
+
+	// without a policy, nothing is archived
+	task := &contacts.ArchiveInactiveContactsTask{}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE status = 'V'`, nil, 0)
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"archive_inactive_months": 6}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	orgIDs, err := models.OrgIDsWithConfig(ctx, db, "archive_inactive_months")
+	require.NoError(t, err)
+	require.Equal(t, []models.OrgID{testdata.Org1.ID}, orgIDs)
+
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE status = 'V'`, nil, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2) AND status = 'V'`, []interface{}{testdata.Cathy.ID, testdata.Bob.ID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND status = 'A'`, []interface{}{testdata.George.ID}, 1)
+
+	// and archived contacts aren't selected again
+	ids, err := models.ContactIDsNotSeenSince(ctx, db, testdata.Org1.ID, time.Now().AddDate(0, -6, 0), 100)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(ids))
+}
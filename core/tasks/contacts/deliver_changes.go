@@ -0,0 +1,157 @@
+package contacts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	deliverChangesLock = "deliver_contact_changes"
+
+	// the number of changes in each request, and the number of requests made to an org's webhook in each run
+	changesBatchSize  = 100
+	changesMaxBatches = 10
+
+	// the header with the signature of each request's body if the org's webhook has a secret
+	changesSignatureHeader = "X-Mailroom-Signature"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartDeliverChangesCron)
+}
+
+// StartDeliverChangesCron starts our cron job of delivering contact changes to org webhooks every 10 seconds
+func StartDeliverChangesCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, deliverChangesLock, time.Second*10,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return DeliverContactChanges(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// changesPayload is the body of each request to an org's contact webhook. The cursor is the sequence number of the last
+// change, and receivers can ignore any change with a sequence number they've already seen.
+type changesPayload struct {
+	Cursor  int64                   `json:"cursor"`
+	Changes []*models.ContactChange `json:"changes"`
+}
+
+// DeliverContactChanges delivers the queued contact changes of each org to its webhook. If delivery to an org fails,
+// its changes stay queued and the next attempt is backed off.
+func DeliverContactChanges(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	orgIDs, err := models.OrgIDsWithContactChanges(rc)
+	if err != nil {
+		return err
+	}
+
+	for _, orgID := range orgIDs {
+		log := logrus.WithField("org_id", orgID)
+
+		backedOff, err := models.ContactChangesBackedOff(rc, orgID)
+		if err != nil {
+			return err
+		}
+		if backedOff {
+			continue
+		}
+
+		oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+		if err != nil {
+			log.WithError(err).Error("unable to load org assets to deliver contact changes")
+			continue
+		}
+
+		webhook := oa.Org().ContactWebhook()
+		if webhook == nil {
+			if err := models.ClearContactChanges(rc, orgID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i := 0; i < changesMaxBatches; i++ {
+			changes, err := models.LoadContactChanges(rc, orgID, changesBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(changes) == 0 {
+				break
+			}
+
+			cursor := changes[len(changes)-1].Seq
+
+			if err := deliverChanges(rt, webhook, &changesPayload{Cursor: cursor, Changes: changes}); err != nil {
+				backoff, err2 := models.BackoffContactChanges(rc, orgID)
+				if err2 != nil {
+					return err2
+				}
+				log.WithError(err).WithField("url", webhook.URL).WithField("backoff", backoff).Warn("error delivering contact changes")
+				break
+			}
+
+			if err := models.AckContactChanges(rc, orgID, cursor); err != nil {
+				return err
+			}
+			if len(changes) < changesBatchSize {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// makes a single request to the given webhook, returning an error unless it responds with a 2XX status
+func deliverChanges(rt *runtime.Runtime, webhook *models.ContactWebhook, payload *changesPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding contact changes")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RapidProMailroom/"+rt.Config.Version)
+
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		req.Header.Set(changesSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client, _, access := goflow.HTTP(rt.Config)
+
+	trace, err := httpx.DoTrace(client, req, nil, access, 1024)
+	if err != nil {
+		return err
+	}
+	if trace.Response.StatusCode/100 != 2 {
+		return errors.Errorf("webhook responded with status %d", trace.Response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package contacts_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliverContactChanges(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://example.com/contacts": {
+			httpx.NewMockResponse(503, nil, `unavailable`),
+			httpx.NewMockResponse(200, nil, `{"ok": true}`),
+		},
+	}))
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// without a webhook, changes aren't recorded
+	err = models.RecordContactChanges(rc, oa, []*models.ContactChange{models.NewContactChange(models.ContactChangeTypeCreated, testdata.Cathy.UUID, nil)})
+	require.NoError(t, err)
+
+	orgIDs, err := models.OrgIDsWithContactChanges(rc)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(orgIDs))
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"contact_webhook": {"url": "https://example.com/contacts", "secret": "sesame"}}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err = models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	err = models.RecordContactChanges(rc, oa, []*models.ContactChange{
+		models.NewContactChange(models.ContactChangeTypeCreated, testdata.Cathy.UUID, nil),
+		models.NewContactChange(models.ContactChangeTypeUpdated, testdata.Bob.UUID, []string{"fields.age", "name"}),
+	})
+	require.NoError(t, err)
+
+	changes, err := models.LoadContactChanges(rc, testdata.Org1.ID, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(changes))
+	assert.Equal(t, int64(1), changes[0].Seq)
+	assert.Equal(t, testdata.Cathy.UUID, changes[0].ContactUUID)
+	assert.Equal(t, int64(2), changes[1].Seq)
+	assert.Equal(t, []string{"fields.age", "name"}, changes[1].Changed)
+
+	// first delivery fails so changes stay queued and we back off
+	err = contacts.DeliverContactChanges(ctx, rt)
+	require.NoError(t, err)
+
+	changes, err = models.LoadContactChanges(rc, testdata.Org1.ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(changes))
+
+	backedOff, err := models.ContactChangesBackedOff(rc, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.True(t, backedOff)
+
+	// and trying again before the backoff has passed doesn't make a request
+	err = contacts.DeliverContactChanges(ctx, rt)
+	require.NoError(t, err)
+
+	rc.Do("DEL", "contact_changes_backoff:1")
+
+	// second delivery succeeds and changes are removed
+	err = contacts.DeliverContactChanges(ctx, rt)
+	require.NoError(t, err)
+
+	changes, err = models.LoadContactChanges(rc, testdata.Org1.ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(changes))
+
+	orgIDs, err = models.OrgIDsWithContactChanges(rc)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(orgIDs))
+
+	// new changes continue the sequence
+	err = models.RecordContactChanges(rc, oa, []*models.ContactChange{models.NewContactChange(models.ContactChangeTypeDeleted, testdata.George.UUID, nil)})
+	require.NoError(t, err)
+
+	changes, err = models.LoadContactChanges(rc, testdata.Org1.ID, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(changes))
+	assert.Equal(t, int64(3), changes[0].Seq)
+	assert.Equal(t, models.ContactChangeTypeDeleted, changes[0].Type)
+}
@@ -0,0 +1,193 @@
+package contacts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/utils/locker"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeExpireValues is the type of the task to clear the temporary field values and group memberships which have expired
+const TypeExpireValues = "expire_values"
+
+const (
+	expireValuesLock      = "expire_values"
+	expireValuesLockKey   = "expire_values_%d"
+	expireValuesBatchSize = 100
+)
+
+func init() {
+	tasks.RegisterType(TypeExpireValues, func() tasks.Task { return &ExpireValuesTask{} })
+	mailroom.AddInitFunction(StartExpireValuesCron)
+}
+
+// StartExpireValuesCron starts our cron job of queuing tasks to expire values for orgs which have values due every minute
+func StartExpireValuesCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, expireValuesLock, time.Minute,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return queueExpireValuesTasks(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// queues a task to expire values for each org which has values which have expired
+func queueExpireValuesTasks(ctx context.Context, rt *runtime.Runtime) error {
+	orgIDs, err := models.OrgIDsWithDueValueExpiries(ctx, rt.DB, dates.Now())
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, orgID := range orgIDs {
+		err := queue.AddTask(rc, queue.BatchQueue, TypeExpireValues, int(orgID), &ExpireValuesTask{}, queue.DefaultPriority)
+		if err != nil {
+			return errors.Wrapf(err, "error queuing expire values task for org: %d", orgID)
+		}
+	}
+
+	return nil
+}
+
+// ExpireValuesTask is our task to clear the temporary field values and remove the temporary group memberships of an org
+// which have expired. Values are cleared by modifiers so the same events are created as when they're cleared by a flow.
+type ExpireValuesTask struct{}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ExpireValuesTask) Timeout() time.Duration {
+	return time.Minute * 15
+}
+
+// Perform clears expired values in batches
+func (t *ExpireValuesTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	// only one expiry task per org at a time
+	lockKey := fmt.Sprintf(expireValuesLockKey, orgID)
+	lock, err := locker.GrabLock(rt.RP, lockKey, time.Minute*15, time.Second*10)
+	if err != nil {
+		return errors.Wrapf(err, "error grabbing lock to expire values for org: %d", orgID)
+	}
+	if lock == "" {
+		return nil
+	}
+	defer locker.ReleaseLock(rt.RP, lockKey, lock)
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	// expiries reference fields by id so build a lookup of them
+	fields, _ := oa.Fields()
+	fieldsByID := make(map[int]*models.Field, len(fields))
+	for _, f := range fields {
+		field := f.(*models.Field)
+		fieldsByID[int(field.ID())] = field
+	}
+
+	start := time.Now()
+	expired := 0
+
+	for {
+		expiries, err := models.LoadDueValueExpiries(ctx, rt.DB, orgID, dates.Now(), expireValuesBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(expiries) == 0 {
+			break
+		}
+
+		if err := expireValues(ctx, rt, oa, fieldsByID, expiries); err != nil {
+			return err
+		}
+
+		expired += len(expiries)
+
+		if len(expiries) < expireValuesBatchSize {
+			break
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":  orgID,
+		"expired": expired,
+		"elapsed": time.Since(start),
+	}).Info("expired temporary values")
+
+	return nil
+}
+
+// clears the given expired values and deletes their expiries. Expiries of values whose field or group has been deleted
+// or whose contact is no longer active are just deleted.
+func expireValues(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, fieldsByID map[int]*models.Field, expiries []*models.ValueExpiry) error {
+	ids := make([]models.ValueExpiryID, len(expiries))
+	byContact := make(map[models.ContactID][]flows.Modifier)
+	contactIDs := make([]models.ContactID, 0, len(expiries))
+
+	for i, e := range expiries {
+		ids[i] = e.ID
+
+		var mod flows.Modifier
+		switch e.Type {
+		case models.ValueExpiryTypeField:
+			if field := fieldsByID[e.ItemID]; field != nil {
+				if flowField := oa.SessionAssets().Fields().Get(field.Key()); flowField != nil {
+					mod = modifiers.NewField(flowField, "")
+				}
+			}
+		case models.ValueExpiryTypeGroup:
+			if group := oa.GroupByID(models.GroupID(e.ItemID)); group != nil {
+				if flowGroup := oa.SessionAssets().Groups().Get(group.UUID()); flowGroup != nil {
+					mod = modifiers.NewGroups([]*flows.Group{flowGroup}, modifiers.GroupsRemove)
+				}
+			}
+		}
+		if mod == nil {
+			continue
+		}
+
+		if _, seen := byContact[e.ContactID]; !seen {
+			contactIDs = append(contactIDs, e.ContactID)
+		}
+		byContact[e.ContactID] = append(byContact[e.ContactID], mod)
+	}
+
+	if len(contactIDs) > 0 {
+		contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+		if err != nil {
+			return errors.Wrapf(err, "error loading contacts with expired values")
+		}
+
+		modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+		for _, c := range contacts {
+			flowContact, err := c.FlowContact(oa)
+			if err != nil {
+				return errors.Wrapf(err, "error creating flow contact for contact: %d", c.ID())
+			}
+			modifiersByContact[flowContact] = byContact[c.ID()]
+		}
+
+		if _, err := models.ApplyModifiers(ctx, rt.DB, rt.RP, oa, modifiersByContact); err != nil {
+			return errors.Wrapf(err, "error clearing expired values")
+		}
+	}
+
+	return models.DeleteValueExpiries(ctx, rt.DB, ids)
+}
@@ -0,0 +1,90 @@
+package contacts_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/modifiers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireValuesTask(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	// values of gender last for an hour and membership of the doctors group for a day
+	db.MustExec(fmt.Sprintf(`UPDATE orgs_org SET config = '{"temporary_values": {"fields": {"gender": 3600}, "groups": {"%s": 86400}}}'::jsonb WHERE id = $1`, testdata.DoctorsGroup.UUID), testdata.Org1.ID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contact_id = $1 AND contactgroup_id = $2`, testdata.Bob.ID, testdata.DoctorsGroup.ID)
+	models.FlushCache()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	bob, err := models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Bob.ID})
+	require.NoError(t, err)
+	flowBob, err := bob[0].FlowContact(oa)
+	require.NoError(t, err)
+
+	gender := oa.SessionAssets().Fields().Get("gender")
+	age := oa.SessionAssets().Fields().Get("age")
+	doctors := oa.SessionAssets().Groups().Get(testdata.DoctorsGroup.UUID)
+
+	// give Bob a gender and age and add him to the doctors group
+	_, err = models.ApplyModifiers(ctx, db, rp, oa, map[*flows.Contact][]flows.Modifier{
+		flowBob: {
+			modifiers.NewField(gender, "Male"),
+			modifiers.NewField(age, "40"),
+			modifiers.NewGroups([]*flows.Group{doctors}, modifiers.GroupsAdd),
+		},
+	})
+	require.NoError(t, err)
+
+	// only the temporary values have expiries
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry WHERE contact_id = $1`, []interface{}{testdata.Bob.ID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry WHERE contact_id = $1 AND expiry_type = 'F' AND item_id = $2 AND expires_on > NOW() + INTERVAL '59 minutes'`, []interface{}{testdata.Bob.ID, testdata.GenderField.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry WHERE contact_id = $1 AND expiry_type = 'G' AND item_id = $2 AND expires_on > NOW() + INTERVAL '23 hours'`, []interface{}{testdata.Bob.ID, testdata.DoctorsGroup.ID}, 1)
+
+	// nothing has expired yet
+	task := &contacts.ExpireValuesTask{}
+	require.NoError(t, task.Perform(ctx, rt, testdata.Org1.ID))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry`, nil, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND fields->$2 IS NOT NULL`, []interface{}{testdata.Bob.ID, testdata.GenderField.UUID}, 1)
+
+	// until their time has passed
+	db.MustExec(`UPDATE contacts_contactvalueexpiry SET expires_on = NOW() - INTERVAL '1 minute'`)
+
+	orgIDs, err := models.OrgIDsWithDueValueExpiries(ctx, db, dates.Now())
+	require.NoError(t, err)
+	require.Equal(t, []models.OrgID{testdata.Org1.ID}, orgIDs)
+
+	require.NoError(t, task.Perform(ctx, rt, testdata.Org1.ID))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry`, nil, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND fields->$2 IS NOT NULL`, []interface{}{testdata.Bob.ID, testdata.GenderField.UUID}, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND fields->$2 IS NOT NULL`, []interface{}{testdata.Bob.ID, testdata.AgeField.UUID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1 AND contactgroup_id = $2`, []interface{}{testdata.Bob.ID, testdata.DoctorsGroup.ID}, 0)
+
+	// clearing a temporary value before it expires cancels its expiry
+	bob, err = models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Bob.ID})
+	require.NoError(t, err)
+	flowBob, err = bob[0].FlowContact(oa)
+	require.NoError(t, err)
+
+	_, err = models.ApplyModifiers(ctx, db, rp, oa, map[*flows.Contact][]flows.Modifier{flowBob: {modifiers.NewField(gender, "Male")}})
+	require.NoError(t, err)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry`, nil, 1)
+
+	_, err = models.ApplyModifiers(ctx, db, rp, oa, map[*flows.Contact][]flows.Modifier{flowBob: {modifiers.NewField(gender, "")}})
+	require.NoError(t, err)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactvalueexpiry`, nil, 0)
+}
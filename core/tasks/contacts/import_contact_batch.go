@@ -1,13 +1,20 @@
 package contacts
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
+	"fmt"
+	"path"
 	"time"
 
+	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks"
 	"github.com/nyaruka/mailroom/runtime"
+
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // TypeImportContactBatch is the type of the import contact batch task
@@ -17,9 +24,11 @@ func init() {
 	tasks.RegisterType(TypeImportContactBatch, func() tasks.Task { return &ImportContactBatchTask{} })
 }
 
-// ImportContactBatchTask is our task to import a batch of contacts
+// ImportContactBatchTask is our task to import a batch of contacts, or if it's a preview, to work out how many contacts
+// would be created or updated without actually importing anything
 type ImportContactBatchTask struct {
 	ContactImportBatchID models.ContactImportBatchID `json:"contact_import_batch_id"`
+	Preview              bool                        `json:"preview,omitempty"`
 }
 
 // Timeout is the maximum amount of time the task can run for
@@ -27,16 +36,75 @@ func (t *ImportContactBatchTask) Timeout() time.Duration {
 	return time.Minute * 10
 }
 
-// Perform figures out the membership for a query based group then repopulates it
+// Perform imports or previews the batch
 func (t *ImportContactBatchTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
 	batch, err := models.LoadContactImportBatch(ctx, rt.DB, t.ContactImportBatchID)
 	if err != nil {
 		return errors.Wrapf(err, "unable to load contact import batch with id %d", t.ContactImportBatchID)
 	}
 
-	if err := batch.Import(ctx, rt.DB, orgID); err != nil {
-		return errors.Wrapf(err, "unable to import contact import batch %d", t.ContactImportBatchID)
+	if t.Preview {
+		if err := batch.Preview(ctx, rt.DB, orgID); err != nil {
+			return errors.Wrapf(err, "unable to preview contact import batch %d", t.ContactImportBatchID)
+		}
+		return nil
+	}
+
+	importErr := batch.Import(ctx, rt.DB, rt.RP, orgID)
+
+	// a failed or timed out batch is still finished, so might be the last batch of the import, and as our context may
+	// have expired, the report is generated with a new one
+	reportCtx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+
+	if err := generateErrorReport(reportCtx, rt, orgID, batch.ImportID); err != nil {
+		logrus.WithError(err).WithField("contact_import_id", batch.ImportID).Error("error generating contact import error report")
+	}
+
+	if importErr != nil {
+		return errors.Wrapf(importErr, "unable to import contact import batch %d", t.ContactImportBatchID)
 	}
 
 	return nil
 }
+
+// if every batch of the given import has finished, generates a CSV of the errors of all its records, which is stored
+// and its URL saved on the import
+func generateErrorReport(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, importID models.ContactImportID) error {
+	claimed, err := models.ClaimContactImportErrorReport(ctx, rt.DB, importID)
+	if err != nil || !claimed {
+		return err
+	}
+
+	errs, err := models.LoadContactImportErrors(ctx, rt.DB, importID)
+	if err != nil || len(errs) == 0 {
+		return err
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// records are numbered from zero and the first row of the file is its headers
+	records := make([][]string, 0, len(errs)+1)
+	records = append(records, []string{"Row", "Error"})
+	for _, e := range errs {
+		records = append(records, []string{fmt.Sprint(e.Record + 2), e.Message})
+	}
+
+	content := &bytes.Buffer{}
+	w := csv.NewWriter(content)
+	if err := w.WriteAll(records); err != nil {
+		return errors.Wrapf(err, "error writing error report CSV")
+	}
+
+	filename := path.Join(rt.Config.S3MediaPrefix, "contact_imports", fmt.Sprint(orgID), fmt.Sprintf("%d_errors_%s.csv", importID, uuids.New()))
+
+	url, err := rt.MediaStorageFor(oa.Org().Region()).Put(ctx, filename, "text/csv", content.Bytes())
+	if err != nil {
+		return errors.Wrapf(err, "error storing error report")
+	}
+
+	return models.SetContactImportErrorReport(ctx, rt.DB, importID, url)
+}
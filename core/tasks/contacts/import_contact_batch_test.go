@@ -1,6 +1,8 @@
 package contacts_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	_ "github.com/nyaruka/mailroom/core/handlers"
@@ -8,6 +10,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,3 +33,72 @@ func TestImportContactBatch(t *testing.T) {
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert' AND language = 'eng'`, nil, 1)
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Leah' AND language IS NULL`, nil, 1)
 }
+
+func TestImportContactBatchErrorReport(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	defer testsuite.Reset()
+	defer testsuite.ResetStorage()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batch1ID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Norbert", "urns": ["tel:+16055740001"]},
+		{"name": "Xavier", "urns": ["xyz:1234567"]}
+	]`))
+	batch2ID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Leah", "language": "xxxx", "urns": ["tel:+16055740002"]},
+		{"name": "Leah", "urns": ["tel:+16055740002"]}
+	]`))
+	db.MustExec(`UPDATE contacts_contactimportbatch SET record_start = 2, record_end = 4 WHERE id = $1`, batch2ID)
+
+	// no report until every batch has finished
+	err := (&contacts.ImportContactBatchTask{ContactImportBatchID: batch1ID}).Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimport WHERE id = $1 AND error_report IS NULL`, []interface{}{importID}, 1)
+
+	err = (&contacts.ImportContactBatchTask{ContactImportBatchID: batch2ID}).Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimport WHERE id = $1 AND error_report LIKE '%.csv'`, []interface{}{importID}, 1)
+
+	files, err := filepath.Glob(filepath.Join(testsuite.MediaStorageDir, "media", "contact_imports", "1", "*_errors_*.csv"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+
+	report, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "Row,Error\n"+
+		"3,Unable to find or create contact with URNs xyz:1234567\n"+
+		"4,'xxxx' is not a valid language code\n"+
+		"5,Contact with URN 'tel:+16055740002' is also in record 2\n", string(report))
+
+	// an import without errors gets an empty report
+	importID = testdata.InsertContactImport(db, testdata.Org1)
+	batch3ID := testdata.InsertContactImportBatch(db, importID, []byte(`[{"name": "Bob", "urns": ["tel:+16055740003"]}]`))
+
+	err = (&contacts.ImportContactBatchTask{ContactImportBatchID: batch3ID}).Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimport WHERE id = $1 AND error_report = ''`, []interface{}{importID}, 1)
+}
+
+func TestPreviewContactBatch(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	defer testsuite.Reset()
+
+	importID := testdata.InsertContactImport(db, testdata.Org1)
+	batchID := testdata.InsertContactImportBatch(db, importID, []byte(`[
+		{"name": "Norbert", "language": "eng", "urns": ["tel:+16055740011"]},
+		{"name": "Cathy", "urns": ["tel:+16055741111"]}
+	]`))
+
+	task := &contacts.ImportContactBatchTask{ContactImportBatchID: batchID, Preview: true}
+
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE name = 'Norbert'`, nil, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactimportbatch WHERE id = $1 AND status = 'C' AND num_created = 1 AND num_updated = 1 AND num_errored = 0`, []interface{}{batchID}, 1)
+}
@@ -0,0 +1,76 @@
+package contacts
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeImportGroupSnapshot is the type of the task to import a group membership snapshot into a new group
+const TypeImportGroupSnapshot = "import_group_snapshot"
+
+func init() {
+	tasks.RegisterType(TypeImportGroupSnapshot, func() tasks.Task { return &ImportGroupSnapshotTask{} })
+}
+
+// ImportGroupSnapshotTask is our task to populate a new static group from a stored group membership snapshot
+type ImportGroupSnapshotTask struct {
+	GroupID      models.GroupID `json:"group_id"`
+	SnapshotPath string         `json:"snapshot_path"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ImportGroupSnapshotTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform reads the snapshot, resolves its contacts in this org and adds them to the group in batches
+func (t *ImportGroupSnapshotTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	start := time.Now()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, orgID, models.RefreshGroups)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	_, data, err := rt.MediaStorageFor(oa.Org().Region()).Get(ctx, t.SnapshotPath)
+	if err != nil {
+		return errors.Wrapf(err, "error reading group snapshot: %s", t.SnapshotPath)
+	}
+
+	snapshot := &models.GroupSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return errors.Wrapf(err, "error unmarshalling group snapshot: %s", t.SnapshotPath)
+	}
+
+	contactIDs, err := models.ResolveGroupSnapshot(ctx, rt.DB, orgID, snapshot)
+	if err != nil {
+		return err
+	}
+
+	if err := models.AddContactsToGroupAndCampaigns(ctx, rt.DB, oa, t.GroupID, contactIDs); err != nil {
+		return errors.Wrapf(err, "error adding snapshot contacts to group: %d", t.GroupID)
+	}
+
+	if err := models.UpdateGroupStatus(ctx, rt.DB, t.GroupID, models.GroupStatusReady); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":        orgID,
+		"group_id":      t.GroupID,
+		"snapshot_path": t.SnapshotPath,
+		"snapshot_size": len(snapshot.Contacts),
+		"imported":      len(contactIDs),
+		"elapsed":       time.Since(start),
+	}).Info("imported group snapshot")
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package contacts_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportGroupSnapshotTask(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// put Cathy and Bob in the doctors group, plus a deleted contact who shouldn't be included
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.DoctorsGroup.ID)
+	db.MustExec(`INSERT INTO contacts_contactgroup_contacts(contactgroup_id, contact_id) VALUES($1, $2), ($1, $3), ($1, $4)`, testdata.DoctorsGroup.ID, testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID)
+	db.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, testdata.George.ID)
+
+	snapshot, err := models.CreateGroupSnapshot(ctx, db, testdata.Org1.ID, oa.GroupByID(testdata.DoctorsGroup.ID))
+	require.NoError(t, err)
+	assert.Equal(t, testdata.DoctorsGroup.UUID, snapshot.Group.UUID)
+	require.Len(t, snapshot.Contacts, 2)
+	assert.Equal(t, testdata.Cathy.ID, snapshot.Contacts[0].ID)
+	assert.Equal(t, []urns.URN{urns.URN("tel:+16055741111")}, snapshot.Contacts[0].URNs)
+	assert.Equal(t, testdata.Bob.ID, snapshot.Contacts[1].ID)
+
+	data, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	_, err = rt.MediaStorage.Put(ctx, "/group_snapshots/doctors.json", "application/json", data)
+	require.NoError(t, err)
+
+	// import the snapshot into a new group
+	groupID, _, err := models.CreateStaticGroup(ctx, db, testdata.Org1.ID, testdata.Admin.ID, "Doctors Restored")
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup WHERE id = $1 AND status = 'I'`, []interface{}{groupID}, 1)
+
+	task := &contacts.ImportGroupSnapshotTask{GroupID: groupID, SnapshotPath: "/group_snapshots/doctors.json"}
+	require.NoError(t, task.Perform(ctx, rt, testdata.Org1.ID))
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup WHERE id = $1 AND status = 'R'`, []interface{}{groupID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, []interface{}{groupID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id IN ($2, $3)`, []interface{}{groupID, testdata.Cathy.ID, testdata.Bob.ID}, 2)
+
+	// in other orgs, contacts are matched by their URNs
+	db.MustExec(`UPDATE contacts_contacturn SET org_id = $1, contact_id = $2 WHERE identity = 'tel:+16055742222'`, testdata.Org2.ID, testdata.Org2Contact.ID)
+
+	resolved, err := models.ResolveGroupSnapshot(ctx, db, testdata.Org2.ID, snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ContactID{testdata.Org2Contact.ID}, resolved)
+}
@@ -0,0 +1,129 @@
+package contacts
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/locker"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeMigrateURNs is the type of the task to rewrite URNs in bulk
+const TypeMigrateURNs = "migrate_urns"
+
+const migrateURNsLockKey string = "migrate_urns_%d"
+
+func init() {
+	tasks.RegisterType(TypeMigrateURNs, func() tasks.Task { return &MigrateURNsTask{} })
+}
+
+// MigrateURNsTask is our task to rewrite the URNs of an org in bulk, e.g. for a country code change. URNs whose new
+// identity already exists are skipped unless the collision policy is merge, which merges the contact with the existing
+// URN into the one being migrated, see models.URNCollisionMerge.
+//
+//   {
+//     "scheme": "tel",
+//     "pattern": "^\\+2507(\\d{8})$",
+//     "replacement": "+25078$1",
+//     "collision_policy": "skip"
+//   }
+//
+type MigrateURNsTask struct {
+	Scheme          string                    `json:"scheme"`
+	Pattern         string                    `json:"pattern"`
+	Replacement     string                    `json:"replacement"`
+	CollisionPolicy models.URNCollisionPolicy `json:"collision_policy"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *MigrateURNsTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform rewrites all the matching URNs in the org
+func (t *MigrateURNsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	pattern, err := regexp.Compile(t.Pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid URN pattern: %s", t.Pattern)
+	}
+
+	policy := t.CollisionPolicy
+	if policy == "" {
+		policy = models.URNCollisionSkip
+	}
+
+	// only one migration per org at a time
+	lockKey := fmt.Sprintf(migrateURNsLockKey, orgID)
+	lock, err := locker.GrabLock(rt.RP, lockKey, time.Hour, time.Minute*5)
+	if err != nil {
+		return errors.Wrapf(err, "error grabbing lock to migrate URNs for org: %d", orgID)
+	}
+	defer locker.ReleaseLock(rt.RP, lockKey, lock)
+
+	log := logrus.WithFields(logrus.Fields{
+		"org_id":  orgID,
+		"scheme":  t.Scheme,
+		"pattern": t.Pattern,
+	})
+	log.Info("starting URN migration")
+
+	counts := make(map[models.URNMigrationResult]int)
+	mergedInto := make([]models.ContactID, 0)
+	err = models.MigrateURNs(ctx, rt.DB, rt.RP, orgID, t.Scheme, pattern, t.Replacement, policy, func(migrations []*models.URNMigration) {
+		for _, m := range migrations {
+			counts[m.Result]++
+			if m.MergedContactID != models.NilContactID {
+				mergedInto = append(mergedInto, m.ContactID)
+			}
+		}
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error migrating URNs for org: %d", orgID)
+	}
+
+	// contacts which had other contacts merged into them may now have fields which put them in other query based groups
+	if len(mergedInto) > 0 {
+		if err := recalculateMergedGroups(ctx, rt, orgID, mergedInto); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"updated": counts[models.URNMigrationUpdated],
+		"merged":  counts[models.URNMigrationMerged],
+		"skipped": counts[models.URNMigrationSkipped],
+		"invalid": counts[models.URNMigrationInvalid],
+	}).Info("completed URN migration")
+
+	return nil
+}
+
+func recalculateMergedGroups(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, contactIDs []models.ContactID) error {
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, orgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets for org: %d", orgID)
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+	if err != nil {
+		return errors.Wrapf(err, "error loading contacts with merged URNs")
+	}
+
+	for _, contact := range contacts {
+		flowContact, err := contact.FlowContact(oa)
+		if err != nil {
+			return errors.Wrapf(err, "error creating flow contact for contact: %d", contact.ID())
+		}
+		if err := models.CalculateDynamicGroups(ctx, rt.DB, oa, flowContact); err != nil {
+			return errors.Wrapf(err, "error recalculating groups for contact: %d", contact.ID())
+		}
+	}
+	return nil
+}
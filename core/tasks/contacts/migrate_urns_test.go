@@ -0,0 +1,29 @@
+package contacts_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateURNsTask(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	task := &contacts.MigrateURNsTask{Scheme: "tel", Pattern: `^\+16055741111$`, Replacement: "+16059991111"}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+16059991111'`, nil, 1)
+
+	task = &contacts.MigrateURNsTask{Scheme: "tel", Pattern: `(`, Replacement: ""}
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	assert.EqualError(t, err, "invalid URN pattern: (: error parsing regexp: missing closing ): `(`")
+}
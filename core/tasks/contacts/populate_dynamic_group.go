@@ -7,6 +7,7 @@ import (
 
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/core/tasks/groups"
 	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/utils/locker"
 
@@ -57,11 +58,18 @@ func (t *PopulateDynamicGroupTask) Perform(ctx context.Context, rt *runtime.Runt
 		return errors.Wrapf(err, "unable to load org when populating group: %d", t.GroupID)
 	}
 
-	count, err := models.PopulateDynamicGroup(ctx, rt.DB, rt.ES, oa, t.GroupID, t.Query)
+	count, changes, err := models.PopulateDynamicGroup(ctx, rt.DB, rt.ES, oa, t.GroupID, t.Query)
 	if err != nil {
 		return errors.Wrapf(err, "error populating dynamic group: %d", t.GroupID)
 	}
 	logrus.WithField("elapsed", time.Since(start)).WithField("count", count).Info("completed populating dynamic group")
 
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := groups.QueueFireGroupChanges(rc, oa, []*models.GroupMembershipChanges{changes}); err != nil {
+		return err
+	}
+
 	return nil
 }
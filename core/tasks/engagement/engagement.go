@@ -0,0 +1,151 @@
+package engagement
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeScoreEngagement is the type of the task to calculate the engagement scores of an org's contacts
+const TypeScoreEngagement = "score_engagement"
+
+const (
+	scoreEngagementLock = "score_engagement"
+
+	// set when an org's contacts have been scored so that each org is scored at most once a day
+	engagementScoredKey = "engagement_scored:%d"
+	engagementScoredTTL = 60 * 60 * 23
+)
+
+func init() {
+	tasks.RegisterType(TypeScoreEngagement, func() tasks.Task { return &ScoreEngagementTask{} })
+	mailroom.AddInitFunction(StartScoreEngagementCron)
+}
+
+// StartScoreEngagementCron starts our cron job of queuing engagement scoring tasks for orgs which have enabled it
+func StartScoreEngagementCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, scoreEngagementLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return queueScoreEngagementTasks(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// queues a task to score engagement for each org which has an engagement field and hasn't been scored today
+func queueScoreEngagementTasks(ctx context.Context, rt *runtime.Runtime) error {
+	orgIDs, err := models.OrgIDsWithConfig(ctx, rt.DB, "engagement_field")
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, orgID := range orgIDs {
+		// only queue if we haven't scored this org recently
+		set, err := rc.Do("SET", fmt.Sprintf(engagementScoredKey, orgID), time.Now().Format(time.RFC3339), "EX", engagementScoredTTL, "NX")
+		if err != nil {
+			return errors.Wrapf(err, "error checking engagement scoring of org: %d", orgID)
+		}
+		if set == nil {
+			continue
+		}
+
+		err = queue.AddTask(rc, queue.BatchQueue, TypeScoreEngagement, int(orgID), &ScoreEngagementTask{}, queue.LowPriority)
+		if err != nil {
+			return errors.Wrapf(err, "error queuing engagement task for org: %d", orgID)
+		}
+	}
+
+	return nil
+}
+
+// ScoreEngagementTask is our task to calculate the engagement scores of all of an org's active contacts
+type ScoreEngagementTask struct{}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ScoreEngagementTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform scores the org's contacts and re-evaluates dynamic group membership for those whose score changed if any
+// groups are based on the score
+func (t *ScoreEngagementTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	field := oa.EngagementField()
+	if field == nil {
+		logrus.WithField("org_id", orgID).Warn("engagement field missing or not a number field, skipping scoring")
+		return nil
+	}
+
+	start := time.Now()
+
+	changed, err := models.ScoreEngagement(ctx, rt.DB, oa, field, start)
+	if err != nil {
+		return errors.Wrapf(err, "error scoring engagement for org: %d", orgID)
+	}
+
+	if len(changed) > 0 && hasGroupsUsingField(oa, field) {
+		if err := recalculateGroups(ctx, rt, oa, changed); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithField("org_id", orgID).WithField("changed", len(changed)).WithField("elapsed", time.Since(start)).Info("scored contact engagement")
+	return nil
+}
+
+// whether any dynamic groups have queries which reference the passed in field
+func hasGroupsUsingField(oa *models.OrgAssets, field *models.Field) bool {
+	groups, _ := oa.Groups()
+	for _, g := range groups {
+		if query := g.(*models.Group).Query(); query != "" && strings.Contains(strings.ToLower(query), field.Key()) {
+			return true
+		}
+	}
+	return false
+}
+
+func recalculateGroups(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, contactIDs []models.ContactID) error {
+	for i := 0; i < len(contactIDs); i += 100 {
+		end := i + 100
+		if end > len(contactIDs) {
+			end = len(contactIDs)
+		}
+
+		contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs[i:end])
+		if err != nil {
+			return errors.Wrapf(err, "error loading contacts")
+		}
+
+		for _, c := range contacts {
+			contact, err := c.FlowContact(oa)
+			if err != nil {
+				return errors.Wrapf(err, "error creating flow contact")
+			}
+			if err := models.CalculateDynamicGroups(ctx, rt.DB, oa, contact); err != nil {
+				return errors.Wrapf(err, "error recalculating dynamic groups for contact: %d", c.ID())
+			}
+		}
+	}
+	return nil
+}
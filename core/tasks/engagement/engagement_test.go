@@ -0,0 +1,43 @@
+package engagement
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScoreEngagement(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"engagement_field": "age"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	// org is queued once for scoring
+	require.NoError(t, queueScoreEngagementTasks(ctx, rt))
+	require.NoError(t, queueScoreEngagementTasks(ctx, rt))
+
+	size, err := queue.Size(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, TypeScoreEngagement, task.Type)
+	assert.Equal(t, int(testdata.Org1.ID), task.OrgID)
+
+	err = (&ScoreEngagementTask{}).Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE org_id = $1 AND is_active = TRUE AND status = 'A' AND NOT fields ? $2`, []interface{}{testdata.Org1.ID, testdata.AgeField.UUID}, 0)
+}
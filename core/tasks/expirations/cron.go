@@ -8,6 +8,7 @@ import (
 
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
 	"github.com/nyaruka/mailroom/runtime"
@@ -30,8 +31,12 @@ func init() {
 	mailroom.AddInitFunction(StartExpirationCron)
 }
 
-// StartExpirationCron starts our cron job of expiring runs every minute
+// StartExpirationCron starts our cron job of expiring runs every minute, unless session waits are only scheduled in redis
 func StartExpirationCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.SessionWaits == config.SessionWaitsRedis {
+		return nil
+	}
+
 	cron.StartCron(quit, rt.RP, expirationLock, time.Second*60,
 		func(lockName string, lockValue string) error {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
@@ -0,0 +1,168 @@
+package expirations
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/utils/marker"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	timersLock          = "expiration_timers"
+	reconcileTimersLock = "expiration_timers_reconcile"
+
+	// maximum number of timers we'll fire per run, anything left over is picked up on the next run
+	maxTimersPerRun = 1000
+
+	// how often we reconcile timers with the database, how far ahead we look, and the most expirations we'll reconcile
+	reconcileInterval   = time.Minute * 10
+	reconcileAhead      = time.Minute * 15
+	maxReconciledTimers = 25000
+)
+
+func init() {
+	mailroom.AddInitFunction(StartTimersCron)
+	mailroom.AddInitFunction(StartReconcileTimersCron)
+}
+
+// StartTimersCron starts our cron job of firing due expiration timers every second, if session waits are scheduled in
+// redis
+func StartTimersCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.SessionWaits == config.SessionWaitsDB {
+		return nil
+	}
+
+	cron.StartCron(quit, rt.RP, timersLock, time.Second,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return fireExpirationTimers(ctx, rt.DB, rt.RP, lockValue)
+		},
+	)
+	return nil
+}
+
+// StartReconcileTimersCron starts our cron job of reconciling expiration timers with the database, if session waits
+// are scheduled in redis
+func StartReconcileTimersCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.SessionWaits == config.SessionWaitsDB {
+		return nil
+	}
+
+	cron.StartCron(quit, rt.RP, reconcileTimersLock, reconcileInterval,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return reconcileExpirationTimers(ctx, rt.DB, rt.RP, time.Now(), lockValue)
+		},
+	)
+	return nil
+}
+
+// fireExpirationTimers pops any due expiration timers and expires their runs the same as the expirations cron does, so
+// whichever gets there first wins. Runs without parents are expired directly, as long as they haven't since waited
+// again, and other runs get an expiration task so that their parent runs can continue.
+func fireExpirationTimers(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockValue string) error {
+	log := logrus.WithFields(logrus.Fields{"comp": "expiration_timers", "lock": lockValue})
+	start := time.Now()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	timers, err := models.PopDueExpirationTimers(rc, start, maxTimersPerRun)
+	if err != nil {
+		return err
+	}
+
+	unparented := make([]models.FlowRunID, 0, len(timers))
+	sessionsByRun := make(map[models.FlowRunID]models.SessionID, len(timers))
+	queued := 0
+
+	for _, timer := range timers {
+		if !timer.HasParent || timer.SessionID == models.SessionID(0) {
+			unparented = append(unparented, timer.RunID)
+			sessionsByRun[timer.RunID] = timer.SessionID
+			continue
+		}
+
+		// check whether the expirations cron already queued this
+		taskID := fmt.Sprintf("%d:%s", timer.RunID, timer.ExpiresOn.Format(time.RFC3339))
+		isQueued, err := marker.HasTask(rc, markerGroup, taskID)
+		if err != nil {
+			return errors.Wrapf(err, "error checking whether expiration is queued")
+		}
+		if isQueued {
+			continue
+		}
+
+		task := handler.NewExpirationTask(timer.OrgID, timer.ContactID, timer.SessionID, timer.RunID, timer.ExpiresOn)
+		if err := handler.QueueHandleTask(rc, timer.ContactID, task); err != nil {
+			return errors.Wrapf(err, "error adding new expiration task")
+		}
+
+		if err := marker.AddTask(rc, markerGroup, taskID); err != nil {
+			return errors.Wrapf(err, "error marking expiration task as queued")
+		}
+
+		queued++
+	}
+
+	expiredRuns := make([]models.FlowRunID, 0, len(unparented))
+	if len(unparented) > 0 {
+		if expiredRuns, err = models.FilterExpiredRuns(ctx, db, unparented, start); err != nil {
+			return err
+		}
+
+		expiredSessions := make([]models.SessionID, 0, len(expiredRuns))
+		for _, runID := range expiredRuns {
+			if sessionID := sessionsByRun[runID]; sessionID != models.SessionID(0) {
+				expiredSessions = append(expiredSessions, sessionID)
+			}
+		}
+
+		if err := models.ExpireRunsAndSessions(ctx, db, expiredRuns, expiredSessions); err != nil {
+			return errors.Wrapf(err, "error expiring runs and sessions")
+		}
+	}
+
+	if queued > 0 || len(expiredRuns) > 0 {
+		log.WithFields(logrus.Fields{"elapsed": time.Since(start), "queued": queued, "expired": len(expiredRuns)}).Info("expiration timers fired")
+	}
+	return nil
+}
+
+// reconcileExpirationTimers schedules timers for the active runs which will expire before our next reconciliation,
+// which catches any that were lost, e.g. because redis was flushed, or that were never scheduled because the session
+// waited before we started scheduling expirations in redis
+func reconcileExpirationTimers(ctx context.Context, db *sqlx.DB, rp *redis.Pool, now time.Time, lockValue string) error {
+	log := logrus.WithFields(logrus.Fields{"comp": "expiration_timers", "lock": lockValue})
+	start := time.Now()
+
+	timers, err := models.LoadUpcomingExpirationTimers(ctx, db, now.Add(reconcileAhead), maxReconciledTimers)
+	if err != nil {
+		return err
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	if err := models.ScheduleExpirationTimers(rc, timers); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{"elapsed": time.Since(start), "count": len(timers)}).Info("expiration timers reconciled")
+	return nil
+}
@@ -0,0 +1,93 @@
+package expirations
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/marker"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationTimers(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	err := marker.ClearTasks(rc, markerGroup)
+	assert.NoError(t, err)
+
+	s1 := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	s2 := testdata.InsertFlowSession(db, testdata.Org1, testdata.George, models.SessionStatusWaiting, nil)
+	s3 := testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.SessionStatusWaiting, nil)
+
+	// simple run, no parent
+	r1ExpiresOn := time.Now()
+	testdata.InsertFlowRun(db, testdata.Org1, s1, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", &r1ExpiresOn)
+
+	// parent run which isn't due until after our next reconciliation, and child run which is due
+	r2ExpiresOn := time.Now().Add(time.Hour * 24)
+	testdata.InsertFlowRun(db, testdata.Org1, s2, testdata.George, testdata.Favorites, models.RunStatusWaiting, "", &r2ExpiresOn)
+	r3ExpiresOn := time.Now()
+	testdata.InsertFlowRun(db, testdata.Org1, s2, testdata.George, testdata.Favorites, models.RunStatusWaiting, "c4126b59-7a61-4ed5-a2da-c7857580355b", &r3ExpiresOn)
+
+	// simple run which waits again after its timer is scheduled
+	r4ExpiresOn := time.Now()
+	r4ID := testdata.InsertFlowRun(db, testdata.Org1, s3, testdata.Bob, testdata.Favorites, models.RunStatusWaiting, "", &r4ExpiresOn)
+
+	// reconciling schedules timers for the runs which are due
+	err = reconcileExpirationTimers(ctx, db, rp, time.Now(), "foo")
+	require.NoError(t, err)
+
+	count, err := redis.Int(rc.Do("ZCARD", "expiration_timers"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	db.MustExec(`UPDATE flows_flowrun SET expires_on = NOW() + INTERVAL '1 day' WHERE id = $1`, r4ID)
+
+	time.Sleep(10 * time.Millisecond)
+
+	err = fireExpirationTimers(ctx, db, rp, "foo")
+	require.NoError(t, err)
+
+	// Cathy's run and session are expired directly
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE is_active = TRUE AND contact_id = $1;`, []interface{}{testdata.Cathy.ID}, 0)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE status = 'X' AND contact_id = $1;`, []interface{}{testdata.Cathy.ID}, 1)
+
+	// George's runs are still active as the parent needs to continue
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE is_active = TRUE AND contact_id = $1;`, []interface{}{testdata.George.ID}, 2)
+
+	// Bob's run has since waited again so isn't expired
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE is_active = TRUE AND contact_id = $1;`, []interface{}{testdata.Bob.ID}, 1)
+
+	// should have created one task for George's child run
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	require.NotNil(t, task)
+
+	eventTask := &handler.HandleEventTask{}
+	err = json.Unmarshal(task.Task, eventTask)
+	assert.NoError(t, err)
+	assert.Equal(t, testdata.George.ID, eventTask.ContactID)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// the expirations cron sees the same expiration as already queued
+	err = expireRuns(ctx, db, rp, expirationLock, "foo")
+	assert.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+}
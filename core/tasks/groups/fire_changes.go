@@ -0,0 +1,211 @@
+package groups
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeFireGroupChanges is the type of the task to notify an org's resthook of contacts entering and leaving groups
+const TypeFireGroupChanges = "fire_group_changes"
+
+// the maximum number of contacts in each resthook payload, larger changes are split across several
+const maxContactsPerPayload = 1000
+
+func init() {
+	tasks.RegisterType(TypeFireGroupChanges, func() tasks.Task { return &FireGroupChangesTask{} })
+}
+
+// QueueFireGroupChanges queues a task to notify the org's resthook of the given changes to dynamic group membership if
+// the org has a resthook for that
+func QueueFireGroupChanges(rc redis.Conn, oa *models.OrgAssets, changes []*models.GroupMembershipChanges) error {
+	if oa.Org().GroupChangesResthook() == "" {
+		return nil
+	}
+
+	nonEmpty := make([]*models.GroupMembershipChanges, 0, len(changes))
+	for _, c := range changes {
+		if !c.IsEmpty() {
+			nonEmpty = append(nonEmpty, c)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil
+	}
+
+	task := &FireGroupChangesTask{Changes: nonEmpty}
+
+	err := queue.AddTask(rc, queue.BatchQueue, TypeFireGroupChanges, int(oa.OrgID()), task, queue.DefaultPriority)
+	return errors.Wrapf(err, "error queuing group changes task")
+}
+
+// FireGroupChangesTask is our task to post changes to dynamic group membership to the subscribers of an org's resthook
+type FireGroupChangesTask struct {
+	Changes []*models.GroupMembershipChanges `json:"changes"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *FireGroupChangesTask) Timeout() time.Duration {
+	return time.Minute * 15
+}
+
+// groupChangesPayload is what's posted to resthook subscribers for each group that contacts entered or left
+type groupChangesPayload struct {
+	Group   *assets.GroupReference `json:"group"`
+	Entered []flows.ContactUUID    `json:"entered"`
+	Left    []flows.ContactUUID    `json:"left"`
+}
+
+// Perform posts a payload for each changed group to each subscriber of the org's resthook
+func (t *FireGroupChangesTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	slug := oa.Org().GroupChangesResthook()
+	resthook := oa.ResthookBySlug(slug)
+	if resthook == nil {
+		logrus.WithField("org_id", orgID).WithField("resthook", slug).Warn("unable to find resthook for group changes, ignoring")
+		return nil
+	}
+
+	payloads, err := t.payloads(ctx, rt, oa)
+	if err != nil {
+		return err
+	}
+
+	webhookEvents := make([]*models.WebhookEvent, 0, len(payloads))
+	unsubs := make([]*models.ResthookUnsubscribe, 0)
+	unsubscribed := make(map[string]bool)
+
+	for _, payload := range payloads {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding group changes")
+		}
+
+		webhookEvents = append(webhookEvents, models.NewWebhookEvent(orgID, resthook.ID(), string(body), time.Now()))
+
+		for _, url := range resthook.Subscribers() {
+			if unsubscribed[url] {
+				continue
+			}
+
+			status, err := post(rt, url, body)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", orgID).WithField("url", url).Warn("error posting group changes to resthook subscriber")
+				continue
+			}
+
+			// like flow resthook calls, a 410 means the subscriber no longer wants to hear from us
+			if status == http.StatusGone {
+				unsubs = append(unsubs, &models.ResthookUnsubscribe{OrgID: orgID, Slug: slug, URL: url})
+				unsubscribed[url] = true
+			}
+		}
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction")
+	}
+
+	if err := models.InsertWebhookEvents(ctx, tx, webhookEvents); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error inserting webhook events")
+	}
+	if len(unsubs) > 0 {
+		if err := models.UnsubscribeResthooks(ctx, tx, unsubs); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return errors.Wrapf(tx.Commit(), "error committing group changes")
+}
+
+// builds the payloads for our changes, splitting large changes into several payloads
+func (t *FireGroupChangesTask) payloads(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets) ([]*groupChangesPayload, error) {
+	contactIDs := make([]models.ContactID, 0)
+	for _, c := range t.Changes {
+		contactIDs = append(contactIDs, c.Entered...)
+		contactIDs = append(contactIDs, c.Left...)
+	}
+
+	uuids, err := models.LoadContactUUIDs(ctx, rt.DB, contactIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	toUUIDs := func(ids []models.ContactID) []flows.ContactUUID {
+		us := make([]flows.ContactUUID, 0, len(ids))
+		for _, id := range ids {
+			if uuid, found := uuids[id]; found {
+				us = append(us, uuid)
+			}
+		}
+		return us
+	}
+
+	payloads := make([]*groupChangesPayload, 0, len(t.Changes))
+
+	for _, c := range t.Changes {
+		group := oa.GroupByID(c.GroupID)
+		if group == nil {
+			continue
+		}
+		ref := assets.NewGroupReference(group.UUID(), group.Name())
+
+		entered, left := toUUIDs(c.Entered), toUUIDs(c.Left)
+
+		for len(entered) > 0 || len(left) > 0 {
+			p := &groupChangesPayload{Group: ref}
+			p.Entered, entered = split(entered, maxContactsPerPayload)
+			p.Left, left = split(left, maxContactsPerPayload-len(p.Entered))
+			payloads = append(payloads, p)
+		}
+	}
+
+	return payloads, nil
+}
+
+func split(uuids []flows.ContactUUID, n int) ([]flows.ContactUUID, []flows.ContactUUID) {
+	if len(uuids) <= n {
+		return uuids, []flows.ContactUUID{}
+	}
+	return uuids[:n], uuids[n:]
+}
+
+// posts the given body to a resthook subscriber, returning the status of the response
+func post(rt *runtime.Runtime, url string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RapidProMailroom/"+rt.Config.Version)
+
+	client, retries, access := goflow.HTTP(rt.Config)
+
+	trace, err := httpx.DoTrace(client, req, retries, access, 1024)
+	if err != nil {
+		return 0, err
+	}
+	return trace.Response.StatusCode, nil
+}
@@ -0,0 +1,55 @@
+package groups_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/groups"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFireGroupChanges(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://example.com/segments": {httpx.NewMockResponse(200, nil, `{"ok": true}`)},
+		"https://example.com/gone":     {httpx.NewMockResponse(410, nil, `gone`)},
+	}))
+
+	var resthookID models.ResthookID
+	db.Get(&resthookID, `INSERT INTO api_resthook(is_active, slug, org_id, created_on, modified_on, created_by_id, modified_by_id) VALUES(TRUE, 'group-changes', 1, NOW(), NOW(), 1, 1) RETURNING id`)
+	db.MustExec(`INSERT INTO api_resthooksubscriber(is_active, created_on, modified_on, target_url, created_by_id, modified_by_id, resthook_id) VALUES(TRUE, NOW(), NOW(), 'https://example.com/segments', 1, 1, $1)`, resthookID)
+	db.MustExec(`INSERT INTO api_resthooksubscriber(is_active, created_on, modified_on, target_url, created_by_id, modified_by_id, resthook_id) VALUES(TRUE, NOW(), NOW(), 'https://example.com/gone', 1, 1, $1)`, resthookID)
+	db.MustExec(`UPDATE orgs_org SET config = '{"group_changes_resthook": "group-changes"}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	task := &groups.FireGroupChangesTask{Changes: []*models.GroupMembershipChanges{
+		{GroupID: testdata.DoctorsGroup.ID, Entered: []models.ContactID{testdata.Cathy.ID, testdata.George.ID}, Left: []models.ContactID{testdata.Bob.ID}},
+	}}
+
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// the payload is recorded as a webhook event
+	var data string
+	err = db.Get(&data, `SELECT data FROM api_webhookevent WHERE resthook_id = $1`, resthookID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"group": {"uuid": "c153e265-f7c9-4539-9dbc-9b358714b638", "name": "Doctors"},
+		"entered": ["6393abc0-283d-4c9b-a1b3-641a035c34bf", "8d024bcd-f473-4719-a00a-bd0bb1190135"],
+		"left": ["b699a406-7e44-49be-9f01-1a82893e8a10"]
+	}`, data)
+
+	// and the subscriber which responded with a 410 is unsubscribed
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_resthooksubscriber WHERE resthook_id = $1 AND is_active = TRUE`, []interface{}{resthookID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_resthooksubscriber WHERE target_url = 'https://example.com/gone' AND is_active = FALSE`, nil, 1)
+}
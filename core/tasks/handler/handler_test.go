@@ -17,6 +17,7 @@ import (
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -368,6 +369,59 @@ func TestStopEvent(t *testing.T) {
 	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, []interface{}{testdata.George.ID}, 1)
 }
 
+func TestDeleteContactEvent(t *testing.T) {
+	testsuite.Reset()
+	rt := testsuite.RT()
+	db := rt.DB
+	rp := rt.RP
+	ctx := testsuite.CTX()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`INSERT INTO api_resthook(is_active, slug, org_id, created_on, modified_on, created_by_id, modified_by_id) VALUES(TRUE, 'contact-deleted', 1, NOW(), NOW(), 1, 1);`)
+	db.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW(), $1, $2);`, testdata.Cathy.ID, testdata.RemindersEvent1.ID)
+
+	// cathy and george are both waiting in sessions
+	cathySessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	georgeSessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.George, models.SessionStatusWaiting, nil)
+
+	event := models.NewChannelEvent(models.DeleteContactEventType, testdata.Org1.ID, testdata.TwilioChannel.ID, testdata.Cathy.ID, testdata.Cathy.URNID, nil, false)
+	eventJSON, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	task := &queue.Task{
+		Type:  handler.DeleteContactEventType,
+		OrgID: int(testdata.Org1.ID),
+		Task:  eventJSON,
+	}
+
+	err = handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+
+	err = handler.HandleEvent(ctx, rt, task)
+	require.NoError(t, err)
+
+	// cathy is stopped with no upcoming events
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND status = 'S'`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, []interface{}{testdata.Cathy.ID}, 0)
+
+	// her session was interrupted but george's wasn't
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'I'`, []interface{}{cathySessionID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'W'`, []interface{}{georgeSessionID}, 1)
+
+	// her URN is no longer attached to her
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM contacts_contacturn WHERE id = $1 AND contact_id IS NULL`, []interface{}{testdata.Cathy.URNID}, 1)
+
+	// and the resthook has an event for her
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookevent WHERE data::jsonb->'contact'->>'uuid' = $1 AND data::jsonb->>'urn' = $2`, []interface{}{testdata.Cathy.UUID, testdata.Cathy.URN}, 1)
+}
+
 func TestTimedEvents(t *testing.T) {
 	testsuite.Reset()
 	rt := testsuite.RT()
@@ -542,3 +596,133 @@ func TestTimedEvents(t *testing.T) {
 
 	testsuite.ResetDB()
 }
+
+func TestDuplicateEvents(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	db.MustExec(`DELETE FROM msgs_msg`)
+
+	testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "start", models.MatchOnly, nil, nil)
+
+	models.FlushCache()
+
+	event := &handler.MsgEvent{
+		ContactID: testdata.Cathy.ID,
+		OrgID:     testdata.Org1.ID,
+		ChannelID: testdata.TwitterChannel.ID,
+		MsgID:     flows.MsgID(20001),
+		MsgUUID:   flows.MsgUUID(uuids.New()),
+		URN:       testdata.Cathy.URN,
+		URNID:     testdata.Cathy.URNID,
+		Text:      "start",
+	}
+	eventJSON, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	// queue the same event twice as courier would if it retried delivery
+	for i := 0; i < 2; i++ {
+		task := &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: eventJSON, QueuedOn: time.Now()}
+		err = handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+		require.NoError(t, err)
+	}
+
+	// the duplicate is dropped before it's queued
+	queued, err := redis.Int(rc.Do("LLEN", fmt.Sprintf("c:%d:%d", testdata.Org1.ID, testdata.Cathy.ID)))
+	require.NoError(t, err)
+	assert.Equal(t, 1, queued)
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+
+	err = handler.HandleEvent(ctx, rt, task)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	// so only one of the events is handled
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text = 'What is your favorite color?'`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1`, []interface{}{testdata.Cathy.ID}, 1)
+}
+
+func TestNewerVersionEvents(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	db.MustExec(`DELETE FROM msgs_msg`)
+
+	// an event queued by a newer release whose payload we can't decode
+	task := &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: []byte(`{"contact": {"id": 1}}`), QueuedOn: time.Now(), Version: 2}
+	err := handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+
+	err = handler.HandleEvent(ctx, rt, task)
+	assert.Equal(t, queue.ErrNewerVersion, errors.Cause(err))
+
+	// event should have been put back on the contact's queue
+	queued, err := redis.Strings(rc.Do("lrange", fmt.Sprintf("c:%d:%d", testdata.Org1.ID, testdata.Cathy.ID), 0, -1))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(queued))
+	assert.Contains(t, queued[0], `"version":2`)
+
+	// as is a handle task from a newer release, before any events are popped
+	task.Version = 2
+	err = handler.HandleEvent(ctx, rt, task)
+	assert.Equal(t, queue.ErrNewerVersion, errors.Cause(err))
+
+	count, err := redis.Int(rc.Do("llen", fmt.Sprintf("c:%d:%d", testdata.Org1.ID, testdata.Cathy.ID)))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestReplyContext(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "start", models.MatchOnly, nil, nil)
+
+	models.FlushCache()
+
+	event := &handler.MsgEvent{
+		ContactID:    testdata.Cathy.ID,
+		OrgID:        testdata.Org1.ID,
+		ChannelID:    testdata.TwitterChannel.ID,
+		MsgID:        flows.MsgID(20001),
+		MsgUUID:      flows.MsgUUID(uuids.New()),
+		URN:          testdata.Cathy.URN,
+		URNID:        testdata.Cathy.URNID,
+		Text:         "start",
+		ReplyContext: &models.MsgReplyContext{StoryID: "345", StoryURL: "https://stories.com/345"},
+	}
+	eventJSON, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	task := &queue.Task{Type: handler.MsgEventType, OrgID: int(testdata.Org1.ID), Task: eventJSON, QueuedOn: time.Now()}
+	err = handler.QueueHandleTask(rc, testdata.Cathy.ID, task)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+
+	err = handler.HandleEvent(ctx, rt, task)
+	require.NoError(t, err)
+
+	// the story replied to should be in the params of the session's trigger
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND output::json->'trigger'->'params'->'reply_to'->>'url' = 'https://stories.com/345'`, []interface{}{testdata.Cathy.ID}, 1)
+}
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
@@ -9,15 +11,45 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// how long we remember the content of handled events for, so that duplicates (e.g. from courier retrying delivery of
+// the same msg event) are only handled once
+const dedupWindowSeconds = 120
+
+const dedupKeyPattern = "handler_dedup:%s"
+
+// returns the key used to claim the passed in contact event. Retries of errored events have a different error count so
+// are never duplicates.
+func eventDedupKey(event *queue.Task) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s|%d|%d|", event.Type, event.OrgID, event.ErrorCount)
+	hash.Write(event.Task)
+	return fmt.Sprintf(dedupKeyPattern, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// claimEvent records that the passed in contact event is being queued, returning false if an identical event has
+// already been queued within our dedup window
+func claimEvent(rc redis.Conn, event *queue.Task) (bool, error) {
+	set, err := redis.String(rc.Do("set", eventDedupKey(event), "1", "NX", "EX", dedupWindowSeconds))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error claiming contact event")
+	}
+	return set == "OK", nil
+}
+
 // QueueHandleTask queues a single task for the given contact
 func QueueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task) error {
 	return queueHandleTask(rc, contactID, task, false)
 }
 
 // queueHandleTask queues a single task for the passed in contact. `front` specifies whether the task
-// should be inserted in front of all other tasks for that contact
+// should be inserted in front of all other tasks for that contact, which is how errored tasks are retried so
+// these are never dropped as duplicates.
 func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task, front bool) error {
 	// marshal our task
 	taskJSON, err := json.Marshal(task)
@@ -25,6 +57,22 @@ func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task
 		return errors.Wrapf(err, "error marshalling contact task")
 	}
 
+	// drop this task if an identical one has already been queued
+	if !front {
+		claimed, err := claimEvent(rc, task)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			logger.WithFields(logrus.Fields{
+				"org_id":     task.OrgID,
+				"contact_id": contactID,
+				"event_type": task.Type,
+			}).Info("ignoring duplicate contact event")
+			return nil
+		}
+	}
+
 	// first push the event on our contact queue
 	contactQ := fmt.Sprintf("c:%d:%d", task.OrgID, contactID)
 	if front {
@@ -34,6 +82,10 @@ func queueHandleTask(rc redis.Conn, contactID models.ContactID, task *queue.Task
 		_, err = redis.Int64(rc.Do("rpush", contactQ, string(taskJSON)))
 	}
 	if err != nil {
+		// release our claim so that the task can be queued again
+		if !front {
+			rc.Do("del", eventDedupKey(task))
+		}
 		return errors.Wrapf(err, "error adding contact event")
 	}
 
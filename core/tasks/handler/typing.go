@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"sync"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartTypingIndicators)
+}
+
+// StartTypingIndicators registers a webhook call listener with the engine so that contacts waiting on a webhook call
+// see a typing indicator on channels which support them
+func StartTypingIndicators(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookCallListener(func(session flows.Session) {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		if _, err := msgio.QueueSessionTyping(rc, session); err != nil {
+			logrus.WithError(err).WithField("session_uuid", session.UUID()).Error("error queuing typing indication")
+		}
+	})
+	return nil
+}
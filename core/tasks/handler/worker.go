@@ -20,8 +20,9 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/runner"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
 	"github.com/nyaruka/mailroom/runtime"
-	"github.com/nyaruka/mailroom/utils/locker"
+	"github.com/nyaruka/mailroom/utils/logx"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -37,8 +38,14 @@ const (
 	ExpirationEventType      = "expiration_event"
 	TimeoutEventType         = "timeout_event"
 	TicketClosedEventType    = "ticket_closed"
+	DeleteContactEventType   = string(models.DeleteContactEventType)
 )
 
+// the slug of the resthook which is notified when a contact is deleted by their channel
+const contactDeletedResthook = "contact-deleted"
+
+var logger = logx.Module("handler")
+
 func init() {
 	mailroom.AddTaskFunction(queue.HandleContactEvent, HandleEvent)
 }
@@ -53,6 +60,11 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
+	// tasks queued by a newer release are left for a worker of that release
+	if task.SchemaVersion() > queue.TaskVersion(task.Type) {
+		return errors.Wrapf(queue.ErrNewerVersion, "task of type %s is version %d", task.Type, task.SchemaVersion())
+	}
+
 	eventTask := &HandleEventTask{}
 	err := json.Unmarshal(task.Task, eventTask)
 	if err != nil {
@@ -60,27 +72,26 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 	}
 
 	// acquire the lock for this contact
-	lockID := models.ContactLock(models.OrgID(task.OrgID), eventTask.ContactID)
-	lock, err := locker.GrabLock(rt.RP, lockID, time.Minute*5, time.Second*10)
+	locks, skipped, err := models.LockContacts(rt.RP, models.OrgID(task.OrgID), []models.ContactID{eventTask.ContactID}, time.Second*10)
 	if err != nil {
 		return errors.Wrapf(err, "error acquiring lock for contact %d", eventTask.ContactID)
 	}
 
 	// we didn't get the lock within our timeout, skip and requeue for later
-	if lock == "" {
+	if len(skipped) > 0 {
 		rc := rt.RP.Get()
 		defer rc.Close()
 		err = queueContactTask(rc, models.OrgID(task.OrgID), eventTask.ContactID)
 		if err != nil {
 			return errors.Wrapf(err, "error re-adding contact task after failing to get lock")
 		}
-		logrus.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"org_id":     task.OrgID,
 			"contact_id": eventTask.ContactID,
 		}).Info("failed to get lock for contact, requeued and skipping")
 		return nil
 	}
-	defer locker.ReleaseLock(rt.RP, lockID, lock)
+	defer locks.Release()
 
 	// read all the events for this contact, one by one
 	contactQ := fmt.Sprintf("c:%d:%d", task.OrgID, eventTask.ContactID)
@@ -109,6 +120,17 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 			return errors.Wrapf(err, "error unmarshalling contact event: %s", event)
 		}
 
+		// events queued by a newer release are put back and, with this task, left for a worker of that release
+		if contactEvent.SchemaVersion() > queue.TaskVersion(contactEvent.Type) {
+			rc = rt.RP.Get()
+			_, err = rc.Do("lpush", contactQ, event)
+			rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "error returning contact event to queue")
+			}
+			return errors.Wrapf(queue.ErrNewerVersion, "contact event of type %s is version %d", contactEvent.Type, contactEvent.SchemaVersion())
+		}
+
 		// hand off to the appropriate handler
 		switch contactEvent.Type {
 
@@ -128,6 +150,14 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 			}
 			_, err = HandleChannelEvent(ctx, rt, models.ChannelEventType(contactEvent.Type), evt, nil)
 
+		case DeleteContactEventType:
+			evt := &models.ChannelEvent{}
+			err = json.Unmarshal(contactEvent.Task, evt)
+			if err != nil {
+				return errors.Wrapf(err, "error unmarshalling delete contact event: %s", event)
+			}
+			err = handleDeleteContactEvent(ctx, rt, evt)
+
 		case MsgEventType:
 			msg := &MsgEvent{}
 			err = json.Unmarshal(contactEvent.Task, msg)
@@ -164,7 +194,7 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 
 		// if we get an error processing an event, requeue it for later and return our error
 		if err != nil {
-			log := logrus.WithFields(logrus.Fields{
+			log := logger.WithFields(logrus.Fields{
 				"org_id":     task.OrgID,
 				"contact_id": eventTask.ContactID,
 				"event":      event,
@@ -175,7 +205,7 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 				rc := rt.RP.Get()
 				retryErr := queueHandleTask(rc, eventTask.ContactID, contactEvent, true)
 				if retryErr != nil {
-					logrus.WithError(retryErr).Error("error requeuing errored contact event")
+					logger.WithError(retryErr).Error("error requeuing errored contact event")
 				}
 				rc.Close()
 
@@ -191,7 +221,7 @@ func handleContactEvent(ctx context.Context, rt *runtime.Runtime, task *queue.Ta
 // handleTimedEvent is called for timeout events
 func handleTimedEvent(ctx context.Context, rt *runtime.Runtime, eventType string, event *TimedEvent) error {
 	start := time.Now()
-	log := logrus.WithFields(logrus.Fields{
+	log := logger.WithFields(logrus.Fields{
 		"event_type": eventType,
 		"contact_id": event.ContactID,
 		"run_id":     event.RunID,
@@ -222,7 +252,7 @@ func handleTimedEvent(ctx context.Context, rt *runtime.Runtime, eventType string
 	}
 
 	// get the active session for this contact
-	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorage, oa, models.FlowTypeMessaging, contact)
+	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorageFor(oa.Org().Region()), oa, models.FlowTypeMessaging, contact)
 	if err != nil {
 		return errors.Wrapf(err, "error loading active session for contact")
 	}
@@ -270,6 +300,14 @@ func handleTimedEvent(ctx context.Context, rt *runtime.Runtime, eventType string
 		timeout := *session.TimeoutOn()
 		if !timeout.Equal(event.Time) {
 			log.WithField("event_timeout", event.Time).WithField("session_timeout", timeout).Info("ignoring timeout, has been updated")
+
+			// timeouts are pushed back once the last message is sent, so reschedule our timer to match
+			rc := rt.RP.Get()
+			defer rc.Close()
+
+			if _, err := session.ScheduleTimer(rc, rt.Config); err != nil {
+				return errors.Wrapf(err, "error rescheduling session timer")
+			}
 			return nil
 		}
 
@@ -298,7 +336,7 @@ func HandleChannelEvent(ctx context.Context, rt *runtime.Runtime, eventType mode
 	// load the channel for this event
 	channel := oa.ChannelByID(event.ChannelID())
 	if channel == nil {
-		logrus.WithField("channel_id", event.ChannelID).Info("ignoring event, couldn't find channel")
+		logger.WithField("channel_id", event.ChannelID).Info("ignoring event, couldn't find channel")
 		return nil, nil
 	}
 
@@ -334,6 +372,14 @@ func HandleChannelEvent(ctx context.Context, rt *runtime.Runtime, eventType mode
 		return nil, errors.Wrapf(err, "error creating flow contact")
 	}
 
+	// last_seen_on was updated outside of a session so reschedule any campaign events relative to it
+	if models.ContactSeenEvents[eventType] {
+		err = models.RescheduleCampaignEventsForField(ctx, rt.DB, oa, []*flows.Contact{contact}, models.LastSeenOnKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error rescheduling campaign events")
+		}
+	}
+
 	// do we have associated trigger?
 	var trigger *models.Trigger
 
@@ -363,16 +409,19 @@ func HandleChannelEvent(ctx context.Context, rt *runtime.Runtime, eventType mode
 		if err != nil {
 			return nil, errors.Wrapf(err, "unable to initialize new contact")
 		}
+
+		recordContactCreated(rt, oa, contact)
 	}
 
 	// no trigger, noop, move on
 	if trigger == nil {
-		logrus.WithField("channel_id", event.ChannelID()).WithField("event_type", eventType).WithField("extra", event.Extra()).Info("ignoring channel event, no trigger found")
+		logger.WithField("channel_id", event.ChannelID()).WithField("event_type", eventType).WithField("extra", event.Extra()).Info("ignoring channel event, no trigger found")
 		return nil, nil
 	}
 
-	// load our flow
-	flow, err := oa.FlowByID(trigger.FlowID())
+	// load our flow, which may be split with another flow
+	flowID, variant := trigger.FlowIDForContact(oa.Org(), contact.UUID())
+	flow, err := oa.FlowByID(flowID)
 	if err == models.ErrNotFound {
 		return nil, nil
 	}
@@ -436,7 +485,7 @@ func HandleChannelEvent(ctx context.Context, rt *runtime.Runtime, eventType mode
 		}
 	}
 
-	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{flowTrigger}, hook, true)
+	sessions, err := runner.StartFlowForContactsWithVariant(ctx, rt, oa, flow, []flows.Trigger{flowTrigger}, hook, true, variant)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error starting flow for contact")
 	}
@@ -472,6 +521,83 @@ func handleStopEvent(ctx context.Context, db *sqlx.DB, rp *redis.Pool, event *St
 	return err
 }
 
+// handleDeleteContactEvent is called when a channel tells us that a contact's account has been deleted, e.g. a WhatsApp
+// user deleting their account. The contact is stopped, their sessions interrupted and the URN detached from them.
+func handleDeleteContactEvent(ctx context.Context, rt *runtime.Runtime, event *models.ChannelEvent) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, event.OrgID())
+	if err != nil {
+		return errors.Wrapf(err, "error loading org")
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, []models.ContactID{event.ContactID()})
+	if err != nil {
+		return errors.Wrapf(err, "error loading contact")
+	}
+
+	// contact has already been deleted, nothing to do
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	contact := contacts[0]
+	urn := contact.URNForID(event.URNID())
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "unable to start transaction for deleting contact")
+	}
+
+	err = models.StopContact(ctx, tx, oa.OrgID(), contact.ID())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = models.InterruptContactRuns(ctx, tx, models.FlowTypeMessaging, []flows.ContactID{flows.ContactID(contact.ID())}, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error interrupting sessions of deleted contact")
+	}
+
+	if urn != urns.NilURN {
+		err = models.DetachContactURN(ctx, tx, contact.ID(), event.URNID())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// notify any subscribers that this contact was deleted
+	if resthook := oa.ResthookBySlug(contactDeletedResthook); resthook != nil {
+		payload := map[string]interface{}{
+			"contact":     map[string]interface{}{"uuid": contact.UUID(), "name": contact.Name()},
+			"urn":         urn.Identity(),
+			"occurred_on": event.OccurredOn(),
+		}
+		if channel := oa.ChannelByID(event.ChannelID()); channel != nil {
+			payload["channel"] = channel.ChannelReference()
+		}
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error marshalling contact deleted payload")
+		}
+
+		err = models.InsertWebhookEvents(ctx, tx, []*models.WebhookEvent{models.NewWebhookEvent(oa.OrgID(), resthook.ID(), string(data), time.Now())})
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error inserting contact deleted webhook event")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "unable to commit for contact delete")
+	}
+	return nil
+}
+
 // handleMsgEvent is called when a new message arrives from a contact
 func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) error {
 	oa, err := models.GetOrgAssets(ctx, rt.DB, event.OrgID)
@@ -528,6 +654,14 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		return nil
 	}
 
+	// remember the channel this contact messaged us on so that replies can stick to it
+	rc := rt.RP.Get()
+	err = models.RecordLastChannel(rc, oa, modelContact.ID(), channel)
+	rc.Close()
+	if err != nil {
+		logger.WithError(err).WithField("contact_uuid", contact.UUID()).Error("error recording last channel")
+	}
+
 	// stopped contact? they are unstopped if they send us an incoming message
 	newContact := event.NewContact
 	if modelContact.Status() == models.ContactStatusStopped {
@@ -547,6 +681,11 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		}
 	}
 
+	// contacts are created by courier so this is the first mailroom hears of them
+	if event.NewContact {
+		recordContactCreated(rt, oa, contact)
+	}
+
 	// look up any open tickets for this contact and forward this message to them
 	tickets, err := models.LoadOpenTicketsForContact(ctx, rt.DB, modelContact)
 	if err != nil {
@@ -556,11 +695,44 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		ticket.ForwardIncoming(ctx, rt.DB, oa, event.MsgUUID, event.Text, event.Attachments)
 	}
 
+	// whichever way this message is handled, index it along with the new activity on any tickets once it's committed
+	defer func() {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		if err := indexing.QueueIndexMsgs(rc, []models.MsgID{models.MsgID(event.MsgID)}); err != nil {
+			logger.WithError(err).WithField("msg_uuid", event.MsgUUID).Error("error queuing msg indexing")
+		}
+		if err := indexing.QueueIndexTickets(rc, oa.OrgID(), tickets); err != nil {
+			logger.WithError(err).WithField("contact_uuid", contact.UUID()).Error("error queuing ticket indexing")
+		}
+		if err := models.RecordContactResponse(rc, oa, modelContact.ID(), event.CreatedOn); err != nil {
+			logger.WithError(err).WithField("contact_uuid", contact.UUID()).Error("error recording contact response hour")
+		}
+	}()
+
+	// if this message is a link code for another contact, link them and don't handle it any further
+	if linking := oa.Org().IdentityLinking(); linking != nil && linking.LinkCodes {
+		rc := rt.RP.Get()
+		linked, err := models.RedeemContactLinkCode(ctx, rt.DB, rc, oa.OrgID(), modelContact.ID(), event.Text)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error redeeming contact link code")
+		}
+		if linked {
+			err := models.UpdateMessage(ctx, rt.DB, event.MsgID, models.MsgStatusHandled, models.VisibilityVisible, models.TypeInbox, topupID)
+			if err != nil {
+				return errors.Wrapf(err, "error marking link code message as handled")
+			}
+			return nil
+		}
+	}
+
 	// find any matching triggers
 	trigger := models.FindMatchingMsgTrigger(oa, contact, event.Text)
 
 	// get any active session for this contact
-	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorage, oa, models.FlowTypeMessaging, contact)
+	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorageFor(oa.Org().Region()), oa, models.FlowTypeMessaging, contact)
 	if err != nil {
 		return errors.Wrapf(err, "error loading active session for contact")
 	}
@@ -581,6 +753,9 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 		}
 	}
 
+	// keep a copy of our contact as it was before this message for any shadow session
+	shadowContact := contact.Clone()
+
 	msgIn := flows.NewMsgIn(event.MsgUUID, event.URN, channel.ChannelReference(), event.Text, event.Attachments)
 	msgIn.SetExternalID(string(event.MsgExternalID))
 	msgIn.SetID(event.MsgID)
@@ -611,8 +786,9 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 	// we found a trigger and their session is nil or doesn't ignore keywords
 	if (trigger != nil && trigger.TriggerType() != models.CatchallTriggerType && (flow == nil || !flow.IgnoreTriggers())) ||
 		(trigger != nil && trigger.TriggerType() == models.CatchallTriggerType && (flow == nil)) {
-		// load our flow
-		flow, err := oa.FlowByID(trigger.FlowID())
+		// load our flow, which may be split with another flow
+		flowID, variant := trigger.FlowIDForContact(oa.Org(), contact.UUID())
+		flow, err := oa.FlowByID(flowID)
 		if err != nil && err != models.ErrNotFound {
 			return errors.Wrapf(err, "error loading flow for trigger")
 		}
@@ -642,12 +818,30 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 				return nil
 			}
 
+			// include what this message was a reply to, if the channel told us, so the flow can branch on it
+			var params *types.XObject
+			if event.ReplyContext != nil {
+				params, err = replyContextParams(ctx, rt, channel, event.ReplyContext)
+				if err != nil {
+					return err
+				}
+			}
+
 			// otherwise build the trigger and start the flow directly
-			trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Msg(msgIn).WithMatch(trigger.Match()).Build()
-			_, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, hook, true)
+			match := trigger.Match()
+			trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Msg(msgIn).WithMatch(match).WithParams(params).Build()
+			sessions, err := runner.StartFlowForContactsWithVariant(ctx, rt, oa, flow, []flows.Trigger{trigger}, hook, true, variant)
 			if err != nil {
 				return errors.Wrapf(err, "error starting flow for contact")
 			}
+
+			// run any shadow version of this flow for comparison, failures there never affect the real session
+			if len(sessions) == 1 {
+				err = runner.StartShadowFlow(ctx, rt, oa, flow, shadowContact, msgIn, match, sessions[0])
+				if err != nil {
+					logger.WithError(err).WithField("flow_uuid", flow.UUID()).Error("error starting shadow flow")
+				}
+			}
 			return nil
 		}
 	}
@@ -655,10 +849,15 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 	// if there is a session, resume it
 	if session != nil && flow != nil {
 		resume := resumes.NewMsg(oa.Env(), contact, msgIn)
-		_, err = runner.ResumeFlow(ctx, rt, oa, session, resume, hook)
+		resumed, err := runner.ResumeFlow(ctx, rt, oa, session, resume, hook)
 		if err != nil {
 			return errors.Wrapf(err, "error resuming flow for contact")
 		}
+
+		err = runner.ResumeShadowFlow(ctx, rt, oa, flow, shadowContact, msgIn, resumed)
+		if err != nil {
+			logger.WithError(err).WithField("flow_uuid", flow.UUID()).Error("error resuming shadow flow")
+		}
 		return nil
 	}
 
@@ -670,6 +869,24 @@ func handleMsgEvent(ctx context.Context, rt *runtime.Runtime, event *MsgEvent) e
 	return nil
 }
 
+// builds the trigger params for a message which was a reply to the given context
+func replyContextParams(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, replyContext *models.MsgReplyContext) (*types.XObject, error) {
+	extra, err := models.ReplyContextParams(ctx, rt.DB, channel.ID(), replyContext)
+	if err != nil || extra == nil {
+		return nil, err
+	}
+
+	asJSON, err := json.Marshal(extra)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to marshal reply context")
+	}
+	params, err := types.ReadXObject(asJSON)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read reply context")
+	}
+	return params, nil
+}
+
 func handleTicketEvent(ctx context.Context, rt *runtime.Runtime, event *models.TicketEvent) error {
 	oa, err := models.GetOrgAssets(ctx, rt.DB, event.OrgID())
 	if err != nil {
@@ -719,12 +936,13 @@ func handleTicketEvent(ctx context.Context, rt *runtime.Runtime, event *models.T
 
 	// no trigger, noop, move on
 	if trigger == nil {
-		logrus.WithField("ticket_id", event.TicketID).WithField("event_type", event.EventType()).Info("ignoring ticket event, no trigger found")
+		logger.WithField("ticket_id", event.TicketID).WithField("event_type", event.EventType()).Info("ignoring ticket event, no trigger found")
 		return nil
 	}
 
-	// load our flow
-	flow, err := oa.FlowByID(trigger.FlowID())
+	// load our flow, which may be split with another flow
+	flowID, variant := trigger.FlowIDForContact(oa.Org(), contact.UUID())
+	flow, err := oa.FlowByID(flowID)
 	if err == models.ErrNotFound {
 		return nil
 	}
@@ -759,7 +977,7 @@ func handleTicketEvent(ctx context.Context, rt *runtime.Runtime, event *models.T
 		return errors.Errorf("unknown ticket event type: %s", event.EventType())
 	}
 
-	_, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{flowTrigger}, nil, true)
+	_, err = runner.StartFlowForContactsWithVariant(ctx, rt, oa, flow, []flows.Trigger{flowTrigger}, nil, true, variant)
 	if err != nil {
 		return errors.Wrapf(err, "error starting flow for contact")
 	}
@@ -797,18 +1015,19 @@ type TimedEvent struct {
 }
 
 type MsgEvent struct {
-	ContactID     models.ContactID   `json:"contact_id"`
-	OrgID         models.OrgID       `json:"org_id"`
-	ChannelID     models.ChannelID   `json:"channel_id"`
-	MsgID         flows.MsgID        `json:"msg_id"`
-	MsgUUID       flows.MsgUUID      `json:"msg_uuid"`
-	MsgExternalID null.String        `json:"msg_external_id"`
-	URN           urns.URN           `json:"urn"`
-	URNID         models.URNID       `json:"urn_id"`
-	Text          string             `json:"text"`
-	Attachments   []utils.Attachment `json:"attachments"`
-	NewContact    bool               `json:"new_contact"`
-	CreatedOn     time.Time          `json:"created_on"`
+	ContactID     models.ContactID        `json:"contact_id"`
+	OrgID         models.OrgID            `json:"org_id"`
+	ChannelID     models.ChannelID        `json:"channel_id"`
+	MsgID         flows.MsgID             `json:"msg_id"`
+	MsgUUID       flows.MsgUUID           `json:"msg_uuid"`
+	MsgExternalID null.String             `json:"msg_external_id"`
+	URN           urns.URN                `json:"urn"`
+	URNID         models.URNID            `json:"urn_id"`
+	Text          string                  `json:"text"`
+	Attachments   []utils.Attachment      `json:"attachments"`
+	ReplyContext  *models.MsgReplyContext `json:"reply_context,omitempty"`
+	NewContact    bool                    `json:"new_contact"`
+	CreatedOn     time.Time               `json:"created_on"`
 }
 
 type StopEvent struct {
@@ -850,3 +1069,14 @@ func NewTimeoutTask(orgID models.OrgID, contactID models.ContactID, sessionID mo
 func NewExpirationTask(orgID models.OrgID, contactID models.ContactID, sessionID models.SessionID, runID models.FlowRunID, time time.Time) *queue.Task {
 	return newTimedTask(ExpirationEventType, orgID, contactID, sessionID, runID, time)
 }
+
+// records the creation of a contact by courier for delivery to the org's contact webhook
+func recordContactCreated(rt *runtime.Runtime, oa *models.OrgAssets, contact *flows.Contact) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	change := models.NewContactChange(models.ContactChangeTypeCreated, contact.UUID(), nil)
+	if err := models.RecordContactChanges(rc, oa, []*models.ContactChange{change}); err != nil {
+		logrus.WithError(err).WithField("contact_uuid", contact.UUID()).Error("error recording contact creation")
+	}
+}
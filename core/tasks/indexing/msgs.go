@@ -0,0 +1,95 @@
+package indexing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	indexMsgsLock      = "index_msgs"
+	msgsToIndexKey     = "msgs_to_index"
+	indexMsgsBatchSize = 500
+)
+
+func init() {
+	mailroom.AddInitFunction(StartIndexMsgsCron)
+}
+
+// StartIndexMsgsCron starts our cron job of indexing queued messages every 5 seconds
+func StartIndexMsgsCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, indexMsgsLock, time.Second*5,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return IndexQueuedMsgs(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// QueueIndexMsgs marks the passed in messages as needing indexing. Messages are much more numerous than tickets so rather
+// than a task for each change, ids are collected in a set which our cron indexes in batches.
+func QueueIndexMsgs(rc redis.Conn, ids []models.MsgID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := rc.Do("SADD", redis.Args{}.Add(msgsToIndexKey).AddFlat(ids)...)
+	return errors.Wrapf(err, "error queuing msg indexing")
+}
+
+// IndexQueuedMsgs indexes all messages which have been queued for indexing
+func IndexQueuedMsgs(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	// without elastic there's nowhere to index to, so don't let the queue grow
+	if rt.ES == nil {
+		_, err := rc.Do("DEL", msgsToIndexKey)
+		return errors.Wrapf(err, "error clearing msgs to index")
+	}
+
+	start := time.Now()
+	indexed := 0
+
+	for {
+		popped, err := redis.Int64s(rc.Do("SPOP", msgsToIndexKey, indexMsgsBatchSize))
+		if err != nil {
+			return errors.Wrapf(err, "error popping msgs to index")
+		}
+		if len(popped) == 0 {
+			break
+		}
+
+		ids := make([]models.MsgID, len(popped))
+		for i := range popped {
+			ids[i] = models.MsgID(popped[i])
+		}
+
+		if err := models.IndexMsgs(ctx, rt.DB, rt.ES, ids); err != nil {
+			// put these back so they're retried next time
+			if qerr := QueueIndexMsgs(rc, ids); qerr != nil {
+				logrus.WithError(qerr).Error("error requeuing msgs to index")
+			}
+			return err
+		}
+
+		indexed += len(ids)
+	}
+
+	if indexed > 0 {
+		logrus.WithField("indexed", indexed).WithField("elapsed", time.Since(start)).Info("indexed msgs")
+	}
+
+	return nil
+}
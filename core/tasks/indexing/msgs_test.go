@@ -0,0 +1,41 @@
+package indexing_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueIndexMsgs(t *testing.T) {
+	ctx, _, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	err := indexing.QueueIndexMsgs(rc, []models.MsgID{1001, 1002})
+	require.NoError(t, err)
+
+	// queuing the same message again doesn't index it twice
+	err = indexing.QueueIndexMsgs(rc, []models.MsgID{1002, 1003})
+	require.NoError(t, err)
+
+	count, err := redis.Int(rc.Do("SCARD", "msgs_to_index"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// without elastic, queued messages are discarded
+	err = indexing.IndexQueuedMsgs(ctx, rt)
+	require.NoError(t, err)
+
+	count, err = redis.Int(rc.Do("SCARD", "msgs_to_index"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
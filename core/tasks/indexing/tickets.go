@@ -0,0 +1,57 @@
+package indexing
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// TypeIndexTickets is the type of the task to update the search index documents of tickets
+const TypeIndexTickets = "index_tickets"
+
+func init() {
+	tasks.RegisterType(TypeIndexTickets, func() tasks.Task { return &IndexTicketsTask{} })
+}
+
+// IndexTicketsTask is our task for updating the search index documents of tickets which have changed
+//
+//   {
+//     "ticket_ids": [1234, 2345]
+//   }
+//
+type IndexTicketsTask struct {
+	TicketIDs []models.TicketID `json:"ticket_ids" validate:"required"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *IndexTicketsTask) Timeout() time.Duration {
+	return time.Minute
+}
+
+// Perform indexes our tickets
+func (t *IndexTicketsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	return models.IndexTickets(ctx, rt.DB, rt.ES, orgID, t.TicketIDs)
+}
+
+// QueueIndexTickets queues a task to index the passed in tickets, which should be called after any changes to them
+// have been committed
+func QueueIndexTickets(rc redis.Conn, orgID models.OrgID, tickets []*models.Ticket) error {
+	if len(tickets) == 0 {
+		return nil
+	}
+
+	ids := make([]models.TicketID, len(tickets))
+	for i, t := range tickets {
+		ids[i] = t.ID()
+	}
+
+	err := queue.AddTask(rc, queue.BatchQueue, TypeIndexTickets, int(orgID), &IndexTicketsTask{TicketIDs: ids}, queue.DefaultPriority)
+	return errors.Wrapf(err, "error queuing ticket indexing")
+}
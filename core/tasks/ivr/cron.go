@@ -101,7 +101,7 @@ func retryCalls(ctx context.Context, config *config.Config, db *sqlx.DB, rp *red
 			continue
 		}
 
-		err = ivr.RequestCallStartForConnection(ctx, config, db, channel, urn, conn)
+		err = ivr.RequestCallStartForConnection(ctx, config, db, oa, channel, urn, conn)
 		if err != nil {
 			log.WithError(err).Error(err)
 			continue
@@ -89,10 +89,22 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 
 	// for each contacts, request a call start
 	for _, contact := range contacts {
+		// stop if we've run out of time, calls already requested will still be made
+		if ctx.Err() != nil {
+			if batch.IsLast() {
+				mctx, mcancel := context.WithTimeout(context.Background(), time.Second*15)
+				if err := models.MarkStartTimedOut(mctx, db, batch.StartID()); err != nil {
+					logrus.WithError(err).WithField("start_id", batch.StartID()).Error("error marking start as timed out")
+				}
+				mcancel()
+			}
+			return errors.Wrapf(ctx.Err(), "error requesting calls for start: %d", batch.StartID())
+		}
+
 		start := time.Now()
 
-		ctx, cancel := context.WithTimeout(bg, time.Minute)
-		session, err := ivr.RequestCallStart(ctx, config, db, oa, batch, contact)
+		callCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		session, err := ivr.RequestCallStart(callCtx, config, db, oa, batch, contact)
 		cancel()
 		if err != nil {
 			logrus.WithError(err).Errorf("error starting ivr flow for contact: %d and flow: %d", contact.ID(), batch.FlowID())
@@ -103,7 +115,7 @@ func HandleFlowStartBatch(bg context.Context, config *config.Config, db *sqlx.DB
 				"elapsed":    time.Since(start),
 				"contact_id": contact.ID(),
 				"start_id":   batch.StartID(),
-			}).Info("call start skipped, no suitable channel")
+			}).Info("call start skipped, contact not active or no suitable channel")
 			continue
 		}
 		logrus.WithFields(logrus.Fields{
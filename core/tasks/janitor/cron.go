@@ -0,0 +1,135 @@
+package janitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/librato"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/campaigns"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	janitorLock = "janitor"
+
+	// the maximum number of orphans of each category that are repaired in one run
+	repairBatchSize = 1000
+
+	// how long things must have been stuck before we consider them orphaned
+	stalledStartAge     = time.Hour * 24
+	runlessSessionAge   = time.Hour
+	stalledMsgAge       = time.Hour
+	stalledEventFireAge = time.Hour * 4 // longer than claims on fires last
+)
+
+func init() {
+	mailroom.AddInitFunction(StartJanitorCron)
+}
+
+// StartJanitorCron starts our cron job of repairing the orphaned data that mailroom can leave if it crashes
+func StartJanitorCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, janitorLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*15)
+			defer cancel()
+			_, err := RepairOrphans(ctx, rt, time.Now(), rt.Config.JanitorDryRun)
+			return err
+		},
+	)
+	return nil
+}
+
+// a category of orphaned data and how we repair it, returning the ids of the orphans found
+type repairer struct {
+	category string
+	repair   func(context.Context, *runtime.Runtime, time.Time, bool) (interface{}, int, error)
+}
+
+var repairers = []repairer{
+	{"stalled_starts", repairStalledStarts},
+	{"runless_sessions", repairRunlessSessions},
+	{"stalled_msgs", repairStalledMsgs},
+	{"stalled_event_fires", repairStalledEventFires},
+}
+
+// RepairOrphans finds orphaned data in each category and repairs it, unless this is a dry run in which case we only
+// report it, returning the number of orphans found in each category
+func RepairOrphans(ctx context.Context, rt *runtime.Runtime, now time.Time, dryRun bool) (map[string]int, error) {
+	found := make(map[string]int, len(repairers))
+
+	for _, r := range repairers {
+		start := time.Now()
+
+		ids, count, err := r.repair(ctx, rt, now, dryRun)
+		if err != nil {
+			return found, err
+		}
+		found[r.category] = count
+
+		librato.Gauge("mr.janitor_"+r.category, float64(count))
+
+		if count > 0 {
+			log := logrus.WithFields(logrus.Fields{"comp": "janitor", "category": r.category, "count": count, "elapsed": time.Since(start)})
+			if dryRun {
+				log.WithField("ids", ids).Warn("found orphaned data, not repairing as dry run")
+			} else {
+				log.Warn("repaired orphaned data")
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// starts which are still pending long after they were created had their start task lost, and as we don't know if they
+// were for a query that's no longer valid, or for contacts that have since been started, they're failed
+func repairStalledStarts(ctx context.Context, rt *runtime.Runtime, now time.Time, dryRun bool) (interface{}, int, error) {
+	ids, err := models.LoadStalledStarts(ctx, rt.DB, now.Add(-stalledStartAge), repairBatchSize)
+	if err != nil || len(ids) == 0 || dryRun {
+		return ids, len(ids), err
+	}
+	return ids, len(ids), models.MarkStartsFailed(ctx, rt.DB, ids)
+}
+
+// waiting sessions without runs can never be resumed, and would keep their contact from being started in other flows,
+// so they're exited as failed
+func repairRunlessSessions(ctx context.Context, rt *runtime.Runtime, now time.Time, dryRun bool) (interface{}, int, error) {
+	ids, err := models.LoadRunlessSessions(ctx, rt.DB, now.Add(-runlessSessionAge), repairBatchSize)
+	if err != nil || len(ids) == 0 || dryRun {
+		return ids, len(ids), err
+	}
+	return ids, len(ids), models.ExitSessions(ctx, rt.DB, ids, models.ExitFailed, now)
+}
+
+// outgoing messages still initializing were never queued to courier, so they're made pending to be queued again
+func repairStalledMsgs(ctx context.Context, rt *runtime.Runtime, now time.Time, dryRun bool) (interface{}, int, error) {
+	ids, err := models.LoadStalledMsgs(ctx, rt.DB, now.Add(-stalledMsgAge), repairBatchSize)
+	if err != nil || len(ids) == 0 || dryRun {
+		return ids, len(ids), err
+	}
+	return ids, len(ids), models.MarkMessageIDsPending(ctx, rt.DB, ids)
+}
+
+// event fires which were queued but never fired, and aren't claimed by a worker firing them, are unmarked as queued so
+// that our campaign cron queues them again
+func repairStalledEventFires(ctx context.Context, rt *runtime.Runtime, now time.Time, dryRun bool) (interface{}, int, error) {
+	unfired, err := models.LoadUnfiredEventFires(ctx, rt.DB, now.Add(-stalledEventFireAge), repairBatchSize)
+	if err != nil || len(unfired) == 0 {
+		return unfired, 0, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	ids, err := campaigns.StalledEventFires(ctx, rt.DB, rc, unfired)
+	if err != nil || len(ids) == 0 || dryRun {
+		return ids, len(ids), err
+	}
+	return ids, len(ids), campaigns.UnmarkEventFires(rc, ids)
+}
@@ -0,0 +1,99 @@
+package janitor_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/janitor"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/marker"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairOrphans(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	now := time.Now()
+
+	// start from a state without any orphans
+	_, err := janitor.RepairOrphans(ctx, rt, now, false)
+	require.NoError(t, err)
+
+	// a start that's been pending for two days and one that was just created
+	oldStartID := testdata.InsertFlowStart(db, testdata.Org1, testdata.Favorites, nil)
+	newStartID := testdata.InsertFlowStart(db, testdata.Org1, testdata.Favorites, nil)
+	db.MustExec(`UPDATE flows_flowstart SET modified_on = NOW() - INTERVAL '2 days' WHERE id = $1`, oldStartID)
+
+	// two waiting sessions, only one of which has a run
+	runlessID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.Favorites, models.RunStatusWaiting, "", nil)
+	db.MustExec(`UPDATE flows_flowsession SET created_on = NOW() - INTERVAL '2 hours' WHERE id = $1 OR id = $2`, runlessID, sessionID)
+
+	// an outgoing message that never got past initializing
+	msg := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.Cathy.ID, testdata.Cathy.URN, testdata.Cathy.URNID, "Hi", nil)
+	db.MustExec(`UPDATE msgs_msg SET status = 'I', created_on = NOW() - INTERVAL '2 hours' WHERE id = $1`, msg.ID())
+
+	// two event fires which were queued hours ago but never fired, one of which is still claimed by a worker
+	db.MustExec(`INSERT INTO campaigns_eventfire(scheduled, contact_id, event_id) VALUES (NOW() - INTERVAL '5 hours', $1, $3), (NOW() - INTERVAL '5 hours', $2, $3);`, testdata.Cathy.ID, testdata.George.ID, testdata.RemindersEvent1.ID)
+
+	var fireIDs []models.FireID
+	require.NoError(t, db.Select(&fireIDs, `SELECT id FROM campaigns_eventfire WHERE event_id = $1 AND fired IS NULL ORDER BY contact_id`, testdata.RemindersEvent1.ID))
+	require.Equal(t, 2, len(fireIDs))
+
+	for _, id := range fireIDs {
+		require.NoError(t, marker.AddTask(rc, "campaign_event", fmt.Sprintf("%d", id)))
+	}
+	_, err = models.ClaimEventFires(ctx, db, []*models.EventFire{{FireID: fireIDs[1]}}, time.Hour)
+	require.NoError(t, err)
+
+	expected := map[string]int{"stalled_starts": 1, "runless_sessions": 1, "stalled_msgs": 1, "stalled_event_fires": 1}
+
+	// a dry run only reports what it finds
+	found, err := janitor.RepairOrphans(ctx, rt, now, true)
+	require.NoError(t, err)
+	assert.Equal(t, expected, found)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'P'`, []interface{}{oldStartID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'W'`, []interface{}{runlessID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'I'`, []interface{}{msg.ID()}, 1)
+
+	found, err = janitor.RepairOrphans(ctx, rt, now, false)
+	require.NoError(t, err)
+	assert.Equal(t, expected, found)
+
+	// stalled starts are failed
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'F'`, []interface{}{oldStartID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'P'`, []interface{}{newStartID}, 1)
+
+	// runless sessions are exited
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'F'`, []interface{}{runlessID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'W'`, []interface{}{sessionID}, 1)
+
+	// stalled messages are made pending
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND status = 'P'`, []interface{}{msg.ID()}, 1)
+
+	// and unclaimed fires will be queued again
+	queued, err := marker.HasTask(rc, "campaign_event", fmt.Sprintf("%d", fireIDs[0]))
+	require.NoError(t, err)
+	assert.False(t, queued)
+
+	queued, err = marker.HasTask(rc, "campaign_event", fmt.Sprintf("%d", fireIDs[1]))
+	require.NoError(t, err)
+	assert.True(t, queued)
+
+	// leaving nothing to repair
+	found, err = janitor.RepairOrphans(ctx, rt, now, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"stalled_starts": 0, "runless_sessions": 0, "stalled_msgs": 0, "stalled_event_fires": 0}, found)
+}
@@ -0,0 +1,129 @@
+package maintenance
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkDBLock = "check_db"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartCheckDBCron)
+}
+
+// StartCheckDBCron starts our cron job of checking the tables and indexes of our hot queries every hour, as well as
+// refreshing our cached copy of the result of the last check, which may have been made by another instance
+func StartCheckDBCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, checkDBLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*30)
+			defer cancel()
+			return CheckDB(ctx, rt)
+		},
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			RefreshDBAdvisory(rt)
+
+			select {
+			case <-quit:
+				return
+			case <-time.After(dbAdvisoryRefreshInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+// how often each instance refreshes its cached copy of the db advisory from redis
+const dbAdvisoryRefreshInterval = time.Minute * 5
+
+// RefreshDBAdvisory caches the result of the last check of the database in our runtime so that the health endpoint
+// can report it without calling redis
+func RefreshDBAdvisory(rt *runtime.Runtime) {
+	rc := rt.RP.Get()
+	advisory, err := models.GetDBAdvisory(rc)
+	rc.Close()
+
+	if err != nil {
+		logrus.WithError(err).Error("error refreshing db advisory")
+		return
+	}
+
+	if advisory != nil {
+		rt.DBAdvisory.SetMissingIndexes(advisory.MissingIndexes)
+	} else {
+		rt.DBAdvisory.SetMissingIndexes(nil)
+	}
+}
+
+// CheckDB analyzes the tables of our hot queries whose stats are stale, and records which of the indexes they depend
+// on are missing so that it can be reported by the health endpoint of every instance
+func CheckDB(ctx context.Context, rt *runtime.Runtime) error {
+	tables := make([]string, 0, len(models.RecommendedIndexes))
+	for t := range models.RecommendedIndexes {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+
+	stats, err := models.LoadTableStats(ctx, rt.DB, tables)
+	if err != nil {
+		return err
+	}
+
+	advisory := &models.DBAdvisory{AnalyzedTables: make([]string, 0), CheckedOn: dates.Now()}
+
+	for _, s := range stats {
+		if !s.IsStale() {
+			continue
+		}
+
+		start := time.Now()
+		if err := models.AnalyzeTable(ctx, rt.DB, s.Name); err != nil {
+			return err
+		}
+		advisory.AnalyzedTables = append(advisory.AnalyzedTables, s.Name)
+
+		logrus.WithFields(logrus.Fields{
+			"table":              s.Name,
+			"live_rows":          s.LiveRows,
+			"mods_since_analyze": s.ModsSinceAnalyze,
+			"last_analyzed":      s.LastAnalyzed,
+			"elapsed":            time.Since(start),
+		}).Info("analyzed table with stale stats")
+	}
+
+	advisory.MissingIndexes, err = models.MissingRecommendedIndexes(ctx, rt.DB)
+	if err != nil {
+		return err
+	}
+	if len(advisory.MissingIndexes) > 0 {
+		logrus.WithField("missing_indexes", advisory.MissingIndexes).Warn("database is missing recommended indexes")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := models.SaveDBAdvisory(rc, advisory); err != nil {
+		return err
+	}
+
+	rt.DBAdvisory.SetMissingIndexes(advisory.MissingIndexes)
+	return nil
+}
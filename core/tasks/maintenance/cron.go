@@ -0,0 +1,84 @@
+package maintenance
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syncMaintenanceLock = "sync_maintenance"
+
+	// orgs are put into maintenance by setting this key in their config, and taken out of it by removing it
+	configMaintenance = "maintenance"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartSyncMaintenanceCron)
+}
+
+// StartSyncMaintenanceCron starts our cron job of syncing which orgs are in maintenance with their configs
+func StartSyncMaintenanceCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, syncMaintenanceLock, time.Second*15,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return SyncMaintenance(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// SyncMaintenance puts orgs which have the maintenance flag in their config into maintenance, and takes orgs which no
+// longer have it out of maintenance, requeuing their parked tasks
+func SyncMaintenance(ctx context.Context, rt *runtime.Runtime) error {
+	flagged, err := models.OrgIDsWithConfig(ctx, rt.DB, configMaintenance)
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	current, err := queue.MaintenanceOrgs(rc)
+	if err != nil {
+		return err
+	}
+
+	inMaintenance := make(map[int]bool, len(current))
+	for _, orgID := range current {
+		inMaintenance[orgID] = true
+	}
+
+	for _, orgID := range flagged {
+		if inMaintenance[int(orgID)] {
+			delete(inMaintenance, int(orgID))
+			continue
+		}
+
+		if err := queue.StartMaintenance(rc, int(orgID)); err != nil {
+			return err
+		}
+		logrus.WithField("org_id", orgID).Info("org entered maintenance, parking its tasks")
+	}
+
+	// anything left is no longer flagged
+	for orgID := range inMaintenance {
+		requeued, err := queue.EndMaintenance(rc, orgID)
+		if err != nil {
+			return errors.Wrapf(err, "error ending maintenance for org %d", orgID)
+		}
+		logrus.WithField("org_id", orgID).WithField("requeued", requeued).Info("org left maintenance, requeued its parked tasks")
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package maintenance_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/maintenance"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncMaintenance(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"maintenance": true}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	require.NoError(t, maintenance.SyncMaintenance(ctx, rt))
+
+	inMaintenance, err := queue.InMaintenance(rc, int(testdata.Org1.ID))
+	require.NoError(t, err)
+	assert.True(t, inMaintenance)
+
+	// tasks for org 1 get parked
+	require.NoError(t, queue.AddTask(rc, queue.BatchQueue, "test_task", int(testdata.Org1.ID), "task1", queue.DefaultPriority))
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	_, total, err := queue.ParkedTasks(rc, queue.BatchQueue, int(testdata.Org1.ID), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+
+	// clearing the flag takes the org out of maintenance and requeues its tasks
+	db.MustExec(`UPDATE orgs_org SET config = '{}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	require.NoError(t, maintenance.SyncMaintenance(ctx, rt))
+
+	inMaintenance, err = queue.InMaintenance(rc, int(testdata.Org1.ID))
+	require.NoError(t, err)
+	assert.False(t, inMaintenance)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, "test_task", task.Type)
+}
+
+func TestCheckDB(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	require.NoError(t, maintenance.CheckDB(ctx, rt))
+
+	advisory, err := models.GetDBAdvisory(rc)
+	require.NoError(t, err)
+	require.NotNil(t, advisory)
+	assert.Equal(t, []string{}, advisory.MissingIndexes)
+
+	// drop one of the indexes our hot queries depend on
+	db.MustExec(`DROP INDEX flows_flowsession_timeout`)
+
+	require.NoError(t, maintenance.CheckDB(ctx, rt))
+
+	advisory, err = models.GetDBAdvisory(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flows_flowsession_timeout"}, advisory.MissingIndexes)
+
+	// the instance which checked caches the result, and other instances cache it when they refresh
+	assert.Equal(t, []string{"flows_flowsession_timeout"}, rt.DBAdvisory.MissingIndexes())
+
+	otherRT := testsuite.RT()
+	assert.Nil(t, otherRT.DBAdvisory.MissingIndexes())
+
+	maintenance.RefreshDBAdvisory(otherRT)
+	assert.Equal(t, []string{"flows_flowsession_timeout"}, otherRT.DBAdvisory.MissingIndexes())
+
+	// tables are only analyzed when enough of them has changed since they were last analyzed
+	assert.False(t, (&models.TableStats{LiveRows: 100000, ModsSinceAnalyze: 4000}).IsStale())
+	assert.True(t, (&models.TableStats{LiveRows: 100000, ModsSinceAnalyze: 6000}).IsStale())
+	assert.False(t, (&models.TableStats{LiveRows: 10, ModsSinceAnalyze: 500}).IsStale())
+	assert.True(t, (&models.TableStats{LiveRows: 10, ModsSinceAnalyze: 1500}).IsStale())
+
+	require.NoError(t, models.AnalyzeTable(ctx, db, "flows_flowsession"))
+}
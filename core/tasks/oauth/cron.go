@@ -0,0 +1,56 @@
+package oauth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	refreshTokensLock = "refresh_oauth_tokens"
+
+	// tokens expiring within this window are refreshed ahead of time
+	refreshWindow = time.Minute * 10
+)
+
+func init() {
+	mailroom.AddInitFunction(StartRefreshTokensCron)
+}
+
+// StartRefreshTokensCron starts our cron job of refreshing OAuth2 tokens before they expire, if token storage has been
+// configured
+func StartRefreshTokensCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	key, err := rt.Config.ParseOAuthTokenKey()
+	if err != nil || key == nil {
+		return err
+	}
+
+	cron.StartCron(quit, rt.RP, refreshTokensLock, time.Minute,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return RefreshTokens(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// RefreshTokens refreshes any stored tokens which are about to expire
+func RefreshTokens(ctx context.Context, rt *runtime.Runtime) error {
+	start := time.Now()
+
+	count, err := models.RefreshExpiringOAuthTokens(ctx, rt.DB, rt.Config, refreshWindow)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("elapsed", time.Since(start)).WithField("refreshed", count).Info("refreshed expiring OAuth tokens")
+	return nil
+}
@@ -0,0 +1,79 @@
+package partitions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maintainPartitionsLock = "maintain_partitions"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartMaintainPartitionsCron)
+}
+
+// StartMaintainPartitionsCron starts our cron job of maintaining the partitions of partitioned tables every hour, if
+// any are configured or writing of run steps is enabled
+func StartMaintainPartitionsCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	tables, err := rt.Config.ParsePartitionedTables()
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 && !rt.Config.RunSteps {
+		return nil
+	}
+
+	// inserts into partitioned tables fail if there's no partition for them so make sure they exist before we start
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := MaintainPartitions(ctx, rt, tables, time.Now()); err != nil {
+		return err
+	}
+
+	cron.StartCron(quit, rt.RP, maintainPartitionsLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return MaintainPartitions(ctx, rt, tables, time.Now())
+		},
+	)
+	return nil
+}
+
+// MaintainPartitions creates upcoming partitions of the passed in tables and detaches expired ones, as well as
+// maintaining the partitions of the run steps table if writing of run steps is enabled. Inserts never create
+// partitions themselves so if any upcoming partitions are still missing afterwards we alert on them.
+func MaintainPartitions(ctx context.Context, rt *runtime.Runtime, tables []string, now time.Time) error {
+	for _, table := range tables {
+		err := models.MaintainPartitionedTable(ctx, rt.DB, table, now, rt.Config.PartitionsAhead, rt.Config.PartitionsRetentionMonths)
+
+		missing, merr := models.MissingMonthlyPartitions(ctx, rt.DB, table, now, rt.Config.PartitionsAhead)
+		if merr != nil {
+			logrus.WithError(merr).WithField("table", table).Error("error checking for missing partitions")
+		} else if len(missing) > 0 {
+			logrus.WithField("table", table).WithField("missing", missing).Error("upcoming partitions are missing, inserts will fail once they're needed")
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "error maintaining partitions of %s", table)
+		}
+	}
+
+	if rt.Config.RunSteps {
+		if err := models.MaintainRunStepsPartitions(ctx, rt.DB, now, rt.Config.RunStepsRetentionMonths); err != nil {
+			return errors.Wrapf(err, "error maintaining run steps partitions")
+		}
+	}
+	return nil
+}
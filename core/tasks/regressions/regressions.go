@@ -0,0 +1,264 @@
+package regressions
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeRunFlowRegressions is the type of the task to replay the recorded sessions of flows to check for regressions
+const TypeRunFlowRegressions = "run_flow_regressions"
+
+// the default and maximum number of recorded sessions replayed for each flow
+const (
+	defaultSessionLimit = 100
+	maxSessionLimit     = 1000
+)
+
+// sessions with these events depended on something other than the contact's messages, e.g. a webhook response which
+// may have changed or a wait timing out, so replaying them wouldn't tell us anything about the flow
+var unreplayableEvents = map[string]bool{
+	events.TypeWebhookCalled:      true,
+	events.TypeWaitTimedOut:       true,
+	events.TypeDialEnded:          true,
+	events.TypeAirtimeTransferred: true,
+}
+
+func init() {
+	tasks.RegisterType(TypeRunFlowRegressions, func() tasks.Task { return &RunFlowRegressionsTask{} })
+}
+
+// RunFlowRegressionsTask is our task to replay the inputs of recently completed sessions of flows against the current
+// version of each flow and engine, and report any sessions whose messages differ from what was recorded
+type RunFlowRegressionsTask struct {
+	FlowIDs []models.FlowID `json:"flow_ids"`
+	Limit   int             `json:"limit,omitempty"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *RunFlowRegressionsTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform replays the recorded sessions of each flow and saves a report for each
+func (t *RunFlowRegressionsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	limit := t.Limit
+	if limit <= 0 {
+		limit = defaultSessionLimit
+	} else if limit > maxSessionLimit {
+		limit = maxSessionLimit
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, flowID := range t.FlowIDs {
+		flow, err := oa.FlowByID(flowID)
+		if err != nil {
+			logrus.WithError(err).WithField("org_id", orgID).WithField("flow_id", flowID).Warn("unable to load flow to check for regressions")
+			continue
+		}
+
+		report, err := RunFlowRegressions(ctx, rt, oa, flow, limit)
+		if err != nil {
+			return errors.Wrapf(err, "error checking regressions for flow: %d", flowID)
+		}
+
+		if err := models.SaveFlowRegressionReport(rc, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunFlowRegressions replays up to limit of the recorded sessions of the given flow, returning a report of which behaved
+// differently
+func RunFlowRegressions(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, flow *models.Flow, limit int) (*models.FlowRegressionReport, error) {
+	flowDef, err := oa.SessionAssets().Flows().Get(flow.UUID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read flow: %s", flow.UUID())
+	}
+
+	sessions, err := models.LoadRecordedSessions(ctx, rt.DB, oa.OrgID(), flow.UUID(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.FlowRegressionReport{
+		FlowID:       flow.ID(),
+		FlowUUID:     flow.UUID(),
+		FlowRevision: flowDef.Revision(),
+		Version:      rt.Config.Version,
+		SpecVersion:  goflow.SpecVersion().String(),
+		CreatedOn:    time.Now(),
+		Regressions:  make([]*models.FlowRegression, 0),
+	}
+
+	for _, s := range sessions {
+		recording, err := readRecording(s.Output)
+		if err != nil {
+			logrus.WithError(err).WithField("session_uuid", s.UUID).Warn("unable to read recorded session")
+			report.Skipped++
+			continue
+		}
+		if !recording.replayable {
+			report.Skipped++
+			continue
+		}
+
+		report.Replayed++
+
+		actual, err := replay(rt, oa, recording)
+		if err != nil {
+			report.Regressions = append(report.Regressions, &models.FlowRegression{SessionUUID: s.UUID, Inputs: recording.inputTexts(), Expected: recording.outputs, Actual: []string{}, Error: err.Error()})
+		} else if !equalMessages(recording.outputs, actual) {
+			report.Regressions = append(report.Regressions, &models.FlowRegression{SessionUUID: s.UUID, Inputs: recording.inputTexts(), Expected: recording.outputs, Actual: actual})
+		} else {
+			report.Passed++
+		}
+	}
+
+	return report, nil
+}
+
+// recording is what we need from a recorded session to replay it
+type recording struct {
+	trigger    json.RawMessage
+	inputs     []*flows.MsgIn
+	outputs    []string
+	replayable bool
+}
+
+func (r *recording) inputTexts() []string {
+	texts := make([]string, len(r.inputs))
+	for i, msg := range r.inputs {
+		texts[i] = msg.Text()
+	}
+	return texts
+}
+
+type recordedEvent struct {
+	Type      string    `json:"type"`
+	CreatedOn time.Time `json:"created_on"`
+	Msg       *struct {
+		URN         urns.URN                 `json:"urn"`
+		Channel     *assets.ChannelReference `json:"channel"`
+		Text        string                   `json:"text"`
+		Attachments []utils.Attachment       `json:"attachments"`
+	} `json:"msg"`
+}
+
+// reads the trigger, the messages received and the messages sent from the output of a recorded session
+func readRecording(output json.RawMessage) (*recording, error) {
+	session := &struct {
+		Trigger json.RawMessage `json:"trigger"`
+		Runs    []struct {
+			Events []*recordedEvent `json:"events"`
+		} `json:"runs"`
+	}{}
+	if err := json.Unmarshal(output, session); err != nil {
+		return nil, err
+	}
+
+	// each run has its own events so put them back in the order they happened
+	es := make([]*recordedEvent, 0)
+	for _, run := range session.Runs {
+		es = append(es, run.Events...)
+	}
+	sort.SliceStable(es, func(i, j int) bool { return es[i].CreatedOn.Before(es[j].CreatedOn) })
+
+	r := &recording{trigger: session.Trigger, inputs: make([]*flows.MsgIn, 0), outputs: make([]string, 0), replayable: true}
+
+	for _, e := range es {
+		switch e.Type {
+		case events.TypeMsgReceived:
+			r.inputs = append(r.inputs, flows.NewMsgIn(flows.MsgUUID(uuids.New()), e.Msg.URN, e.Msg.Channel, e.Msg.Text, e.Msg.Attachments))
+		case events.TypeMsgCreated:
+			r.outputs = append(r.outputs, e.Msg.Text)
+		default:
+			if unreplayableEvents[e.Type] {
+				r.replayable = false
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// replays the given recording against the current flow, returning the text of the messages sent
+func replay(rt *runtime.Runtime, oa *models.OrgAssets, r *recording) ([]string, error) {
+	sa := oa.SessionAssets()
+
+	recorded, err := triggers.ReadTrigger(sa, r.trigger, assets.IgnoreMissing)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read trigger")
+	}
+
+	// starting with the recorded trigger means the contact has the same fields, groups etc as they did at the time
+	session, sprint, err := goflow.Simulator(rt.Config).NewSession(sa, recorded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to start session")
+	}
+
+	actual := sentMessages(sprint.Events())
+
+	for _, input := range r.inputs {
+		if session.Status() != flows.SessionStatusWaiting {
+			break
+		}
+
+		sprint, err := session.Resume(resumes.NewMsg(oa.Env(), session.Contact(), input))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to resume session")
+		}
+		actual = append(actual, sentMessages(sprint.Events())...)
+	}
+
+	return actual, nil
+}
+
+// gets the text of the messages sent in the given events
+func sentMessages(es []flows.Event) []string {
+	msgs := make([]string, 0)
+	for _, e := range es {
+		if event, ok := e.(*events.MsgCreatedEvent); ok {
+			msgs = append(msgs, event.Msg.Text())
+		}
+	}
+	return msgs
+}
+
+func equalMessages(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package regressions_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/regressions"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunFlowRegressions(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// record a session of Cathy in the favorites flow
+	contact, err := models.LoadContact(ctx, db, oa, testdata.Cathy.ID)
+	require.NoError(t, err)
+	flowContact, err := contact.FlowContact(oa)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), flowContact).Manual().Build()
+	session, _, err := goflow.Simulator(rt.Config).NewSession(oa.SessionAssets(), trigger)
+	require.NoError(t, err)
+
+	for _, text := range []string{"blue", "primus"} {
+		msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, text, nil)
+		_, err = session.Resume(resumes.NewMsg(oa.Env(), session.Contact(), msg))
+		require.NoError(t, err)
+	}
+
+	output, err := json.Marshal(session)
+	require.NoError(t, err)
+
+	db.MustExec(`INSERT INTO flows_flowsession(uuid, session_type, status, responded, output, created_on, contact_id, org_id)
+	             VALUES($1, 'M', 'C', TRUE, $2, NOW(), $3, $4)`, session.UUID(), string(output), testdata.Cathy.ID, testdata.Org1.ID)
+
+	task := &regressions.RunFlowRegressionsTask{FlowIDs: []models.FlowID{testdata.Favorites.ID}}
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	reports, err := models.LoadFlowRegressionReports(rc, testdata.Favorites.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(reports))
+	assert.Equal(t, testdata.Favorites.UUID, reports[0].FlowUUID)
+	assert.Equal(t, 1, reports[0].Replayed)
+	assert.Equal(t, 1, reports[0].Passed)
+	assert.Equal(t, 0, len(reports[0].Regressions))
+
+	// change what was recorded as sent so that replaying it no longer matches
+	db.MustExec(`UPDATE flows_flowsession SET output = replace(output, 'Good choice', 'Great choice') WHERE uuid = $1`, session.UUID())
+
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	reports, err = models.LoadFlowRegressionReports(rc, testdata.Favorites.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(reports))
+	assert.Equal(t, 0, reports[0].Passed)
+	require.Equal(t, 1, len(reports[0].Regressions))
+
+	regression := reports[0].Regressions[0]
+	assert.Equal(t, session.UUID(), regression.SessionUUID)
+	assert.Equal(t, []string{"blue", "primus"}, regression.Inputs)
+	assert.Contains(t, regression.Expected[1], "Great choice")
+	assert.Contains(t, regression.Actual[1], "Good choice")
+
+	// sessions which made webhook calls aren't replayed
+	db.MustExec(`UPDATE flows_flowsession SET output = replace(output, '"type":"msg_received"', '"type":"webhook_called"') WHERE uuid = $1`, session.UUID())
+
+	report, err := regressions.RunFlowRegressions(ctx, rt, oa, flow, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Replayed)
+	assert.Equal(t, 1, report.Skipped)
+}
@@ -0,0 +1,163 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeSendReports is the type of the task to generate and deliver an org's scheduled reports
+const TypeSendReports = "send_reports"
+
+const (
+	sendReportsLock = "send_reports"
+
+	// the end of the last period delivered for each report, so that each period is only delivered once
+	reportDeliveredKey = "report_delivered:%d:%s"
+	reportDeliveredTTL = 60 * 60 * 24 * 40
+)
+
+func init() {
+	tasks.RegisterType(TypeSendReports, func() tasks.Task { return &SendReportsTask{} })
+	mailroom.AddInitFunction(StartSendReportsCron)
+}
+
+// StartSendReportsCron starts our cron job of queuing report tasks for orgs with scheduled reports every hour
+func StartSendReportsCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, sendReportsLock, time.Hour,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return queueReportTasks(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// queues a task to send reports for each org which has scheduled reports
+func queueReportTasks(ctx context.Context, rt *runtime.Runtime) error {
+	orgIDs, err := models.OrgIDsWithConfig(ctx, rt.DB, "reports")
+	if err != nil {
+		return err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, orgID := range orgIDs {
+		err := queue.AddTask(rc, queue.BatchQueue, TypeSendReports, int(orgID), &SendReportsTask{}, queue.LowPriority)
+		if err != nil {
+			return errors.Wrapf(err, "error queuing reports task for org: %d", orgID)
+		}
+	}
+
+	return nil
+}
+
+// SendReportsTask is our task to generate and deliver any of an org's scheduled reports whose last period hasn't been
+// delivered yet
+type SendReportsTask struct{}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *SendReportsTask) Timeout() time.Duration {
+	return time.Minute * 30
+}
+
+// Perform sends each report which is due
+func (t *SendReportsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for _, report := range oa.Org().Reports() {
+		start, end := report.LastPeriod(time.Now(), oa.Env().Timezone())
+
+		key := fmt.Sprintf(reportDeliveredKey, orgID, report.UUID)
+		delivered, err := redis.String(rc.Do("GET", key))
+		if err != nil && err != redis.ErrNil {
+			return errors.Wrapf(err, "error checking delivery of report: %s", report.UUID)
+		}
+		if delivered == end.Format(time.RFC3339) {
+			continue
+		}
+
+		// a failing report shouldn't stop the others being delivered, it'll be retried next time
+		if err := SendReport(ctx, rt, oa, report, start, end); err != nil {
+			logrus.WithError(err).WithField("org_id", orgID).WithField("report_uuid", report.UUID).Error("error sending report")
+			continue
+		}
+
+		if _, err := rc.Do("SET", key, end.Format(time.RFC3339), "EX", reportDeliveredTTL); err != nil {
+			return errors.Wrapf(err, "error recording delivery of report: %s", report.UUID)
+		}
+	}
+
+	return nil
+}
+
+// SendReport generates the passed in report for the given period as a CSV and delivers it. If the report is stored, its
+// recipients are emailed a link to the stored file, otherwise they are sent its content.
+func SendReport(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, report *models.Report, start, end time.Time) error {
+	records, err := models.GenerateReport(ctx, rt.DB, oa, report, start, end)
+	if err != nil {
+		return err
+	}
+
+	content := &bytes.Buffer{}
+	w := csv.NewWriter(content)
+	if err := w.WriteAll(records); err != nil {
+		return errors.Wrapf(err, "error writing report CSV")
+	}
+
+	period := fmt.Sprintf("%s to %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+	subject := fmt.Sprintf("%s (%s)", report.Name, period)
+	body := content.String()
+
+	if report.Store {
+		filename := path.Join(config.Mailroom.S3MediaPrefix, "reports", fmt.Sprint(oa.OrgID()), string(report.UUID), start.Format("2006-01-02")+".csv")
+
+		url, err := rt.MediaStorageFor(oa.Org().Region()).Put(ctx, filename, "text/csv", content.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "error storing report")
+		}
+
+		body = fmt.Sprintf("Your report for %s is ready: %s", period, url)
+	}
+
+	if len(report.Emails) > 0 {
+		if err := oa.Org().SendEmail(report.Emails, subject, body); err != nil {
+			return errors.Wrapf(err, "error emailing report")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":      oa.OrgID(),
+		"report_uuid": report.UUID,
+		"type":        report.Type,
+		"start":       start,
+		"end":         end,
+		"rows":        len(records) - 1,
+	}).Info("report sent")
+
+	return nil
+}
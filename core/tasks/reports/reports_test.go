@@ -0,0 +1,48 @@
+package reports_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/reports"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendReports(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = jsonb_build_object('reports', jsonb_build_array(
+		jsonb_build_object('uuid', '3a1d3e3b-48d3-4e3d-9e19-6ac7e1e1d6c5', 'name', 'Volumes', 'type', 'msg_volumes', 'schedule', 'daily', 'store', true)
+	)) WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	task := &reports.SendReportsTask{}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// report for the last day is recorded as delivered
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, end := oa.Org().Reports()[0].LastPeriod(time.Now(), oa.Env().Timezone())
+
+	delivered, err := redis.String(rc.Do("GET", fmt.Sprintf("report_delivered:%d:3a1d3e3b-48d3-4e3d-9e19-6ac7e1e1d6c5", testdata.Org1.ID)))
+	require.NoError(t, err)
+	assert.Equal(t, end.Format(time.RFC3339), delivered)
+
+	// running again doesn't redeliver it
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package sessions
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeInterruptByChannel is the type of the task to interrupt all sessions waiting on a channel
+const TypeInterruptByChannel = "interrupt_by_channel"
+
+const interruptBatchSize = 100
+
+func init() {
+	tasks.RegisterType(TypeInterruptByChannel, func() tasks.Task { return &InterruptByChannelTask{} })
+}
+
+// InterruptByChannelTask is our task for interrupting the sessions waiting on a channel which has been removed
+//
+//   {
+//     "channel_id": 123
+//   }
+//
+type InterruptByChannelTask struct {
+	ChannelID models.ChannelID `json:"channel_id" validate:"required"`
+}
+
+// selects waiting IVR sessions whose call is on the channel, and waiting messaging sessions whose contact's preferred
+// URN is affiliated with the channel
+const selectSessionIDsForChannelSQL = `
+SELECT
+	fs.id
+FROM
+	flows_flowsession fs
+WHERE
+	fs.org_id = $1 AND
+	fs.status = 'W' AND
+	fs.id > $3 AND
+	(
+		fs.connection_id IN (SELECT id FROM channels_channelconnection WHERE channel_id = $2) OR
+		(fs.session_type = 'M' AND (
+			SELECT channel_id FROM contacts_contacturn WHERE contact_id = fs.contact_id ORDER BY priority DESC, id ASC LIMIT 1
+		) = $2)
+	)
+ORDER BY
+	fs.id ASC
+LIMIT
+	$4
+`
+
+// Timeout is the maximum amount of time the task can run for
+func (t *InterruptByChannelTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform interrupts the sessions waiting on our channel in batches
+func (t *InterruptByChannelTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	start := time.Now()
+	lastID := models.SessionID(0)
+	interrupted := 0
+
+	for {
+		sessionIDs := make([]models.SessionID, 0, interruptBatchSize)
+		err := rt.DB.SelectContext(ctx, &sessionIDs, selectSessionIDsForChannelSQL, orgID, t.ChannelID, lastID, interruptBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "error selecting sessions for channel: %d", t.ChannelID)
+		}
+
+		if len(sessionIDs) == 0 {
+			break
+		}
+		lastID = sessionIDs[len(sessionIDs)-1]
+
+		err = models.ExitSessions(ctx, rt.DB, sessionIDs, models.ExitInterrupted, time.Now())
+		if err != nil {
+			return errors.Wrapf(err, "error interrupting sessions for channel: %d", t.ChannelID)
+		}
+
+		interrupted += len(sessionIDs)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":      orgID,
+		"channel_id":  t.ChannelID,
+		"interrupted": interrupted,
+		"elapsed":     time.Since(start),
+	}).Info("interrupted sessions for channel")
+
+	return nil
+}
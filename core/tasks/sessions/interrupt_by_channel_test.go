@@ -0,0 +1,48 @@
+package sessions_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/sessions"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterruptByChannel(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+	rt := testsuite.RT()
+
+	// Cathy prefers the Twilio channel, George prefers the Vonage channel
+	db.MustExec(`UPDATE contacts_contacturn SET channel_id = $2 WHERE id = $1`, testdata.Cathy.URNID, testdata.TwilioChannel.ID)
+	db.MustExec(`UPDATE contacts_contacturn SET channel_id = $2 WHERE id = $1`, testdata.George.URNID, testdata.VonageChannel.ID)
+
+	cathySessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, cathySessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", nil)
+	georgeSessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.George, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, georgeSessionID, testdata.George, testdata.Favorites, models.RunStatusWaiting, "", nil)
+
+	// and Bob has an IVR session with a call on the Twilio channel
+	var connectionID models.ConnectionID
+	err := db.Get(&connectionID,
+		`INSERT INTO channels_channelconnection(created_on, modified_on, external_id, status, direction, connection_type, retry_count, error_count, org_id, channel_id, contact_id, contact_urn_id) 
+		VALUES(NOW(), NOW(), 'ext1', 'I', 'I', 'V', 0, 0, $1, $2, $3, $4) RETURNING id`,
+		testdata.Org1.ID, testdata.TwilioChannel.ID, testdata.Bob.ID, testdata.Bob.URNID,
+	)
+	require.NoError(t, err)
+
+	bobSessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.SessionStatusWaiting, nil)
+	db.MustExec(`UPDATE flows_flowsession SET session_type = 'V', connection_id = $2 WHERE id = $1`, bobSessionID, connectionID)
+
+	task := &sessions.InterruptByChannelTask{ChannelID: testdata.TwilioChannel.ID}
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	assert.NoError(t, err)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = ANY(ARRAY[$1, $2]::int[]) AND status = 'I'`, []interface{}{cathySessionID, bobSessionID}, 2)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1 AND status = 'W'`, []interface{}{georgeSessionID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowrun WHERE session_id = $1 AND status = 'I'`, []interface{}{cathySessionID}, 1)
+}
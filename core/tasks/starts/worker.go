@@ -3,6 +3,7 @@ package starts
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/nyaruka/goflow/contactql"
@@ -47,7 +48,20 @@ func handleFlowStart(ctx context.Context, rt *runtime.Runtime, task *queue.Task)
 
 	err = CreateFlowBatches(ctx, rt.DB, rt.RP, rt.ES, startTask)
 	if err != nil {
-		models.MarkStartFailed(ctx, rt.DB, startTask.ID())
+		// our context may have expired so the start's status is updated with a new one
+		mctx, mcancel := context.WithTimeout(context.Background(), time.Second*15)
+		defer mcancel()
+
+		if errors.Cause(err) == context.DeadlineExceeded {
+			if merr := models.MarkStartTimedOut(mctx, rt.DB, startTask.ID()); merr != nil {
+				logrus.WithError(merr).WithField("start_id", startTask.ID()).Error("error marking start as timed out")
+			}
+			return err
+		}
+
+		if merr := models.MarkStartFailed(mctx, rt.DB, startTask.ID()); merr != nil {
+			logrus.WithError(merr).WithField("start_id", startTask.ID()).Error("error marking start as failed")
+		}
 
 		// if error is user created query error.. don't escalate error to sentry
 		isQueryError, _ := contactql.IsQueryError(err)
@@ -61,6 +75,21 @@ func handleFlowStart(ctx context.Context, rt *runtime.Runtime, task *queue.Task)
 
 // CreateFlowBatches takes our master flow start and creates batches of flow starts for all the unique contacts
 func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *elastic.Client, start *models.FlowStart) error {
+	// RapidPro claims the key before creating a start, so a start whose key was completed by another start is a
+	// duplicate that slipped past that and mustn't start anyone again
+	if start.IdempotencyKey() != "" {
+		rc := rp.Get()
+		originalID, err := models.IdempotentRequestResult(rc, start.OrgID(), models.IdempotencyScopeStart, start.IdempotencyKey())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if originalID != "" && originalID != fmt.Sprint(start.ID()) {
+			logrus.WithFields(logrus.Fields{"start_id": start.ID(), "original_start_id": originalID, "idempotency_key": start.IdempotencyKey()}).Error("flow start duplicates an earlier start with the same idempotency key")
+			return models.MarkStartFailed(ctx, db, start.ID())
+		}
+	}
+
 	contactIDs := make(map[models.ContactID]bool)
 	createdContactIDs := make([]models.ContactID, 0)
 
@@ -118,7 +147,7 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 
 	// if we have a query, add the contacts that match that as well
 	if start.Query() != "" {
-		matches, err := models.ContactIDsForQuery(ctx, ec, oa, start.Query())
+		matches, err := models.ContactIDsForQuery(ctx, db, ec, oa, start.Query())
 		if err != nil {
 			return errors.Wrapf(err, "error performing search for start: %d", start.ID())
 		}
@@ -179,7 +208,7 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 	contacts := make([]models.ContactID, 0, 100)
 	queueBatch := func(last bool) {
 		batch := start.CreateBatch(contacts, last, len(contactIDs))
-		err = queue.AddTask(rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
+		err = queue.AddTracedTask(ctx, rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
 		if err != nil {
 			// TODO: is continuing the right thing here? what do we do if redis is down? (panic!)
 			logrus.WithError(err).WithField("start_id", start.ID()).Error("error while queuing start")
@@ -190,6 +219,10 @@ func CreateFlowBatches(ctx context.Context, db *sqlx.DB, rp *redis.Pool, ec *ela
 	// build up batches of contacts to start
 	for c := range contactIDs {
 		if len(contacts) == startBatchSize {
+			// stop if we've run out of time, the batches already queued will still be started
+			if err := ctx.Err(); err != nil {
+				return errors.Wrapf(err, "error queuing batches for start: %d", start.ID())
+			}
 			queueBatch(false)
 		}
 		contacts = append(contacts, c)
@@ -325,3 +325,64 @@ func TestStarts(t *testing.T) {
 		}
 	}
 }
+
+func TestStartIdempotency(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := testsuite.RT()
+	db := rt.DB
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	newStart := func() *models.FlowStart {
+		start := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, testdata.Favorites.ID, models.DoRestartParticipants, models.DoIncludeActive).
+			WithContactIDs([]models.ContactID{testdata.Cathy.ID}).
+			WithIdempotencyKey("d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2")
+
+		err := models.InsertFlowStarts(ctx, db, []*models.FlowStart{start})
+		require.NoError(t, err)
+		return start
+	}
+
+	// RapidPro claims the key and records the first start as having been created for it
+	_, replay, err := models.StartIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeStart, "d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2")
+	require.NoError(t, err)
+	assert.False(t, replay)
+
+	start1 := newStart()
+
+	err = models.CompleteIdempotentRequest(rc, testdata.Org1.ID, models.IdempotencyScopeStart, "d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2", fmt.Sprint(start1.ID()))
+	require.NoError(t, err)
+
+	// but another start still gets created with the same key
+	start2 := newStart()
+
+	for _, start := range []*models.FlowStart{start1, start1, start2} {
+		startJSON, err := json.Marshal(start)
+		require.NoError(t, err)
+
+		err = handleFlowStart(ctx, rt, &queue.Task{Type: queue.StartFlow, Task: startJSON})
+		assert.NoError(t, err)
+	}
+
+	// a retry of the same start task still creates its batch, but the duplicate start doesn't
+	count := 0
+	for {
+		task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		count++
+
+		batch := &models.FlowStartBatch{}
+		require.NoError(t, json.Unmarshal(task.Task, batch))
+		assert.Equal(t, start1.ID(), batch.StartID())
+	}
+	assert.Equal(t, 2, count)
+
+	// and is failed rather than completed
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM flows_flowstart WHERE id = $1 AND status = 'F'`, []interface{}{start2.ID()}, 1)
+}
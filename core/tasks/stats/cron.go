@@ -2,6 +2,7 @@ package stats
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -9,10 +10,10 @@ import (
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cache"
 	"github.com/nyaruka/mailroom/utils/cron"
 	"github.com/sirupsen/logrus"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -30,29 +31,27 @@ func StartStatsCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) err
 		func(lockName string, lockValue string) error {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 			defer cancel()
-			return dumpStats(ctx, rt.DB, rt.RP, lockName, lockValue)
+			return dumpStats(ctx, rt, lockName, lockValue)
 		},
 	)
 	return nil
 }
 
+// the wait stats of each db pool when we last dumped stats, so that we can report the change since then
 var (
-	waitDuration time.Duration
-	waitCount    int64
+	waitDurations = make(map[runtime.Workload]time.Duration)
+	waitCounts    = make(map[runtime.Workload]int64)
 )
 
 // dumpStats calculates a bunch of stats every minute and both logs them and posts them to librato
-func dumpStats(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string, lockValue string) error {
+func dumpStats(ctx context.Context, rt *runtime.Runtime, lockName string, lockValue string) error {
 	// We wait 15 seconds since we fire at the top of the minute, the same as expirations.
 	// That way any metrics related to the size of our queue are a bit more accurate (all expirations can
 	// usually be handled in 15 seconds). Something more complicated would take into account the age of
 	// the items in our queues.
 	time.Sleep(time.Second * 15)
 
-	// get our DB status
-	stats := db.Stats()
-
-	rc := rp.Get()
+	rc := rt.RP.Get()
 	defer rc.Close()
 
 	// calculate size of batch queue
@@ -68,23 +67,80 @@ func dumpStats(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName string
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"db_idle":      stats.Idle,
-		"db_busy":      stats.InUse,
-		"db_waiting":   stats.WaitCount - waitCount,
-		"db_wait":      stats.WaitDuration - waitDuration,
 		"batch_size":   batchSize,
 		"handler_size": handlerSize,
 	}).Info("current stats")
 
 	librato.Gauge("mr.handler_queue", float64(handlerSize))
 	librato.Gauge("mr.batch_queue", float64(batchSize))
-	librato.Gauge("mr.db_busy", float64(stats.InUse))
-	librato.Gauge("mr.db_idle", float64(stats.Idle))
-	librato.Gauge("mr.db_waiting", float64(stats.WaitCount-waitCount))
-	librato.Gauge("mr.db_wait_ms", float64((stats.WaitDuration-waitDuration)/time.Millisecond))
 
-	waitCount = stats.WaitCount
-	waitDuration = stats.WaitDuration
+	pools := rt.DBPools
+	if len(pools) == 0 {
+		pools = map[runtime.Workload]*sqlx.DB{runtime.WorkloadHandler: rt.DB}
+	}
+
+	for w, db := range pools {
+		dumpDBStats(w, db)
+	}
+
+	for _, s := range cache.TakeStats() {
+		dumpCacheStats(s)
+	}
 
 	return nil
 }
+
+// logs and posts the stats of the db pool of a workload, the handler pool also being reported under our original
+// unprefixed metric names
+func dumpDBStats(w runtime.Workload, db *sqlx.DB) {
+	stats := db.Stats()
+	waiting := stats.WaitCount - waitCounts[w]
+	waitDuration := stats.WaitDuration - waitDurations[w]
+
+	// the fraction of the pool's connections which are in use
+	saturation := 0.0
+	if stats.MaxOpenConnections > 0 {
+		saturation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"pool":          w,
+		"db_idle":       stats.Idle,
+		"db_busy":       stats.InUse,
+		"db_waiting":    waiting,
+		"db_wait":       waitDuration,
+		"db_saturation": saturation,
+	}).Info("current db pool stats")
+
+	prefixes := []string{fmt.Sprintf("mr.db_%s", w)}
+	if w == runtime.WorkloadHandler {
+		prefixes = append(prefixes, "mr.db")
+	}
+
+	for _, prefix := range prefixes {
+		librato.Gauge(prefix+"_busy", float64(stats.InUse))
+		librato.Gauge(prefix+"_idle", float64(stats.Idle))
+		librato.Gauge(prefix+"_waiting", float64(waiting))
+		librato.Gauge(prefix+"_wait_ms", float64(waitDuration/time.Millisecond))
+		librato.Gauge(prefix+"_saturation", saturation)
+	}
+
+	waitCounts[w] = stats.WaitCount
+	waitDurations[w] = stats.WaitDuration
+}
+
+// logs and posts the hits, misses and hit rate of a cache tier since its stats were last taken. Counts are kept per
+// instance, so like our db pool stats, these are only those of the instance which has the stats lock.
+func dumpCacheStats(s *cache.Stats) {
+	logrus.WithFields(logrus.Fields{
+		"cache":    s.Name,
+		"hits":     s.Hits,
+		"misses":   s.Misses,
+		"hit_rate": s.HitRate(),
+	}).Info("current cache stats")
+
+	prefix := fmt.Sprintf("mr.cache_%s", s.Name)
+	librato.Gauge(prefix+"_hits", float64(s.Hits))
+	librato.Gauge(prefix+"_misses", float64(s.Misses))
+	librato.Gauge(prefix+"_hit_rate", s.HitRate())
+}
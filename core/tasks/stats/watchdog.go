@@ -0,0 +1,119 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/librato"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	watchdogLock = "queue_watchdog"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartWatchdogCron)
+}
+
+// StartWatchdogCron starts our cron job of checking our queues for starved orgs every 30 seconds
+func StartWatchdogCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, watchdogLock, time.Second*30,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return checkQueues(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// QueueHealth is the result of checking a single queue
+type QueueHealth struct {
+	Queue          string
+	Size           int
+	Busy           int
+	MaxWait        time.Duration
+	StarvedOrgs    map[int]time.Duration
+	DesiredWorkers int
+}
+
+// checkQueues measures how long tasks are waiting in each queue, logging any orgs that are being starved, and records
+// the number of workers each queue needs so that autoscalers and our own foremen can act on it
+func checkQueues(ctx context.Context, rt *runtime.Runtime) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	threshold := time.Second * time.Duration(rt.Config.QueueStarvationThreshold)
+
+	for _, q := range []string{queue.BatchQueue, queue.HandlerQueue} {
+		health, err := CheckQueue(rc, q, threshold)
+		if err != nil {
+			return err
+		}
+
+		for orgID, wait := range health.StarvedOrgs {
+			logrus.WithFields(logrus.Fields{"queue": q, "org_id": orgID, "wait": wait}).Warn("queue starvation detected")
+		}
+
+		if err := queue.SetDesiredWorkers(rc, q, health.DesiredWorkers); err != nil {
+			return errors.Wrapf(err, "error recording desired workers for queue: %s", q)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"queue":           q,
+			"size":            health.Size,
+			"busy":            health.Busy,
+			"max_wait":        health.MaxWait,
+			"starved_orgs":    len(health.StarvedOrgs),
+			"desired_workers": health.DesiredWorkers,
+		}).Info("queue health checked")
+
+		librato.Gauge(fmt.Sprintf("mr.%s_max_wait_ms", q), float64(health.MaxWait/time.Millisecond))
+		librato.Gauge(fmt.Sprintf("mr.%s_starved_orgs", q), float64(len(health.StarvedOrgs)))
+		librato.Gauge(fmt.Sprintf("mr.%s_desired_workers", q), float64(health.DesiredWorkers))
+	}
+
+	return nil
+}
+
+// CheckQueue checks the health of the passed in queue. The desired worker count is enough workers for every task that is
+// either being worked on or waiting, so that nothing has to wait on another org's tasks.
+func CheckQueue(rc redis.Conn, q string, threshold time.Duration) (*QueueHealth, error) {
+	size, err := queue.Size(rc, q)
+	if err != nil {
+		return nil, err
+	}
+
+	busy, err := queue.Busy(rc, q)
+	if err != nil {
+		return nil, err
+	}
+
+	waits, err := queue.Waits(rc, q)
+	if err != nil {
+		return nil, err
+	}
+
+	health := &QueueHealth{Queue: q, Size: size, Busy: busy, StarvedOrgs: make(map[int]time.Duration), DesiredWorkers: busy + size}
+
+	for orgID, wait := range waits {
+		if wait > health.MaxWait {
+			health.MaxWait = wait
+		}
+		if wait > threshold {
+			health.StarvedOrgs[orgID] = wait
+		}
+	}
+
+	return health, nil
+}
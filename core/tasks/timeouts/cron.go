@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
 	"github.com/nyaruka/mailroom/runtime"
@@ -28,8 +29,13 @@ func init() {
 	mailroom.AddInitFunction(StartTimeoutCron)
 }
 
-// StartTimeoutCron starts our cron job of continuing timed out sessions every minute
+// StartTimeoutCron starts our cron job of continuing timed out sessions every minute, unless session waits are only
+// scheduled in redis
 func StartTimeoutCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.SessionWaits == config.SessionWaitsRedis {
+		return nil
+	}
+
 	cron.StartCron(quit, rt.RP, timeoutLock, time.Second*60,
 		func(lockName string, lockValue string) error {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
@@ -66,7 +72,7 @@ func timeoutSessions(ctx context.Context, db *sqlx.DB, rp *redis.Pool, lockName
 		}
 
 		// check whether we've already queued this
-		taskID := fmt.Sprintf("%d:%s", timeout.SessionID, timeout.TimeoutOn.Format(time.RFC3339))
+		taskID := fmt.Sprintf("%d:%s", timeout.SessionID, timeout.TimeoutOn.Format(time.RFC3339Nano))
 		queued, err := marker.HasTask(rc, markerGroup, taskID)
 		if err != nil {
 			return errors.Wrapf(err, "error checking whether task is queued")
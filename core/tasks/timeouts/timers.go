@@ -0,0 +1,137 @@
+package timeouts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+	"github.com/nyaruka/mailroom/utils/marker"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	timersLock          = "session_timers"
+	reconcileTimersLock = "session_timers_reconcile"
+
+	// maximum number of timers we'll fire per run, anything left over is picked up on the next run
+	maxTimersPerRun = 1000
+
+	// how often we reconcile timers with the database, how far ahead we look, and the most timeouts we'll reconcile
+	reconcileInterval   = time.Minute * 10
+	reconcileAhead      = time.Minute * 15
+	maxReconciledTimers = 25000
+)
+
+func init() {
+	mailroom.AddInitFunction(StartTimersCron)
+	mailroom.AddInitFunction(StartReconcileTimersCron)
+}
+
+// StartTimersCron starts our cron job of firing due session timers every second
+func StartTimersCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, timersLock, time.Second,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return fireSessionTimers(ctx, rt.RP, lockName, lockValue)
+		},
+	)
+	return nil
+}
+
+// fireSessionTimers pops any due session timers and queues timeout tasks for them, the same as the timeouts cron does
+// for sessions whose timeout has passed, so whichever gets there first wins
+func fireSessionTimers(ctx context.Context, rp *redis.Pool, lockName string, lockValue string) error {
+	log := logrus.WithField("comp", "session_timers").WithField("lock", lockValue)
+	start := time.Now()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	timers, err := models.PopDueSessionTimers(rc, start, maxTimersPerRun)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, timer := range timers {
+		// check whether the timeouts cron already queued this
+		taskID := fmt.Sprintf("%d:%s", timer.SessionID, timer.TimeoutOn.Format(time.RFC3339Nano))
+		queued, err := marker.HasTask(rc, markerGroup, taskID)
+		if err != nil {
+			return errors.Wrapf(err, "error checking whether task is queued")
+		}
+		if queued {
+			continue
+		}
+
+		task := handler.NewTimeoutTask(timer.OrgID, timer.ContactID, timer.SessionID, timer.TimeoutOn)
+		if err := handler.QueueHandleTask(rc, timer.ContactID, task); err != nil {
+			return errors.Wrapf(err, "error adding new handle task")
+		}
+
+		if err := marker.AddTask(rc, markerGroup, taskID); err != nil {
+			return errors.Wrapf(err, "error marking timeout task as queued")
+		}
+
+		count++
+	}
+
+	if count > 0 {
+		log.WithField("elapsed", time.Since(start)).WithField("count", count).Info("session timers fired")
+	}
+	return nil
+}
+
+// StartReconcileTimersCron starts our cron job of reconciling session timers with the database, if session waits are
+// scheduled in redis
+func StartReconcileTimersCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.SessionWaits == config.SessionWaitsDB {
+		return nil
+	}
+
+	cron.StartCron(quit, rt.RP, reconcileTimersLock, reconcileInterval,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return reconcileSessionTimers(ctx, rt.DB, rt.RP, time.Now(), lockValue)
+		},
+	)
+	return nil
+}
+
+// reconcileSessionTimers schedules timers for the waiting sessions which will time out before our next reconciliation,
+// which catches any that were lost, e.g. because redis was flushed, or that were never scheduled because the session
+// waited before we started scheduling timeouts in redis
+func reconcileSessionTimers(ctx context.Context, db *sqlx.DB, rp *redis.Pool, now time.Time, lockValue string) error {
+	log := logrus.WithFields(logrus.Fields{"comp": "session_timers", "lock": lockValue})
+	start := time.Now()
+
+	timers, err := models.LoadUpcomingSessionTimers(ctx, db, now.Add(reconcileAhead), maxReconciledTimers)
+	if err != nil {
+		return err
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	for _, timer := range timers {
+		if _, err := models.ScheduleSessionTimer(rc, timer, 0); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(logrus.Fields{"elapsed": time.Since(start), "count": len(timers)}).Info("session timers reconciled")
+	return nil
+}
@@ -0,0 +1,82 @@
+package timeouts
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/utils/marker"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimers(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	err := marker.ClearTasks(rc, markerGroup)
+	assert.NoError(t, err)
+
+	// one timer which is due and one which isn't
+	timeoutOn := time.Now().Add(-time.Millisecond).Round(time.Microsecond)
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, &timeoutOn)
+	_, err = models.ScheduleSessionTimer(rc, &models.SessionTimer{OrgID: testdata.Org1.ID, ContactID: testdata.Cathy.ID, SessionID: sessionID, TimeoutOn: timeoutOn}, 100)
+	require.NoError(t, err)
+	_, err = models.ScheduleSessionTimer(rc, &models.SessionTimer{OrgID: testdata.Org1.ID, ContactID: testdata.George.ID, SessionID: 12345, TimeoutOn: time.Now().Add(time.Minute)}, 100)
+	require.NoError(t, err)
+
+	err = fireSessionTimers(ctx, rp, timersLock, "foo")
+	assert.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	require.NotNil(t, task)
+
+	eventTask := &handler.HandleEventTask{}
+	err = json.Unmarshal(task.Task, eventTask)
+	assert.NoError(t, err)
+	assert.Equal(t, testdata.Cathy.ID, eventTask.ContactID)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// the timeouts cron sees the same timeout as already queued
+	err = timeoutSessions(ctx, db, rp, timeoutLock, "foo")
+	assert.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.HandlerQueue)
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+}
+
+func TestReconcileSessionTimers(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	// one session which times out before our next reconciliation and one which doesn't
+	timeoutOn := time.Now().Add(time.Minute * 5).Round(time.Microsecond)
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, &timeoutOn)
+	laterTimeoutOn := time.Now().Add(time.Hour)
+	testdata.InsertFlowSession(db, testdata.Org1, testdata.George, models.SessionStatusWaiting, &laterTimeoutOn)
+
+	err := reconcileSessionTimers(ctx, db, rp, time.Now(), "foo")
+	require.NoError(t, err)
+
+	timers, err := models.PopDueSessionTimers(rc, time.Now().Add(time.Hour*2), 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(timers))
+	assert.Equal(t, sessionID, timers[0].SessionID)
+	assert.Equal(t, testdata.Cathy.ID, timers[0].ContactID)
+	assert.True(t, timeoutOn.Equal(timers[0].TimeoutOn))
+}
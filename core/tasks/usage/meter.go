@@ -0,0 +1,83 @@
+package usage
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// how each type of usage is described in the error events of refused calls
+var usageTypeNames = map[models.UsageType]string{
+	models.UsageTypeWebhookCalls:    "webhook calls",
+	models.UsageTypeClassifierCalls: "classifier calls",
+	models.UsageTypeTTSChars:        "TTS characters",
+}
+
+func init() {
+	mailroom.AddInitFunction(StartMetering)
+}
+
+// StartMetering registers call limiters with the engine so that webhook and classifier calls made by real sessions are
+// metered against their org's budgets, and refused once a blocking budget is exhausted
+func StartMetering(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookCallLimiter(func(session flows.Session, request *http.Request) error {
+		return limit(rt, session.Assets().Source().(*models.OrgAssets), models.UsageTypeWebhookCalls)
+	})
+	goflow.RegisterClassificationCallLimiter(func(session flows.Session, classifier *flows.Classifier) error {
+		return limit(rt, session.Assets().Source().(*models.OrgAssets), models.UsageTypeClassifierCalls)
+	})
+	return nil
+}
+
+// refuses a single call if the org's budget for it is exhausted and blocks further calls, otherwise meters it
+func limit(rt *runtime.Runtime, oa *models.OrgAssets, usageType models.UsageType) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	log := logrus.WithField("org_id", oa.OrgID()).WithField("usage_type", usageType)
+
+	exhausted, err := models.UsageBudgetExhausted(rc, oa.Org(), usageType)
+	if err != nil {
+		// we don't refuse calls just because we couldn't check the budget
+		log.WithError(err).Error("error checking usage budget")
+		return nil
+	}
+	if exhausted {
+		budget := oa.Org().UsageBudgets().Budget(usageType)
+		return errors.Errorf("monthly budget of %d %s has been exhausted", budget.Limit, usageTypeNames[usageType])
+	}
+
+	if err := Meter(rc, oa, usageType, 1); err != nil {
+		log.WithError(err).Error("error metering usage")
+	}
+	return nil
+}
+
+// Meter records usage by the given org and queues warnings for any percentages of its budget that were crossed
+func Meter(rc redis.Conn, oa *models.OrgAssets, usageType models.UsageType, amount int64) error {
+	warnings, err := models.RecordUsage(rc, oa.Org(), usageType, amount)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		logrus.WithFields(logrus.Fields{
+			"org_id":     oa.OrgID(),
+			"usage_type": w.Type,
+			"percent":    w.Percent,
+			"used":       w.Used,
+			"limit":      w.Limit,
+		}).Warn("org has crossed usage budget warning threshold")
+	}
+
+	return QueueUsageWarnings(rc, oa, warnings)
+}
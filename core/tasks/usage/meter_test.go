@@ -0,0 +1,68 @@
+package usage_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/usage"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://example.com/billing": {httpx.NewMockResponse(200, nil, `{"ok": true}`)},
+	}))
+
+	var resthookID models.ResthookID
+	db.Get(&resthookID, `INSERT INTO api_resthook(is_active, slug, org_id, created_on, modified_on, created_by_id, modified_by_id) VALUES(TRUE, 'usage-warnings', 1, NOW(), NOW(), 1, 1) RETURNING id`)
+	db.MustExec(`INSERT INTO api_resthooksubscriber(is_active, created_on, modified_on, target_url, created_by_id, modified_by_id, resthook_id) VALUES(TRUE, NOW(), NOW(), 'https://example.com/billing', 1, 1, $1)`, resthookID)
+	db.MustExec(`UPDATE orgs_org SET config = '{"usage_budgets": {"budgets": {"classifier_calls": {"limit": 4, "block": true}}, "warn_at": [50], "resthook": "usage-warnings"}}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// usage below the threshold doesn't queue anything
+	err = usage.Meter(rc, oa, models.UsageTypeClassifierCalls, 1)
+	require.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	// crossing it queues a warning
+	err = usage.Meter(rc, oa, models.UsageTypeClassifierCalls, 1)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, usage.TypeSendUsageWarnings, task.Type)
+
+	warningsTask := &usage.SendUsageWarningsTask{}
+	require.NoError(t, json.Unmarshal(task.Task, warningsTask))
+
+	err = warningsTask.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// which is posted to the resthook and recorded as a webhook event
+	var data string
+	err = db.Get(&data, `SELECT data FROM api_webhookevent WHERE resthook_id = $1`, resthookID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type": "classifier_calls", "month": "`+models.UsageMonth(task.QueuedOn)+`", "percent": 50, "used": 2, "limit": 4}`, data)
+}
@@ -0,0 +1,136 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeSendUsageWarnings is the type of the task to warn an org's resthook that usage has crossed thresholds of its budgets
+const TypeSendUsageWarnings = "send_usage_warnings"
+
+func init() {
+	tasks.RegisterType(TypeSendUsageWarnings, func() tasks.Task { return &SendUsageWarningsTask{} })
+}
+
+// QueueUsageWarnings queues a task to send the given usage warnings to the org's resthook if it has one for them
+func QueueUsageWarnings(rc redis.Conn, oa *models.OrgAssets, warnings []*models.UsageWarning) error {
+	budgets := oa.Org().UsageBudgets()
+	if len(warnings) == 0 || budgets == nil || budgets.Resthook == "" {
+		return nil
+	}
+
+	task := &SendUsageWarningsTask{Warnings: warnings}
+
+	err := queue.AddTask(rc, queue.BatchQueue, TypeSendUsageWarnings, int(oa.OrgID()), task, queue.HighPriority)
+	return errors.Wrapf(err, "error queuing usage warnings task")
+}
+
+// SendUsageWarningsTask is our task to post usage warnings to the subscribers of an org's resthook
+type SendUsageWarningsTask struct {
+	Warnings []*models.UsageWarning `json:"warnings"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *SendUsageWarningsTask) Timeout() time.Duration {
+	return time.Minute * 5
+}
+
+// Perform posts each warning to each subscriber of the org's resthook
+func (t *SendUsageWarningsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", orgID)
+	}
+
+	budgets := oa.Org().UsageBudgets()
+	if budgets == nil || budgets.Resthook == "" {
+		return nil
+	}
+
+	resthook := oa.ResthookBySlug(budgets.Resthook)
+	if resthook == nil {
+		logrus.WithField("org_id", orgID).WithField("resthook", budgets.Resthook).Warn("unable to find resthook for usage warnings, ignoring")
+		return nil
+	}
+
+	webhookEvents := make([]*models.WebhookEvent, 0, len(t.Warnings))
+	unsubs := make([]*models.ResthookUnsubscribe, 0)
+	unsubscribed := make(map[string]bool)
+
+	for _, warning := range t.Warnings {
+		body, err := json.Marshal(warning)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding usage warning")
+		}
+
+		webhookEvents = append(webhookEvents, models.NewWebhookEvent(orgID, resthook.ID(), string(body), time.Now()))
+
+		for _, url := range resthook.Subscribers() {
+			if unsubscribed[url] {
+				continue
+			}
+
+			status, err := post(rt, url, body)
+			if err != nil {
+				logrus.WithError(err).WithField("org_id", orgID).WithField("url", url).Warn("error posting usage warning to resthook subscriber")
+				continue
+			}
+
+			// like flow resthook calls, a 410 means the subscriber no longer wants to hear from us
+			if status == http.StatusGone {
+				unsubs = append(unsubs, &models.ResthookUnsubscribe{OrgID: orgID, Slug: budgets.Resthook, URL: url})
+				unsubscribed[url] = true
+			}
+		}
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction")
+	}
+
+	if err := models.InsertWebhookEvents(ctx, tx, webhookEvents); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error inserting webhook events")
+	}
+	if len(unsubs) > 0 {
+		if err := models.UnsubscribeResthooks(ctx, tx, unsubs); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return errors.Wrapf(tx.Commit(), "error committing usage warnings")
+}
+
+// posts the given body to a resthook subscriber, returning the status of the response
+func post(rt *runtime.Runtime, url string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RapidProMailroom/"+rt.Config.Version)
+
+	client, retries, access := goflow.HTTP(rt.Config)
+
+	trace, err := httpx.DoTrace(client, req, retries, access, 1024)
+	if err != nil {
+		return 0, err
+	}
+	return trace.Response.StatusCode, nil
+}
@@ -0,0 +1,79 @@
+package warmup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	releaseLock = "release_warmup_msgs"
+
+	// how many delayed messages we queue for each org per run, so a busy day's spillover doesn't hog the cron
+	releaseBatchSize = 1000
+)
+
+func init() {
+	mailroom.AddInitFunction(StartWarmupCron)
+}
+
+// StartWarmupCron starts our cron job of queuing messages which were delayed by channel warm-ups once their day comes,
+// and the later parts of split messages once their delay has passed
+func StartWarmupCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.StartCron(quit, rt.RP, releaseLock, time.Minute,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return ReleaseDelayedMsgs(ctx, rt, lockName, lockValue)
+		},
+	)
+	return nil
+}
+
+// ReleaseDelayedMsgs queues to courier any messages delayed by channel warm-ups or message splitting which can now be sent
+func ReleaseDelayedMsgs(ctx context.Context, rt *runtime.Runtime, lockName string, lockValue string) error {
+	log := logrus.WithField("comp", "warmup_releaser").WithField("lock", lockValue)
+	start := time.Now()
+	now := dates.Now()
+
+	orgIDs, err := models.OrgIDsWithDelayedMessages(ctx, rt.DB, now)
+	if err != nil {
+		return err
+	}
+
+	released := 0
+	for _, orgID := range orgIDs {
+		oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+		if err != nil {
+			return errors.Wrapf(err, "error loading org assets for org: %d", orgID)
+		}
+
+		msgs, err := models.LoadDelayedMessages(ctx, rt.DB, oa, now, releaseBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		if err := models.ClearMessagesNextAttempt(ctx, rt.DB, msgs); err != nil {
+			return err
+		}
+
+		msgio.SendMessages(ctx, rt.DB, rt.RP, nil, msgs)
+		released += len(msgs)
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("released", released).Info("released delayed messages")
+	return nil
+}
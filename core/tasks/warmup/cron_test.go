@@ -0,0 +1,72 @@
+package warmup_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/core/tasks/warmup"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseDelayedMsgs(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	now := time.Now().UTC()
+	dates.SetNowSource(dates.NewFixedNowSource(now))
+
+	// warm up our Twilio channel so that it can only send one message today
+	db.MustExec(`UPDATE channels_channel SET config = $2 WHERE id = $1`, testdata.TwilioChannel.ID, fmt.Sprintf(`{"warmup": {"started_on": "%s", "caps": [1]}}`, now.Format(time.RFC3339)))
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, db, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	urn := urns.URN(fmt.Sprintf("tel:+16055741111?id=%d", testdata.Cathy.URNID))
+
+	msgs := make([]*models.Msg, 2)
+	for i := range msgs {
+		flowMsg := flows.NewMsgOut(urn, channel.ChannelReference(), "Hello", nil, nil, nil, flows.NilMsgTopic)
+		msgs[i], err = models.NewOutgoingMsg(oa.Org(), channel, testdata.Cathy.ID, flowMsg, now)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, models.InsertMessages(ctx, db, msgs))
+	require.NoError(t, models.ApplyChannelWarmups(ctx, db, rc, msgs, now))
+
+	// only the first message is sent today
+	msgio.SendMessages(ctx, db, rp, nil, msgs)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {1}})
+
+	// nothing to release yet
+	err = warmup.ReleaseDelayedMsgs(ctx, testsuite.RT(), "test", "test")
+	assert.NoError(t, err)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {1}})
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE next_attempt IS NOT NULL`, nil, 1)
+
+	// but tomorrow the second message can be sent
+	rc.Do("FLUSHDB")
+	dates.SetNowSource(dates.NewFixedNowSource(now.Add(time.Hour * 24)))
+
+	err = warmup.ReleaseDelayedMsgs(ctx, testsuite.RT(), "test", "test")
+	assert.NoError(t, err)
+
+	testsuite.AssertCourierQueues(t, map[string][]int{"msgs:74729f45-7f29-4868-9dc4-90e491e3c7d8|10/0": {1}})
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE next_attempt IS NOT NULL`, nil, 0)
+}
@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retryWebhooksLock = "retry_webhooks"
+
+	// the maximum number of retries made in one run
+	retryBatchSize = 100
+)
+
+// the slug of the resthook which is notified when a retried webhook call succeeds or is given up on
+const webhookRetriedResthook = "webhook-retried"
+
+func init() {
+	mailroom.AddInitFunction(StartRetryCron)
+}
+
+// StartRetryCron starts our cron job of retrying failed webhook calls
+func StartRetryCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	if rt.Config.WebhooksDeferredRetries == 0 {
+		return nil
+	}
+
+	cron.StartCron(quit, rt.RP, retryWebhooksLock, time.Minute,
+		func(lockName string, lockValue string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			_, err := RetryWebhooks(ctx, rt, time.Now())
+			return err
+		},
+	)
+	return nil
+}
+
+// webhookRetriedPayload is what's posted to resthook subscribers when a retried webhook call is resolved
+type webhookRetriedPayload struct {
+	Contact    *contactReference `json:"contact,omitempty"`
+	Resthook   string            `json:"resthook,omitempty"`
+	URL        string            `json:"url"`
+	Status     string            `json:"status"`
+	StatusCode int               `json:"status_code"`
+	Attempts   int               `json:"attempts"`
+}
+
+type contactReference struct {
+	UUID string `json:"uuid"`
+}
+
+// RetryWebhooks makes the next attempt of each failed webhook call whose retry is due, returning how many were made
+func RetryWebhooks(ctx context.Context, rt *runtime.Runtime, now time.Time) (int, error) {
+	retries, err := models.LoadDueWebhookRetries(ctx, rt.DB, now, retryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	retried := 0
+	for _, retry := range retries {
+		// stop if we've run out of time, the rest will still be due next time
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err := retryWebhook(ctx, rt, retry); err != nil {
+			return retried, errors.Wrapf(err, "error retrying webhook #%d", retry.ID())
+		}
+		retried++
+	}
+
+	if retried > 0 {
+		logrus.WithField("comp", "webhook_retrier").WithField("count", retried).WithField("elapsed", time.Since(now)).Info("retried webhooks")
+	}
+
+	return retried, nil
+}
+
+// makes the next attempt of a single webhook call, recording its result
+func retryWebhook(ctx context.Context, rt *runtime.Runtime, retry *models.WebhookRetry) error {
+	log := logrus.WithField("comp", "webhook_retrier").WithField("retry_id", retry.ID()).WithField("url", retry.URL())
+
+	request, err := retry.HTTPRequest(ctx, rt.Config)
+	if err != nil {
+		// a request we can't recreate will never succeed
+		log.WithError(err).Error("unable to recreate webhook request, giving up")
+		retry.GiveUp(time.Now())
+		return resolveRetry(ctx, rt, retry)
+	}
+
+	// this is already a retry so we don't also make immediate retries
+	client, _, access := goflow.HTTP(rt.Config)
+
+	start := time.Now()
+	trace, err := httpx.DoTrace(client, request, nil, access, rt.Config.WebhooksMaxBodyBytes)
+	elapsed := time.Since(start)
+
+	// like the engine, we use the response of a call which couldn't connect to say so
+	statusCode, requestTrace, response := 0, "", "connection error"
+	if trace != nil {
+		requestTrace = string(trace.RequestTrace)
+	}
+	if err == nil {
+		statusCode = trace.Response.StatusCode
+		response = string(trace.ResponseTrace) + string(trace.ResponseBody)
+	}
+
+	result := models.NewWebhookResult(retry.OrgID(), retry.ContactID(), retry.URL(), requestTrace, statusCode, response, elapsed, time.Now())
+	if err := models.InsertWebhookResults(ctx, rt.DB, []*models.WebhookResult{result}); err != nil {
+		return err
+	}
+
+	retry.RecordAttempt(rt.Config, statusCode, statusCode/100 == 2, time.Now())
+
+	log.WithField("status_code", statusCode).WithField("attempts", retry.Attempts()).WithField("status", retry.Status()).Debug("webhook retried")
+
+	return resolveRetry(ctx, rt, retry)
+}
+
+// saves the given retry after an attempt, and if it's no longer pending, notifies the org's resthook
+func resolveRetry(ctx context.Context, rt *runtime.Runtime, retry *models.WebhookRetry) error {
+	if err := models.UpdateWebhookRetry(ctx, rt.DB, retry); err != nil {
+		return err
+	}
+
+	if retry.Status() == models.WebhookRetryStatusPending {
+		return nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, retry.OrgID())
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets for org: %d", retry.OrgID())
+	}
+
+	resthook := oa.ResthookBySlug(webhookRetriedResthook)
+	if resthook == nil {
+		return nil
+	}
+
+	payload := &webhookRetriedPayload{
+		Resthook:   retry.Resthook(),
+		URL:        retry.URL(),
+		Status:     "succeeded",
+		StatusCode: retry.LastStatusCode(),
+		Attempts:   retry.Attempts(),
+	}
+	if retry.Status() == models.WebhookRetryStatusFailed {
+		payload.Status = "failed"
+	}
+	if retry.ContactUUID() != "" {
+		payload.Contact = &contactReference{UUID: string(retry.ContactUUID())}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling webhook retried payload")
+	}
+
+	err = models.InsertWebhookEvents(ctx, rt.DB, []*models.WebhookEvent{models.NewWebhookEvent(oa.OrgID(), resthook.ID(), string(data), time.Now())})
+	return errors.Wrapf(err, "error inserting webhook retried event")
+}
@@ -0,0 +1,85 @@
+package webhooks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/webhooks"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryWebhooks(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	defer testsuite.Reset()
+
+	rt.Config.WebhooksDeferredRetries = 2
+	defer func() { rt.Config.WebhooksDeferredRetries = 0 }()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"http://example.com/ok": {
+			httpx.NewMockResponse(200, nil, "OK"),
+		},
+		"http://example.com/down": {
+			httpx.MockConnectionError,
+			httpx.NewMockResponse(502, nil, "Bad Gateway"),
+		},
+	}))
+
+	db.MustExec(`INSERT INTO api_resthook(is_active, slug, org_id, created_on, modified_on, created_by_id, modified_by_id) VALUES(TRUE, 'webhook-retried', 1, NOW(), NOW(), 1, 1);`)
+
+	now := time.Now()
+	request := func(path string) string {
+		return "POST " + path + " HTTP/1.1\r\nHost: example.com\r\nContent-Length: 14\r\nContent-Type: application/json\r\n\r\n{\"name\":\"Bob\"}"
+	}
+
+	ok := models.NewWebhookRetry(testdata.Org1.ID, testdata.Cathy.ID, "", "http://example.com/ok", request("/ok"), 503, now.Add(-time.Minute))
+	down := models.NewWebhookRetry(testdata.Org1.ID, testdata.Bob.ID, "new-order", "http://example.com/down", request("/down"), 0, now.Add(-time.Minute))
+	garbled := models.NewWebhookRetry(testdata.Org1.ID, testdata.George.ID, "", "http://example.com/ok", "???", 502, now.Add(-time.Minute))
+	later := models.NewWebhookRetry(testdata.Org1.ID, testdata.Alexandria.ID, "", "http://example.com/ok", request("/ok"), 502, now.Add(time.Hour))
+
+	err := models.InsertWebhookRetries(ctx, db, rt.Config, []*models.WebhookRetry{ok, down, garbled, later})
+	require.NoError(t, err)
+
+	retried, err := webhooks.RetryWebhooks(ctx, rt, now)
+	require.NoError(t, err)
+	assert.Equal(t, 3, retried)
+
+	// the call which now succeeds is complete, the call which still can't connect is rescheduled, and the call we
+	// can't recreate is given up on
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'S' AND attempts = 1 AND last_status_code = 200`, []interface{}{ok.ID()}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'P' AND attempts = 1 AND last_status_code = 0 AND next_attempt_on > NOW() + INTERVAL '90 seconds'`, []interface{}{down.ID()}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'F' AND attempts = 0`, []interface{}{garbled.ID()}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'P' AND attempts = 0`, []interface{}{later.ID()}, 1)
+
+	// each attempt has a result like the original call
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookresult WHERE contact_id = $1 AND url = 'http://example.com/ok' AND status_code = 200`, []interface{}{testdata.Cathy.ID}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookresult WHERE contact_id = $1 AND url = 'http://example.com/down' AND status_code = 0 AND response = 'connection error'`, []interface{}{testdata.Bob.ID}, 1)
+
+	// and the resolved calls are sent to the resthook
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookevent WHERE data::jsonb @> $1::jsonb`, []interface{}{`{"contact": {"uuid": "` + string(testdata.Cathy.UUID) + `"}, "url": "http://example.com/ok", "status": "succeeded", "status_code": 200, "attempts": 1}`}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookevent WHERE data::jsonb @> $1::jsonb`, []interface{}{`{"contact": {"uuid": "` + string(testdata.George.UUID) + `"}, "status": "failed", "status_code": 502, "attempts": 0}`}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookevent`, nil, 2)
+
+	// nothing else is due yet
+	retried, err = webhooks.RetryWebhooks(ctx, rt, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, retried)
+
+	// the next attempt still fails and as that's the last attempt, that call is given up on too
+	retried, err = webhooks.RetryWebhooks(ctx, rt, now.Add(time.Minute*3))
+	require.NoError(t, err)
+	assert.Equal(t, 1, retried)
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookretry WHERE id = $1 AND status = 'F' AND attempts = 2 AND last_status_code = 502 AND next_attempt_on IS NULL`, []interface{}{down.ID()}, 1)
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM api_webhookevent WHERE data::jsonb @> $1::jsonb`, []interface{}{`{"contact": {"uuid": "` + string(testdata.Bob.UUID) + `"}, "resthook": "new-order", "url": "http://example.com/down", "status": "failed", "status_code": 502, "attempts": 2}`}, 1)
+}
@@ -10,20 +10,21 @@ require (
 	github.com/edganiukov/fcm v0.4.0
 	github.com/getsentry/raven-go v0.1.2-0.20190125112653-238ebd86338d // indirect
 	github.com/go-chi/chi v4.1.2+incompatible
-	github.com/golang/protobuf v1.4.0
+	github.com/golang/protobuf v1.5.2
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/gorilla/schema v1.1.0
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/lib/pq v1.4.0
 	github.com/mattn/go-sqlite3 v1.10.0 // indirect
+	github.com/mna/redisc v1.3.2
 	github.com/nyaruka/ezconf v0.2.1
 	github.com/nyaruka/gocommon v1.10.0
 	github.com/nyaruka/goflow v0.124.2
 	github.com/nyaruka/librato v1.0.0
 	github.com/nyaruka/logrus_sentry v0.8.2-0.20190129182604-c2962b80ba7d
 	github.com/nyaruka/null v1.2.0
-	github.com/nyaruka/phonenumbers v1.0.65 // indirect
+	github.com/nyaruka/phonenumbers v1.0.65
 	github.com/olivere/elastic/v7 v7.0.22
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
@@ -32,6 +33,10 @@ require (
 	github.com/shopspring/decimal v1.2.0
 	github.com/sirupsen/logrus v1.5.0
 	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	gopkg.in/go-playground/validator.v9 v9.31.0
 )
 
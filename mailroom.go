@@ -11,10 +11,14 @@ import (
 
 	"github.com/nyaruka/gocommon/storage"
 	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/redisutil"
+	"github.com/nyaruka/mailroom/utils/tracing"
 	"github.com/nyaruka/mailroom/web"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/librato"
@@ -55,18 +59,18 @@ type Mailroom struct {
 	handlerForeman *Foreman
 
 	webserver *web.Server
+
+	stopTracing func(context.Context) error
 }
 
 // NewMailroom creates and returns a new mailroom instance
 func NewMailroom(config *config.Config) *Mailroom {
 	mr := &Mailroom{
-		rt:   &runtime.Runtime{Config: config},
+		rt:   &runtime.Runtime{Config: config, DBAdvisory: &runtime.DBAdvisoryCache{}},
 		quit: make(chan bool),
 		wg:   &sync.WaitGroup{},
 	}
 	mr.ctx, mr.cancel = context.WithCancel(context.Background())
-	mr.batchForeman = NewForeman(mr.rt, mr.wg, queue.BatchQueue, config.BatchWorkers)
-	mr.handlerForeman = NewForeman(mr.rt, mr.wg, queue.HandlerQueue, config.HandlerWorkers)
 
 	return mr
 }
@@ -89,26 +93,19 @@ func (mr *Mailroom) Start() error {
 		return fmt.Errorf("invalid DB URL: '%s', only postgres is supported", c.DB)
 	}
 
-	// build our db
-	db, err := sqlx.Open("postgres", c.DB)
+	// build our main db pool, and the pools of any workloads which have their own
+	mr.rt.DB, err = openDBPool(c.DB, c.DBPoolSize)
 	if err != nil {
-		return fmt.Errorf("unable to open DB with config: '%s': %s", c.DB, err)
+		return err
 	}
 
-	// configure our pool
-	db.SetMaxIdleConns(8)
-	db.SetMaxOpenConns(c.DBPoolSize)
-	db.SetConnMaxLifetime(time.Minute * 30)
-	mr.rt.DB = db
-
-	// try connecting
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	err = db.PingContext(ctx)
-	cancel()
-	if err != nil {
-		log.Error("db not reachable")
-	} else {
-		log.Info("db ok")
+	mr.rt.DBPools = map[runtime.Workload]*sqlx.DB{runtime.WorkloadHandler: mr.rt.DB}
+	for w, size := range map[runtime.Workload]int{runtime.WorkloadBatch: c.DBBatchPoolSize, runtime.WorkloadCron: c.DBCronPoolSize, runtime.WorkloadWeb: c.DBWebPoolSize} {
+		if size > 0 {
+			if mr.rt.DBPools[w], err = openDBPool(c.DB, size); err != nil {
+				return err
+			}
+		}
 	}
 
 	// parse and test our redis config
@@ -117,6 +114,31 @@ func (mr *Mailroom) Start() error {
 		return fmt.Errorf("unable to parse Redis URL '%s': %s", c.Redis, err)
 	}
 
+	// dials a single redis instance, authenticating and selecting our DB if required
+	dialRedis := func(addr string) (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// send auth if required
+		if redisURL.User != nil {
+			pass, authRequired := redisURL.User.Password()
+			if authRequired {
+				if _, err := conn.Do("AUTH", pass); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+		}
+
+		// switch to the right DB, clusters only having the one
+		if !c.RedisCluster {
+			_, err = conn.Do("SELECT", strings.TrimLeft(redisURL.Path, "/"))
+		}
+		return conn, err
+	}
+
 	// create our pool
 	redisPool := &redis.Pool{
 		Wait:        true,              // makes callers wait for a connection
@@ -124,38 +146,26 @@ func (mr *Mailroom) Start() error {
 		MaxIdle:     4,                 // only keep up to this many idle
 		IdleTimeout: 240 * time.Second, // how long to wait before reaping a connection
 		Dial: func() (redis.Conn, error) {
-			conn, err := redis.Dial("tcp", redisURL.Host)
-			if err != nil {
-				return nil, err
-			}
-
-			// send auth if required
-			if redisURL.User != nil {
-				pass, authRequired := redisURL.User.Password()
-				if authRequired {
-					if _, err := conn.Do("AUTH", pass); err != nil {
-						conn.Close()
-						return nil, err
-					}
-				}
-			}
-
-			// switch to the right DB
-			_, err = conn.Do("SELECT", strings.TrimLeft(redisURL.Path, "/"))
-			return conn, err
+			return dialRedis(redisURL.Host)
 		},
 	}
-	mr.rt.RP = redisPool
 
-	// test our redis connection
-	conn := redisPool.Get()
-	defer conn.Close()
-	_, err = conn.Do("PING")
-	if err != nil {
-		log.WithError(err).Error("redis not reachable")
-	} else {
-		log.Info("redis ok")
+	// with sentinels we dial whichever instance is currently the master, and with a cluster we get connections bound to
+	// the node serving the key of their first command, which are pooled per node so aren't kept idle here
+	if c.RedisSentinels != "" {
+		redisPool.Dial = redisutil.SentinelDialer(strings.Split(c.RedisSentinels, ","), c.RedisSentinelMaster, dialRedis)
+		redisPool.TestOnBorrow = redisutil.TestRole
+	} else if c.RedisCluster {
+		redisPool.Dial, err = redisutil.ClusterDialer(strings.Split(redisURL.Host, ","), dialRedis)
+		if err != nil {
+			return fmt.Errorf("unable to connect to redis cluster: %s", err)
+		}
+		redisPool.MaxIdle = 0
 	}
+	mr.rt.RP = redisPool
+
+	// keys which are used together are hash tagged if RapidPro and courier have been configured to use them too
+	redisutil.UseHashTags(c.RedisHashTags)
 
 	// create our storage (S3 or file system)
 	if mr.rt.Config.AWSAccessKeyID != "" {
@@ -172,47 +182,74 @@ func (mr *Mailroom) Start() error {
 		}
 		mr.rt.MediaStorage = storage.NewS3(s3Client, mr.rt.Config.S3MediaBucket, 32)
 		mr.rt.SessionStorage = storage.NewS3(s3Client, mr.rt.Config.S3SessionBucket, 32)
+		mr.rt.MediaUploader = newMediaUploader(s3Client, c.S3MediaBucket)
+
+		// create storage for each of our data regions
+		regions, err := c.ParseS3Regions()
+		if err != nil {
+			return err
+		}
+		mr.rt.RegionalStorage = make(map[string]*runtime.RegionStorage, len(regions))
+		for _, r := range regions {
+			regionClient, err := storage.NewS3Client(&storage.S3Options{
+				AWSAccessKeyID:     c.AWSAccessKeyID,
+				AWSSecretAccessKey: c.AWSSecretAccessKey,
+				Endpoint:           r.Endpoint,
+				Region:             r.S3Region,
+				DisableSSL:         c.S3DisableSSL,
+				ForcePathStyle:     c.S3ForcePathStyle,
+			})
+			if err != nil {
+				return err
+			}
+			mr.rt.RegionalStorage[r.Name] = &runtime.RegionStorage{
+				MediaStorage:   storage.NewS3(regionClient, r.MediaBucket, 32),
+				SessionStorage: runtime.NewFallbackStorage(storage.NewS3(regionClient, r.SessionBucket, 32), mr.rt.SessionStorage),
+				MediaUploader:  newMediaUploader(regionClient, r.MediaBucket),
+			}
+			log.WithField("region", r.Name).WithField("endpoint", r.Endpoint).Info("regional storage configured")
+		}
 	} else {
 		mr.rt.MediaStorage = storage.NewFS("_storage")
 		mr.rt.SessionStorage = storage.NewFS("_storage")
 	}
 
-	// test our media storage
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
-	err = mr.rt.MediaStorage.Test(ctx)
-	cancel()
-
-	if err != nil {
-		log.WithError(err).Error(mr.rt.MediaStorage.Name() + " media storage not available")
-	} else {
-		log.Info(mr.rt.MediaStorage.Name() + " media storage ok")
-	}
-
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
-	err = mr.rt.SessionStorage.Test(ctx)
-	cancel()
-
-	if err != nil {
-		log.WithError(err).Error(mr.rt.SessionStorage.Name() + " session storage not available")
-	} else {
-		log.Info(mr.rt.SessionStorage.Name() + " session storage ok")
-	}
-
 	// initialize our elastic client
 	mr.rt.ES, err = newElasticClient(c.Elastic)
 	if err != nil {
 		log.WithError(err).Error("unable to connect to elastic, check configuration")
-	} else {
-		log.Info("elastic ok")
 	}
 
+	// check everything we depend on is reachable and compatible before we start doing any work
+	mr.rt.FailedChecks = RunStartupChecks(mr.ctx, mr.rt)
+	if len(mr.rt.FailedChecks) > 0 {
+		if c.StrictStartup {
+			return fmt.Errorf("startup checks failed: %s", strings.Join(mr.rt.FailedChecks, ", "))
+		}
+		log.WithField("failed_checks", mr.rt.FailedChecks).Warn("starting in degraded state")
+	}
+
+	// now that our runtime is ready, create the runtimes of any workloads with their own db pools
+	mr.rt.InitWorkloads()
+
 	// warn if we won't be doing FCM syncing
 	if c.FCMKey == "" {
 		logrus.Error("fcm not configured, no syncing of android channels")
 	}
 
+	// export traces if we have a collector to send them to
+	mr.stopTracing, err = tracing.Configure(mr.ctx, c.OTLPEndpoint, c.TraceSampleRate, c.Version)
+	if err != nil {
+		return err
+	}
+
 	for _, initFunc := range initFunctions {
-		initFunc(mr.rt, mr.wg, mr.quit)
+		if err := initFunc(mr.rt.ForWorkload(runtime.WorkloadCron), mr.wg, mr.quit); err != nil {
+			if c.StrictStartup {
+				return err
+			}
+			log.WithError(err).Error("error running init function")
+		}
 	}
 
 	// if we have a librato token, configure it
@@ -222,12 +259,19 @@ func (mr *Mailroom) Start() error {
 		librato.Start()
 	}
 
+	// warm the asset caches of our most active orgs so that we're not loading them all as we start handling their tasks
+	if c.WarmOrgs > 0 {
+		mr.warmOrgAssets(c.WarmOrgs)
+	}
+
 	// init our foremen and start it
+	mr.batchForeman = NewForeman(mr.rt.ForWorkload(runtime.WorkloadBatch), mr.wg, queue.BatchQueue, c.BatchWorkers, c.BatchWorkersMax)
+	mr.handlerForeman = NewForeman(mr.rt.ForWorkload(runtime.WorkloadHandler), mr.wg, queue.HandlerQueue, c.HandlerWorkers, c.HandlerWorkersMax)
 	mr.batchForeman.Start()
 	mr.handlerForeman.Start()
 
 	// start our web server
-	mr.webserver = web.NewServer(mr.ctx, c, mr.rt.DB, mr.rt.RP, mr.rt.MediaStorage, mr.rt.ES, mr.wg)
+	mr.webserver = web.NewServer(mr.ctx, mr.rt.ForWorkload(runtime.WorkloadWeb), mr.wg)
 	mr.webserver.Start()
 
 	logrus.Info("mailroom started")
@@ -248,11 +292,62 @@ func (mr *Mailroom) Stop() error {
 	mr.webserver.Stop()
 
 	mr.wg.Wait()
+
+	// flush any spans that haven't been exported yet
+	if mr.stopTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := mr.stopTracing(ctx); err != nil {
+			logrus.WithError(err).Error("error stopping tracing")
+		}
+		cancel()
+	}
+
 	mr.rt.ES.Stop()
+	mr.rt.CloseDBPools()
 	logrus.Info("mailroom stopped")
 	return nil
 }
 
+// opens a pool of connections to our db with the given maximum number of open connections
+func openDBPool(dsn string, size int) (*sqlx.DB, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open DB with config: '%s': %s", dsn, err)
+	}
+
+	// configure our pool
+	db.SetMaxIdleConns(8)
+	db.SetMaxOpenConns(size)
+	db.SetConnMaxLifetime(time.Minute * 30)
+	return db, nil
+}
+
+// loads the assets of the given number of our most active orgs into our cache
+func (mr *Mailroom) warmOrgAssets(count int) {
+	start := time.Now()
+
+	rc := mr.rt.RP.Get()
+	ids, err := queue.MostActive(rc, start, count)
+	rc.Close()
+
+	if err != nil {
+		logrus.WithError(err).Error("error getting most active orgs to warm")
+		return
+	}
+
+	orgIDs := make([]models.OrgID, len(ids))
+	for i, id := range ids {
+		orgIDs[i] = models.OrgID(id)
+	}
+
+	ctx, cancel := context.WithTimeout(mr.ctx, time.Minute*5)
+	defer cancel()
+
+	failed := models.WarmOrgAssets(ctx, mr.rt.DB, orgIDs)
+
+	logrus.WithField("orgs", len(orgIDs)).WithField("failed", len(failed)).WithField("elapsed", time.Since(start)).Info("warmed org assets")
+}
+
 func newElasticClient(url string) (*elastic.Client, error) {
 	// enable retrying
 	backoff := elastic.NewSimpleBackoff(500, 1000, 2000)
@@ -265,3 +360,11 @@ func newElasticClient(url string) (*elastic.Client, error) {
 		elastic.SetRetrier(retrier),
 	)
 }
+
+// creates an uploader for direct uploads to the given media bucket if the client is a real S3 client
+func newMediaUploader(client storage.S3Client, bucket string) runtime.MediaUploader {
+	if s3Client, isS3 := client.(*s3.S3); isS3 {
+		return runtime.NewS3MediaUploader(s3Client, bucket)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package runtime
 
 import (
+	"context"
+	"sync"
+
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/nyaruka/gocommon/storage"
 	"github.com/nyaruka/mailroom/config"
 	"github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
 )
 
 // Runtime represents the set of services required to run many Mailroom functions. Used as a wrapper for
@@ -17,4 +21,177 @@ type Runtime struct {
 	MediaStorage   storage.Storage
 	SessionStorage storage.Storage
 	Config         *config.Config
+
+	// creates URLs for clients to upload media directly to our media storage, nil if our storage doesn't support that
+	MediaUploader MediaUploader
+
+	// storage for orgs whose data must stay in a specific region, keyed by region name
+	RegionalStorage map[string]*RegionStorage
+
+	// the names of any startup checks which failed, in which case we're running degraded
+	FailedChecks []string
+
+	// what the last periodic check of the database advised, cached so that health checks don't need redis
+	DBAdvisory *DBAdvisoryCache
+
+	// db pools dedicated to a workload, keyed by workload, so that e.g. batch tasks can't starve message handling
+	DBPools map[Workload]*sqlx.DB
+
+	// the runtimes of workloads with their own db pools, created once by InitWorkloads
+	workloads map[Workload]*Runtime
+}
+
+// Workload is a kind of work which can have its own db pool
+type Workload string
+
+// the workloads which can have their own db pools, anything else uses the handler pool
+const (
+	WorkloadHandler = Workload("handler")
+	WorkloadBatch   = Workload("batch")
+	WorkloadCron    = Workload("cron")
+	WorkloadWeb     = Workload("web")
+)
+
+// InitWorkloads creates the runtime of each workload which has its own db pool. It should be called once this runtime
+// is fully initialized as each workload runtime shares all of its other services.
+func (r *Runtime) InitWorkloads() {
+	r.workloads = make(map[Workload]*Runtime, len(r.DBPools))
+
+	for w, db := range r.DBPools {
+		if db != nil && db != r.DB {
+			wr := *r
+			wr.DB = db
+			wr.workloads = nil
+			r.workloads[w] = &wr
+		}
+	}
+}
+
+// ForWorkload returns the runtime for the passed in workload, or this runtime if that workload doesn't have its own pool
+func (r *Runtime) ForWorkload(w Workload) *Runtime {
+	if wr := r.workloads[w]; wr != nil {
+		return wr
+	}
+	return r
+}
+
+// CloseDBPools closes our main db pool and the pools of any workloads which have their own
+func (r *Runtime) CloseDBPools() {
+	for _, db := range r.DBPools {
+		if db != nil && db != r.DB {
+			db.Close()
+		}
+	}
+	if r.DB != nil {
+		r.DB.Close()
+	}
+}
+
+// DBAdvisoryCache holds the indexes which were missing when the database was last checked
+type DBAdvisoryCache struct {
+	mutex          sync.RWMutex
+	missingIndexes []string
+}
+
+// SetMissingIndexes updates the cached missing indexes
+func (c *DBAdvisoryCache) SetMissingIndexes(indexes []string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.missingIndexes = indexes
+	c.mutex.Unlock()
+}
+
+// MissingIndexes returns the cached missing indexes
+func (c *DBAdvisoryCache) MissingIndexes() []string {
+	if c == nil {
+		return nil
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.missingIndexes
+}
+
+// RegionStorage is the media and session storage for a data region
+type RegionStorage struct {
+	MediaStorage   storage.Storage
+	SessionStorage storage.Storage
+	MediaUploader  MediaUploader
+}
+
+// FallbackStorage is storage which reads anything it can't find from another storage, e.g. so that the sessions of an
+// org which was moved into a region can still be read from the default storage they were written to
+type FallbackStorage struct {
+	storage.Storage
+
+	fallback storage.Storage
+}
+
+// NewFallbackStorage creates a new storage which writes to primary and reads from fallback anything not in primary
+func NewFallbackStorage(primary, fallback storage.Storage) *FallbackStorage {
+	return &FallbackStorage{Storage: primary, fallback: fallback}
+}
+
+// Get gets the object at the given path, trying our fallback storage if that fails
+func (s *FallbackStorage) Get(ctx context.Context, path string) (string, []byte, error) {
+	contentType, contents, err := s.Storage.Get(ctx, path)
+	if err != nil && s.fallback != nil {
+		if fbType, fbContents, fbErr := s.fallback.Get(ctx, path); fbErr == nil {
+			return fbType, fbContents, nil
+		}
+	}
+	return contentType, contents, err
+}
+
+// MediaStorageFor returns the media storage for the passed in region, or our default storage if no region is given. The
+// storage of a region which isn't configured fails every read and write rather than putting data outside that region.
+func (r *Runtime) MediaStorageFor(region string) storage.Storage {
+	if region == "" {
+		return r.MediaStorage
+	}
+	if rs := r.RegionalStorage[region]; rs != nil {
+		return rs.MediaStorage
+	}
+	return &unconfiguredStorage{region: region}
+}
+
+// SessionStorageFor returns the session storage for the passed in region, or our default storage if no region is given.
+// The storage of a region which isn't configured fails every read and write rather than putting data outside that region.
+func (r *Runtime) SessionStorageFor(region string) storage.Storage {
+	if region == "" {
+		return r.SessionStorage
+	}
+	if rs := r.RegionalStorage[region]; rs != nil {
+		return rs.SessionStorage
+	}
+	return &unconfiguredStorage{region: region}
+}
+
+// storage for a region which has no configured storage, which errors on everything
+type unconfiguredStorage struct {
+	region string
+}
+
+func (s *unconfiguredStorage) err() error {
+	return errors.Errorf("no storage configured for region '%s'", s.region)
+}
+
+func (s *unconfiguredStorage) Name() string { return "unconfigured" }
+
+func (s *unconfiguredStorage) Test(ctx context.Context) error { return s.err() }
+
+func (s *unconfiguredStorage) Get(ctx context.Context, path string) (string, []byte, error) {
+	return "", nil, s.err()
+}
+
+func (s *unconfiguredStorage) Put(ctx context.Context, path string, contentType string, contents []byte) (string, error) {
+	return "", s.err()
+}
+
+func (s *unconfiguredStorage) BatchPut(ctx context.Context, uploads []*storage.Upload) error {
+	for _, u := range uploads {
+		u.Error = s.err()
+	}
+	return s.err()
 }
@@ -0,0 +1,97 @@
+package runtime_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/gocommon/storage"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackStorage(t *testing.T) {
+	ctx := context.Background()
+
+	defer os.RemoveAll("_test_primary")
+	defer os.RemoveAll("_test_fallback")
+
+	primary := storage.NewFS("_test_primary")
+	fallback := storage.NewFS("_test_fallback")
+	s := runtime.NewFallbackStorage(primary, fallback)
+
+	_, err := fallback.Put(ctx, "/old.json", "application/json", []byte(`{"old":true}`))
+	require.NoError(t, err)
+
+	_, err = s.Put(ctx, "/new.json", "application/json", []byte(`{"new":true}`))
+	require.NoError(t, err)
+
+	// new objects are only written to primary
+	_, _, err = fallback.Get(ctx, "/new.json")
+	assert.Error(t, err)
+
+	_, contents, err := s.Get(ctx, "/new.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"new":true}`, string(contents))
+
+	// but objects only in our fallback can still be read
+	_, contents, err = s.Get(ctx, "/old.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"old":true}`, string(contents))
+
+	_, _, err = s.Get(ctx, "/missing.json")
+	assert.Error(t, err)
+}
+
+func TestStorageFor(t *testing.T) {
+	ctx := context.Background()
+
+	defaultStorage := storage.NewFS("_test_default")
+	euStorage := storage.NewFS("_test_eu")
+
+	rt := &runtime.Runtime{
+		MediaStorage:    defaultStorage,
+		SessionStorage:  defaultStorage,
+		RegionalStorage: map[string]*runtime.RegionStorage{"eu": {MediaStorage: euStorage, SessionStorage: euStorage}},
+	}
+
+	assert.Same(t, defaultStorage, rt.MediaStorageFor(""))
+	assert.Same(t, defaultStorage, rt.SessionStorageFor(""))
+	assert.Same(t, euStorage, rt.MediaStorageFor("eu"))
+	assert.Same(t, euStorage, rt.SessionStorageFor("eu"))
+
+	// a region without storage never falls back to our default storage
+	_, err := rt.MediaStorageFor("us").Put(ctx, "/test.json", "application/json", []byte(`{}`))
+	assert.EqualError(t, err, "no storage configured for region 'us'")
+
+	_, _, err = rt.SessionStorageFor("us").Get(ctx, "/test.json")
+	assert.EqualError(t, err, "no storage configured for region 'us'")
+}
+
+func TestForWorkload(t *testing.T) {
+	mainDB, batchDB := &sqlx.DB{}, &sqlx.DB{}
+
+	rt := &runtime.Runtime{
+		DB:      mainDB,
+		DBPools: map[runtime.Workload]*sqlx.DB{runtime.WorkloadHandler: mainDB, runtime.WorkloadBatch: batchDB},
+	}
+
+	// before workloads are initialized, everything uses our runtime
+	assert.Same(t, rt, rt.ForWorkload(runtime.WorkloadBatch))
+
+	rt.FailedChecks = []string{"elastic"}
+	rt.InitWorkloads()
+
+	assert.Same(t, rt, rt.ForWorkload(runtime.WorkloadHandler))
+	assert.Same(t, rt, rt.ForWorkload(runtime.WorkloadWeb))
+
+	// a workload with its own pool gets a runtime using that pool, which is the same runtime every time
+	batchRT := rt.ForWorkload(runtime.WorkloadBatch)
+	assert.NotSame(t, rt, batchRT)
+	assert.Same(t, batchDB, batchRT.DB)
+	assert.Same(t, batchRT, rt.ForWorkload(runtime.WorkloadBatch))
+	assert.Equal(t, []string{"elastic"}, batchRT.FailedChecks)
+}
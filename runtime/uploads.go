@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// MediaUploader creates time limited URLs which clients can use to upload media directly to our media storage
+type MediaUploader interface {
+	// PresignUpload returns a URL which can be used to PUT an object with the given path and content type, and the
+	// headers which must be sent with that request
+	PresignUpload(path, contentType string, expires time.Duration) (string, map[string]string, error)
+}
+
+type s3MediaUploader struct {
+	client *s3.S3
+	bucket string
+}
+
+// NewS3MediaUploader creates a new uploader for the given S3 bucket
+func NewS3MediaUploader(client *s3.S3, bucket string) MediaUploader {
+	return &s3MediaUploader{client: client, bucket: bucket}
+}
+
+func (u *s3MediaUploader) PresignUpload(path, contentType string, expires time.Duration) (string, map[string]string, error) {
+	req, _ := u.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(u.bucket),
+		Key:         aws.String(path),
+		ContentType: aws.String(contentType),
+		ACL:         aws.String(s3.BucketCannedACLPublicRead),
+	})
+
+	url, err := req.Presign(expires)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "error presigning upload to %s", path)
+	}
+
+	// uploaded media is public like the media we store ourselves
+	return url, map[string]string{"Content-Type": contentType, "x-amz-acl": s3.BucketCannedACLPublicRead}, nil
+}
+
+// MediaUploaderFor returns the media uploader for the passed in region, or our default uploader if no region is given,
+// which will be nil if that media storage doesn't support direct uploads or the region isn't configured
+func (r *Runtime) MediaUploaderFor(region string) MediaUploader {
+	if region == "" {
+		return r.MediaUploader
+	}
+	if rs := r.RegionalStorage[region]; rs != nil {
+		return rs.MediaUploader
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package runtime_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3MediaUploader(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	require.NoError(t, err)
+
+	uploader := runtime.NewS3MediaUploader(s3.New(sess), "mailroom-media")
+
+	// presigning doesn't need to talk to S3
+	uploadURL, headers, err := uploader.PresignUpload("/media/1/6683/83ba/668383ba-387c-49bc-b164-1213ac0ea7aa.jpg", "image/jpeg", time.Minute*15)
+	require.NoError(t, err)
+
+	u, err := url.Parse(uploadURL)
+	require.NoError(t, err)
+	assert.Equal(t, "mailroom-media.s3.amazonaws.com", u.Host)
+	assert.Equal(t, "/media/1/6683/83ba/668383ba-387c-49bc-b164-1213ac0ea7aa.jpg", u.Path)
+	assert.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	assert.Contains(t, u.Query().Get("X-Amz-SignedHeaders"), "content-type")
+	assert.NotEqual(t, "", u.Query().Get("X-Amz-Signature"))
+
+	assert.Equal(t, map[string]string{"Content-Type": "image/jpeg", "x-amz-acl": "public-read"}, headers)
+
+	// without a regional uploader, orgs use our default uploader, which may be nil
+	rt := &runtime.Runtime{MediaUploader: uploader, RegionalStorage: map[string]*runtime.RegionStorage{"eu": {}}}
+	assert.Equal(t, uploader, rt.MediaUploaderFor(""))
+	assert.Nil(t, rt.MediaUploaderFor("eu"))
+
+	// and orgs in regions we don't have storage for can't upload at all
+	assert.Nil(t, rt.MediaUploaderFor("us"))
+}
@@ -0,0 +1,112 @@
+package aggregates
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+)
+
+// InterceptHost is the host of webhook URLs which query org aggregates rather than making an HTTP call:
+//
+//   GET https://aggregates.mailroom/contacts
+//   GET https://aggregates.mailroom/group_contacts?group=<uuid>
+//   GET https://aggregates.mailroom/flow_runs?flow=<uuid>&period=today
+//   GET https://aggregates.mailroom/flow_responses?flow=<uuid>&period=today
+//
+// The response is the count, e.g. {"count": 153}, and the period is optional, defaulting to all time.
+const InterceptHost = "aggregates.mailroom"
+
+// timeout for aggregates calculated for intercepted webhook calls
+const aggregateTimeout = time.Second * 15
+
+func init() {
+	mailroom.AddInitFunction(StartInterceptor)
+}
+
+// StartInterceptor registers our webhook interceptor with the engine
+func StartInterceptor(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookInterceptor(func(session flows.Session, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+		return Intercept(rt, session.Assets().Source().(*models.OrgAssets), request)
+	})
+	return nil
+}
+
+// Intercept handles webhook requests to our intercept host by getting the requested aggregate
+func Intercept(rt *runtime.Runtime, oa *models.OrgAssets, request *http.Request) (*flows.WebhookCall, error) {
+	if request.URL.Host != InterceptHost {
+		return nil, nil
+	}
+
+	start := time.Now()
+
+	agg, err := parseAggregate(oa, models.AggregateType(strings.Trim(request.URL.Path, "/")), request.URL.Query())
+	if err != nil {
+		return goflow.NewInterceptedCall(request, start, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), aggregateTimeout)
+	defer cancel()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	count, err := models.GetAggregate(ctx, rt.DB, rc, oa.OrgID(), agg)
+	if err != nil {
+		return nil, err
+	}
+
+	return goflow.NewInterceptedCall(request, start, http.StatusOK, map[string]int64{"count": count})
+}
+
+func parseAggregate(oa *models.OrgAssets, aggType models.AggregateType, params map[string][]string) (*models.Aggregate, error) {
+	param := func(name string) string {
+		if values := params[name]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	agg := &models.Aggregate{Type: aggType}
+
+	switch aggType {
+	case models.AggregateTypeContacts:
+	case models.AggregateTypeGroupContacts:
+		group := oa.GroupByUUID(assets.GroupUUID(param("group")))
+		if group == nil {
+			return nil, errors.Errorf("no such group '%s'", param("group"))
+		}
+		agg.GroupID = group.ID()
+	case models.AggregateTypeFlowRuns, models.AggregateTypeFlowResponses:
+		flow, err := oa.Flow(assets.FlowUUID(param("flow")))
+		if err != nil {
+			return nil, errors.Errorf("no such flow '%s'", param("flow"))
+		}
+		agg.FlowID = flow.(*models.Flow).ID()
+	default:
+		return nil, errors.Errorf("unknown aggregate '%s'", aggType)
+	}
+
+	switch param("period") {
+	case "", "all":
+	case "today":
+		now := dates.Now().In(oa.Env().Timezone())
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		agg.Since = &today
+	default:
+		return nil, errors.Errorf("unknown period '%s', must be all or today", param("period"))
+	}
+
+	return agg, nil
+}
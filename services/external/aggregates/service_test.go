@@ -0,0 +1,81 @@
+package aggregates_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/external/aggregates"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntercept(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	defer testsuite.Reset()
+
+	testdata.InsertFlowRun(db, testdata.Org1, models.SessionID(0), testdata.Cathy, testdata.Favorites, models.RunStatusCompleted, "", nil)
+	testdata.InsertFlowRun(db, testdata.Org1, models.SessionID(0), testdata.Bob, testdata.Favorites, models.RunStatusCompleted, "", nil)
+	oldRunID := testdata.InsertFlowRun(db, testdata.Org1, models.SessionID(0), testdata.George, testdata.Favorites, models.RunStatusCompleted, "", nil)
+	db.MustExec(`UPDATE flows_flowrun SET created_on = NOW() - INTERVAL '3 days', responded = FALSE WHERE id = $1`, oldRunID)
+
+	var numContacts, numDoctors int64
+	require.NoError(t, db.Get(&numContacts, `SELECT count(*) FROM contacts_contact WHERE org_id = $1 AND is_active = TRUE AND status = 'A'`, testdata.Org1.ID))
+	require.NoError(t, db.Get(&numDoctors, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.DoctorsGroup.ID))
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	intercept := func(url string) (int, string) {
+		request, _ := httpx.NewRequest("GET", url, nil, nil)
+		call, err := aggregates.Intercept(rt, oa, request)
+		require.NoError(t, err)
+		if call == nil {
+			return 0, ""
+		}
+		return call.Response.StatusCode, string(call.ResponseBody)
+	}
+
+	tcs := []struct {
+		url            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"https://example.com/contacts", 0, ``},
+		{"https://aggregates.mailroom/contacts", 200, `{"count":` + itoa(numContacts) + `}`},
+		{"https://aggregates.mailroom/group_contacts?group=" + string(testdata.DoctorsGroup.UUID), 200, `{"count":` + itoa(numDoctors) + `}`},
+		{"https://aggregates.mailroom/flow_runs?flow=" + string(testdata.Favorites.UUID), 200, `{"count":3}`},
+		{"https://aggregates.mailroom/flow_runs?flow=" + string(testdata.Favorites.UUID) + "&period=today", 200, `{"count":2}`},
+		{"https://aggregates.mailroom/flow_responses?flow=" + string(testdata.Favorites.UUID), 200, `{"count":2}`},
+		{"https://aggregates.mailroom/flow_responses?flow=" + string(testdata.Favorites.UUID) + "&period=today", 200, `{"count":2}`},
+		{"https://aggregates.mailroom/group_contacts?group=8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d", 400, `{"error":"no such group '8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d'"}`},
+		{"https://aggregates.mailroom/flow_runs?flow=8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d", 400, `{"error":"no such flow '8a7c1b0e-2f5d-4a9c-9e3b-5d6f7a8b9c0d'"}`},
+		{"https://aggregates.mailroom/flow_runs?flow=" + string(testdata.Favorites.UUID) + "&period=forever", 400, `{"error":"unknown period 'forever', must be all or today"}`},
+		{"https://aggregates.mailroom/messages", 400, `{"error":"unknown aggregate 'messages'"}`},
+	}
+
+	for _, tc := range tcs {
+		status, body := intercept(tc.url)
+		assert.Equal(t, tc.expectedStatus, status, "status mismatch for %s", tc.url)
+		assert.Equal(t, tc.expectedBody, body, "body mismatch for %s", tc.url)
+	}
+
+	// new runs aren't counted until the cached aggregate expires
+	testdata.InsertFlowRun(db, testdata.Org1, models.SessionID(0), testdata.Alexandria, testdata.Favorites, models.RunStatusCompleted, "", nil)
+
+	_, body := intercept("https://aggregates.mailroom/flow_runs?flow=" + string(testdata.Favorites.UUID))
+	assert.Equal(t, `{"count":3}`, body)
+
+	count, err := models.CalculateAggregate(ctx, db, testdata.Org1.ID, &models.Aggregate{Type: models.AggregateTypeFlowRuns, FlowID: testdata.Favorites.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
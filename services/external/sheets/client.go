@@ -0,0 +1,72 @@
+package sheets
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+
+	"github.com/pkg/errors"
+)
+
+const apiBaseURL = "https://sheets.googleapis.com/v4"
+
+// Client is a basic Google Sheets client
+type Client struct {
+	httpClient  *http.Client
+	httpRetries *httpx.RetryConfig
+	accessToken string
+}
+
+// NewClient creates a new Google Sheets client
+func NewClient(httpClient *http.Client, httpRetries *httpx.RetryConfig, accessToken string) *Client {
+	return &Client{
+		httpClient:  httpClient,
+		httpRetries: httpRetries,
+		accessToken: accessToken,
+	}
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// AppendRow appends a row of values after the last row of the given sheet
+// see https://developers.google.com/sheets/api/reference/rest/v4/spreadsheets.values/append
+func (c *Client) AppendRow(spreadsheetID, sheet string, values []interface{}) (*httpx.Trace, error) {
+	appendURL := fmt.Sprintf("%s/spreadsheets/%s/values/%s:append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS", apiBaseURL, url.PathEscape(spreadsheetID), url.PathEscape(sheet))
+
+	body := map[string]interface{}{"values": []interface{}{values}}
+	bodyJSON, err := jsonx.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := httpx.NewRequest("POST", appendURL, bytes.NewReader(bodyJSON), map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+
+	trace, err := httpx.DoTrace(c.httpClient, req, c.httpRetries, nil, -1)
+	if err != nil {
+		return trace, err
+	}
+
+	if trace.Response.StatusCode >= 400 {
+		response := &errorResponse{}
+		jsonx.Unmarshal(trace.ResponseBody, response)
+		if response.Error.Message != "" {
+			return trace, errors.New(response.Error.Message)
+		}
+		return trace, errors.Errorf("sheets API returned status %d", trace.Response.StatusCode)
+	}
+
+	return trace, nil
+}
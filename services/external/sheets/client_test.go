@@ -0,0 +1,40 @@
+package sheets_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/services/external/sheets"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendRow(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://sheets.googleapis.com/v4/spreadsheets/1BxiMVs0XRA5/values/Sheet1:append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS": {
+			httpx.MockConnectionError,
+			httpx.NewMockResponse(403, nil, `{"error": {"code": 403, "message": "The caller does not have permission", "status": "PERMISSION_DENIED"}}`),
+			httpx.NewMockResponse(500, nil, `Oops`),
+			httpx.NewMockResponse(200, nil, `{"spreadsheetId": "1BxiMVs0XRA5", "updates": {"updatedRows": 1}}`),
+		},
+	}))
+
+	client := sheets.NewClient(http.DefaultClient, nil, "sesame")
+
+	_, err := client.AppendRow("1BxiMVs0XRA5", "Sheet1", []interface{}{"Cathy", 23})
+	assert.EqualError(t, err, "unable to connect to server")
+
+	_, err = client.AppendRow("1BxiMVs0XRA5", "Sheet1", []interface{}{"Cathy", 23})
+	assert.EqualError(t, err, "The caller does not have permission")
+
+	_, err = client.AppendRow("1BxiMVs0XRA5", "Sheet1", []interface{}{"Cathy", 23})
+	assert.EqualError(t, err, "sheets API returned status 500")
+
+	trace, err := client.AppendRow("1BxiMVs0XRA5", "Sheet1", []interface{}{"Cathy", 23})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+	assert.Equal(t, "Bearer sesame", trace.Request.Header.Get("Authorization"))
+}
@@ -0,0 +1,116 @@
+package sheets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// InterceptHost is the host of webhook URLs which append to sheets rather than making an HTTP call, e.g. a webhook
+	// node calling https://sheets.mailroom/registrations appends to the org's "registrations" destination
+	InterceptHost = "sheets.mailroom"
+
+	configDestinations = "google_sheets"
+)
+
+func init() {
+	mailroom.AddInitFunction(StartInterceptor)
+}
+
+// Destination is a sheet which flows can append rows to, configured on the org by name
+type Destination struct {
+	SpreadsheetID string `json:"spreadsheet_id"`
+	Sheet         string `json:"sheet"`
+
+	// the key of the OAuth token stored for the org which has access to the spreadsheet
+	Integration string `json:"integration"`
+}
+
+// GetDestination gets the destination with the given name for the passed in org
+func GetDestination(org *models.Org, name string) (*Destination, error) {
+	destinations := make(map[string]*Destination)
+	if _, err := org.ConfigObject(configDestinations, &destinations); err != nil {
+		return nil, err
+	}
+
+	dest := destinations[name]
+	if dest == nil || dest.SpreadsheetID == "" {
+		return nil, errors.Errorf("no such sheet destination '%s'", name)
+	}
+	if dest.Sheet == "" {
+		dest.Sheet = "Sheet1"
+	}
+	if dest.Integration == "" {
+		dest.Integration = "sheets"
+	}
+	return dest, nil
+}
+
+// StartInterceptor registers our webhook interceptor with the engine
+func StartInterceptor(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookInterceptor(func(session flows.Session, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+		return Intercept(rt, session.Assets().Source().(*models.OrgAssets), request, simulated)
+	})
+	return nil
+}
+
+// Intercept handles webhook requests to our intercept host by queuing a task to append a row to the sheet. The body of
+// the request should be a JSON object with the row as an array of values, e.g. {"values": ["@contact.name", "@results.age"]}
+func Intercept(rt *runtime.Runtime, oa *models.OrgAssets, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+	if request.URL.Host != InterceptHost {
+		return nil, nil
+	}
+
+	start := time.Now()
+	name := strings.Trim(request.URL.Path, "/")
+
+	body := []byte{}
+	if request.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(request.Body); err != nil {
+			return nil, errors.Wrapf(err, "error reading sheets request body")
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	payload := &struct {
+		Values []interface{} `json:"values"`
+	}{}
+	if err := jsonx.Unmarshal(body, payload); err != nil || len(payload.Values) == 0 {
+		return goflow.NewInterceptedCall(request, start, http.StatusBadRequest, map[string]string{"error": "request body must be an object with a non-empty values array"})
+	}
+
+	if _, err := GetDestination(oa.Org(), name); err != nil {
+		return goflow.NewInterceptedCall(request, start, http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+
+	// simulated sessions don't get to modify real sheets
+	if !simulated {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		task := &AppendRowTask{Destination: name, Values: payload.Values}
+		if err := queue.AddTask(rc, queue.BatchQueue, TypeAppendRow, int(oa.OrgID()), task, queue.DefaultPriority); err != nil {
+			return nil, errors.Wrapf(err, "error queuing sheets append task")
+		}
+
+		logrus.WithField("org_id", oa.OrgID()).WithField("destination", name).Debug("queued sheets append")
+	}
+
+	return goflow.NewInterceptedCall(request, start, http.StatusOK, map[string]string{"status": "queued"})
+}
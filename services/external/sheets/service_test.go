@@ -0,0 +1,109 @@
+package sheets_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/services/external/sheets"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterceptAndAppend(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://sheets.googleapis.com/v4/spreadsheets/1BxiMVs0XRA5/values/Registrations:append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS": {
+			httpx.NewMockResponse(403, nil, `{"error": {"code": 403, "message": "The caller does not have permission"}}`),
+			httpx.NewMockResponse(200, nil, `{"spreadsheetId": "1BxiMVs0XRA5", "updates": {"updatedRows": 1}}`),
+		},
+	}))
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"google_sheets": {"registrations": {"spreadsheet_id": "1BxiMVs0XRA5", "sheet": "Registrations"}}}' WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	rt.Config.OAuthTokenKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	require.NoError(t, models.SaveOAuthToken(ctx, db, rt.Config, &models.OAuthToken{OrgID: testdata.Org1.ID, Integration: "sheets", TokenURL: "https://oauth2.googleapis.com/token", ClientID: "1234", AccessToken: "sesame"}))
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	intercept := func(url, body string, simulated bool) (int, string) {
+		request, _ := httpx.NewRequest("POST", url, strings.NewReader(body), nil)
+		call, err := sheets.Intercept(rt, oa, request, simulated)
+		require.NoError(t, err)
+		if call == nil {
+			return 0, ""
+		}
+		return call.Response.StatusCode, string(call.ResponseBody)
+	}
+
+	// requests to other hosts aren't intercepted
+	status, _ := intercept("https://example.com/registrations", `{"values": ["Cathy"]}`, false)
+	assert.Equal(t, 0, status)
+
+	status, body := intercept("https://sheets.mailroom/registrations", `["Cathy"]`, false)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"request body must be an object with a non-empty values array"}`, body)
+
+	status, body = intercept("https://sheets.mailroom/signups", `{"values": ["Cathy"]}`, false)
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `{"error":"no such sheet destination 'signups'"}`, body)
+
+	// simulated sessions get a response but nothing is queued
+	status, body = intercept("https://sheets.mailroom/registrations", `{"values": ["Cathy", 23]}`, true)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"status":"queued"}`, body)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	status, _ = intercept("https://sheets.mailroom/registrations", `{"values": ["Cathy", 23]}`, false)
+	assert.Equal(t, 200, status)
+
+	// first attempt to append fails and so the task is requeued
+	performNextTask(t, ctx, rt, rc)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, sheets.TypeAppendRow, task.Type)
+	assert.JSONEq(t, `{"destination": "registrations", "values": ["Cathy", 23], "attempt": 1}`, string(task.Task))
+
+	require.NoError(t, queue.AddTask(rc, queue.BatchQueue, task.Type, task.OrgID, json.RawMessage(task.Task), queue.DefaultPriority))
+
+	// second attempt succeeds
+	performNextTask(t, ctx, rt, rc)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+}
+
+func performNextTask(t *testing.T, ctx context.Context, rt *runtime.Runtime, rc redis.Conn) {
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	typedTask, err := tasks.ReadTask(task.Type, task.Task)
+	require.NoError(t, err)
+
+	require.NoError(t, typedTask.Perform(ctx, rt, models.OrgID(task.OrgID)))
+}
@@ -0,0 +1,82 @@
+package sheets
+
+import (
+	"context"
+	"time"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeAppendRow is the type of the task to append a row to a sheet
+const TypeAppendRow = "append_sheet_row"
+
+// the number of times we'll try a task before giving up
+const maxAppendAttempts = 3
+
+func init() {
+	tasks.RegisterType(TypeAppendRow, func() tasks.Task { return &AppendRowTask{} })
+}
+
+// AppendRowTask is our task to append a row to a sheet destination
+type AppendRowTask struct {
+	Destination string        `json:"destination" validate:"required"`
+	Values      []interface{} `json:"values"      validate:"required"`
+	Attempt     int           `json:"attempt,omitempty"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *AppendRowTask) Timeout() time.Duration {
+	return time.Minute
+}
+
+// Perform appends the row to the sheet, requeuing the task if that fails and it hasn't been attempted too many times
+func (t *AppendRowTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	err := t.append(ctx, rt, orgID)
+	if err == nil {
+		return nil
+	}
+
+	if t.Attempt+1 >= maxAppendAttempts {
+		return errors.Wrapf(err, "error appending to sheet destination '%s' after %d attempts", t.Destination, maxAppendAttempts)
+	}
+
+	logrus.WithError(err).WithField("org_id", orgID).WithField("destination", t.Destination).Warn("error appending to sheet, will retry")
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	retry := &AppendRowTask{Destination: t.Destination, Values: t.Values, Attempt: t.Attempt + 1}
+	return queue.AddTask(rc, queue.BatchQueue, TypeAppendRow, int(orgID), retry, queue.DefaultPriority)
+}
+
+func (t *AppendRowTask) append(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	oa, err := models.GetOrgAssets(ctx, rt.DB, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets")
+	}
+
+	dest, err := GetDestination(oa.Org(), t.Destination)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GetOAuthAccessToken(ctx, rt.DB, rt.Config, orgID, dest.Integration)
+	if err != nil {
+		return errors.Wrapf(err, "error getting access token")
+	}
+
+	httpClient, _, _ := goflow.HTTP(rt.Config)
+	httpClient = goflow.RegionalHTTP(rt.Config, httpClient, oa.Org().Region())
+	httpRetries := httpx.NewExponentialRetries(time.Second, 2, 0.5)
+
+	_, err = NewClient(httpClient, httpRetries, token).AppendRow(dest.SpreadsheetID, dest.Sheet, t.Values)
+	return err
+}
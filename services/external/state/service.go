@@ -0,0 +1,171 @@
+package state
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// InterceptHost is the host of webhook URLs which read and write the contact's state rather than making an HTTP call:
+//
+//   GET https://state.mailroom/              gets all values
+//   GET https://state.mailroom/visits        gets the value of visits
+//   POST https://state.mailroom/visits       sets the value of visits to the request body
+//   POST https://state.mailroom/visits?incr=1  increments the value of visits by 1
+//   DELETE https://state.mailroom/visits     removes visits
+//
+const InterceptHost = "state.mailroom"
+
+func init() {
+	mailroom.AddInitFunction(StartInterceptor)
+}
+
+// StartInterceptor registers our webhook interceptor with the engine
+func StartInterceptor(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookInterceptor(func(session flows.Session, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+		return Intercept(rt, session.Assets().Source().(*models.OrgAssets), models.ContactID(session.Contact().ID()), request, simulated)
+	})
+	return nil
+}
+
+// Intercept handles webhook requests to our intercept host by reading or changing the contact's state
+func Intercept(rt *runtime.Runtime, oa *models.OrgAssets, contactID models.ContactID, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+	if request.URL.Host != InterceptHost {
+		return nil, nil
+	}
+
+	start := time.Now()
+	key := strings.Trim(request.URL.Path, "/")
+
+	respond := func(status int, body interface{}) (*flows.WebhookCall, error) {
+		return goflow.NewInterceptedCall(request, start, status, body)
+	}
+	respondError := func(status int, err error) (*flows.WebhookCall, error) {
+		return respond(status, map[string]string{"error": err.Error()})
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if key == "" {
+		if request.Method != http.MethodGet {
+			return respondError(http.StatusMethodNotAllowed, errors.Errorf("illegal method: %s", request.Method))
+		}
+
+		values, err := models.GetContactState(rc, oa.OrgID(), contactID)
+		if err != nil {
+			return nil, err
+		}
+		return respond(http.StatusOK, map[string]interface{}{"state": values})
+	}
+
+	if err := models.ValidateContactStateKey(key); err != nil {
+		return respondError(http.StatusBadRequest, err)
+	}
+
+	var change *models.ContactStateChange
+	var err error
+
+	switch request.Method {
+	case http.MethodGet:
+		values, err := models.GetContactState(rc, oa.OrgID(), contactID)
+		if err != nil {
+			return nil, err
+		}
+		value, found := values[key]
+		if !found {
+			return respondError(http.StatusNotFound, errors.Errorf("no value for key '%s'", key))
+		}
+		return respond(http.StatusOK, map[string]string{"key": key, "value": value})
+
+	case http.MethodPost, http.MethodPut:
+		if incr := request.URL.Query().Get("incr"); incr != "" {
+			by, parseErr := strconv.ParseInt(incr, 10, 64)
+			if parseErr != nil {
+				return respondError(http.StatusBadRequest, errors.Errorf("incr must be an integer"))
+			}
+			if simulated {
+				change, err = simulateChange(rc, oa.OrgID(), contactID, key, func(previous *string) (*string, error) {
+					current := int64(0)
+					if previous != nil {
+						var err error
+						if current, err = strconv.ParseInt(*previous, 10, 64); err != nil {
+							return nil, models.ErrContactStateNotInteger
+						}
+					}
+					value := strconv.FormatInt(current+by, 10)
+					return &value, nil
+				})
+			} else {
+				change, err = models.IncrContactStateValue(rc, rt.Config, oa.OrgID(), contactID, key, by)
+			}
+		} else {
+			body := []byte{}
+			if request.Body != nil {
+				if body, err = ioutil.ReadAll(request.Body); err != nil {
+					return nil, errors.Wrapf(err, "error reading state request body")
+				}
+				request.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			value := strings.TrimSpace(string(body))
+
+			if simulated {
+				if len(value) > rt.Config.ContactStateMaxValueBytes {
+					return respondError(http.StatusBadRequest, models.ErrContactStateTooLong)
+				}
+				change, err = simulateChange(rc, oa.OrgID(), contactID, key, func(*string) (*string, error) { return &value, nil })
+			} else {
+				change, err = models.SetContactStateValue(rc, rt.Config, oa.OrgID(), contactID, key, value)
+			}
+		}
+
+	case http.MethodDelete:
+		if simulated {
+			change, err = simulateChange(rc, oa.OrgID(), contactID, key, func(*string) (*string, error) { return nil, nil })
+		} else {
+			change, err = models.DeleteContactStateValue(rc, oa.OrgID(), contactID, key)
+		}
+
+	default:
+		return respondError(http.StatusMethodNotAllowed, errors.Errorf("illegal method: %s", request.Method))
+	}
+
+	switch err {
+	case nil:
+		return respond(http.StatusOK, change)
+	case models.ErrContactStateFull, models.ErrContactStateTooLong, models.ErrContactStateNotInteger:
+		return respondError(http.StatusBadRequest, err)
+	default:
+		return nil, err
+	}
+}
+
+// simulated sessions can read the contact's state but not change it, so we just work out what the change would be
+func simulateChange(rc redis.Conn, orgID models.OrgID, contactID models.ContactID, key string, apply func(*string) (*string, error)) (*models.ContactStateChange, error) {
+	values, err := models.GetContactState(rc, orgID, contactID)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &models.ContactStateChange{Key: key}
+	if previous, found := values[key]; found {
+		change.Previous = &previous
+	}
+	if change.Value, err = apply(change.Previous); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
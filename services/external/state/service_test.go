@@ -0,0 +1,89 @@
+package state_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/external/state"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntercept(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	defer testsuite.Reset()
+
+	rt.Config.ContactStateMaxValueBytes = 10
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	intercept := func(method, url, body string, simulated bool) (int, string) {
+		request, _ := httpx.NewRequest(method, url, strings.NewReader(body), nil)
+		call, err := state.Intercept(rt, oa, testdata.Cathy.ID, request, simulated)
+		require.NoError(t, err)
+		if call == nil {
+			return 0, ""
+		}
+		return call.Response.StatusCode, string(call.ResponseBody)
+	}
+
+	// requests to other hosts aren't intercepted
+	status, _ := intercept("GET", "https://example.com/visits", "", false)
+	assert.Equal(t, 0, status)
+
+	status, body := intercept("GET", "https://state.mailroom/visits", "", false)
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `{"error":"no value for key 'visits'"}`, body)
+
+	status, body = intercept("POST", "https://state.mailroom/visits?incr=2", "", false)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"visits","previous":null,"value":"2"}`, body)
+
+	status, body = intercept("POST", "https://state.mailroom/color", " red ", false)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"color","previous":null,"value":"red"}`, body)
+
+	status, body = intercept("GET", "https://state.mailroom/color", "", false)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"color","value":"red"}`, body)
+
+	// simulated changes are returned but not saved
+	status, body = intercept("POST", "https://state.mailroom/visits?incr=3", "", true)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"visits","previous":"2","value":"5"}`, body)
+
+	status, body = intercept("DELETE", "https://state.mailroom/color", "", true)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"color","previous":"red","value":null}`, body)
+
+	status, body = intercept("GET", "https://state.mailroom/", "", false)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"state":{"color":"red","visits":"2"}}`, body)
+
+	status, body = intercept("DELETE", "https://state.mailroom/color", "", false)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"key":"color","previous":"red","value":null}`, body)
+
+	status, body = intercept("POST", "https://state.mailroom/visits?incr=x", "", false)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"incr must be an integer"}`, body)
+
+	status, body = intercept("POST", "https://state.mailroom/color", "very very red", false)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"state value is too long"}`, body)
+
+	status, body = intercept("POST", "https://state.mailroom/a$b", "red", false)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"invalid state key"}`, body)
+
+	status, body = intercept("PATCH", "https://state.mailroom/color", "red", false)
+	assert.Equal(t, 405, status)
+	assert.Equal(t, `{"error":"illegal method: PATCH"}`, body)
+}
@@ -0,0 +1,65 @@
+package tables
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+)
+
+// InterceptHost is the host of webhook URLs which query lookup tables rather than making an HTTP call, e.g. a webhook
+// node calling https://lookups.mailroom/products?key=@results.code gets the row of the "products" table with that key
+const InterceptHost = "lookups.mailroom"
+
+// timeout for lookups made by intercepted webhook calls
+const lookupTimeout = time.Second * 15
+
+func init() {
+	mailroom.AddInitFunction(StartInterceptor)
+}
+
+// StartInterceptor registers our webhook interceptor
+func StartInterceptor(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	goflow.RegisterWebhookInterceptor(func(session flows.Session, request *http.Request, simulated bool) (*flows.WebhookCall, error) {
+		return Intercept(rt, session.Assets().Source().(*models.OrgAssets), request)
+	})
+	return nil
+}
+
+// Intercept handles webhook requests to our intercept host by looking up the key in the table named by the path
+func Intercept(rt *runtime.Runtime, oa *models.OrgAssets, request *http.Request) (*flows.WebhookCall, error) {
+	if request.URL.Host != InterceptHost {
+		return nil, nil
+	}
+
+	start := time.Now()
+	name := strings.Trim(request.URL.Path, "/")
+	key := strings.TrimSpace(request.URL.Query().Get("key"))
+
+	if key == "" {
+		return goflow.NewInterceptedCall(request, start, http.StatusBadRequest, map[string]string{"error": "missing key to look up"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	result, err := Lookup(ctx, rt, oa, name, key)
+	if err == ErrNoSuchTable {
+		return goflow.NewInterceptedCall(request, start, http.StatusNotFound, map[string]string{"error": "no such lookup table '" + name + "'"})
+	}
+	if err != nil {
+		return goflow.NewInterceptedCall(request, start, http.StatusBadGateway, map[string]string{"error": err.Error()})
+	}
+	if result == nil {
+		return goflow.NewInterceptedCall(request, start, http.StatusNotFound, map[string]string{"error": "no match for key '" + key + "'"})
+	}
+
+	return goflow.NewInterceptedCall(request, start, http.StatusOK, result)
+}
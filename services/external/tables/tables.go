@@ -0,0 +1,174 @@
+package tables
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	configTables = "lookup_tables"
+
+	cacheKey = "lookup_table:%d:%s:%s"
+
+	// how long we cache results for if the table doesn't specify
+	defaultCacheSeconds = 300
+)
+
+// TableType is the type of a lookup table
+type TableType string
+
+// lookup table types
+const (
+	TableTypeREST = TableType("rest")
+	TableTypeCSV  = TableType("csv")
+)
+
+// ErrNoSuchTable is returned when an org has no lookup table with a name
+var ErrNoSuchTable = errors.New("no such lookup table")
+
+// Table is an external REST dataset or an uploaded CSV file which flows can query by key
+type Table struct {
+	Type         TableType `json:"type"`
+	CacheSeconds int       `json:"cache_seconds,omitempty"`
+
+	// for REST tables, the URL to fetch, where {key} is replaced by the key being looked up, and the optional name of
+	// the org webhook auth profile to authenticate with
+	URL         string `json:"url,omitempty"`
+	AuthProfile string `json:"auth_profile,omitempty"`
+}
+
+// GetTable gets the lookup table with the given name for the passed in org
+func GetTable(org *models.Org, name string) (*Table, error) {
+	tables := make(map[string]*Table)
+	if _, err := org.ConfigObject(configTables, &tables); err != nil {
+		return nil, err
+	}
+
+	table := tables[name]
+	if table == nil || (table.Type != TableTypeREST && table.Type != TableTypeCSV) || (table.Type == TableTypeREST && table.URL == "") {
+		return nil, ErrNoSuchTable
+	}
+	if table.CacheSeconds <= 0 {
+		table.CacheSeconds = defaultCacheSeconds
+	}
+	return table, nil
+}
+
+// Lookup looks up the given key in the named table, returning nil if there is no match. Results, including misses, are
+// cached so that we don't query the source for every lookup.
+func Lookup(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, name, key string) (json.RawMessage, error) {
+	table, err := GetTable(oa.Org(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	cached, err := redis.Bytes(rc.Do("GET", fmt.Sprintf(cacheKey, oa.OrgID(), name, key)))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error reading lookup cache")
+	}
+	if err == nil {
+		if len(cached) == 0 {
+			return nil, nil
+		}
+		return cached, nil
+	}
+
+	var result json.RawMessage
+	if table.Type == TableTypeCSV {
+		result, err = models.GetLookupTableRow(ctx, rt.DB, oa.OrgID(), name, key)
+	} else {
+		result, err = fetchREST(rt, oa.Org(), table, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rc.Do("SET", fmt.Sprintf(cacheKey, oa.OrgID(), name, key), []byte(result), "EX", table.CacheSeconds); err != nil {
+		return nil, errors.Wrapf(err, "error writing lookup cache")
+	}
+
+	return result, nil
+}
+
+// ClearCache clears all cached results for the named table, e.g. after its rows have been replaced
+func ClearCache(rc redis.Conn, orgID models.OrgID, name string) error {
+	pattern := fmt.Sprintf(cacheKey, orgID, name, "*")
+	cursor := 0
+
+	for {
+		values, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return errors.Wrapf(err, "error scanning lookup cache")
+		}
+
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+
+		for _, key := range keys {
+			if _, err := rc.Do("DEL", key); err != nil {
+				return errors.Wrapf(err, "error clearing lookup cache")
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// fetches the given key from a REST table, returning nil if the source returns a 404
+func fetchREST(rt *runtime.Runtime, org *models.Org, table *Table, key string) (json.RawMessage, error) {
+	fetchURL := strings.Replace(table.URL, "{key}", url.PathEscape(key), -1)
+	if fetchURL == table.URL {
+		sep := "?"
+		if strings.Contains(fetchURL, "?") {
+			sep = "&"
+		}
+		fetchURL += sep + "key=" + url.QueryEscape(key)
+	}
+
+	request, err := httpx.NewRequest("GET", fetchURL, nil, map[string]string{"Accept": "application/json"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating lookup request")
+	}
+	if table.AuthProfile != "" {
+		request.Header.Set(models.WebhookAuthHeader, table.AuthProfile)
+	}
+
+	httpClient, httpRetries, httpAccess := goflow.HTTP(rt.Config)
+
+	if err := org.PrepareWebhookRequest(httpClient, request); err != nil {
+		return nil, err
+	}
+
+	trace, err := httpx.DoTrace(httpClient, request, httpRetries, httpAccess, rt.Config.WebhooksMaxBodyBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching from lookup source")
+	}
+	if trace.Response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("lookup source returned status %d", trace.Response.StatusCode)
+	}
+	if !json.Valid(trace.ResponseBody) {
+		return nil, errors.New("lookup source returned invalid JSON")
+	}
+
+	return trace.ResponseBody, nil
+}
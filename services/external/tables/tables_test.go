@@ -0,0 +1,138 @@
+package tables_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/external/tables"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+	rc := testsuite.RC()
+	defer rc.Close()
+	defer testsuite.Reset()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://api.example.com/products/A%2F1": {
+			httpx.NewMockResponse(200, nil, `{"code": "A/1", "price": 12.5}`),
+		},
+		"https://api.example.com/products/B2": {
+			httpx.NewMockResponse(404, nil, `{"detail": "not found"}`),
+		},
+		"https://api.example.com/products/C3": {
+			httpx.NewMockResponse(500, nil, `Oops`),
+		},
+		"https://api.example.com/stock?region=east&key=A%2F1": {
+			httpx.NewMockResponse(200, nil, `[1, 2, 3]`),
+		},
+	}))
+
+	db.MustExec(`UPDATE orgs_org SET config = '{
+		"webhook_auth_profiles": {"shop": {"type": "bearer", "token": "sesame"}},
+		"lookup_tables": {
+			"products": {"type": "rest", "url": "https://api.example.com/products/{key}", "auth_profile": "shop"},
+			"stock": {"type": "rest", "url": "https://api.example.com/stock?region=east", "cache_seconds": 60},
+			"clinics": {"type": "csv"},
+			"broken": {"type": "rest"}
+		}
+	}' WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	tx := db.MustBegin()
+	require.NoError(t, models.ReplaceLookupTableRows(ctx, tx, testdata.Org1.ID, "clinics", map[string]json.RawMessage{
+		"KGL1": json.RawMessage(`{"code": "KGL1", "name": "Kigali Central"}`),
+	}))
+	require.NoError(t, tx.Commit())
+
+	oa, err := models.GetOrgAssets(ctx, db, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// REST table, looked up twice but only fetched once as the result is cached
+	for i := 0; i < 2; i++ {
+		result, err := tables.Lookup(ctx, rt, oa, "products", "A/1")
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"code": "A/1", "price": 12.5}`, string(result))
+	}
+
+	// as are misses
+	for i := 0; i < 2; i++ {
+		result, err := tables.Lookup(ctx, rt, oa, "products", "B2")
+		assert.NoError(t, err)
+		assert.Nil(t, result)
+	}
+
+	// but not errors
+	_, err = tables.Lookup(ctx, rt, oa, "products", "C3")
+	assert.EqualError(t, err, "lookup source returned status 500")
+
+	// REST table without a {key} placeholder gets key as a query param
+	result, err := tables.Lookup(ctx, rt, oa, "stock", "A/1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[1, 2, 3]`, string(result))
+
+	result, err = tables.Lookup(ctx, rt, oa, "clinics", "KGL1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code": "KGL1", "name": "Kigali Central"}`, string(result))
+
+	result, err = tables.Lookup(ctx, rt, oa, "clinics", "HYE2")
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+
+	// replacing the rows of a table requires its cache to be cleared
+	tx = db.MustBegin()
+	require.NoError(t, models.ReplaceLookupTableRows(ctx, tx, testdata.Org1.ID, "clinics", map[string]json.RawMessage{
+		"HYE2": json.RawMessage(`{"code": "HYE2", "name": "Huye"}`),
+	}))
+	require.NoError(t, tx.Commit())
+	require.NoError(t, tables.ClearCache(rc, testdata.Org1.ID, "clinics"))
+
+	result, err = tables.Lookup(ctx, rt, oa, "clinics", "HYE2")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code": "HYE2", "name": "Huye"}`, string(result))
+
+	_, err = tables.Lookup(ctx, rt, oa, "broken", "A/1")
+	assert.Equal(t, tables.ErrNoSuchTable, err)
+
+	_, err = tables.Lookup(ctx, rt, oa, "unknown", "A/1")
+	assert.Equal(t, tables.ErrNoSuchTable, err)
+
+	// check lookups via intercepted webhook calls
+	intercept := func(url string) (int, string) {
+		request, _ := httpx.NewRequest("GET", url, nil, nil)
+		call, err := tables.Intercept(rt, oa, request)
+		require.NoError(t, err)
+		if call == nil {
+			return 0, ""
+		}
+		return call.Response.StatusCode, string(call.ResponseBody)
+	}
+
+	status, _ := intercept("https://example.com/clinics?key=HYE2")
+	assert.Equal(t, 0, status)
+
+	status, body := intercept("https://lookups.mailroom/clinics?key=HYE2")
+	assert.Equal(t, 200, status)
+	assert.JSONEq(t, `{"code": "HYE2", "name": "Huye"}`, body)
+
+	status, body = intercept("https://lookups.mailroom/clinics?key=XXX")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `{"error":"no match for key 'XXX'"}`, body)
+
+	status, body = intercept("https://lookups.mailroom/clinics")
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"missing key to look up"}`, body)
+
+	status, body = intercept("https://lookups.mailroom/unknown?key=HYE2")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `{"error":"no such lookup table 'unknown'"}`, body)
+}
@@ -0,0 +1,84 @@
+package twilio
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/jsonx"
+
+	"github.com/pkg/errors"
+)
+
+const apiBaseURL = "https://lookups.twilio.com/v1"
+
+// ErrNotFound is returned when Twilio doesn't recognize a number as valid
+var ErrNotFound = errors.New("phone number not found")
+
+// Client is a basic Twilio Lookup client
+type Client struct {
+	httpClient  *http.Client
+	httpRetries *httpx.RetryConfig
+	accountSID  string
+	authToken   string
+}
+
+// NewClient creates a new Twilio Lookup client
+func NewClient(httpClient *http.Client, httpRetries *httpx.RetryConfig, accountSID, authToken string) *Client {
+	return &Client{
+		httpClient:  httpClient,
+		httpRetries: httpRetries,
+		accountSID:  accountSID,
+		authToken:   authToken,
+	}
+}
+
+// Carrier is the carrier information for a phone number
+type Carrier struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// PhoneNumber is a looked up phone number
+type PhoneNumber struct {
+	PhoneNumber string   `json:"phone_number"`
+	CountryCode string   `json:"country_code"`
+	Carrier     *Carrier `json:"carrier"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// LookupPhoneNumber looks up the given number, including its carrier information
+// see https://www.twilio.com/docs/lookup/api
+func (c *Client) LookupPhoneNumber(number string) (*PhoneNumber, *httpx.Trace, error) {
+	lookupURL := fmt.Sprintf("%s/PhoneNumbers/%s?Type=carrier", apiBaseURL, url.PathEscape(number))
+
+	req, err := httpx.NewRequest("GET", lookupURL, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.SetBasicAuth(c.accountSID, c.authToken)
+
+	trace, err := httpx.DoTrace(c.httpClient, req, c.httpRetries, nil, -1)
+	if err != nil {
+		return nil, trace, err
+	}
+
+	if trace.Response.StatusCode == http.StatusNotFound {
+		return nil, trace, ErrNotFound
+	}
+	if trace.Response.StatusCode >= 400 {
+		response := &errorResponse{}
+		jsonx.Unmarshal(trace.ResponseBody, response)
+		return nil, trace, errors.New(response.Message)
+	}
+
+	response := &PhoneNumber{}
+	if err := jsonx.Unmarshal(trace.ResponseBody, response); err != nil {
+		return nil, trace, err
+	}
+	return response, trace, nil
+}
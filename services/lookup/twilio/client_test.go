@@ -0,0 +1,47 @@
+package twilio_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/mailroom/services/lookup/twilio"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupPhoneNumber(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://lookups.twilio.com/v1/PhoneNumbers/+250788123123?Type=carrier": {
+			httpx.MockConnectionError,
+			httpx.NewMockResponse(401, nil, `{"message": "Authenticate", "status": 401}`),
+			httpx.NewMockResponse(404, nil, `{"message": "The requested resource was not found", "status": 404}`),
+			httpx.NewMockResponse(200, nil, `{
+				"country_code": "RW",
+				"phone_number": "+250788123123",
+				"national_format": "0788 123 123",
+				"carrier": {"mobile_country_code": "635", "mobile_network_code": "10", "name": "MTN Rwanda", "type": "mobile", "error_code": null}
+			}`),
+		},
+	}))
+
+	client := twilio.NewClient(http.DefaultClient, nil, "AC123", "345")
+
+	_, _, err := client.LookupPhoneNumber("+250788123123")
+	assert.EqualError(t, err, "unable to connect to server")
+
+	_, _, err = client.LookupPhoneNumber("+250788123123")
+	assert.EqualError(t, err, "Authenticate")
+
+	_, _, err = client.LookupPhoneNumber("+250788123123")
+	assert.Equal(t, twilio.ErrNotFound, err)
+
+	number, trace, err := client.LookupPhoneNumber("+250788123123")
+	assert.NoError(t, err)
+	assert.Equal(t, "+250788123123", number.PhoneNumber)
+	assert.Equal(t, "RW", number.CountryCode)
+	assert.Equal(t, &twilio.Carrier{Name: "MTN Rwanda", Type: "mobile"}, number.Carrier)
+	assert.Equal(t, 200, trace.Response.StatusCode)
+}
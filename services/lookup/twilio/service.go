@@ -0,0 +1,69 @@
+package twilio
+
+import (
+	"net/http"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	typeTwilio = "twilio"
+
+	configAccountSID = "account_sid"
+	configAuthToken  = "auth_token"
+)
+
+func init() {
+	models.RegisterLookupService(typeTwilio, NewService)
+}
+
+type service struct {
+	client   *Client
+	redactor utils.Redactor
+}
+
+// NewService creates a new Twilio Lookup service
+func NewService(httpClient *http.Client, httpRetries *httpx.RetryConfig, config map[string]string) (models.LookupService, error) {
+	accountSID := config[configAccountSID]
+	authToken := config[configAuthToken]
+
+	if accountSID != "" && authToken != "" {
+		return &service{
+			client:   NewClient(httpClient, httpRetries, accountSID, authToken),
+			redactor: utils.NewRedactor(flows.RedactionMask, authToken),
+		}, nil
+	}
+	return nil, errors.New("missing account_sid or auth_token in twilio lookup config")
+}
+
+// Lookup looks up the given tel URN, returning an invalid result if Twilio doesn't recognize it
+func (s *service) Lookup(urn urns.URN, logHTTP flows.HTTPLogCallback) (*models.LookupResult, error) {
+	number, trace, err := s.client.LookupPhoneNumber(urn.Path())
+	if trace != nil {
+		logHTTP(flows.NewHTTPLog(trace, flows.HTTPStatusFromCode, s.redactor))
+	}
+	if err == ErrNotFound {
+		return &models.LookupResult{URN: urn, Valid: false}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up phone number")
+	}
+
+	normalized, err := urns.NewTelURNForCountry(number.PhoneNumber, number.CountryCode)
+	if err != nil {
+		return &models.LookupResult{URN: urn, Valid: false}, nil
+	}
+
+	result := &models.LookupResult{URN: normalized, Valid: true}
+	if number.Carrier != nil {
+		result.Carrier = number.Carrier.Name
+		result.LineType = number.Carrier.Type
+	}
+	return result, nil
+}
@@ -0,0 +1,46 @@
+package twilio_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/lookup/twilio"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://lookups.twilio.com/v1/PhoneNumbers/+250788123123?Type=carrier": {
+			httpx.NewMockResponse(200, nil, `{"country_code": "RW", "phone_number": "+250788123123", "carrier": {"name": "MTN Rwanda", "type": "mobile"}}`),
+		},
+		"https://lookups.twilio.com/v1/PhoneNumbers/+250700000000?Type=carrier": {
+			httpx.NewMockResponse(404, nil, `{"message": "The requested resource was not found", "status": 404}`),
+		},
+	}))
+
+	_, err := twilio.NewService(http.DefaultClient, nil, map[string]string{"account_sid": "AC123"})
+	assert.EqualError(t, err, "missing account_sid or auth_token in twilio lookup config")
+
+	svc, err := twilio.NewService(http.DefaultClient, nil, map[string]string{"account_sid": "AC123", "auth_token": "345"})
+	require.NoError(t, err)
+
+	logger := &flows.HTTPLogger{}
+
+	result, err := svc.Lookup(urns.URN("tel:+250788123123"), logger.Log)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.LookupResult{URN: "tel:+250788123123", Valid: true, Carrier: "MTN Rwanda", LineType: "mobile"}, result)
+
+	result, err = svc.Lookup(urns.URN("tel:+250700000000"), logger.Log)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.LookupResult{URN: "tel:+250700000000", Valid: false}, result)
+
+	assert.Equal(t, 2, len(logger.Logs))
+}
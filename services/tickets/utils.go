@@ -21,9 +21,11 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
 	"github.com/nyaruka/mailroom/runtime"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // GetContactDisplay gets a non-empty display value for a contact for use on a ticket
@@ -56,7 +58,7 @@ func FromTicketUUID(ctx context.Context, db *sqlx.DB, uuid flows.TicketUUID, tic
 	}
 
 	// and load it as a service
-	svc, err := ticketer.AsService(config.Mailroom, flows.NewTicketer(ticketer))
+	svc, err := ticketer.AsService(config.Mailroom, assets.Org(), flows.NewTicketer(ticketer))
 	if err != nil {
 		return nil, nil, nil, errors.Wrap(err, "error loading ticketer service")
 	}
@@ -71,8 +73,14 @@ func FromTicketerUUID(ctx context.Context, db *sqlx.DB, uuid assets.TicketerUUID
 		return nil, nil, errors.Errorf("error looking up ticketer %s", uuid)
 	}
 
+	// the service calls external services on behalf of the ticketer's org
+	oa, err := models.GetOrgAssets(ctx, db, ticketer.OrgID())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error looking up org #%d", ticketer.OrgID())
+	}
+
 	// and load it as a service
-	svc, err := ticketer.AsService(config.Mailroom, flows.NewTicketer(ticketer))
+	svc, err := ticketer.AsService(config.Mailroom, oa.Org(), flows.NewTicketer(ticketer))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "error loading ticketer service")
 	}
@@ -93,7 +101,7 @@ func SendReply(ctx context.Context, rt *runtime.Runtime, ticket *models.Ticket,
 	for i, file := range files {
 		filename := string(uuids.New()) + filepath.Ext(file.URL)
 
-		attachments[i], err = oa.Org().StoreAttachment(ctx, rt.MediaStorage, filename, file.ContentType, file.Body)
+		attachments[i], err = oa.Org().StoreAttachment(ctx, rt.MediaStorageFor(oa.Org().Region()), filename, file.ContentType, file.Body)
 		if err != nil {
 			return nil, errors.Wrapf(err, "error storing attachment %s for ticket reply", file.URL)
 		}
@@ -112,6 +120,14 @@ func SendReply(ctx context.Context, rt *runtime.Runtime, ticket *models.Ticket,
 	}
 
 	msgio.SendMessages(ctx, rt.DB, rt.RP, nil, msgs)
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := indexing.QueueIndexMsgs(rc, []models.MsgID{models.MsgID(msgs[0].ID())}); err != nil {
+		logrus.WithError(err).WithField("ticket_uuid", ticket.UUID()).Error("error queuing ticket reply for indexing")
+	}
+
 	return msgs[0], nil
 }
 
@@ -156,6 +172,11 @@ func CloseTicket(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		if err != nil {
 			return errors.Wrapf(err, "error queueing ticket closed event")
 		}
+
+		err = indexing.QueueIndexTickets(rc, oa.OrgID(), []*models.Ticket{ticket})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -163,6 +184,17 @@ func CloseTicket(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 
 // ReopenTicket reopens the given ticket
 func ReopenTicket(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, ticket *models.Ticket, externally bool, l *models.HTTPLogger) error {
-	_, err := models.ReopenTickets(ctx, rt.DB, oa, models.NilUserID, []*models.Ticket{ticket}, externally, l)
-	return err
+	events, err := models.ReopenTickets(ctx, rt.DB, oa, models.NilUserID, []*models.Ticket{ticket}, externally, l)
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 1 {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		return indexing.QueueIndexTickets(rc, oa.OrgID(), []*models.Ticket{ticket})
+	}
+
+	return nil
 }
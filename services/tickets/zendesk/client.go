@@ -181,9 +181,16 @@ func (c *RESTClient) DeleteTrigger(id int64) (*httpx.Trace, error) {
 
 // Ticket see https://developer.zendesk.com/rest_api/docs/support/tickets#json-format
 type Ticket struct {
-	ID         int64  `json:"id,omitempty"`
-	ExternalID string `json:"external_id,omitempty"`
-	Status     string `json:"status,omitempty"`
+	ID         int64    `json:"id,omitempty"`
+	ExternalID string   `json:"external_id,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Comment    *Comment `json:"comment,omitempty"`
+}
+
+// Comment see https://developer.zendesk.com/rest_api/docs/support/ticket_comments#json-format
+type Comment struct {
+	Body   string `json:"body"`
+	Public bool   `json:"public"`
 }
 
 // JobStatus see https://developer.zendesk.com/rest_api/docs/support/job_statuses#job-statuses
@@ -195,10 +202,20 @@ type JobStatus struct {
 
 // UpdateManyTickets see https://developer.zendesk.com/rest_api/docs/support/tickets#update-many-tickets
 func (c *RESTClient) UpdateManyTickets(ids []int64, status string) (*JobStatus, *httpx.Trace, error) {
+	return c.updateMany(ids, &Ticket{Status: status})
+}
+
+// CommentManyTickets adds a private comment to many tickets using the update many endpoint, see
+// https://developer.zendesk.com/rest_api/docs/support/tickets#update-many-tickets
+func (c *RESTClient) CommentManyTickets(ids []int64, body string) (*JobStatus, *httpx.Trace, error) {
+	return c.updateMany(ids, &Ticket{Comment: &Comment{Body: body, Public: false}})
+}
+
+func (c *RESTClient) updateMany(ids []int64, ticket *Ticket) (*JobStatus, *httpx.Trace, error) {
 	payload := struct {
 		Ticket *Ticket `json:"ticket"`
 	}{
-		Ticket: &Ticket{Status: status},
+		Ticket: ticket,
 	}
 
 	response := &struct {
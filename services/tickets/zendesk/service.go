@@ -149,6 +149,20 @@ func (s *service) Reopen(tickets []*models.Ticket, logHTTP flows.HTTPLogCallback
 	return err
 }
 
+// AddNote adds the given note to the passed in tickets as a private comment
+func (s *service) AddNote(tickets []*models.Ticket, note string, logHTTP flows.HTTPLogCallback) error {
+	ids, err := ticketsToZendeskIDs(tickets)
+	if err != nil {
+		return nil
+	}
+
+	_, trace, err := s.restClient.CommentManyTickets(ids, note)
+	if trace != nil {
+		logHTTP(flows.NewHTTPLog(trace, flows.HTTPStatusFromCode, s.redactor))
+	}
+	return err
+}
+
 // AddStatusCallback adds a target and trigger to callback to us when ticket status is changed
 func (s *service) AddStatusCallback(name, domain string, logHTTP flows.HTTPLogCallback) (map[string]string, error) {
 	targetURL := fmt.Sprintf("https://%s/mr/tickets/types/zendesk/target/%s", domain, s.ticketer.UUID())
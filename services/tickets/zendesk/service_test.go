@@ -174,3 +174,46 @@ func TestCloseAndReopen(t *testing.T) {
 	assert.NoError(t, err)
 	test.AssertSnapshot(t, "reopen_tickets", logger.Logs[1].Request)
 }
+
+func TestAddNote(t *testing.T) {
+	rt := testsuite.RT()
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://nyaruka.zendesk.com/api/v2/tickets/update_many.json?ids=12,14": {
+			httpx.NewMockResponse(201, nil, `{
+				"job_status": {
+					"id": "1234-abcd",
+					"url": "http://zendesk.com",
+					"status": "queued"
+				}
+			}`),
+		},
+	}))
+
+	ticketer := flows.NewTicketer(types.NewTicketer(assets.TicketerUUID(uuids.New()), "Support", "zendesk"))
+	svc, err := zendesk.NewService(
+		rt.Config,
+		http.DefaultClient,
+		nil,
+		ticketer,
+		map[string]string{
+			"subdomain":   "nyaruka",
+			"secret":      "sesame",
+			"oauth_token": "987654321",
+			"push_id":     "1234-abcd",
+			"push_token":  "123456789",
+		},
+	)
+	require.NoError(t, err)
+
+	logger := &flows.HTTPLogger{}
+	ticket1 := models.NewTicket("88bfa1dc-be33-45c2-b469-294ecb0eba90", testdata.Org1.ID, testdata.Cathy.ID, testdata.Zendesk.ID, "12", "New ticket", "Where my cookies?", models.NilUserID, nil)
+	ticket2 := models.NewTicket("645eee60-7e84-4a9e-ade3-4fce01ae28f1", testdata.Org1.ID, testdata.Bob.ID, testdata.Zendesk.ID, "14", "Second ticket", "Where my shoes?", models.NilUserID, nil)
+
+	err = svc.(models.TicketNoteService).AddNote([]*models.Ticket{ticket1, ticket2}, "Customer is a VIP", logger.Log)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(logger.Logs))
+	assert.Contains(t, logger.Logs[0].Request, `{"ticket":{"comment":{"body":"Customer is a VIP","public":false}}}`)
+}
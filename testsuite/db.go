@@ -69,6 +69,13 @@ func (d *MockDB) GetContext(ctx context.Context, value interface{}, query string
 	return d.real.GetContext(ctx, value, query, args...)
 }
 
+func (d *MockDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	if err := d.check("SelectContext"); err != nil {
+		return err
+	}
+	return d.real.SelectContext(ctx, dest, query, args...)
+}
+
 func (d *MockDB) BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error) {
 	if err := d.check("BeginTxx"); err != nil {
 		return nil, err
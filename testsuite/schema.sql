@@ -0,0 +1,141 @@
+-- Tables used by mailroom which are created by RapidPro migrations but aren't yet in mailroom_test.dump. These are
+-- applied after restoring the dump, and each should be removed from here once the dump has been regenerated with the
+-- migration which creates it.
+
+-- flows_flowrunstep: the path of each run as normalized step rows, partitioned by month of arrival so that old steps
+-- can be cheaply dropped
+CREATE TABLE flows_flowrunstep (
+    org_id integer NOT NULL,
+    flow_id integer NOT NULL,
+    run_uuid uuid NOT NULL,
+    step_uuid uuid NOT NULL,
+    node_uuid uuid NOT NULL,
+    exit_uuid uuid NULL,
+    arrived_on timestamp with time zone NOT NULL
+) PARTITION BY RANGE (arrived_on);
+
+-- orgs_oauthtoken: encrypted OAuth2 tokens of org integrations
+CREATE TABLE orgs_oauthtoken (
+    id serial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    integration character varying(128) NOT NULL,
+    token_url text NOT NULL,
+    client_id text NOT NULL,
+    client_secret text NOT NULL,
+    access_token text NOT NULL,
+    refresh_token text NOT NULL,
+    expires_on timestamp with time zone NULL,
+    modified_on timestamp with time zone NOT NULL,
+    UNIQUE (org_id, integration)
+)
+;
+
+-- orgs_lookuptablerow: the rows of uploaded lookup tables
+CREATE TABLE orgs_lookuptablerow (
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    table_name character varying(64) NOT NULL,
+    key character varying(255) NOT NULL,
+    data jsonb NOT NULL,
+    PRIMARY KEY (org_id, table_name, key)
+);
+
+-- contacts_contactlink: links between contacts identified as the same person, each stored once with the lower contact
+-- id first
+CREATE TABLE contacts_contactlink (
+    id serial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    linked_contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    method character varying(16) NOT NULL,
+    created_on timestamp with time zone NOT NULL,
+    UNIQUE (contact_id, linked_contact_id)
+);
+
+-- contacts_contactvalueexpiry: when temporary contact field values and group memberships expire
+CREATE TABLE contacts_contactvalueexpiry (
+    id bigserial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    expiry_type character varying(1) NOT NULL,
+    item_id integer NOT NULL,
+    expires_on timestamp with time zone NOT NULL,
+    UNIQUE (contact_id, expiry_type, item_id)
+);
+CREATE INDEX contacts_contactvalueexpiry_expires_on ON contacts_contactvalueexpiry(expires_on);
+
+-- tickets_topic: topics which tickets can be categorized by
+CREATE TABLE tickets_topic (
+    id serial PRIMARY KEY,
+    uuid uuid NOT NULL UNIQUE,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    name character varying(64) NOT NULL,
+    is_active boolean NOT NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
+-- tickets_team: teams of agents which tickets can be routed to
+CREATE TABLE tickets_team (
+    id serial PRIMARY KEY,
+    uuid uuid NOT NULL UNIQUE,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    name character varying(64) NOT NULL,
+    is_active boolean NOT NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
+CREATE TABLE tickets_team_users (
+    team_id integer NOT NULL REFERENCES tickets_team(id),
+    user_id integer NOT NULL REFERENCES auth_user(id),
+    PRIMARY KEY (team_id, user_id)
+);
+
+-- tickets_ticketrouting: the topic and team of each ticket which has been routed
+CREATE TABLE tickets_ticketrouting (
+    ticket_id integer PRIMARY KEY REFERENCES tickets_ticket(id),
+    topic_id integer NULL REFERENCES tickets_topic(id),
+    team_id integer NULL REFERENCES tickets_team(id)
+);
+
+-- api_webhookretry: webhook calls which failed in a way that might succeed later, and are retried with backoff
+CREATE TABLE api_webhookretry (
+    id serial PRIMARY KEY,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NULL REFERENCES contacts_contact(id),
+    resthook character varying(255) NOT NULL,
+    url text NOT NULL,
+    request text NOT NULL,
+    status character varying(1) NOT NULL,
+    attempts integer NOT NULL,
+    last_status_code integer NOT NULL,
+    next_attempt_on timestamp with time zone NULL,
+    created_on timestamp with time zone NOT NULL,
+    modified_on timestamp with time zone NOT NULL
+);
+CREATE INDEX api_webhookretry_next_attempt_on ON api_webhookretry(next_attempt_on) WHERE status = 'P';
+
+-- contacts_contactimport.error_report: the URL of the CSV of errors generated when every batch of an import has
+-- finished, or empty if there were no errors
+ALTER TABLE contacts_contactimport ADD COLUMN error_report text NULL;
+
+-- contacts_contactimport.mode: what an import does with its contacts, (D)efault creates or updates them, (G)roups only
+-- adds existing contacts matched by URN to groups, (C)reate only skips existing contacts, (U)pdate only skips new ones
+ALTER TABLE contacts_contactimport ADD COLUMN mode character varying(1) NOT NULL DEFAULT 'D';
+
+-- contacts_contactimport.field_merge: how imported field values are merged with those of existing contacts,
+-- (O)verwrite replaces existing values, (B)lanks only only sets fields which don't have a value
+ALTER TABLE contacts_contactimport ADD COLUMN field_merge character varying(1) NOT NULL DEFAULT 'O';
+
+-- contacts_contactimportbatch.num_skipped: the number of records skipped because of their import's mode
+ALTER TABLE contacts_contactimportbatch ADD COLUMN num_skipped integer NOT NULL DEFAULT 0;
+
+-- contacts_contact.ticket_count, last_flow_id, entered_flow_ids, completed_flow_ids: the number of open tickets of each
+-- contact, the flow it last entered and all the flows it has entered and completed, kept up to date by mailroom so that
+-- they're indexed for open_tickets, last_flow, entered and completed conditions in contact queries
+ALTER TABLE contacts_contact ADD COLUMN ticket_count integer NOT NULL DEFAULT 0;
+ALTER TABLE contacts_contact ADD COLUMN last_flow_id integer NULL;
+ALTER TABLE contacts_contact ADD COLUMN entered_flow_ids integer[] NOT NULL DEFAULT '{}';
+ALTER TABLE contacts_contact ADD COLUMN completed_flow_ids integer[] NOT NULL DEFAULT '{}';
+
+-- campaigns_eventfire.claimed_on: when a mailroom worker claimed an unfired event fire to fire it, so that fires queued
+-- more than once are only fired once
+ALTER TABLE campaigns_eventfire ADD COLUMN claimed_on timestamp with time zone NULL;
@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// Fetcher fetches the value of a key which isn't cached, e.g. from the database
+type Fetcher func(ctx context.Context, key string) (string, error)
+
+// Cache is a cache of string values by key, which fetches the values it doesn't have from the next tier, or with the
+// given fetcher if it's the last tier. Errors from fetchers are returned and never cached.
+type Cache interface {
+	Get(ctx context.Context, rp *redis.Pool, key string, fetch Fetcher) (string, error)
+	Clear(rp *redis.Pool, key string) error
+}
+
+// NewTwoTier creates a new cache with an in-process LRU tier of the given size and TTL, in front of a redis tier
+// shared by all instances with the given TTL. Tiers report their stats as <name>_local and <name>_redis.
+func NewTwoTier(name string, size int, localTTL time.Duration, redisTTL time.Duration) *Local {
+	return NewLocal(name+"_local", size, localTTL, NewRedis(name+"_redis", redisTTL, nil))
+}
+
+//------------------------------------------------------------------------------------------
+// Local tier
+//------------------------------------------------------------------------------------------
+
+// Local is an in-process LRU cache whose values expire after a TTL
+type Local struct {
+	size  int
+	ttl   time.Duration
+	next  Cache
+	stats *counter
+
+	mutex   sync.Mutex
+	items   map[string]*list.Element
+	recency *list.List // most recently used at the front
+}
+
+type localItem struct {
+	key       string
+	value     string
+	expiresOn time.Time
+}
+
+// NewLocal creates a new in-process cache of the given size and TTL, in front of the given next tier if not nil
+func NewLocal(name string, size int, ttl time.Duration, next Cache) *Local {
+	return &Local{
+		size:    size,
+		ttl:     ttl,
+		next:    next,
+		stats:   register(name),
+		items:   make(map[string]*list.Element, size),
+		recency: list.New(),
+	}
+}
+
+// Get gets the value of the given key
+func (c *Local) Get(ctx context.Context, rp *redis.Pool, key string, fetcher Fetcher) (string, error) {
+	c.mutex.Lock()
+
+	if el, found := c.items[key]; found {
+		item := el.Value.(*localItem)
+		if time.Now().Before(item.expiresOn) {
+			c.recency.MoveToFront(el)
+			c.mutex.Unlock()
+			c.stats.hit()
+			return item.value, nil
+		}
+		c.remove(el)
+	}
+
+	c.mutex.Unlock()
+	c.stats.miss()
+
+	var value string
+	var err error
+	if c.next != nil {
+		value, err = c.next.Get(ctx, rp, key, fetcher)
+	} else {
+		value, err = fetcher(ctx, key)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	c.add(key, value)
+	c.mutex.Unlock()
+
+	return value, nil
+}
+
+// Clear removes the given key from this and any later tiers
+func (c *Local) Clear(rp *redis.Pool, key string) error {
+	c.mutex.Lock()
+	if el, found := c.items[key]; found {
+		c.remove(el)
+	}
+	c.mutex.Unlock()
+
+	if c.next != nil {
+		return c.next.Clear(rp, key)
+	}
+	return nil
+}
+
+// Flush removes all values from this tier
+func (c *Local) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.items = make(map[string]*list.Element, c.size)
+	c.recency.Init()
+}
+
+// Len returns the number of values currently held, including any which have expired but not yet been evicted
+func (c *Local) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.recency.Len()
+}
+
+// adds a value, evicting the least recently used value if we're full, caller must hold our mutex
+func (c *Local) add(key, value string) {
+	if el, found := c.items[key]; found {
+		c.remove(el)
+	}
+	if c.recency.Len() >= c.size {
+		c.remove(c.recency.Back())
+	}
+
+	c.items[key] = c.recency.PushFront(&localItem{key: key, value: value, expiresOn: time.Now().Add(c.ttl)})
+}
+
+// removes a value, caller must hold our mutex
+func (c *Local) remove(el *list.Element) {
+	c.recency.Remove(el)
+	delete(c.items, el.Value.(*localItem).key)
+}
+
+//------------------------------------------------------------------------------------------
+// Redis tier
+//------------------------------------------------------------------------------------------
+
+// Redis is a cache in redis, shared by all instances, whose values expire after a TTL
+type Redis struct {
+	name  string
+	ttl   time.Duration
+	next  Cache
+	stats *counter
+}
+
+// NewRedis creates a new redis cache with the given TTL, in front of the given next tier if not nil
+func NewRedis(name string, ttl time.Duration, next Cache) *Redis {
+	return &Redis{name: name, ttl: ttl, next: next, stats: register(name)}
+}
+
+// Get gets the value of the given key. Errors talking to redis aren't returned, the value is just fetched instead.
+func (c *Redis) Get(ctx context.Context, rp *redis.Pool, key string, fetcher Fetcher) (string, error) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	redisKey := c.redisKey(key)
+
+	value, err := redis.String(rc.Do("GET", redisKey))
+	if err == nil {
+		c.stats.hit()
+		return value, nil
+	}
+	if err != redis.ErrNil {
+		logrus.WithError(err).WithField("cache", c.name).Error("error reading from redis cache")
+	}
+
+	c.stats.miss()
+
+	if c.next != nil {
+		value, err = c.next.Get(ctx, rp, key, fetcher)
+	} else {
+		value, err = fetcher(ctx, key)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := rc.Do("SET", redisKey, value, "PX", int64(c.ttl/time.Millisecond)); err != nil {
+		logrus.WithError(err).WithField("cache", c.name).Error("error writing to redis cache")
+	}
+
+	return value, nil
+}
+
+// Clear removes the given key from this and any later tiers
+func (c *Redis) Clear(rp *redis.Pool, key string) error {
+	rc := rp.Get()
+	defer rc.Close()
+
+	if _, err := rc.Do("DEL", c.redisKey(key)); err != nil {
+		return err
+	}
+
+	if c.next != nil {
+		return c.next.Clear(rp, key)
+	}
+	return nil
+}
+
+func (c *Redis) redisKey(key string) string {
+	return fmt.Sprintf("cache:%s:%s", c.name, key)
+}
+
+//------------------------------------------------------------------------------------------
+// Stats
+//------------------------------------------------------------------------------------------
+
+// Stats are the number of hits and misses of a cache tier
+type Stats struct {
+	Name   string
+	Hits   int64
+	Misses int64
+}
+
+// HitRate returns the fraction of gets which were hits, or zero if there weren't any gets
+func (s *Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type counter struct {
+	mutex  sync.Mutex
+	hits   int64
+	misses int64
+}
+
+func (c *counter) hit() {
+	c.mutex.Lock()
+	c.hits++
+	c.mutex.Unlock()
+}
+
+func (c *counter) miss() {
+	c.mutex.Lock()
+	c.misses++
+	c.mutex.Unlock()
+}
+
+var (
+	countersMutex sync.Mutex
+	counters      = make(map[string]*counter)
+)
+
+// registers the counter of the cache tier with the given name, tiers with the same name share a counter
+func register(name string) *counter {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	if counters[name] == nil {
+		counters[name] = &counter{}
+	}
+	return counters[name]
+}
+
+// TakeStats returns the stats of each cache tier since the last call, ordered by name
+func TakeStats() []*Stats {
+	countersMutex.Lock()
+	defer countersMutex.Unlock()
+
+	stats := make([]*Stats, 0, len(counters))
+	for name, c := range counters {
+		c.mutex.Lock()
+		stats = append(stats, &Stats{Name: name, Hits: c.hits, Misses: c.misses})
+		c.hits, c.misses = 0, 0
+		c.mutex.Unlock()
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
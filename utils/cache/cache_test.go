@@ -0,0 +1,103 @@
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/utils/cache"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoTier(t *testing.T) {
+	ctx := context.Background()
+	testsuite.ResetRP()
+	rp := testsuite.RP()
+	rc := rp.Get()
+	defer rc.Close()
+
+	cache.TakeStats()
+
+	fetches := 0
+	fetch := func(ctx context.Context, key string) (string, error) {
+		fetches++
+		if key == "bad" {
+			return "", errors.New("boom")
+		}
+		return "value_" + key, nil
+	}
+
+	c := cache.NewTwoTier("test", 2, time.Millisecond*500, time.Minute)
+
+	// first get is fetched and stored in both tiers
+	value, err := c.Get(ctx, rp, "a", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", value)
+	assert.Equal(t, 1, fetches)
+
+	stored, err := redis.String(rc.Do("GET", "cache:test_redis:a"))
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", stored)
+
+	// second comes from the local tier
+	value, err = c.Get(ctx, rp, "a", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", value)
+	assert.Equal(t, 1, fetches)
+
+	// errors are returned and not cached
+	_, err = c.Get(ctx, rp, "bad", fetch)
+	assert.EqualError(t, err, "boom")
+	_, err = c.Get(ctx, rp, "bad", fetch)
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, 3, fetches)
+
+	// local tier only holds two values, so getting two more evicts a
+	c.Get(ctx, rp, "b", fetch)
+	c.Get(ctx, rp, "c", fetch)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, 5, fetches)
+
+	// but it's still in the redis tier
+	value, err = c.Get(ctx, rp, "a", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", value)
+	assert.Equal(t, 5, fetches)
+
+	// once a value expires from the local tier, it's read from redis again
+	time.Sleep(time.Millisecond * 600)
+
+	value, err = c.Get(ctx, rp, "a", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", value)
+	assert.Equal(t, 5, fetches)
+
+	// clearing a key removes it from both tiers
+	err = c.Clear(rp, "a")
+	require.NoError(t, err)
+
+	value, err = c.Get(ctx, rp, "a", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "value_a", value)
+	assert.Equal(t, 6, fetches)
+
+	// other caches may be registered but haven't been used
+	stats := make(map[string]string)
+	for _, s := range cache.TakeStats() {
+		if s.Hits+s.Misses > 0 {
+			stats[s.Name] = fmt.Sprintf("%d/%d", s.Hits, s.Misses)
+		}
+	}
+	assert.Equal(t, map[string]string{"test_local": "1/8", "test_redis": "2/6"}, stats)
+
+	// taking stats resets them
+	for _, s := range cache.TakeStats() {
+		assert.Equal(t, 0.0, s.HitRate())
+	}
+}
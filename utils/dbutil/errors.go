@@ -1,6 +1,9 @@
 package dbutil
 
-import "github.com/lib/pq"
+import (
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
 
 // IsUniqueViolation returns true if the given error is a violation of unique constraint
 func IsUniqueViolation(err error) bool {
@@ -9,3 +12,20 @@ func IsUniqueViolation(err error) bool {
 	}
 	return false
 }
+
+// IsRetryable returns true if the given error is a deadlock or serialization failure, which means the transaction was
+// rolled back because of concurrent transactions and may succeed if retried
+func IsRetryable(err error) bool {
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		return pqErr.Code == "40P01" || pqErr.Code == "40001"
+	}
+	return false
+}
+
+// ErrorTable returns the table which the given error relates to if known
+func ErrorTable(err error) string {
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		return pqErr.Table
+	}
+	return ""
+}
@@ -16,3 +16,16 @@ func TestIsUniqueViolation(t *testing.T) {
 	assert.True(t, dbutil.IsUniqueViolation(err))
 	assert.False(t, dbutil.IsUniqueViolation(errors.New("boom")))
 }
+
+func TestIsRetryable(t *testing.T) {
+	deadlock := &pq.Error{Code: pq.ErrorCode("40P01"), Table: "contacts_contact"}
+
+	assert.True(t, dbutil.IsRetryable(deadlock))
+	assert.True(t, dbutil.IsRetryable(errors.Wrap(deadlock, "error committing")))
+	assert.True(t, dbutil.IsRetryable(&pq.Error{Code: pq.ErrorCode("40001")}))
+	assert.False(t, dbutil.IsRetryable(&pq.Error{Code: pq.ErrorCode("23505")}))
+	assert.False(t, dbutil.IsRetryable(errors.New("boom")))
+
+	assert.Equal(t, "contacts_contact", dbutil.ErrorTable(errors.Wrap(deadlock, "error committing")))
+	assert.Equal(t, "", dbutil.ErrorTable(errors.New("boom")))
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // GrabLock grabs the passed in lock from redis in an atomic operation. It returns the lock value
@@ -46,9 +47,9 @@ func GrabLock(rp *redis.Pool, key string, expiration time.Duration, retry time.D
 	return value, nil
 }
 
-var releaseScript = redis.NewScript(2, `
-    -- KEYS: [Key, Value]
-	if redis.call("get", KEYS[1]) == KEYS[2] then
+var releaseScript = redis.NewScript(1, `
+    -- KEYS: [Key] ARGV: [Value]
+	if redis.call("get", KEYS[1]) == ARGV[1] then
       return redis.call("del", KEYS[1])
     else
       return 0
@@ -66,10 +67,10 @@ func ReleaseLock(rp *redis.Pool, key string, value string) error {
 	return err
 }
 
-var expireScript = redis.NewScript(3, `
-    -- KEYS: [Key, Value, Expiration]
-	  if redis.call("get", KEYS[1]) == KEYS[2] then
-      return redis.call("expire", KEYS[1], KEYS[3])
+var expireScript = redis.NewScript(1, `
+    -- KEYS: [Key] ARGV: [Value, Expiration]
+	  if redis.call("get", KEYS[1]) == ARGV[1] then
+      return redis.call("expire", KEYS[1], ARGV[2])
     else
       return 0
     end
@@ -91,6 +92,45 @@ func ExtendLock(rp *redis.Pool, key string, value string, expiration time.Durati
 	return err
 }
 
+// KeepLocks extends the passed in locks, a map of keys to values, by the passed in expiration every half of that
+// expiration until the returned function is called, so that locks held for longer than expected don't expire while
+// their owner is still using them, but locks of owners which die do
+func KeepLocks(rp *redis.Pool, locks map[string]string, expiration time.Duration) func() {
+	// copy our locks so the caller can't change them under us
+	kept := make(map[string]string, len(locks))
+	for key, value := range locks {
+		kept[key] = value
+	}
+
+	quit := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(expiration / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				for key, value := range kept {
+					if err := ExtendLock(rp, key, value, expiration); err != nil {
+						logrus.WithError(err).WithField("lock", key).Error("error extending lock")
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 // makeRandom creates a random key of the length passed in
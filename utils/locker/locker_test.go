@@ -48,3 +48,29 @@ func TestLocker(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotZero(t, v5)
 }
+
+func TestKeepLocks(t *testing.T) {
+	testsuite.ResetRP()
+	rp := testsuite.RP()
+
+	v1, err := locker.GrabLock(rp, "test1", time.Second*2, time.Second)
+	assert.NoError(t, err)
+	v2, err := locker.GrabLock(rp, "test2", time.Second*2, time.Second)
+	assert.NoError(t, err)
+
+	stop := locker.KeepLocks(rp, map[string]string{"test1": v1, "test2": v2}, time.Second*2)
+
+	// our locks outlive their expiration while they're being kept
+	time.Sleep(time.Second * 3)
+
+	v3, err := locker.GrabLock(rp, "test1", time.Second*2, 0)
+	assert.NoError(t, err)
+	assert.Zero(t, v3)
+
+	// but not once we stop keeping them
+	stop()
+
+	v4, err := locker.GrabLock(rp, "test2", time.Second*2, time.Second*3)
+	assert.NoError(t, err)
+	assert.NotZero(t, v4)
+}
@@ -0,0 +1,161 @@
+// Package logx is a thin layer over logrus which gives each module its own logger, so that levels can be overridden
+// per module at runtime, and which allows high volume log entries to be sampled.
+package logx
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mutex      sync.Mutex
+	modules    = make(map[string]*logrus.Logger)
+	overrides  = make(map[string]logrus.Level)
+	sampleRate = 1.0
+
+	// entries which aren't sampled are written here instead
+	discard = logrus.NewEntry(&logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}, Hooks: make(logrus.LevelHooks), Level: logrus.PanicLevel})
+)
+
+// Configure sets the format of all log output, either text or json, the default level and the fraction of sampled
+// entries which are written
+func Configure(format string, level logrus.Level, rate float64) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "text", "":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return errors.Errorf("unknown log format: %s", format)
+	}
+
+	std := logrus.StandardLogger()
+	std.SetFormatter(formatter)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, l := range modules {
+		l.SetFormatter(formatter)
+		l.SetOutput(std.Out)
+	}
+
+	setDefaultLevel(level)
+	sampleRate = rate
+	return nil
+}
+
+// Module returns the logger for the named module, its entries having a comp field with the module name
+func Module(name string) *logrus.Entry {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l := modules[name]
+	if l == nil {
+		// share the output, formatter and hooks (e.g. Sentry) of the standard logger
+		std := logrus.StandardLogger()
+		l = &logrus.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: std.Hooks, Level: std.GetLevel(), ExitFunc: std.ExitFunc}
+		if level, overridden := overrides[name]; overridden {
+			l.SetLevel(level)
+		}
+		modules[name] = l
+	}
+	return l.WithField("comp", name)
+}
+
+// SetDefaultLevel sets the level of the standard logger and of all modules which don't have an override
+func SetDefaultLevel(level logrus.Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	setDefaultLevel(level)
+}
+
+func setDefaultLevel(level logrus.Level) {
+	logrus.SetLevel(level)
+
+	for name, l := range modules {
+		if _, overridden := overrides[name]; !overridden {
+			l.SetLevel(level)
+		}
+	}
+}
+
+// SetLevel overrides the level of the named module
+func SetLevel(name string, level logrus.Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	overrides[name] = level
+	if l := modules[name]; l != nil {
+		l.SetLevel(level)
+	}
+}
+
+// ClearLevel removes any override of the level of the named module so that it uses the default level
+func ClearLevel(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(overrides, name)
+	if l := modules[name]; l != nil {
+		l.SetLevel(logrus.GetLevel())
+	}
+}
+
+// Levels returns the overridden levels of modules
+func Levels() map[string]string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	levels := make(map[string]string, len(overrides))
+	for name, level := range overrides {
+		levels[name] = level.String()
+	}
+	return levels
+}
+
+// Modules returns the names of all modules which have loggers
+func Modules() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SampleRate returns the fraction of sampled entries which are written
+func SampleRate() float64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return sampleRate
+}
+
+// SetSampleRate sets the fraction of sampled entries which are written
+func SetSampleRate(rate float64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sampleRate = rate
+}
+
+// Sampled returns the passed in entry if it's been sampled, otherwise an entry which discards everything. This should
+// be used for high volume entries, e.g. one per message handled, which are only useful in aggregate.
+func Sampled(entry *logrus.Entry) *logrus.Entry {
+	rate := SampleRate()
+	if rate >= 1 || rand.Float64() < rate {
+		return entry
+	}
+	return discard
+}
@@ -0,0 +1,88 @@
+package logx_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/logx"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModules(t *testing.T) {
+	out := &bytes.Buffer{}
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(out)
+
+	handler := logx.Module("handler")
+
+	err := logx.Configure("json", logrus.InfoLevel, 1)
+	require.NoError(t, err)
+	defer logx.Configure("text", logrus.InfoLevel, 1)
+
+	assert.EqualError(t, logx.Configure("xml", logrus.InfoLevel, 1), "unknown log format: xml")
+
+	web := logx.Module("web")
+	assert.Equal(t, []string{"handler", "web"}, logx.Modules())
+
+	handler.Debug("not written")
+	web.WithField("org_id", 1).Info("written")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1)
+
+	entry := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "web", entry["comp"])
+	assert.Equal(t, "written", entry["msg"])
+	assert.Equal(t, float64(1), entry["org_id"])
+
+	// override the level of just the handler module
+	logx.SetLevel("handler", logrus.DebugLevel)
+	assert.Equal(t, map[string]string{"handler": "debug"}, logx.Levels())
+
+	out.Reset()
+	handler.Debug("written")
+	web.Debug("not written")
+	assert.Equal(t, 1, strings.Count(out.String(), "written"))
+
+	// changing the default level doesn't affect overridden modules
+	logx.SetDefaultLevel(logrus.ErrorLevel)
+
+	out.Reset()
+	handler.Debug("written")
+	web.Info("not written")
+	assert.Equal(t, 1, strings.Count(out.String(), "written"))
+
+	logx.ClearLevel("handler")
+	assert.Equal(t, map[string]string{}, logx.Levels())
+
+	out.Reset()
+	handler.Info("not written")
+	assert.Equal(t, "", out.String())
+}
+
+func TestSampled(t *testing.T) {
+	out := &bytes.Buffer{}
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(out)
+
+	log := logx.Module("sampled")
+	logx.SetLevel("sampled", logrus.InfoLevel)
+
+	logx.SetSampleRate(0)
+	for i := 0; i < 10; i++ {
+		logx.Sampled(log).Info("task complete")
+	}
+	assert.Equal(t, "", out.String())
+
+	logx.SetSampleRate(1)
+	for i := 0; i < 10; i++ {
+		logx.Sampled(log).Info("task complete")
+	}
+	assert.Equal(t, 10, strings.Count(out.String(), "task complete"))
+}
@@ -13,24 +13,22 @@ const (
 	oneDay     = 60 * 60 * 24
 )
 
-var hasTask = redis.NewScript(3,
-	`-- KEYS: [TodayKey, YesterdayKey, TaskID]
-     local found = redis.call("sismember", KEYS[1], KEYS[3])
-     if found == 1 then
-	   return 1
-     end
-     return redis.call("sismember", KEYS[2], KEYS[3])
-`)
-
 // HasTask returns whether the passed in taskID has already been marked for execution
 func HasTask(rc redis.Conn, taskGroup string, taskID string) (bool, error) {
 	todayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().UTC().Format("2006_01_02"))
 	yesterdayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().Add(time.Hour*-24).UTC().Format("2006_01_02"))
-	found, err := redis.Bool(hasTask.Do(rc, todayKey, yesterdayKey, taskID))
-	if err != nil {
-		return false, errors.Wrapf(err, "error checking for task: %s for group: %s", taskID, taskGroup)
+
+	// these keys are checked with separate commands as they can be in different slots of a redis cluster
+	for _, key := range []string{todayKey, yesterdayKey} {
+		found, err := redis.Bool(rc.Do("sismember", key, taskID))
+		if err != nil {
+			return false, errors.Wrapf(err, "error checking for task: %s for group: %s", taskID, taskGroup)
+		}
+		if found {
+			return true, nil
+		}
 	}
-	return found, nil
+	return false, nil
 }
 
 // AddTask marks the passed in task
@@ -49,11 +47,10 @@ func AddTask(rc redis.Conn, taskGroup string, taskID string) error {
 func RemoveTask(rc redis.Conn, taskGroup string, taskID string) error {
 	todayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().UTC().Format("2006_01_02"))
 	yesterdayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().Add(time.Hour*-24).UTC().Format("2006_01_02"))
-	rc.Send("srem", todayKey, taskID)
-	rc.Send("srem", yesterdayKey, taskID)
-	_, err := rc.Do("")
-	if err != nil {
-		return errors.Wrapf(err, "error removing task: %s from redis set for group: %s", taskID, taskGroup)
+	for _, key := range []string{todayKey, yesterdayKey} {
+		if _, err := rc.Do("srem", key, taskID); err != nil {
+			return errors.Wrapf(err, "error removing task: %s from redis set for group: %s", taskID, taskGroup)
+		}
 	}
 	return nil
 }
@@ -62,8 +59,10 @@ func RemoveTask(rc redis.Conn, taskGroup string, taskID string) error {
 func ClearTasks(rc redis.Conn, taskGroup string) error {
 	todayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().UTC().Format("2006_01_02"))
 	yesterdayKey := fmt.Sprintf(keyPattern, taskGroup, time.Now().Add(time.Hour*-24).UTC().Format("2006_01_02"))
-	rc.Send("del", todayKey)
-	rc.Send("del", yesterdayKey)
-	_, err := rc.Do("")
-	return err
+	for _, key := range []string{todayKey, yesterdayKey} {
+		if _, err := rc.Do("del", key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,130 @@
+package redisutil
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+	"github.com/pkg/errors"
+)
+
+// how many times a command is tried when the cluster redirects it to another node, e.g. during resharding, and how long
+// to wait before trying again when a slot is being migrated
+const (
+	clusterAttempts   = 3
+	clusterRetryDelay = time.Millisecond * 100
+)
+
+// ClusterDialer returns a function for a pool which gets connections to the redis cluster whose nodes are discovered
+// from the given seed nodes. Commands are sent to the node serving their key, following redirects if slots have moved,
+// but the keys of each pipeline or transaction must all be in the same slot.
+func ClusterDialer(seeds []string, dial DialFunc) (func() (redis.Conn, error), error) {
+	cluster := &redisc.Cluster{
+		StartupNodes: seeds,
+		CreatePool: func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+			return &redis.Pool{
+				MaxIdle:     4,
+				IdleTimeout: 240 * time.Second,
+				Dial: func() (redis.Conn, error) {
+					return dial(addr)
+				},
+			}, nil
+		},
+	}
+	if err := cluster.Refresh(); err != nil {
+		return nil, errors.Wrapf(err, "error loading slots of redis cluster")
+	}
+
+	return func() (redis.Conn, error) {
+		return &clusterConn{cluster: cluster, Conn: cluster.Get()}, nil
+	}, nil
+}
+
+// A redisc connection is bound to a single node by its first command, but our connections are used for keys in many
+// slots, so each pipeline or transaction gets a connection bound to the node serving the key of its first command. A
+// MULTI which starts a transaction is held back until that command.
+type clusterConn struct {
+	redis.Conn
+	cluster *redisc.Cluster
+	pending int // number of commands sent whose replies haven't been received
+	multi   bool
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.pending == 0 && cmd != "" {
+		if err := c.bind(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.sendMulti(); err != nil {
+		return nil, err
+	}
+	c.pending = 0
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.pending == 0 && !c.multi {
+		if strings.EqualFold(cmd, "MULTI") {
+			c.multi = true
+			return nil
+		}
+		if err := c.bind(cmd, args); err != nil {
+			return err
+		}
+	}
+	if err := c.sendMulti(); err != nil {
+		return err
+	}
+	c.pending++
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.pending > 0 {
+		c.pending--
+	}
+	return c.Conn.Receive()
+}
+
+// sends a MULTI which has been held back until the first command of its transaction
+func (c *clusterConn) sendMulti() error {
+	if !c.multi {
+		return nil
+	}
+	c.multi = false
+	c.pending++
+	return c.Conn.Send("MULTI")
+}
+
+// replaces our connection with one which follows redirects and is bound to the node serving the key of the given
+// command, commands without keys being sent to whichever node our current connection is bound to
+func (c *clusterConn) bind(cmd string, args []interface{}) error {
+	// scripts are sent with the number of keys they use before their keys
+	if strings.EqualFold(cmd, "EVAL") || strings.EqualFold(cmd, "EVALSHA") {
+		if len(args) < 3 || fmt.Sprintf("%v", args[1]) == "0" {
+			return nil
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	conn := c.cluster.Get()
+	if err := redisc.BindConn(conn, fmt.Sprintf("%s", args[0])); err != nil {
+		conn.Close()
+		return err
+	}
+	retrying, err := redisc.RetryConn(conn, clusterAttempts, clusterRetryDelay)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.Conn.Close()
+	c.Conn = retrying
+	return nil
+}
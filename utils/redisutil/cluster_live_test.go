@@ -0,0 +1,137 @@
+package redisutil_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/utils/locker"
+	"github.com/nyaruka/mailroom/utils/marker"
+	"github.com/nyaruka/mailroom/utils/redisutil"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLiveCluster runs against an actual redis cluster whose seed nodes are given by MAILROOM_TEST_REDIS_CLUSTER, e.g.
+// localhost:7000,localhost:7001,localhost:7002, and is skipped if that isn't set
+func TestLiveCluster(t *testing.T) {
+	seeds := os.Getenv("MAILROOM_TEST_REDIS_CLUSTER")
+	if seeds == "" {
+		t.Skip("MAILROOM_TEST_REDIS_CLUSTER not set")
+	}
+
+	dial, err := redisutil.ClusterDialer(strings.Split(seeds, ","), func(addr string) (redis.Conn, error) {
+		return redis.Dial("tcp", addr)
+	})
+	require.NoError(t, err)
+
+	rp := &redis.Pool{MaxActive: 4, Wait: true, Dial: dial}
+	defer rp.Close()
+
+	redisutil.UseHashTags(true)
+	defer redisutil.UseHashTags(false)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// these keys are in different slots, and with 3 or more masters, on different nodes
+	keys := []string{"cluster_test:a", "cluster_test:b", "cluster_test:c", "cluster_test:d"}
+
+	// commands are each sent to the node serving their key
+	for i, key := range keys {
+		_, err := rc.Do("SET", key, i)
+		require.NoError(t, err)
+	}
+	for i, key := range keys {
+		value, err := redis.Int(rc.Do("GET", key))
+		require.NoError(t, err)
+		assert.Equal(t, i, value)
+	}
+
+	// as are pipelines of commands whose keys are in the same slot
+	for _, key := range keys {
+		rc.Send("DEL", key)
+		rc.Send("SET", "{"+key+"}:x", 1)
+		rc.Send("INCR", "{"+key+"}:x")
+		values, err := redis.Values(rc.Do(""))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), values[2])
+	}
+
+	// transactions can only use keys in the same slot
+	rc.Send("MULTI")
+	rc.Send("SET", "{cluster_test}:a", 1)
+	rc.Send("INCR", "{cluster_test}:a")
+	results, err := redis.Values(rc.Do("EXEC"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), results[1])
+
+	rc.Send("MULTI")
+	rc.Send("SET", "cluster_test:a", 1)
+	rc.Send("SET", "cluster_test:b", 1)
+	_, err = rc.Do("EXEC")
+	assert.Error(t, err)
+
+	// the connection is still usable after that
+	_, err = rc.Do("DEL", "{cluster_test}:a")
+	assert.NoError(t, err)
+
+	// queues keep all their keys in the slot of their hash tag
+	_, err = queue.DiscardParkedTasks(rc, 1001)
+	require.NoError(t, err)
+	for {
+		task, err := queue.PopNextTask(rc, queue.BatchQueue)
+		require.NoError(t, err)
+		if task == nil {
+			break
+		}
+		queue.MarkTaskComplete(rc, queue.BatchQueue, task.OrgID)
+	}
+
+	assert.NoError(t, queue.AddTask(rc, queue.BatchQueue, "campaign", 1001, "task1", queue.DefaultPriority))
+	assert.NoError(t, queue.AddTask(rc, queue.BatchQueue, "campaign", 1002, "task2", queue.DefaultPriority))
+	assert.NoError(t, queue.StartMaintenance(rc, 1001))
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1002, task.OrgID)
+	assert.NoError(t, queue.MarkTaskComplete(rc, queue.BatchQueue, 1002))
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	requeued, err := queue.EndMaintenance(rc, 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1001, task.OrgID)
+	assert.NoError(t, queue.MarkTaskComplete(rc, queue.BatchQueue, 1001))
+
+	// locks only use the one key
+	lock, err := locker.GrabLock(rp, "cluster_test", time.Minute, time.Second)
+	require.NoError(t, err)
+	assert.NotEqual(t, "", lock)
+	assert.NoError(t, locker.ExtendLock(rp, "cluster_test", lock, time.Minute))
+	assert.NoError(t, locker.ReleaseLock(rp, "cluster_test", lock))
+
+	// markers check today's and yesterday's sets separately as they can be in different slots
+	assert.NoError(t, marker.ClearTasks(rc, "cluster_test"))
+	assert.NoError(t, marker.AddTask(rc, "cluster_test", "1"))
+
+	found, err := marker.HasTask(rc, "cluster_test", "1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	assert.NoError(t, marker.RemoveTask(rc, "cluster_test", "1"))
+
+	found, err = marker.HasTask(rc, "cluster_test", "1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
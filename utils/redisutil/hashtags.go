@@ -0,0 +1,25 @@
+package redisutil
+
+// whether keys which are used together, e.g. by a script or transaction, are hash tagged so that they're in the same
+// slot of a redis cluster
+var hashTags = false
+
+// UseHashTags sets whether keys which are used together are hash tagged. Tagged keys differ from untagged ones, e.g.
+// {batch}:1 rather than batch:1, so RapidPro and courier must be configured to use the same keys.
+func UseHashTags(use bool) {
+	hashTags = use
+}
+
+// UsingHashTags returns whether keys which are used together are hash tagged
+func UsingHashTags() bool {
+	return hashTags
+}
+
+// HashTag returns the passed in key prefix as a hash tag if we're using them, e.g. batch becomes {batch}, so that all
+// the keys with that prefix are in the same slot of a redis cluster
+func HashTag(prefix string) string {
+	if hashTags {
+		return "{" + prefix + "}"
+	}
+	return prefix
+}
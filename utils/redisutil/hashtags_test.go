@@ -0,0 +1,21 @@
+package redisutil_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/redisutil"
+
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashTag(t *testing.T) {
+	assert.Equal(t, "batch", redisutil.HashTag("batch"))
+
+	redisutil.UseHashTags(true)
+	defer redisutil.UseHashTags(false)
+
+	assert.Equal(t, "{batch}", redisutil.HashTag("batch"))
+	assert.Equal(t, redisc.Slot("{org:1}:cache:active_topup"), redisc.Slot("{org:1}:cache:credits_remaining:12"))
+	assert.Equal(t, redisc.Slot("{batch}:active"), redisc.Slot("parked_tasks:{batch}:1001"))
+}
@@ -0,0 +1,65 @@
+package redisutil
+
+import (
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// DialFunc is a function which dials the redis instance at the given address, e.g. also authenticating
+type DialFunc func(addr string) (redis.Conn, error)
+
+// connections which have been idle for longer than this are checked to still be to a master when borrowed
+const roleCheckInterval = time.Second
+
+// SentinelDialer returns a function for a pool which dials the current master of the named set of redis instances
+// monitored by the given sentinels
+func SentinelDialer(sentinels []string, master string, dial DialFunc) func() (redis.Conn, error) {
+	return func() (redis.Conn, error) {
+		addr, err := SentinelMaster(sentinels, master)
+		if err != nil {
+			return nil, err
+		}
+		return dial(addr)
+	}
+}
+
+// SentinelMaster asks each of the given sentinels in turn for the address of the named master until one answers
+func SentinelMaster(sentinels []string, master string) (string, error) {
+	for _, sentinel := range sentinels {
+		conn, err := redis.Dial("tcp", sentinel, redis.DialConnectTimeout(time.Second*5))
+		if err != nil {
+			continue
+		}
+
+		hostAndPort, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", master))
+		conn.Close()
+
+		if err == nil && len(hostAndPort) == 2 {
+			return net.JoinHostPort(hostAndPort[0], hostAndPort[1]), nil
+		}
+	}
+	return "", errors.Errorf("no sentinel knows the address of master %s", master)
+}
+
+// TestRole is a function for a pool's TestOnBorrow which checks that connections which have been idle are still to a
+// master, as after a failover the old master is demoted to a replica and connections to it become read only
+func TestRole(conn redis.Conn, idleSince time.Time) error {
+	if time.Since(idleSince) < roleCheckInterval {
+		return nil
+	}
+
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("empty reply to ROLE")
+	}
+	if r, _ := redis.String(role[0], nil); r != "master" {
+		return errors.Errorf("connection is to a %s rather than the master", r)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Package scope tracks the context of a task or request, i.e. the org, flow and session it's operating on along with a
+// trail of the last few operations it performed, so that errors can be reported with that context attached.
+package scope
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxCrumbs is the number of most recent operations kept as breadcrumbs
+const MaxCrumbs = 20
+
+type contextKey int
+
+const scopeKey contextKey = 0
+
+// Scope is the reporting context of a single task or request
+type Scope struct {
+	mutex  sync.Mutex
+	fields logrus.Fields
+	crumbs []string
+	next   int
+}
+
+// New returns a copy of the passed in context with a new scope which has the passed in fields
+func New(ctx context.Context, fields logrus.Fields) context.Context {
+	s := &Scope{fields: make(logrus.Fields, len(fields)+4), crumbs: make([]string, 0, MaxCrumbs)}
+	for k, v := range fields {
+		s.fields[k] = v
+	}
+	return context.WithValue(ctx, scopeKey, s)
+}
+
+// Set sets a field on the scope of the passed in context, if it has one
+func Set(ctx context.Context, key string, value interface{}) {
+	if s, _ := ctx.Value(scopeKey).(*Scope); s != nil {
+		s.mutex.Lock()
+		s.fields[key] = value
+		s.mutex.Unlock()
+	}
+}
+
+// AddCrumb records an operation on the scope of the passed in context, if it has one, dropping the oldest operation
+// if we already have the maximum number
+func AddCrumb(ctx context.Context, category string, format string, args ...interface{}) {
+	s, _ := ctx.Value(scopeKey).(*Scope)
+	if s == nil {
+		return
+	}
+
+	crumb := fmt.Sprintf("%s %s: %s", time.Now().UTC().Format("15:04:05.000"), category, fmt.Sprintf(format, args...))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.crumbs) < MaxCrumbs {
+		s.crumbs = append(s.crumbs, crumb)
+	} else {
+		s.crumbs[s.next] = crumb
+	}
+	s.next = (s.next + 1) % MaxCrumbs
+}
+
+// Fields returns the fields of the scope of the passed in context, including its breadcrumbs oldest first
+func Fields(ctx context.Context) logrus.Fields {
+	s, _ := ctx.Value(scopeKey).(*Scope)
+	if s == nil {
+		return logrus.Fields{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fields := make(logrus.Fields, len(s.fields)+1)
+	for k, v := range s.fields {
+		fields[k] = v
+	}
+
+	if len(s.crumbs) > 0 {
+		crumbs := make([]string, 0, len(s.crumbs))
+		if len(s.crumbs) == MaxCrumbs {
+			crumbs = append(crumbs, s.crumbs[s.next:]...)
+			crumbs = append(crumbs, s.crumbs[:s.next]...)
+		} else {
+			crumbs = append(crumbs, s.crumbs...)
+		}
+		fields["breadcrumbs"] = crumbs
+	}
+
+	return fields
+}
+
+// Log returns a log entry with the fields of the scope of the passed in context, which when logged as an error will
+// send those fields to Sentry as extra data
+func Log(ctx context.Context) *logrus.Entry {
+	return logrus.WithFields(Fields(ctx))
+}
@@ -0,0 +1,47 @@
+package scope_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/scope"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScope(t *testing.T) {
+	// contexts without a scope are ignored
+	ctx := context.Background()
+	scope.Set(ctx, "org_id", 1)
+	scope.AddCrumb(ctx, "db", "insert msgs")
+	assert.Equal(t, logrus.Fields{}, scope.Fields(ctx))
+
+	ctx = scope.New(ctx, logrus.Fields{"task_type": "start_flow"})
+	assert.Equal(t, logrus.Fields{"task_type": "start_flow"}, scope.Fields(ctx))
+
+	scope.Set(ctx, "org_id", 1)
+	scope.AddCrumb(ctx, "db", "insert %s", "msgs")
+
+	fields := scope.Fields(ctx)
+	assert.Equal(t, "start_flow", fields["task_type"])
+	assert.Equal(t, 1, fields["org_id"])
+	assert.Len(t, fields["breadcrumbs"], 1)
+	assert.True(t, strings.HasSuffix(fields["breadcrumbs"].([]string)[0], " db: insert msgs"))
+
+	// once we have the max number of crumbs, the oldest are dropped
+	for i := 0; i < scope.MaxCrumbs+5; i++ {
+		scope.AddCrumb(ctx, "http", "call %d", i)
+	}
+
+	crumbs := scope.Fields(ctx)["breadcrumbs"].([]string)
+	assert.Len(t, crumbs, scope.MaxCrumbs)
+	assert.True(t, strings.HasSuffix(crumbs[0], " http: call 5"))
+	assert.True(t, strings.HasSuffix(crumbs[scope.MaxCrumbs-1], fmt.Sprintf(" http: call %d", scope.MaxCrumbs+4)))
+
+	// a new scope starts fresh
+	ctx = scope.New(ctx, nil)
+	assert.Equal(t, logrus.Fields{}, scope.Fields(ctx))
+}
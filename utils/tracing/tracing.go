@@ -0,0 +1,94 @@
+// Package tracing traces web requests and tasks with OpenTelemetry. The trace context of a request is carried into the
+// payloads of the tasks it queues, and from those into the tasks they queue, so that e.g. a flow start can be followed
+// from the request that created it through its batch tasks to the session runs, webhook calls and messages of each
+// contact.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pkg/errors"
+)
+
+const tracerName = "github.com/nyaruka/mailroom"
+
+// we always use W3C trace context, i.e. a traceparent header or task field
+var propagator = propagation.TraceContext{}
+
+// Configure starts exporting traces to the OTLP/HTTP collector at the given endpoint, e.g. localhost:4318, sampling the
+// given fraction of traces which aren't already part of a sampled trace. It returns a function which flushes any pending
+// spans and stops exporting. If the endpoint is empty, tracing is left disabled and all spans are no-ops.
+func Configure(ctx context.Context, endpoint string, sampleRate float64, version string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating trace exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "mailroom"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a new span as a child of any span in the passed in context
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Record adds a span for an operation which has already happened, e.g. a webhook call made by the engine
+func Record(ctx context.Context, name string, start, end time.Time, attrs ...attribute.KeyValue) {
+	_, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(attrs...))
+	span.End(trace.WithTimestamp(end))
+}
+
+// RecordError records the passed in error on the passed in span and marks that span as failed
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject returns the trace context of the passed in context for including in a task payload, or nil if it isn't part
+// of a trace
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns a copy of the passed in context which continues the trace of a task payload, if it has one
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// ExtractHeaders returns a copy of the passed in context which continues the trace of an incoming request, if it has one
+func ExtractHeaders(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,61 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/utils/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+
+	// without an endpoint, tracing stays disabled
+	stop, err := tracing.Configure(ctx, "", 1, "Dev")
+	require.NoError(t, err)
+	assert.NoError(t, stop(ctx))
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// contexts which aren't part of a trace have nothing to carry
+	assert.Nil(t, tracing.Inject(ctx))
+	assert.Equal(t, ctx, tracing.Extract(ctx, nil))
+
+	requestCtx, requestSpan := tracing.Start(ctx, "POST /mr/flow/start")
+
+	// a task queued during the request carries its trace
+	carrier := tracing.Inject(requestCtx)
+	assert.Contains(t, carrier, "traceparent")
+
+	taskCtx, taskSpan := tracing.Start(tracing.Extract(ctx, carrier), "task start_flow")
+	assert.Equal(t, requestSpan.SpanContext().TraceID(), taskSpan.SpanContext().TraceID())
+
+	called := time.Date(2021, 7, 6, 12, 30, 0, 0, time.UTC)
+	tracing.Record(taskCtx, "webhook", called, called.Add(time.Second))
+
+	taskSpan.End()
+	requestSpan.End()
+
+	// as can a request with a traceparent header
+	header := http.Header{}
+	header.Set("traceparent", carrier["traceparent"])
+	assert.Equal(t, requestSpan.SpanContext().TraceID(), trace.SpanContextFromContext(tracing.ExtractHeaders(ctx, header)).TraceID())
+
+	spans := recorder.Ended()
+	require.Equal(t, 3, len(spans))
+	assert.Equal(t, "webhook", spans[0].Name())
+	assert.True(t, called.Equal(spans[0].StartTime()))
+	assert.True(t, called.Add(time.Second).Equal(spans[0].EndTime()))
+	assert.Equal(t, taskSpan.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, requestSpan.SpanContext().SpanID(), spans[1].Parent().SpanID())
+}
@@ -0,0 +1,91 @@
+package translit
+
+import (
+	"strings"
+
+	"github.com/nyaruka/gocommon/gsm7"
+)
+
+// punctuation and symbols which have plain equivalents in the GSM-7 alphabet
+var substitutions = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'",
+	'“': `"`, '”': `"`, '„': `"`, '‟': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'–': "-", '—': "-", '―': "-", '‐': "-", '‑': "-", '−': "-",
+	'…': "...", '•': "-", '·': ".", '×': "x", '÷': "/",
+	'\u00a0': " ", '\u2002': " ", '\u2003': " ", '\u2009': " ", '\u200b': "",
+	'©': "(c)", '®': "(r)", '™': "TM", '°': "o",
+	'½': "1/2", '¼': "1/4", '¾': "3/4",
+	'₹': "Rs", '₦': "N", '₵': "GHS", '¢': "c",
+}
+
+// emoji which are commonly used in messages and have a recognizable text equivalent
+var emoji = map[rune]string{
+	'😀': ":D", '😃': ":D", '😄': ":D", '😁': ":D", '😆': "XD", '😂': ":'D", '🤣': ":'D",
+	'🙂': ":)", '😊': ":)", '☺': ":)", '😉': ";)", '😍': "<3", '🥰': "<3", '😘': ":*",
+	'😛': ":P", '😜': ";P", '😝': "XP", '😐': ":|", '😕': ":/", '🙁': ":(", '☹': ":(",
+	'😞': ":(", '😢': ":'(", '😭': ":'(", '😠': ">:(", '😡': ">:(", '😮': ":O", '😲': ":O",
+	'❤': "<3", '💕': "<3", '💖': "<3", '💙': "<3", '💚': "<3", '💛': "<3", '💜': "<3", '💔': "</3",
+	'👍': "(y)", '👎': "(n)", '👋': "(wave)", '🙏': "(pray)", '👏': "(clap)", '💪': "(strong)",
+	'✅': "(v)", '✔': "(v)", '❌': "(x)", '✖': "(x)", '⚠': "(!)", '❗': "!", '❓': "?",
+	'⭐': "*", '🌟': "*", '✨': "*", '🎉': "(party)", '🔥': "(fire)", '📞': "(phone)", '📱': "(phone)",
+	'👉': "->", '➡': "->", '⬅': "<-", '👈': "<-",
+}
+
+// letters with diacritics which aren't in the GSM-7 alphabet and their closest ASCII equivalents
+var letters = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'Ć': "C", 'ć': "c", 'Č': "C", 'č': "c",
+	'Ď': "D", 'ď': "d", 'Đ': "D", 'đ': "d",
+	'È': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ę': "E", 'Ě': "E",
+	'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'Ğ': "G", 'ğ': "g",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I", 'İ': "I",
+	'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i",
+	'Ł': "L", 'ł': "l",
+	'Ń': "N", 'ń': "n", 'Ň': "N", 'ň': "n",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ō': "O", 'Ő': "O",
+	'ó': "o", 'ô': "o", 'õ': "o", 'ō': "o", 'ő': "o",
+	'Ř': "R", 'ř': "r",
+	'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s", 'Š': "S", 'š': "s",
+	'Ť': "T", 'ť': "t", 'Ţ': "T", 'ţ': "t",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ū': "U", 'Ů': "U", 'Ű': "U",
+	'ú': "u", 'û': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'Ý': "Y", 'ý': "y", 'ÿ': "y", 'Ÿ': "Y",
+	'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+	'Œ': "OE", 'œ': "oe", 'Þ': "TH", 'þ': "th", 'Ð': "D", 'ð': "d",
+}
+
+// ToGSM7 transliterates characters in the passed in text which aren't in the GSM-7 alphabet to their closest GSM-7
+// equivalents, e.g. smart quotes to straight quotes, emoji to emoticons and accented letters to plain ones. Characters
+// without an equivalent are left as is, in which case the text will still need to be sent as UCS-2.
+func ToGSM7(text string) string {
+	if gsm7.IsValid(text) {
+		return text
+	}
+
+	var b strings.Builder
+	b.Grow(len(text))
+
+	for _, r := range text {
+		// variation selectors and joiners only affect how emoji are displayed
+		if r == '\ufe0f' || r == '\ufe0e' || r == '\u200d' {
+			continue
+		}
+
+		s := string(r)
+		if gsm7.IsValid(s) {
+			b.WriteString(s)
+		} else if sub, found := substitutions[r]; found {
+			b.WriteString(sub)
+		} else if sub, found := emoji[r]; found {
+			b.WriteString(sub)
+		} else if sub, found := letters[r]; found {
+			b.WriteString(sub)
+		} else {
+			b.WriteString(s)
+		}
+	}
+
+	return b.String()
+}
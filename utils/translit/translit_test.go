@@ -0,0 +1,30 @@
+package translit_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/translit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToGSM7(t *testing.T) {
+	tcs := []struct {
+		text     string
+		expected string
+	}{
+		{"", ""},
+		{"Hello world", "Hello world"},
+		{"Où est la gare? Ça va, Müller!", "Où est la gare? Ça va, Müller!"},
+		{"“Don’t” – she said…", `"Don't" - she said...`},
+		{"Great job 👍😊", "Great job (y):)"},
+		{"I ❤️ it", "I <3 it"},
+		{"Hola, ¿cómo estás? Łódź", "Hola, ¿como estas? Lodz"},
+		{"Price: 100 ₦", "Price: 100 N"},
+		{"Привет 🦄", "Привет 🦄"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, translit.ToGSM7(tc.text), "transliteration mismatch for '%s'", tc.text)
+	}
+}
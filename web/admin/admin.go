@@ -0,0 +1,360 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logx"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/warm_cache", web.RequireAuthToken(handleWarmCache))
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/log_levels", web.RequireAuthToken(handleGetLogLevels))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/log_levels", web.RequireAuthToken(handleSetLogLevels))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/parked_tasks", web.RequireAuthToken(handleParkedTasks))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/admin/parked_tasks/flush", web.RequireAuthToken(handleFlushParkedTasks))
+	web.RegisterJSONRoute(http.MethodGet, "/mr/admin/queues", web.RequireAuthToken(handleQueues))
+}
+
+// the number of orgs we warm if a request doesn't specify which or how many
+const defaultWarmCount = 20
+
+// Request to warm the asset caches of either the given orgs or the given number of most active orgs
+//
+//   {
+//     "org_ids": [1, 2],
+//     "count": 20
+//   }
+//
+type warmCacheRequest struct {
+	OrgIDs []models.OrgID `json:"org_ids"`
+	Count  int            `json:"count"   validate:"min=1,max=1000"`
+}
+
+// Response to a warm cache request with the orgs which were warmed and any which failed
+//
+//   {
+//     "org_ids": [1, 2],
+//     "failed_ids": []
+//   }
+//
+type warmCacheResponse struct {
+	OrgIDs    []models.OrgID `json:"org_ids"`
+	FailedIDs []models.OrgID `json:"failed_ids"`
+}
+
+// Loads org assets into this instance's cache so that a newly deployed instance can be warmed up before it's
+// put into service
+func handleWarmCache(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &warmCacheRequest{Count: defaultWarmCount}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	orgIDs := request.OrgIDs
+	if len(orgIDs) == 0 {
+		var err error
+		orgIDs, err = mostActiveOrgs(rt, request.Count)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	failed := models.WarmOrgAssets(ctx, rt.DB, orgIDs)
+	sort.Slice(failed, func(i, j int) bool { return failed[i] < failed[j] })
+
+	return &warmCacheResponse{OrgIDs: orgIDs, FailedIDs: failed}, http.StatusOK, nil
+}
+
+// returns the ids of the passed in number of orgs which have recently handled the most tasks
+func mostActiveOrgs(rt *runtime.Runtime, count int) ([]models.OrgID, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	ids, err := queue.MostActive(rc, time.Now(), count)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting most active orgs")
+	}
+
+	orgIDs := make([]models.OrgID, len(ids))
+	for i, id := range ids {
+		orgIDs[i] = models.OrgID(id)
+	}
+	return orgIDs, nil
+}
+
+// Response with the current logging configuration of this instance
+//
+//   {
+//     "default_level": "error",
+//     "levels": {"handler": "debug"},
+//     "modules": ["foreman", "handler", "runner"],
+//     "sample_rate": 0.1
+//   }
+//
+type logLevelsResponse struct {
+	DefaultLevel string            `json:"default_level"`
+	Levels       map[string]string `json:"levels"`
+	Modules      []string          `json:"modules"`
+	SampleRate   float64           `json:"sample_rate"`
+}
+
+func newLogLevelsResponse() *logLevelsResponse {
+	return &logLevelsResponse{
+		DefaultLevel: logrus.GetLevel().String(),
+		Levels:       logx.Levels(),
+		Modules:      logx.Modules(),
+		SampleRate:   logx.SampleRate(),
+	}
+}
+
+// Returns the current logging configuration of this instance
+func handleGetLogLevels(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	return newLogLevelsResponse(), http.StatusOK, nil
+}
+
+// Request to change the logging configuration of this instance. Module levels which are empty are cleared so that the
+// module uses the default level again.
+//
+//   {
+//     "default_level": "warning",
+//     "levels": {"handler": "debug", "runner": ""},
+//     "sample_rate": 0.1
+//   }
+//
+type setLogLevelsRequest struct {
+	DefaultLevel string            `json:"default_level"`
+	Levels       map[string]string `json:"levels"`
+	SampleRate   *float64          `json:"sample_rate" validate:"omitempty,min=0,max=1"`
+}
+
+// Changes the logging configuration of this instance until it's restarted
+func handleSetLogLevels(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &setLogLevelsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// check all levels are valid before changing anything
+	var defaultLevel logrus.Level
+	var err error
+	if request.DefaultLevel != "" {
+		if defaultLevel, err = logrus.ParseLevel(request.DefaultLevel); err != nil {
+			return errors.Errorf("invalid level: %s", request.DefaultLevel), http.StatusBadRequest, nil
+		}
+	}
+	levels := make(map[string]logrus.Level, len(request.Levels))
+	for module, l := range request.Levels {
+		if l == "" {
+			continue
+		}
+		if levels[module], err = logrus.ParseLevel(l); err != nil {
+			return errors.Errorf("invalid level for %s: %s", module, l), http.StatusBadRequest, nil
+		}
+	}
+
+	if request.DefaultLevel != "" {
+		logx.SetDefaultLevel(defaultLevel)
+	}
+	for module, l := range request.Levels {
+		if l == "" {
+			logx.ClearLevel(module)
+		} else {
+			logx.SetLevel(module, levels[module])
+		}
+	}
+	if request.SampleRate != nil {
+		logx.SetSampleRate(*request.SampleRate)
+	}
+
+	return newLogLevelsResponse(), http.StatusOK, nil
+}
+
+// the maximum number of parked tasks we return for each queue
+const maxParkedTasks = 100
+
+// Request to view the tasks parked for an org while it's in maintenance
+//
+//   {
+//     "org_id": 1
+//   }
+//
+type parkedTasksRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+}
+
+// Response with whether the org is in maintenance and the first of its parked tasks in each queue
+//
+//   {
+//     "org_id": 1,
+//     "maintenance": true,
+//     "queues": {
+//       "batch": {"total": 1, "tasks": [{"type": "start_flow", "org_id": 1, "task": {...}, "queued_on": "..."}]},
+//       "handler": {"total": 0, "tasks": []}
+//     }
+//   }
+//
+type parkedTasksResponse struct {
+	OrgID       models.OrgID                 `json:"org_id"`
+	Maintenance bool                         `json:"maintenance"`
+	Queues      map[string]*parkedQueueTasks `json:"queues"`
+}
+
+type parkedQueueTasks struct {
+	Total int           `json:"total"`
+	Tasks []*queue.Task `json:"tasks"`
+}
+
+// Returns the tasks parked for an org
+func handleParkedTasks(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &parkedTasksRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	maintenance, err := queue.InMaintenance(rc, int(request.OrgID))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	response := &parkedTasksResponse{OrgID: request.OrgID, Maintenance: maintenance, Queues: make(map[string]*parkedQueueTasks)}
+
+	for _, q := range []string{queue.BatchQueue, queue.HandlerQueue} {
+		tasks, total, err := queue.ParkedTasks(rc, q, int(request.OrgID), maxParkedTasks)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		response.Queues[q] = &parkedQueueTasks{Total: total, Tasks: tasks}
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Request to flush the tasks parked for an org, either by requeuing them or discarding them. Tasks can only be
+// requeued once the org has left maintenance, which also requeues them automatically.
+//
+//   {
+//     "org_id": 1,
+//     "discard": false
+//   }
+//
+type flushParkedTasksRequest struct {
+	OrgID   models.OrgID `json:"org_id"  validate:"required"`
+	Discard bool         `json:"discard"`
+}
+
+// Response with the number of tasks which were flushed
+//
+//   {
+//     "org_id": 1,
+//     "requeued": 3,
+//     "discarded": 0
+//   }
+//
+type flushParkedTasksResponse struct {
+	OrgID     models.OrgID `json:"org_id"`
+	Requeued  int          `json:"requeued"`
+	Discarded int          `json:"discarded"`
+}
+
+// Flushes the tasks parked for an org
+func handleFlushParkedTasks(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &flushParkedTasksRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	response := &flushParkedTasksResponse{OrgID: request.OrgID}
+
+	if request.Discard {
+		discarded, err := queue.DiscardParkedTasks(rc, int(request.OrgID))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		response.Discarded = discarded
+	} else {
+		maintenance, err := queue.InMaintenance(rc, int(request.OrgID))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if maintenance {
+			return errors.Errorf("org %d is still in maintenance", request.OrgID), http.StatusBadRequest, nil
+		}
+
+		requeued, err := queue.RequeueParkedTasks(rc, int(request.OrgID))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		response.Requeued = requeued
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Response with the tasks queued and executing for an org on each queue
+//
+//   {
+//     "org_id": 1,
+//     "maintenance": false,
+//     "queues": {
+//       "batch": {
+//         "size": 2,
+//         "types": {"start_flow_batch": 2},
+//         "oldest_queued_on": "2021-06-23T15:30:00Z",
+//         "busy": 1,
+//         "executing": [{"id": "...", "type": "start_flow_batch", "host": "mr1", "queued_on": "...", "started_on": "..."}]
+//       },
+//       "handler": {...}
+//     }
+//   }
+//
+type queuesResponse struct {
+	OrgID       models.OrgID               `json:"org_id"`
+	Maintenance bool                       `json:"maintenance"`
+	Queues      map[string]*queue.OrgQueue `json:"queues"`
+}
+
+// Returns the tasks queued and executing for the org passed as the org query parameter
+func handleQueues(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	orgID, err := strconv.Atoi(r.URL.Query().Get("org"))
+	if err != nil || orgID <= 0 {
+		return errors.Errorf("missing or invalid org parameter"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	maintenance, err := queue.InMaintenance(rc, orgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	response := &queuesResponse{OrgID: models.OrgID(orgID), Maintenance: maintenance, Queues: make(map[string]*queue.OrgQueue)}
+
+	for _, q := range []string{queue.HandlerQueue, queue.BatchQueue} {
+		summary, err := queue.InspectOrgQueue(rc, q, orgID, time.Now())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		response.Queues[q] = summary
+	}
+
+	return response, http.StatusOK, nil
+}
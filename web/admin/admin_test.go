@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/utils/logx"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmCache(t *testing.T) {
+	testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// org 2 has handled more tasks than org 1 today
+	for _, orgID := range []int{1, 2, 2} {
+		require.NoError(t, queue.RecordActivity(rc, orgID, time.Now()))
+	}
+
+	web.RunWebTests(t, "testdata/warm_cache.json", nil)
+}
+
+func TestLogLevels(t *testing.T) {
+	testsuite.Reset()
+
+	logx.Module("test_module")
+
+	web.RunWebTests(t, "testdata/log_levels.json", nil)
+}
+
+func TestParkedTasks(t *testing.T) {
+	testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	// org 1 is in maintenance with a parked task
+	require.NoError(t, queue.StartMaintenance(rc, 1))
+	_, err := rc.Do("zadd", "parked_tasks:batch:1", "1600000000.000000", `{"type":"start_flow","org_id":1,"task":{"flow_id":10000},"queued_on":"2020-09-13T12:26:40Z"}`)
+	require.NoError(t, err)
+
+	web.RunWebTests(t, "testdata/parked_tasks.json", nil)
+}
+
+func TestQueues(t *testing.T) {
+	testsuite.Reset()
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	defer testsuite.Reset()
+
+	// org 1 has two queued start tasks and one executing
+	for _, task := range []string{
+		`{"type":"start_flow","org_id":1,"task":{},"queued_on":"2021-06-23T15:30:00Z"}`,
+		`{"type":"start_flow","org_id":1,"task":{},"queued_on":"2021-06-23T15:35:00Z"}`,
+	} {
+		_, err := rc.Do("zadd", "batch:1", "1624462200.000000", task)
+		require.NoError(t, err)
+	}
+	_, err := rc.Do("zadd", "batch:active", 1, 1)
+	require.NoError(t, err)
+	_, err = rc.Do("zadd", "batch:executing:1", time.Now().Unix(), `{"id":"5f3ae2a6-3b4c-4e1c-8a3b-3b2f5c1f2e11","type":"start_flow_batch","host":"mr1","queued_on":"2021-06-23T15:20:00Z","started_on":"2021-06-23T15:25:00Z"}`)
+	require.NoError(t, err)
+
+	web.RunWebTests(t, "testdata/queues.json", nil)
+}
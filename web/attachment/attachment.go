@@ -0,0 +1,118 @@
+package attachment
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/attachment/upload_url", web.RequireAuthOrUserToken(handleUploadURL))
+}
+
+// how long clients have to use an upload URL
+const uploadURLExpiry = 15 * time.Minute
+
+// the extensions of uploaded files which we keep
+var validExtension = regexp.MustCompile(`^\.[a-zA-Z0-9]{1,10}$`)
+
+// Request for a URL which a client like the simulator or surveyor can use to upload an attachment directly to media
+// storage, rather than sending its contents via RapidPro. Requests made with an API token don't need an org_id.
+//
+//   {
+//     "org_id": 1,
+//     "filename": "selfie.jpg",
+//     "content_type": "image/jpeg"
+//   }
+//
+// Response is the URL to PUT the attachment to with the given headers before it expires, and the URL and attachment
+// which it can be referred to by once uploaded.
+//
+//   {
+//     "upload_url": "https://mailroom-media.s3.amazonaws.com/media/1/6683/83ba/668383ba-387c-49bc-b164-1213ac0ea7aa.jpg?X-Amz-Algorithm=...",
+//     "upload_headers": {"Content-Type": "image/jpeg", "x-amz-acl": "public-read"},
+//     "expires_on": "2021-06-15T13:45:00.000000Z",
+//     "url": "https://mailroom-media.s3.amazonaws.com/media/1/6683/83ba/668383ba-387c-49bc-b164-1213ac0ea7aa.jpg",
+//     "attachment": "image/jpeg:https://mailroom-media.s3.amazonaws.com/media/1/6683/83ba/668383ba-387c-49bc-b164-1213ac0ea7aa.jpg"
+//   }
+//
+type uploadURLRequest struct {
+	OrgID       models.OrgID `json:"org_id"`
+	Filename    string       `json:"filename"     validate:"max=255"`
+	ContentType string       `json:"content_type" validate:"required,max=255"`
+}
+
+type uploadURLResponse struct {
+	UploadURL     string            `json:"upload_url"`
+	UploadHeaders map[string]string `json:"upload_headers"`
+	ExpiresOn     time.Time         `json:"expires_on"`
+	URL           string            `json:"url"`
+	Attachment    utils.Attachment  `json:"attachment"`
+}
+
+// handles a request for an attachment upload URL
+func handleUploadURL(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &uploadURLRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// requests made with API tokens are always for the token's org
+	if orgID, hasOrg := ctx.Value(web.OrgIDKey).(models.OrgID); hasOrg {
+		request.OrgID = orgID
+	}
+	if request.OrgID == models.NilOrgID {
+		return errors.New("request failed validation: field 'org_id' is required"), http.StatusBadRequest, nil
+	}
+
+	contentType, _, err := mime.ParseMediaType(request.ContentType)
+	if err != nil || !strings.Contains(contentType, "/") {
+		return errors.Errorf("invalid content type: %s", request.ContentType), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	uploader := rt.MediaUploaderFor(oa.Org().Region())
+	if uploader == nil {
+		return errors.New("media storage doesn't support direct uploads"), http.StatusBadRequest, nil
+	}
+
+	// attachments are always given new names in the org's media path so clients can't overwrite other files
+	filename := string(uuids.New())
+	if ext := filepath.Ext(request.Filename); validExtension.MatchString(ext) {
+		filename += strings.ToLower(ext)
+	}
+	path := oa.Org().AttachmentPath(filename)
+
+	uploadURL, headers, err := uploader.PresignUpload(path, contentType, uploadURLExpiry)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error creating upload URL")
+	}
+
+	// the URL of the attachment once uploaded is the upload URL without the signature
+	url := strings.SplitN(uploadURL, "?", 2)[0]
+
+	return &uploadURLResponse{
+		UploadURL:     uploadURL,
+		UploadHeaders: headers,
+		ExpiresOn:     dates.Now().Add(uploadURLExpiry),
+		URL:           url,
+		Attachment:    utils.Attachment(contentType + ":" + url),
+	}, http.StatusOK, nil
+}
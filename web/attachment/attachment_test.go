@@ -0,0 +1,82 @@
+package attachment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testUploader struct{}
+
+func (u *testUploader) PresignUpload(path, contentType string, expires time.Duration) (string, map[string]string, error) {
+	return fmt.Sprintf("https://media.example.com%s?expires=%d", path, int(expires/time.Second)), map[string]string{"Content-Type": contentType}, nil
+}
+
+func TestUploadURL(t *testing.T) {
+	ctx, _, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	defer dates.SetNowSource(dates.DefaultNowSource)
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2021, 6, 15, 13, 30, 0, 0, time.UTC)))
+
+	rt := testsuite.RT()
+
+	uploadURL := func(body string) (interface{}, int) {
+		value, status, err := handleUploadURL(ctx, rt, httptest.NewRequest(http.MethodPost, "/mr/attachment/upload_url", strings.NewReader(body)))
+		require.NoError(t, err)
+		return value, status
+	}
+
+	// our test storage doesn't support direct uploads
+	value, status := uploadURL(`{"org_id": 1, "filename": "selfie.jpg", "content_type": "image/jpeg"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.EqualError(t, value.(error), "media storage doesn't support direct uploads")
+
+	rt.MediaUploader = &testUploader{}
+
+	value, status = uploadURL(`{"org_id": 1, "filename": "selfie.JPG", "content_type": "image/jpeg"}`)
+	require.Equal(t, http.StatusOK, status)
+
+	response := value.(*uploadURLResponse)
+	assert.Regexp(t, `^https://media\.example\.com/media/1/[0-9a-f]{4}/[0-9a-f\-]{4}/[0-9a-f\-]{36}\.jpg$`, response.URL)
+	assert.Equal(t, response.URL+"?expires=900", response.UploadURL)
+	assert.Equal(t, map[string]string{"Content-Type": "image/jpeg"}, response.UploadHeaders)
+	assert.Equal(t, time.Date(2021, 6, 15, 13, 45, 0, 0, time.UTC), response.ExpiresOn)
+	assert.Equal(t, utils.Attachment("image/jpeg:"+response.URL), response.Attachment)
+
+	// each upload gets a new path
+	value, _ = uploadURL(`{"org_id": 1, "filename": "selfie.JPG", "content_type": "image/jpeg"}`)
+	assert.NotEqual(t, response.URL, value.(*uploadURLResponse).URL)
+
+	// extensions which could be used to break out of the org's path are dropped
+	value, status = uploadURL(`{"org_id": 1, "filename": "../../evil/", "content_type": "text/plain; charset=utf-8"}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.Regexp(t, `^text/plain:https://media\.example\.com/media/1/[0-9a-f]{4}/[0-9a-f\-]{4}/[0-9a-f\-]{36}$`, string(value.(*uploadURLResponse).Attachment))
+
+	value, status = uploadURL(`{"org_id": 1, "content_type": "jpeg"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.EqualError(t, value.(error), "invalid content type: jpeg")
+
+	value, status = uploadURL(`{"content_type": "image/jpeg"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.EqualError(t, value.(error), "request failed validation: field 'org_id' is required")
+
+	// requests made with API tokens use the token's org
+	ctx = context.WithValue(ctx, web.OrgIDKey, models.OrgID(1))
+	value, status = uploadURL(`{"content_type": "image/jpeg"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, value.(*uploadURLResponse).URL, "/media/1/")
+}
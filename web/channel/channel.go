@@ -0,0 +1,56 @@
+package channel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/sessions"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/channel/interrupt", web.RequireAuthToken(handleInterrupt))
+}
+
+// Request to interrupt all the sessions waiting on a channel, e.g. because it has been deleted. Our cached values for the
+// channel are also cleared so that it stops receiving IVR callbacks.
+//
+//   {
+//     "org_id": 1,
+//     "channel_id": 123
+//   }
+//
+type interruptRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ChannelID models.ChannelID `json:"channel_id" validate:"required"`
+}
+
+// handles a request to interrupt the sessions of a channel, the actual interrupting is done by a batch task
+func handleInterrupt(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &interruptRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	if err := models.ClearCachedChannel(ctx, rt.DB, rt.RP, request.ChannelID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	task := &sessions.InterruptByChannelTask{ChannelID: request.ChannelID}
+
+	err := queue.AddTask(rc, queue.BatchQueue, sessions.TypeInterruptByChannel, int(request.OrgID), task, queue.HighPriority)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing interrupt task for channel: %d", request.ChannelID)
+	}
+
+	return map[string]interface{}{"channel_id": request.ChannelID}, http.StatusOK, nil
+}
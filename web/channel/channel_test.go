@@ -0,0 +1,44 @@
+package channel_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/sessions"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	defer testsuite.Reset()
+
+	// look up the org of the channel so that it's cached, then release it
+	orgID, err := models.OrgIDForChannelUUID(ctx, db, rp, testdata.TwilioChannel.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, testdata.Org1.ID, orgID)
+
+	db.MustExec(`UPDATE channels_channel SET is_active = FALSE WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	web.RunWebTests(t, "testdata/interrupt.json", nil)
+
+	// the cached org of the channel was cleared so it's no longer found
+	_, err = models.OrgIDForChannelUUID(ctx, db, rp, testdata.TwilioChannel.UUID)
+	assert.Error(t, err)
+
+	rc := testsuite.RC()
+	defer rc.Close()
+
+	// check the interrupt task was queued
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, sessions.TypeInterruptByChannel, task.Type)
+	assert.Equal(t, 1, task.OrgID)
+	assert.JSONEq(t, `{"channel_id": 10000}`, string(task.Task))
+}
@@ -20,6 +20,8 @@ func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/create", web.RequireAuthToken(handleCreate))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify", web.RequireAuthToken(handleModify))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/resolve", web.RequireAuthToken(handleResolve))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/change_status", web.RequireAuthToken(handleChangeStatus))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/deleted", web.RequireAuthToken(handleDeleted))
 }
 
 // Request to create a new contact.
@@ -55,6 +57,25 @@ func handleCreate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
+	// if org has a lookup service, validate and normalize any phone numbers
+	httpClient, httpRetries, _ := goflow.HTTP(rt.Config)
+
+	lookupSvc, err := oa.Org().LookupService(httpClient, httpRetries)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to create lookup service")
+	}
+	if lookupSvc != nil {
+		logger := &models.HTTPLogger{}
+		specErrors := models.LookupContactSpecs(oa, lookupSvc, []*models.ContactSpec{request.Contact}, logger.PhoneLookup(oa.OrgID()))
+
+		if err := logger.Insert(ctx, rt.DB); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error writing HTTP logs")
+		}
+		if len(specErrors[0]) > 0 {
+			return errors.New(specErrors[0][0]), http.StatusBadRequest, nil
+		}
+	}
+
 	c, err := SpecToCreation(request.Contact, oa.Env(), oa.SessionAssets())
 	if err != nil {
 		return err, http.StatusBadRequest, nil
@@ -71,6 +92,13 @@ func handleCreate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrap(err, "error modifying new contact")
 	}
 
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := models.RecordContactChanges(rc, oa, []*models.ContactChange{models.NewContactChange(models.ContactChangeTypeCreated, contact.UUID(), nil)}); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error recording contact creation")
+	}
+
 	return map[string]interface{}{"contact": contact}, http.StatusOK, nil
 }
 
@@ -203,6 +231,15 @@ func handleResolve(ctx context.Context, rt *runtime.Runtime, r *http.Request) (i
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error getting or creating contact")
 	}
 
+	if created {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		if err := models.RecordContactChanges(rc, oa, []*models.ContactChange{models.NewContactChange(models.ContactChangeTypeCreated, contact.UUID(), nil)}); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrap(err, "error recording contact creation")
+		}
+	}
+
 	// find the URN on the contact
 	urn := request.URN.Normalize(string(oa.Env().DefaultCountry()))
 	for _, u := range contact.URNs() {
@@ -221,3 +258,92 @@ func handleResolve(ctx context.Context, rt *runtime.Runtime, r *http.Request) (i
 		"created": created,
 	}, http.StatusOK, nil
 }
+
+// Request that the status of a set of contacts is changed. Contacts who become blocked, stopped or archived have their
+// waiting sessions interrupted.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 1,
+//     "contact_ids": [15,235],
+//     "status": "archived"
+//   }
+//
+type changeStatusRequest struct {
+	OrgID      models.OrgID        `json:"org_id"       validate:"required"`
+	UserID     models.UserID       `json:"user_id"`
+	ContactIDs []models.ContactID  `json:"contact_ids"  validate:"required"`
+	Status     flows.ContactStatus `json:"status"       validate:"required,oneof=active blocked stopped archived"`
+}
+
+// handles a request to change the status of the passed in contacts
+func handleChangeStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &changeStatusRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// grab our org assets
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, request.ContactIDs)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.Wrapf(err, "unable to load contacts")
+	}
+
+	eventsByContact, err := models.ChangeContactStatuses(ctx, rt.DB, rt.RP, oa, request.UserID, contacts, request.Status)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error changing contact statuses")
+	}
+
+	// create our results
+	results := make(map[flows.ContactID]modifyResult, len(contacts))
+	for flowContact, events := range eventsByContact {
+		results[flowContact.ID()] = modifyResult{Contact: flowContact, Events: events}
+	}
+
+	return results, http.StatusOK, nil
+}
+
+// Request to record that contacts have been deleted, so that their deletion can be delivered to the org's contact
+// webhook along with changes made by mailroom.
+//
+//   {
+//     "org_id": 1,
+//     "contact_uuids": ["6393abc0-283d-4c9b-a1b3-641a035c34bf"]
+//   }
+//
+type deletedRequest struct {
+	OrgID        models.OrgID        `json:"org_id"        validate:"required"`
+	ContactUUIDs []flows.ContactUUID `json:"contact_uuids" validate:"required"`
+}
+
+// handles a request to record the deletion of the passed in contacts
+func handleDeleted(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &deletedRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	changes := make([]*models.ContactChange, len(request.ContactUUIDs))
+	for i, uuid := range request.ContactUUIDs {
+		changes[i] = models.NewContactChange(models.ContactChangeTypeDeleted, uuid, nil)
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := models.RecordContactChanges(rc, oa, changes); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error recording contact deletions")
+	}
+
+	return map[string]interface{}{"contact_uuids": request.ContactUUIDs}, http.StatusOK, nil
+}
@@ -54,6 +54,30 @@ func TestModifyContacts(t *testing.T) {
 	models.FlushCache()
 }
 
+func TestChangeContactStatus(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/change_status.json", nil)
+}
+
+func TestEvaluateContacts(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/evaluate.json", nil)
+}
+
+func TestPreviewImport(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/preview_import.json", nil)
+}
+
+func TestPreviewImportFile(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/preview_import_file.json", nil)
+}
+
 func TestResolveContacts(t *testing.T) {
 	testsuite.Reset()
 	db := testsuite.DB()
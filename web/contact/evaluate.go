@@ -0,0 +1,94 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/evaluate", web.RequireAuthToken(handleEvaluate))
+}
+
+// Request to evaluate a contact query against a small set of contacts. Unlike searches, the query is evaluated against
+// the contacts as they are in the database rather than in elastic, so results always reflect their latest changes. Only
+// said conditions use elastic, as they're evaluated against the messages index.
+//
+//   {
+//     "org_id": 1,
+//     "query": "age > 10 AND gender = F",
+//     "contact_ids": [12345, 23456]
+//   }
+//
+// Returns the normalized query and which of the contacts match it, e.g.
+//
+//   {
+//     "query": "age > 10 AND gender = \"F\"",
+//     "matches": [23456]
+//   }
+//
+type evaluateRequest struct {
+	OrgID      models.OrgID       `json:"org_id"      validate:"required"`
+	Query      string             `json:"query"       validate:"required"`
+	ContactIDs []models.ContactID `json:"contact_ids" validate:"required,max=1000"`
+}
+
+// handles a request to evaluate a query against a set of contacts
+func handleEvaluate(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &evaluateRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// grab our org assets, refreshing fields and groups so new ones can be used in queries right away
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	parsed, err := models.ParseQuery(oa, request.Query)
+	if err != nil {
+		isQueryError, qerr := models.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, request.ContactIDs)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load contacts")
+	}
+
+	matched, err := models.EvaluateQuery(ctx, rt.DB, rt.ES, oa, parsed, contacts)
+	if err != nil {
+		isQueryError, qerr := models.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error evaluating query")
+	}
+
+	// return matches in the order they were requested
+	isMatch := make(map[models.ContactID]bool, len(matched))
+	for _, id := range matched {
+		isMatch[id] = true
+	}
+	matches := make([]models.ContactID, 0, len(matched))
+	for _, id := range request.ContactIDs {
+		if isMatch[id] {
+			matches = append(matches, id)
+			delete(isMatch, id)
+		}
+	}
+
+	normalized := parsed.String()
+
+	return map[string]interface{}{"query": normalized, "matches": matches}, http.StatusOK, nil
+}
@@ -0,0 +1,133 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/imports"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/preview_import", web.RequireAuthToken(handlePreviewImport))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/import/preview", web.RequireAuthToken(handlePreviewImportFile))
+}
+
+// Request to preview the import of some contacts, without creating or updating any of them.
+//
+//   {
+//     "org_id": 1,
+//     "specs": [
+//       {"name": "Joe Blow", "urns": ["tel:+250788123123"], "fields": {"age": "39"}},
+//       {"uuid": "559d4cf7-8ed3-43db-9bbb-2be85345f87e", "language": "eng"}
+//     ]
+//   }
+//
+// Response is the number of contacts which would be created, updated, skipped or errored, and any errors by record.
+//
+//   {
+//     "num_created": 1,
+//     "num_updated": 0,
+//     "num_skipped": 0,
+//     "num_errored": 1,
+//     "errors": [{"record": 1, "message": "Unable to find contact with UUID '559d4cf7-8ed3-43db-9bbb-2be85345f87e'"}]
+//   }
+//
+type previewImportRequest struct {
+	OrgID models.OrgID          `json:"org_id"  validate:"required"`
+	Specs []*models.ContactSpec `json:"specs"   validate:"required"`
+}
+
+// handles a request to preview a contact import
+func handlePreviewImport(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &previewImportRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	results, err := models.PreviewContactImport(ctx, rt.DB, oa, request.Specs, 0)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return results, http.StatusOK, nil
+}
+
+// Request to preview the import of a CSV or XLSX file, posted as a multipart form with the file as "file".
+//
+//   {
+//     "org_id": 1
+//   }
+//
+// Response is the proposed mapping of each column, with a suggested new field for columns which would be ignored,
+// the first few records as they are in the file, and what importing all the records would do. Errors are by record,
+// counting from zero.
+//
+//   {
+//     "columns": [
+//       {"header": "UUID", "type": "uuid"},
+//       {"header": "Phone", "type": "urn", "scheme": "tel"},
+//       {"header": "Field:Age", "type": "field", "field_key": "age", "field_name": "Age"},
+//       {"header": "Nickname", "type": "ignore", "suggested": {"header": "Nickname", "type": "field", "field_key": "nickname", "field_name": "Nickname", "new_field": true}}
+//     ],
+//     "sample": [["", "+250788123123", "39", "Joe"], ["559d4cf7-8ed3-43db-9bbb-2be85345f87e", "", "", "Jo"]],
+//     "num_records": 2,
+//     "num_created": 1,
+//     "num_updated": 0,
+//     "num_errored": 1,
+//     "errors": [{"record": 1, "message": "Unable to find contact with UUID '559d4cf7-8ed3-43db-9bbb-2be85345f87e'"}]
+//   }
+//
+type previewImportFileForm struct {
+	OrgID models.OrgID `form:"org_id" validate:"required"`
+}
+
+// handles a request to preview the import of a file
+func handlePreviewImportFile(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	form := &previewImportFileForm{}
+	if err := web.DecodeAndValidateForm(form, r); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return errors.Wrapf(err, "missing import file on request"), http.StatusBadRequest, nil
+	}
+	defer file.Close()
+
+	format := imports.Format(strings.ToLower(strings.TrimPrefix(filepath.Ext(header.Filename), ".")))
+
+	reader, err := imports.NewReader(file, header.Size, format)
+	if err != nil {
+		return errors.Wrapf(err, "invalid import file"), http.StatusBadRequest, nil
+	}
+	defer reader.Close()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, form.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	preview, err := imports.PreviewFile(ctx, rt.DB, oa, reader)
+	if err != nil {
+		isFileError, ferr := imports.IsFileError(err)
+		if isFileError {
+			return errors.Wrapf(ferr, "invalid import file"), http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return preview, http.StatusOK, nil
+}
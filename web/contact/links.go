@@ -0,0 +1,160 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/link_code", web.RequireAuthToken(handleLinkCode))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/linked", web.RequireAuthToken(handleLinked))
+}
+
+// Request for a code which a contact can send on another channel to be linked to the given contact. Orgs must have
+// link codes enabled in their identity linking config.
+//
+//   {
+//     "org_id": 1,
+//     "contact_id": 12345
+//   }
+//
+// Returns the code, e.g.
+//
+//   {
+//     "code": "7KQ2MX"
+//   }
+//
+type linkCodeRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id" validate:"required"`
+}
+
+// handles a request to generate a link code for a contact
+func handleLinkCode(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &linkCodeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	if linking := oa.Org().IdentityLinking(); linking == nil || !linking.LinkCodes {
+		return errors.New("org doesn't have link codes enabled"), http.StatusBadRequest, nil
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, []models.ContactID{request.ContactID})
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load contact")
+	}
+	if len(contacts) == 0 {
+		return errors.Errorf("no such contact: %d", request.ContactID), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	code, err := models.NewContactLinkCode(rc, oa.OrgID(), request.ContactID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"code": code}, http.StatusOK, nil
+}
+
+// Request for the other contacts which have been linked to a contact as the same person, for the linked identities
+// in the contact's history.
+//
+//   {
+//     "org_id": 1,
+//     "contact_id": 12345
+//   }
+//
+// Returns the linked contacts, e.g.
+//
+//   {
+//     "linked": [
+//       {
+//         "uuid": "6393abc0-283d-4c9b-a1b3-641a035c34bf",
+//         "name": "Bob",
+//         "urns": ["whatsapp:250788123123"],
+//         "method": "field",
+//         "linked_on": "2021-06-01T10:30:00.123456Z"
+//       }
+//     ]
+//   }
+//
+type linkedRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	ContactID models.ContactID `json:"contact_id" validate:"required"`
+}
+
+type linkedContact struct {
+	UUID     flows.ContactUUID        `json:"uuid"`
+	Name     string                   `json:"name"`
+	URNs     []urns.URN               `json:"urns"`
+	Method   models.ContactLinkMethod `json:"method"`
+	LinkedOn time.Time                `json:"linked_on"`
+}
+
+// handles a request to list the contacts linked to a contact
+func handleLinked(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &linkedRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	links, err := models.LoadContactLinks(ctx, rt.DB, oa.OrgID(), request.ContactID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	ids := make([]models.ContactID, len(links))
+	for i, l := range links {
+		ids[i] = l.ContactID
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, ids)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load linked contacts")
+	}
+	byID := make(map[models.ContactID]*models.Contact, len(contacts))
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+
+	linked := make([]*linkedContact, 0, len(links))
+	for _, l := range links {
+		c := byID[l.ContactID]
+		if c == nil {
+			continue
+		}
+
+		// only include the identities of URNs and not our internal URN ids and priorities
+		identities := make([]urns.URN, len(c.URNs()))
+		for i, u := range c.URNs() {
+			identities[i] = u.Identity()
+		}
+
+		linked = append(linked, &linkedContact{UUID: c.UUID(), Name: c.Name(), URNs: identities, Method: l.Method, LinkedOn: l.CreatedOn})
+	}
+
+	return map[string]interface{}{"linked": linked}, http.StatusOK, nil
+}
@@ -83,11 +83,11 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 	}
 
 	// perform our search
-	parsed, hits, total, err := models.ContactIDsForQueryPage(ctx, rt.ES, oa,
+	parsed, hits, total, err := models.ContactIDsForQueryPage(ctx, rt.DB, rt.ES, oa,
 		request.GroupUUID, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize)
 
 	if err != nil {
-		isQueryError, qerr := contactql.IsQueryError(err)
+		isQueryError, qerr := models.IsQueryError(err)
 		if isQueryError {
 			return qerr, http.StatusBadRequest, nil
 		}
@@ -102,7 +102,7 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 
 	if parsed != nil {
 		normalized = parsed.String()
-		metadata = contactql.Inspect(parsed)
+		metadata = models.InspectQuery(oa, parsed)
 		fields = append(fields, metadata.Attributes...)
 		for _, f := range metadata.Fields {
 			fields = append(fields, f.Key)
@@ -174,11 +174,9 @@ func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
 	}
 
-	env := oa.Env()
-	parsed, err := contactql.ParseQuery(env, request.Query, oa.SessionAssets())
-
+	parsed, err := models.ParseQuery(oa, request.Query)
 	if err != nil {
-		isQueryError, qerr := contactql.IsQueryError(err)
+		isQueryError, qerr := models.IsQueryError(err)
 		if isQueryError {
 			return qerr, http.StatusBadRequest, nil
 		}
@@ -193,7 +191,7 @@ func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 
 	if parsed != nil {
 		normalized = parsed.String()
-		metadata = contactql.Inspect(parsed)
+		metadata = models.InspectQuery(oa, parsed)
 		fields = append(fields, metadata.Attributes...)
 		for _, f := range metadata.Fields {
 			fields = append(fields, f.Key)
@@ -201,7 +199,17 @@ func handleParseQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request)
 		allowAsGroup = metadata.AllowAsGroup
 	}
 
-	eq := models.BuildElasticQuery(oa, request.GroupUUID, models.NilContactStatus, nil, parsed)
+	// conditions on messages are resolved to contacts when the query is compiled
+	compiled, err := models.ToElasticQuery(ctx, rt.DB, rt.ES, oa, parsed)
+	if err != nil {
+		isQueryError, qerr := models.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	eq := models.BuildElasticQuery(oa, request.GroupUUID, models.NilContactStatus, nil, compiled)
 	eqj, err := eq.Source()
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
@@ -15,6 +15,7 @@ import (
 	"github.com/nyaruka/mailroom/config"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
@@ -40,7 +41,7 @@ func TestSearch(t *testing.T) {
 	)
 	assert.NoError(t, err)
 
-	server := web.NewServer(ctx, config.Mailroom, db, rp, nil, client, wg)
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, ES: client, Config: config.Mailroom}, wg)
 	server.Start()
 
 	// give our server time to start
@@ -0,0 +1,181 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/event/receive", web.RequireAuthToken(handleReceive))
+}
+
+// Request from an external system to receive an event about a contact, who is referenced by UUID or URN. Each of the
+// org's event subscriptions which match the event start a flow for the contact with the params in @trigger.params.
+//
+//   {
+//     "org_id": 1,
+//     "event": "order.shipped",
+//     "contact_uuid": "6393abc0-283d-4c9b-a1b3-641a035c34bf",
+//     "urn": "tel:+16055741111",
+//     "params": {"order_id": "A123", "carrier": "DHL"},
+//     "idempotency_key": "ad2bc7b5-45cc-4bcb-b8b9-0e6e4b0a8f0e"
+//   }
+//
+// A request which is retried with the same idempotency key within 24 hours doesn't start any flows again, and gets the
+// response of the original request.
+type receiveRequest struct {
+	OrgID          models.OrgID           `json:"org_id"          validate:"required"`
+	Event          string                 `json:"event"           validate:"required"`
+	ContactUUID    flows.ContactUUID      `json:"contact_uuid"`
+	URN            urns.URN               `json:"urn"`
+	Params         map[string]interface{} `json:"params"`
+	IdempotencyKey string                 `json:"idempotency_key"`
+}
+
+// Response with the flows which will be started for the contact
+//
+//   {
+//     "flows": [{"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Shipping Update"}]
+//   }
+//
+type receiveResponse struct {
+	Flows []*assets.FlowReference `json:"flows"`
+}
+
+// handles a request to receive an event from an external system
+func handleReceive(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &receiveRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	if request.ContactUUID == "" && request.URN == urns.NilURN {
+		return errors.New("request must include a contact UUID or URN"), http.StatusBadRequest, nil
+	}
+	if request.ContactUUID == "" {
+		if err := request.URN.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid URN"), http.StatusBadRequest, nil
+		}
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	// claim the idempotency key before we create anything, returning the original response if this is a retry
+	if request.IdempotencyKey != "" {
+		original, replay, err := models.StartIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeEventReceive, request.IdempotencyKey)
+		if err == models.ErrIdempotentRequestInProgress {
+			return err, http.StatusConflict, nil
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if replay {
+			response := &receiveResponse{}
+			if err := json.Unmarshal([]byte(original), response); err != nil {
+				return nil, http.StatusInternalServerError, errors.Wrapf(err, "error unmarshaling original response")
+			}
+			return response, http.StatusOK, nil
+		}
+	}
+
+	response, status, err := receiveEvent(ctx, rt, rc, oa, request)
+
+	// the flows have been started so failing to record that would only lead to retries starting them again
+	if request.IdempotencyKey != "" {
+		var keyErr error
+		if status == http.StatusOK && err == nil {
+			original, _ := json.Marshal(response)
+			keyErr = models.CompleteIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeEventReceive, request.IdempotencyKey, string(original))
+		} else {
+			keyErr = models.AbandonIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeEventReceive, request.IdempotencyKey)
+		}
+		if keyErr != nil {
+			logrus.WithError(keyErr).WithField("idempotency_key", request.IdempotencyKey).Error("error updating idempotency key")
+		}
+	}
+
+	return response, status, err
+}
+
+// creates and queues the flow starts of the org's event subscriptions which match the received event
+func receiveEvent(ctx context.Context, rt *runtime.Runtime, rc redis.Conn, oa *models.OrgAssets, request *receiveRequest) (interface{}, int, error) {
+	var contactIDs []models.ContactID
+	var contactURNs []urns.URN
+	var err error
+
+	if request.ContactUUID != "" {
+		contactIDs, err = models.GetContactIDsFromReferences(ctx, rt.DB, oa.OrgID(), []*flows.ContactReference{flows.NewContactReference(request.ContactUUID, "")})
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error looking up contact")
+		}
+		if len(contactIDs) == 0 {
+			return errors.Errorf("no such contact with UUID '%s'", request.ContactUUID), http.StatusBadRequest, nil
+		}
+	} else {
+		contactURNs = []urns.URN{request.URN}
+	}
+
+	var extra json.RawMessage
+	if len(request.Params) > 0 {
+		if extra, err = json.Marshal(request.Params); err != nil {
+			return errors.Wrapf(err, "invalid event params"), http.StatusBadRequest, nil
+		}
+	}
+
+	started := make([]*assets.FlowReference, 0, 1)
+	starts := make([]*models.FlowStart, 0, 1)
+
+	for _, sub := range models.MatchEventSubscriptions(oa.Org(), request.Event, request.Params) {
+		// subscriptions to flows which have since been deleted are ignored
+		f, err := oa.Flow(sub.Flow.UUID)
+		if err == models.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		flow := f.(*models.Flow)
+
+		start := models.NewFlowStart(oa.OrgID(), models.StartTypeAPI, flow.FlowType(), flow.ID(), models.RestartParticipants(sub.RestartParticipants), models.DoIncludeActive).
+			WithContactIDs(contactIDs).
+			WithURNs(contactURNs).
+			WithCreateContact(len(contactURNs) > 0).
+			WithExtra(extra)
+
+		starts = append(starts, start)
+		started = append(started, flow.FlowReference())
+	}
+
+	if len(starts) > 0 {
+		if err := models.InsertFlowStarts(ctx, rt.DB, starts); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error inserting flow starts")
+		}
+
+		for _, start := range starts {
+			if err := queue.AddTracedTask(ctx, rc, queue.HandlerQueue, queue.StartFlow, int(oa.OrgID()), start, queue.DefaultPriority); err != nil {
+				return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing flow start")
+			}
+		}
+	}
+
+	return &receiveResponse{Flows: started}, http.StatusOK, nil
+}
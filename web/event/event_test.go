@@ -0,0 +1,24 @@
+package event_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestReceive(t *testing.T) {
+	_, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`UPDATE orgs_org SET config = '{"event_subscriptions": [
+		{"event": "order.shipped", "where": {"carrier": "DHL"}, "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Favorites"}},
+		{"event": "order.shipped", "flow": {"uuid": "5890fe3a-f204-4661-b74d-025be4ee019c", "name": "Pick a Number"}, "restart_participants": true},
+		{"event": "order.cancelled", "flow": {"uuid": "a1c8a48e-5ae4-4b5c-a33b-a5bb47ef6d4a", "name": "Deleted"}}
+	]}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	models.FlushCache()
+
+	web.RunWebTests(t, "testdata/receive.json", nil)
+}
@@ -11,4 +11,6 @@ func TestServer(t *testing.T) {
 	web.RunWebTests(t, "testdata/clone.json", nil)
 	web.RunWebTests(t, "testdata/inspect.json", nil)
 	web.RunWebTests(t, "testdata/migrate.json", nil)
+	web.RunWebTests(t, "testdata/regressions.json", nil)
+	web.RunWebTests(t, "testdata/test.json", nil)
 }
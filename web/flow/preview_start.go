@@ -0,0 +1,184 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// how long since a contact was last seen for them to be excluded as not seen recently
+const notSeenRecentlyDays = 90
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/preview_start", web.RequireAuthToken(handlePreviewStart))
+}
+
+// Previews a flow start, returning the query that its recipients would be found with, the estimated number of them and
+// a sample of them, without creating the start.
+//
+//   {
+//     "org_id": 1,
+//     "flow_id": 10001,
+//     "include": {
+//       "group_uuids": ["5fa925e4-edd8-4e2a-ab24-b3dbb5932ddd"],
+//       "contact_uuids": ["5b8a3c54-b3a7-4e8e-91c6-24c5d9e5df3e"],
+//       "query": "age > 20"
+//     },
+//     "exclude": {
+//       "non_active": true,
+//       "in_a_flow": true,
+//       "started_previously": true,
+//       "not_seen_recently": false
+//     },
+//     "sample_size": 5
+//   }
+//
+type previewStartRequest struct {
+	OrgID   models.OrgID  `json:"org_id"   validate:"required"`
+	FlowID  models.FlowID `json:"flow_id"  validate:"required"`
+	Include struct {
+		GroupUUIDs   []assets.GroupUUID  `json:"group_uuids"`
+		ContactUUIDs []flows.ContactUUID `json:"contact_uuids"`
+		Query        string              `json:"query"`
+	} `json:"include"`
+	Exclude struct {
+		NonActive         bool `json:"non_active"`
+		InAFlow           bool `json:"in_a_flow"`
+		StartedPreviously bool `json:"started_previously"`
+		NotSeenRecently   bool `json:"not_seen_recently"`
+	} `json:"exclude"`
+	SampleSize int `json:"sample_size"`
+}
+
+// Response for a flow start preview. Exclusions of non-active contacts and contacts in other flows are applied on top of
+// the returned query.
+//
+//   {
+//     "query": "(group = \"Testers\" OR age > 20) AND entered != \"Registration\"",
+//     "total": 567,
+//     "sample": [12, 34, 56, 78, 90],
+//     "metadata": {
+//       "fields": [{"key": "age", "name": "Age"}],
+//       "allow_as_group": false
+//     }
+//   }
+//
+type previewStartResponse struct {
+	Query    string                `json:"query"`
+	Total    int64                 `json:"total"`
+	Sample   []models.ContactID    `json:"sample"`
+	Metadata *contactql.Inspection `json:"metadata,omitempty"`
+}
+
+func handlePreviewStart(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &previewStartRequest{SampleSize: 5}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	flow, err := oa.FlowByID(request.FlowID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load flow: %d", request.FlowID), http.StatusBadRequest, nil
+	}
+
+	query, err := request.buildQuery(oa, flow)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	status := models.NilContactStatus
+	if request.Exclude.NonActive {
+		status = models.ContactStatusActive
+	}
+
+	var excludeIDs []models.ContactID
+	if request.Exclude.InAFlow {
+		excludeIDs, err = models.FindContactsWithActiveSessions(ctx, rt.DB, oa.OrgID(), flow.FlowType())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	parsed, sample, total, err := models.ContactIDsForQueryPageWithStatus(ctx, rt.DB, rt.ES, oa, "", status, excludeIDs, query, "-id", 0, request.SampleSize)
+	if err != nil {
+		isQueryError, qerr := models.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var metadata *contactql.Inspection
+	if parsed != nil {
+		metadata = models.InspectQuery(oa, parsed)
+	}
+
+	return &previewStartResponse{Query: query, Total: total, Sample: sample, Metadata: metadata}, http.StatusOK, nil
+}
+
+// builds the contact query which matches the included contacts which aren't excluded by the query itself
+func (r *previewStartRequest) buildQuery(oa *models.OrgAssets, flow *models.Flow) (string, error) {
+	inclusions := make([]string, 0, len(r.Include.GroupUUIDs)+len(r.Include.ContactUUIDs)+1)
+
+	for _, groupUUID := range r.Include.GroupUUIDs {
+		group := oa.GroupByUUID(groupUUID)
+		if group == nil {
+			return "", errors.Errorf("no such group with UUID: %s", groupUUID)
+		}
+		inclusions = append(inclusions, fmt.Sprintf("group = %s", quoteValue(group.Name())))
+	}
+	for _, contactUUID := range r.Include.ContactUUIDs {
+		inclusions = append(inclusions, fmt.Sprintf("uuid = %s", quoteValue(string(contactUUID))))
+	}
+	if query := strings.TrimSpace(r.Include.Query); query != "" {
+		if len(inclusions) > 0 {
+			query = "(" + query + ")"
+		}
+		inclusions = append(inclusions, query)
+	}
+
+	if len(inclusions) == 0 {
+		return "", errors.New("start must include at least one group, contact or query")
+	}
+
+	exclusions := make([]string, 0, 2)
+	if r.Exclude.StartedPreviously {
+		exclusions = append(exclusions, fmt.Sprintf("entered != %s", quoteValue(flow.Name())))
+	}
+	if r.Exclude.NotSeenRecently {
+		seenSince := dates.Now().AddDate(0, 0, -notSeenRecentlyDays)
+		exclusions = append(exclusions, fmt.Sprintf("last_seen_on > %s", quoteValue(seenSince.Format("2006-01-02"))))
+	}
+
+	query := strings.Join(inclusions, " OR ")
+	if len(exclusions) > 0 {
+		if len(inclusions) > 1 {
+			query = "(" + query + ")"
+		}
+		query = query + " AND " + strings.Join(exclusions, " AND ")
+	}
+
+	return query, nil
+}
+
+// quotes a value for use in a contact query
+func quoteValue(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
@@ -0,0 +1,148 @@
+package flow_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewStart(t *testing.T) {
+	ctx, db, rp := testsuite.Reset()
+	wg := &sync.WaitGroup{}
+
+	defer testsuite.Reset()
+	defer dates.SetNowSource(dates.DefaultNowSource)
+
+	dates.SetNowSource(dates.NewFixedNowSource(time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)))
+
+	es := testsuite.NewMockElasticServer()
+	defer es.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(es.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, ES: client, Config: config.Mailroom}, wg)
+	server.Start()
+
+	// give our server time to start
+	time.Sleep(time.Second)
+
+	defer server.Stop()
+
+	// put Bob in the middle of a flow
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.SessionStatusWaiting, nil)
+	db.MustExec(`UPDATE flows_flowsession SET current_flow_id = $2 WHERE id = $1`, sessionID, testdata.PickANumber.ID)
+
+	esResponse := fmt.Sprintf(`{
+		"_scroll_id": "DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAbgc0WS1hqbHlfb01SM2lLTWJRMnVOSVZDdw==",
+		"took": 2,
+		"timed_out": false,
+		"_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": {
+			"total": 2,
+			"max_score": null,
+			"hits": [
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124352]},
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124351]}
+			]
+		}
+	}`, testdata.George.ID, testdata.Cathy.ID)
+
+	tcs := []struct {
+		body           string
+		expectedStatus int
+		expectedError  string
+		expectedQuery  string
+		expectedSample []models.ContactID
+		expectedTotal  int64
+		expectedInES   []string
+	}{
+		{
+			body:           `{"org_id": 1, "flow_id": 10000}`,
+			expectedStatus: 400,
+			expectedError:  "start must include at least one group, contact or query",
+		},
+		{
+			body:           `{"org_id": 1, "flow_id": 10000, "include": {"group_uuids": ["8b7c8d2e-9a6f-4b1e-a2b3-3c4d5e6f7a8b"]}}`,
+			expectedStatus: 400,
+			expectedError:  "no such group with UUID: 8b7c8d2e-9a6f-4b1e-a2b3-3c4d5e6f7a8b",
+		},
+		{
+			body:           `{"org_id": 1, "flow_id": 10000, "include": {"query": "age > tomorrow"}}`,
+			expectedStatus: 400,
+			expectedError:  "can't convert 'tomorrow' to a number",
+		},
+		{
+			body:           fmt.Sprintf(`{"org_id": 1, "flow_id": 10000, "include": {"group_uuids": ["%s"]}}`, testdata.DoctorsGroup.UUID),
+			expectedStatus: 200,
+			expectedQuery:  `group = "Doctors"`,
+			expectedSample: []models.ContactID{testdata.George.ID, testdata.Cathy.ID},
+			expectedTotal:  2,
+		},
+		{
+			body: fmt.Sprintf(
+				`{"org_id": 1, "flow_id": 10000, "include": {"group_uuids": ["%s"], "contact_uuids": ["%s"], "query": "age > 20"}, "exclude": {"non_active": true, "in_a_flow": true, "started_previously": true, "not_seen_recently": true}}`,
+				testdata.DoctorsGroup.UUID, testdata.Cathy.UUID,
+			),
+			expectedStatus: 200,
+			expectedQuery:  fmt.Sprintf(`(group = "Doctors" OR uuid = "%s" OR (age > 20)) AND entered != "Favorites" AND last_seen_on > "2021-03-17"`, testdata.Cathy.UUID),
+			expectedSample: []models.ContactID{testdata.George.ID, testdata.Cathy.ID},
+			expectedTotal:  2,
+			expectedInES:   []string{`"status":"A"`, fmt.Sprintf(`"values":["%d"]`, testdata.Bob.ID)},
+		},
+	}
+
+	for i, tc := range tcs {
+		es.NextResponse = esResponse
+
+		resp, err := http.Post("http://localhost:8090/mr/flow/preview_start", "application/json", bytes.NewReader([]byte(tc.body)))
+		require.NoError(t, err, "%d: error making request", i)
+
+		content, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err, "%d: error reading body", i)
+
+		assert.Equal(t, tc.expectedStatus, resp.StatusCode, "%d: unexpected status", i)
+
+		if resp.StatusCode == 200 {
+			r := &struct {
+				Query  string             `json:"query"`
+				Total  int64              `json:"total"`
+				Sample []models.ContactID `json:"sample"`
+			}{}
+			require.NoError(t, json.Unmarshal(content, r), "%d: error unmarshaling response", i)
+
+			assert.Equal(t, tc.expectedQuery, r.Query, "%d: query mismatch", i)
+			assert.Equal(t, tc.expectedTotal, r.Total, "%d: total mismatch", i)
+			assert.Equal(t, tc.expectedSample, r.Sample, "%d: sample mismatch", i)
+
+			for _, s := range tc.expectedInES {
+				assert.Contains(t, es.LastBody, s, "%d: elastic request mismatch", i)
+			}
+		} else {
+			r := &web.ErrorResponse{}
+			require.NoError(t, json.Unmarshal(content, r), "%d: error unmarshaling error response", i)
+			assert.Equal(t, tc.expectedError, r.Error, "%d: error mismatch", i)
+		}
+	}
+}
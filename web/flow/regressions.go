@@ -0,0 +1,121 @@
+package flow
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/regressions"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/regressions/run", web.RequireAuthToken(handleRunRegressions))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/regressions", web.RequireAuthToken(handleRegressions))
+}
+
+// Request to replay the recent completed sessions of flows against their current definitions and report any whose
+// messages differ from what was originally sent. Limit is the number of sessions per flow and defaults to 100.
+//
+//   {
+//     "org_id": 1,
+//     "flow_ids": [12, 13],
+//     "limit": 200
+//   }
+//
+type runRegressionsRequest struct {
+	OrgID   models.OrgID    `json:"org_id"   validate:"required"`
+	FlowIDs []models.FlowID `json:"flow_ids" validate:"required,min=1"`
+	Limit   int             `json:"limit"    validate:"omitempty,min=1,max=1000"`
+}
+
+// handles a request to check flows for regressions, the actual replaying is done by a batch task
+func handleRunRegressions(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &runRegressionsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	task := &regressions.RunFlowRegressionsTask{FlowIDs: request.FlowIDs, Limit: request.Limit}
+
+	err := queue.AddTask(rc, queue.BatchQueue, regressions.TypeRunFlowRegressions, int(request.OrgID), task, queue.LowPriority)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing regressions task")
+	}
+
+	return map[string]interface{}{"flow_ids": request.FlowIDs}, http.StatusOK, nil
+}
+
+// Request for the regression reports of a flow, most recent first.
+//
+//   {
+//     "org_id": 1,
+//     "flow_id": 12
+//   }
+//
+// Response is the saved reports, each of which includes the mailroom version and flow revision it was run with, so
+// that a new regression can be traced to an upgrade or an edit of the flow.
+//
+//   {
+//     "reports": [
+//       {
+//         "flow_id": 12,
+//         "flow_uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85",
+//         "flow_revision": 3,
+//         "version": "6.5.0",
+//         "spec_version": "13.1.0",
+//         "created_on": "2021-06-01T10:00:00Z",
+//         "replayed": 2,
+//         "skipped": 0,
+//         "passed": 1,
+//         "regressions": [
+//           {
+//             "session_uuid": "f8a6e5c2-...",
+//             "inputs": ["red"],
+//             "expected": ["What is your favorite color?", "Good choice, I like Red too!"],
+//             "actual": ["What is your favorite color?", "I don't know that color"]
+//           }
+//         ]
+//       }
+//     ]
+//   }
+//
+type regressionsRequest struct {
+	OrgID  models.OrgID  `json:"org_id"  validate:"required"`
+	FlowID models.FlowID `json:"flow_id" validate:"required"`
+}
+
+func handleRegressions(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &regressionsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// check the flow belongs to this org
+	if _, err := oa.FlowByID(request.FlowID); err != nil {
+		return errors.Wrapf(err, "unable to load flow"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	reports, err := models.LoadFlowRegressionReports(rc, request.FlowID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"reports": reports}, http.StatusOK, nil
+}
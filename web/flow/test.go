@@ -0,0 +1,259 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/test", web.RequireAuthToken(handleTest))
+}
+
+// Runs a suite of test cases against a flow definition without saving anything. Each test case starts the flow for a
+// contact, sends it the given inputs in turn, and checks the messages sent, the final result values and status. The
+// contact is optional and defaults to a new contact with no fields.
+//
+//   {
+//     "org_id": 1,
+//     "flow": {"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "nodes": [...]},
+//     "tests": [
+//       {
+//         "name": "picks red",
+//         "contact": {"uuid": "...", "name": "Bob", "urns": ["tel:+250788123123"], ...},
+//         "inputs": ["red"],
+//         "messages": ["What is your favorite color?", "Good choice, I like Red too!"],
+//         "results": {"color": {"value": "red", "category": "Red"}},
+//         "status": "completed"
+//       }
+//     ]
+//   }
+//
+// Response is whether each test case passed and, for those that didn't, what failed.
+//
+//   {
+//     "passed": 0,
+//     "failed": 1,
+//     "tests": [
+//       {
+//         "name": "picks red",
+//         "passed": false,
+//         "failures": ["message 2: expected 'Good choice, I like Red too!', got 'I don't know that color'"],
+//         "messages": ["What is your favorite color?", "I don't know that color"],
+//         "results": {"color": {"value": "red", "category": "Other"}},
+//         "status": "waiting"
+//       }
+//     ]
+//   }
+//
+type testRequest struct {
+	OrgID models.OrgID    `json:"org_id" validate:"required"`
+	Flow  json.RawMessage `json:"flow"   validate:"required"`
+	Tests []*testCase     `json:"tests"  validate:"required,min=1,max=100,dive"`
+}
+
+type testCase struct {
+	Name     string                 `json:"name"     validate:"required"`
+	Contact  json.RawMessage        `json:"contact"`
+	Inputs   []string               `json:"inputs"`
+	Messages []string               `json:"messages"`
+	Results  map[string]*testResult `json:"results"`
+	Status   flows.SessionStatus    `json:"status"`
+}
+
+type testResult struct {
+	Value    *string `json:"value,omitempty"`
+	Category *string `json:"category,omitempty"`
+}
+
+type testCaseResult struct {
+	Name     string                 `json:"name"`
+	Passed   bool                   `json:"passed"`
+	Failures []string               `json:"failures"`
+	Messages []string               `json:"messages"`
+	Results  map[string]*testResult `json:"results"`
+	Status   flows.SessionStatus    `json:"status"`
+}
+
+type testResponse struct {
+	Passed int               `json:"passed"`
+	Failed int               `json:"failed"`
+	Tests  []*testCaseResult `json:"tests"`
+}
+
+func handleTest(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &testRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	flowDef, err := goflow.ReadFlow(rt.Config, request.Flow)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read flow"), http.StatusUnprocessableEntity, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	oa, err = oa.CloneForSimulation(ctx, rt.DB, map[assets.FlowUUID]json.RawMessage{flowDef.UUID(): request.Flow}, nil)
+	if err != nil {
+		return errors.Wrapf(err, "unable to clone org assets"), http.StatusBadRequest, nil
+	}
+
+	response := &testResponse{Tests: make([]*testCaseResult, len(request.Tests))}
+
+	for i, tc := range request.Tests {
+		result, err := runTestCase(rt, oa, flowDef.Reference(), tc)
+		if err != nil {
+			return errors.Wrapf(err, "error running test '%s'", tc.Name), http.StatusUnprocessableEntity, nil
+		}
+
+		response.Tests[i] = result
+		if result.Passed {
+			response.Passed++
+		} else {
+			response.Failed++
+		}
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// runs a single test case, returning what happened and how that differs from what was expected
+func runTestCase(rt *runtime.Runtime, oa *models.OrgAssets, flowRef *assets.FlowReference, tc *testCase) (*testCaseResult, error) {
+	sa := oa.SessionAssets()
+
+	contactJSON := tc.Contact
+	if len(contactJSON) == 0 {
+		contactJSON = []byte(fmt.Sprintf(`{"uuid": "%s", "name": "Test Contact", "created_on": "%s"}`, uuids.New(), dates.Now().Format(time.RFC3339)))
+	}
+	contact, err := flows.ReadContact(sa, contactJSON, assets.IgnoreMissing)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read contact")
+	}
+
+	var urn urns.URN
+	if len(contact.URNs()) > 0 {
+		urn = contact.URNs()[0].URN()
+	}
+
+	trigger := triggers.NewBuilder(oa.Env(), flowRef, contact).Manual().Build()
+
+	session, sprint, err := goflow.Simulator(rt.Config).NewSession(sa, trigger)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to start session")
+	}
+
+	result := &testCaseResult{Name: tc.Name, Failures: []string{}, Messages: []string{}, Results: map[string]*testResult{}}
+	result.Messages = append(result.Messages, sentMessages(sprint.Events())...)
+
+	for i, input := range tc.Inputs {
+		if session.Status() != flows.SessionStatusWaiting {
+			result.Failures = append(result.Failures, fmt.Sprintf("input %d: session is %s and can't take input", i+1, session.Status()))
+			break
+		}
+
+		msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), urn, nil, input, nil)
+		sprint, err := session.Resume(resumes.NewMsg(oa.Env(), session.Contact(), msg))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to resume session with input %d", i+1)
+		}
+		result.Messages = append(result.Messages, sentMessages(sprint.Events())...)
+	}
+
+	for _, run := range session.Runs() {
+		if run.FlowReference().UUID != flowRef.UUID {
+			continue
+		}
+		for key, r := range run.Results() {
+			value, category := r.Value, r.Category
+			result.Results[key] = &testResult{Value: &value, Category: &category}
+		}
+	}
+	result.Status = session.Status()
+
+	result.Failures = append(result.Failures, checkTestCase(tc, result)...)
+	result.Passed = len(result.Failures) == 0
+
+	return result, nil
+}
+
+// checks the outcome of a test case against what was expected, returning a description of each difference
+func checkTestCase(tc *testCase, actual *testCaseResult) []string {
+	failures := make([]string, 0)
+
+	if tc.Messages != nil {
+		for i, expected := range tc.Messages {
+			if i >= len(actual.Messages) {
+				failures = append(failures, fmt.Sprintf("message %d: expected '%s', got nothing", i+1, expected))
+			} else if strings.TrimSpace(actual.Messages[i]) != strings.TrimSpace(expected) {
+				failures = append(failures, fmt.Sprintf("message %d: expected '%s', got '%s'", i+1, expected, actual.Messages[i]))
+			}
+		}
+		for i := len(tc.Messages); i < len(actual.Messages); i++ {
+			failures = append(failures, fmt.Sprintf("message %d: expected nothing, got '%s'", i+1, actual.Messages[i]))
+		}
+	}
+
+	keys := make([]string, 0, len(tc.Results))
+	for key := range tc.Results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		expected, got := tc.Results[key], actual.Results[key]
+		if got == nil {
+			failures = append(failures, fmt.Sprintf("result '%s': expected a value, got nothing", key))
+			continue
+		}
+		if expected.Value != nil && *expected.Value != *got.Value {
+			failures = append(failures, fmt.Sprintf("result '%s': expected value '%s', got '%s'", key, *expected.Value, *got.Value))
+		}
+		if expected.Category != nil && *expected.Category != *got.Category {
+			failures = append(failures, fmt.Sprintf("result '%s': expected category '%s', got '%s'", key, *expected.Category, *got.Category))
+		}
+	}
+
+	if tc.Status != "" && tc.Status != actual.Status {
+		failures = append(failures, fmt.Sprintf("status: expected %s, got %s", tc.Status, actual.Status))
+	}
+
+	return failures
+}
+
+// gets the text of the messages sent to the contact in the passed in events
+func sentMessages(es []flows.Event) []string {
+	msgs := make([]string, 0)
+	for _, e := range es {
+		switch event := e.(type) {
+		case *events.MsgCreatedEvent:
+			msgs = append(msgs, event.Msg.Text())
+		case *events.IVRCreatedEvent:
+			msgs = append(msgs, event.Msg.Text())
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,130 @@
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/group/export", web.RequireAuthToken(handleExport))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/group/import", web.RequireAuthToken(handleImport))
+}
+
+// Request to export a snapshot of the membership of a group to a file in media storage. The snapshot includes the ids
+// and URNs of the group's contacts, so that it can be imported into a new group in this or another org.
+//
+//   {
+//     "org_id": 1,
+//     "group_uuid": "c153e265-f7c9-4539-9dbc-9b358714b638"
+//   }
+//
+// Returns the path and URL of the snapshot and how many contacts it contains, e.g.
+//
+//   {
+//     "path": "/media/group_snapshots/1/c153e265-f7c9-4539-9dbc-9b358714b638/20210601T103000Z.json",
+//     "url": "https://media.example.com/media/group_snapshots/1/c153e265-f7c9-4539-9dbc-9b358714b638/20210601T103000Z.json",
+//     "count": 2
+//   }
+//
+type exportRequest struct {
+	OrgID     models.OrgID     `json:"org_id"     validate:"required"`
+	GroupUUID assets.GroupUUID `json:"group_uuid" validate:"required"`
+}
+
+// handles a request to export a group membership snapshot
+func handleExport(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &exportRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshGroups)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	group := oa.GroupByUUID(request.GroupUUID)
+	if group == nil {
+		return errors.Errorf("no such group: %s", request.GroupUUID), http.StatusBadRequest, nil
+	}
+
+	snapshot, err := models.CreateGroupSnapshot(ctx, rt.DB, oa.OrgID(), group)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error marshalling group snapshot")
+	}
+
+	filename := path.Join(rt.Config.S3MediaPrefix, "group_snapshots", fmt.Sprint(oa.OrgID()), string(group.UUID()), snapshot.CreatedOn.UTC().Format("20060102T150405Z")+".json")
+
+	url, err := rt.MediaStorageFor(oa.Org().Region()).Put(ctx, filename, "application/json", data)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error storing group snapshot")
+	}
+
+	return map[string]interface{}{"path": filename, "url": url, "count": len(snapshot.Contacts)}, http.StatusOK, nil
+}
+
+// Request to import a group membership snapshot into a new static group. Contacts are matched by their ids if the
+// snapshot was exported from the same org, and by their URNs otherwise. Snapshots are read from the media storage of
+// the org's region so can only be copied between orgs in the same region.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 3,
+//     "name": "Doctors (Restored)",
+//     "snapshot_path": "/media/group_snapshots/1/c153e265-f7c9-4539-9dbc-9b358714b638/20210601T103000Z.json"
+//   }
+//
+// Returns the new group which will be populated in the background, e.g.
+//
+//   {
+//     "id": 10023,
+//     "uuid": "8f8e2cae-3c8d-4dce-9c4b-19514437e427"
+//   }
+//
+type importRequest struct {
+	OrgID        models.OrgID  `json:"org_id"        validate:"required"`
+	UserID       models.UserID `json:"user_id"       validate:"required"`
+	Name         string        `json:"name"          validate:"required,max=64"`
+	SnapshotPath string        `json:"snapshot_path" validate:"required"`
+}
+
+// handles a request to import a group membership snapshot
+func handleImport(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &importRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	groupID, groupUUID, err := models.CreateStaticGroup(ctx, rt.DB, request.OrgID, request.UserID, request.Name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	task := &contacts.ImportGroupSnapshotTask{GroupID: groupID, SnapshotPath: request.SnapshotPath}
+	if err := queue.AddTask(rc, queue.BatchQueue, contacts.TypeImportGroupSnapshot, int(request.OrgID), task, queue.DefaultPriority); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing task to import group snapshot")
+	}
+
+	return map[string]interface{}{"id": groupID, "uuid": groupUUID}, http.StatusOK, nil
+}
@@ -0,0 +1,120 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/idempotency/claim", web.RequireAuthToken(handleClaim))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/idempotency/complete", web.RequireAuthToken(handleComplete))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/idempotency/abandon", web.RequireAuthToken(handleAbandon))
+}
+
+type keyRequest struct {
+	OrgID          models.OrgID            `json:"org_id"          validate:"required"`
+	Scope          models.IdempotencyScope `json:"scope"           validate:"required,oneof=start broadcast"`
+	IdempotencyKey string                  `json:"idempotency_key" validate:"required"`
+}
+
+// Claims an idempotency key before RapidPro creates the flow start or broadcast it was given for. If the key was used
+// by a request which completed within the last 24 hours, the id of what it created is returned as `original_id` and
+// nothing should be created. Otherwise the key is held for 5 minutes, during which the creator must either complete
+// or abandon it, and retries get a 409.
+//
+//   {
+//     "org_id": 1,
+//     "scope": "start",
+//     "idempotency_key": "d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2"
+//   }
+//
+func handleClaim(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &keyRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	original, replay, err := models.StartIdempotentRequest(rc, request.OrgID, request.Scope, request.IdempotencyKey)
+	if err == models.ErrIdempotentRequestInProgress {
+		return err, http.StatusConflict, nil
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if replay {
+		originalID, err := strconv.ParseInt(original, 10, 64)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error parsing original id")
+		}
+		return map[string]interface{}{"claimed": false, "original_id": originalID}, http.StatusOK, nil
+	}
+
+	return map[string]interface{}{"claimed": true}, http.StatusOK, nil
+}
+
+type completeRequest struct {
+	keyRequest
+	ID int64 `json:"id" validate:"required"`
+}
+
+// Completes a claimed idempotency key with the id of the flow start or broadcast that was created, which is returned
+// to retries for 24 hours.
+//
+//   {
+//     "org_id": 1,
+//     "scope": "start",
+//     "idempotency_key": "d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2",
+//     "id": 1234
+//   }
+//
+func handleComplete(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &completeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	result := strconv.FormatInt(request.ID, 10)
+	if err := models.CompleteIdempotentRequest(rc, request.OrgID, request.Scope, request.IdempotencyKey, result); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"id": request.ID}, http.StatusOK, nil
+}
+
+// Releases a claimed idempotency key after creating the flow start or broadcast failed, so that it can be retried.
+//
+//   {
+//     "org_id": 1,
+//     "scope": "start",
+//     "idempotency_key": "d8b9ca22-5b1c-4a5c-8a0e-7cf7e8c9a4b2"
+//   }
+//
+func handleAbandon(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &keyRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := models.AbandonIdempotentRequest(rc, request.OrgID, request.Scope, request.IdempotencyKey); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{}, http.StatusOK, nil
+}
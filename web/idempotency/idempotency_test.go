@@ -0,0 +1,15 @@
+package idempotency_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestServer(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/claim.json", nil)
+}
@@ -73,7 +73,7 @@ func handleIncomingCall(ctx context.Context, rt *runtime.Runtime, r *http.Reques
 	channelUUID := assets.ChannelUUID(chi.URLParam(r, "uuid"))
 
 	// load the org id for this UUID (we could load the entire channel here but we want to take the same paths through everything else)
-	orgID, err := models.OrgIDForChannelUUID(ctx, rt.DB, channelUUID)
+	orgID, err := models.OrgIDForChannelUUID(ctx, rt.DB, rt.RP, channelUUID)
 	if err != nil {
 		return nil, nil, writeClientError(w, err)
 	}
@@ -91,7 +91,7 @@ func handleIncomingCall(ctx context.Context, rt *runtime.Runtime, r *http.Reques
 	}
 
 	// get the right kind of client
-	client, err := ivr.GetClient(channel)
+	client, err := ivr.GetClient(oa, channel)
 	if client == nil {
 		return channel, nil, writeClientError(w, errors.Wrapf(err, "unable to load client for channel: %s", channelUUID))
 	}
@@ -251,7 +251,7 @@ func handleFlow(ctx context.Context, rt *runtime.Runtime, r *http.Request, w htt
 	}
 
 	// get the right kind of client
-	client, err := ivr.GetClient(channel)
+	client, err := ivr.GetClient(oa, channel)
 	if client == nil {
 		return channel, conn, writeClientError(w, errors.Wrapf(err, "unable to load client for channel: %d", conn.ChannelID()))
 	}
@@ -336,7 +336,7 @@ func handleStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request, w h
 	channelUUID := assets.ChannelUUID(chi.URLParam(r, "uuid"))
 
 	// load the org id for this UUID (we could load the entire channel here but we want to take the same paths through everything else)
-	orgID, err := models.OrgIDForChannelUUID(ctx, rt.DB, channelUUID)
+	orgID, err := models.OrgIDForChannelUUID(ctx, rt.DB, rt.RP, channelUUID)
 	if err != nil {
 		return nil, nil, writeClientError(w, err)
 	}
@@ -354,7 +354,7 @@ func handleStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request, w h
 	}
 
 	// get the right kind of client
-	client, err := ivr.GetClient(channel)
+	client, err := ivr.GetClient(oa, channel)
 	if client == nil {
 		return channel, nil, writeClientError(w, errors.Wrapf(err, "unable to load client for channel: %s", channelUUID))
 	}
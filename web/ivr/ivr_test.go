@@ -16,6 +16,7 @@ import (
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/tasks/starts"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/web"
 	"github.com/sirupsen/logrus"
 
@@ -61,7 +62,7 @@ func TestTwilioIVR(t *testing.T) {
 	twiml.IgnoreSignatures = true
 
 	wg := &sync.WaitGroup{}
-	server := web.NewServer(ctx, config.Mailroom, db, rp, testsuite.MediaStorage(), nil, wg)
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, MediaStorage: testsuite.MediaStorage(), Config: config.Mailroom}, wg)
 	server.Start()
 	defer server.Stop()
 
@@ -397,7 +398,7 @@ func TestVonageIVR(t *testing.T) {
 	defer ts.Close()
 
 	wg := &sync.WaitGroup{}
-	server := web.NewServer(ctx, config.Mailroom, db, rp, testsuite.MediaStorage(), nil, wg)
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, MediaStorage: testsuite.MediaStorage(), Config: config.Mailroom}, wg)
 	server.Start()
 	defer server.Stop()
 
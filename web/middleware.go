@@ -8,8 +8,12 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/nyaruka/mailroom/utils/tracing"
+
+	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func requestLogger(next http.Handler) http.Handler {
@@ -41,6 +45,27 @@ func requestLogger(next http.Handler) http.Handler {
 	})
 }
 
+// wraps each request in a span which continues the trace of the caller if it sent a traceparent header, so that the
+// tasks it queues can be traced back to it
+func requestTracer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ctx, span := tracing.Start(tracing.ExtractHeaders(r.Context(), r.Header), r.Method+" "+r.URL.Path, attribute.String("http.method", r.Method))
+		defer span.End()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		// now that we've been routed, name our span by the route rather than the path which can contain ids
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+		}
+		span.SetAttributes(attribute.Int("http.status_code", ww.Status()))
+		if ww.Status() >= http.StatusInternalServerError {
+			tracing.RecordError(span, fmt.Errorf("request failed with status %d", ww.Status()))
+		}
+	})
+}
+
 // recovers from panics, logs them to sentry and returns an HTTP 500 response
 func panicRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,8 @@ package msg
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/utils"
@@ -16,6 +18,7 @@ import (
 
 func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/msg/resend", web.RequireAuthToken(handleResend))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/msg/search", web.RequireAuthToken(handleSearch))
 }
 
 // Request to resend failed messages.
@@ -62,3 +65,70 @@ func handleResend(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 	}
 	return map[string]interface{}{"msg_ids": resentMsgIDs}, http.StatusOK, nil
 }
+
+// Request to search the messages of an org, newest first. All filters are optional.
+//
+//   {
+//     "org_id": 1,
+//     "text": "vaccine",
+//     "direction": "I",
+//     "label_ids": [12, 13],
+//     "contact_ids": [10001],
+//     "after": "2021-06-01T00:00:00Z",
+//     "before": "2021-07-01T00:00:00Z",
+//     "cursor": "WzE2MjQzNzc1NTAwMDAsMTAwMF0",
+//     "page_size": 50
+//   }
+//
+type searchRequest struct {
+	OrgID      models.OrgID        `json:"org_id"      validate:"required"`
+	Text       string              `json:"text"`
+	Direction  models.MsgDirection `json:"direction"   validate:"omitempty,oneof=I O"`
+	LabelIDs   []models.LabelID    `json:"label_ids"`
+	ContactIDs []models.ContactID  `json:"contact_ids"`
+	After      *time.Time          `json:"after"`
+	Before     *time.Time          `json:"before"`
+	Cursor     string              `json:"cursor"`
+	PageSize   int                 `json:"page_size"   validate:"omitempty,min=1,max=500"`
+}
+
+// Response for a message search
+//
+//   {
+//     "msg_ids": [123456, 123455],
+//     "total": 12,
+//     "next_cursor": "WzE2MjQzNzc1NDAwMDAsMTIzNDU1XQ"
+//   }
+//
+type searchResponse struct {
+	MsgIDs     []models.MsgID `json:"msg_ids"`
+	Total      int64          `json:"total"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// handles a request to search messages
+func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &searchRequest{PageSize: 50}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	page, err := models.SearchMsgs(ctx, rt.ES, request.OrgID, &models.MsgSearch{
+		Text:       strings.TrimSpace(request.Text),
+		Direction:  request.Direction,
+		LabelIDs:   request.LabelIDs,
+		ContactIDs: request.ContactIDs,
+		After:      request.After,
+		Before:     request.Before,
+		Cursor:     request.Cursor,
+		PageSize:   request.PageSize,
+	})
+	if err == models.ErrInvalidCursor {
+		return err, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &searchResponse{MsgIDs: page.IDs, Total: page.Total, NextCursor: page.NextCursor}, http.StatusOK, nil
+}
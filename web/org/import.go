@@ -0,0 +1,102 @@
+package org
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/campaigns"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/org/import", web.RequireAuthToken(handleImport))
+}
+
+// Request to import a bundle of flows, campaigns and triggers exported from RapidPro. Everything in the bundle is
+// imported in a single transaction so if any part of it fails, nothing is imported.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 3,
+//     "bundle": {
+//       "version": "13",
+//       "fields": [{"key": "joined", "name": "Joined", "type": "datetime"}],
+//       "groups": [{"uuid": "c153e265-f7c9-4539-9dbc-9b358714b638", "name": "Doctors", "query": null}],
+//       "flows": [...],
+//       "campaigns": [...],
+//       "triggers": [...]
+//     }
+//   }
+//
+// Response is a report of what was done with each object in the bundle.
+//
+//   {
+//     "fields": [{"id": 8, "key": "joined", "name": "Joined", "action": "existing"}],
+//     "groups": [{"id": 10000, "uuid": "c153e265-f7c9-4539-9dbc-9b358714b638", "name": "Doctors", "action": "existing"}],
+//     "flows": [{"id": 10012, "uuid": "9ecc8e84-6b83-442b-a04a-8094d5de997b", "name": "Registration", "action": "created"}],
+//     "campaigns": [],
+//     "triggers": [{"id": 123, "type": "K", "keyword": "join", "action": "created"}],
+//     "archived_trigger_ids": [],
+//     "remapped_uuids": {}
+//   }
+//
+type importRequest struct {
+	OrgID  models.OrgID   `json:"org_id"  validate:"required"`
+	UserID models.UserID  `json:"user_id" validate:"required"`
+	Bundle *models.Bundle `json:"bundle"  validate:"required"`
+}
+
+// handles a request to import a bundle of flows, campaigns and triggers
+func handleImport(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &importRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// triggers are checked for conflicts so make sure we have the latest
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshTriggers)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error starting transaction")
+	}
+
+	report, err := models.ImportBundle(ctx, tx, rt.Config, oa, request.UserID, request.Bundle)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "import failed"), http.StatusBadRequest, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error committing import")
+	}
+
+	// now that everything is committed, queue tasks to populate new query based groups and schedule new campaign events
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	for groupID, query := range report.DynamicGroups {
+		task := &contacts.PopulateDynamicGroupTask{GroupID: groupID, Query: query}
+		if err := queue.AddTask(rc, queue.BatchQueue, contacts.TypePopulateDynamicGroup, int(request.OrgID), task, queue.DefaultPriority); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing task to populate group: %d", groupID)
+		}
+	}
+	for _, eventID := range report.EventIDs {
+		task := &campaigns.ScheduleCampaignEventTask{CampaignEventID: eventID}
+		if err := queue.AddTask(rc, queue.BatchQueue, campaigns.TypeScheduleCampaignEvent, int(request.OrgID), task, queue.DefaultPriority); err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing task to schedule campaign event: %d", eventID)
+		}
+	}
+
+	return report, http.StatusOK, nil
+}
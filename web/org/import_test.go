@@ -0,0 +1,20 @@
+package org_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestImport(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/import.json", map[string]string{
+		"age_id":     fmt.Sprint(testdata.AgeField.ID),
+		"doctors_id": fmt.Sprint(testdata.DoctorsGroup.ID),
+	})
+}
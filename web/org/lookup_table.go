@@ -0,0 +1,129 @@
+package org
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/services/external/tables"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// the maximum number of rows an uploaded lookup table can have
+const maxLookupTableRows = 50000
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/org/lookup_table", web.RequireAuthToken(handleLookupTable))
+}
+
+// Request to upload the rows of a CSV lookup table, replacing any existing rows. The first line of the CSV is the
+// header row and each row is stored as an object of column name to value, keyed by the value of the key column.
+//
+//   {
+//     "org_id": 1,
+//     "name": "clinics",
+//     "key_column": "code",
+//     "csv": "code,name,district\nKGL1,Kigali Central,Nyarugenge\n"
+//   }
+//
+// Response is the number of rows stored.
+//
+//   {
+//     "rows": 1
+//   }
+//
+type lookupTableRequest struct {
+	OrgID     models.OrgID `json:"org_id"     validate:"required"`
+	Name      string       `json:"name"       validate:"required,max=64"`
+	KeyColumn string       `json:"key_column" validate:"required"`
+	CSV       string       `json:"csv"        validate:"required"`
+}
+
+// handles a request to upload a CSV lookup table
+func handleLookupTable(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &lookupTableRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rows, err := parseLookupTableCSV(request.CSV, request.KeyColumn)
+	if err != nil {
+		return errors.Wrapf(err, "invalid CSV"), http.StatusBadRequest, nil
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error starting transaction")
+	}
+
+	if err := models.ReplaceLookupTableRows(ctx, tx, request.OrgID, request.Name, rows); err != nil {
+		tx.Rollback()
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error committing lookup table")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := tables.ClearCache(rc, request.OrgID, request.Name); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]int{"rows": len(rows)}, http.StatusOK, nil
+}
+
+// parses the given CSV into rows keyed by the value of the key column, later rows replacing earlier rows with the same key
+func parseLookupTableCSV(data, keyColumn string) (map[string]json.RawMessage, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("missing header row")
+	}
+	if len(records)-1 > maxLookupTableRows {
+		return nil, errors.Errorf("too many rows, limit is %d", maxLookupTableRows)
+	}
+
+	header := records[0]
+	keyIndex := -1
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if header[i] == keyColumn {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		return nil, errors.Errorf("no column named '%s'", keyColumn)
+	}
+
+	rows := make(map[string]json.RawMessage, len(records)-1)
+	for _, record := range records[1:] {
+		key := strings.TrimSpace(record[keyIndex])
+		if key == "" {
+			continue
+		}
+
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = strings.TrimSpace(record[i])
+		}
+
+		rows[key], err = json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
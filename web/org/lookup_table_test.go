@@ -0,0 +1,15 @@
+package org_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestLookupTable(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/lookup_table.json", nil)
+}
@@ -145,7 +145,73 @@ type channelStats struct {
 	Counts      map[string]int64
 }
 
-func calculateChannelCounts(ctx context.Context, rt *runtime.Runtime, org *models.OrgReference) (*dto.MetricFamily, error) {
+// counts the messages of test contacts by channel so that they can be excluded from our channel counts
+const testContactChannelCountsSQL = `
+SELECT
+  m.channel_id AS channel_id,
+  CONCAT(m.direction, CASE WHEN m.msg_type = 'V' THEN 'V' ELSE 'M' END) AS count_type,
+  COUNT(*) AS count
+FROM
+  msgs_msg m
+INNER JOIN
+  contacts_contactgroup_contacts gc
+ON
+  gc.contact_id = m.contact_id
+INNER JOIN
+  contacts_contactgroup g
+ON
+  g.id = gc.contactgroup_id
+WHERE
+  g.org_id = $1 AND
+  g.uuid = $2 AND
+  m.channel_id IS NOT NULL
+GROUP BY
+  (m.channel_id, count_type);
+`
+
+type testContactCountRow struct {
+	ChannelID models.ChannelID `db:"channel_id"`
+	CountType string           `db:"count_type"`
+	Count     int64            `db:"count"`
+}
+
+// calculateTestContactCounts calculates the number of messages of each count type by channel for the passed in test
+// contacts group
+func calculateTestContactCounts(ctx context.Context, rt *runtime.Runtime, org *models.OrgReference, testGroup assets.GroupUUID) (map[models.ChannelID]map[string]int64, error) {
+	counts := make(map[models.ChannelID]map[string]int64)
+	if testGroup == "" {
+		return counts, nil
+	}
+
+	rows, err := rt.DB.QueryxContext(ctx, testContactChannelCountsSQL, org.ID, testGroup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying test contact counts for org")
+	}
+	defer rows.Close()
+
+	row := &testContactCountRow{}
+	for rows.Next() {
+		err = rows.StructScan(row)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error scanning test contact count row")
+		}
+
+		if counts[row.ChannelID] == nil {
+			counts[row.ChannelID] = make(map[string]int64)
+		}
+		counts[row.ChannelID][row.CountType] = row.Count
+	}
+
+	return counts, nil
+}
+
+func calculateChannelCounts(ctx context.Context, rt *runtime.Runtime, org *models.OrgReference, testGroup assets.GroupUUID) (*dto.MetricFamily, error) {
+	// messages of test contacts are excluded from our counts
+	testCounts, err := calculateTestContactCounts(ctx, rt, org, testGroup)
+	if err != nil {
+		return nil, err
+	}
+
 	rows, err := rt.DB.QueryxContext(ctx, channelCountsSQL, org.ID)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error querying channel counts for org")
@@ -193,7 +259,7 @@ func calculateChannelCounts(ctx context.Context, rt *runtime.Runtime, org *model
 
 		// set our count if we have one and it isn't a channel log count
 		if row.CountType != nil {
-			channel.Counts[*row.CountType] = row.Count
+			channel.Counts[*row.CountType] = row.Count - testCounts[row.ID][*row.CountType]
 		}
 	}
 
@@ -287,7 +353,12 @@ func handleMetrics(ctx context.Context, rt *runtime.Runtime, r *http.Request, ra
 		return errors.Wrapf(err, "error calculating group counts for org: %d", org.ID)
 	}
 
-	channels, err := calculateChannelCounts(ctx, rt, org)
+	oa, err := models.GetOrgAssets(ctx, rt.DB, org.ID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets for org: %d", org.ID)
+	}
+
+	channels, err := calculateChannelCounts(ctx, rt, org, oa.Org().TestContactsGroup())
 	if err != nil {
 		return errors.Wrapf(err, "error calculating channel counts for org: %d", org.ID)
 	}
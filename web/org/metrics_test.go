@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
@@ -26,7 +27,7 @@ func TestMetrics(t *testing.T) {
 	db.MustExec(`INSERT INTO api_apitoken(is_active, org_id, created, key, role_id, user_id) VALUES(TRUE, $1, NOW(), $2, 8, 1);`, testdata.Org1.ID, adminToken)
 
 	wg := &sync.WaitGroup{}
-	server := web.NewServer(ctx, config.Mailroom, db, rp, nil, nil, wg)
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, Config: config.Mailroom}, wg)
 	server.Start()
 
 	// wait for the server to start
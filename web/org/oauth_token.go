@@ -0,0 +1,83 @@
+package org
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/org/oauth_token", web.RequireAuthToken(handleOAuthToken))
+}
+
+// Request to store an OAuth2 token for an org integration once the authorization flow has been completed. Tokens are
+// encrypted before they are stored and mailroom takes care of refreshing them before they expire.
+//
+//   {
+//     "org_id": 1,
+//     "integration": "ticketer:6c50665f-b4ff-4e37-9625-bc464fe6a999",
+//     "token_url": "https://oauth2.googleapis.com/token",
+//     "client_id": "1234",
+//     "client_secret": "sesame",
+//     "access_token": "ya29.a0AfH6SM",
+//     "refresh_token": "1//0gLN3",
+//     "expires_in": 3599
+//   }
+//
+// Response is the stored token without its secrets.
+//
+//   {
+//     "id": 1,
+//     "org_id": 1,
+//     "integration": "ticketer:6c50665f-b4ff-4e37-9625-bc464fe6a999",
+//     "token_url": "https://oauth2.googleapis.com/token",
+//     "client_id": "1234",
+//     "expires_on": "2021-06-15T13:30:00.000000Z"
+//   }
+//
+type oauthTokenRequest struct {
+	OrgID        models.OrgID `json:"org_id"        validate:"required"`
+	Integration  string       `json:"integration"   validate:"required,max=128"`
+	TokenURL     string       `json:"token_url"     validate:"required,url"`
+	ClientID     string       `json:"client_id"     validate:"required"`
+	ClientSecret string       `json:"client_secret"`
+	AccessToken  string       `json:"access_token"  validate:"required"`
+	RefreshToken string       `json:"refresh_token"`
+	ExpiresIn    int          `json:"expires_in"    validate:"min=0"`
+}
+
+// handles a request to store an OAuth2 token
+func handleOAuthToken(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &oauthTokenRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	token := &models.OAuthToken{
+		OrgID:        request.OrgID,
+		Integration:  request.Integration,
+		TokenURL:     request.TokenURL,
+		ClientID:     request.ClientID,
+		ClientSecret: request.ClientSecret,
+		AccessToken:  request.AccessToken,
+		RefreshToken: request.RefreshToken,
+	}
+	if request.ExpiresIn > 0 {
+		expiresOn := dates.Now().Add(time.Duration(request.ExpiresIn) * time.Second)
+		token.ExpiresOn = &expiresOn
+	}
+
+	if err := models.SaveOAuthToken(ctx, rt.DB, rt.Config, token); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error saving token")
+	}
+
+	return token, http.StatusOK, nil
+}
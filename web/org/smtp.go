@@ -0,0 +1,138 @@
+package org
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/org/smtp_settings", web.RequireAuthToken(handleSMTPSettings))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/org/verify_smtp", web.RequireAuthToken(handleVerifySMTP))
+}
+
+// Request to save an org's own SMTP settings which will be used to send emails from its flows. The password is
+// encrypted before it is stored. Omitting the settings removes them so that the org uses the global SMTP server.
+//
+//   {
+//     "org_id": 1,
+//     "settings": {
+//       "host": "smtp.example.com",
+//       "port": 587,
+//       "username": "bob",
+//       "password": "sesame",
+//       "from": "bob@example.com",
+//       "tls_mode": "starttls"
+//     }
+//   }
+//
+// Response is the saved settings without the password.
+//
+//   {
+//     "org_id": 1,
+//     "settings": {
+//       "host": "smtp.example.com",
+//       "port": 587,
+//       "username": "bob",
+//       "from": "bob@example.com",
+//       "tls_mode": "starttls"
+//     }
+//   }
+//
+type smtpSettingsRequest struct {
+	OrgID    models.OrgID         `json:"org_id"   validate:"required"`
+	Settings *models.SMTPSettings `json:"settings"`
+}
+
+type smtpSettingsResponse struct {
+	Host     string             `json:"host"`
+	Port     int                `json:"port"`
+	Username string             `json:"username"`
+	From     string             `json:"from"`
+	TLSMode  models.SMTPTLSMode `json:"tls_mode"`
+}
+
+// handles a request to save an org's SMTP settings
+func handleSMTPSettings(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &smtpSettingsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	if err := models.SaveOrgSMTPSettings(ctx, rt.DB, rt.Config, request.OrgID, request.Settings); err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error saving SMTP settings")
+	}
+
+	var settings *smtpSettingsResponse
+	if s := request.Settings; s != nil {
+		settings = &smtpSettingsResponse{Host: s.Host, Port: s.Port, Username: s.Username, From: s.From, TLSMode: s.TLSMode}
+	}
+
+	return map[string]interface{}{"org_id": request.OrgID, "settings": settings}, http.StatusOK, nil
+}
+
+// Request to verify SMTP settings by sending a test email. If settings aren't included, the org's current SMTP
+// configuration is verified.
+//
+//   {
+//     "org_id": 1,
+//     "to": "bob@example.com",
+//     "settings": {
+//       "host": "smtp.example.com",
+//       "port": 587,
+//       "username": "bob",
+//       "password": "sesame",
+//       "from": "bob@example.com",
+//       "tls_mode": "starttls"
+//     }
+//   }
+//
+// Response is whether the test email could be sent, and if not, the error.
+//
+//   {
+//     "sent": false,
+//     "error": "535 Authentication failed"
+//   }
+//
+type verifySMTPRequest struct {
+	OrgID    models.OrgID         `json:"org_id"   validate:"required"`
+	To       string               `json:"to"       validate:"required,email"`
+	Settings *models.SMTPSettings `json:"settings"`
+}
+
+const (
+	verifySMTPSubject = "Test email"
+	verifySMTPBody    = "This is a test email to verify your SMTP settings."
+)
+
+// handles a request to verify SMTP settings
+func handleVerifySMTP(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &verifySMTPRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	var sendErr error
+	if request.Settings != nil {
+		sendErr = request.Settings.SendEmail([]string{request.To}, verifySMTPSubject, verifySMTPBody)
+	} else {
+		// refresh the org so we verify settings which have just been saved
+		oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshOrg)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+		}
+
+		sendErr = oa.Org().SendEmail([]string{request.To}, verifySMTPSubject, verifySMTPBody)
+	}
+
+	if sendErr != nil {
+		return map[string]interface{}{"sent": false, "error": sendErr.Error()}, http.StatusOK, nil
+	}
+	return map[string]interface{}{"sent": true}, http.StatusOK, nil
+}
@@ -0,0 +1,19 @@
+package org_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestSMTP(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+
+	defer func() { config.Mailroom.OrgSecretsKey = "" }()
+	config.Mailroom.OrgSecretsKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	web.RunWebTests(t, "testdata/smtp.json", nil)
+}
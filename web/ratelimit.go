@@ -0,0 +1,152 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the endpoint group whose limit applies to endpoints which don't have their own
+const defaultRateLimitGroup = "*"
+
+// takes a token from a bucket which refills at the given rate up to the burst size, returning zero if one was taken, or
+// how many milliseconds until there will be one
+var takeRateLimitToken = redis.NewScript(1, `
+-- KEYS: [Bucket] ARGV: [Rate, Burst, Now]
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return wait
+`)
+
+// limits how often each org can make requests to each group of endpoints, using token buckets in redis so that limits
+// are shared by all our instances. Requests are made by orgs either with their own API tokens, or with our auth token
+// and an org_id in the body. Requests we can't attribute to an org aren't limited.
+func rateLimiter(rt *runtime.Runtime, limits map[string]*config.RateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			group, limit := rateLimitGroup(r.URL.Path, limits)
+			if limit == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			org, err := rateLimitOrg(rt, r)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			if org == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rc := rt.RP.Get()
+			wait, err := redis.Int64(takeRateLimitToken.Do(rc, fmt.Sprintf("rate_limit:%s:%s", group, org), limit.Rate, limit.Burst, time.Now().UnixNano()/int64(time.Millisecond)))
+			rc.Close()
+
+			// if redis is having problems, we'd rather serve requests than refuse them all
+			if err != nil {
+				logrus.WithError(err).WithField("group", group).Error("error checking rate limit")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if wait > 0 {
+				retryAfter := int(math.Ceil(float64(wait) / 1000))
+
+				logrus.WithFields(logrus.Fields{"group": group, "org": org, "retry_after": retryAfter}).Warn("request rate limited")
+
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				writeJSONError(w, http.StatusTooManyRequests, errors.Errorf("rate limit exceeded for %s requests, retry after %d seconds", group, retryAfter))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gets the endpoint group of the given path, which is the segment after /mr/, and the limit which applies to it
+func rateLimitGroup(path string, limits map[string]*config.RateLimit) (string, *config.RateLimit) {
+	if !strings.HasPrefix(path, "/mr/") {
+		return "", nil
+	}
+
+	group := strings.SplitN(strings.TrimPrefix(path, "/mr/"), "/", 2)[0]
+	if limit := limits[group]; limit != nil {
+		return group, limit
+	}
+	return defaultRateLimitGroup, limits[defaultRateLimitGroup]
+}
+
+// identifies the org making a request, either by its API token, or by the org_id in the JSON body
+func rateLimitOrg(rt *runtime.Runtime, r *http.Request) (string, error) {
+	auth := r.Header.Get("authorization")
+	if strings.HasPrefix(auth, "Token ") && auth != "Token "+rt.Config.AuthToken {
+		// we don't want API tokens in redis so use a hash
+		hash := sha1.Sum([]byte(auth[6:]))
+		return "token:" + hex.EncodeToString(hash[:8]), nil
+	}
+
+	// uploaded files can be large and don't have an org_id we can find without parsing the form
+	if r.Body == nil || r.Method != http.MethodPost || strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return "", nil
+	}
+
+	// read the body so we can look for an org id, and replace it so that the handler can read it too
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxRequestBytes))
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading request body")
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	request := &struct {
+		OrgID models.OrgID `json:"org_id"`
+	}{}
+	if err := json.Unmarshal(body, request); err != nil || request.OrgID == models.NilOrgID {
+		return "", nil
+	}
+	return fmt.Sprintf("org:%d", request.OrgID), nil
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	serialized, _ := jsonx.MarshalPretty(NewErrorResponse(err))
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(serialized)
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/testsuite"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	testsuite.Reset()
+	defer testsuite.Reset()
+
+	cfg := *config.Mailroom
+	cfg.AuthToken = "sesame"
+	cfg.RateLimits = "sim:0.01:2,*:0.01:3"
+	limits, err := cfg.ParseRateLimits()
+	require.NoError(t, err)
+
+	rt := &runtime.Runtime{DB: testsuite.DB(), RP: testsuite.RP(), Config: &cfg}
+
+	// our handler echoes the body so we can check it can still be read
+	handler := rateLimiter(rt, limits)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+
+	request := func(path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// org 1 can make 2 sim requests before being limited
+	for i := 0; i < 2; i++ {
+		w := request("/mr/sim/start", "sesame", `{"org_id": 1}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `{"org_id": 1}`, w.Body.String())
+	}
+
+	w := request("/mr/sim/resume", "sesame", `{"org_id": 1}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "100", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error": "rate limit exceeded for sim requests, retry after 100 seconds"}`, w.Body.String())
+
+	// but that doesn't affect org 2 or other endpoints
+	assert.Equal(t, http.StatusOK, request("/mr/sim/start", "sesame", `{"org_id": 2}`).Code)
+	assert.Equal(t, http.StatusOK, request("/mr/contact/search", "sesame", `{"org_id": 1}`).Code)
+
+	// other endpoints share the default limit
+	assert.Equal(t, http.StatusOK, request("/mr/contact/search", "sesame", `{"org_id": 1}`).Code)
+	assert.Equal(t, http.StatusOK, request("/mr/msg/resend", "sesame", `{"org_id": 1}`).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/mr/flow/inspect", "sesame", `{"org_id": 1}`).Code)
+
+	// requests with API tokens are limited by token
+	assert.Equal(t, http.StatusOK, request("/mr/sim/start", "abc123", `{}`).Code)
+	assert.Equal(t, http.StatusOK, request("/mr/sim/start", "abc123", `{}`).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/mr/sim/start", "abc123", `{}`).Code)
+
+	// requests we can't attribute to an org aren't limited
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, request("/mr/sim/start", "sesame", `[]`).Code)
+	}
+
+	// nor are file uploads, whose bodies we don't read
+	upload := httptest.NewRequest(http.MethodPost, "/mr/import/preview", strings.NewReader(`{"org_id": 1}`))
+	upload.Header.Set("Authorization", "Token sesame")
+	upload.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, upload)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// nor are endpoints outside of /mr/
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, request("/", "abc123", ``).Code)
+	}
+}
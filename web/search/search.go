@@ -0,0 +1,72 @@
+package search
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodGet, "/mr/search", web.RequireAuthToken(handleSearch))
+}
+
+// Searches across the contacts, messages and tickets of an org, optionally filtered by type
+//
+//   /mr/search?org_id=1&query=bob&type=contact&type=ticket&limit=20
+//
+type searchRequest struct {
+	OrgID models.OrgID `form:"org_id" validate:"required"`
+	Query string       `form:"query"  validate:"required"`
+	Types []string     `form:"type"`
+	Limit int          `form:"limit"  validate:"omitempty,min=1,max=100"`
+}
+
+// Response for a global search, ranked by relevance
+//
+//   {
+//     "query": "bob",
+//     "results": [
+//       {"type": "contact", "id": 10001, "score": 1},
+//       {"type": "ticket", "id": 123, "score": 0.75}
+//     ]
+//   }
+//
+type searchResponse struct {
+	Query   string                 `json:"query"`
+	Results []*models.SearchResult `json:"results"`
+}
+
+// handles a global search request
+func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &searchRequest{Limit: 20}
+	if err := web.DecodeAndValidateForm(request, r); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	types := models.AllSearchResultTypes
+	if len(request.Types) > 0 {
+		types = make([]models.SearchResultType, 0, len(request.Types))
+		for _, t := range request.Types {
+			types = append(types, models.SearchResultType(strings.ToLower(t)))
+		}
+	}
+
+	for _, t := range types {
+		if t != models.SearchResultTypeContact && t != models.SearchResultTypeMsg && t != models.SearchResultTypeTicket {
+			return errors.Errorf("invalid result type: %s", t), http.StatusBadRequest, nil
+		}
+	}
+
+	results, err := models.GlobalSearch(ctx, rt.ES, request.OrgID, strings.TrimSpace(request.Query), types, request.Limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &searchResponse{Query: request.Query, Results: results}, http.StatusOK, nil
+}
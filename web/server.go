@@ -10,15 +10,13 @@ import (
 	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
-	"github.com/nyaruka/gocommon/storage"
-	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/scope"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/gomodule/redigo/redis"
-	"github.com/jmoiron/sqlx"
-	"github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -62,18 +60,11 @@ func RegisterRoute(method string, pattern string, handler Handler) {
 }
 
 // NewServer creates a new web server, it will need to be started after being created
-func NewServer(ctx context.Context, config *config.Config, db *sqlx.DB, rp *redis.Pool, store storage.Storage, es *elastic.Client, wg *sync.WaitGroup) *Server {
+func NewServer(ctx context.Context, rt *runtime.Runtime, wg *sync.WaitGroup) *Server {
 	s := &Server{
 		ctx: ctx,
-		rt: &runtime.Runtime{
-			RP:           rp,
-			DB:           db,
-			ES:           es,
-			MediaStorage: store,
-			Config:       config,
-		},
-
-		wg: wg,
+		rt:  rt,
+		wg:  wg,
 	}
 
 	router := chi.NewRouter()
@@ -83,14 +74,22 @@ func NewServer(ctx context.Context, config *config.Config, db *sqlx.DB, rp *redi
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 	router.Use(panicRecovery)
+	router.Use(requestTracer)
 	router.Use(middleware.Timeout(60 * time.Second))
 	router.Use(requestLogger)
 
+	// limit how often each org can make requests if we've been configured to
+	rateLimits, _ := rt.Config.ParseRateLimits()
+	if len(rateLimits) > 0 {
+		router.Use(rateLimiter(rt, rateLimits))
+	}
+
 	// wire up our main pages
 	router.NotFound(s.WrapJSONHandler(handle404))
 	router.MethodNotAllowed(s.WrapJSONHandler(handle405))
 	router.Get("/", s.WrapJSONHandler(handleIndex))
 	router.Get("/mr/", s.WrapJSONHandler(handleIndex))
+	router.Get("/mr/version", s.WrapJSONHandler(handleVersion))
 
 	// add any registered json routes
 	for _, route := range jsonRoutes {
@@ -104,7 +103,7 @@ func NewServer(ctx context.Context, config *config.Config, db *sqlx.DB, rp *redi
 
 	// configure our http server
 	s.httpServer = &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", config.Address, config.Port),
+		Addr:         fmt.Sprintf("%s:%d", rt.Config.Address, rt.Config.Port),
 		Handler:      router,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
@@ -118,7 +117,8 @@ func (s *Server) WrapJSONHandler(handler JSONHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-type", "application/json")
 
-		value, status, err := handler(r.Context(), s.rt, r)
+		ctx := scope.New(r.Context(), logrus.Fields{"http_path": r.URL.Path})
+		value, status, err := handler(ctx, s.rt, r)
 
 		// handler errored (a hard error)
 		if err != nil {
@@ -140,7 +140,7 @@ func (s *Server) WrapJSONHandler(handler JSONHandler) http.HandlerFunc {
 		}
 
 		if err != nil {
-			logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+			scope.Log(ctx).WithError(err).WithField("http_request", r).Error("error handling request")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write(serialized)
 			return
@@ -154,12 +154,13 @@ func (s *Server) WrapJSONHandler(handler JSONHandler) http.HandlerFunc {
 // WrapHandler wraps a simple Handler, taking care of passing down server and handling errors
 func (s *Server) WrapHandler(handler Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := handler(r.Context(), s.rt, r, w)
+		ctx := scope.New(r.Context(), logrus.Fields{"http_path": r.URL.Path})
+		err := handler(ctx, s.rt, r, w)
 		if err == nil {
 			return
 		}
 
-		logrus.WithError(err).WithField("http_request", r).Error("error handling request")
+		scope.Log(ctx).WithError(err).WithField("http_request", r).Error("error handling request")
 		w.WriteHeader(http.StatusInternalServerError)
 		serialized, _ := json.Marshal(NewErrorResponse(err))
 		w.Write(serialized)
@@ -195,11 +196,70 @@ func (s *Server) Stop() {
 }
 
 func handleIndex(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
-	response := map[string]string{
+	response := map[string]interface{}{
 		"url":       fmt.Sprintf("%s", r.URL),
 		"component": "mailroom",
 		"version":   rt.Config.Version,
+		"status":    "ok",
+	}
+
+	// if any startup checks failed, make it clear we're running degraded
+	if len(rt.FailedChecks) > 0 {
+		response["status"] = "degraded"
+		response["failed_checks"] = rt.FailedChecks
 	}
+
+	// report any indexes our hot queries depend on which were missing when the database was last checked
+	if missing := rt.DBAdvisory.MissingIndexes(); len(missing) > 0 {
+		response["missing_indexes"] = missing
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Response describing the capabilities of this deployment, so that the editor and other tools can adapt to them.
+//
+//   {
+//     "version": "v6.5.0",
+//     "spec_version": "13.1.0",
+//     "action_types": ["add_contact_groups", "add_contact_urn", ...],
+//     "modifier_types": ["channel", "field", ...],
+//     "ticketers": ["internal", "mailgun", "zendesk"],
+//     "classifiers": ["bothub", "luis", "wit"],
+//     "services": {"airtime": true, "email": true, "fcm": false, "lookups": ["twilio"]}
+//   }
+//
+type versionResponse struct {
+	Version       string   `json:"version"`
+	SpecVersion   string   `json:"spec_version"`
+	ActionTypes   []string `json:"action_types"`
+	ModifierTypes []string `json:"modifier_types"`
+	Ticketers     []string `json:"ticketers"`
+	Classifiers   []string `json:"classifiers"`
+	Services      struct {
+		Airtime bool     `json:"airtime"`
+		Email   bool     `json:"email"`
+		FCM     bool     `json:"fcm"`
+		Lookups []string `json:"lookups"`
+	} `json:"services"`
+}
+
+func handleVersion(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	response := &versionResponse{
+		Version:       rt.Config.Version,
+		SpecVersion:   goflow.SpecVersion().String(),
+		ActionTypes:   goflow.ActionTypes(),
+		ModifierTypes: goflow.ModifierTypes(),
+		Ticketers:     models.TicketerTypes(),
+		Classifiers:   models.ClassifierTypes,
+	}
+
+	// airtime transfers and emails are configured per org, but emails can also use our own SMTP server
+	response.Services.Airtime = true
+	response.Services.Email = rt.Config.SMTPServer != ""
+	response.Services.FCM = rt.Config.FCMKey != ""
+	response.Services.Lookups = models.LookupServiceTypes()
+
 	return response, http.StatusOK, nil
 }
 
@@ -0,0 +1,183 @@
+package simulation
+
+import (
+	"encoding/json"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/routers/waits"
+	"github.com/nyaruka/goflow/flows/routers/waits/hints"
+	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/pkg/errors"
+)
+
+// resume types which let the simulator provide input to voice flows as it would be received during a call
+const (
+	resumeTypeDTMF  = "dtmf"
+	resumeTypeAudio = "audio"
+)
+
+// the URN we call if the simulated contact doesn't have a phone number
+const simulatedCallURN = urns.URN("tel:+12065550100")
+
+// ivrCommand is something said or played to the contact during a simulated call
+type ivrCommand struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Language string `json:"language,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// ivrGather is the input a simulated call is waiting for
+type ivrGather struct {
+	Type         string `json:"type"`
+	Count        *int   `json:"count,omitempty"`
+	TerminatedBy string `json:"terminated_by,omitempty"`
+}
+
+// ivrResponse is how a simulated call would be rendered by a voice channel
+type ivrResponse struct {
+	Status   string        `json:"status"`
+	Commands []*ivrCommand `json:"commands"`
+	Gather   *ivrGather    `json:"gather,omitempty"`
+}
+
+// newIVRResponse renders the events and wait of a sprint of a voice session as the instructions a call would get
+func newIVRResponse(session flows.Session, es []flows.Event) *ivrResponse {
+	if session == nil || session.Trigger().Connection() == nil {
+		return nil
+	}
+
+	r := &ivrResponse{Status: "in_progress", Commands: make([]*ivrCommand, 0)}
+
+	for _, e := range es {
+		if event, ok := e.(*events.IVRCreatedEvent); ok {
+			if len(event.Msg.Attachments()) == 0 {
+				r.Commands = append(r.Commands, &ivrCommand{Type: "say", Text: event.Msg.Text(), Language: string(event.Msg.TextLanguage)})
+			} else {
+				for _, a := range event.Msg.Attachments() {
+					a = models.NormalizeAttachment(config.Mailroom, a)
+					r.Commands = append(r.Commands, &ivrCommand{Type: "play", URL: a.URL()})
+				}
+			}
+		}
+	}
+
+	switch wait := session.Wait().(type) {
+	case *waits.ActivatedMsgWait:
+		switch hint := wait.Hint().(type) {
+		case *hints.DigitsHint:
+			r.Gather = &ivrGather{Type: "digits", Count: hint.Count, TerminatedBy: hint.TerminatedBy}
+		case *hints.AudioHint:
+			r.Gather = &ivrGather{Type: "record"}
+		}
+	case *waits.ActivatedDialWait:
+		r.Gather = &ivrGather{Type: "dial"}
+	case nil:
+		r.Status = "completed"
+		r.Commands = append(r.Commands, &ivrCommand{Type: "hangup"})
+	}
+
+	return r
+}
+
+// addSimulatedConnection adds a connection to the passed in trigger if it starts a voice flow and doesn't already have
+// one, so that the flow runs as if the contact had answered a call
+func addSimulatedConnection(oa *models.OrgAssets, data json.RawMessage) (json.RawMessage, error) {
+	trigger := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &trigger); err != nil {
+		return nil, errors.Wrapf(err, "unable to read trigger")
+	}
+	if _, hasConnection := trigger["connection"]; hasConnection {
+		return data, nil
+	}
+
+	envelope := &struct {
+		Flow    assets.FlowReference `json:"flow"`
+		Contact struct {
+			URNs []urns.URN `json:"urns"`
+		} `json:"contact"`
+	}{}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		return nil, errors.Wrapf(err, "unable to read trigger")
+	}
+
+	flow, err := oa.Flow(envelope.Flow.UUID)
+	if err != nil || flow.(*models.Flow).FlowType() != models.FlowTypeVoice {
+		return data, nil
+	}
+
+	channel, err := callChannel(oa)
+	if err != nil {
+		return nil, err
+	}
+
+	urn := simulatedCallURN
+	for _, u := range envelope.Contact.URNs {
+		if u.Scheme() == urns.TelScheme {
+			urn = u.Identity()
+			break
+		}
+	}
+
+	connection, err := json.Marshal(flows.NewConnection(assets.NewChannelReference(channel.UUID(), channel.Name()), urn))
+	if err != nil {
+		return nil, err
+	}
+	trigger["connection"] = connection
+
+	return json.Marshal(trigger)
+}
+
+// convertIVRResume converts a DTMF or audio resume into the msg resume that a call would resume its session with
+func convertIVRResume(data json.RawMessage) (json.RawMessage, error) {
+	resume := &struct {
+		Type         string          `json:"type"`
+		Contact      json.RawMessage `json:"contact"`
+		ResumedOn    json.RawMessage `json:"resumed_on"`
+		Digits       string          `json:"digits"`
+		RecordingURL string          `json:"recording_url"`
+	}{}
+	if err := json.Unmarshal(data, resume); err != nil {
+		return nil, errors.Wrapf(err, "unable to read resume")
+	}
+
+	msg := map[string]interface{}{"uuid": uuids.New(), "text": ""}
+
+	switch resume.Type {
+	case resumeTypeDTMF:
+		msg["text"] = resume.Digits
+	case resumeTypeAudio:
+		if resume.RecordingURL == "" {
+			return nil, errors.New("audio resume must have a recording_url")
+		}
+		msg["attachments"] = []string{"audio/mp4:" + resume.RecordingURL}
+	default:
+		return data, nil
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":       "msg",
+		"contact":    resume.Contact,
+		"resumed_on": resume.ResumedOn,
+		"msg":        msg,
+	})
+}
+
+// callChannel finds a channel which can make calls to use for simulated calls
+func callChannel(oa *models.OrgAssets) (assets.Channel, error) {
+	channels, _ := oa.Channels()
+	for _, ch := range channels {
+		for _, role := range ch.Roles() {
+			if role == assets.ChannelRoleCall {
+				return ch, nil
+			}
+		}
+	}
+	return nil, errors.New("no channel with the call role to simulate a voice flow with")
+}
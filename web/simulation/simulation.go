@@ -59,6 +59,10 @@ type simulationResponse struct {
 	Session flows.Session   `json:"session"`
 	Events  []flows.Event   `json:"events"`
 	Context *xtypes.XObject `json:"context,omitempty"`
+	IVR     *ivrResponse    `json:"ivr,omitempty"`
+
+	// what each message would cost if sent as SMS, so that flow authors can see that before sending
+	Segments map[flows.MsgUUID]*models.MsgSegments `json:"segments,omitempty"`
 }
 
 func newSimulationResponse(session flows.Session, sprint flows.Sprint) *simulationResponse {
@@ -73,7 +77,27 @@ func newSimulationResponse(session flows.Session, sprint flows.Sprint) *simulati
 			})
 		}
 	}
-	return &simulationResponse{Session: session, Events: sprint.Events(), Context: context}
+	return &simulationResponse{
+		Session:  session,
+		Events:   sprint.Events(),
+		Context:  context,
+		IVR:      newIVRResponse(session, sprint.Events()),
+		Segments: msgSegments(sprint.Events()),
+	}
+}
+
+// calculates the SMS segments of the messages created by the given events
+func msgSegments(es []flows.Event) map[flows.MsgUUID]*models.MsgSegments {
+	segments := make(map[flows.MsgUUID]*models.MsgSegments)
+	for _, e := range es {
+		if e.Type() == events.TypeMsgCreated {
+			msg := e.(*events.MsgCreatedEvent).Msg
+			if msg.Text() != "" {
+				segments[msg.UUID()] = models.CalculateSegments(msg.Text())
+			}
+		}
+	}
+	return segments
 }
 
 // Starts a new engine session
@@ -132,6 +156,12 @@ func handleStart(ctx context.Context, rt *runtime.Runtime, r *http.Request) (int
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "unable to clone org")
 	}
 
+	// voice flows are simulated as if the contact answered a call
+	request.Trigger, err = addSimulatedConnection(oa, request.Trigger)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
 	// read our trigger
 	trigger, err := triggers.ReadTrigger(oa.SessionAssets(), request.Trigger, assets.IgnoreMissing)
 	if err != nil {
@@ -200,6 +230,12 @@ func handleResume(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusBadRequest, err
 	}
 
+	// voice flows can be resumed with digits or a recording as they would be during a call
+	request.Resume, err = convertIVRResume(request.Resume)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
 	// read our resume
 	resume, err := resumes.ReadResume(oa.SessionAssets(), request.Resume, assets.IgnoreMissing)
 	if err != nil {
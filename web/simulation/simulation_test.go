@@ -2,6 +2,7 @@ package simulation
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -13,11 +14,13 @@ import (
 
 	"github.com/nyaruka/mailroom/config"
 	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -257,7 +260,7 @@ func TestServer(t *testing.T) {
 	rp := testsuite.RP()
 	wg := &sync.WaitGroup{}
 
-	server := web.NewServer(ctx, config.Mailroom, db, rp, nil, nil, wg)
+	server := web.NewServer(ctx, &runtime.Runtime{DB: db, RP: rp, Config: config.Mailroom}, wg)
 	server.Start()
 
 	// give our server time to start
@@ -281,6 +284,7 @@ func TestServer(t *testing.T) {
 	}{
 		{"/mr/sim/start", "GET", "", 405, "illegal"},
 		{"/mr/sim/start", "POST", startBody, 200, "What is your favorite color?"},
+		{"/mr/sim/start", "POST", startBody, 200, `"segments":{"`},
 		{"/mr/sim/resume", "GET", "", 405, "illegal"},
 		{"/mr/sim/resume", "POST", resumeBody, 200, "Good choice, I like Blue too! What is your favorite beer?"},
 		{"/mr/sim/start", "POST", customStartBody, 200, "Your channel is Test Channel"},
@@ -330,3 +334,81 @@ func TestServer(t *testing.T) {
 		assert.True(t, strings.Contains(string(content), tc.Response), "%d: did not find string: %s in body: %s", i, tc.Response, string(content))
 	}
 }
+
+func TestIVRSimulation(t *testing.T) {
+	testsuite.Reset()
+	ctx := testsuite.CTX()
+	rt := &runtime.Runtime{DB: testsuite.DB(), RP: testsuite.RP(), Config: config.Mailroom}
+
+	contact := `{
+		"uuid": "ba96bf7f-bc2a-4873-a7c7-254d1927c4e3",
+		"id": 1234567,
+		"name": "Ben Haggerty",
+		"language": "eng",
+		"urns": ["tel:+12065551212"],
+		"fields": {},
+		"created_on": "2000-01-01T00:00:00.000000000-00:00"
+	}`
+	channels := `[{"uuid": "440099cf-200c-4d45-a8e7-4a564f4a0e8b", "name": "Test Channel", "address": "+12065551441", "schemes": ["tel"], "roles": ["send", "receive", "call"], "country": "US"}]`
+
+	call := func(handler func(context.Context, *runtime.Runtime, *http.Request) (interface{}, int, error), body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "http://localhost:8090/mr/sim", strings.NewReader(body))
+		value, status, err := handler(ctx, rt, req)
+		require.NoError(t, err)
+
+		content, err := json.Marshal(value)
+		require.NoError(t, err)
+
+		parsed := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(content, &parsed))
+		return status, parsed
+	}
+
+	// starting a voice flow simulates a call to the contact
+	status, response := call(handleStart, `{
+		"org_id": 1,
+		"trigger": {
+			"type": "manual",
+			"contact": `+contact+`,
+			"environment": {"date_format": "YYYY-MM-DD", "time_format": "hh:mm", "timezone": "America/Los_Angeles"},
+			"flow": {"uuid": "2f81d0ea-4d75-4843-9371-3f7465311cce", "name": "IVR Flow"},
+			"triggered_on": "2000-01-01T00:00:00.000000000-00:00"
+		},
+		"assets": {"channels": `+channels+`}
+	}`)
+	require.Equal(t, 200, status)
+
+	ivr := response["ivr"].(map[string]interface{})
+	assert.Equal(t, "in_progress", ivr["status"])
+	assert.Contains(t, ivr["commands"].([]interface{})[0].(map[string]interface{})["text"], "Hello there. Please enter one or two.")
+	assert.Equal(t, "digits", ivr["gather"].(map[string]interface{})["type"])
+
+	session, _ := json.Marshal(response["session"])
+
+	// which can be resumed with digits
+	status, response = call(handleResume, `{
+		"org_id": 1,
+		"session": `+string(session)+`,
+		"resume": {"type": "dtmf", "digits": "1", "contact": `+contact+`, "resumed_on": "2000-01-01T00:00:00.000000000-00:00"},
+		"assets": {"channels": `+channels+`}
+	}`)
+	require.Equal(t, 200, status)
+
+	ivr = response["ivr"].(map[string]interface{})
+	assert.Contains(t, ivr["commands"].([]interface{})[0].(map[string]interface{})["text"], "Great! You said One.")
+
+	// audio resumes need a recording
+	req, _ := http.NewRequest("POST", "http://localhost:8090/mr/sim/resume", strings.NewReader(`{
+		"org_id": 1,
+		"session": `+string(session)+`,
+		"resume": {"type": "audio", "contact": `+contact+`, "resumed_on": "2000-01-01T00:00:00.000000000-00:00"}
+	}`))
+	_, status, err := handleResume(ctx, rt, req)
+	assert.Equal(t, 400, status)
+	assert.EqualError(t, err, "audio resume must have a recording_url")
+
+	// non-voice flows don't get an IVR response
+	status, response = call(handleStart, startBody)
+	require.Equal(t, 200, status)
+	assert.NotContains(t, response, "ivr")
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/test"
 	"github.com/nyaruka/mailroom/config"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/testsuite"
 
 	"github.com/stretchr/testify/assert"
@@ -40,7 +41,7 @@ func RunWebTests(t *testing.T, truthFile string, substitutions map[string]string
 
 	defer testsuite.ResetStorage()
 
-	server := NewServer(context.Background(), config.Mailroom, db, rp, testsuite.MediaStorage(), nil, wg)
+	server := NewServer(context.Background(), &runtime.Runtime{DB: db, RP: rp, MediaStorage: testsuite.MediaStorage(), Config: config.Mailroom}, wg)
 	server.Start()
 	defer server.Stop()
 
@@ -0,0 +1,196 @@
+package ticket
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/topics", web.RequireAuthToken(handleTopics))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/create_topic", web.RequireAuthToken(handleCreateTopic))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/create_team", web.RequireAuthToken(handleCreateTeam))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/route", web.RequireAuthToken(handleRoute))
+}
+
+type topicsRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+}
+
+// Returns the topics and teams of an org
+//
+//   {
+//     "org_id": 1
+//   }
+//
+func handleTopics(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &topicsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	topics, err := models.LoadTopics(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	teams, err := models.LoadTeams(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"topics": topics, "teams": teams}, http.StatusOK, nil
+}
+
+type createTopicRequest struct {
+	OrgID models.OrgID `json:"org_id" validate:"required"`
+	Name  string       `json:"name"   validate:"required,max=64"`
+}
+
+// Creates a new topic which tickets can be categorized by
+//
+//   {
+//     "org_id": 1,
+//     "name": "Billing"
+//   }
+//
+func handleCreateTopic(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &createTopicRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	topic, err := models.CreateTopic(ctx, rt.DB, request.OrgID, request.Name)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	return topic, http.StatusOK, nil
+}
+
+type createTeamRequest struct {
+	OrgID   models.OrgID    `json:"org_id"   validate:"required"`
+	Name    string          `json:"name"     validate:"required,max=64"`
+	UserIDs []models.UserID `json:"user_ids"`
+}
+
+// Creates a new team of agents which tickets can be routed to
+//
+//   {
+//     "org_id": 1,
+//     "name": "Support",
+//     "user_ids": [6, 7]
+//   }
+//
+func handleCreateTeam(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &createTeamRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	for _, userID := range request.UserIDs {
+		if oa.UserByID(userID) == nil {
+			return errors.Errorf("no such user: %d", userID), http.StatusBadRequest, nil
+		}
+	}
+
+	team, err := models.CreateTeam(ctx, rt.DB, request.OrgID, request.Name, request.UserIDs)
+	if err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	return team, http.StatusOK, nil
+}
+
+type routeRequest struct {
+	bulkTicketRequest
+
+	TopicID *models.TopicID `json:"topic_id"`
+	TeamID  *models.TeamID  `json:"team_id"`
+}
+
+// Sets the topic and/or team of the tickets with the given ids. Either can be omitted to leave it unchanged, or be
+// zero to clear it.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 3,
+//     "ticket_ids": [1234, 2345],
+//     "topic_id": 12,
+//     "team_id": 3
+//   }
+//
+func handleRoute(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &routeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	topicID, teamID := models.NilTopicID, models.NilTeamID
+
+	if request.TopicID != nil && *request.TopicID != models.NilTopicID {
+		topics, err := models.LoadTopics(ctx, rt.DB, request.OrgID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		for _, t := range topics {
+			if t.ID == *request.TopicID {
+				topicID = t.ID
+			}
+		}
+		if topicID == models.NilTopicID {
+			return errors.Errorf("no such topic: %d", *request.TopicID), http.StatusBadRequest, nil
+		}
+	}
+
+	if request.TeamID != nil && *request.TeamID != models.NilTeamID {
+		teams, err := models.LoadTeams(ctx, rt.DB, request.OrgID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		for _, t := range teams {
+			if t.ID == *request.TeamID {
+				teamID = t.ID
+			}
+		}
+		if teamID == models.NilTeamID {
+			return errors.Errorf("no such team: %d", *request.TeamID), http.StatusBadRequest, nil
+		}
+	}
+
+	tickets, err := loadOrgTickets(ctx, rt, request.OrgID, request.TicketIDs)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	err = models.RouteTickets(ctx, rt.DB, tickets, topicID, request.TopicID != nil, teamID, request.TeamID != nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = indexing.QueueIndexTickets(rc, request.OrgID, tickets)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	changed := make(map[*models.Ticket]*models.TicketEvent, len(tickets))
+	for _, t := range tickets {
+		changed[t] = nil
+	}
+	return newBulkResponse(changed), http.StatusOK, nil
+}
@@ -0,0 +1,41 @@
+package ticket
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestTicketCreateTopic(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/create_topic.json", nil)
+}
+
+func TestTicketCreateTeam(t *testing.T) {
+	testsuite.Reset()
+
+	web.RunWebTests(t, "testdata/create_team.json", nil)
+}
+
+func TestTicketRoute(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+
+	// a topic and team in each org, the agent being the only member of the first team
+	db.MustExec(`INSERT INTO tickets_topic(id, uuid, org_id, name, is_active, created_on) VALUES
+		(1, 'a2c5e3ba-7ba1-4c1e-9a33-9e7b6f7f4d2f', 1, 'Billing', TRUE, NOW()),
+		(2, 'c8d1a6c9-8d56-4c47-b83c-1b8cd5a4e2c4', 2, 'Billing', TRUE, NOW())`)
+	db.MustExec(`INSERT INTO tickets_team(id, uuid, org_id, name, is_active, created_on) VALUES
+		(1, '5e1f8f8a-3f4b-44e4-9f6a-6c5a0b2d1e7c', 1, 'Support', TRUE, NOW()),
+		(2, '0b8d1c3e-9a8f-4f3a-8f5d-2c6b7a9e1d4f', 2, 'Support', TRUE, NOW())`)
+	db.MustExec(`INSERT INTO tickets_team_users(team_id, user_id) VALUES(1, $1)`, testdata.Agent.ID)
+
+	// create 2 open tickets for Cathy
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, "Need help", "Where's my refund?", "", nil)
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, "More help", "Where's my order?", "", nil)
+
+	web.RunWebTests(t, "testdata/route.json", nil)
+}
@@ -2,22 +2,37 @@ package ticket
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks/handler"
+	"github.com/nyaruka/mailroom/core/tasks/indexing"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/services/tickets"
 	"github.com/nyaruka/mailroom/web"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/close", web.RequireAuthToken(web.WithHTTPLogs(handleClose)))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/reopen", web.RequireAuthToken(web.WithHTTPLogs(handleReopen)))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/assign", web.RequireAuthToken(web.WithHTTPLogs(handleAssign)))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/add_note", web.RequireAuthToken(web.WithHTTPLogs(handleAddNote)))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/search", web.RequireAuthToken(handleSearch))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ticket/reply", web.RequireAuthToken(handleReply))
 }
 
+// the type of the internal ticketer, whose tickets are replied to from mailroom rather than an external service
+const internalTicketerType = "internal"
+
 type bulkTicketRequest struct {
 	OrgID     models.OrgID      `json:"org_id"      validate:"required"`
 	UserID    models.UserID     `json:"user_id"      validate:"required"`
@@ -33,9 +48,18 @@ func newBulkResponse(changed map[*models.Ticket]*models.TicketEvent) *bulkTicket
 	for t := range changed {
 		ids = append(ids, t.ID())
 	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 	return &bulkTicketResponse{ChangedIDs: ids}
 }
 
+func changedTickets(changed map[*models.Ticket]*models.TicketEvent) []*models.Ticket {
+	tickets := make([]*models.Ticket, 0, len(changed))
+	for t := range changed {
+		tickets = append(tickets, t)
+	}
+	return tickets
+}
+
 // Closes any open tickets with the given ids
 //
 //   {
@@ -76,6 +100,11 @@ func handleClose(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *m
 		}
 	}
 
+	err = indexing.QueueIndexTickets(rc, request.OrgID, changedTickets(evts))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
 	return newBulkResponse(evts), http.StatusOK, nil
 }
 
@@ -109,5 +138,295 @@ func handleReopen(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *
 		return nil, http.StatusBadRequest, errors.Wrapf(err, "error reopening tickets for org: %d", request.OrgID)
 	}
 
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = indexing.QueueIndexTickets(rc, request.OrgID, changedTickets(evts))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
 	return newBulkResponse(evts), http.StatusOK, nil
 }
+
+type assignRequest struct {
+	bulkTicketRequest
+
+	AssigneeID models.UserID `json:"assignee_id"`
+	Note       string        `json:"note"`
+}
+
+// Assigns the tickets with the given ids to the given user, or unassigns them if assignee_id is null, optionally with a
+// note which is also added to the tickets on their ticketers if they support that
+//
+//   {
+//     "org_id": 123,
+//     "user_id": 234,
+//     "ticket_ids": [1234, 2345],
+//     "assignee_id": 567,
+//     "note": "please handle these"
+//   }
+//
+func handleAssign(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *models.HTTPLogger) (interface{}, int, error) {
+	request := &assignRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// grab our org assets
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	if request.AssigneeID != models.NilUserID && oa.UserByID(request.AssigneeID) == nil {
+		return errors.Errorf("no such user: %d", request.AssigneeID), http.StatusBadRequest, nil
+	}
+
+	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
+	}
+
+	evts, err := models.AssignTickets(ctx, rt.DB, oa, request.UserID, tickets, request.AssigneeID, request.Note, l)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error assigning tickets")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = indexing.QueueIndexTickets(rc, request.OrgID, changedTickets(evts))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return newBulkResponse(evts), http.StatusOK, nil
+}
+
+type addNoteRequest struct {
+	bulkTicketRequest
+
+	Note string `json:"note" validate:"required"`
+}
+
+// Adds the given note to the tickets with the given ids, and on their ticketers if they support that
+//
+//   {
+//     "org_id": 123,
+//     "user_id": 234,
+//     "ticket_ids": [1234, 2345],
+//     "note": "spam"
+//   }
+//
+func handleAddNote(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *models.HTTPLogger) (interface{}, int, error) {
+	request := &addNoteRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// grab our org assets
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	tickets, err := models.LoadTickets(ctx, rt.DB, request.TicketIDs)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.Wrapf(err, "error loading tickets for org: %d", request.OrgID)
+	}
+
+	evts, err := models.NoteTickets(ctx, rt.DB, oa, request.UserID, tickets, request.Note, l)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrap(err, "error adding notes to tickets")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = indexing.QueueIndexTickets(rc, request.OrgID, changedTickets(evts))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return newBulkResponse(evts), http.StatusOK, nil
+}
+
+// Searches the tickets of an org, returning a page of ticket ids and a cursor for the next page
+//
+//   {
+//     "org_id": 1,
+//     "query": "refund",
+//     "status": "O",
+//     "assignee_id": 234,
+//     "sort": "-last_activity_on",
+//     "cursor": "WzE2MTE3NjA0MDAwMDAsMTIzNF0",
+//     "page_size": 50
+//   }
+//
+type searchRequest struct {
+	OrgID      models.OrgID        `json:"org_id"      validate:"required"`
+	Query      string              `json:"query"`
+	Status     models.TicketStatus `json:"status"      validate:"omitempty,oneof=O C"`
+	AssigneeID models.UserID       `json:"assignee_id"`
+	Sort       string              `json:"sort"`
+	Cursor     string              `json:"cursor"`
+	PageSize   int                 `json:"page_size"   validate:"omitempty,min=1,max=500"`
+}
+
+// Response for a ticket search
+//
+//   {
+//     "ticket_ids": [1234, 1233],
+//     "total": 12,
+//     "next_cursor": "WzE2MTE3NjAzMDAwMDAsMTIzM10"
+//   }
+//
+type searchResponse struct {
+	TicketIDs  []models.TicketID `json:"ticket_ids"`
+	Total      int64             `json:"total"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// handles a request to search tickets
+func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &searchRequest{PageSize: 50}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	validSort := request.Sort == ""
+	for _, f := range models.TicketSortFields {
+		if request.Sort == f || request.Sort == "-"+f {
+			validSort = true
+		}
+	}
+	if !validSort {
+		return errors.Errorf("invalid sort: %s", request.Sort), http.StatusBadRequest, nil
+	}
+
+	page, err := models.SearchTickets(ctx, rt.ES, request.OrgID, &models.TicketSearch{
+		Query:      strings.TrimSpace(request.Query),
+		Status:     request.Status,
+		AssigneeID: request.AssigneeID,
+		Sort:       request.Sort,
+		Cursor:     request.Cursor,
+		PageSize:   request.PageSize,
+	})
+	if err == models.ErrInvalidCursor {
+		return err, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &searchResponse{TicketIDs: page.IDs, Total: page.Total, NextCursor: page.NextCursor}, http.StatusOK, nil
+}
+
+type replyRequest struct {
+	OrgID          models.OrgID    `json:"org_id"    validate:"required"`
+	UserID         models.UserID   `json:"user_id"   validate:"required"`
+	TicketID       models.TicketID `json:"ticket_id" validate:"required"`
+	Text           string          `json:"text"      validate:"required"`
+	IdempotencyKey string          `json:"idempotency_key"`
+}
+
+// Sends a reply from an agent to the contact of an internal ticket, returning the id of the new message. A request which
+// is retried with the same idempotency key within 24 hours doesn't send the reply again, and returns the id of the
+// original message.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 6,
+//     "ticket_id": 1234,
+//     "text": "We've refunded your order",
+//     "idempotency_key": "0d7b1f4a-3f0e-4b7b-9a36-6b5b3c1a8e2d"
+//   }
+//
+func handleReply(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &replyRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt.DB, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	loaded, err := loadOrgTickets(ctx, rt, request.OrgID, []models.TicketID{request.TicketID})
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(loaded) == 0 {
+		return errors.Errorf("no such ticket: %d", request.TicketID), http.StatusBadRequest, nil
+	}
+	ticket := loaded[0]
+
+	ticketer := oa.TicketerByID(ticket.TicketerID())
+	if ticketer == nil || ticketer.Type() != internalTicketerType {
+		return errors.New("can only reply to tickets of the internal ticketer"), http.StatusBadRequest, nil
+	}
+	if ticket.Status() != models.TicketStatusOpen {
+		return errors.New("can't reply to a closed ticket"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	// claim the idempotency key before we send anything, returning the original message if this is a retry
+	if request.IdempotencyKey != "" {
+		original, replay, err := models.StartIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeTicketReply, request.IdempotencyKey)
+		if err == models.ErrIdempotentRequestInProgress {
+			return err, http.StatusConflict, nil
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if replay {
+			msgID, err := strconv.ParseInt(original, 10, 64)
+			if err != nil {
+				return nil, http.StatusInternalServerError, errors.Wrapf(err, "error parsing original message id")
+			}
+			return map[string]interface{}{"msg_id": flows.MsgID(msgID)}, http.StatusOK, nil
+		}
+	}
+
+	msg, err := tickets.SendReply(ctx, rt, ticket, request.Text, nil)
+	if err != nil {
+		if request.IdempotencyKey != "" {
+			if err := models.AbandonIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeTicketReply, request.IdempotencyKey); err != nil {
+				logrus.WithError(err).WithField("idempotency_key", request.IdempotencyKey).Error("error releasing idempotency key")
+			}
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// the reply has been sent so failing to record that would only lead to retries sending it again
+	if request.IdempotencyKey != "" {
+		if err := models.CompleteIdempotentRequest(rc, oa.OrgID(), models.IdempotencyScopeTicketReply, request.IdempotencyKey, fmt.Sprint(msg.ID())); err != nil {
+			logrus.WithError(err).WithField("idempotency_key", request.IdempotencyKey).Error("error recording idempotency key")
+		}
+	}
+
+	if err := models.UpdateTicketLastActivity(ctx, rt.DB, loaded); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return map[string]interface{}{"msg_id": msg.ID()}, http.StatusOK, nil
+}
+
+// loads the tickets with the given ids, ignoring any which don't belong to the given org
+func loadOrgTickets(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, ids []models.TicketID) ([]*models.Ticket, error) {
+	all, err := models.LoadTickets(ctx, rt.DB, ids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading tickets for org: %d", orgID)
+	}
+
+	tickets := make([]*models.Ticket, 0, len(all))
+	for _, t := range all {
+		if t.OrgID() == orgID {
+			tickets = append(tickets, t)
+		}
+	}
+	return tickets, nil
+}
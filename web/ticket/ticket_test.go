@@ -1,13 +1,22 @@
 package ticket
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/nyaruka/mailroom/core/models"
+	_ "github.com/nyaruka/mailroom/services/tickets/intern"
 	_ "github.com/nyaruka/mailroom/services/tickets/mailgun"
 	_ "github.com/nyaruka/mailroom/services/tickets/zendesk"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTicketClose(t *testing.T) {
@@ -33,3 +42,75 @@ func TestTicketReopen(t *testing.T) {
 
 	web.RunWebTests(t, "testdata/reopen.json", nil)
 }
+
+func TestTicketAssign(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+
+	// create an open mailgun ticket assigned to the agent and an open unassigned zendesk ticket
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Need help", "Have you seen my cookies?", "17", testdata.Agent)
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Zendesk, "More help", "Have you seen my cookies?", "21", nil)
+
+	web.RunWebTests(t, "testdata/assign.json", nil)
+}
+
+func TestTicketAddNote(t *testing.T) {
+	testsuite.Reset()
+	db := testsuite.DB()
+
+	// create an open mailgun ticket and an open zendesk ticket, only the latter supporting notes
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Need help", "Have you seen my cookies?", "17", testdata.Admin)
+	testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Zendesk, "More help", "Have you seen my cookies?", "21", nil)
+
+	web.RunWebTests(t, "testdata/add_note.json", nil)
+}
+
+func TestTicketReply(t *testing.T) {
+	ctx, db, _ := testsuite.Reset()
+	rt := testsuite.RT()
+
+	mailgunTicket := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, "Need help", "Have you seen my cookies?", "17", nil)
+	openTicket := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, "Need help", "Where's my refund?", "", nil)
+	closedTicket := testdata.InsertClosedTicket(db, testdata.Org1, testdata.Cathy, testdata.Internal, "Old question", "Where's my order?", "", nil)
+
+	reply := func(ticketID models.TicketID) (interface{}, int, error) {
+		body := fmt.Sprintf(`{"org_id": 1, "user_id": 6, "ticket_id": %d, "text": "We've refunded your order"}`, ticketID)
+		return handleReply(ctx, rt, httptest.NewRequest(http.MethodPost, "/mr/ticket/reply", strings.NewReader(body)))
+	}
+
+	// can't reply to tickets of external ticketing services or which are closed
+	resp, status, err := reply(mailgunTicket.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.EqualError(t, resp.(error), "can only reply to tickets of the internal ticketer")
+
+	resp, status, err = reply(closedTicket.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.EqualError(t, resp.(error), "can't reply to a closed ticket")
+
+	resp, status, err = reply(openTicket.ID)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	msgID := resp.(map[string]interface{})["msg_id"]
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE id = $1 AND direction = 'O' AND contact_id = $2 AND text = 'We''ve refunded your order'`, []interface{}{msgID, testdata.Cathy.ID}, 1)
+
+	// a reply with an idempotency key is only sent once, with retries getting the id of the original message
+	replyWithKey := func() (interface{}, int, error) {
+		body := fmt.Sprintf(`{"org_id": 1, "user_id": 6, "ticket_id": %d, "text": "Anything else?", "idempotency_key": "0d7b1f4a"}`, openTicket.ID)
+		return handleReply(ctx, rt, httptest.NewRequest(http.MethodPost, "/mr/ticket/reply", strings.NewReader(body)))
+	}
+
+	resp, status, err = replyWithKey()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	msgID = resp.(map[string]interface{})["msg_id"]
+
+	resp, status, err = replyWithKey()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, msgID, resp.(map[string]interface{})["msg_id"])
+
+	testsuite.AssertQueryCount(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND text = 'Anything else?'`, []interface{}{testdata.Cathy.ID}, 1)
+}
@@ -0,0 +1,154 @@
+package trigger
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/trigger/archive", web.RequireAuthToken(handleArchive))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/trigger/restore", web.RequireAuthToken(handleRestore))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/trigger/conflicts", web.RequireAuthToken(handleConflicts))
+}
+
+// Request to archive or restore triggers in bulk.
+//
+//   {
+//     "org_id": 1,
+//     "trigger_ids": [1234, 2345]
+//   }
+//
+type bulkRequest struct {
+	OrgID      models.OrgID       `json:"org_id"      validate:"required"`
+	TriggerIDs []models.TriggerID `json:"trigger_ids" validate:"required"`
+}
+
+// Response to an archive request with the ids of the triggers which were archived
+//
+//   {
+//     "archived_ids": [1234, 2345]
+//   }
+//
+type archiveResponse struct {
+	ArchivedIDs []models.TriggerID `json:"archived_ids"`
+}
+
+// handles a request to archive triggers
+func handleArchive(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &bulkRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	archived, err := models.ArchiveTriggers(ctx, rt.DB, request.OrgID, request.TriggerIDs)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error archiving triggers")
+	}
+
+	return &archiveResponse{ArchivedIDs: archived}, http.StatusOK, nil
+}
+
+// Response to a restore request with the ids of the triggers which were restored, and for any which now conflict with
+// other active triggers, what they conflict with
+//
+//   {
+//     "restored_ids": [1234, 2345],
+//     "conflicts": {
+//       "1234": [{"trigger": {"id": 3456, ...}, "type": "ambiguous"}]
+//     }
+//   }
+//
+type restoreResponse struct {
+	RestoredIDs []models.TriggerID                             `json:"restored_ids"`
+	Conflicts   map[models.TriggerID][]*models.TriggerConflict `json:"conflicts"`
+}
+
+// handles a request to restore archived triggers
+func handleRestore(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &bulkRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	restored, err := models.RestoreTriggers(ctx, rt.DB, request.OrgID, request.TriggerIDs)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error restoring triggers")
+	}
+
+	// reload our triggers so we can check the restored ones against everything now active
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshTriggers)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	isRestored := make(map[models.TriggerID]bool, len(restored))
+	for _, id := range restored {
+		isRestored[id] = true
+	}
+
+	conflicts := make(map[models.TriggerID][]*models.TriggerConflict)
+	for _, t := range oa.Triggers() {
+		if isRestored[t.ID()] {
+			if c := models.FindTriggerConflicts(oa, t); len(c) > 0 {
+				conflicts[t.ID()] = c
+			}
+		}
+	}
+
+	return &restoreResponse{RestoredIDs: restored, Conflicts: conflicts}, http.StatusOK, nil
+}
+
+// Request to check a proposed trigger for conflicts with the existing active triggers. When editing an existing
+// trigger, its id should be included so that it isn't reported as conflicting with itself.
+//
+//   {
+//     "org_id": 1,
+//     "trigger": {
+//       "id": 1234,
+//       "trigger_type": "K",
+//       "keyword": "join",
+//       "match_type": "F",
+//       "channel_id": 0,
+//       "referrer_id": "",
+//       "include_group_ids": [12],
+//       "exclude_group_ids": []
+//     }
+//   }
+//
+type conflictsRequest struct {
+	OrgID   models.OrgID    `json:"org_id"  validate:"required"`
+	Trigger *models.Trigger `json:"trigger" validate:"required"`
+}
+
+// Response with the existing triggers which conflict with the proposed trigger
+//
+//   {
+//     "conflicts": [{"trigger": {"id": 3456, ...}, "type": "shadows"}]
+//   }
+//
+type conflictsResponse struct {
+	Conflicts []*models.TriggerConflict `json:"conflicts"`
+}
+
+// handles a request to check a proposed trigger for conflicts
+func handleConflicts(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &conflictsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	// triggers may have just been edited so make sure we're checking against the latest
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt.DB, request.OrgID, models.RefreshTriggers)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	return &conflictsResponse{Conflicts: models.FindTriggerConflicts(oa, request.Trigger)}, http.StatusOK, nil
+}
@@ -0,0 +1,29 @@
+package trigger_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestTriggers(t *testing.T) {
+	_, db, _ := testsuite.Reset()
+	defer testsuite.Reset()
+
+	db.MustExec(`DELETE FROM triggers_trigger`)
+
+	joinID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "join", models.MatchFirst, nil, nil)
+	joinDoctorsID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.PickANumber, "join", models.MatchFirst, []*testdata.Group{testdata.DoctorsGroup}, nil)
+	leaveID := testdata.InsertKeywordTrigger(db, testdata.Org1, testdata.Favorites, "leave", models.MatchFirst, nil, nil)
+
+	web.RunWebTests(t, "testdata/triggers.json", map[string]string{
+		"join_id":         fmt.Sprint(joinID),
+		"join_doctors_id": fmt.Sprint(joinDoctorsID),
+		"leave_id":        fmt.Sprint(leaveID),
+		"doctors_id":      fmt.Sprint(testdata.DoctorsGroup.ID),
+	})
+}
@@ -76,6 +76,21 @@ func RequireAuthToken(handler JSONHandler) JSONHandler {
 	}
 }
 
+// RequireAuthOrUserToken wraps a handler to require either our global authorization header, for requests made by
+// RapidPro on behalf of an org, or an API token, for requests made directly by clients like surveyor. In the latter case
+// the user and org are set on the context.
+func RequireAuthOrUserToken(handler JSONHandler) JSONHandler {
+	authTokenHandler := RequireAuthToken(handler)
+	userTokenHandler := RequireUserToken(handler)
+
+	return func(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+		if rt.Config.AuthToken == "" || fmt.Sprintf("Token %s", rt.Config.AuthToken) == r.Header.Get("authorization") {
+			return authTokenHandler(ctx, rt, r)
+		}
+		return userTokenHandler(ctx, rt, r)
+	}
+}
+
 // LoggingJSONHandler is a JSON web handler which logs HTTP logs
 type LoggingJSONHandler func(ctx context.Context, rt *runtime.Runtime, r *http.Request, l *models.HTTPLogger) (interface{}, int, error)
 
@@ -2,38 +2,70 @@ package mailroom
 
 import (
 	"context"
+	"os"
 	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/logx"
+	"github.com/nyaruka/mailroom/utils/scope"
+	"github.com/nyaruka/mailroom/utils/tracing"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var logger = logx.Module("foreman")
+
 // Foreman takes care of managing our set of workers and assigns msgs for each to send
 type Foreman struct {
 	rt               *runtime.Runtime
 	wg               *sync.WaitGroup
 	queue            string
+	minWorkers       int
+	maxWorkers       int
 	workers          []*Worker
 	availableWorkers chan *Worker
 	quit             chan bool
+	host             string
+	taskTimeouts     map[string]time.Duration
+
+	// protects workers, retiring and nextID as the pool is resized
+	mutex    sync.Mutex
+	retiring int
+	nextID   int
 }
 
-// NewForeman creates a new Foreman for the passed in server with the number of max workers
-func NewForeman(rt *runtime.Runtime, wg *sync.WaitGroup, queue string, maxWorkers int) *Foreman {
+// NewForeman creates a new Foreman for the passed in server which starts with min workers and, if max workers is greater
+// than that, will grow and shrink its pool between the two according to the desired worker count for its queue
+func NewForeman(rt *runtime.Runtime, wg *sync.WaitGroup, queue string, minWorkers int, maxWorkers int) *Foreman {
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+
+	host, _ := os.Hostname()
+
+	// config has already been validated so this can't fail
+	taskTimeouts, _ := rt.Config.ParseTaskTimeouts()
+
 	foreman := &Foreman{
 		rt:               rt,
 		wg:               wg,
 		queue:            queue,
-		workers:          make([]*Worker, maxWorkers),
+		minWorkers:       minWorkers,
+		maxWorkers:       maxWorkers,
+		workers:          make([]*Worker, minWorkers),
 		availableWorkers: make(chan *Worker, maxWorkers),
 		quit:             make(chan bool),
+		nextID:           minWorkers,
+		host:             host,
+		taskTimeouts:     taskTimeouts,
 	}
 
-	for i := 0; i < maxWorkers; i++ {
+	for i := 0; i < minWorkers; i++ {
 		foreman.workers[i] = NewWorker(foreman, i)
 	}
 
@@ -46,15 +78,110 @@ func (f *Foreman) Start() {
 		worker.Start()
 	}
 	go f.Assign()
+
+	if f.maxWorkers > f.minWorkers {
+		f.wg.Add(1)
+		go f.Scale()
+	}
 }
 
 // Stop stops the foreman and all its workers, the wait group of the worker can be used to track progress
 func (f *Foreman) Stop() {
+	f.mutex.Lock()
 	for _, worker := range f.workers {
 		worker.Stop()
 	}
+	f.workers = nil
+	f.mutex.Unlock()
+
 	close(f.quit)
-	logrus.WithField("comp", "foreman").WithField("state", "stopping").Info("foreman stopping")
+	logger.WithField("state", "stopping").Info("foreman stopping")
+}
+
+// Scale is our loop for resizing our pool of workers, every 30 seconds it reads the desired worker count for our queue
+// and grows or shrinks the pool towards that, within our min and max bounds. The caller must add it to our wait group.
+func (f *Foreman) Scale() {
+	defer f.wg.Done()
+	log := logger.WithField("queue", f.queue)
+
+	for {
+		select {
+		case <-f.quit:
+			return
+
+		case <-time.After(30 * time.Second):
+			rc := f.rt.RP.Get()
+			desired, err := queue.DesiredWorkers(rc, f.queue)
+			rc.Close()
+
+			if err != nil {
+				log.WithError(err).Error("error reading desired workers")
+				continue
+			}
+
+			if desired < f.minWorkers {
+				desired = f.minWorkers
+			} else if desired > f.maxWorkers {
+				desired = f.maxWorkers
+			}
+
+			if current := f.Resize(desired); current != desired {
+				log.WithField("workers", desired).WithField("previous", current).Info("resized worker pool")
+			}
+		}
+	}
+}
+
+// Resize grows or shrinks our pool to the passed in number of workers, returning the previous size. Workers are retired
+// as they next become available so that no task is interrupted.
+func (f *Foreman) Resize(size int) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	current := len(f.workers) - f.retiring
+
+	if size > current {
+		// cancel any pending retirements first
+		added := size - current
+		unretired := added
+		if unretired > f.retiring {
+			unretired = f.retiring
+		}
+		f.retiring -= unretired
+
+		for i := 0; i < added-unretired; i++ {
+			worker := NewWorker(f, f.nextID)
+			f.nextID++
+			f.workers = append(f.workers, worker)
+			worker.Start()
+		}
+	} else if size < current {
+		f.retiring += current - size
+	}
+
+	return current
+}
+
+// retire stops the passed in available worker if we have workers waiting to be retired
+func (f *Foreman) retire(worker *Worker) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.retiring == 0 {
+		return false
+	}
+
+	for i, w := range f.workers {
+		if w == worker {
+			f.workers = append(f.workers[:i], f.workers[i+1:]...)
+			f.retiring--
+			worker.Stop()
+			return true
+		}
+	}
+
+	// worker isn't in our pool because we've been stopped
+	return true
 }
 
 // Assign is our main loop for the Foreman, it takes care of popping the next outgoing task from our
@@ -62,11 +189,11 @@ func (f *Foreman) Stop() {
 func (f *Foreman) Assign() {
 	f.wg.Add(1)
 	defer f.wg.Done()
-	log := logrus.WithField("comp", "foreman")
+	log := logger
 
 	log.WithFields(logrus.Fields{
 		"state":   "started",
-		"workers": len(f.workers),
+		"workers": f.minWorkers,
 		"queue":   f.queue,
 	}).Info("workers started and waiting")
 
@@ -81,6 +208,11 @@ func (f *Foreman) Assign() {
 
 		// otherwise, grab the next task and assign it to a worker
 		case worker := <-f.availableWorkers:
+			// if our pool is shrinking, this worker may be done
+			if f.retire(worker) {
+				continue
+			}
+
 			// see if we have a task to work on
 			rc := f.rt.RP.Get()
 			task, err := queue.PopNextTask(rc, f.queue)
@@ -132,7 +264,7 @@ func (w *Worker) Start() {
 	go func() {
 		defer w.foreman.wg.Done()
 
-		log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id)
+		log := logger.WithField("queue", w.foreman.queue).WithField("worker_id", w.id)
 		log.Debug("started")
 
 		for {
@@ -159,14 +291,22 @@ func (w *Worker) Stop() {
 }
 
 func (w *Worker) handleTask(task *queue.Task) {
-	log := logrus.WithField("queue", w.foreman.queue).WithField("worker_id", w.id).WithField("task_type", task.Type).WithField("org_id", task.OrgID)
+	log := logger.WithField("queue", w.foreman.queue).WithField("worker_id", w.id).WithField("task_type", task.Type).WithField("org_id", task.OrgID)
+
+	// anything reported as an error while handling this task will include the task's context
+	ctx := scope.New(context.Background(), logrus.Fields{"queue": w.foreman.queue, "task_type": task.Type, "org_id": task.OrgID})
+
+	// and continues the trace of whatever queued it
+	ctx, span := tracing.Start(tracing.Extract(ctx, task.Trace), "task "+task.Type,
+		attribute.String("queue", w.foreman.queue), attribute.Int("org_id", task.OrgID))
+	defer span.End()
 
 	defer func() {
 		// catch any panics and recover
 		panicLog := recover()
 		if panicLog != nil {
 			debug.PrintStack()
-			log.WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).Errorf("panic handling task: %s", panicLog)
+			scope.Log(ctx).WithField("task", string(task.Task)).Errorf("panic handling task: %s", panicLog)
 		}
 
 		// mark our task as complete
@@ -175,21 +315,67 @@ func (w *Worker) handleTask(task *queue.Task) {
 		if err != nil {
 			log.WithError(err)
 		}
+
+		// and count it toward our org's activity so we know which orgs to warm caches for
+		err = queue.RecordActivity(rc, task.OrgID, time.Now())
+		if err != nil {
+			log.WithError(err).Error("error recording org activity")
+		}
 		rc.Close()
 	}()
 
-	log.Info("starting handling of task")
+	logx.Sampled(log).Info("starting handling of task")
 	start := time.Now()
 
+	// record that we're executing this task so that it can be seen by queue introspection
+	rc := w.foreman.rt.RP.Get()
+	token, err := queue.StartExecuting(rc, w.foreman.queue, task, w.foreman.host, start)
+	rc.Close()
+	if err != nil {
+		log.WithError(err).Error("error recording executing task")
+	} else {
+		defer func() {
+			rc := w.foreman.rt.RP.Get()
+			if err := queue.StopExecuting(rc, w.foreman.queue, task.OrgID, token); err != nil {
+				log.WithError(err).Error("error removing executing task")
+			}
+			rc.Close()
+		}()
+	}
+
 	taskFunc, found := taskFunctions[task.Type]
 	if found {
-		err := taskFunc(context.Background(), w.foreman.rt, task)
-		if err != nil {
-			log.WithError(err).WithField("task", string(task.Task)).WithField("task_type", task.Type).WithField("org_id", task.OrgID).Error("error running task")
+		// tasks are cancelled if they run longer than the maximum configured for their type, as well as their own
+		if timeout, hasTimeout := w.foreman.taskTimeouts[task.Type]; hasTimeout {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		err := taskFunc(ctx, w.foreman.rt, task)
+		if errors.Cause(err) == queue.ErrNewerVersion {
+			rc := w.foreman.rt.RP.Get()
+			requeued, rerr := queue.RequeueTask(rc, w.foreman.queue, task, time.Now())
+			rc.Close()
+
+			log := log.WithError(err).WithField("requeues", task.Requeues)
+			if rerr != nil {
+				log.WithError(rerr).Error("error requeuing task")
+			} else if requeued {
+				log.Info("requeued task queued by a newer version")
+			} else {
+				log.WithField("first_requeued_on", task.FirstRequeuedOn).Error("task queued by a newer version has been requeued for too long, moved to dead tasks")
+			}
+		} else if errors.Cause(err) == context.DeadlineExceeded {
+			scope.Log(ctx).WithError(err).WithField("task", string(task.Task)).WithField("elapsed", time.Since(start)).Error("task timed out")
+			tracing.RecordError(span, err)
+		} else if err != nil {
+			scope.Log(ctx).WithError(err).WithField("task", string(task.Task)).Error("error running task")
+			tracing.RecordError(span, err)
 		}
 	} else {
 		log.Error("unable to find function for task type")
 	}
 
-	log.WithField("elapsed", time.Since(start)).Info("task complete")
+	logx.Sampled(log).WithField("elapsed", time.Since(start)).Info("task complete")
 }